@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// adminToken is the bearer token for the /api/admin endpoints (ADMIN_TOKEN);
+// they are disabled when it is unset
+var adminToken string
+
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.Error(w, "Admin API disabled", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+adminToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminStatsHandler reports job counts and storage housekeeping
+func adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	jobsMutex.RLock()
+	byStatus := make(map[string]int)
+	for _, job := range jobs {
+		byStatus[job.Status]++
+	}
+	total := len(jobs)
+	variants := canaryStats()
+	energy := energySnapshot()
+	jobsMutex.RUnlock()
+
+	partialUploadsMutex.Lock()
+	partials := len(partialUploads)
+	partialUploadsMutex.Unlock()
+
+	queued, running := processingQueue.stats()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"jobs":            map[string]interface{}{"total": total, "by_status": byStatus},
+		"queue":           map[string]int{"queued": queued, "running": running, "workers": maxConcurrentJobs()},
+		"variants":        variants,
+		"partial_uploads": partials,
+		"orphan_gc":       orphanGCSnapshot(),
+		"reconciliation":  reconcileSnapshot(),
+		"self_test":       selfTestSnapshot(),
+		"energy":          energy,
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /api/admin/events streams every job lifecycle event, across all users
+// and API keys, as server-sent events, for watching the whole system live
+// during incidents. Query parameters narrow the stream:
+//
+//	status     comma-separated job statuses (the job's status after the event)
+//	type       comma-separated event types (job.failed, ...)
+//	processor  processor URL the job was sent to, or the instance it ran on
+//
+// Each message is named after the event type, carries the event ID and has
+// the event as data, as webhooks receive it. Jobs are only matched to a
+// processor once they were sent to one. A client too slow to keep up misses
+// events rather than holding up the jobs; the stream then sends a "dropped"
+// message with how many.
+
+// adminStreamBuffer is how many events a slow subscriber may fall behind
+const adminStreamBuffer = 64
+
+// adminEventFilter is the parsed query of an admin event stream
+type adminEventFilter struct {
+	Statuses  map[string]bool
+	Types     map[string]bool
+	Processor string
+}
+
+// adminSubscriber is one connected admin stream
+type adminSubscriber struct {
+	filter  adminEventFilter
+	events  chan Event
+	dropped int
+}
+
+var (
+	adminSubscribers      = make(map[*adminSubscriber]struct{})
+	adminSubscribersMutex = &sync.Mutex{}
+)
+
+// parseAdminEventFilter reads the stream's query parameters
+func parseAdminEventFilter(r *http.Request) (adminEventFilter, error) {
+	q := r.URL.Query()
+	f := adminEventFilter{Processor: strings.TrimSuffix(q.Get("processor"), "/")}
+	for _, p := range []struct {
+		name    string
+		allowed map[string]bool
+		set     *map[string]bool
+	}{
+		{"status", allowedJobStatuses, &f.Statuses},
+		{"type", eventTypes, &f.Types},
+	} {
+		raw := q.Get(p.name)
+		if raw == "" {
+			continue
+		}
+		*p.set = make(map[string]bool)
+		for _, v := range strings.Split(raw, ",") {
+			v = strings.TrimSpace(v)
+			if !p.allowed[v] {
+				return f, invalidOption(p.name, sortedKeys(p.allowed))
+			}
+			(*p.set)[v] = true
+		}
+	}
+	return f, nil
+}
+
+// matches reports whether an event passes the filter
+func (f adminEventFilter) matches(e Event) bool {
+	if f.Statuses != nil && !f.Statuses[e.Job.Status] {
+		return false
+	}
+	if f.Types != nil && !f.Types[e.Type] {
+		return false
+	}
+	if f.Processor != "" {
+		instance := ""
+		if e.Job.Environment != nil {
+			instance = e.Job.Environment.Instance
+		}
+		if e.Job.processorURL != f.Processor && instance != f.Processor {
+			return false
+		}
+	}
+	return true
+}
+
+// publishAdminEvent hands an event to the matching admin streams; main
+// registers it as an event listener
+func publishAdminEvent(e Event) {
+	adminSubscribersMutex.Lock()
+	defer adminSubscribersMutex.Unlock()
+	for s := range adminSubscribers {
+		if !s.filter.matches(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+// takeDropped returns and resets the events a subscriber missed
+func (s *adminSubscriber) takeDropped() int {
+	adminSubscribersMutex.Lock()
+	defer adminSubscribersMutex.Unlock()
+	n := s.dropped
+	s.dropped = 0
+	return n
+}
+
+func adminEventsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAdminEventFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := &adminSubscriber{filter: filter, events: make(chan Event, adminStreamBuffer)}
+	adminSubscribersMutex.Lock()
+	adminSubscribers[sub] = struct{}{}
+	adminSubscribersMutex.Unlock()
+	defer func() {
+		adminSubscribersMutex.Lock()
+		delete(adminSubscribers, sub)
+		adminSubscribersMutex.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // stop nginx buffering the stream
+	w.WriteHeader(http.StatusOK)
+	// Let the client know it is connected before the first event
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case e := <-sub.events:
+			if n := sub.takeDropped(); n > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"count\":%d}\n\n", n)
+			}
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "event: %s\nid: %s\ndata: %s\n\n", e.Type, e.ID, data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAdminEventFilter(t *testing.T) {
+	f, err := parseAdminEventFilter(httptest.NewRequest("GET", "/api/admin/events?status=failed,completed&type=job.failed&processor=http://gpu:5000/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Statuses["failed"] || !f.Statuses["completed"] || !f.Types[EventJobFailed] || f.Processor != "http://gpu:5000" {
+		t.Errorf("filter = %+v", f)
+	}
+	for _, q := range []string{"status=done", "type=job.started"} {
+		if _, err := parseAdminEventFilter(httptest.NewRequest("GET", "/api/admin/events?"+q, nil)); err == nil {
+			t.Errorf("%s accepted", q)
+		}
+	}
+
+	gpu := Event{Type: EventJobFailed, Job: Job{Status: "failed", processorURL: "http://gpu:5000"}}
+	worker := Event{Type: EventJobCompleted, Job: Job{Status: "completed", Environment: &ProcessingEnv{Instance: "worker-7"}}}
+	queued := Event{Type: EventJobCreated, Job: Job{Status: "queued"}}
+	for _, tc := range []struct {
+		filter adminEventFilter
+		event  Event
+		want   bool
+	}{
+		{adminEventFilter{}, queued, true},
+		{f, gpu, true},
+		{f, worker, false},
+		{f, queued, false},
+		{adminEventFilter{Processor: "worker-7"}, worker, true},
+		{adminEventFilter{Statuses: map[string]bool{"queued": true}}, gpu, false},
+	} {
+		if got := tc.filter.matches(tc.event); got != tc.want {
+			t.Errorf("%+v matches %s %s = %v", tc.filter, tc.event.Type, tc.event.Job.Status, got)
+		}
+	}
+}
+
+func TestAdminEventsStream(t *testing.T) {
+	oldToken := adminToken
+	adminToken = "secret"
+	t.Cleanup(func() { adminToken = oldToken })
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	get := func(query, auth string) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+"/api/admin/events"+query, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := get("", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong token = %d", resp.StatusCode)
+	}
+	if resp := get("?status=bogus", "secret"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad filter = %d", resp.StatusCode)
+	}
+
+	resp := get("?status=failed", "secret")
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	reader := bufio.NewReader(resp.Body)
+	if line, _ := reader.ReadString('\n'); line != ": connected\n" {
+		t.Fatalf("first line = %q", line)
+	}
+
+	publishAdminEvent(Event{ID: "e1", Type: EventJobCompleted, Job: Job{ID: "a", Status: "completed"}})
+	publishAdminEvent(Event{ID: "e2", Type: EventJobFailed, CreatedAt: time.Now(), Job: Job{ID: "b", Status: "failed", Error: "boom"}})
+
+	var name, id string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			var e Event
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e)
+			if name != EventJobFailed || id != "e2" || e.Job.ID != "b" || e.Job.Error != "boom" {
+				t.Errorf("event %s %s = %+v, want only the failed job", name, id, e)
+			}
+			return
+		}
+	}
+}
+
+func TestAdminEventsDropped(t *testing.T) {
+	sub := &adminSubscriber{events: make(chan Event, 1)}
+	adminSubscribersMutex.Lock()
+	adminSubscribers[sub] = struct{}{}
+	adminSubscribersMutex.Unlock()
+	t.Cleanup(func() {
+		adminSubscribersMutex.Lock()
+		delete(adminSubscribers, sub)
+		adminSubscribersMutex.Unlock()
+	})
+	for i := 0; i < 4; i++ {
+		publishAdminEvent(Event{Type: EventJobCreated})
+	}
+	if n := sub.takeDropped(); n != 3 {
+		t.Errorf("dropped = %d, want 3", n)
+	}
+	if n := sub.takeDropped(); n != 0 {
+		t.Errorf("dropped after reading = %d, want 0", n)
+	}
+}
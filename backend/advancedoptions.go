@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Advanced options. advanced_options=jobs=4,float32 passes Demucs flags
+// that have no option of their own through to the processor, as
+// comma-separated name=value pairs (a bare name turns a flag on). Only the
+// options in advancedOptionSchema are accepted, each checked against its
+// range and the output formats it applies to; ADVANCED_OPTIONS narrows
+// them to a comma-separated list, and ADVANCED_OPTIONS=none turns the
+// field off. The processor maps each option to its Demucs flag itself.
+
+// advancedOption describes an option advanced_options accepts
+type advancedOption struct {
+	Flag     bool // on or off; otherwise an integer from Min to Max
+	Min, Max int
+	Formats  []string // output formats it applies to; empty: every format
+}
+
+var advancedOptionSchema = map[string]advancedOption{
+	"jobs":       {Min: 1, Max: 8},                               // -j, parallel jobs (more memory)
+	"float32":    {Flag: true, Formats: []string{"wav"}},         // --float32 WAV stems
+	"int24":      {Flag: true, Formats: []string{"wav", "flac"}}, // --int24 WAV (and FLAC) stems
+	"mp3_preset": {Min: 2, Max: 7, Formats: []string{"mp3"}},     // --mp3-preset, 2 best to 7 fastest
+}
+
+// enabledAdvancedOptions returns the advanced options this instance offers
+func enabledAdvancedOptions() []string {
+	raw := os.Getenv("ADVANCED_OPTIONS")
+	if raw == "" {
+		return sortedKeys(advancedOptionSchema)
+	}
+	var names []string
+	for _, name := range strings.Split(raw, ",") {
+		if _, known := advancedOptionSchema[strings.TrimSpace(name)]; known {
+			names = append(names, strings.TrimSpace(name))
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// parseAdvancedOptions reads an advanced_options value for a job writing
+// outputFormat
+func parseAdvancedOptions(raw, outputFormat string) (map[string]string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	enabled := enabledAdvancedOptions()
+	if len(enabled) == 0 {
+		return nil, fmt.Errorf("advanced_options are turned off on this instance")
+	}
+	opts := make(map[string]string)
+	for _, entry := range strings.Split(raw, ",") {
+		name, value, hasValue := strings.Cut(strings.TrimSpace(entry), "=")
+		schema := advancedOptionSchema[name]
+		if !slices.Contains(enabled, name) {
+			return nil, invalidOption("advanced_options", enabled)
+		}
+		if _, repeated := opts[name]; repeated {
+			return nil, fmt.Errorf("advanced_options repeats %s", name)
+		}
+		if schema.Flag {
+			if !hasValue {
+				value = "true"
+			}
+			if value != "true" && value != "false" {
+				return nil, fmt.Errorf("Invalid advanced_options %s value (allowed: true, false)", name)
+			}
+			if value == "false" {
+				continue
+			}
+		} else if n, err := strconv.Atoi(value); err != nil || n < schema.Min || n > schema.Max {
+			return nil, fmt.Errorf("Invalid advanced_options %s value (allowed: %d to %d)", name, schema.Min, schema.Max)
+		}
+		if len(schema.Formats) > 0 && !slices.Contains(schema.Formats, outputFormat) {
+			return nil, fmt.Errorf("advanced_options %s only applies to output_format %s", name, strings.Join(schema.Formats, " or "))
+		}
+		opts[name] = value
+	}
+	if opts["float32"] != "" && opts["int24"] != "" {
+		return nil, fmt.Errorf("advanced_options float32 and int24 can't be combined")
+	}
+	if len(opts) == 0 {
+		return nil, nil
+	}
+	return opts, nil
+}
+
+// formatAdvancedOptions writes advanced options the way they are parsed,
+// sorted by name
+func formatAdvancedOptions(opts map[string]string) string {
+	var entries []string
+	for _, name := range slices.Sorted(maps.Keys(opts)) {
+		entries = append(entries, name+"="+opts[name])
+	}
+	return strings.Join(entries, ",")
+}
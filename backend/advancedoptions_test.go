@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAdvancedOptions(t *testing.T) {
+	opts, err := parseAdvancedOptions(" jobs=4, int24 ,float32=false", "flac")
+	if err != nil || len(opts) != 2 || opts["jobs"] != "4" || opts["int24"] != "true" {
+		t.Fatalf("parseAdvancedOptions = %v, %v", opts, err)
+	}
+	if got := formatAdvancedOptions(opts); got != "int24=true,jobs=4" {
+		t.Errorf("formatted = %q", got)
+	}
+	if opts, err := parseAdvancedOptions("float32=false", "wav"); opts != nil || err != nil {
+		t.Errorf("only flags turned off = %v, %v", opts, err)
+	}
+
+	for _, c := range []struct{ value, format, want string }{
+		{"device=cuda", "mp3", "Invalid advanced_options value"},
+		{"jobs=2,--device=cpu", "mp3", "Invalid advanced_options value"},
+		{"jobs=9", "mp3", "jobs value (allowed: 1 to 8)"},
+		{"jobs", "mp3", "jobs value"},
+		{"float32=yes", "wav", "float32 value"},
+		{"float32", "flac", "only applies to output_format wav"},
+		{"mp3_preset=2", "wav", "only applies to output_format mp3"},
+		{"jobs=2,jobs=3", "mp3", "repeats jobs"},
+		{"float32,int24=true", "wav", "can't be combined"},
+	} {
+		if _, err := parseAdvancedOptions(c.value, c.format); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("parseAdvancedOptions(%q, %s) = %v, want %q", c.value, c.format, err, c.want)
+		}
+	}
+
+	t.Setenv("ADVANCED_OPTIONS", "jobs, nope")
+	if _, err := parseAdvancedOptions("mp3_preset=2", "mp3"); err == nil || !strings.Contains(err.Error(), "(allowed: jobs)") {
+		t.Errorf("option left out of ADVANCED_OPTIONS: %v", err)
+	}
+	t.Setenv("ADVANCED_OPTIONS", "none")
+	if _, err := parseAdvancedOptions("jobs=2", "mp3"); err == nil || !strings.Contains(err.Error(), "turned off") {
+		t.Errorf("ADVANCED_OPTIONS=none: %v", err)
+	}
+}
+
+func TestIntegrationAdvancedOptions(t *testing.T) {
+	b := newIntegrationBackend(t, 1)
+
+	job := b.waitFor(b.upload("song.mp3", map[string]string{"output_format": "wav", "advanced_options": "jobs=2,int24"}).ID, "completed")
+	if job.AdvancedOptions["jobs"] != "2" || job.Effective == nil || job.Effective.Advanced["int24"] != "true" {
+		t.Errorf("job = %+v, effective %+v", job.AdvancedOptions, job.Effective)
+	}
+	if requests := b.processor.Requests(); len(requests) != 1 || requests[0]["advanced_options"] != "int24=true,jobs=2" {
+		t.Errorf("processor requests = %+v", requests)
+	}
+}
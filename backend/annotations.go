@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Annotation is a review comment anchored to a point in time on one stem
+// of a job, e.g. "bleed at 1:23 in vocals".
+type Annotation struct {
+	ID        string    `json:"id"`
+	JobID     string    `json:"job_id"`
+	Stem      string    `json:"stem"`
+	At        float64   `json:"at"`        // seconds from the start
+	Timestamp string    `json:"timestamp"` // At formatted as m:ss
+	Text      string    `json:"text"`
+	Author    string    `json:"author,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	maxAnnotationText     = 2000
+	maxAnnotationAuthor   = 100
+	maxAnnotationsPerJob  = 500
+	maxAnnotationTimeSecs = 24 * 60 * 60
+)
+
+var (
+	annotations      = make(map[string][]*Annotation) // keyed by job ID
+	annotationsMutex = &sync.RWMutex{}
+)
+
+// annotationRequest is the JSON body of POST /api/jobs/{id}/annotations.
+// "at" accepts seconds (83.5) or a clock string ("1:23", "1:02:03").
+type annotationRequest struct {
+	Stem   string          `json:"stem"`
+	At     json.RawMessage `json:"at"`
+	Text   string          `json:"text"`
+	Author string          `json:"author"`
+}
+
+// parseTimestamp converts seconds or an [h:]mm:ss[.fff] clock string to seconds
+func parseTimestamp(raw json.RawMessage) (float64, error) {
+	var seconds float64
+	if err := json.Unmarshal(raw, &seconds); err == nil {
+		return seconds, nil
+	}
+	var clock string
+	if err := json.Unmarshal(raw, &clock); err != nil {
+		return 0, fmt.Errorf("invalid timestamp")
+	}
+	parts := strings.Split(clock, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp")
+	}
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || v < 0 || (i > 0 && v >= 60) {
+			return 0, fmt.Errorf("invalid timestamp")
+		}
+		seconds = seconds*60 + v
+	}
+	return seconds, nil
+}
+
+// formatTimestamp renders seconds as m:ss (or h:mm:ss past an hour)
+func formatTimestamp(seconds float64) string {
+	total := int(seconds)
+	h, m, s := total/3600, (total%3600)/60, total%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
+
+// annotatableJob checks that the job exists and returns its stem names
+func annotatableJob(w http.ResponseWriter, jobID string) (map[string]string, bool) {
+	if !isValidJobID(jobID) {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return nil, false
+	}
+	jobsMutex.RLock()
+	job, exists := jobs[jobID]
+	var outputs map[string]string
+	if exists {
+		outputs = job.snapshot().OutputFiles
+	}
+	jobsMutex.RUnlock()
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return nil, false
+	}
+	return outputs, true
+}
+
+func createAnnotationHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+	outputs, ok := annotatableJob(w, jobID)
+	if !ok {
+		return
+	}
+
+	var req annotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid annotation", http.StatusBadRequest)
+		return
+	}
+	req.Text = strings.TrimSpace(req.Text)
+	if req.Text == "" || utf8.RuneCountInString(req.Text) > maxAnnotationText {
+		http.Error(w, "Invalid text value", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(req.Author) > maxAnnotationAuthor {
+		http.Error(w, "Invalid author value", http.StatusBadRequest)
+		return
+	}
+	if _, exists := outputs[req.Stem]; !exists && !allowedStems[req.Stem] {
+		http.Error(w, "Invalid stem value", http.StatusBadRequest)
+		return
+	}
+	at, err := parseTimestamp(req.At)
+	if err != nil || at < 0 || at > maxAnnotationTimeSecs {
+		http.Error(w, "Invalid at value", http.StatusBadRequest)
+		return
+	}
+
+	a := &Annotation{
+		ID:        uuid.New().String(),
+		JobID:     jobID,
+		Stem:      req.Stem,
+		At:        at,
+		Timestamp: formatTimestamp(at),
+		Text:      req.Text,
+		Author:    strings.TrimSpace(req.Author),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	annotationsMutex.Lock()
+	if len(annotations[jobID]) >= maxAnnotationsPerJob {
+		annotationsMutex.Unlock()
+		http.Error(w, "Too many annotations on this job", http.StatusConflict)
+		return
+	}
+	annotations[jobID] = append(annotations[jobID], a)
+	annotationsMutex.Unlock()
+
+	writeJSON(w, http.StatusCreated, a)
+}
+
+// listAnnotationsHandler returns a job's annotations ordered by time,
+// optionally filtered with ?stem=
+func listAnnotationsHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+	if _, ok := annotatableJob(w, jobID); !ok {
+		return
+	}
+	stem := r.URL.Query().Get("stem")
+
+	annotationsMutex.RLock()
+	list := make([]Annotation, 0, len(annotations[jobID]))
+	for _, a := range annotations[jobID] {
+		if stem == "" || a.Stem == stem {
+			list = append(list, *a)
+		}
+	}
+	annotationsMutex.RUnlock()
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].At < list[j].At })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func deleteAnnotationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobID := vars["id"]
+	if _, ok := annotatableJob(w, jobID); !ok {
+		return
+	}
+
+	annotationsMutex.Lock()
+	list := annotations[jobID]
+	found := false
+	for i, a := range list {
+		if a.ID == vars["annotation"] {
+			annotations[jobID] = append(list[:i], list[i+1:]...)
+			found = true
+			break
+		}
+	}
+	annotationsMutex.Unlock()
+
+	if !found {
+		http.Error(w, "Annotation not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+// deleteAnnotations drops every annotation of a deleted job
+func deleteAnnotations(jobID string) {
+	annotationsMutex.Lock()
+	delete(annotations, jobID)
+	annotationsMutex.Unlock()
+}
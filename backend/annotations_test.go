@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want float64
+	}{
+		{`83.5`, 83.5},
+		{`"1:23"`, 83},
+		{`"1:02:03"`, 3723},
+		{`"0:07.25"`, 7.25},
+	}
+	for _, tc := range tests {
+		got, err := parseTimestamp(json.RawMessage(tc.raw))
+		if err != nil || got != tc.want {
+			t.Errorf("parseTimestamp(%s) = %v, %v; want %v", tc.raw, got, err, tc.want)
+		}
+	}
+
+	for _, raw := range []string{`"1:75"`, `"a:b"`, `"1:2:3:4"`, `true`, ``} {
+		if _, err := parseTimestamp(json.RawMessage(raw)); err == nil {
+			t.Errorf("expected %q to be rejected", raw)
+		}
+	}
+
+	if got := formatTimestamp(3723); got != "1:02:03" {
+		t.Errorf("formatTimestamp(3723) = %q", got)
+	}
+	if got := formatTimestamp(83.9); got != "1:23" {
+		t.Errorf("formatTimestamp(83.9) = %q", got)
+	}
+}
+
+func TestAnnotationLifecycle(t *testing.T) {
+	jobsMutex.Lock()
+	jobs["annotated-job"] = &Job{ID: "annotated-job", Status: "completed", CreatedAt: time.Now()}
+	jobsMutex.Unlock()
+	defer func() {
+		jobsMutex.Lock()
+		delete(jobs, "annotated-job")
+		jobsMutex.Unlock()
+		deleteAnnotations("annotated-job")
+	}()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/jobs/{id}/annotations", createAnnotationHandler).Methods("POST")
+	router.HandleFunc("/api/jobs/{id}/annotations", listAnnotationsHandler).Methods("GET")
+
+	for _, body := range []string{
+		`{"stem": "vocals", "at": "1:23", "text": "bleed here"}`,
+		`{"stem": "drums", "at": 12, "text": "nice fill"}`,
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", "/api/jobs/annotated-job/annotations", strings.NewReader(body)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("create: got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", "/api/jobs/annotated-job/annotations", strings.NewReader(`{"stem": "kazoo", "at": 1, "text": "x"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown stem: got %d, want 400", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/jobs/annotated-job/annotations", nil))
+	var list []Annotation
+	json.NewDecoder(rec.Body).Decode(&list)
+	if len(list) != 2 || list[0].Stem != "drums" || list[1].Timestamp != "1:23" {
+		t.Errorf("expected annotations ordered by time, got %+v", list)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/jobs/annotated-job/annotations?stem=vocals", nil))
+	list = nil
+	json.NewDecoder(rec.Body).Decode(&list)
+	if len(list) != 1 || list[0].Stem != "vocals" {
+		t.Errorf("stem filter: got %+v", list)
+	}
+}
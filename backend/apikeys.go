@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// With API_KEYS_REQUIRED=true every API request must present a key, sent as
+// X-API-Key, as "Authorization: Bearer t2s_..." or, for links the browser
+// opens itself (downloads, EventSource), as the api_key query parameter.
+// Admins manage keys through /api/keys. Each key has a per-minute request
+// limit and a monthly quota of processing minutes, counted from the moment
+// a job starts processing until it finishes; uploads are refused once the
+// quota is used up. A key can also be given a tier (see tiers.go) and
+// limits of its own (see overrides.go). Keys only see and download their
+// own jobs, those of their organizations (see orgs.go) and those shared
+// with them (see invitations.go).
+//
+// Keys are stored hashed in API_KEYS_FILE (default .api-keys.json in the
+// upload directory) together with their usage, so they survive restarts.
+
+const apiKeyPrefix = "t2s_"
+
+// APIKey is a client credential with its limits and usage
+type APIKey struct {
+	ID             string             `json:"id"`
+	Name           string             `json:"name"`
+	Hint           string             `json:"hint"`                // start of the key, to recognise it
+	RateLimit      int                `json:"rate_limit"`          // requests per minute, 0 for unlimited
+	MonthlyMinutes float64            `json:"monthly_minutes"`     // processing minutes per month, 0 for unlimited
+	Tier           string             `json:"tier,omitempty"`      // TIERS tier; TIER_DEFAULT when empty
+	Overrides      *KeyOverrides      `json:"overrides,omitempty"` // see overrides.go
+	CreatedAt      time.Time          `json:"created_at"`
+	Usage          map[string]float64 `json:"usage"` // processing minutes by month (2006-01)
+	Hash           string             `json:"hash"`  // SHA-256 of the key; never returned by the API
+}
+
+// apiKeyView is a key as returned by the API
+type apiKeyView struct {
+	ID             string        `json:"id"`
+	Name           string        `json:"name"`
+	Hint           string        `json:"hint"`
+	RateLimit      int           `json:"rate_limit"`
+	MonthlyMinutes float64       `json:"monthly_minutes"`
+	Tier           string        `json:"tier,omitempty"`
+	Overrides      *KeyOverrides `json:"overrides,omitempty"`
+	CreatedAt      time.Time     `json:"created_at"`
+	Month          string        `json:"month"`
+	MinutesUsed    float64       `json:"minutes_used"`
+	Key            string        `json:"key,omitempty"` // only when the key is created
+}
+
+// apiKeyWindow counts a key's requests in the current minute
+type apiKeyWindow struct {
+	start time.Time
+	count int
+}
+
+var (
+	apiKeys      = make(map[string]*APIKey) // by ID
+	apiKeysMutex = &sync.Mutex{}
+
+	apiKeyWindows = make(map[string]*apiKeyWindow)
+	// apiKeyJobStarts holds when each keyed job started processing
+	apiKeyJobStarts = make(map[string]time.Time)
+)
+
+type apiKeyContextKey struct{}
+
+// apiKeysRequired reports whether requests need an API key (API_KEYS_REQUIRED=true)
+func apiKeysRequired() bool {
+	return os.Getenv("API_KEYS_REQUIRED") == "true"
+}
+
+func init() { keepInUploads(apiKeysFile) }
+
+func apiKeysFile() string {
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		return path
+	}
+	return filepath.Join(uploadDir, ".api-keys.json")
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func usageMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// loadAPIKeys restores the keys saved by saveAPIKeys
+func loadAPIKeys() {
+	data, err := os.ReadFile(apiKeysFile())
+	if err != nil {
+		return
+	}
+	var list []*APIKey
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Failed to load API keys: %v", err)
+		return
+	}
+	apiKeysMutex.Lock()
+	for _, k := range list {
+		apiKeys[k.ID] = k
+	}
+	apiKeysMutex.Unlock()
+	log.Printf("Loaded %d API keys", len(list))
+}
+
+// saveAPIKeys writes every key to the keys file. Callers hold apiKeysMutex.
+func saveAPIKeys() {
+	list := make([]*APIKey, 0, len(apiKeys))
+	for _, id := range sortedKeys(apiKeys) {
+		list = append(list, apiKeys[id])
+	}
+	data, _ := json.MarshalIndent(list, "", "  ")
+	tmp := apiKeysFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Failed to save API keys: %v", err)
+		return
+	}
+	os.Rename(tmp, apiKeysFile())
+}
+
+// viewAPIKey describes a key for the API. Callers hold apiKeysMutex.
+func viewAPIKey(k *APIKey) apiKeyView {
+	month := usageMonth(time.Now())
+	return apiKeyView{
+		ID: k.ID, Name: k.Name, Hint: k.Hint, RateLimit: k.RateLimit, MonthlyMinutes: k.MonthlyMinutes, Tier: k.Tier,
+		Overrides: k.Overrides, CreatedAt: k.CreatedAt, Month: month, MinutesUsed: k.Usage[month],
+	}
+}
+
+// requestAPIKey reads the key a request presents
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && strings.HasPrefix(bearer, apiKeyPrefix) {
+		return bearer
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// lookupAPIKey returns a copy of the key with the given secret
+func lookupAPIKey(secret string) (APIKey, bool) {
+	hash := hashAPIKey(secret)
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	for _, k := range apiKeys {
+		if k.Hash == hash {
+			return *k, true
+		}
+	}
+	return APIKey{}, false
+}
+
+// allowAPIKeyRequest counts a request against the key's per-minute limit
+func allowAPIKeyRequest(k APIKey, now time.Time) bool {
+	if k.RateLimit <= 0 {
+		return true
+	}
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	win := apiKeyWindows[k.ID]
+	if win == nil || now.Sub(win.start) >= time.Minute {
+		win = &apiKeyWindow{start: now}
+		apiKeyWindows[k.ID] = win
+	}
+	if win.count >= k.RateLimit {
+		return false
+	}
+	win.count++
+	return true
+}
+
+// apiKeyExempt lists routes that don't take API keys: health checks, the
+// terms, branding and changelog the UI needs first, the event schemas, routes with
+// their own tokens and the OAuth callback the storage provider redirects to
+var apiKeyExempt = map[string]bool{
+	"/api/health":                          true,
+	"/api/ready":                           true,
+	"/metrics":                             true,
+	"/api/branding":                        true,
+	"/api/changelog":                       true,
+	"/api/schemas/events":                  true,
+	"/api/terms":                           true,
+	"/api/terms/accept":                    true,
+	"/api/oembed":                          true,
+	"/api/stream/{token}":                  true,
+	"/api/guest/{token}":                   true,
+	"/api/guest/{token}/upload":            true,
+	"/api/storage/{provider}/callback":     true,
+	"/api/keys":                            true,
+	"/api/keys/{id}":                       true,
+	"/embed/{token}":                       true,
+	"/embed/{token}/preview/{stem}":        true,
+	"/api/public/jobs":                     true,
+	"/api/public/jobs/{id}":                true,
+	"/api/public/jobs/{id}/preview/{stem}": true,
+}
+
+// apiKeyExemptPrefixes are route families with their own authentication
+var apiKeyExemptPrefixes = []string{"/api/admin/", "/api/worker/"}
+
+func isAPIKeyExempt(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return true
+	}
+	tpl, err := route.GetPathTemplate()
+	if err != nil {
+		return false
+	}
+	if apiKeyExempt[tpl] {
+		return true
+	}
+	for _, prefix := range apiKeyExemptPrefixes {
+		if strings.HasPrefix(tpl, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyMiddleware authenticates requests with an API key and applies its
+// rate limit when keys are required
+func apiKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !apiKeysRequired() || r.Method == "OPTIONS" || isAPIKeyExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Signed download URLs are their own credential
+		if isSignedDownload(r) {
+			if !validDownloadSignature(r, time.Now()) {
+				http.Error(w, "Download URL expired or invalid", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		secret := requestAPIKey(r)
+		if secret == "" {
+			http.Error(w, "API key required", http.StatusUnauthorized)
+			return
+		}
+		k, ok := lookupAPIKey(secret)
+		if !ok {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if !allowAPIKeyRequest(k, time.Now()) {
+			writeRejection(w, http.StatusTooManyRequests, "rate_limited", "Rate limit exceeded", retryRemedy(60, "Retry after 60s"))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, k.ID)))
+	})
+}
+
+// apiKeyID returns the ID of the key that authenticated the request, or ""
+func apiKeyID(ctx context.Context) string {
+	id, _ := ctx.Value(apiKeyContextKey{}).(string)
+	return id
+}
+
+// canAccessJob reports whether the request may see a job: keys only see
+// their own, their organizations' (see orgs.go) and those they accepted an
+// invitation to (see invitations.go)
+func canAccessJob(r *http.Request, job *Job) bool {
+	return ownedByRequest(r, job.APIKeyID) || orgRole(r.Context(), job.OrgID) != "" || sharePermission(r.Context(), job.ID) != ""
+}
+
+// canChangeJob reports whether the request may change a job it can see:
+// organization viewers and invitees only read, and remix invitees mix
+func canChangeJob(r *http.Request, job *Job) bool {
+	role := orgRole(r.Context(), job.OrgID)
+	return ownedByRequest(r, job.APIKeyID) || role == orgOwner || role == orgMember || canRemixJob(r, job)
+}
+
+// ownedByRequest reports whether the request may see something created by
+// the given key: requests without a key see everything
+func ownedByRequest(r *http.Request, owner string) bool {
+	id := apiKeyID(r.Context())
+	return id == "" || owner == id
+}
+
+// jobRoutePrefixes are the route templates addressing one job by its {id}
+var jobRoutePrefixes = []string{"/api/jobs/{id}", "/api/download/{id}", "/api/processing-status/{id}"}
+
+// jobAccessMiddleware answers 404 for a job of another key on every job
+// route, and 403 for anything but reads of a job the key may only see, so
+// no handler can forget the check. Jobs that don't exist are left to the
+// handler.
+func jobAccessMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiKeyID(r.Context()) != "" && isJobRoute(r) {
+			jobsMutex.RLock()
+			job, exists := jobs[mux.Vars(r)["id"]]
+			allowed := !exists || canAccessJob(r, job)
+			readOnly := exists && allowed && !canChangeJob(r, job)
+			jobsMutex.RUnlock()
+			if !allowed {
+				http.Error(w, "Job not found", http.StatusNotFound)
+				return
+			}
+			if readOnly && r.Method != "GET" && r.Method != "HEAD" {
+				http.Error(w, "Read-only access to this job", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isJobRoute reports whether the request was routed to one of
+// jobRoutePrefixes
+func isJobRoute(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	tpl, err := route.GetPathTemplate()
+	return err == nil && isJobRouteTemplate(tpl)
+}
+
+// isJobRouteTemplate reports whether a route template is one of
+// jobRoutePrefixes or below one
+func isJobRouteTemplate(tpl string) bool {
+	for _, prefix := range jobRoutePrefixes {
+		if tpl == prefix || strings.HasPrefix(tpl, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// requireQuota refuses new jobs once the key has used its processing
+// minutes for the month
+func requireQuota(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if quotaExceeded(apiKeyID(r.Context())) {
+			writeRejection(w, http.StatusTooManyRequests, "quota_exceeded", quotaExceededMessage, quotaRemedy(time.Now()))
+			return
+		}
+		next(w, r)
+	}
+}
+
+const quotaExceededMessage = "Monthly processing quota exceeded"
+
+// quotaExceeded reports whether a key has used its processing minutes for
+// the month; requests without a key have no quota
+func quotaExceeded(id string) bool {
+	if id == "" {
+		return false
+	}
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	k, exists := apiKeys[id]
+	return exists && k.MonthlyMinutes > 0 && k.Usage[usageMonth(time.Now())] >= k.MonthlyMinutes
+}
+
+// trackAPIKeyUsage adds the processing time of keyed jobs to their key's
+// monthly usage
+func trackAPIKeyUsage(e Event) {
+	if e.Job.APIKeyID == "" {
+		return
+	}
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	switch e.Type {
+	case EventJobProcessing:
+		apiKeyJobStarts[e.Job.ID] = e.CreatedAt
+	case EventJobCompleted, EventJobFailed, EventJobDeleted:
+		started, ok := apiKeyJobStarts[e.Job.ID]
+		if !ok {
+			return
+		}
+		delete(apiKeyJobStarts, e.Job.ID)
+		addKeyUsage(e.Job.APIKeyID, e.CreatedAt, e.CreatedAt.Sub(started).Minutes())
+	}
+}
+
+// chargeAPIKey adds processing minutes to a key's usage for the month of at
+func chargeAPIKey(id string, at time.Time, minutes float64) {
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	addKeyUsage(id, at, minutes)
+}
+
+// addKeyUsage is chargeAPIKey for callers holding apiKeysMutex
+func addKeyUsage(id string, at time.Time, minutes float64) {
+	k, exists := apiKeys[id]
+	if !exists {
+		return
+	}
+	if k.Usage == nil {
+		k.Usage = make(map[string]float64)
+	}
+	k.Usage[usageMonth(at)] += minutes
+	saveAPIKeys()
+}
+
+// apiKeyRequest is the body of POST /api/keys and PATCH /api/keys/{id};
+// omitted limits keep their defaults (or current values)
+type apiKeyRequest struct {
+	Name           string        `json:"name"`
+	RateLimit      *int          `json:"rate_limit"`
+	MonthlyMinutes *float64      `json:"monthly_minutes"`
+	Tier           *string       `json:"tier"`      // "" for TIER_DEFAULT
+	Overrides      *KeyOverrides `json:"overrides"` // replaces the key's overrides
+}
+
+func (req apiKeyRequest) apply(k *APIKey) bool {
+	if req.RateLimit != nil {
+		if *req.RateLimit < 0 {
+			return false
+		}
+		k.RateLimit = *req.RateLimit
+	}
+	if req.MonthlyMinutes != nil {
+		if *req.MonthlyMinutes < 0 {
+			return false
+		}
+		k.MonthlyMinutes = *req.MonthlyMinutes
+	}
+	if req.Tier != nil {
+		if *req.Tier != "" && !isTier(*req.Tier) {
+			return false
+		}
+		k.Tier = *req.Tier
+	}
+	if req.Overrides != nil {
+		if !req.Overrides.valid() {
+			return false
+		}
+		k.Overrides = req.Overrides
+		if req.Overrides.empty() {
+			k.Overrides = nil
+		}
+	}
+	if req.Name != "" {
+		k.Name = req.Name
+	}
+	return true
+}
+
+// defaultAPIKeyLimits reads API_KEY_RATE_LIMIT (default 60 requests per
+// minute) and API_KEY_MONTHLY_MINUTES (default unlimited)
+func defaultAPIKeyLimits() (int, float64) {
+	rate := 60
+	if n, err := strconv.Atoi(os.Getenv("API_KEY_RATE_LIMIT")); err == nil && n >= 0 {
+		rate = n
+	}
+	minutes, err := strconv.ParseFloat(os.Getenv("API_KEY_MONTHLY_MINUTES"), 64)
+	if err != nil || minutes < 0 {
+		minutes = 0
+	}
+	return rate, minutes
+}
+
+// createAPIKeyHandler issues a key; the secret is only returned here
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	secret := apiKeyPrefix + randomToken(24)
+	k := &APIKey{ID: uuid.New().String(), Hint: secret[:len(apiKeyPrefix)+6], CreatedAt: time.Now().UTC(), Hash: hashAPIKey(secret)}
+	k.RateLimit, k.MonthlyMinutes = defaultAPIKeyLimits()
+	if !req.apply(k) {
+		http.Error(w, "Invalid limit value", http.StatusBadRequest)
+		return
+	}
+
+	apiKeysMutex.Lock()
+	apiKeys[k.ID] = k
+	saveAPIKeys()
+	view := viewAPIKey(k)
+	apiKeysMutex.Unlock()
+	recordAudit("api_key.created", "", map[string]string{"key_id": k.ID, "name": k.Name})
+	view.Key = secret
+	writeJSON(w, http.StatusCreated, view)
+}
+
+func listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	apiKeysMutex.Lock()
+	list := make([]apiKeyView, 0, len(apiKeys))
+	for _, id := range sortedKeys(apiKeys) {
+		list = append(list, viewAPIKey(apiKeys[id]))
+	}
+	apiKeysMutex.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+// updateAPIKeyHandler changes a key's name or limits
+func updateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	apiKeysMutex.Lock()
+	k, exists := apiKeys[mux.Vars(r)["id"]]
+	if !exists {
+		apiKeysMutex.Unlock()
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	updated := *k
+	if !req.apply(&updated) {
+		apiKeysMutex.Unlock()
+		http.Error(w, "Invalid limit value", http.StatusBadRequest)
+		return
+	}
+	*k = updated
+	saveAPIKeys()
+	view := viewAPIKey(k)
+	apiKeysMutex.Unlock()
+	writeJSON(w, http.StatusOK, view)
+}
+
+func deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	apiKeysMutex.Lock()
+	_, exists := apiKeys[id]
+	delete(apiKeys, id)
+	delete(apiKeyWindows, id)
+	if exists {
+		saveAPIKeys()
+	}
+	apiKeysMutex.Unlock()
+	if !exists {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	forgetOrgMember(id)
+	forgetInvitee(id)
+	recordAudit("api_key.revoked", "", map[string]string{"key_id": id})
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
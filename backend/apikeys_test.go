@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAPIKeyAuthAndQuota(t *testing.T) {
+	oldUploadDir := uploadDir
+	uploadDir = t.TempDir()
+	t.Setenv("API_KEYS_REQUIRED", "true")
+	t.Cleanup(func() {
+		uploadDir = oldUploadDir
+		apiKeysMutex.Lock()
+		apiKeys, apiKeyWindows = make(map[string]*APIKey), make(map[string]*apiKeyWindow)
+		apiKeysMutex.Unlock()
+	})
+
+	create := func(body string) apiKeyView {
+		rec := httptest.NewRecorder()
+		createAPIKeyHandler(rec, httptest.NewRequest("POST", "/api/keys", strings.NewReader(body)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("create key = %d: %s", rec.Code, rec.Body.String())
+		}
+		var v apiKeyView
+		json.NewDecoder(rec.Body).Decode(&v)
+		return v
+	}
+	alice := create(`{"name": "alice", "rate_limit": 3, "monthly_minutes": 10}`)
+	bob := create(`{"name": "bob", "rate_limit": 0}`)
+	if !strings.HasPrefix(alice.Key, apiKeyPrefix) || alice.RateLimit != 3 || bob.RateLimit != 0 {
+		t.Fatalf("created keys = %+v, %+v", alice, bob)
+	}
+
+	jobsMutex.Lock()
+	jobs["key-job-alice"] = &Job{ID: "key-job-alice", Status: "completed", APIKeyID: alice.ID}
+	jobs["key-job-bob"] = &Job{ID: "key-job-bob", Status: "completed", APIKeyID: bob.ID}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, "key-job-alice")
+		delete(jobs, "key-job-bob")
+		jobsMutex.Unlock()
+	})
+
+	router := mux.NewRouter()
+	router.Use(apiKeyMiddleware)
+	router.HandleFunc("/api/health", healthHandler)
+	router.HandleFunc("/api/jobs", listJobsHandler)
+	router.HandleFunc("/api/jobs/{id}", getJobHandler)
+	router.HandleFunc("/api/upload", requireQuota(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	do := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("/api/health", ""); rec.Code != http.StatusOK {
+		t.Errorf("health without key = %d", rec.Code)
+	}
+	if rec := do("/api/jobs", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("jobs without key = %d, want 401", rec.Code)
+	}
+	if rec := do("/api/jobs", "t2s_wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("jobs with unknown key = %d, want 401", rec.Code)
+	}
+
+	// Keys only see their own jobs
+	rec := do("/api/jobs?api_key="+bob.Key, "")
+	var page JobList
+	json.NewDecoder(rec.Body).Decode(&page)
+	list := page.Jobs
+	for _, job := range list {
+		if job.APIKeyID != bob.ID {
+			t.Errorf("bob listed job %s of key %s", job.ID, job.APIKeyID)
+		}
+	}
+	if len(list) != 1 {
+		t.Errorf("bob listed %d jobs, want 1", len(list))
+	}
+	if rec := do("/api/jobs/key-job-alice", bob.Key); rec.Code != http.StatusNotFound {
+		t.Errorf("bob reading alice's job = %d, want 404", rec.Code)
+	}
+
+	// Alice has 3 requests a minute
+	if rec := do("/api/jobs/key-job-alice", alice.Key); rec.Code != http.StatusOK {
+		t.Errorf("alice reading her job = %d", rec.Code)
+	}
+	do("/api/upload", alice.Key)
+	do("/api/jobs", alice.Key)
+	if rec := do("/api/jobs", alice.Key); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("fourth request = %d, want 429", rec.Code)
+	}
+
+	// Eleven minutes of processing use up alice's monthly quota
+	started := time.Now().Add(-11 * time.Minute)
+	trackAPIKeyUsage(Event{Type: EventJobProcessing, CreatedAt: started, Job: Job{ID: "key-job-alice", APIKeyID: alice.ID}})
+	trackAPIKeyUsage(Event{Type: EventJobCompleted, CreatedAt: time.Now(), Job: Job{ID: "key-job-alice", APIKeyID: alice.ID}})
+	apiKeysMutex.Lock()
+	apiKeyWindows = make(map[string]*apiKeyWindow)
+	apiKeysMutex.Unlock()
+	if rec := do("/api/upload", alice.Key); rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "quota") {
+		t.Errorf("upload over quota = %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("/api/upload", bob.Key); rec.Code != http.StatusAccepted {
+		t.Errorf("upload without quota = %d", rec.Code)
+	}
+
+	// Keys and usage survive a restart
+	apiKeysMutex.Lock()
+	apiKeys = make(map[string]*APIKey)
+	apiKeysMutex.Unlock()
+	loadAPIKeys()
+	if k, ok := lookupAPIKey(alice.Key); !ok || k.Usage[usageMonth(time.Now())] < 10 {
+		t.Errorf("reloaded key = %+v, %v", k, ok)
+	}
+}
+
+func TestJobRoutesCheckOwnership(t *testing.T) {
+	oldUploadDir := uploadDir
+	uploadDir = t.TempDir()
+	t.Setenv("API_KEYS_REQUIRED", "true")
+	t.Cleanup(func() {
+		uploadDir = oldUploadDir
+		apiKeysMutex.Lock()
+		apiKeys, apiKeyWindows = make(map[string]*APIKey), make(map[string]*apiKeyWindow)
+		apiKeysMutex.Unlock()
+	})
+	create := func(name string) apiKeyView {
+		rec := httptest.NewRecorder()
+		createAPIKeyHandler(rec, httptest.NewRequest("POST", "/api/keys", strings.NewReader(`{"name": "`+name+`", "rate_limit": 0}`)))
+		var v apiKeyView
+		json.NewDecoder(rec.Body).Decode(&v)
+		return v
+	}
+	alice, bob := create("alice"), create("bob")
+
+	id := "3f2b8c1e-5d4a-4e6f-9a7b-0c1d2e3f4a5b"
+	jobsMutex.Lock()
+	jobs[id] = &Job{ID: id, Status: "completed", FileName: "song.mp3", APIKeyID: alice.ID, OutputFiles: map[string]string{"vocals": "/nonexistent/vocals.wav"}}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+	})
+
+	// Every route addressing one job refuses bob
+	router := newRouter()
+	placeholder := strings.NewReplacer("{id}", id, "{stem}", "vocals", "{mix}", "m", "{annotation}", "a", "{token}", "t", "{hash}", "h", "{invitation}", "i")
+	checked := 0
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || !isJobRouteTemplate(tpl) {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		path := placeholder.Replace(tpl)
+		for _, method := range methods {
+			if strings.Contains(path, "{") {
+				t.Errorf("%s: no placeholder for %s", tpl, path)
+				continue
+			}
+			req := httptest.NewRequest(method, path, nil)
+			req.Header.Set("X-API-Key", bob.Key)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("bob %s %s = %d, want 404", method, tpl, rec.Code)
+			}
+			checked++
+		}
+		return nil
+	})
+	if checked < 20 {
+		t.Errorf("checked %d job routes", checked)
+	}
+
+	// Comparisons look both jobs up
+	for _, key := range []string{bob.Key, alice.Key} {
+		req := httptest.NewRequest("GET", "/api/compare?job_a="+id+"&job_b="+id, nil)
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if bob := key == bob.Key; bob != (rec.Code == http.StatusNotFound) {
+			t.Errorf("compare as bob=%v = %d", bob, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/jobs/"+id, nil)
+	req.Header.Set("X-API-Key", alice.Key)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("alice reading her job = %d", rec.Code)
+	}
+}
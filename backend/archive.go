@@ -0,0 +1,141 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Job archives (GET /api/jobs/{id}/archive). One tar.gz with everything
+// worth keeping of a session offline, under a single {name}/ directory:
+// the output files in stems/, manifest.json as in packages,
+// analysis.json (media info of every output, annotations, mixes, pipeline
+// steps, the options the job ran with and processor notes), lyrics.txt
+// when the upload had embedded lyrics and, with original=true, the upload
+// itself in original/ while it is still kept (KEEP_UPLOADS=true).
+
+// jobAnalysis is the analysis.json of an archive
+type jobAnalysis struct {
+	Outputs     []OutputInfo      `json:"outputs"`
+	Annotations []Annotation      `json:"annotations"`
+	Mixes       []Mix             `json:"mixes,omitempty"`
+	Pipeline    []PipelineStep    `json:"pipeline,omitempty"`
+	Policy      *PolicyDecision   `json:"policy,omitempty"`
+	Options     *EffectiveOptions `json:"effective_options,omitempty"`
+	Notes       []JobNote         `json:"notes,omitempty"`
+}
+
+// archiveJobHandler streams a job as a tar.gz:
+// GET /api/jobs/{id}/archive?stems=&original=true&lyrics=false
+func archiveJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupCompletedJob(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	stems, ok := packageStems(w, job, q.Get("stems"))
+	if !ok {
+		return
+	}
+	var original string
+	if q.Get("original") == "true" {
+		jobsMutex.RLock()
+		if j, exists := jobs[job.ID]; exists {
+			original = j.inputPath
+		}
+		jobsMutex.RUnlock()
+		if _, err := os.Stat(original); original == "" || err != nil {
+			http.Error(w, "Original upload is no longer kept", http.StatusNotFound)
+			return
+		}
+	}
+
+	annotationsMutex.RLock()
+	analysis := jobAnalysis{Annotations: make([]Annotation, 0, len(annotations[job.ID]))}
+	for _, a := range annotations[job.ID] {
+		analysis.Annotations = append(analysis.Annotations, *a)
+	}
+	annotationsMutex.RUnlock()
+	sort.SliceStable(analysis.Annotations, func(i, j int) bool { return analysis.Annotations[i].At < analysis.Annotations[j].At })
+	analysis.Outputs = jobOutputs(r.Context(), job)
+	analysis.Mixes, analysis.Pipeline, analysis.Policy, analysis.Options, analysis.Notes = job.Mixes, job.Pipeline, job.Policy, job.Effective, job.Notes
+
+	base := sanitizeFilename(strings.TrimSuffix(job.FileName, filepath.Ext(job.FileName)))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", base+".tar.gz"))
+
+	// Stems are mostly compressed already, so don't spend CPU on them
+	gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	defer gz.Close()
+	tw := tar.NewWriter(gz)
+	defer tw.Close()
+
+	var entries []packageEntry
+	for _, stem := range stems {
+		src := job.OutputFiles[stem]
+		entry, err := addArchiveFile(tw, path.Join(base, "stems", filepath.Base(src)), stem, src)
+		if err != nil {
+			// Headers are already sent; a truncated archive is the best signal left
+			return
+		}
+		entries = append(entries, entry)
+	}
+	if original != "" {
+		entry, err := addArchiveFile(tw, path.Join(base, "original", sanitizeFilename(job.FileName)), "original", original)
+		if err != nil {
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	now := time.Now().UTC()
+	if job.Metadata != nil && job.Metadata.Lyrics != "" && q.Get("lyrics") != "false" {
+		addArchiveBytes(tw, path.Join(base, "lyrics.txt"), []byte(job.Metadata.Lyrics), now)
+	}
+	data, _ := json.MarshalIndent(analysis, "", "  ")
+	addArchiveBytes(tw, path.Join(base, "analysis.json"), append(data, '\n'), now)
+	manifest := jobManifest(job, entries)
+	manifest["archived_at"] = now
+	data, _ = json.MarshalIndent(manifest, "", "  ")
+	addArchiveBytes(tw, path.Join(base, "manifest.json"), append(data, '\n'), now)
+}
+
+// addArchiveFile writes src into the archive, hashing it on the way through
+func addArchiveFile(tw *tar.Writer, name, stem, src string) (packageEntry, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return packageEntry{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return packageEntry{}, err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+		return packageEntry{}, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tw, h), f)
+	if err != nil {
+		return packageEntry{}, err
+	}
+	return packageEntry{Path: name, Stem: stem, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+func addArchiveBytes(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// readArchive returns the files of a tar.gz by name
+func readArchive(t *testing.T, body []byte) map[string][]byte {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("not gzip: %v", err)
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatalf("bad tar: %v", err)
+		}
+		files[header.Name], _ = io.ReadAll(tr)
+	}
+}
+
+func TestIntegrationArchive(t *testing.T) {
+	t.Setenv("KEEP_UPLOADS", "true")
+	b := newIntegrationBackend(t, 1)
+	job := b.waitFor(b.upload("song.mp3", nil).ID, "completed")
+
+	code, body := b.get("/api/jobs/" + job.ID + "/archive?original=true")
+	if code != http.StatusOK {
+		t.Fatalf("archive = %d: %s", code, body)
+	}
+	files := readArchive(t, body)
+	if _, ok := files["song/original/song.mp3"]; !ok {
+		t.Errorf("no original in %d files", len(files))
+	}
+
+	var manifest struct {
+		JobID string         `json:"job_id"`
+		Files []packageEntry `json:"files"`
+	}
+	if err := json.Unmarshal(files["song/manifest.json"], &manifest); err != nil || manifest.JobID != job.ID {
+		t.Fatalf("manifest = %s", files["song/manifest.json"])
+	}
+	if len(manifest.Files) != len(job.OutputFiles)+1 {
+		t.Errorf("manifest lists %d files for %d outputs and the original", len(manifest.Files), len(job.OutputFiles))
+	}
+	for _, f := range manifest.Files {
+		sum := sha256.Sum256(files[f.Path])
+		if hex.EncodeToString(sum[:]) != f.SHA256 {
+			t.Errorf("%s doesn't match its hash", f.Path)
+		}
+	}
+	var analysis jobAnalysis
+	if err := json.Unmarshal(files["song/analysis.json"], &analysis); err != nil || len(analysis.Outputs) != len(job.OutputFiles) {
+		t.Errorf("analysis = %s", files["song/analysis.json"])
+	}
+
+	code, body = b.get("/api/jobs/" + job.ID + "/archive?stems=vocals")
+	if files := readArchive(t, body); code != http.StatusOK || len(files) != 3 {
+		t.Errorf("vocals only = %d with %d files", code, len(files))
+	}
+	if code, _ := b.get("/api/jobs/" + job.ID + "/archive?stems=cowbell"); code != http.StatusNotFound {
+		t.Errorf("unknown stem = %d", code)
+	}
+
+	jobsMutex.Lock()
+	jobs[job.ID].inputPath = ""
+	jobsMutex.Unlock()
+	if code, _ := b.get("/api/jobs/" + job.ID + "/archive?original=true"); code != http.StatusNotFound {
+		t.Errorf("original after the upload was released = %d", code)
+	}
+}
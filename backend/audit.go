@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one security-relevant decision, written as a JSON line to
+// AUDIT_LOG_FILE (or the server log when unset)
+type AuditEntry struct {
+	Time   time.Time         `json:"time"`
+	Action string            `json:"action"`
+	JobID  string            `json:"job_id,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+var auditMutex = &sync.Mutex{}
+
+// recordAudit appends an entry to the audit log. Failures to write are
+// logged but never fail the request being audited.
+func recordAudit(action, jobID string, fields map[string]string) {
+	line, err := json.Marshal(AuditEntry{Time: time.Now().UTC(), Action: action, JobID: jobID, Fields: fields})
+	if err != nil {
+		log.Printf("Failed to encode audit entry %s: %v", action, err)
+		return
+	}
+
+	path := os.Getenv("AUDIT_LOG_FILE")
+	if path == "" {
+		log.Printf("audit: %s", line)
+		return
+	}
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Failed to open audit log: %v (entry: %s)", err, line)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write audit log: %v (entry: %s)", err, line)
+	}
+}
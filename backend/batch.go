@@ -0,0 +1,251 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Batch uploads (POST /api/upload/batch) turn every file of one multipart
+// request into a child job with the same separation options, grouped under
+// a parent batch. GET /api/download/{id}/all streams the completed stems of
+// a job or a batch as a single ZIP, written as it is read.
+
+// maxBatchFiles caps the files in one batch upload
+const maxBatchFiles = 50
+
+// maxBatchBytes caps a batch request body (nginx allows the same)
+const maxBatchBytes = 20 * maxUploadBytes
+
+// Batch groups the jobs created by one batch upload
+type Batch struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	JobIDs    []string  `json:"job_ids"`
+}
+
+var (
+	batches      = make(map[string]*Batch)
+	batchesMutex = &sync.RWMutex{}
+)
+
+// batchRejection is a file of a batch that didn't become a job
+type batchRejection struct {
+	FileName    string       `json:"filename"`
+	Status      int          `json:"status"`
+	Error       string       `json:"error"`
+	Code        string       `json:"code,omitempty"`
+	Remediation *Remediation `json:"remediation,omitempty"`
+	TierLimit   *tierError   `json:"tier_limit,omitempty"` // the limit a 403 hit
+}
+
+// batchView is a batch with its jobs' current state
+type batchView struct {
+	ID        string           `json:"id"`
+	Status    string           `json:"status"` // processing, completed, failed, partial
+	CreatedAt time.Time        `json:"created_at"`
+	Counts    map[string]int   `json:"counts"` // jobs per status
+	Jobs      []Job            `json:"jobs"`
+	Rejected  []batchRejection `json:"rejected,omitempty"`
+}
+
+// batchJobs returns snapshots of a batch's jobs that still exist
+func batchJobs(b *Batch) []Job {
+	jobsMutex.RLock()
+	defer jobsMutex.RUnlock()
+	list := make([]Job, 0, len(b.JobIDs))
+	for _, id := range b.JobIDs {
+		if job, exists := jobs[id]; exists {
+			snap := job.snapshot()
+			snap.QueuePosition = processingQueue.position(id)
+			list = append(list, snap)
+		}
+	}
+	return list
+}
+
+func newBatchView(b *Batch) batchView {
+	v := batchView{ID: b.ID, CreatedAt: b.CreatedAt, Counts: map[string]int{}, Jobs: batchJobs(b)}
+	for _, job := range v.Jobs {
+		v.Counts[job.Status]++
+	}
+	switch {
+	case v.Counts["completed"]+v.Counts["failed"] < len(v.Jobs):
+		v.Status = "processing"
+	case v.Counts["failed"] == 0:
+		v.Status = "completed"
+	case v.Counts["completed"] == 0:
+		v.Status = "failed"
+	default:
+		v.Status = "partial"
+	}
+	return v
+}
+
+// batchUploadHandler accepts several audio files in the "files" field, with
+// the same form options as /api/upload applied to each
+func batchUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > 0 {
+		if e := checkDiskSpace(map[string]int64{os.TempDir(): r.ContentLength, uploadDir: r.ContentLength}); e != nil {
+			writeStorageError(w, e)
+			return
+		}
+	}
+	err := r.ParseMultipartForm(32 << 20)
+	if isBodyTooLarge(err) {
+		r := sizeRemedy(maxUploadBytes + 1<<20)
+		r.Hint = "Send fewer or smaller files per batch, under " + formatMegabytes(r.MaxBytes) + " in all"
+		writeRejection(w, http.StatusRequestEntityTooLarge, "batch_too_large", "Batch too large", r)
+		return
+	}
+	if isNoSpace(err) {
+		writeStorageError(w, &storageError{Error: "Insufficient storage", Path: os.TempDir()})
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	headers := append(r.MultipartForm.File["files"], r.MultipartForm.File["file"]...)
+	if len(headers) == 0 {
+		http.Error(w, "No files in batch", http.StatusBadRequest)
+		return
+	}
+	if len(headers) > maxBatchFiles {
+		http.Error(w, fmt.Sprintf("Too many files (max %d)", maxBatchFiles), http.StatusBadRequest)
+		return
+	}
+	opts, err := parseJobOptions(r.FormValue)
+	if err == nil {
+		err = opts.checkFields(formFieldNames(r), formFields("files", "file"), strictOptions(r))
+	}
+	if err != nil {
+		writeRejection(w, http.StatusBadRequest, "invalid_option", err.Error(), optionRemedy(err))
+		return
+	}
+	if e := checkTier(r.Context(), opts, ""); e != nil {
+		writeJSON(w, http.StatusForbidden, e)
+		return
+	}
+	if uerr := checkOrg(r.Context(), opts.Org); uerr != nil {
+		uerr.write(w)
+		return
+	}
+
+	batch := &Batch{ID: uuid.New().String(), CreatedAt: time.Now().UTC()}
+	var rejected []batchRejection
+	for _, header := range headers {
+		if header.Size > maxUploadBytes {
+			rejected = append(rejected, batchRejection{FileName: header.Filename, Status: http.StatusRequestEntityTooLarge, Error: "File too large", Code: "file_too_large", Remediation: sizeRemedy(maxUploadBytes)})
+			continue
+		}
+		job, uerr := storeUpload(r.Context(), header, opts, batch.ID)
+		if uerr != nil {
+			rejected = append(rejected, uerr.batchRejection(header.Filename))
+			continue
+		}
+		batch.JobIDs = append(batch.JobIDs, job.ID)
+	}
+	if len(batch.JobIDs) == 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, batchView{Status: "failed", Counts: map[string]int{}, Jobs: []Job{}, Rejected: rejected})
+		return
+	}
+
+	batchesMutex.Lock()
+	batches[batch.ID] = batch
+	batchesMutex.Unlock()
+	v := newBatchView(batch)
+	v.Rejected = rejected
+	writeJSON(w, http.StatusOK, v)
+}
+
+func getBatchHandler(w http.ResponseWriter, r *http.Request) {
+	batchesMutex.RLock()
+	batch, exists := batches[mux.Vars(r)["id"]]
+	batchesMutex.RUnlock()
+	if !exists {
+		http.Error(w, "Batch not found", http.StatusNotFound)
+		return
+	}
+	v := newBatchView(batch)
+	for i := range v.Jobs {
+		withDownloadURLs(r, &v.Jobs[i])
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// downloadAllHandler streams every completed stem of a job, or of each
+// completed job in a batch, as a ZIP with one folder per job
+func downloadAllHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !isValidJobID(id) {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+
+	var list []Job
+	archiveName := ""
+	batchesMutex.RLock()
+	batch, isBatch := batches[id]
+	batchesMutex.RUnlock()
+	if isBatch {
+		for _, job := range batchJobs(batch) {
+			if job.Status == "completed" {
+				list = append(list, job)
+			}
+		}
+		if len(list) == 0 {
+			http.Error(w, "No completed jobs in batch", http.StatusBadRequest)
+			return
+		}
+		archiveName = "batch-" + id
+	} else {
+		job, ok := completedJob(w, r, id)
+		if !ok {
+			return
+		}
+		list = []Job{job}
+		archiveName = strings.TrimSuffix(job.FileName, filepath.Ext(job.FileName))
+	}
+	for _, job := range list {
+		for stem, p := range job.OutputFiles {
+			if !safeOutputPath(p) {
+				http.Error(w, "Stem not found: "+stem, http.StatusNotFound)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", sanitizeFilename(archiveName)+".zip"))
+	zw := zip.NewWriter(w)
+	dirs := map[string]bool{}
+	for _, job := range list {
+		// Albums often repeat file names across discs; keep each job apart
+		dir := pathSegment(strings.TrimSuffix(job.FileName, filepath.Ext(job.FileName)))
+		if dirs[dir] {
+			dir += " (" + job.ID[:8] + ")"
+		}
+		dirs[dir] = true
+		for _, stem := range sortedKeys(job.OutputFiles) {
+			src := job.OutputFiles[stem]
+			if _, err := addPackageFile(zw, path.Join(dir, stem+filepath.Ext(src)), stem, src); err != nil {
+				// Headers are already sent; a truncated archive is the best signal left
+				zw.Close()
+				return
+			}
+		}
+	}
+	zw.Close()
+}
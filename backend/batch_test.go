@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestBatchUploadAndDownloadAll(t *testing.T) {
+	oldUploadDir, oldOutputDir := uploadDir, outputDir
+	uploadDir, outputDir = t.TempDir(), t.TempDir()
+	externalWorkers = true // keep the accepted jobs from being dispatched to a processor
+	t.Cleanup(func() { uploadDir, outputDir, externalWorkers = oldUploadDir, oldOutputDir, false })
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, name := range []string{"01 Intro.mp3", "02 Song.mp3", "03 Intro.mp3"} {
+		part, _ := mw.CreateFormFile("files", name)
+		part.Write([]byte("ID3 " + name))
+	}
+	mw.WriteField("output_format", "wav")
+	mw.Close()
+	req := httptest.NewRequest("POST", "/api/upload/batch", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	batchUploadHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("batch upload = %d: %s", rec.Code, rec.Body.String())
+	}
+	var v batchView
+	json.NewDecoder(rec.Body).Decode(&v)
+	if len(v.Jobs) != 3 || v.Status != "processing" || v.Jobs[0].BatchID != v.ID || v.Jobs[0].OutputFormat != "wav" {
+		t.Fatalf("batch = %+v", v)
+	}
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		for _, job := range v.Jobs {
+			delete(jobs, job.ID)
+		}
+		jobsMutex.Unlock()
+		batchesMutex.Lock()
+		delete(batches, v.ID)
+		batchesMutex.Unlock()
+	})
+
+	// Complete the first two jobs and fail the third; both intros share a name
+	jobsMutex.Lock()
+	for i, view := range v.Jobs {
+		job := jobs[view.ID]
+		if i == 2 {
+			job.Status = "failed"
+			continue
+		}
+		job.Status = "completed"
+		job.FileName = "Intro.mp3"
+		job.OutputFiles = map[string]string{}
+		for _, stem := range []string{"vocals", "drums"} {
+			p := filepath.Join(outputDir, job.ID, stem+".wav")
+			os.MkdirAll(filepath.Dir(p), 0755)
+			os.WriteFile(p, []byte(stem), 0644)
+			job.OutputFiles[stem] = p
+		}
+	}
+	jobsMutex.Unlock()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/batches/{id}", getBatchHandler)
+	router.HandleFunc("/api/download/{id}/all", downloadAllHandler)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/batches/"+v.ID, nil))
+	json.NewDecoder(rec.Body).Decode(&v)
+	if v.Status != "partial" || v.Counts["completed"] != 2 || v.Counts["failed"] != 1 {
+		t.Errorf("batch status = %s %v, want partial", v.Status, v.Counts)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/download/"+v.ID+"/all", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("download all = %d: %s", rec.Code, rec.Body.String())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	second := "Intro (" + v.Jobs[1].ID[:8] + ")"
+	want := []string{second + "/drums.wav", second + "/vocals.wav", "Intro/drums.wav", "Intro/vocals.wav"}
+	if len(names) != len(want) {
+		t.Fatalf("archive = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("archive = %v, want %v", names, want)
+			break
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/download/"+v.Jobs[2].ID+"/all", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("download all of a failed job = %d, want 400", rec.Code)
+	}
+}
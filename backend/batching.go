@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Batched processor submission. Loading the Demucs model costs seconds,
+// more than separating a short clip takes, so a worker that takes a short
+// clip off the queue also takes the queued clips that can share its
+// processor run: up to BATCH_MAX_JOBS (default 8; 1 turns batching off)
+// clips no longer than BATCH_MAX_CLIP_SECONDS (default 30) with the same
+// variant and separation options. They go to the processor's /process/batch
+// in one request, which separates them with one model load and answers
+// with each job's stems or error, so one bad clip doesn't fail the others.
+// A processor says it takes batches, and how many clips, in an
+// X-Batch-Limit header on its responses; until it has, and for clips
+// ffprobe can't measure, jobs go one by one. Deterministic, self-test and
+// pinned jobs are never batched. Jobs of a batch share processor_batch.
+
+var (
+	processorBatchLimits      = make(map[string]int) // by processor URL
+	processorBatchLimitsMutex = &sync.Mutex{}
+)
+
+// batchMaxJobs reads BATCH_MAX_JOBS (default 8)
+func batchMaxJobs() int {
+	if n, err := strconv.Atoi(os.Getenv("BATCH_MAX_JOBS")); err == nil && n > 0 {
+		return n
+	}
+	return 8
+}
+
+// batchMaxClipSeconds reads BATCH_MAX_CLIP_SECONDS (default 30)
+func batchMaxClipSeconds() float64 {
+	if s, err := strconv.ParseFloat(os.Getenv("BATCH_MAX_CLIP_SECONDS"), 64); err == nil && s > 0 {
+		return s
+	}
+	return 30
+}
+
+// noteProcessorBatchLimit records the X-Batch-Limit of a processor response
+func noteProcessorBatchLimit(url string, header http.Header) {
+	limit, err := strconv.Atoi(strings.TrimSpace(header.Get("X-Batch-Limit")))
+	if err != nil || limit < 1 {
+		limit = 1
+	}
+	processorBatchLimitsMutex.Lock()
+	processorBatchLimits[url] = limit
+	processorBatchLimitsMutex.Unlock()
+}
+
+// batchLimit returns how many jobs of a variant and model can go in one
+// request: the smallest limit among the processors it may be sent to
+func batchLimit(variant, model string) int {
+	var urls []string
+	if c := canaryFromEnv(); len(registeredProcessors()) == 0 || (variant == variantCanary && c.ProcessorURL != "") {
+		urls = []string{processorURLFor(variant)}
+	} else {
+		for _, p := range registeredProcessors() {
+			if p.supports(model) {
+				urls = append(urls, p.URL)
+			}
+		}
+	}
+	limit := batchMaxJobs()
+	processorBatchLimitsMutex.Lock()
+	defer processorBatchLimitsMutex.Unlock()
+	for _, url := range urls {
+		limit = min(limit, max(processorBatchLimits[url], 1))
+	}
+	if len(urls) == 0 {
+		return 1
+	}
+	return limit
+}
+
+// batchable reports whether a queued job may share a processor request;
+// called with jobsMutex held
+func (j *Job) batchable() bool {
+	return j.Status == "queued" && !j.Deterministic && !j.Encrypted && j.Watermark == "" && !j.SelfTest && j.pinnedProcessor == "" && j.inputPath != ""
+}
+
+// batchKey is equal for jobs that can be separated together; called with
+// jobsMutex held
+func (j *Job) batchKey() string {
+	return fmt.Sprint(j.Variant, processorFields("", j.options())[1:])
+}
+
+// clipSeconds returns a job's upload length, probing it the first time;
+// it is negative when ffprobe can't tell
+func clipSeconds(jobID string) float64 {
+	jobsMutex.RLock()
+	job, exists := jobs[jobID]
+	var seconds float64
+	var path string
+	if exists {
+		seconds, path = job.clipSeconds, job.inputPath
+	}
+	jobsMutex.RUnlock()
+	if !exists || seconds != 0 {
+		return seconds
+	}
+	seconds = -1
+	if probe, err := probeAudio(context.Background(), path); err == nil && probe.DurationSeconds > 0 {
+		seconds = probe.DurationSeconds
+	}
+	jobsMutex.Lock()
+	job.clipSeconds = seconds
+	jobsMutex.Unlock()
+	return seconds
+}
+
+// shortClip reports whether a job is short enough to batch
+func shortClip(jobID string) bool {
+	seconds := clipSeconds(jobID)
+	return seconds > 0 && seconds <= batchMaxClipSeconds()
+}
+
+// takeBatch returns jobID together with the queued jobs it can be sent
+// with, taken off the queue; just jobID when it goes alone
+func takeBatch(jobID string, opts jobOptions) []string {
+	jobsMutex.RLock()
+	job := jobs[jobID]
+	ok := job != nil && job.batchable()
+	var key, variant string
+	if ok {
+		key, variant = job.batchKey(), job.Variant
+	}
+	jobsMutex.RUnlock()
+	if !ok {
+		return []string{jobID}
+	}
+	limit := batchLimit(variant, opts.Model)
+	if limit < 2 || !shortClip(jobID) {
+		return []string{jobID}
+	}
+
+	var others []string
+	for _, id := range processingQueue.queued() {
+		if len(others) == limit-1 {
+			break
+		}
+		jobsMutex.RLock()
+		candidate := jobs[id]
+		match := candidate != nil && candidate.batchable() && candidate.batchKey() == key
+		jobsMutex.RUnlock()
+		if match && shortClip(id) {
+			others = append(others, id)
+		}
+	}
+	return append([]string{jobID}, processingQueue.take(others)...)
+}
+
+// batchClip is a job of a batch being sent
+type batchClip struct {
+	id   string
+	path string
+	opts jobOptions
+	ctx  context.Context
+}
+
+// processBatch separates jobs taken together by takeBatch in one
+// /process/batch request. The first job is counted by the worker that runs
+// it, the others by take.
+func processBatch(jobIDs []string) {
+	defer func() {
+		for range jobIDs[1:] {
+			processingQueue.done()
+		}
+	}()
+
+	batchID := uuid.New().String()
+	var clips []batchClip
+	var variant, reqID string
+	jobsMutex.Lock()
+	for _, id := range jobIDs {
+		job, exists := jobs[id]
+		if !exists || job.Status != "queued" {
+			continue
+		}
+		job.Status = "processing"
+		job.ProcessorBatch = batchID
+		ctx, cancel := job.startContext()
+		defer cancel(nil)
+		clips = append(clips, batchClip{id: id, path: job.inputPath, opts: job.options(), ctx: ctx})
+		variant = job.Variant
+		if reqID == "" {
+			reqID = job.RequestID
+		}
+	}
+	jobsMutex.Unlock()
+	if len(clips) == 0 {
+		return
+	}
+	for _, c := range clips {
+		emitJobEvent(c.id, EventJobProcessing)
+	}
+
+	// The request stops once every job in it is cancelled, or on shutdown
+	ctx, stop := context.WithCancelCause(jobsContext)
+	defer stop(nil)
+	go func() {
+		for _, c := range clips {
+			select {
+			case <-c.ctx.Done():
+			case <-ctx.Done():
+				return
+			}
+		}
+		stop(errJobCancelled)
+	}()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	var ids []string
+	for _, c := range clips {
+		if err := writeBatchClip(writer, c); err != nil {
+			updateJobError(c.id, err.Error())
+			continue
+		}
+		ids = append(ids, c.id)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	fields := processorFields("", clips[0].opts)[1:]
+	for _, f := range fields {
+		writer.WriteField(f[0], f[1])
+	}
+	writer.Close()
+
+	estimate, timeout := processorBudget(ids, clips[0].opts)
+	sentAt := time.Now()
+	code, respBody, err := postToProcessor(ctx, ids[0], variant, jobNeeds(clips[0].opts), processRequest{
+		Body:        body.Bytes(),
+		ContentType: writer.FormDataContentType(),
+		Fields:      append([][2]string{{"job_id", strings.Join(ids, ",")}}, fields...),
+		RequestID:   reqID,
+
+		Path:      "/process/batch",
+		BatchJobs: ids[1:],
+		Timeout:   timeout,
+	})
+	failAll := func(msg string) {
+		for _, id := range ids {
+			updateJobError(id, msg)
+		}
+	}
+	if cause := context.Cause(ctx); cause != nil {
+		if cause == errShuttingDown {
+			for _, id := range ids {
+				cancelOnProcessor(id, variant, reqID)
+			}
+			failAll(cause.Error())
+		}
+		return
+	}
+	if err != nil && code == 0 {
+		failAll("Failed to process: " + err.Error())
+		return
+	}
+	if code != http.StatusOK {
+		failAll("Processor failed: " + string(respBody))
+		return
+	}
+	observeProcessorSpeed(clips[0].opts.Model, estimate, time.Since(sentAt))
+
+	var result struct {
+		Results        map[string]map[string]interface{} `json:"results"`
+		ProcessingTime string                            `json:"processing_time"`
+		Environment    interface{}                       `json:"environment"`
+		Compute        *processorCompute                 `json:"compute"`
+	}
+	if err != nil || json.Unmarshal(respBody, &result) != nil {
+		failAll("Failed to parse response")
+		return
+	}
+	lengths := make([]float64, len(clips))
+	for i, c := range clips {
+		lengths[i] = clipSeconds(c.id)
+	}
+	compute := splitCompute(result.Compute, lengths)
+	for i, c := range clips {
+		if !slices.Contains(ids, c.id) {
+			continue
+		}
+		r, ok := result.Results[c.id]
+		switch {
+		case !ok:
+			updateJobError(c.id, "Processor returned no result for the job")
+		case r["error"] != nil:
+			updateJobError(c.id, fmt.Sprintf("Processor failed: %v", r["error"]))
+		default:
+			completeJob(c.id, c.opts, false, map[string]interface{}{
+				"outputs":         r["outputs"],
+				"processing_time": result.ProcessingTime,
+				"environment":     result.Environment,
+				"compute":         compute[i],
+				"notes":           r["notes"],
+			}, nil)
+		}
+	}
+}
+
+// writeBatchClip adds a job's file and job_id to a batch request
+func writeBatchClip(writer *multipart.Writer, c batchClip) error {
+	file, err := os.Open(c.path)
+	if err != nil {
+		return fmt.Errorf("Failed to open file")
+	}
+	defer file.Close()
+	part, err := writer.CreateFormFile("file", filepath.Base(c.path))
+	if err != nil {
+		return fmt.Errorf("Failed to create form")
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return fmt.Errorf("Failed to copy file")
+	}
+	return writer.WriteField("job_id", c.id)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBatchLimit(t *testing.T) {
+	const url = "http://batch.test"
+	t.Setenv("PROCESSOR_URL", url)
+	t.Cleanup(func() {
+		processorBatchLimitsMutex.Lock()
+		delete(processorBatchLimits, url)
+		processorBatchLimitsMutex.Unlock()
+	})
+	if got := batchLimit(variantStable, "htdemucs"); got != 1 {
+		t.Errorf("unknown processor: limit %d", got)
+	}
+	for value, want := range map[string]int{"4": 4, "32": 8, "0": 1, "many": 1} {
+		noteProcessorBatchLimit(url, http.Header{"X-Batch-Limit": {value}})
+		if got := batchLimit(variantStable, "htdemucs"); got != want {
+			t.Errorf("X-Batch-Limit %s: limit %d, want %d", value, got, want)
+		}
+	}
+	noteProcessorBatchLimit(url, http.Header{"X-Batch-Limit": {"4"}})
+	t.Setenv("BATCH_MAX_JOBS", "1")
+	if got := batchLimit(variantStable, "htdemucs"); got != 1 {
+		t.Errorf("BATCH_MAX_JOBS=1: limit %d", got)
+	}
+}
+
+func TestIntegrationBatchedClips(t *testing.T) {
+	fakeFFprobe(t, `{"streams":[{"codec_name":"mp3","sample_rate":"44100","channels":2}],"format":{"format_name":"mp3","duration":"4.5"}}`)
+	b := newIntegrationBackend(t, 1)
+	t.Cleanup(func() {
+		processorBatchLimitsMutex.Lock()
+		delete(processorBatchLimits, b.processor.URL)
+		processorBatchLimitsMutex.Unlock()
+	})
+	b.processor.setBatchLimit(3)
+
+	// Learnt from the first job's response; then hold the worker while
+	// clips queue up behind it
+	b.waitFor(b.upload("first.mp3", nil).ID, "completed")
+	running := b.upload("hang.mp3", nil)
+	b.waitFor(running.ID, "processing")
+	a := b.upload("a.mp3", nil)
+	failing := b.upload("fail.mp3", nil)
+	isolated := b.upload("isolated.mp3", map[string]string{"stem_mode": "isolate", "isolate_stem": "vocals"})
+	second := b.upload("b.mp3", nil)
+	last := b.upload("c.mp3", nil)
+	req, _ := http.NewRequest("DELETE", b.URL+"/api/jobs/"+running.ID, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	first, other := b.waitFor(a.ID, "completed"), b.waitFor(second.ID, "completed")
+	if first.ProcessorBatch == "" || first.ProcessorBatch != other.ProcessorBatch || len(first.OutputFiles) == 0 || len(other.OutputFiles) == 0 {
+		t.Errorf("batched jobs = %+v, %+v", first, other)
+	}
+	if job := b.waitFor(failing.ID, "failed"); job.Error != "Processor failed: Demucs exited with status 1" || job.ProcessorBatch != first.ProcessorBatch {
+		t.Errorf("failed clip = %+v", job)
+	}
+	for _, id := range []string{isolated.ID, last.ID} {
+		if job := b.waitFor(id, "completed"); job.ProcessorBatch != "" {
+			t.Errorf("%s sent in batch %s", job.FileName, job.ProcessorBatch)
+		}
+	}
+
+	batched := 0
+	for _, fields := range b.processor.Requests() {
+		if fields["batch"] != "" {
+			batched++
+			if fields["batch"] != "3" || fields["stem_mode"] != "all" {
+				t.Errorf("batched request fields = %v", fields)
+			}
+		}
+	}
+	if batched != 3 {
+		t.Errorf("%d clips batched, want 3", batched)
+	}
+}
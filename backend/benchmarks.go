@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Model benchmarks (POST /api/benchmarks). One upload is separated with
+// each of the listed models, as ordinary jobs of the requester that are
+// never served from the deduplication cache, and once every run has
+// finished the results are compared:
+//
+//   - per run, the processing time, the spectral flatness of each stem
+//     (higher means more broadband noise and bleed) and how well the stems
+//     add back up to the input (mix_correlation and
+//     mix_log_spectral_distance_db, the /api/compare metrics of the summed
+//     stems against the upload);
+//   - per pair of models, how closely their common stems agree.
+//
+// The benchmark keeps its own copy of the upload until the comparison is
+// done; benchmarks are kept in memory.
+
+const (
+	maxBenchmarkModels = 6
+	benchmarkTimeout   = 6 * time.Hour // per run, queueing included
+)
+
+// BenchmarkRun is one model's job in a benchmark
+type BenchmarkRun struct {
+	Model                    string             `json:"model"`
+	JobID                    string             `json:"job_id"`
+	JobURL                   string             `json:"job_url"`
+	DownloadURL              string             `json:"download_url"` // ZIP of the stems
+	Status                   string             `json:"status"`
+	Error                    string             `json:"error,omitempty"`
+	ProcessingSeconds        float64            `json:"processing_seconds,omitempty"`
+	Stems                    []string           `json:"stems,omitempty"`
+	Flatness                 map[string]float64 `json:"spectral_flatness,omitempty"` // by stem
+	MixCorrelation           float64            `json:"mix_correlation,omitempty"`
+	MixLogSpectralDistanceDB float64            `json:"mix_log_spectral_distance_db,omitempty"`
+}
+
+// BenchmarkPair compares the common stems of two models' runs
+type BenchmarkPair struct {
+	ModelA                   string  `json:"model_a"`
+	ModelB                   string  `json:"model_b"`
+	Stems                    int     `json:"stems"` // compared
+	AvgCorrelation           float64 `json:"avg_correlation"`
+	AvgLogSpectralDistanceDB float64 `json:"avg_log_spectral_distance_db"`
+}
+
+// Benchmark runs one upload through several models
+type Benchmark struct {
+	ID          string          `json:"id"`
+	Status      string          `json:"status"` // running, completed
+	FileName    string          `json:"filename"`
+	Models      []string        `json:"models"`
+	CreatedAt   time.Time       `json:"created_at"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+	Runs        []BenchmarkRun  `json:"runs"`
+	Matrix      []BenchmarkPair `json:"matrix,omitempty"`
+
+	apiKeyID  string
+	inputPath string // copy of the upload, removed once compared
+}
+
+var (
+	benchmarks      = make(map[string]*Benchmark)
+	benchmarksMutex = &sync.Mutex{}
+)
+
+// parseBenchmarkModels reads the comma-separated models field
+func parseBenchmarkModels(v string) ([]string, error) {
+	var models []string
+	for _, m := range strings.Split(v, ",") {
+		if m = strings.TrimSpace(m); m == "" || slices.Contains(models, m) {
+			continue
+		}
+		if !isAllowedModel(m) {
+			return nil, fmt.Errorf("Invalid model value: %s", m)
+		}
+		models = append(models, m)
+	}
+	if len(models) < 2 || len(models) > maxBenchmarkModels {
+		return nil, fmt.Errorf("models must list 2 to %d models", maxBenchmarkModels)
+	}
+	return models, nil
+}
+
+// benchmarkView copies a benchmark for the API. Callers hold benchmarksMutex.
+func benchmarkView(b *Benchmark) Benchmark {
+	view := *b
+	view.Runs = slices.Clone(b.Runs)
+	if b.Status == "running" {
+		jobsMutex.RLock()
+		for i, run := range view.Runs {
+			if job, exists := jobs[run.JobID]; exists {
+				view.Runs[i].Status = job.Status
+			}
+		}
+		jobsMutex.RUnlock()
+	}
+	return view
+}
+
+// createBenchmarkHandler accepts a file and the models to run it through:
+// POST /api/benchmarks with file, models=htdemucs,htdemucs_ft,mdx_extra and
+// the /api/upload options every run shares
+func createBenchmarkHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseMultipartForm(32 << 20)
+	if isBodyTooLarge(err) {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Failed to get file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if r.FormValue("model") != "" {
+		http.Error(w, "Benchmarks take models, not model", http.StatusBadRequest)
+		return
+	}
+	models, err := parseBenchmarkModels(r.FormValue("models"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := parseJobOptions(r.FormValue)
+	if err == nil {
+		err = opts.checkFields(formFieldNames(r), formFields("file", "models"), strictOptions(r))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Cached stems would say nothing about the model's speed
+	opts.Force = true
+	for _, model := range models {
+		runOpts := opts
+		runOpts.Model = model
+		if e := checkTier(r.Context(), runOpts, ""); e != nil {
+			writeJSON(w, http.StatusForbidden, e)
+			return
+		}
+	}
+
+	b := &Benchmark{
+		ID:        uuid.New().String(),
+		Status:    "running",
+		FileName:  sanitizeFilename(header.Filename),
+		Models:    models,
+		CreatedAt: time.Now().UTC(),
+		apiKeyID:  apiKeyID(r.Context()),
+	}
+	b.inputPath = filepath.Join(uploadDir, "benchmark-"+b.ID+"_"+b.FileName)
+	dst, err := os.Create(b.inputPath)
+	if err == nil {
+		_, err = io.Copy(dst, file)
+		dst.Close()
+	}
+	if err != nil {
+		os.Remove(b.inputPath)
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+	for _, model := range models {
+		runOpts := opts
+		runOpts.Model = model
+		job, uerr := storeUpload(r.Context(), header, runOpts, "")
+		if uerr != nil {
+			b.Runs = append(b.Runs, BenchmarkRun{Model: model, Status: "failed", Error: uerr.Message})
+			continue
+		}
+		b.Runs = append(b.Runs, BenchmarkRun{
+			Model: model, JobID: job.ID, Status: "queued",
+			JobURL: "/api/jobs/" + job.ID, DownloadURL: "/api/download/" + job.ID + "/all",
+		})
+	}
+
+	benchmarksMutex.Lock()
+	benchmarks[b.ID] = b
+	view := benchmarkView(b)
+	benchmarksMutex.Unlock()
+	go runBenchmark(b)
+	writeJSON(w, http.StatusAccepted, view)
+}
+
+// runBenchmark waits for every run, then compares them
+func runBenchmark(b *Benchmark) {
+	benchmarksMutex.Lock()
+	runs := slices.Clone(b.Runs)
+	benchmarksMutex.Unlock()
+
+	done := make(map[string]Job) // completed runs by model
+	for i, run := range runs {
+		if run.JobID == "" {
+			continue
+		}
+		job, ok := waitForSelfTestJob(run.JobID, benchmarkTimeout)
+		switch {
+		case !ok:
+			runs[i].Status, runs[i].Error = "failed", fmt.Sprintf("Timed out after %s", benchmarkTimeout)
+		case job.Status != "completed":
+			runs[i].Status, runs[i].Error = job.Status, job.Error
+		default:
+			runs[i].Status = job.Status
+			runs[i].ProcessingSeconds = parseProcessingTime(job.ProcessingTime)
+			done[run.Model] = job
+		}
+	}
+
+	input, err := decodeMonoPCM(b.inputPath, compareSampleRate)
+	os.Remove(b.inputPath)
+	if err != nil && len(done) > 0 {
+		log.Printf("Benchmark %s: failed to decode the upload: %v", b.ID, err)
+	}
+	for i := range runs {
+		if job, ok := done[runs[i].Model]; ok && err == nil {
+			if e := measureBenchmarkRun(&runs[i], job, input); e != nil {
+				runs[i].Error = e.Error()
+			}
+		}
+	}
+	matrix := compareBenchmarkRuns(b.Models, done)
+
+	benchmarksMutex.Lock()
+	now := time.Now().UTC()
+	b.Runs, b.Matrix = runs, matrix
+	b.Status, b.CompletedAt = "completed", &now
+	benchmarksMutex.Unlock()
+	log.Printf("Benchmark %s: compared %d of %d models", b.ID, len(done), len(b.Models))
+}
+
+// benchmarkStems returns a job's separated stems, without mixes and extra
+// formats
+func benchmarkStems(job Job) []string {
+	var stems []string
+	for _, stem := range sortedKeys(job.OutputFiles) {
+		if !isMixOutput(stem) && !isFormatOutput(stem) && safeOutputPath(job.OutputFiles[stem]) {
+			stems = append(stems, stem)
+		}
+	}
+	return stems
+}
+
+// measureBenchmarkRun fills in the stem flatness and how the summed stems
+// compare with the input
+func measureBenchmarkRun(run *BenchmarkRun, job Job, input []int16) error {
+	run.Stems = benchmarkStems(job)
+	run.Flatness = make(map[string]float64)
+	sum := make([]float64, len(input))
+	for _, stem := range run.Stems {
+		samples, err := decodeMonoPCM(job.OutputFiles[stem], compareSampleRate)
+		if err != nil {
+			return fmt.Errorf("Failed to decode %s: %v", stem, err)
+		}
+		signal := int16ToFloat(samples)
+		run.Flatness[stem] = round3(spectralFlatness(magnitudeSpectrogram(signal, compareFrameSize, compareHop)))
+		for i := range min(len(sum), len(signal)) {
+			sum[i] += signal[i]
+		}
+	}
+	c := compareSignals(int16ToFloat(input), sum, compareSampleRate)
+	run.MixCorrelation, run.MixLogSpectralDistanceDB = round3(c.Correlation), round3(c.LogSpectralDistanceDB)
+	return nil
+}
+
+// compareBenchmarkRuns compares every pair of completed runs one stem at
+// a time, so at most one decoded stem per model is held in memory
+func compareBenchmarkRuns(models []string, done map[string]Job) []BenchmarkPair {
+	var completed []string
+	for _, m := range models {
+		if _, ok := done[m]; ok {
+			completed = append(completed, m)
+		}
+	}
+	pairs := make(map[[2]string]*BenchmarkPair)
+	var order [][2]string
+	for i, a := range completed {
+		for _, b := range completed[i+1:] {
+			key := [2]string{a, b}
+			pairs[key] = &BenchmarkPair{ModelA: a, ModelB: b}
+			order = append(order, key)
+		}
+	}
+
+	stems := map[string]bool{}
+	for _, m := range completed {
+		for _, stem := range benchmarkStems(done[m]) {
+			stems[stem] = true
+		}
+	}
+	for _, stem := range sortedKeys(stems) {
+		decoded := make(map[string][]float64)
+		for _, m := range completed {
+			if path, ok := done[m].OutputFiles[stem]; ok && safeOutputPath(path) {
+				if samples, err := decodeMonoPCM(path, compareSampleRate); err == nil {
+					decoded[m] = int16ToFloat(samples)
+				}
+			}
+		}
+		for _, key := range order {
+			a, okA := decoded[key[0]]
+			b, okB := decoded[key[1]]
+			if !okA || !okB {
+				continue
+			}
+			c := compareSignals(a, b, compareSampleRate)
+			p := pairs[key]
+			p.Stems++
+			p.AvgCorrelation += c.Correlation
+			p.AvgLogSpectralDistanceDB += c.LogSpectralDistanceDB
+		}
+	}
+
+	var matrix []BenchmarkPair
+	for _, key := range order {
+		p := pairs[key]
+		if p.Stems > 0 {
+			p.AvgCorrelation = round3(p.AvgCorrelation / float64(p.Stems))
+			p.AvgLogSpectralDistanceDB = round3(p.AvgLogSpectralDistanceDB / float64(p.Stems))
+		}
+		matrix = append(matrix, *p)
+	}
+	return matrix
+}
+
+func round3(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// lookupBenchmark finds a benchmark the request may see; keys only see
+// their own
+func lookupBenchmark(w http.ResponseWriter, r *http.Request) (*Benchmark, bool) {
+	benchmarksMutex.Lock()
+	b, exists := benchmarks[mux.Vars(r)["id"]]
+	benchmarksMutex.Unlock()
+	if id := apiKeyID(r.Context()); !exists || (id != "" && b.apiKeyID != id) {
+		http.Error(w, "Benchmark not found", http.StatusNotFound)
+		return nil, false
+	}
+	return b, true
+}
+
+// getBenchmarkHandler serves GET /api/benchmarks/{id}
+func getBenchmarkHandler(w http.ResponseWriter, r *http.Request) {
+	b, ok := lookupBenchmark(w, r)
+	if !ok {
+		return
+	}
+	benchmarksMutex.Lock()
+	view := benchmarkView(b)
+	benchmarksMutex.Unlock()
+	writeJSON(w, http.StatusOK, view)
+}
+
+// listBenchmarksHandler serves GET /api/benchmarks, newest first
+func listBenchmarksHandler(w http.ResponseWriter, r *http.Request) {
+	id := apiKeyID(r.Context())
+	benchmarksMutex.Lock()
+	list := []Benchmark{}
+	for _, b := range benchmarks {
+		if id == "" || b.apiKeyID == id {
+			list = append(list, benchmarkView(b))
+		}
+	}
+	benchmarksMutex.Unlock()
+	slices.SortFunc(list, func(a, b Benchmark) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseBenchmarkModels(t *testing.T) {
+	if models, err := parseBenchmarkModels("htdemucs, htdemucs_ft,htdemucs"); err != nil || len(models) != 2 {
+		t.Errorf("models = %v, %v", models, err)
+	}
+	for _, bad := range []string{"", "htdemucs", "htdemucs,cowbell", "htdemucs,htdemucs_ft,htdemucs_6s,mdx,mdx_extra,mdx_q,mdx_extra_q"} {
+		if _, err := parseBenchmarkModels(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestIntegrationBenchmark(t *testing.T) {
+	oldPoll := selfTestPollInterval
+	selfTestPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() {
+		selfTestPollInterval = oldPoll
+		benchmarksMutex.Lock()
+		benchmarks = make(map[string]*Benchmark)
+		benchmarksMutex.Unlock()
+	})
+	// ffmpeg "decodes" by passing the file through
+	dir := t.TempDir()
+	script := "#!/bin/sh\nwhile [ $# -gt 0 ]; do if [ \"$1\" = -i ]; then cat \"$2\"; exit; fi; shift; done\n"
+	os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0755)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	b := newIntegrationBackend(t, 2)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "song.mp3")
+	part.Write(bytes.Repeat([]byte("ID3 song of the year "), 2000))
+	mw.WriteField("models", "htdemucs,htdemucs_ft,mdx_extra")
+	mw.Close()
+	resp, err := http.Post(b.URL+"/api/benchmarks", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	var bench Benchmark
+	if json.Unmarshal(data, &bench); resp.StatusCode != http.StatusAccepted || len(bench.Runs) != 3 {
+		t.Fatalf("create benchmark = %d: %s", resp.StatusCode, data)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for bench.Status != "completed" {
+		if time.Now().After(deadline) {
+			t.Fatalf("benchmark is still %s", bench.Status)
+		}
+		time.Sleep(20 * time.Millisecond)
+		_, data := b.get("/api/benchmarks/" + bench.ID)
+		json.Unmarshal(data, &bench)
+	}
+	for _, run := range bench.Runs {
+		if run.Status != "completed" || run.Error != "" || len(run.Stems) != 4 || len(run.Flatness) != 4 || run.MixCorrelation == 0 {
+			t.Errorf("%s run = %+v", run.Model, run)
+		}
+		if job := b.job(run.JobID); job.Model != run.Model || job.CacheHit {
+			t.Errorf("%s job = %s, cache hit %v", run.Model, job.Model, job.CacheHit)
+		}
+		if code, _ := b.get(run.DownloadURL); code != http.StatusOK {
+			t.Errorf("%s download = %d", run.Model, code)
+		}
+	}
+	// The mock processor makes the same stems whatever the model
+	if len(bench.Matrix) != 3 || bench.Matrix[0].AvgCorrelation != 1 || bench.Matrix[0].ModelA != "htdemucs" || bench.Matrix[0].ModelB != "htdemucs_ft" || bench.Matrix[0].Stems != 4 {
+		t.Errorf("matrix = %+v", bench.Matrix)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "benchmark-"+bench.ID+"_song.mp3")); !os.IsNotExist(err) {
+		t.Errorf("benchmark copy of the upload is still there: %v", err)
+	}
+}
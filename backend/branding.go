@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"os"
+)
+
+// Branding lets self-hosters white-label the UI from environment variables
+// (BRANDING_*) without rebuilding the frontend, which loads it on startup.
+
+// Branding is the response of GET /api/branding
+type Branding struct {
+	Name     string            `json:"name"`
+	Tagline  string            `json:"tagline"`
+	LogoURL  string            `json:"logo_url,omitempty"`
+	Links    map[string]string `json:"links"` // terms, privacy, imprint, support
+	Limits   brandingLimits    `json:"limits"`
+	Features map[string]bool   `json:"features"`
+}
+
+type brandingLimits struct {
+	MaxUploadBytes int64               `json:"max_upload_bytes"`
+	MaxChunkBytes  int64               `json:"max_chunk_bytes"`
+	PreviewSeconds int                 `json:"preview_seconds"`
+	OutputFormats  []string            `json:"output_formats"`
+	Models         []string            `json:"models"`
+	ModelStems     map[string][]string `json:"model_stems"` // what each model separates
+	Stems          []string            `json:"stems"`
+}
+
+// brandingLinkEnv maps link names to the variables that set them
+var brandingLinkEnv = map[string]string{
+	"terms":   "BRANDING_TERMS_URL",
+	"privacy": "BRANDING_PRIVACY_URL",
+	"imprint": "BRANDING_IMPRINT_URL",
+	"support": "BRANDING_SUPPORT_URL",
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func brandingFromEnv() Branding {
+	b := Branding{
+		Name:    envOr("BRANDING_NAME", "Track2stem"),
+		Tagline: envOr("BRANDING_TAGLINE", "Turn any track into multi-stem"),
+		LogoURL: os.Getenv("BRANDING_LOGO_URL"),
+		Links:   map[string]string{},
+		Limits: brandingLimits{
+			MaxUploadBytes: maxUploadBytes,
+			MaxChunkBytes:  maxUploadChunkBytes,
+			PreviewSeconds: previewSeconds(),
+			OutputFormats:  sortedKeys(allowedOutputFormats),
+			Models:         modelNames(),
+			Stems:          sortedKeys(allowedStems),
+		},
+	}
+	b.Limits.ModelStems = make(map[string][]string, len(b.Limits.Models))
+	for _, name := range b.Limits.Models {
+		b.Limits.ModelStems[name] = modelStems(name)
+	}
+	for name, key := range brandingLinkEnv {
+		if v := os.Getenv(key); v != "" {
+			b.Links[name] = v
+		}
+	}
+
+	b.Features = map[string]bool{
+		"chunked_uploads":  true,
+		"packaging":        true,
+		"share_links":      true,
+		"stream_tokens":    true,
+		"webhooks":         true,
+		"public_gallery":   galleryEnabled(),
+		"terms_required":   currentTerms().Required,
+		"external_workers": externalWorkers,
+		"virus_scanning":   virusScannerFromEnv() != nil,
+	}
+	for _, target := range []string{"local", "s3", "sftp", "webdav", "drive", "dropbox"} {
+		_, err := lookupExporter(target)
+		// A configured but unlinked cloud account still offers the feature
+		b.Features["delivery_"+target] = err == nil || err.Error() == "Storage not linked"
+	}
+	return b
+}
+
+func brandingHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, brandingFromEnv())
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBrandingFromEnv(t *testing.T) {
+	t.Setenv("BRANDING_NAME", "Studio Stems")
+	t.Setenv("BRANDING_TERMS_URL", "https://studio.example.com/terms")
+	t.Setenv("PUBLIC_GALLERY", "true")
+	t.Setenv("LOCAL_EXPORT_DIR", t.TempDir())
+
+	rec := httptest.NewRecorder()
+	brandingHandler(rec, httptest.NewRequest("GET", "/api/branding", nil))
+	var b Branding
+	if err := json.Unmarshal(rec.Body.Bytes(), &b); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("branding = %d %s", rec.Code, rec.Body.String())
+	}
+	if b.Name != "Studio Stems" || b.Tagline == "" || b.Links["terms"] != "https://studio.example.com/terms" {
+		t.Errorf("branding = %+v", b)
+	}
+	if _, ok := b.Links["privacy"]; ok {
+		t.Error("unset links should be omitted")
+	}
+	if b.Limits.MaxUploadBytes != maxUploadBytes || len(b.Limits.Models) == 0 {
+		t.Errorf("limits = %+v", b.Limits)
+	}
+	if !b.Features["public_gallery"] || !b.Features["delivery_local"] || b.Features["delivery_s3"] {
+		t.Errorf("features = %v", b.Features)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Job callbacks. An upload with callback_url (and optionally
+// callback_secret) gets a POST to that URL once its job completes, fails or
+// is cancelled, so pipelines don't have to poll GET /api/jobs/{id}. The body
+// is a callbackPayload; with a secret it is signed like webhook deliveries
+// (X-Track2stem-Signature: sha256=<hex HMAC>). Failed deliveries are
+// retried with the webhooks' exponential backoff.
+
+// jobCancelledMessage is the error of a job deleted before it finished
+const jobCancelledMessage = "Cancelled by user"
+
+// Callback event types; job.cancelled is a job.deleted of an unfinished job
+const (
+	callbackCompleted = "job.completed"
+	callbackFailed    = "job.failed"
+	callbackCancelled = "job.cancelled"
+)
+
+// jobCallbacks holds each job's callback deliveries, guarded by webhooksMutex
+var jobCallbacks = make(map[string][]*WebhookDelivery)
+
+// callbackPayload is the JSON body POSTed to a job's callback_url
+type callbackPayload struct {
+	Event         string            `json:"event"`
+	EventID       string            `json:"event_id"`
+	SchemaVersion int               `json:"schema_version"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Job           Job               `json:"job"`
+	Downloads     map[string]string `json:"downloads,omitempty"` // stem -> download URL
+}
+
+// callbackEvent maps a lifecycle event to the callback it triggers, if any
+func callbackEvent(e Event) (string, bool) {
+	switch e.Type {
+	case EventJobCompleted:
+		return callbackCompleted, true
+	case EventJobFailed:
+		return callbackFailed, true
+	case EventJobDeleted:
+		if e.Job.Error == jobCancelledMessage {
+			return callbackCancelled, true
+		}
+	}
+	return "", false
+}
+
+// callbackDownloads returns the download URL of every output of a job,
+// absolute when PUBLIC_BASE_URL is set
+func callbackDownloads(job Job) map[string]string {
+	if len(job.OutputFiles) == 0 {
+		return nil
+	}
+	base := strings.TrimSuffix(os.Getenv("PUBLIC_BASE_URL"), "/")
+	downloads := make(map[string]string, len(job.OutputFiles))
+	for stem := range job.OutputFiles {
+		downloads[stem] = base + "/api/download/" + job.ID + "/" + url.PathEscape(stem)
+	}
+	return downloads
+}
+
+// dispatchJobCallback is the event listener that calls jobs' callback URLs
+func dispatchJobCallback(e Event) {
+	if e.Job.CallbackURL == "" {
+		return
+	}
+	eventType, ok := callbackEvent(e)
+	if !ok {
+		return
+	}
+	job := e.Job
+	job.QueuePosition = 0
+	payload, err := json.Marshal(callbackPayload{
+		Event:         eventType,
+		EventID:       e.ID,
+		SchemaVersion: eventSchemaVersion,
+		CreatedAt:     e.CreatedAt,
+		Job:           job,
+		Downloads:     callbackDownloads(job),
+	})
+	if err != nil {
+		log.Printf("Failed to encode callback of job %s: %v", job.ID, err)
+		return
+	}
+
+	d := &WebhookDelivery{
+		ID:        uuid.New().String(),
+		EventID:   e.ID,
+		EventType: eventType,
+		Status:    "pending",
+		CreatedAt: time.Now().UTC(),
+		payload:   payload,
+		target:    job.CallbackURL,
+		secret:    job.callbackSecret,
+	}
+	webhooksMutex.Lock()
+	jobCallbacks[job.ID] = append(jobCallbacks[job.ID], d)
+	webhooksMutex.Unlock()
+	go sendWebhook(d)
+}
+
+// listCallbacksHandler returns a job's callback deliveries, oldest first.
+// They outlive the job so a cancellation's callback can still be checked.
+func listCallbacksHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+	if !isValidJobID(jobID) {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	webhooksMutex.RLock()
+	history, known := jobCallbacks[jobID]
+	list := make([]WebhookDelivery, 0, len(history))
+	for _, d := range history {
+		list = append(list, *d)
+	}
+	webhooksMutex.RUnlock()
+	if !known {
+		jobsMutex.RLock()
+		_, exists := jobs[jobID]
+		jobsMutex.RUnlock()
+		if !exists {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func TestJobCallbackRetriesAndSigns(t *testing.T) {
+	t.Setenv("OUTBOUND_ALLOW_PRIVATE", "true") // the test endpoint listens on loopback
+	t.Setenv("PUBLIC_BASE_URL", "https://stems.example.com/")
+	oldBase := webhookRetryBase
+	webhookRetryBase = 10 * time.Millisecond
+	t.Cleanup(func() { webhookRetryBase = oldBase })
+
+	type delivery struct {
+		signature string
+		body      []byte
+	}
+	received := make(chan delivery, 4)
+	var attempts atomic.Int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received <- delivery{r.Header.Get("X-Track2stem-Signature"), body}
+	}))
+	defer endpoint.Close()
+
+	opts, err := parseJobOptions(url.Values{"callback_url": {endpoint.URL + "/done"}, "callback_secret": {"s3cret"}}.Get)
+	if err != nil {
+		t.Fatalf("parseJobOptions: %v", err)
+	}
+	jobID := uuid.New().String()
+	job := newJob(jobID, "song.mp3", opts)
+	job.Status = "completed"
+	job.OutputFiles = map[string]string{"vocals": "/app/outputs/" + jobID + "/song_t2s_vocals.mp3"}
+	t.Cleanup(func() {
+		webhooksMutex.Lock()
+		delete(jobCallbacks, jobID)
+		webhooksMutex.Unlock()
+	})
+
+	dispatchJobCallback(Event{ID: "e1", Type: EventJobProcessing, Job: job.snapshot()})
+	dispatchJobCallback(Event{ID: "e2", Type: EventJobCompleted, Job: job.snapshot()})
+	var got delivery
+	select {
+	case got = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback not delivered")
+	}
+	if got.signature != signWebhookPayload("s3cret", got.body) {
+		t.Errorf("signature %q doesn't match the body", got.signature)
+	}
+	var payload callbackPayload
+	json.Unmarshal(got.body, &payload)
+	if payload.Event != "job.completed" || payload.Job.ID != jobID ||
+		payload.Downloads["vocals"] != "https://stems.example.com/api/download/"+jobID+"/vocals" {
+		t.Errorf("payload = %s", got.body)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/jobs/{id}/callbacks", listCallbacksHandler)
+	deadline := time.Now().Add(time.Second)
+	var list []WebhookDelivery
+	for time.Now().Before(deadline) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/jobs/"+jobID+"/callbacks", nil))
+		json.Unmarshal(rec.Body.Bytes(), &list)
+		if len(list) == 1 && list[0].Status == "succeeded" {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(list) != 1 || list[0].Status != "succeeded" || list[0].Attempts != 2 || list[0].EventType != "job.completed" {
+		t.Errorf("callback deliveries = %+v", list)
+	}
+}
+
+func TestCallbackEvents(t *testing.T) {
+	if _, err := parseJobOptions(url.Values{"callback_url": {"ftp://example.com/x"}}.Get); err == nil {
+		t.Error("expected a non-HTTP callback_url to be rejected")
+	}
+	for _, tc := range []struct {
+		event Event
+		want  string
+	}{
+		{Event{Type: EventJobFailed}, "job.failed"},
+		{Event{Type: EventJobDeleted, Job: Job{Status: "failed", Error: jobCancelledMessage}}, "job.cancelled"},
+		{Event{Type: EventJobDeleted, Job: Job{Status: "completed"}}, ""},
+		{Event{Type: EventJobCreated}, ""},
+	} {
+		if got, _ := callbackEvent(tc.event); got != tc.want {
+			t.Errorf("callbackEvent(%s, %s) = %q, want %q", tc.event.Type, tc.event.Job.Status, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/crc32"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Canary rollouts send CANARY_PERCENT of new jobs to a new processor
+// (CANARY_PROCESSOR_URL) and/or model (CANARY_MODEL, replacing
+// CANARY_BASE_MODEL). Every job is tagged with its variant while a canary is
+// configured, and /api/admin/stats compares the variants' failure rates and
+// user ratings (POST /api/jobs/{id}/rating) before a full rollout.
+
+const (
+	variantStable = "stable"
+	variantCanary = "canary"
+)
+
+// canaryConfig is the rollout read from the environment
+type canaryConfig struct {
+	Percent      int
+	ProcessorURL string
+	Model        string
+	BaseModel    string
+}
+
+func canaryFromEnv() canaryConfig {
+	c := canaryConfig{
+		ProcessorURL: os.Getenv("CANARY_PROCESSOR_URL"),
+		Model:        os.Getenv("CANARY_MODEL"),
+		BaseModel:    os.Getenv("CANARY_BASE_MODEL"),
+	}
+	if n, err := strconv.Atoi(os.Getenv("CANARY_PERCENT")); err == nil && n > 0 && n <= 100 {
+		c.Percent = n
+	}
+	if !isAllowedModel(c.Model) || !isAllowedModel(c.BaseModel) {
+		c.Model, c.BaseModel = "", ""
+	}
+	return c
+}
+
+func (c canaryConfig) enabled() bool {
+	return c.Percent > 0 && (c.ProcessorURL != "" || c.Model != "")
+}
+
+// assignVariant tags a new job stable or canary. Jobs are split by a hash
+// of their ID, so a job keeps its variant if it is dispatched again. Model
+// canaries only take jobs that asked for the base model.
+func assignVariant(job *Job) {
+	c := canaryFromEnv()
+	if !c.enabled() {
+		return
+	}
+	job.Variant = variantStable
+	if c.ProcessorURL == "" && job.Model != c.BaseModel {
+		return
+	}
+	if int(crc32.ChecksumIEEE([]byte(job.ID))%100) >= c.Percent {
+		return
+	}
+	job.Variant = variantCanary
+	if c.Model != "" && job.Model == c.BaseModel {
+		job.Model = c.Model
+	}
+}
+
+// defaultProcessorURL is where the processor is expected without PROCESSOR_URL
+const defaultProcessorURL = "http://localhost:5000"
+
+// processorBaseURL reads PROCESSOR_URL, the processor used when PROCESSORS
+// isn't set
+func processorBaseURL() string {
+	if url := os.Getenv("PROCESSOR_URL"); url != "" {
+		return url
+	}
+	return defaultProcessorURL
+}
+
+// processorURLFor returns the processor that handles a job's variant,
+// falling back to processorBaseURL
+func processorURLFor(variant string) string {
+	if variant == variantCanary {
+		if url := os.Getenv("CANARY_PROCESSOR_URL"); url != "" {
+			return url
+		}
+	}
+	return processorBaseURL()
+}
+
+// rateJobHandler records a user's 1-5 quality rating of a completed job:
+// POST /api/jobs/{id}/rating with {"score": 4}
+func rateJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupCompletedJob(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Score int `json:"score"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Score < 1 || req.Score > 5 {
+		http.Error(w, "Invalid score value", http.StatusBadRequest)
+		return
+	}
+	jobsMutex.Lock()
+	if j, exists := jobs[job.ID]; exists {
+		j.Rating = req.Score
+	}
+	jobsMutex.Unlock()
+	writeJSON(w, http.StatusOK, map[string]int{"score": req.Score})
+}
+
+// variantStats summarises the jobs of one variant
+type variantStats struct {
+	Jobs        int     `json:"jobs"`
+	Completed   int     `json:"completed"`
+	Failed      int     `json:"failed"`
+	FailureRate float64 `json:"failure_rate"` // failed / finished
+	Rated       int     `json:"rated"`
+	AvgRating   float64 `json:"avg_rating,omitempty"`
+}
+
+// canaryStats compares the variants for the admin stats. Callers hold
+// jobsMutex.
+func canaryStats() map[string]*variantStats {
+	stats := map[string]*variantStats{}
+	ratings := map[string]int{}
+	for _, job := range jobs {
+		if job.Variant == "" {
+			continue
+		}
+		s, ok := stats[job.Variant]
+		if !ok {
+			s = &variantStats{}
+			stats[job.Variant] = s
+		}
+		s.Jobs++
+		switch job.Status {
+		case "completed":
+			s.Completed++
+		case "failed":
+			s.Failed++
+		}
+		if job.Rating > 0 {
+			s.Rated++
+			ratings[job.Variant] += job.Rating
+		}
+	}
+	for variant, s := range stats {
+		if finished := s.Completed + s.Failed; finished > 0 {
+			s.FailureRate = float64(s.Failed) / float64(finished)
+		}
+		if s.Rated > 0 {
+			s.AvgRating = float64(ratings[variant]) / float64(s.Rated)
+		}
+	}
+	return stats
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestAssignVariant(t *testing.T) {
+	t.Setenv("CANARY_PERCENT", "20")
+	t.Setenv("CANARY_MODEL", "htdemucs_ft")
+	t.Setenv("CANARY_BASE_MODEL", "htdemucs")
+
+	canaries := 0
+	for i := 0; i < 1000; i++ {
+		job := &Job{ID: uuid.New().String(), Model: "htdemucs"}
+		assignVariant(job)
+		switch {
+		case job.Variant == variantCanary && job.Model == "htdemucs_ft":
+			canaries++
+		case job.Variant != variantStable || job.Model != "htdemucs":
+			t.Fatalf("job = %+v", job)
+		}
+	}
+	if canaries < 120 || canaries > 280 {
+		t.Errorf("%d of 1000 jobs were canaries, want about 200", canaries)
+	}
+
+	// Other models aren't part of a model canary
+	job := &Job{ID: "j", Model: "htdemucs_6s"}
+	t.Setenv("CANARY_PERCENT", "100")
+	assignVariant(job)
+	if job.Variant != variantStable || job.Model != "htdemucs_6s" {
+		t.Errorf("6-stem job = %+v, want stable", job)
+	}
+
+	t.Setenv("CANARY_PROCESSOR_URL", "http://processor-next:5000")
+	assignVariant(job)
+	if job.Variant != variantCanary || job.Model != "htdemucs_6s" {
+		t.Errorf("processor canary job = %+v", job)
+	}
+	if url := processorURLFor(job.Variant); url != "http://processor-next:5000" {
+		t.Errorf("canary processor = %s", url)
+	}
+}
+
+func TestProcessorBaseURL(t *testing.T) {
+	// Dispatch, status, cancel and model listings agree without PROCESSOR_URL
+	t.Setenv("PROCESSOR_URL", "")
+	if processorURLFor(variantStable) != defaultProcessorURL || processorURLForJob("no-such-job", "") != defaultProcessorURL {
+		t.Errorf("default processor = %s, %s", processorURLFor(variantStable), processorURLForJob("no-such-job", ""))
+	}
+	t.Setenv("PROCESSOR_URL", "http://processor:5000")
+	if got := processorURLForJob("no-such-job", variantCanary); got != "http://processor:5000" {
+		t.Errorf("canary job without a canary processor = %s", got)
+	}
+}
+
+func TestCanaryStats(t *testing.T) {
+	oldJobs := jobs
+	jobs = map[string]*Job{
+		"a": {Variant: variantStable, Status: "completed", Rating: 4},
+		"b": {Variant: variantStable, Status: "completed", Rating: 2},
+		"c": {Variant: variantCanary, Status: "failed"},
+		"d": {Variant: variantCanary, Status: "completed", Rating: 5},
+		"e": {Variant: variantCanary, Status: "processing"},
+		"f": {Status: "completed"},
+	}
+	t.Cleanup(func() { jobs = oldJobs })
+
+	stats := canaryStats()
+	if s := stats[variantStable]; s.Jobs != 2 || s.FailureRate != 0 || s.AvgRating != 3 {
+		t.Errorf("stable = %+v", s)
+	}
+	if s := stats[variantCanary]; s.Jobs != 3 || s.FailureRate != 0.5 || s.Rated != 1 || s.AvgRating != 5 {
+		t.Errorf("canary = %+v", s)
+	}
+}
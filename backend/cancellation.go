@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Job cancellation. A running job has a context: deleting the job cancels
+// it, and so does shutdown for jobs still running after SHUTDOWN_TIMEOUT.
+// Cancelling aborts the job's processor request at once, instead of
+// leaving it to run into the 30-minute request timeout, and the processor
+// is told through /cancel to stop Demucs. A deleted job is gone; one
+// stopped by shutdown fails with "Server is shutting down".
+
+var (
+	errJobCancelled = errors.New(jobCancelledMessage)
+	errShuttingDown = errors.New("Server is shutting down")
+)
+
+// jobsContext is the parent of every job's context; stopJobs cancels them all
+var jobsContext, stopJobs = context.WithCancelCause(context.Background())
+
+// startContext gives a job that starts processing its context; called with
+// jobsMutex held
+func (j *Job) startContext() (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(jobsContext)
+	j.cancel = cancel
+	return ctx, cancel
+}
+
+// cancelOnProcessor asks the processor running a job to stop it
+func cancelOnProcessor(jobID, variant, reqID string) {
+	processorURL := processorURLForJob(jobID, variant)
+	client := newProcessorClient(10 * time.Second)
+	cancelReq, err := http.NewRequest("POST", processorURL+"/cancel/"+jobID, nil)
+	if err != nil {
+		return
+	}
+	if reqID != "" {
+		cancelReq.Header.Set("X-Request-ID", reqID)
+	}
+	resp, err := client.Do(cancelReq)
+	if err != nil {
+		log.Printf("Failed to cancel job in processor: %v", err)
+		return
+	}
+	resp.Body.Close()
+	log.Printf("Cancelled job %s in processor", jobID)
+}
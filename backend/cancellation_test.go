@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// waitAborted waits for the processor to see a job's request dropped
+func waitAborted(t *testing.T, b *integrationBackend, jobID string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Contains(b.processor.Aborted(), jobID) {
+		if time.Now().After(deadline) {
+			t.Fatalf("request of job %s wasn't aborted", jobID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIntegrationDeleteAbortsProcessorRequest(t *testing.T) {
+	b := newIntegrationBackend(t, 1)
+	// The processor ignores /cancel: only dropping the request frees the worker
+	running := b.upload("stuck.mp3", nil)
+	b.waitFor(running.ID, "processing")
+	waiting := b.upload("song.mp3", nil)
+
+	req, _ := http.NewRequest("DELETE", b.URL+"/api/jobs/"+running.ID, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitAborted(t, b, running.ID)
+	b.waitFor(waiting.ID, "completed")
+	if code, _ := b.get("/api/jobs/" + running.ID); code != http.StatusNotFound {
+		t.Errorf("deleted job = %d", code)
+	}
+}
+
+func TestIntegrationShutdownStopsJobs(t *testing.T) {
+	oldContext, oldStop := jobsContext, stopJobs
+	jobsContext, stopJobs = context.WithCancelCause(context.Background())
+	t.Cleanup(func() { jobsContext, stopJobs = oldContext, oldStop })
+	b := newIntegrationBackend(t, 1)
+
+	running := b.upload("stuck.mp3", nil)
+	b.waitFor(running.ID, "processing")
+	stopJobs(errShuttingDown)
+	if job := b.waitFor(running.ID, "failed"); job.Error != "Server is shutting down" {
+		t.Errorf("stopped job failed with %q", job.Error)
+	}
+	waitAborted(t, b, running.ID)
+	if cancelled := b.processor.Cancelled(); !slices.Contains(cancelled, running.ID) {
+		t.Errorf("processor cancels = %v", cancelled)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CDN downloads. With object storage (STORAGE_BACKEND=s3) and CDN_PROVIDER
+// set, stem downloads redirect to a signed URL on CDN_BASE_URL, a CDN whose
+// origin is the bucket, so audio never passes through the backend:
+//
+//   - cloudfront: a canned-policy signed URL valid for STORAGE_URL_TTL,
+//     signed with CDN_CLOUDFRONT_KEY_PAIR_ID and CDN_CLOUDFRONT_PRIVATE_KEY
+//     (a PEM key or the path of one). Deleted stems are invalidated in
+//     CDN_CLOUDFRONT_DISTRIBUTION_ID with the storage credentials.
+//   - cloudflare: a ?verify= token for a WAF rule checking
+//     is_timed_hmac_valid_v0 with CDN_CLOUDFLARE_TOKEN_SECRET; the rule's
+//     lifetime bounds the URL. Deleted stems are purged from
+//     CDN_CLOUDFLARE_ZONE_ID with CDN_CLOUDFLARE_API_TOKEN.
+//
+// CDN paths are the object keys, including STORAGE_S3_PREFIX. Uploads are
+// never sent through the CDN.
+
+var (
+	cloudfrontAPI = "https://cloudfront.amazonaws.com/2020-05-31"
+	cloudflareAPI = "https://api.cloudflare.com/client/v4"
+)
+
+// cloudflarePurgeBatch is the most URLs one purge request may list
+const cloudflarePurgeBatch = 30
+
+// cdnConfig is the configured CDN in front of the storage bucket
+type cdnConfig struct {
+	Provider string // cloudfront or cloudflare
+	BaseURL  string
+	Prefix   string // bucket prefix the keys are stored under
+
+	KeyPairID      string
+	PrivateKey     *rsa.PrivateKey
+	DistributionID string
+
+	TokenSecret string
+	ZoneID      string
+	APIToken    string
+}
+
+// cdnFromEnv returns the configured CDN, nil when there is none, or an error
+// when CDN_PROVIDER is invalid or incomplete
+func cdnFromEnv() (*cdnConfig, error) {
+	c := &cdnConfig{
+		Provider:       os.Getenv("CDN_PROVIDER"),
+		BaseURL:        strings.TrimSuffix(os.Getenv("CDN_BASE_URL"), "/"),
+		Prefix:         strings.Trim(os.Getenv("STORAGE_S3_PREFIX"), "/"),
+		KeyPairID:      os.Getenv("CDN_CLOUDFRONT_KEY_PAIR_ID"),
+		DistributionID: os.Getenv("CDN_CLOUDFRONT_DISTRIBUTION_ID"),
+		TokenSecret:    os.Getenv("CDN_CLOUDFLARE_TOKEN_SECRET"),
+		ZoneID:         os.Getenv("CDN_CLOUDFLARE_ZONE_ID"),
+		APIToken:       os.Getenv("CDN_CLOUDFLARE_API_TOKEN"),
+	}
+	switch c.Provider {
+	case "":
+		return nil, nil
+	case "cloudfront":
+		if c.BaseURL == "" || c.KeyPairID == "" {
+			return nil, fmt.Errorf("CDN_PROVIDER=cloudfront needs CDN_BASE_URL and CDN_CLOUDFRONT_KEY_PAIR_ID")
+		}
+		key, err := parseRSAPrivateKey(os.Getenv("CDN_CLOUDFRONT_PRIVATE_KEY"))
+		if err != nil {
+			return nil, fmt.Errorf("CDN_CLOUDFRONT_PRIVATE_KEY: %v", err)
+		}
+		c.PrivateKey = key
+	case "cloudflare":
+		if c.BaseURL == "" || c.TokenSecret == "" {
+			return nil, fmt.Errorf("CDN_PROVIDER=cloudflare needs CDN_BASE_URL and CDN_CLOUDFLARE_TOKEN_SECRET")
+		}
+	default:
+		return nil, fmt.Errorf("unknown CDN_PROVIDER %q", c.Provider)
+	}
+	return c, nil
+}
+
+// configuredCDN returns the CDN in front of remote storage, if any
+func configuredCDN() (*cdnConfig, bool) {
+	if _, remote := remoteStorage(); !remote {
+		return nil, false
+	}
+	c, err := cdnFromEnv()
+	if err != nil {
+		log.Printf("CDN: %v", err)
+	}
+	return c, c != nil
+}
+
+// parseRSAPrivateKey reads a PKCS#1 or PKCS#8 PEM key, given inline or as
+// the path of a file
+func parseRSAPrivateKey(value string) (*rsa.PrivateKey, error) {
+	data := []byte(value)
+	if !strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		var err error
+		if data, err = os.ReadFile(value); err != nil {
+			return nil, err
+		}
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA key")
+	}
+	return key, nil
+}
+
+// path returns the escaped CDN path of a storage key
+func (c *cdnConfig) path(key string) string {
+	if c.Prefix != "" {
+		key = c.Prefix + "/" + key
+	}
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// signedURL returns a URL for key that the CDN serves until expires
+func (c *cdnConfig) signedURL(key string, now, expires time.Time) (string, error) {
+	path := c.path(key)
+	switch c.Provider {
+	case "cloudfront":
+		resource := c.BaseURL + path
+		policy := fmt.Sprintf(`{"Statement":[{"Resource":"%s","Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`,
+			resource, expires.Unix())
+		sum := sha1.Sum([]byte(policy))
+		sig, err := rsa.SignPKCS1v15(nil, c.PrivateKey, crypto.SHA1, sum[:])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s?Expires=%d&Signature=%s&Key-Pair-Id=%s",
+			resource, expires.Unix(), cloudfrontBase64(sig), url.QueryEscape(c.KeyPairID)), nil
+	default: // cloudflare
+		ts := strconv.FormatInt(now.Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(c.TokenSecret))
+		mac.Write([]byte(path + ts))
+		token := ts + "-" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		return c.BaseURL + path + "?verify=" + url.QueryEscape(token), nil
+	}
+}
+
+// cloudfrontBase64 is base64 with the characters CloudFront expects in URLs
+func cloudfrontBase64(b []byte) string {
+	return strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(base64.StdEncoding.EncodeToString(b))
+}
+
+// invalidate drops the cached copies of keys from the CDN
+func (c *cdnConfig) invalidate(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	switch c.Provider {
+	case "cloudfront":
+		if c.DistributionID == "" {
+			return nil
+		}
+		return c.invalidateCloudFront(ctx, keys)
+	default:
+		if c.ZoneID == "" || c.APIToken == "" {
+			return nil
+		}
+		for start := 0; start < len(keys); start += cloudflarePurgeBatch {
+			end := min(start+cloudflarePurgeBatch, len(keys))
+			if err := c.purgeCloudflare(ctx, keys[start:end]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// cloudfrontInvalidation is the body of a CloudFront CreateInvalidation call
+type cloudfrontInvalidation struct {
+	XMLName         xml.Name `xml:"http://cloudfront.amazonaws.com/doc/2020-05-31/ InvalidationBatch"`
+	Quantity        int      `xml:"Paths>Quantity"`
+	Paths           []string `xml:"Paths>Items>Path"`
+	CallerReference string   `xml:"CallerReference"`
+}
+
+func (c *cdnConfig) invalidateCloudFront(ctx context.Context, keys []string) error {
+	batch := cloudfrontInvalidation{Quantity: len(keys), CallerReference: uuid.New().String()}
+	for _, key := range keys {
+		batch.Paths = append(batch.Paths, c.path(key))
+	}
+	body, err := xml.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	config, ok := s3ConfigFromEnv("STORAGE_S3")
+	if !ok {
+		return fmt.Errorf("no AWS credentials for CloudFront invalidation")
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		cloudfrontAPI+"/distribution/"+url.PathEscape(c.DistributionID)+"/invalidation", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	// CloudFront is a global service signed in us-east-1
+	signer := &s3Config{Region: "us-east-1", AccessKey: config.AccessKey, SecretKey: config.SecretKey, Service: "cloudfront"}
+	sum := sha256.Sum256(body)
+	signer.signV4(req, fmt.Sprintf("%x", sum), time.Now())
+	return doCDNRequest(req)
+}
+
+func (c *cdnConfig) purgeCloudflare(ctx context.Context, keys []string) error {
+	files := make([]string, 0, len(keys))
+	for _, key := range keys {
+		files = append(files, c.BaseURL+c.path(key))
+	}
+	body, _ := json.Marshal(map[string][]string{"files": files})
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		cloudflareAPI+"/zones/"+url.PathEscape(c.ZoneID)+"/purge_cache", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.APIToken)
+	return doCDNRequest(req)
+}
+
+func doCDNRequest(req *http.Request) error {
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// invalidateCDN drops deleted stems from the CDN, if one is configured
+func invalidateCDN(ctx context.Context, keys []string) {
+	c, ok := configuredCDN()
+	if !ok {
+		return
+	}
+	var stems []string
+	for _, key := range keys {
+		if strings.HasPrefix(key, "outputs/") {
+			stems = append(stems, key)
+		}
+	}
+	if err := c.invalidate(ctx, stems); err != nil {
+		log.Printf("CDN: failed to invalidate %d files: %v", len(stems), err)
+	}
+}
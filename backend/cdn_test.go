@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCDNSignedURLs(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CDN_PROVIDER", "cloudfront")
+	t.Setenv("CDN_BASE_URL", "https://d111.cloudfront.net/")
+	t.Setenv("CDN_CLOUDFRONT_KEY_PAIR_ID", "K2JCJMDEHXQW5F")
+	t.Setenv("CDN_CLOUDFRONT_PRIVATE_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})))
+	t.Setenv("STORAGE_S3_PREFIX", "prod")
+	c, err := cdnFromEnv()
+	if err != nil {
+		t.Fatalf("cdnFromEnv: %v", err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	signed, err := c.signedURL("outputs/job/my song.mp3", now, now.Add(15*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(signed)
+	resource := "https://d111.cloudfront.net/prod/outputs/job/my%20song.mp3"
+	if got := u.Scheme + "://" + u.Host + u.EscapedPath(); got != resource || u.Query().Get("Expires") != "1700000900" ||
+		u.Query().Get("Key-Pair-Id") != "K2JCJMDEHXQW5F" {
+		t.Fatalf("CloudFront URL = %s", signed)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(u.Query().Get("Signature")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := `{"Statement":[{"Resource":"` + resource + `","Condition":{"DateLessThan":{"AWS:EpochTime":1700000900}}}]}`
+	sum := sha1.Sum([]byte(policy))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, sum[:], sig); err != nil {
+		t.Errorf("CloudFront signature doesn't verify: %v", err)
+	}
+
+	t.Setenv("CDN_PROVIDER", "cloudflare")
+	t.Setenv("CDN_CLOUDFLARE_TOKEN_SECRET", "s3cret")
+	c, err = cdnFromEnv()
+	if err != nil {
+		t.Fatalf("cdnFromEnv: %v", err)
+	}
+	signed, _ = c.signedURL("outputs/job/vocals.mp3", now, now.Add(time.Minute))
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte("/prod/outputs/job/vocals.mp3" + "1700000000"))
+	want := "https://d111.cloudfront.net/prod/outputs/job/vocals.mp3?verify=" +
+		url.QueryEscape("1700000000-"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	if signed != want {
+		t.Errorf("Cloudflare URL = %s, want %s", signed, want)
+	}
+
+	t.Setenv("STORAGE_BACKEND", "s3")
+	t.Setenv("STORAGE_S3_BUCKET", "stems")
+	t.Setenv("STORAGE_S3_ACCESS_KEY_ID", "key")
+	t.Setenv("STORAGE_S3_SECRET_ACCESS_KEY", "secret")
+	s, _ := remoteStorage()
+	rec := httptest.NewRecorder()
+	serveFromStorage(rec, httptest.NewRequest("GET", "/api/download/job/vocals", nil), s, filepath.Join(outputDir, "job", "vocals.mp3"))
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusFound || !strings.HasPrefix(loc, "https://d111.cloudfront.net/prod/outputs/job/vocals.mp3?verify=") {
+		t.Errorf("download = %d to %q, want a CDN redirect", rec.Code, loc)
+	}
+
+	for _, env := range [][2]string{{"CDN_PROVIDER", "akamai"}, {"CDN_CLOUDFLARE_TOKEN_SECRET", ""}} {
+		t.Setenv("CDN_PROVIDER", "cloudflare")
+		t.Setenv(env[0], env[1])
+		if _, err := cdnFromEnv(); err == nil {
+			t.Errorf("expected an error with %s=%q", env[0], env[1])
+		}
+	}
+}
+
+func TestCDNInvalidation(t *testing.T) {
+	var mu sync.Mutex
+	var requests []*http.Request
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests, bodies = append(requests, r), append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	oldCloudFront, oldCloudflare := cloudfrontAPI, cloudflareAPI
+	cloudfrontAPI, cloudflareAPI = server.URL, server.URL
+	t.Cleanup(func() { cloudfrontAPI, cloudflareAPI = oldCloudFront, oldCloudflare })
+
+	keys := make([]string, 31)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("outputs/job/stem%d.mp3", i)
+	}
+	c := &cdnConfig{Provider: "cloudflare", BaseURL: "https://cdn.example.com", ZoneID: "zone", APIToken: "token"}
+	if err := c.invalidate(context.Background(), keys); err != nil {
+		t.Fatalf("Cloudflare purge: %v", err)
+	}
+	if len(requests) != 2 || requests[0].URL.Path != "/zones/zone/purge_cache" ||
+		requests[0].Header.Get("Authorization") != "Bearer token" ||
+		!strings.Contains(bodies[1], `"https://cdn.example.com/outputs/job/stem30.mp3"`) {
+		t.Errorf("Cloudflare purges = %d, first %s, bodies %q", len(requests), requests[0].URL, bodies)
+	}
+
+	t.Setenv("STORAGE_S3_BUCKET", "stems")
+	t.Setenv("STORAGE_S3_ACCESS_KEY_ID", "key")
+	t.Setenv("STORAGE_S3_SECRET_ACCESS_KEY", "secret")
+	requests, bodies = nil, nil
+	c = &cdnConfig{Provider: "cloudfront", BaseURL: "https://d111.cloudfront.net", DistributionID: "EDFDVBD6EXAMPLE"}
+	if err := c.invalidate(context.Background(), keys[:2]); err != nil {
+		t.Fatalf("CloudFront invalidation: %v", err)
+	}
+	if len(requests) != 1 || requests[0].URL.Path != "/distribution/EDFDVBD6EXAMPLE/invalidation" ||
+		!strings.Contains(requests[0].Header.Get("Authorization"), "/us-east-1/cloudfront/aws4_request") ||
+		!strings.Contains(bodies[0], "<Quantity>2</Quantity><Items><Path>/outputs/job/stem0.mp3</Path><Path>/outputs/job/stem1.mp3</Path></Items>") {
+		t.Errorf("CloudFront invalidations = %d, body %q", len(requests), bodies)
+	}
+}
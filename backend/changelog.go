@@ -0,0 +1,121 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// What's new (GET /api/changelog). Release notes are embedded from
+// changelog.json and list, per version, the models, output formats and
+// features it added, so the frontend can announce them ("6-stem model now
+// available"). An item is only listed while this instance offers it: a
+// model that is allowed, an output format it writes, a feature /api/branding
+// reports as on. ?since=1.2.0 lists only later releases, for a client that
+// remembers the last version it showed.
+
+//go:embed changelog.json
+var changelogJSON []byte
+
+// Release is a version's entry in the changelog
+type Release struct {
+	Version string          `json:"version"`
+	Date    string          `json:"date"`
+	Items   []ChangelogItem `json:"items"`
+}
+
+// ChangelogItem is something a release added
+type ChangelogItem struct {
+	Kind        string `json:"kind"` // model, format or feature
+	Name        string `json:"name"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// changelogResponse is the response of GET /api/changelog
+type changelogResponse struct {
+	Latest   string    `json:"latest"`
+	Releases []Release `json:"releases"` // newest first
+}
+
+var releaseNotes = func() []Release {
+	var releases []Release
+	if err := json.Unmarshal(changelogJSON, &releases); err != nil {
+		panic("changelog.json: " + err.Error())
+	}
+	return releases
+}()
+
+// parseVersion splits a dotted version into its numbers
+func parseVersion(v string) ([]int, bool) {
+	parts := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	nums := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		nums[i] = n
+	}
+	return nums, true
+}
+
+// offered reports whether this instance has what an item announces
+func (item ChangelogItem) offered(features map[string]bool) bool {
+	switch item.Kind {
+	case "model":
+		return isAllowedModel(item.Name)
+	case "format":
+		return allowedOutputFormats[item.Name]
+	}
+	switch item.Name {
+	case "batching":
+		return batchMaxJobs() > 1
+	case "unicode_filenames":
+		return filenamePolicy() == filenamePolicyUnicode
+	}
+	on, known := features[item.Name]
+	return on || !known
+}
+
+// changelog returns the releases after since (all when it is empty) with
+// the items this instance offers, newest first
+func changelog(since []int) changelogResponse {
+	features := brandingFromEnv().Features
+	resp := changelogResponse{Releases: []Release{}}
+	for _, release := range slices.Backward(releaseNotes) {
+		if resp.Latest == "" {
+			resp.Latest = release.Version
+		}
+		version, _ := parseVersion(release.Version)
+		if since != nil && slices.Compare(version, since) <= 0 {
+			continue
+		}
+		items := []ChangelogItem{}
+		for _, item := range release.Items {
+			if item.offered(features) {
+				items = append(items, item)
+			}
+		}
+		if len(items) > 0 {
+			release.Items = items
+			resp.Releases = append(resp.Releases, release)
+		}
+	}
+	return resp
+}
+
+func changelogHandler(w http.ResponseWriter, r *http.Request) {
+	var since []int
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		var ok bool
+		if since, ok = parseVersion(raw); !ok {
+			http.Error(w, "Invalid since value", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, changelog(since))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func getChangelog(t *testing.T, query string) (int, changelogResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	changelogHandler(rec, httptest.NewRequest("GET", "/api/changelog"+query, nil))
+	var resp changelogResponse
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, resp
+}
+
+func TestChangelog(t *testing.T) {
+	code, resp := getChangelog(t, "")
+	if code != http.StatusOK || len(resp.Releases) != len(releaseNotes) || resp.Latest != resp.Releases[0].Version {
+		t.Fatalf("changelog = %d %+v", code, resp)
+	}
+	for i, release := range resp.Releases[1:] {
+		newer, _ := parseVersion(resp.Releases[i].Version)
+		older, ok := parseVersion(release.Version)
+		if !ok || release.Date == "" || slices.Compare(newer, older) <= 0 {
+			t.Errorf("releases out of order at %s", release.Version)
+		}
+	}
+
+	_, resp = getChangelog(t, "?since=1.2.0")
+	for _, release := range resp.Releases {
+		if v, _ := parseVersion(release.Version); slices.Compare(v, []int{1, 2, 0}) <= 0 {
+			t.Errorf("since=1.2.0 listed %s", release.Version)
+		}
+	}
+	if _, resp = getChangelog(t, "?since="+resp.Latest); len(resp.Releases) != 0 || resp.Latest == "" {
+		t.Errorf("since=latest = %+v", resp)
+	}
+	if code, _ := getChangelog(t, "?since=next"); code != http.StatusBadRequest {
+		t.Errorf("since=next = %d", code)
+	}
+}
+
+func TestChangelogOnlyListsOfferedItems(t *testing.T) {
+	listed := func() map[string]bool {
+		_, resp := getChangelog(t, "")
+		names := map[string]bool{}
+		for _, release := range resp.Releases {
+			for _, item := range release.Items {
+				names[item.Name] = true
+			}
+		}
+		return names
+	}
+	if names := listed(); !names["htdemucs_6s"] || !names["batching"] || names["public_gallery"] || names["delivery_s3"] {
+		t.Errorf("default instance lists %v", names)
+	}
+
+	t.Setenv("PUBLIC_GALLERY", "true")
+	t.Setenv("BATCH_MAX_JOBS", "1")
+	t.Setenv("FILENAME_POLICY", filenamePolicyASCII)
+	if names := listed(); !names["public_gallery"] || names["batching"] || names["unicode_filenames"] {
+		t.Errorf("configured instance lists %v", names)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault injection for resilience testing. It only exists in binaries built
+// with -tags chaos; CHAOS_FAULTS then lists the faults to inject, read on
+// every call so they can be switched while the backend runs:
+//
+//	CHAOS_FAULTS=processor_delay=2s,processor_error=0.2,callback_drop=0.5,disk_full=true
+//
+// processor_delay waits before every processor request, processor_error
+// fails that share of them as if the processor were unreachable,
+// callback_drop fails that share of webhook deliveries and disk_full
+// reports no free space on the upload and output disks.
+
+// chaosFaults are the faults parsed from CHAOS_FAULTS
+type chaosFaults struct {
+	ProcessorDelay time.Duration
+	ProcessorError float64
+	CallbackDrop   float64
+	DiskFull       bool
+}
+
+var (
+	chaosRand      = rand.New(rand.NewSource(time.Now().UnixNano()))
+	chaosRandMutex = &sync.Mutex{}
+)
+
+// errInjected marks failures caused by fault injection
+var errInjected = errors.New("injected fault")
+
+func currentChaosFaults() chaosFaults {
+	var f chaosFaults
+	if !chaosBuild {
+		return f
+	}
+	for _, item := range strings.Split(os.Getenv("CHAOS_FAULTS"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(item), "=")
+		switch name {
+		case "processor_delay":
+			f.ProcessorDelay, _ = time.ParseDuration(value)
+		case "processor_error":
+			f.ProcessorError, _ = strconv.ParseFloat(value, 64)
+		case "callback_drop":
+			f.CallbackDrop, _ = strconv.ParseFloat(value, 64)
+		case "disk_full":
+			f.DiskFull = value == "true"
+		}
+	}
+	return f
+}
+
+// chaosHit reports whether a fault with the given probability fires
+func chaosHit(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	chaosRandMutex.Lock()
+	defer chaosRandMutex.Unlock()
+	return chaosRand.Float64() < p
+}
+
+// chaosTransport injects the processor faults into requests to the processor
+type chaosTransport struct{}
+
+func (chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f := currentChaosFaults()
+	if f.ProcessorDelay > 0 {
+		select {
+		case <-time.After(f.ProcessorDelay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	if chaosHit(f.ProcessorError) {
+		log.Printf("Chaos: failing processor request %s %s", req.Method, req.URL.Path)
+		return nil, errInjected
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newProcessorClient returns a client for processor requests
+func newProcessorClient(timeout time.Duration) *http.Client {
+	if !chaosBuild {
+		return &http.Client{Timeout: timeout}
+	}
+	return &http.Client{Timeout: timeout, Transport: chaosTransport{}}
+}
+
+// chaosDropCallback reports whether to drop a webhook delivery
+func chaosDropCallback() bool {
+	if chaosHit(currentChaosFaults().CallbackDrop) {
+		log.Printf("Chaos: dropping webhook delivery")
+		return true
+	}
+	return false
+}
+
+// chaosDiskFull reports whether disks should look full
+func chaosDiskFull() bool {
+	return currentChaosFaults().DiskFull
+}
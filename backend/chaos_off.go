@@ -0,0 +1,6 @@
+//go:build !chaos
+
+package main
+
+// chaosBuild is false in release builds, which ignore CHAOS_FAULTS
+const chaosBuild = false
@@ -0,0 +1,7 @@
+//go:build chaos
+
+package main
+
+// chaosBuild enables fault injection (CHAOS_FAULTS) in binaries built with
+// -tags chaos
+const chaosBuild = true
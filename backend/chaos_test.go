@@ -0,0 +1,156 @@
+//go:build chaos
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run with: go test -race -tags chaos -run Chaos ./...
+
+func TestChaosProcessorFaultsAndSelfTestRecovery(t *testing.T) {
+	oldUploadDir, oldOutputDir, oldQueue, oldPoll := uploadDir, outputDir, processingQueue, selfTestPollInterval
+	uploadDir, outputDir = t.TempDir(), t.TempDir()
+	processingQueue, selfTestPollInterval = newJobQueue(), 10*time.Millisecond
+	processingQueue.start(1, runQueuedJob)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		processingQueue.drain(ctx)
+		uploadDir, outputDir, processingQueue, selfTestPollInterval = oldUploadDir, oldOutputDir, oldQueue, oldPoll
+		selfTestMutex.Lock()
+		selfTest = SelfTestStatus{}
+		selfTestMutex.Unlock()
+	})
+	processor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dir := filepath.Join(outputDir, r.FormValue("job_id"))
+		os.MkdirAll(dir, 0755)
+		os.WriteFile(filepath.Join(dir, "vocals.wav"), []byte("vocals"), 0644)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"outputs": map[string]string{"vocals": filepath.Join(dir, "vocals.wav")}})
+	}))
+	defer processor.Close()
+	t.Setenv("PROCESSOR_URL", processor.URL)
+	selfTestMutex.Lock()
+	selfTest = SelfTestStatus{Enabled: true}
+	selfTestMutex.Unlock()
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		readyHandler(rec, httptest.NewRequest("GET", "/api/ready", nil))
+		return rec.Code
+	}
+
+	t.Setenv("CHAOS_FAULTS", "processor_error=1")
+	runSelfTest()
+	if s := selfTestSnapshot(); s.Last.Passed || !strings.Contains(s.Last.Error, errInjected.Error()) {
+		t.Fatalf("self-test with a failing processor = %+v", s.Last)
+	}
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("ready = %d with a failing processor, want 503", code)
+	}
+
+	// A slow but working processor recovers readiness and shows in the latency
+	t.Setenv("CHAOS_FAULTS", "processor_delay=50ms")
+	runSelfTest()
+	s := selfTestSnapshot()
+	if !s.Last.Passed || s.Last.LatencySeconds < 0.05 {
+		t.Fatalf("self-test with a slow processor = %+v", s.Last)
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("ready = %d after recovery", code)
+	}
+}
+
+func TestChaosDroppedCallbacksAreRetried(t *testing.T) {
+	t.Setenv("OUTBOUND_ALLOW_PRIVATE", "true")
+	received := make(chan struct{}, 4)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer endpoint.Close()
+	webhookRetryBase = 20 * time.Millisecond
+	t.Cleanup(func() { webhookRetryBase = 5 * time.Second })
+
+	router := webhookRouter()
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", "/api/webhooks",
+		strings.NewReader(`{"url":"`+endpoint.URL+`","events":["job.failed"]}`)))
+	var hook Webhook
+	json.Unmarshal(rec.Body.Bytes(), &hook)
+	t.Cleanup(func() {
+		webhooksMutex.Lock()
+		delete(webhooks, hook.ID)
+		delete(webhookDeliveries, hook.ID)
+		webhooksMutex.Unlock()
+	})
+
+	t.Setenv("CHAOS_FAULTS", "callback_drop=1")
+	dispatchWebhooks(Event{ID: "chaos-event", Type: EventJobFailed, Job: Job{ID: "chaos-job"}})
+	time.Sleep(10 * time.Millisecond)
+	os.Setenv("CHAOS_FAULTS", "") // the retry gets through
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("dropped delivery was not retried")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	var history []WebhookDelivery
+	for time.Now().Before(deadline) {
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/webhooks/"+hook.ID+"/deliveries", nil))
+		json.Unmarshal(rec.Body.Bytes(), &history)
+		if len(history) == 1 && history[0].Status == "succeeded" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(history) != 1 || history[0].Status != "succeeded" || history[0].Attempts < 2 {
+		t.Errorf("history = %+v, want one delivery that succeeded on a retry", history)
+	}
+}
+
+func TestChaosDiskFull(t *testing.T) {
+	oldUploadDir, oldOutputDir := uploadDir, outputDir
+	uploadDir, outputDir = t.TempDir(), t.TempDir()
+	externalWorkers = true
+	t.Cleanup(func() { uploadDir, outputDir, externalWorkers = oldUploadDir, oldOutputDir, false })
+	t.Setenv("MIN_FREE_DISK_MB", "0")
+
+	upload := func() *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", "song.mp3")
+		part.Write([]byte("ID3"))
+		mw.Close()
+		req := httptest.NewRequest("POST", "/api/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		uploadHandler(rec, req)
+		return rec
+	}
+
+	t.Setenv("CHAOS_FAULTS", "disk_full=true")
+	if rec := upload(); rec.Code != http.StatusInsufficientStorage {
+		t.Errorf("upload on a full disk = %d, want 507", rec.Code)
+	}
+	t.Setenv("CHAOS_FAULTS", "")
+	rec := upload()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload after space was freed = %d: %s", rec.Code, rec.Body.String())
+	}
+	var job Job
+	json.Unmarshal(rec.Body.Bytes(), &job)
+	jobsMutex.Lock()
+	delete(jobs, job.ID)
+	jobsMutex.Unlock()
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Chapter export for spoken-word material
+//
+// Separating a podcast with stem_mode=isolate&isolate_stem=vocals yields a
+// speech track (vocals) and a music bed (instrumental). The activity of each
+// is measured in short frames and turned into chapters wherever the mix
+// changes between speech, music and speech over a music bed. The activity
+// map is cached on the job per threshold, so asking for the same chapters
+// in another format or with another chapter length doesn't decode the
+// stems again. format=m4a renders the episode (all the stems at unity
+// gain) as AAC with the chapters muxed in as an MP4 chapter track.
+
+const (
+	activitySampleRate   = 8000
+	activityFrameSeconds = 0.5
+	// activityMinRunFrames drops blips shorter than this and fills gaps as short
+	activityMinRunFrames = 4
+	defaultActivityDB    = -45.0
+	defaultChapterSecs   = 5.0
+	// activityCacheSize bounds the thresholds cached per job
+	activityCacheSize = 8
+)
+
+// chapterFormats are the format values of GET /api/jobs/{id}/chapters
+var chapterFormats = []string{"activity", "ffmetadata", "json", "m4a"}
+
+// cachedActivity is the activity map of a job at one threshold, valid
+// while the job has the same stem files
+type cachedActivity struct {
+	source   string // the speech and music stem paths it was measured from
+	segments []ActivitySegment
+}
+
+// ActivitySegment is a span of the recording with a single speech/music state
+type ActivitySegment struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	State string  `json:"state"` // silence, speech, music, speech_over_music
+}
+
+// podcastChapter follows the Podcasting 2.0 JSON chapters format
+type podcastChapter struct {
+	StartTime float64 `json:"startTime"`
+	EndTime   float64 `json:"endTime,omitempty"`
+	Title     string  `json:"title"`
+}
+
+var chapterTitles = map[string]string{
+	"silence":           "Silence",
+	"speech":            "Speech",
+	"music":             "Music",
+	"speech_over_music": "Speech over music bed",
+}
+
+// frameLevels returns the RMS level of each frame in dBFS
+func frameLevels(samples []int16, frameLen int) []float64 {
+	levels := make([]float64, 0, len(samples)/frameLen+1)
+	for start := 0; start < len(samples); start += frameLen {
+		end := start + frameLen
+		if end > len(samples) {
+			end = len(samples)
+		}
+		var sum float64
+		for _, s := range samples[start:end] {
+			v := float64(s) / 32768
+			sum += v * v
+		}
+		rms := math.Sqrt(sum / float64(end-start))
+		levels = append(levels, 20*math.Log10(rms+1e-9))
+	}
+	return levels
+}
+
+// activeFrames thresholds frame levels and smooths the result so short gaps
+// are bridged and short blips are ignored
+func activeFrames(levels []float64, thresholdDB float64, minRun int) []bool {
+	active := make([]bool, len(levels))
+	for i, l := range levels {
+		active[i] = l > thresholdDB
+	}
+	// Bridge short gaps first, then drop short runs
+	fillRuns(active, false, minRun)
+	fillRuns(active, true, minRun)
+	return active
+}
+
+// fillRuns flips interior runs of value shorter than minRun
+func fillRuns(frames []bool, value bool, minRun int) {
+	for i := 0; i < len(frames); {
+		if frames[i] != value {
+			i++
+			continue
+		}
+		j := i
+		for j < len(frames) && frames[j] == value {
+			j++
+		}
+		interior := i > 0 && j < len(frames)
+		if j-i < minRun && (interior || value) {
+			for k := i; k < j; k++ {
+				frames[k] = !value
+			}
+		}
+		i = j
+	}
+}
+
+// activityMap merges per-frame speech/music activity into state segments
+func activityMap(speech, music []bool, frameSeconds float64) []ActivitySegment {
+	n := len(speech)
+	if len(music) > n {
+		n = len(music)
+	}
+	var segments []ActivitySegment
+	for i := 0; i < n; i++ {
+		s := i < len(speech) && speech[i]
+		m := i < len(music) && music[i]
+		state := "silence"
+		switch {
+		case s && m:
+			state = "speech_over_music"
+		case s:
+			state = "speech"
+		case m:
+			state = "music"
+		}
+		start := float64(i) * frameSeconds
+		if len(segments) > 0 && segments[len(segments)-1].State == state {
+			segments[len(segments)-1].End = start + frameSeconds
+			continue
+		}
+		segments = append(segments, ActivitySegment{Start: start, End: start + frameSeconds, State: state})
+	}
+	return segments
+}
+
+// chaptersFromActivity folds segments shorter than minSeconds into the
+// preceding chapter and titles the rest
+func chaptersFromActivity(segments []ActivitySegment, minSeconds float64) []podcastChapter {
+	var chapters []podcastChapter
+	for _, seg := range segments {
+		if len(chapters) > 0 && (seg.End-seg.Start < minSeconds || chapters[len(chapters)-1].Title == chapterTitles[seg.State]) {
+			chapters[len(chapters)-1].EndTime = seg.End
+			continue
+		}
+		chapters = append(chapters, podcastChapter{StartTime: seg.Start, EndTime: seg.End, Title: chapterTitles[seg.State]})
+	}
+	return chapters
+}
+
+// ffmetadataChapters renders chapters in ffmpeg's FFMETADATA format, which
+// can be muxed into an MP4/M4A chapter track with
+// `ffmpeg -i episode.m4a -i chapters.txt -map_metadata 1 -codec copy out.m4a`
+func ffmetadataChapters(chapters []podcastChapter) string {
+	var b strings.Builder
+	b.WriteString(";FFMETADATA1\n")
+	for _, c := range chapters {
+		fmt.Fprintf(&b, "\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n",
+			int64(c.StartTime*1000), int64(c.EndTime*1000), c.Title)
+	}
+	return b.String()
+}
+
+// stemLevels decodes a stem and returns its level per activity frame
+func stemLevels(path string) ([]float64, error) {
+	samples, err := decodeMonoPCM(path, activitySampleRate)
+	if err != nil {
+		return nil, err
+	}
+	return frameLevels(samples, int(activitySampleRate*activityFrameSeconds)), nil
+}
+
+// sumLevels adds up the energy of frame levels, as if the stems were mixed
+func sumLevels(levels [][]float64) []float64 {
+	var energy []float64
+	for _, l := range levels {
+		for i, db := range l {
+			if i >= len(energy) {
+				energy = append(energy, 0)
+			}
+			energy[i] += math.Pow(10, db/10)
+		}
+	}
+	sum := make([]float64, len(energy))
+	for i, e := range energy {
+		sum[i] = 10 * math.Log10(e+1e-18)
+	}
+	return sum
+}
+
+// stemActivity decodes the given stems, sums their energy and returns the
+// smoothed activity per frame
+func stemActivity(paths []string, thresholdDB float64) ([]bool, error) {
+	var levels [][]float64
+	for _, path := range paths {
+		l, err := stemLevels(path)
+		if err != nil {
+			return nil, err
+		}
+		levels = append(levels, l)
+	}
+	return activeFrames(sumLevels(levels), thresholdDB, activityMinRunFrames), nil
+}
+
+// jobActivity returns the activity map of a job's stems at thresholdDB,
+// from the job's cache when the stems haven't changed
+func jobActivity(jobID, speechPath string, musicPaths []string, thresholdDB float64) ([]ActivitySegment, error) {
+	sort.Strings(musicPaths)
+	source := strings.Join(append([]string{speechPath}, musicPaths...), "\n")
+	jobsMutex.RLock()
+	var cached cachedActivity
+	var hit bool
+	if job, exists := jobs[jobID]; exists {
+		cached, hit = job.chapterActivity[thresholdDB]
+	}
+	jobsMutex.RUnlock()
+	if hit && cached.source == source {
+		return cached.segments, nil
+	}
+
+	speech, err := stemActivity([]string{speechPath}, thresholdDB)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to analyze speech stem")
+	}
+	music, err := stemActivity(musicPaths, thresholdDB)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to analyze music stems")
+	}
+	segments := activityMap(speech, music, activityFrameSeconds)
+
+	jobsMutex.Lock()
+	if job, exists := jobs[jobID]; exists {
+		if job.chapterActivity == nil || len(job.chapterActivity) >= activityCacheSize {
+			job.chapterActivity = make(map[float64]cachedActivity)
+		}
+		job.chapterActivity[thresholdDB] = cachedActivity{source: source, segments: segments}
+	}
+	jobsMutex.Unlock()
+	return segments, nil
+}
+
+// serveChapteredEpisode renders the stems back into the episode as M4A with
+// the chapters as its chapter track, and sends it
+func serveChapteredEpisode(w http.ResponseWriter, r *http.Request, job Job, paths []string, chapters []podcastChapter) {
+	tmp, err := os.MkdirTemp("", "t2s-chapters-")
+	if err != nil {
+		http.Error(w, "Failed to render the episode", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tmp)
+	render := mixRender{Dst: filepath.Join(tmp, "episode.m4a"), Chapters: filepath.Join(tmp, "chapters.txt")}
+	for _, path := range paths {
+		render.Inputs = append(render.Inputs, mixInput{Path: path})
+	}
+	if err := os.WriteFile(render.Chapters, []byte(ffmetadataChapters(chapters)), 0600); err != nil {
+		http.Error(w, "Failed to render the episode", http.StatusInternalServerError)
+		return
+	}
+	mixSlots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	err = renderMix(ctx, render)
+	cancel()
+	<-mixSlots
+	if err != nil {
+		http.Error(w, "Failed to render the episode: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	base := sanitizeFilename(strings.TrimSuffix(job.FileName, filepath.Ext(job.FileName)))
+	w.Header().Set("Content-Type", "audio/mp4")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", base+" - chapters.m4a"))
+	http.ServeFile(w, r, render.Dst)
+}
+
+// chaptersHandler serves GET /api/jobs/{id}/chapters in one of four formats:
+// json (Podcasting 2.0 chapters, default), ffmetadata, m4a (the episode
+// with a chapter track), or activity (raw map)
+func chaptersHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupCompletedJob(w, r)
+	if !ok || refuseEncrypted(w, job) {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if !slices.Contains(chapterFormats, format) {
+		http.Error(w, invalidOption("format", chapterFormats).Error(), http.StatusBadRequest)
+		return
+	}
+	thresholdDB := defaultActivityDB
+	if v := r.URL.Query().Get("threshold_db"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil || t > 0 || t < -90 {
+			http.Error(w, "Invalid threshold_db value", http.StatusBadRequest)
+			return
+		}
+		thresholdDB = t
+	}
+	minSeconds := defaultChapterSecs
+	if v := r.URL.Query().Get("min_chapter_seconds"); v != "" {
+		m, err := strconv.ParseFloat(v, 64)
+		if err != nil || m < 0 || m > 600 {
+			http.Error(w, "Invalid min_chapter_seconds value", http.StatusBadRequest)
+			return
+		}
+		minSeconds = m
+	}
+
+	speechPath, hasSpeech := job.OutputFiles["vocals"]
+	var musicPaths []string
+	for stem, path := range job.OutputFiles {
+		if stem != "vocals" && (allowedStems[stem] || stem == "instrumental" || stem == "backing") {
+			musicPaths = append(musicPaths, path)
+		}
+	}
+	if !hasSpeech || len(musicPaths) == 0 {
+		http.Error(w, "Chapters need a vocals stem and at least one music stem", http.StatusBadRequest)
+		return
+	}
+	for _, p := range append([]string{speechPath}, musicPaths...) {
+		if !safeOutputPath(p) {
+			http.Error(w, "Invalid file path", http.StatusBadRequest)
+			return
+		}
+	}
+
+	segments, err := jobActivity(job.ID, speechPath, musicPaths, thresholdDB)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch format {
+	case "activity":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"frame_seconds": activityFrameSeconds, "segments": segments})
+	case "m4a":
+		serveChapteredEpisode(w, r, job, append([]string{speechPath}, musicPaths...), chaptersFromActivity(segments, minSeconds))
+	case "ffmetadata":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"chapters.txt\"")
+		w.Write([]byte(ffmetadataChapters(chaptersFromActivity(segments, minSeconds))))
+	default:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"version":  "1.2.0",
+			"chapters": chaptersFromActivity(segments, minSeconds),
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func frames(pattern string) []bool {
+	out := make([]bool, len(pattern))
+	for i, c := range pattern {
+		out[i] = c == '#'
+	}
+	return out
+}
+
+func TestActiveFramesSmoothing(t *testing.T) {
+	levels := make([]float64, 0)
+	for _, c := range "######..######.........##......" {
+		if c == '#' {
+			levels = append(levels, -20)
+		} else {
+			levels = append(levels, -70)
+		}
+	}
+	got := activeFrames(levels, -45, 4)
+	want := frames("##############.................")[:len(levels)]
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("frame %d: got %v, want %v (short gaps should be bridged, blips dropped)", i, got[i], want[i])
+		}
+	}
+}
+
+func TestActivityMapAndChapters(t *testing.T) {
+	speech := frames("####################..........##########")
+	music := frames("..........##############################")
+	segments := activityMap(speech, music, 0.5)
+
+	wantStates := []string{"speech", "speech_over_music", "music", "speech_over_music"}
+	if len(segments) != len(wantStates) {
+		t.Fatalf("got %d segments, want %d: %+v", len(segments), len(wantStates), segments)
+	}
+	for i, s := range wantStates {
+		if segments[i].State != s {
+			t.Errorf("segment %d state = %q, want %q", i, segments[i].State, s)
+		}
+	}
+	if segments[1].Start != 5 || segments[1].End != 10 {
+		t.Errorf("music bed should start at 5s: %+v", segments[1])
+	}
+
+	chapters := chaptersFromActivity(segments, 5)
+	if len(chapters) != 4 || chapters[0].Title != "Speech" || chapters[2].Title != "Music" {
+		t.Errorf("unexpected chapters: %+v", chapters)
+	}
+
+	// Segments shorter than the minimum fold into the previous chapter
+	if merged := chaptersFromActivity(segments, 6); len(merged) != 1 || merged[0].EndTime != 20 {
+		t.Errorf("expected short chapters to merge: %+v", merged)
+	}
+}
+
+func TestFFMetadataChapters(t *testing.T) {
+	out := ffmetadataChapters([]podcastChapter{{StartTime: 0, EndTime: 12.5, Title: "Speech"}})
+	if !strings.HasPrefix(out, ";FFMETADATA1\n") {
+		t.Error("missing FFMETADATA header")
+	}
+	if !strings.Contains(out, "START=0\nEND=12500\ntitle=Speech") {
+		t.Errorf("unexpected chapter block: %q", out)
+	}
+}
+
+func TestChaptersHandlerCachesActivity(t *testing.T) {
+	oldOutputDir, oldRender := outputDir, renderMix
+	outputDir = t.TempDir()
+	var rendered mixRender
+	var muxed string
+	renderMix = func(ctx context.Context, r mixRender) error {
+		rendered = r
+		data, _ := os.ReadFile(r.Chapters)
+		muxed = string(data)
+		return os.WriteFile(r.Dst, []byte("episode"), 0644)
+	}
+	t.Cleanup(func() { outputDir, renderMix = oldOutputDir, oldRender })
+
+	id := uuid.New().String()
+	outputs := map[string]string{}
+	for _, stem := range []string{"vocals", "instrumental"} {
+		outputs[stem] = filepath.Join(outputDir, id, "episode_t2s_"+stem+".wav")
+	}
+	source := outputs["vocals"] + "\n" + outputs["instrumental"]
+	// ffmpeg isn't available, so only a cached activity map can answer
+	jobsMutex.Lock()
+	jobs[id] = &Job{ID: id, Status: "completed", FileName: "episode.mp3", OutputFiles: outputs,
+		chapterActivity: map[float64]cachedActivity{
+			defaultActivityDB: {source: source, segments: []ActivitySegment{
+				{Start: 0, End: 30, State: "speech"}, {Start: 30, End: 90, State: "music"},
+			}},
+			-30: {source: "moved.wav", segments: []ActivitySegment{{Start: 0, End: 90, State: "music"}}},
+		}}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/jobs/{id}/chapters", chaptersHandler).Methods("GET")
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/jobs/"+id+"/chapters"+query, nil))
+		return rec
+	}
+
+	rec := get("")
+	var body struct{ Chapters []podcastChapter }
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusOK || len(body.Chapters) != 2 || body.Chapters[1].StartTime != 30 {
+		t.Errorf("cached chapters = %d: %s", rec.Code, rec.Body)
+	}
+	// A cached map of other stem files is measured again
+	if rec := get("?threshold_db=-30"); rec.Code != http.StatusInternalServerError {
+		t.Errorf("stale cache = %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = get("?format=m4a")
+	if rec.Code != http.StatusOK || rec.Body.String() != "episode" || rec.Header().Get("Content-Type") != "audio/mp4" ||
+		!strings.Contains(rec.Header().Get("Content-Disposition"), "episode%20-%20chapters.m4a") {
+		t.Fatalf("m4a = %d %v: %s", rec.Code, rec.Header(), rec.Body)
+	}
+	if len(rendered.Inputs) != 2 || filepath.Ext(rendered.Dst) != ".m4a" || !strings.Contains(muxed, "START=30000\nEND=90000\ntitle=Music") {
+		t.Errorf("rendered %+v with chapters %q", rendered, muxed)
+	}
+	if rec := get("?format=mp4"); rec.Code != http.StatusBadRequest {
+		t.Errorf("format=mp4 = %d", rec.Code)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cleanup preview. Nothing the housekeeping deletes can be brought back, so
+// GET /api/admin/cleanup/preview lists what it would remove if it ran now:
+// the jobs past their retention, the event logs of deleted jobs, abandoned
+// chunked uploads and orphaned files, each with its paths, size and the
+// reason. POST /api/admin/cleanup/run runs the same policies at once, so an
+// operator can check the preview, clean up by hand and only then leave
+// JOB_RETENTION_HOURS to the janitor. Both take policy=retention,orphans to
+// look at some policies only. /metrics reports the pending garbage as
+// track2stem_cleanup_pending_items and track2stem_cleanup_pending_bytes.
+
+const (
+	cleanupRetention      = "retention"
+	cleanupEventLogs      = "event_logs"
+	cleanupPartialUploads = "partial_uploads"
+	cleanupOrphans        = "orphans"
+)
+
+// cleanupPolicyNames are the policies in the order a run applies them:
+// expiry first, so the files of jobs it expires aren't also orphans
+var cleanupPolicyNames = []string{cleanupRetention, cleanupEventLogs, cleanupPartialUploads, cleanupOrphans}
+
+// CleanupItem is one job or file a cleanup policy would remove
+type CleanupItem struct {
+	Policy   string   `json:"policy"`
+	JobID    string   `json:"job_id,omitempty"`
+	UploadID string   `json:"upload_id,omitempty"`
+	Paths    []string `json:"paths"`
+	Bytes    int64    `json:"bytes"`
+	Remote   bool     `json:"remote,omitempty"` // also deleted from object storage
+	Reason   string   `json:"reason"`
+}
+
+// cleanupTotals sums a policy's items
+type cleanupTotals struct {
+	Items int   `json:"items"`
+	Bytes int64 `json:"bytes"`
+}
+
+// expiringJobs lists the jobs expireJobs would expire at now
+func expiringJobs(now time.Time, ttl time.Duration) []CleanupItem {
+	retentions := keyRetentions()
+	var items []CleanupItem
+	var inputs []string
+	jobsMutex.RLock()
+	for _, job := range jobs {
+		keep, due := expiryDue(job, now, ttl, retentions)
+		if !due {
+			continue
+		}
+		reason := fmt.Sprintf("completed %s ago, past its retention of %s", now.Sub(*job.CompletedAt).Round(time.Minute), keep)
+		if _, override := retentions[job.APIKeyID]; override {
+			reason += " (key override)"
+		}
+		items = append(items, CleanupItem{
+			Policy: cleanupRetention,
+			JobID:  job.ID,
+			Paths:  append(jobFiles(job), filepath.Join(outputDir, job.ID)),
+			Remote: job.Stored,
+			Reason: reason,
+		})
+		inputs = append(inputs, job.inputPath)
+	}
+	jobsMutex.RUnlock()
+	for i := range items {
+		items[i].Bytes = entrySize(filepath.Join(outputDir, items[i].JobID))
+		if inputs[i] != "" {
+			items[i].Bytes += entrySize(inputs[i])
+		}
+	}
+	return items
+}
+
+// staleEventLogItems lists the event logs pruneJobEventLogs would remove at now
+func staleEventLogItems(now time.Time, ttl time.Duration) []CleanupItem {
+	var items []CleanupItem
+	for jobID, info := range staleJobEventLogs(now, ttl) {
+		items = append(items, CleanupItem{
+			Policy: cleanupEventLogs,
+			JobID:  jobID,
+			Paths:  []string{jobEventLogPath(jobID)},
+			Bytes:  info.Size(),
+			Reason: fmt.Sprintf("job deleted, log untouched for %s (retention %s)", now.Sub(info.ModTime()).Round(time.Minute), ttl),
+		})
+	}
+	return items
+}
+
+// abandonedUploadItems lists the uploads expirePartialUploads would delete at now
+func abandonedUploadItems(now time.Time, ttl time.Duration) []CleanupItem {
+	var items []CleanupItem
+	partialUploadsMutex.Lock()
+	for id, u := range partialUploads {
+		if !u.mu.TryLock() {
+			continue
+		}
+		if u.abandoned(now, ttl) {
+			items = append(items, CleanupItem{
+				Policy:   cleanupPartialUploads,
+				UploadID: id,
+				Paths:    []string{filepath.Join(partialUploadDir(), id+".json"), u.TempPath},
+				Bytes:    u.Received,
+				Reason:   fmt.Sprintf("nothing received for %s (limit %s), %d of %d bytes uploaded", now.Sub(u.UpdatedAt).Round(time.Minute), ttl, u.Received, u.Size),
+			})
+		}
+		u.mu.Unlock()
+	}
+	partialUploadsMutex.Unlock()
+	return items
+}
+
+// cleanupPreview returns what the policies would remove at now, jobs and
+// files of each policy sorted by path
+func cleanupPreview(now time.Time, policies []string) []CleanupItem {
+	items := []CleanupItem{}
+	for _, policy := range policies {
+		var planned []CleanupItem
+		switch policy {
+		case cleanupRetention:
+			planned = expiringJobs(now, jobRetention())
+		case cleanupEventLogs:
+			planned = staleEventLogItems(now, jobEventsRetention())
+		case cleanupPartialUploads:
+			planned = abandonedUploadItems(now, partialUploadTTL())
+		case cleanupOrphans:
+			planned = orphanEntries(now, orphanGCGrace())
+		}
+		slices.SortFunc(planned, func(a, b CleanupItem) int { return strings.Compare(a.Paths[0], b.Paths[0]) })
+		items = append(items, planned...)
+	}
+	return items
+}
+
+// cleanupSummary totals items by policy, listing every policy asked for
+func cleanupSummary(items []CleanupItem, policies []string) map[string]cleanupTotals {
+	summary := make(map[string]cleanupTotals, len(policies))
+	for _, policy := range policies {
+		summary[policy] = cleanupTotals{}
+	}
+	for _, item := range items {
+		t := summary[item.Policy]
+		t.Items++
+		t.Bytes += item.Bytes
+		summary[item.Policy] = t
+	}
+	return summary
+}
+
+// parseCleanupPolicies reads the policy parameter; empty means all of them
+func parseCleanupPolicies(r *http.Request) ([]string, error) {
+	raw := r.URL.Query().Get("policy")
+	if raw == "" {
+		return cleanupPolicyNames, nil
+	}
+	var policies []string
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if !slices.Contains(cleanupPolicyNames, name) {
+			return nil, invalidOption("policy", cleanupPolicyNames)
+		}
+		policies = append(policies, name)
+	}
+	// Applied in the run order whatever order the request lists them in
+	return slices.DeleteFunc(slices.Clone(cleanupPolicyNames), func(name string) bool {
+		return !slices.Contains(policies, name)
+	}), nil
+}
+
+// cleanupPreviewHandler serves GET /api/admin/cleanup/preview
+func cleanupPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	policies, err := parseCleanupPolicies(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	items := cleanupPreview(now, policies)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"generated_at": now,
+		"summary":      cleanupSummary(items, policies),
+		"items":        items,
+	})
+}
+
+// cleanupRunHandler serves POST /api/admin/cleanup/run. The counts are what
+// each policy removed, which can differ from a preview taken before if jobs
+// finished or uploads resumed in between.
+func cleanupRunHandler(w http.ResponseWriter, r *http.Request) {
+	policies, err := parseCleanupPolicies(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	removed := make(map[string]int, len(policies))
+	var reclaimed int64
+	for _, policy := range policies {
+		switch policy {
+		case cleanupRetention:
+			removed[policy] = expireJobs(now, jobRetention())
+		case cleanupEventLogs:
+			removed[policy] = pruneJobEventLogs(now, jobEventsRetention())
+		case cleanupPartialUploads:
+			removed[policy] = expirePartialUploads(now, partialUploadTTL())
+		case cleanupOrphans:
+			removed[policy], reclaimed = sweepOrphans(orphanGCGrace())
+			recordOrphanSweep(removed[policy], reclaimed)
+		}
+	}
+
+	fields := map[string]string{"policies": strings.Join(policies, ",")}
+	for policy, n := range removed {
+		fields[policy] = strconv.Itoa(n)
+	}
+	recordAudit("cleanup.run", "", fields)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ran_at":                 now,
+		"removed":                removed,
+		"orphan_bytes_reclaimed": reclaimed,
+	})
+}
+
+// writeCleanupMetrics reports what a cleanup run would remove now
+func writeCleanupMetrics(w io.Writer) {
+	summary := cleanupSummary(cleanupPreview(time.Now(), cleanupPolicyNames), cleanupPolicyNames)
+	writeMetric(w, "track2stem_cleanup_pending_items", "gauge", "Jobs and files the cleanup policies would remove now, by policy.")
+	for _, policy := range cleanupPolicyNames {
+		fmt.Fprintf(w, "track2stem_cleanup_pending_items{policy=%s} %d\n", labelValue(policy), summary[policy].Items)
+	}
+	writeMetric(w, "track2stem_cleanup_pending_bytes", "gauge", "Bytes the cleanup policies would free now, by policy.")
+	for _, policy := range cleanupPolicyNames {
+		fmt.Fprintf(w, "track2stem_cleanup_pending_bytes{policy=%s} %d\n", labelValue(policy), summary[policy].Bytes)
+	}
+}
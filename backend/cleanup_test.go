@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCleanupPreviewAndRun(t *testing.T) {
+	oldUploadDir, oldOutputDir := uploadDir, outputDir
+	uploadDir, outputDir = t.TempDir(), t.TempDir()
+	t.Cleanup(func() { uploadDir, outputDir = oldUploadDir, oldOutputDir })
+	t.Setenv("JOB_RETENTION_HOURS", "2")
+
+	old := time.Now().Add(-48 * time.Hour)
+	write := func(path string, size int, mtime time.Time) {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, make([]byte, size), 0644)
+		os.Chtimes(path, mtime, mtime)
+		os.Chtimes(filepath.Dir(path), mtime, mtime)
+	}
+	vocals := filepath.Join(outputDir, "cleanup-expiring", "song_t2s_vocals.mp3")
+	write(vocals, 40, time.Now())
+	write(filepath.Join(outputDir, "cleanup-orphan", "vocals.mp3"), 30, old)
+	write(jobEventLogPath("cleanup-deleted"), 20, old.Add(-7*24*time.Hour))
+	completed := time.Now().Add(-3 * time.Hour)
+	jobsMutex.Lock()
+	jobs["cleanup-expiring"] = &Job{ID: "cleanup-expiring", Status: "completed", CompletedAt: &completed, OutputFiles: map[string]string{"vocals": vocals}}
+	jobsMutex.Unlock()
+	u := &PartialUpload{ID: "cleanup-abandoned", Size: 10, Received: 3, UpdatedAt: old}
+	u.TempPath = filepath.Join(partialUploadDir(), u.ID+".part")
+	write(u.TempPath, 3, old)
+	u.save()
+	partialUploadsMutex.Lock()
+	partialUploads[u.ID] = u
+	partialUploadsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, "cleanup-expiring")
+		jobsMutex.Unlock()
+		partialUploadsMutex.Lock()
+		delete(partialUploads, u.ID)
+		partialUploadsMutex.Unlock()
+	})
+
+	preview := func(query string) (int, map[string]cleanupTotals, []CleanupItem) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		cleanupPreviewHandler(rec, httptest.NewRequest("GET", "/api/admin/cleanup/preview"+query, nil))
+		var body struct {
+			Summary map[string]cleanupTotals `json:"summary"`
+			Items   []CleanupItem            `json:"items"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body.Summary, body.Items
+	}
+
+	_, summary, items := preview("")
+	want := map[string]cleanupTotals{
+		cleanupRetention:      {Items: 1, Bytes: 40},
+		cleanupEventLogs:      {Items: 1, Bytes: 20},
+		cleanupPartialUploads: {Items: 1, Bytes: 3},
+		cleanupOrphans:        {Items: 1, Bytes: 30},
+	}
+	for policy, totals := range want {
+		if summary[policy] != totals {
+			t.Errorf("%s = %+v, want %+v", policy, summary[policy], totals)
+		}
+	}
+	if len(items) != 4 || items[0].JobID != "cleanup-expiring" || !strings.Contains(items[0].Reason, "past its retention of 2h0m0s") {
+		t.Fatalf("items = %+v", items)
+	}
+	// A preview removes nothing
+	if _, err := os.Stat(vocals); err != nil {
+		t.Fatal("preview removed the stems")
+	}
+	if code, _, _ := preview("?policy=retention,trash"); code != http.StatusBadRequest {
+		t.Errorf("unknown policy = %d", code)
+	}
+
+	rec := httptest.NewRecorder()
+	cleanupRunHandler(rec, httptest.NewRequest("POST", "/api/admin/cleanup/run?policy=orphans,retention", nil))
+	var run struct {
+		Removed   map[string]int `json:"removed"`
+		Reclaimed int64          `json:"orphan_bytes_reclaimed"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &run)
+	if rec.Code != http.StatusOK || len(run.Removed) != 2 || run.Removed[cleanupRetention] != 1 || run.Removed[cleanupOrphans] != 1 || run.Reclaimed != 30 {
+		t.Errorf("run = %d %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(vocals); !os.IsNotExist(err) {
+		t.Error("stems of the expired job still on disk")
+	}
+	if _, summary, _ := preview(""); summary[cleanupRetention].Items != 0 || summary[cleanupOrphans].Items != 0 || summary[cleanupEventLogs].Items != 1 {
+		t.Errorf("summary after the run = %+v", summary)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Cloud storage export (Google Drive, Dropbox)
+//
+// A storage link is created through the provider's OAuth consent screen:
+// GET /api/storage/{provider}/connect redirects there and the provider calls
+// back into /api/storage/{provider}/callback with an authorization code that
+// is exchanged for tokens. Deliveries with target=drive or target=dropbox then
+// upload the chosen stems into the linked account.
+
+// oauthProvider describes one OAuth-linked storage provider
+type oauthProvider struct {
+	Name        string
+	AuthURL     string
+	TokenURL    string
+	Scope       string
+	ClientIDEnv string
+	SecretEnv   string
+	// ExtraAuthParams request offline access so a refresh token is issued
+	ExtraAuthParams map[string]string
+	upload          func(ctx context.Context, p *oauthProvider, link *StorageLink, folder, name, path string) error
+	// APIBase and UploadBase are overridable for tests
+	APIBase    string
+	UploadBase string
+}
+
+// StorageLink is an authorized connection to a user's cloud storage
+type StorageLink struct {
+	Provider     string    `json:"provider"`
+	LinkedAt     time.Time `json:"linked_at"`
+	AccessToken  string    `json:"-"`
+	RefreshToken string    `json:"-"`
+	Expiry       time.Time `json:"-"`
+}
+
+var oauthProviders = map[string]*oauthProvider{
+	"drive": {
+		Name:        "drive",
+		AuthURL:     "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenURL:    "https://oauth2.googleapis.com/token",
+		Scope:       "https://www.googleapis.com/auth/drive.file",
+		ClientIDEnv: "GDRIVE_CLIENT_ID",
+		SecretEnv:   "GDRIVE_CLIENT_SECRET",
+		ExtraAuthParams: map[string]string{
+			"access_type": "offline",
+			"prompt":      "consent",
+		},
+		upload:     uploadToDrive,
+		APIBase:    "https://www.googleapis.com/drive/v3",
+		UploadBase: "https://www.googleapis.com/upload/drive/v3",
+	},
+	"dropbox": {
+		Name:        "dropbox",
+		AuthURL:     "https://www.dropbox.com/oauth2/authorize",
+		TokenURL:    "https://api.dropboxapi.com/oauth2/token",
+		ClientIDEnv: "DROPBOX_APP_KEY",
+		SecretEnv:   "DROPBOX_APP_SECRET",
+		ExtraAuthParams: map[string]string{
+			"token_access_type": "offline",
+		},
+		upload:     uploadToDropbox,
+		UploadBase: "https://content.dropboxapi.com/2",
+	},
+}
+
+const oauthStateTTL = 10 * time.Minute
+
+var (
+	storageLinks = make(map[string]*StorageLink) // keyed by provider
+	oauthStates  = make(map[string]time.Time)    // pending consent flows
+	cloudMutex   = &sync.Mutex{}
+	cloudClient  = &http.Client{Timeout: 30 * time.Minute}
+)
+
+// configured reports whether the provider's OAuth client credentials are set
+func (p *oauthProvider) configured() bool {
+	return os.Getenv(p.ClientIDEnv) != "" && os.Getenv(p.SecretEnv) != ""
+}
+
+// redirectURI is where the provider sends the user back after consent;
+// OAUTH_REDIRECT_BASE must be the public origin of this backend
+func (p *oauthProvider) redirectURI() string {
+	return strings.TrimSuffix(os.Getenv("OAUTH_REDIRECT_BASE"), "/") + "/api/storage/" + p.Name + "/callback"
+}
+
+// lookupProvider resolves {provider}, failing when unknown or unconfigured
+func lookupProvider(w http.ResponseWriter, name string) (*oauthProvider, bool) {
+	p, exists := oauthProviders[name]
+	if !exists {
+		http.Error(w, "Unknown storage provider", http.StatusNotFound)
+		return nil, false
+	}
+	if !p.configured() {
+		http.Error(w, "Storage provider not configured", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return p, true
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func connectStorageHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := lookupProvider(w, mux.Vars(r)["provider"])
+	if !ok {
+		return
+	}
+
+	state := randomToken(16)
+	cloudMutex.Lock()
+	now := time.Now()
+	for s, expires := range oauthStates {
+		if now.After(expires) {
+			delete(oauthStates, s)
+		}
+	}
+	oauthStates[state] = now.Add(oauthStateTTL)
+	cloudMutex.Unlock()
+
+	params := url.Values{
+		"client_id":     {os.Getenv(p.ClientIDEnv)},
+		"redirect_uri":  {p.redirectURI()},
+		"response_type": {"code"},
+		"state":         {state},
+	}
+	if p.Scope != "" {
+		params.Set("scope", p.Scope)
+	}
+	for k, v := range p.ExtraAuthParams {
+		params.Set(k, v)
+	}
+	http.Redirect(w, r, p.AuthURL+"?"+params.Encode(), http.StatusFound)
+}
+
+// tokenResponse is the standard OAuth 2.0 token endpoint response
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// requestToken posts a grant to the provider's token endpoint
+func (p *oauthProvider) requestToken(ctx context.Context, form url.Values) (*tokenResponse, error) {
+	form.Set("client_id", os.Getenv(p.ClientIDEnv))
+	form.Set("client_secret", os.Getenv(p.SecretEnv))
+	req, err := http.NewRequestWithContext(ctx, "POST", p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %d", resp.StatusCode)
+	}
+	var tok tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil || tok.AccessToken == "" {
+		return nil, fmt.Errorf("invalid token response")
+	}
+	return &tok, nil
+}
+
+func storageCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := lookupProvider(w, mux.Vars(r)["provider"])
+	if !ok {
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	cloudMutex.Lock()
+	expires, valid := oauthStates[state]
+	delete(oauthStates, state)
+	cloudMutex.Unlock()
+	if !valid || time.Now().After(expires) {
+		http.Error(w, "Invalid or expired state", http.StatusBadRequest)
+		return
+	}
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		http.Error(w, "Authorization was not granted", http.StatusBadRequest)
+		return
+	}
+
+	tok, err := p.requestToken(r.Context(), url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.redirectURI()},
+	})
+	if err != nil {
+		log.Printf("OAuth code exchange with %s failed: %v", p.Name, err)
+		http.Error(w, "Failed to link storage", http.StatusBadGateway)
+		return
+	}
+
+	link := &StorageLink{
+		Provider:     p.Name,
+		LinkedAt:     time.Now().UTC(),
+		AccessToken:  tok.AccessToken,
+		RefreshToken: tok.RefreshToken,
+	}
+	if tok.ExpiresIn > 0 {
+		link.Expiry = time.Now().UTC().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	}
+	cloudMutex.Lock()
+	storageLinks[p.Name] = link
+	cloudMutex.Unlock()
+	log.Printf("Linked %s storage", p.Name)
+
+	writeJSON(w, http.StatusOK, link)
+}
+
+func listStorageHandler(w http.ResponseWriter, r *http.Request) {
+	type providerStatus struct {
+		Provider   string     `json:"provider"`
+		Configured bool       `json:"configured"`
+		Linked     bool       `json:"linked"`
+		LinkedAt   *time.Time `json:"linked_at,omitempty"`
+	}
+	cloudMutex.Lock()
+	defer cloudMutex.Unlock()
+	list := make([]providerStatus, 0, len(oauthProviders))
+	for _, name := range sortedKeys(oauthProviders) {
+		status := providerStatus{Provider: name, Configured: oauthProviders[name].configured()}
+		if link, exists := storageLinks[name]; exists {
+			status.Linked = true
+			linkedAt := link.LinkedAt
+			status.LinkedAt = &linkedAt
+		}
+		list = append(list, status)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func unlinkStorageHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	cloudMutex.Lock()
+	_, exists := storageLinks[name]
+	delete(storageLinks, name)
+	cloudMutex.Unlock()
+	if !exists {
+		http.Error(w, "Storage not linked", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "unlinked"})
+}
+
+// accessToken returns a valid access token, refreshing it when expired
+func (p *oauthProvider) accessToken(ctx context.Context, link *StorageLink) (string, error) {
+	cloudMutex.Lock()
+	token, refresh, expiry := link.AccessToken, link.RefreshToken, link.Expiry
+	cloudMutex.Unlock()
+	if expiry.IsZero() || time.Until(expiry) > time.Minute {
+		return token, nil
+	}
+	if refresh == "" {
+		return "", fmt.Errorf("access token expired, relink storage")
+	}
+
+	tok, err := p.requestToken(ctx, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refresh}})
+	if err != nil {
+		return "", fmt.Errorf("token refresh failed: %v", err)
+	}
+	cloudMutex.Lock()
+	link.AccessToken = tok.AccessToken
+	if tok.RefreshToken != "" {
+		link.RefreshToken = tok.RefreshToken
+	}
+	if tok.ExpiresIn > 0 {
+		link.Expiry = time.Now().UTC().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	}
+	cloudMutex.Unlock()
+	return tok.AccessToken, nil
+}
+
+// checkUploadResponse turns a non-2xx provider response into an error
+func checkUploadResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("upload failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// uploadToDrive creates (or reuses) the export folder and uploads the file
+// with a resumable upload session so large stems stream straight from disk
+func uploadToDrive(ctx context.Context, p *oauthProvider, link *StorageLink, folder, name, path string) error {
+	token, err := p.accessToken(ctx, link)
+	if err != nil {
+		return err
+	}
+	folderID, err := driveFolder(ctx, p, token, folder)
+	if err != nil {
+		return err
+	}
+
+	// Drive only gets the one folder; a layout's directories become part of
+	// the file name
+	name = strings.ReplaceAll(name, "/", " - ")
+	meta, _ := json.Marshal(map[string]interface{}{"name": name, "parents": []string{folderID}})
+	req, _ := http.NewRequestWithContext(ctx, "POST", p.UploadBase+"/files?uploadType=resumable", strings.NewReader(string(meta)))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if err := checkUploadResponse(resp); err != nil {
+		return err
+	}
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return fmt.Errorf("no upload session returned")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	put, _ := http.NewRequestWithContext(ctx, "PUT", session, f)
+	put.ContentLength = info.Size()
+	put.Header.Set("Authorization", "Bearer "+token)
+	resp, err = cloudClient.Do(put)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkUploadResponse(resp)
+}
+
+// driveFolder finds the named top-level folder created by this app, or creates it
+func driveFolder(ctx context.Context, p *oauthProvider, token, folder string) (string, error) {
+	q := fmt.Sprintf("name = '%s' and mimeType = 'application/vnd.google-apps.folder' and trashed = false",
+		strings.ReplaceAll(folder, "'", "\\'"))
+	req, _ := http.NewRequestWithContext(ctx, "GET", p.APIBase+"/files?fields=files(id)&q="+url.QueryEscape(q), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	var found struct {
+		Files []struct {
+			ID string `json:"id"`
+		} `json:"files"`
+	}
+	err = checkUploadResponse(resp)
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&found)
+	}
+	resp.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if len(found.Files) > 0 {
+		return found.Files[0].ID, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"name": folder, "mimeType": "application/vnd.google-apps.folder"})
+	req, _ = http.NewRequestWithContext(ctx, "POST", p.APIBase+"/files?fields=id", strings.NewReader(string(body)))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = cloudClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := checkUploadResponse(resp); err != nil {
+		return "", err
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || created.ID == "" {
+		return "", fmt.Errorf("failed to create folder")
+	}
+	return created.ID, nil
+}
+
+// uploadToDropbox uploads the file into /{folder}/{name}, overwriting it
+func uploadToDropbox(ctx context.Context, p *oauthProvider, link *StorageLink, folder, name, path string) error {
+	token, err := p.accessToken(ctx, link)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	arg, _ := json.Marshal(map[string]interface{}{"path": "/" + folder + "/" + name, "mode": "overwrite", "mute": true})
+	req, _ := http.NewRequestWithContext(ctx, "POST", p.UploadBase+"/files/upload", f)
+	req.ContentLength = info.Size()
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Dropbox-API-Arg", string(arg))
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkUploadResponse(resp)
+}
+
+// oauthExporter delivers stems into a linked Drive or Dropbox account
+type oauthExporter struct {
+	provider *oauthProvider
+	link     *StorageLink
+}
+
+func (e oauthExporter) Deliver(ctx context.Context, d Delivery, files []deliveryFile) error {
+	folder := d.Folder
+	if folder == "" {
+		folder = "Track2stem"
+	}
+	for _, file := range files {
+		// Without a layout stems go straight into the folder, no job directory
+		name := file.Name
+		if d.Layout == "" {
+			name = path.Base(name)
+		}
+		if err := e.provider.upload(ctx, e.provider, e.link, folder, name, file.Path); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// exportJobHandler serves POST /api/jobs/{id}/export?target=drive|dropbox
+// with optional stems=vocals,drums, folder= and layout= query parameters.
+// It is a query-string shorthand for POST /api/jobs/{id}/deliveries.
+func exportJobHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	req := deliveryRequest{Target: q.Get("target"), Folder: q.Get("folder"), Layout: q.Get("layout")}
+	if v := q.Get("stems"); v != "" {
+		req.Stems = strings.Split(v, ",")
+	}
+	createDelivery(w, mux.Vars(r)["id"], req)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestConnectStorageRequiresCredentials(t *testing.T) {
+	t.Setenv("DROPBOX_APP_KEY", "")
+	router := mux.NewRouter()
+	router.HandleFunc("/api/storage/{provider}/connect", connectStorageHandler)
+
+	for path, want := range map[string]int{
+		"/api/storage/dropbox/connect":  http.StatusServiceUnavailable,
+		"/api/storage/onedrive/connect": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != want {
+			t.Errorf("GET %s = %d, want %d", path, rec.Code, want)
+		}
+	}
+}
+
+func TestDropboxLinkAndExport(t *testing.T) {
+	var mu sync.Mutex
+	uploads := map[string]string{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth2/token":
+			r.ParseForm()
+			if r.Form.Get("code") != "granted" || r.Form.Get("client_secret") != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "tok", "expires_in": 3600})
+		case "/2/files/upload":
+			if r.Header.Get("Authorization") != "Bearer tok" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			var arg struct {
+				Path string `json:"path"`
+			}
+			json.Unmarshal([]byte(r.Header.Get("Dropbox-API-Arg")), &arg)
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			uploads[arg.Path] = string(body)
+			mu.Unlock()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer api.Close()
+
+	original := oauthProviders["dropbox"]
+	p := *original
+	p.AuthURL, p.TokenURL, p.UploadBase = api.URL+"/authorize", api.URL+"/oauth2/token", api.URL+"/2"
+	oauthProviders["dropbox"] = &p
+	t.Setenv("DROPBOX_APP_KEY", "key")
+	t.Setenv("DROPBOX_APP_SECRET", "secret")
+	t.Setenv("OAUTH_REDIRECT_BASE", "https://stems.example.com")
+
+	saved := outputDir
+	outputDir = t.TempDir()
+	vocals := filepath.Join(outputDir, "job", "song_t2s_vocals.mp3")
+	os.MkdirAll(filepath.Dir(vocals), 0755)
+	os.WriteFile(vocals, []byte("vocal data"), 0644)
+	jobsMutex.Lock()
+	jobs["exported-job"] = &Job{ID: "exported-job", Status: "completed", OutputFiles: map[string]string{"vocals": vocals}}
+	jobsMutex.Unlock()
+	defer func() {
+		oauthProviders["dropbox"] = original
+		outputDir = saved
+		jobsMutex.Lock()
+		delete(jobs, "exported-job")
+		jobsMutex.Unlock()
+		cloudMutex.Lock()
+		delete(storageLinks, "dropbox")
+		cloudMutex.Unlock()
+	}()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/storage/{provider}/connect", connectStorageHandler)
+	router.HandleFunc("/api/storage/{provider}/callback", storageCallbackHandler)
+	router.HandleFunc("/api/jobs/{id}/export", exportJobHandler)
+	router.HandleFunc("/api/jobs/{id}/deliveries", listDeliveriesHandler)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/storage/dropbox/connect", nil))
+	location, _ := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != http.StatusFound || location.Query().Get("redirect_uri") != "https://stems.example.com/api/storage/dropbox/callback" {
+		t.Fatalf("connect = %d, Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+	state := location.Query().Get("state")
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/storage/dropbox/callback?code=granted&state="+state, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("callback = %d: %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "tok") {
+		t.Errorf("callback response leaked the access token: %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/storage/dropbox/callback?code=granted&state="+state, nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("replayed state = %d, want 400", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", "/api/jobs/exported-job/export?target=dropbox&folder=Mixes", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("export = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	runDelivery(<-deliveryQueue)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/jobs/exported-job/deliveries", nil))
+	var list []Delivery
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if len(list) != 1 || list[0].Status != "delivered" || list[0].Target != "dropbox" {
+		t.Fatalf("deliveries = %+v", list)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := uploads["/Mixes/song_t2s_vocals.mp3"]; got != "vocal data" {
+		t.Errorf("uploaded %v", uploads)
+	}
+}
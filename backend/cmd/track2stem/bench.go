@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// benchSample is the timing of one benchmark job
+type benchSample struct {
+	JobID    string  `json:"job_id,omitempty"`
+	Status   string  `json:"status"` // completed, failed
+	Error    string  `json:"error,omitempty"`
+	CacheHit bool    `json:"cache_hit,omitempty"`
+	Upload   float64 `json:"upload_seconds"`     // until the upload was accepted
+	Wait     float64 `json:"queue_wait_seconds"` // until processing started
+	Total    float64 `json:"total_seconds"`      // until the job finished
+}
+
+// latencyStats summarizes one latency over the completed jobs, in seconds
+type latencyStats struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+// benchReport is the result of `track2stem bench`
+type benchReport struct {
+	Server      string        `json:"server"`
+	File        string        `json:"file"`
+	Concurrency int           `json:"concurrency"`
+	Requests    int           `json:"requests"`
+	StartedAt   time.Time     `json:"started_at"`
+	Seconds     float64       `json:"duration_seconds"`
+	Succeeded   int           `json:"succeeded"`
+	Failed      int           `json:"failed"`
+	JobsPerMin  float64       `json:"jobs_per_minute"`
+	Upload      latencyStats  `json:"upload_latency"`
+	Wait        latencyStats  `json:"queue_wait"`
+	Total       latencyStats  `json:"total_latency"`
+	Samples     []benchSample `json:"samples"`
+}
+
+// benchJob uploads the file once and follows the job until it finishes
+func benchJob(ctx context.Context, c *client, file string, opts url.Values) benchSample {
+	s := benchSample{Status: "failed"}
+	start := time.Now()
+	submitted, err := c.upload(ctx, file, opts)
+	s.Upload = time.Since(start).Seconds()
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.JobID = submitted.ID
+	started := false
+	err = c.follow(ctx, submitted.ID, func(p progress) {
+		if !started && p.Status != "queued" && p.Status != "pending" {
+			started = true
+			s.Wait = time.Since(start).Seconds() - s.Upload
+		}
+	})
+	s.Total = time.Since(start).Seconds()
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	done, err := c.job(ctx, submitted.ID)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	if done.Status != "completed" {
+		s.Error = done.Error
+		return s
+	}
+	s.Status = "completed"
+	s.CacheHit = done.CacheHit
+	return s
+}
+
+// runBench submits up to requests jobs with at most concurrency in flight
+func runBench(ctx context.Context, c *client, file string, opts url.Values, concurrency, requests int) []benchSample {
+	samples := make([]benchSample, requests)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				samples[i] = benchJob(ctx, c, file, opts)
+			}
+		}()
+	}
+	// Jobs not yet submitted when ctx ends are left out
+	sent := 0
+	for ; sent < requests && ctx.Err() == nil; sent++ {
+		next <- sent
+	}
+	close(next)
+	wg.Wait()
+	return samples[:sent]
+}
+
+// summarize computes latency statistics from unsorted values
+func summarize(values []float64) latencyStats {
+	if len(values) == 0 {
+		return latencyStats{}
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	// Nearest-rank percentile
+	pct := func(p float64) float64 {
+		i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+		return sorted[max(i, 0)]
+	}
+	return latencyStats{
+		Min: sorted[0], Mean: sum / float64(len(sorted)),
+		P50: pct(50), P90: pct(90), P95: pct(95), P99: pct(99),
+		Max: sorted[len(sorted)-1],
+	}
+}
+
+// newBenchReport aggregates the samples of a run that took elapsed
+func newBenchReport(samples []benchSample, elapsed time.Duration) benchReport {
+	r := benchReport{Seconds: elapsed.Seconds(), Samples: samples}
+	var upload, wait, total []float64
+	for _, s := range samples {
+		if s.Status != "completed" {
+			r.Failed++
+			continue
+		}
+		r.Succeeded++
+		upload = append(upload, s.Upload)
+		wait = append(wait, s.Wait)
+		total = append(total, s.Total)
+	}
+	r.Upload, r.Wait, r.Total = summarize(upload), summarize(wait), summarize(total)
+	if elapsed > 0 {
+		r.JobsPerMin = float64(r.Succeeded) / elapsed.Minutes()
+	}
+	return r
+}
+
+// print writes the human-readable summary
+func (r benchReport) print(w io.Writer) {
+	fmt.Fprintf(w, "%d jobs of %s against %s, %d at a time\n", r.Requests, r.File, r.Server, r.Concurrency)
+	fmt.Fprintf(w, "Completed %d, failed %d in %.1fs: %.2f jobs/min\n\n", r.Succeeded, r.Failed, r.Seconds, r.JobsPerMin)
+	fmt.Fprintf(w, "%-12s %8s %8s %8s %8s %8s %8s %8s\n", "latency (s)", "min", "mean", "p50", "p90", "p95", "p99", "max")
+	for _, row := range []struct {
+		name string
+		s    latencyStats
+	}{{"upload", r.Upload}, {"queue wait", r.Wait}, {"total", r.Total}} {
+		fmt.Fprintf(w, "%-12s %8.2f %8.2f %8.2f %8.2f %8.2f %8.2f %8.2f\n",
+			row.name, row.s.Min, row.s.Mean, row.s.P50, row.s.P90, row.s.P95, row.s.P99, row.s.Max)
+	}
+	for _, s := range r.Samples {
+		if s.Error != "" {
+			fmt.Fprintf(w, "\nfirst failure: %s\n", s.Error)
+			break
+		}
+	}
+}
+
+func benchCommand(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	server := fs.String("server", defaultServer(), "backend URL")
+	file := fs.String("file", "", "audio file to upload for every job (required)")
+	concurrency := fs.Int("concurrency", 4, "jobs in flight at once")
+	requests := fs.Int("requests", 0, "jobs to run in total (default: --concurrency)")
+	reportPath := fs.String("report", "", "also write the JSON report, with every job's timings, here")
+	cache := fs.Bool("cache", false, "let the server reuse cached stems instead of separating every upload")
+	var sep separationFlags
+	sep.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: track2stem bench --file <audio> [flags]")
+		fs.PrintDefaults()
+	}
+	if _, err := parseInterspersed(fs, args); err != nil {
+		return err
+	}
+	if *file == "" || *concurrency < 1 || *requests < 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if _, err := os.Stat(*file); err != nil {
+		return err
+	}
+	if *requests == 0 {
+		*requests = *concurrency
+	}
+	opts := sep.values()
+	// Identical uploads would otherwise be served from the dedup cache
+	if !*cache {
+		opts.Set("force", "true")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	start := time.Now()
+	samples := runBench(ctx, newClient(*server), *file, opts, *concurrency, *requests)
+	report := newBenchReport(samples, time.Since(start))
+	report.Server, report.File = *server, *file
+	report.Concurrency, report.Requests = *concurrency, *requests
+	report.StartedAt = start.UTC()
+	report.print(os.Stdout)
+
+	if *reportPath != "" {
+		f, err := os.Create(*reportPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d of %d jobs failed", report.Failed, len(samples))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSummarize(t *testing.T) {
+	values := make([]float64, 0, 100)
+	for i := 100; i >= 1; i-- {
+		values = append(values, float64(i))
+	}
+	s := summarize(values)
+	if s.Min != 1 || s.Max != 100 || s.Mean != 50.5 || s.P50 != 50 || s.P90 != 90 || s.P99 != 99 {
+		t.Errorf("summarize = %+v", s)
+	}
+	if s := summarize([]float64{3}); s.P50 != 3 || s.P99 != 3 {
+		t.Errorf("summarize of one value = %+v", s)
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, peak int
+	var uploads atomic.Int32
+	forced := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/upload":
+			r.ParseMultipartForm(1 << 20)
+			mu.Lock()
+			forced = forced && r.FormValue("force") == "true"
+			mu.Unlock()
+			n := uploads.Add(1)
+			json.NewEncoder(w).Encode(job{ID: fmt.Sprintf("job-%d", n), Status: "queued"})
+		case strings.HasSuffix(r.URL.Path, "/events"):
+			mu.Lock()
+			inFlight++
+			peak = max(peak, inFlight)
+			mu.Unlock()
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: {\"status\":\"queued\"}\n\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+			fmt.Fprint(w, "data: {\"status\":\"processing\",\"progress\":50}\n\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+			status := "completed"
+			if strings.Contains(r.URL.Path, "job-3/") {
+				status = "failed"
+			}
+			fmt.Fprintf(w, "data: {\"status\":%q}\n\n", status)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		case strings.HasPrefix(r.URL.Path, "/api/jobs/"):
+			id := strings.TrimPrefix(r.URL.Path, "/api/jobs/")
+			if id == "job-3" {
+				json.NewEncoder(w).Encode(job{ID: id, Status: "failed", Error: "Processor failed"})
+				return
+			}
+			json.NewEncoder(w).Encode(job{ID: id, Status: "completed"})
+		}
+	}))
+	defer server.Close()
+
+	file := filepath.Join(t.TempDir(), "sample.wav")
+	os.WriteFile(file, []byte("RIFF"), 0644)
+	opts := url.Values{"force": {"true"}}
+	start := time.Now()
+	samples := runBench(context.Background(), newClient(server.URL), file, opts, 2, 5)
+	report := newBenchReport(samples, time.Since(start))
+
+	if len(samples) != 5 || report.Succeeded != 4 || report.Failed != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+	if peak > 2 || !forced {
+		t.Errorf("peak concurrency %d, forced %v", peak, forced)
+	}
+	if report.Wait.Min < 0.015 || report.Total.Min < 0.035 || report.Total.Max < report.Total.P50 || report.JobsPerMin <= 0 {
+		t.Errorf("latencies = wait %+v total %+v (%.1f jobs/min)", report.Wait, report.Total, report.JobsPerMin)
+	}
+	var buf strings.Builder
+	report.print(&buf)
+	if !strings.Contains(buf.String(), "first failure: Processor failed") {
+		t.Errorf("summary = %s", buf.String())
+	}
+}
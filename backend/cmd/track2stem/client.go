@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// job mirrors the backend's job JSON
+type job struct {
+	ID             string            `json:"id"`
+	Status         string            `json:"status"`
+	FileName       string            `json:"filename"`
+	Error          string            `json:"error,omitempty"`
+	OutputFiles    map[string]string `json:"output_files,omitempty"`
+	Metadata       *trackMetadata    `json:"metadata,omitempty"`
+	ProcessingTime string            `json:"processing_time,omitempty"`
+	CacheHit       bool              `json:"cache_hit,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+}
+
+// trackMetadata is the tag data the backend detected for a job's upload
+type trackMetadata struct {
+	Title  string `json:"title,omitempty"`
+	Artist string `json:"artist,omitempty"`
+	Album  string `json:"album,omitempty"`
+	Track  string `json:"track,omitempty"`
+	Year   string `json:"year,omitempty"`
+}
+
+// progress is a processing update for one job
+type progress struct {
+	Status   string  `json:"status"`
+	Progress float64 `json:"progress"`
+	Stage    string  `json:"stage"`
+}
+
+// client talks to a track2stem backend over its HTTP API
+type client struct {
+	baseURL string
+	http    *http.Client
+	stream  *http.Client // no timeout, for event streams open for a whole job
+}
+
+func newClient(baseURL string) *client {
+	transport := http.DefaultTransport
+	if key := os.Getenv("TRACK2STEM_API_KEY"); key != "" {
+		transport = keyTransport{key: key, next: transport}
+	}
+	return &client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http:    &http.Client{Timeout: 30 * time.Minute, Transport: transport},
+		stream:  &http.Client{Transport: transport},
+	}
+}
+
+// keyTransport sends the API key with every request, for backends that
+// require one (API_KEYS_REQUIRED)
+type keyTransport struct {
+	key  string
+	next http.RoundTripper
+}
+
+func (t keyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("X-API-Key", t.key)
+	return t.next.RoundTrip(req)
+}
+
+// rejection is the JSON body of a refused request, with what to do about it
+type rejection struct {
+	Error       string `json:"error"`
+	Remediation *struct {
+		Hint string `json:"hint"`
+	} `json:"remediation"`
+}
+
+// apiError turns a non-2xx response into an error carrying the body text,
+// or the message and remediation hint of a JSON rejection
+func apiError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var r rejection
+	if json.Unmarshal(body, &r) == nil && r.Error != "" {
+		if r.Remediation != nil && r.Remediation.Hint != "" {
+			return fmt.Errorf("%s: %s. %s", resp.Status, r.Error, r.Remediation.Hint)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, r.Error)
+	}
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// Files larger than chunkedUploadThreshold are sent with the resumable
+// upload API in uploadChunkSize pieces, so a dropped connection only costs
+// the chunk in flight
+var (
+	chunkedUploadThreshold int64 = 64 << 20
+	uploadChunkSize        int64 = 16 << 20
+	uploadRetryDelay             = 2 * time.Second
+)
+
+// uploadChunkAttempts is how often a chunk is tried before giving up
+const uploadChunkAttempts = 5
+
+// setTermsHeader sends the acceptance ID for instances that gate uploads on
+// terms (POST /api/terms/accept)
+func setTermsHeader(req *http.Request) {
+	if id := os.Getenv("TRACK2STEM_TERMS"); id != "" {
+		req.Header.Set("X-Track2stem-Terms", id)
+	}
+}
+
+// upload streams a file to POST /api/upload with the given form options,
+// or in resumable chunks when it is large
+func (c *client) upload(ctx context.Context, path string, opts url.Values) (*job, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Size() > chunkedUploadThreshold {
+		return c.uploadChunked(ctx, f, filepath.Base(path), info.Size(), opts)
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		for key, values := range opts {
+			for _, v := range values {
+				mw.WriteField(key, v)
+			}
+		}
+		part, err := mw.CreateFormFile("file", filepath.Base(path))
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/api/upload", pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	setTermsHeader(req)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+	var j job
+	if err := json.NewDecoder(resp.Body).Decode(&j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// uploadChunked sends a file through POST /api/upload/init, PATCH
+// /api/upload/{id} and POST /api/upload/{id}/complete, resuming from the
+// server's offset after a failed chunk
+func (c *client) uploadChunked(ctx context.Context, f *os.File, name string, size int64, opts url.Values) (*job, error) {
+	init := map[string]interface{}{"filename": name, "size": size}
+	for key := range opts {
+		if key != "force" {
+			init[key] = opts.Get(key)
+		}
+	}
+	body, _ := json.Marshal(init)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/api/upload/init", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setTermsHeader(req)
+	var upload struct {
+		ID     string `json:"id"`
+		Offset int64  `json:"offset"`
+	}
+	if err := c.doJSON(req, http.StatusCreated, &upload); err != nil {
+		return nil, err
+	}
+	uploadURL := c.baseURL + "/api/upload/" + url.PathEscape(upload.ID)
+
+	offset, failures := upload.Offset, 0
+	for offset < size {
+		n, err := c.sendChunk(ctx, uploadURL, f, offset, min(uploadChunkSize, size-offset))
+		if err == nil {
+			offset, failures = n, 0
+			continue
+		}
+		if failures++; failures >= uploadChunkAttempts || ctx.Err() != nil {
+			return nil, fmt.Errorf("upload interrupted at byte %d: %v", offset, err)
+		}
+		select {
+		case <-time.After(uploadRetryDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// Part of the chunk may have been stored; continue from what the server has
+		if req, err := http.NewRequestWithContext(ctx, "GET", uploadURL, nil); err == nil {
+			var state struct {
+				Offset int64 `json:"offset"`
+			}
+			if c.doJSON(req, http.StatusOK, &state) == nil {
+				offset = state.Offset
+			}
+		}
+	}
+
+	completeURL := uploadURL + "/complete"
+	if opts.Get("force") == "true" {
+		completeURL += "?force=true"
+	}
+	req, err = http.NewRequestWithContext(ctx, "POST", completeURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	setTermsHeader(req)
+	var j job
+	if err := c.doJSON(req, http.StatusOK, &j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// sendChunk PATCHes length bytes of f at offset and returns the server's
+// new offset
+func (c *client) sendChunk(ctx context.Context, uploadURL string, f *os.File, offset, length int64) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "PATCH", uploadURL, io.NewSectionReader(f, offset, length))
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, apiError(resp)
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// doJSON sends req and decodes the response, which must have status want
+func (c *client) doJSON(req *http.Request, want int, v interface{}) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != want {
+		return apiError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *client) job(ctx context.Context, id string) (*job, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/api/jobs/"+url.PathEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+	var j job
+	if err := json.NewDecoder(resp.Body).Decode(&j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// jobs lists every job on the server, newest first, following the
+// listing's pages
+func (c *client) jobs(ctx context.Context) ([]job, error) {
+	var list []job
+	cursor := ""
+	for {
+		query := url.Values{"limit": {"1000"}}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+		var page struct {
+			Jobs       []job  `json:"jobs"`
+			NextCursor string `json:"next_cursor"`
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/api/jobs?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.doJSON(req, http.StatusOK, &page); err != nil {
+			return nil, err
+		}
+		list = append(list, page.Jobs...)
+		if page.NextCursor == "" {
+			return list, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// follow reports a job's progress until it finishes or ctx ends. It reads
+// the server-sent event stream at /api/jobs/{id}/events and falls back to
+// polling /api/processing-status/{id} on servers without it.
+func (c *client) follow(ctx context.Context, id string, update func(progress)) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/api/jobs/"+url.PathEscape(id)+"/events", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	// The stream stays open for the whole job, so bypass the client timeout
+	resp, err := c.stream.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return readEvents(resp.Body, func(data []byte) bool {
+			var p progress
+			if json.Unmarshal(data, &p) != nil {
+				return true
+			}
+			update(p)
+			return p.Status != "completed" && p.Status != "failed"
+		})
+	}
+	resp.Body.Close()
+
+	for {
+		p, err := c.processingStatus(ctx, id)
+		if err != nil {
+			return err
+		}
+		update(*p)
+		if p.Status == "completed" || p.Status == "failed" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// readEvents calls fn with the data of each server-sent event until fn
+// returns false or the stream ends
+func readEvents(r io.Reader, fn func(data []byte) bool) error {
+	scanner := bufio.NewScanner(r)
+	var data []byte
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 && !fn(data) {
+				return nil
+			}
+			data = nil
+		case strings.HasPrefix(line, "data:"):
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")...)
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *client) processingStatus(ctx context.Context, id string) (*progress, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/api/processing-status/"+url.PathEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+	var p progress
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// wait polls a job until it completes or fails
+func (c *client) wait(ctx context.Context, id string, interval time.Duration) (*job, error) {
+	for {
+		j, err := c.job(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if j.Status == "completed" || j.Status == "failed" {
+			return j, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// deliver asks the server to deliver a job's stems to a configured target
+// and returns the delivery ID
+func (c *client) deliver(ctx context.Context, id, target string, stems []string) (string, error) {
+	body, _ := json.Marshal(map[string]interface{}{"target": target, "stems": stems})
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/api/jobs/"+url.PathEscape(id)+"/deliveries", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return "", apiError(resp)
+	}
+	var d struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return "", err
+	}
+	return d.ID, nil
+}
+
+// download saves one stem into dir, named as the server suggests, and
+// returns the written path
+func (c *client) download(ctx context.Context, id, stem, dir string) (string, error) {
+	return c.save(ctx, id, stem, func(name string) string { return filepath.Join(dir, name) })
+}
+
+// downloadAs saves one stem to dst
+func (c *client) downloadAs(ctx context.Context, id, stem, dst string) (string, error) {
+	return c.save(ctx, id, stem, func(string) string { return dst })
+}
+
+// save downloads a stem to the path target picks from the suggested name
+func (c *client) save(ctx context.Context, id, stem string, target func(name string) string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/api/download/"+url.PathEscape(id)+"/"+url.PathEscape(stem), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", apiError(resp)
+	}
+
+	name := stem
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		name = filepath.Base(params["filename"])
+	}
+	dst := target(name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	tmp := dst + ".part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return dst, os.Rename(tmp, dst)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUploadChunked(t *testing.T) {
+	oldThreshold, oldChunk, oldDelay := chunkedUploadThreshold, uploadChunkSize, uploadRetryDelay
+	chunkedUploadThreshold, uploadChunkSize, uploadRetryDelay = 4, 4, 0
+	t.Cleanup(func() { chunkedUploadThreshold, uploadChunkSize, uploadRetryDelay = oldThreshold, oldChunk, oldDelay })
+
+	var mu sync.Mutex
+	var received []byte
+	var init map[string]interface{}
+	patches, forced := 0, false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/api/upload/init":
+			json.NewDecoder(r.Body).Decode(&init)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id": "u1", "offset": 0}`))
+		case r.Method == "PATCH" && r.URL.Path == "/api/upload/u1":
+			if patches++; patches == 2 {
+				// Keep half the chunk, then drop the connection's response
+				chunk, _ := io.ReadAll(r.Body)
+				received = append(received, chunk[:2]...)
+				http.Error(w, "Chunk interrupted", http.StatusBadRequest)
+				return
+			}
+			if r.Header.Get("Upload-Offset") != strconv.Itoa(len(received)) {
+				http.Error(w, "Offset mismatch", http.StatusConflict)
+				return
+			}
+			chunk, _ := io.ReadAll(r.Body)
+			received = append(received, chunk...)
+			w.Header().Set("Upload-Offset", strconv.Itoa(len(received)))
+			w.Write([]byte(`{}`))
+		case r.Method == "GET" && r.URL.Path == "/api/upload/u1":
+			w.Write([]byte(`{"offset": ` + strconv.Itoa(len(received)) + `}`))
+		case r.Method == "POST" && r.URL.Path == "/api/upload/u1/complete":
+			forced = r.URL.Query().Get("force") == "true"
+			w.Write([]byte(`{"id": "job-1", "status": "queued"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "master.wav")
+	os.WriteFile(path, []byte("0123456789"), 0644)
+	j, err := newClient(server.URL).upload(context.Background(), path, url.Values{"output_format": {"flac"}, "force": {"true"}})
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if j.ID != "job-1" || string(received) != "0123456789" || !forced {
+		t.Errorf("job %+v, server got %q (forced %v)", j, received, forced)
+	}
+	if init["filename"] != "master.wav" || init["size"] != float64(10) || init["output_format"] != "flac" || init["force"] != nil {
+		t.Errorf("init request = %v", init)
+	}
+}
+
+func TestAPIErrorHint(t *testing.T) {
+	for body, want := range map[string]string{
+		`{"error": "File too large", "code": "file_too_large", "remediation": {"action": "shrink", "hint": "Compress or trim the file to under 100 MB"}}`: "413 Request Entity Too Large: File too large. Compress or trim the file to under 100 MB",
+		`{"error": "File too large"}`: "413 Request Entity Too Large: File too large",
+		"File too large\n":            "413 Request Entity Too Large: File too large",
+	} {
+		resp := &http.Response{Status: "413 Request Entity Too Large", Body: io.NopCloser(strings.NewReader(body))}
+		if err := apiError(resp); err.Error() != want {
+			t.Errorf("%s = %q", body, err)
+		}
+	}
+}
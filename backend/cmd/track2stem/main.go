@@ -0,0 +1,126 @@
+// Command track2stem is a command-line client for a track2stem backend.
+//
+//	track2stem watch ./incoming --out ./stems --two-stems vocals
+//	track2stem run jobs.yaml --report results.json
+//	track2stem bench --concurrency 20 --file sample.wav
+//	track2stem serve --port 8080
+//	track2stem migrate --dry-run
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+const usage = `Usage: track2stem <command> [arguments]
+
+Commands:
+  watch <dir>        Upload new audio files from a directory and download their stems
+  run <manifest>     Run the batch of jobs listed in a YAML manifest
+  bench              Load-test a backend with concurrent jobs and report latencies
+  tui                Browse the job queue, watch progress and download stems
+  serve              Run a self-contained backend that separates stems on this machine
+  migrate            Copy a backend's jobs and their files to its object storage bucket
+
+Run "track2stem <command> -h" for the command's flags.
+The backend URL defaults to $TRACK2STEM_URL or http://localhost:8080.
+Set $TRACK2STEM_API_KEY for backends that require an API key.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "watch":
+		err = watchCommand(os.Args[2:])
+	case "run":
+		err = runCommand(os.Args[2:])
+	case "bench":
+		err = benchCommand(os.Args[2:])
+	case "tui":
+		err = tuiCommand(os.Args[2:])
+	case "serve":
+		err = serveCommand(os.Args[2:])
+	case "migrate":
+		err = migrateCommand(os.Args[2:])
+	case "-h", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "track2stem: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "track2stem:", err)
+		os.Exit(1)
+	}
+}
+
+// separationFlags are the per-job options shared by commands that submit jobs
+type separationFlags struct {
+	twoStems string
+	model    string
+	format   string
+	bitrate  string
+	force    bool
+}
+
+func (s *separationFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&s.twoStems, "two-stems", "", "isolate one stem (vocals, drums, bass, guitar, piano, other) plus its instrumental")
+	fs.StringVar(&s.model, "model", "", "demucs model (default: server default)")
+	fs.StringVar(&s.format, "format", "", "output format: mp3, wav or flac (default: server default)")
+	fs.StringVar(&s.bitrate, "mp3-bitrate", "", "mp3 bitrate in kbps: 128, 192, 256 or 320 (default 320)")
+	fs.BoolVar(&s.force, "force", false, "separate again even if the server has stems for the same audio and options")
+}
+
+// values converts the flags into upload form fields
+func (s *separationFlags) values() url.Values {
+	v := url.Values{}
+	if s.twoStems != "" {
+		v.Set("stem_mode", "isolate")
+		v.Set("isolate_stem", s.twoStems)
+	}
+	if s.model != "" {
+		v.Set("model", s.model)
+	}
+	if s.format != "" {
+		v.Set("output_format", s.format)
+	}
+	if s.bitrate != "" {
+		v.Set("mp3_bitrate", s.bitrate)
+	}
+	if s.force {
+		v.Set("force", "true")
+	}
+	return v
+}
+
+func defaultServer() string {
+	if v := os.Getenv("TRACK2STEM_URL"); v != "" {
+		return v
+	}
+	return "http://localhost:8080"
+}
+
+// parseInterspersed parses flags that may appear before or after the
+// positional arguments ("watch ./in --out ./stems") and returns the positionals
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
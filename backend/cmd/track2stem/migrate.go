@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+)
+
+// migrationReport mirrors the backend's answer to POST /api/admin/migrate
+type migrationReport struct {
+	Target    string            `json:"target"`
+	DryRun    bool              `json:"dry_run"`
+	Migrated  []string          `json:"migrated"`
+	Skipped   map[string]string `json:"skipped"`
+	Failed    map[string]string `json:"failed"`
+	Objects   int               `json:"objects_copied"`
+	Bytes     int64             `json:"bytes_copied"`
+	Unchanged int               `json:"objects_unchanged"`
+}
+
+// migrateCommand copies a backend's jobs to its object storage bucket:
+//
+//	track2stem migrate --dry-run
+func migrateCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	server := fs.String("server", defaultServer(), "backend URL")
+	token := fs.String("admin-token", os.Getenv("TRACK2STEM_ADMIN_TOKEN"), "the backend's ADMIN_TOKEN (default $TRACK2STEM_ADMIN_TOKEN)")
+	dryRun := fs.Bool("dry-run", false, "only list what would be copied")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: track2stem migrate [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *token == "" {
+		return fmt.Errorf("migrate needs --admin-token or $TRACK2STEM_ADMIN_TOKEN")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report, err := newClient(*server).migrate(ctx, *token, *dryRun)
+	if err != nil {
+		return err
+	}
+	report.print(os.Stdout)
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d jobs failed to migrate; run it again to retry them", len(report.Failed))
+	}
+	return nil
+}
+
+func (c *client) migrate(ctx context.Context, token string, dryRun bool) (*migrationReport, error) {
+	u := c.baseURL + "/api/admin/migrate"
+	if dryRun {
+		u += "?dry_run=true"
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	var report migrationReport
+	if err := c.doJSON(req, http.StatusOK, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func (r *migrationReport) print(w io.Writer) {
+	verb := "Migrated"
+	if r.DryRun {
+		verb = "Would migrate"
+	}
+	fmt.Fprintf(w, "%s %d jobs to %s: %d objects copied (%d bytes), %d already there\n",
+		verb, len(r.Migrated), r.Target, r.Objects, r.Bytes, r.Unchanged)
+	for _, id := range sortedIDs(r.Skipped) {
+		fmt.Fprintf(w, "  skipped %s: %s\n", id, r.Skipped[id])
+	}
+	for _, id := range sortedIDs(r.Failed) {
+		fmt.Fprintf(w, "  failed  %s: %s\n", id, r.Failed[id])
+	}
+}
+
+func sortedIDs(m map[string]string) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/admin/migrate" || r.Header.Get("Authorization") != "Bearer admin" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		dryRun := r.URL.Query().Get("dry_run")
+		if dryRun == "" {
+			dryRun = "false"
+		}
+		w.Write([]byte(`{"target": "s3://stems", "dry_run": ` + dryRun +
+			`, "migrated": ["a"], "failed": {"b": "vocals missing"}, "objects_copied": 3, "bytes_copied": 2048, "objects_unchanged": 1}`))
+	}))
+	defer server.Close()
+
+	c := newClient(server.URL)
+	if _, err := c.migrate(context.Background(), "wrong", false); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("wrong token = %v", err)
+	}
+	report, err := c.migrate(context.Background(), "admin", true)
+	if err != nil || !report.DryRun || len(report.Migrated) != 1 || report.Failed["b"] != "vocals missing" {
+		t.Fatalf("migrate = %+v, %v", report, err)
+	}
+	var out bytes.Buffer
+	report.print(&out)
+	want := "Would migrate 1 jobs to s3://stems: 3 objects copied (2048 bytes), 1 already there\n  failed  b: vocals missing\n"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
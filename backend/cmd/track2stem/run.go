@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// manifestJob is one file of a batch manifest. Empty fields inherit from
+// the manifest's defaults.
+type manifestJob struct {
+	File     string            `yaml:"file" json:"file"`
+	TwoStems string            `yaml:"two_stems,omitempty" json:"two_stems,omitempty"`
+	Model    string            `yaml:"model,omitempty" json:"model,omitempty"`
+	Format   string            `yaml:"format,omitempty" json:"format,omitempty"`
+	Options  map[string]string `yaml:"options,omitempty" json:"options,omitempty"` // extra upload fields, e.g. shifts
+	Stems    []string          `yaml:"stems,omitempty" json:"stems,omitempty"`     // stems to download; default all
+	Out      string            `yaml:"out,omitempty" json:"out,omitempty"`         // local download directory
+	Deliver  []string          `yaml:"deliver,omitempty" json:"deliver,omitempty"` // server-side delivery targets
+}
+
+// manifest is the YAML document read by `track2stem run`
+type manifest struct {
+	Server   string        `yaml:"server"`
+	Parallel int           `yaml:"parallel"`
+	Defaults manifestJob   `yaml:"defaults"`
+	Jobs     []manifestJob `yaml:"jobs"`
+}
+
+// runResult is the machine-readable outcome of one manifest entry
+type runResult struct {
+	File       string   `json:"file"`
+	JobID      string   `json:"job_id,omitempty"`
+	Status     string   `json:"status"` // completed, failed
+	Error      string   `json:"error,omitempty"`
+	Outputs    []string `json:"outputs,omitempty"`
+	Deliveries []string `json:"deliveries,omitempty"` // delivery IDs
+	Seconds    float64  `json:"duration_seconds"`
+}
+
+// runReport is written as JSON once every manifest entry has finished
+type runReport struct {
+	Manifest   string      `json:"manifest"`
+	StartedAt  time.Time   `json:"started_at"`
+	FinishedAt time.Time   `json:"finished_at"`
+	Succeeded  int         `json:"succeeded"`
+	Failed     int         `json:"failed"`
+	Results    []runResult `json:"results"`
+}
+
+// loadManifest parses a manifest, applies defaults and resolves paths
+// relative to the manifest's directory
+func loadManifest(path string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if len(m.Jobs) == 0 {
+		return nil, fmt.Errorf("%s lists no jobs", path)
+	}
+	if m.Parallel == 0 {
+		m.Parallel = 2
+	}
+	if m.Parallel < 0 {
+		return nil, fmt.Errorf("parallel must be positive")
+	}
+
+	base := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(base, p)
+	}
+	d := m.Defaults
+	for i := range m.Jobs {
+		j := &m.Jobs[i]
+		if j.File == "" {
+			return nil, fmt.Errorf("job %d has no file", i+1)
+		}
+		if j.TwoStems == "" {
+			j.TwoStems = d.TwoStems
+		}
+		if j.Model == "" {
+			j.Model = d.Model
+		}
+		if j.Format == "" {
+			j.Format = d.Format
+		}
+		if j.Stems == nil {
+			j.Stems = d.Stems
+		}
+		if j.Deliver == nil {
+			j.Deliver = d.Deliver
+		}
+		merged := make(map[string]string)
+		for k, v := range d.Options {
+			merged[k] = v
+		}
+		for k, v := range j.Options {
+			merged[k] = v
+		}
+		j.Options = merged
+		if j.Out == "" {
+			out := d.Out
+			if out == "" {
+				out = "stems"
+			}
+			name := filepath.Base(j.File)
+			j.Out = filepath.Join(out, name[:len(name)-len(filepath.Ext(name))])
+		}
+		j.File = resolve(j.File)
+		j.Out = resolve(j.Out)
+	}
+	return &m, nil
+}
+
+// values converts the job's options into upload form fields
+func (j manifestJob) values() url.Values {
+	v := (&separationFlags{twoStems: j.TwoStems, model: j.Model, format: j.Format}).values()
+	for k, val := range j.Options {
+		v.Set(k, val)
+	}
+	return v
+}
+
+// runJob uploads, waits, downloads and requests deliveries for one entry
+func runJob(ctx context.Context, c *client, j manifestJob, poll time.Duration) runResult {
+	start := time.Now()
+	res := runResult{File: j.File, Status: "failed"}
+	defer func() { res.Seconds = time.Since(start).Seconds() }()
+
+	submitted, err := c.upload(ctx, j.File, j.values())
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.JobID = submitted.ID
+	done, err := c.wait(ctx, submitted.ID, poll)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if done.Status == "failed" {
+		res.Error = done.Error
+		return res
+	}
+
+	stems := j.Stems
+	if len(stems) == 0 {
+		for stem := range done.OutputFiles {
+			stems = append(stems, stem)
+		}
+		sort.Strings(stems)
+	}
+	for _, stem := range stems {
+		path, err := c.download(ctx, done.ID, stem, j.Out)
+		if err != nil {
+			res.Error = fmt.Sprintf("download %s: %v", stem, err)
+			return res
+		}
+		res.Outputs = append(res.Outputs, path)
+	}
+	for _, target := range j.Deliver {
+		id, err := c.deliver(ctx, done.ID, target, j.Stems)
+		if err != nil {
+			res.Error = fmt.Sprintf("deliver to %s: %v", target, err)
+			return res
+		}
+		res.Deliveries = append(res.Deliveries, id)
+	}
+	res.Status = "completed"
+	return res
+}
+
+// runManifest executes every entry with at most m.Parallel in flight;
+// results keep the manifest's order
+func runManifest(ctx context.Context, c *client, m *manifest, poll time.Duration) []runResult {
+	results := make([]runResult, len(m.Jobs))
+	sem := make(chan struct{}, m.Parallel)
+	var wg sync.WaitGroup
+	for i, j := range m.Jobs {
+		wg.Add(1)
+		go func(i int, j manifestJob) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = runJob(ctx, c, j, poll)
+			if results[i].Status == "completed" {
+				log.Printf("%s: completed (job %s)", j.File, results[i].JobID)
+			} else {
+				log.Printf("%s: failed: %s", j.File, results[i].Error)
+			}
+		}(i, j)
+	}
+	wg.Wait()
+	return results
+}
+
+func runCommand(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	server := fs.String("server", "", "backend URL (default: manifest server, $TRACK2STEM_URL or http://localhost:8080)")
+	reportPath := fs.String("report", "", "write the JSON results report here (default: stdout)")
+	parallel := fs.Int("parallel", 0, "override the manifest's parallelism")
+	poll := fs.Duration("poll", 3*time.Second, "how often to poll job status")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: track2stem run <manifest.yaml> [flags]")
+		fs.PrintDefaults()
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	m, err := loadManifest(positional[0])
+	if err != nil {
+		return err
+	}
+	if *parallel > 0 {
+		m.Parallel = *parallel
+	}
+	serverURL := *server
+	if serverURL == "" {
+		serverURL = m.Server
+	}
+	if serverURL == "" {
+		serverURL = defaultServer()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	report := runReport{Manifest: positional[0], StartedAt: time.Now().UTC()}
+	report.Results = runManifest(ctx, newClient(serverURL), m, *poll)
+	report.FinishedAt = time.Now().UTC()
+	for _, r := range report.Results {
+		if r.Status == "completed" {
+			report.Succeeded++
+		} else {
+			report.Failed++
+		}
+	}
+
+	out := os.Stdout
+	if *reportPath != "" {
+		f, err := os.Create(*reportPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d of %d jobs failed", report.Failed, len(report.Results))
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadManifest(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "jobs.yaml")
+	os.WriteFile(path, []byte(`
+parallel: 3
+defaults:
+  model: htdemucs_ft
+  out: ./stems
+  options:
+    shifts: "2"
+jobs:
+  - file: songs/a.mp3
+    two_stems: vocals
+  - file: /library/b.wav
+    model: htdemucs_6s
+    out: /tmp/b
+    options:
+      shifts: "5"
+`), 0644)
+
+	m, err := loadManifest(path)
+	if err != nil {
+		t.Fatalf("loadManifest: %v", err)
+	}
+	a, b := m.Jobs[0], m.Jobs[1]
+	if m.Parallel != 3 || a.File != filepath.Join(dir, "songs/a.mp3") || a.Out != filepath.Join(dir, "stems/a") {
+		t.Errorf("unexpected first job %+v (parallel %d)", a, m.Parallel)
+	}
+	if v := a.values(); v.Get("model") != "htdemucs_ft" || v.Get("stem_mode") != "isolate" || v.Get("shifts") != "2" {
+		t.Errorf("first job values = %v", v)
+	}
+	if v := b.values(); b.File != "/library/b.wav" || b.Out != "/tmp/b" || v.Get("model") != "htdemucs_6s" || v.Get("shifts") != "5" {
+		t.Errorf("second job %+v values %v", b, v)
+	}
+
+	os.WriteFile(path, []byte("jobs: []\n"), 0644)
+	if _, err := loadManifest(path); err == nil {
+		t.Error("expected empty manifest to be rejected")
+	}
+}
+
+func TestRunManifest(t *testing.T) {
+	var mu sync.Mutex
+	delivered := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/upload":
+			r.ParseMultipartForm(1 << 20)
+			_, header, _ := r.FormFile("file")
+			if header.Filename == "bad.mp3" {
+				http.Error(w, "Invalid model value", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(job{ID: "job-good", Status: "pending"})
+		case r.URL.Path == "/api/jobs/job-good":
+			json.NewEncoder(w).Encode(job{ID: "job-good", Status: "completed", OutputFiles: map[string]string{"vocals": "x"}})
+		case strings.HasSuffix(r.URL.Path, "/deliveries"):
+			var body struct{ Target string }
+			json.NewDecoder(r.Body).Decode(&body)
+			mu.Lock()
+			delivered = append(delivered, body.Target)
+			mu.Unlock()
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]string{"id": "delivery-1"})
+		default:
+			w.Write([]byte("audio"))
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	for _, name := range []string{"good.mp3", "bad.mp3"} {
+		os.WriteFile(filepath.Join(dir, name), []byte("audio"), 0644)
+	}
+	m := &manifest{Parallel: 2, Jobs: []manifestJob{
+		{File: filepath.Join(dir, "good.mp3"), Out: filepath.Join(dir, "out"), Deliver: []string{"s3"}},
+		{File: filepath.Join(dir, "bad.mp3"), Out: filepath.Join(dir, "out")},
+	}}
+
+	results := runManifest(context.Background(), newClient(server.URL), m, time.Millisecond)
+	if results[0].Status != "completed" || len(results[0].Outputs) != 1 || results[0].Deliveries[0] != "delivery-1" {
+		t.Errorf("good result = %+v", results[0])
+	}
+	if results[1].Status != "failed" || !strings.Contains(results[1].Error, "Invalid model value") {
+		t.Errorf("bad result = %+v", results[1])
+	}
+	if len(delivered) != 1 || delivered[0] != "s3" {
+		t.Errorf("deliveries requested = %v", delivered)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// serverBinary is the backend built with -tags embedded (make embedded),
+// which separates stems itself when no processor is configured
+const serverBinary = "track2stem-server"
+
+// serveCommand runs a self-contained backend in the foreground:
+//
+//	track2stem serve --port 8080 --data ~/stems
+func serveCommand(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	port := fs.String("port", "8080", "port to listen on")
+	data := fs.String("data", "", "directory for uploads and stems (default: ~/.local/share/track2stem)")
+	server := fs.String("server", "", "backend binary to run (default: "+serverBinary+" next to this command or on the PATH)")
+	fs.Parse(args)
+
+	path, err := findServer(*server)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(path)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), serveEnv(*port, *data)...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Pass Ctrl-C and SIGTERM on so running jobs can finish
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	return cmd.Wait()
+}
+
+// findServer resolves the backend binary: the given path, or else
+// serverBinary beside the running executable or on the PATH
+func findServer(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	if self, err := os.Executable(); err == nil {
+		beside := filepath.Join(filepath.Dir(self), serverBinary)
+		if info, err := os.Stat(beside); err == nil && !info.IsDir() {
+			return beside, nil
+		}
+	}
+	if path, err := exec.LookPath(serverBinary); err == nil {
+		return path, nil
+	}
+	return "", errors.New(serverBinary + " not found; build it with make embedded or pass --server")
+}
+
+// serveEnv is the backend configuration for the serve flags
+func serveEnv(port, data string) []string {
+	env := []string{"PORT=" + port}
+	if data != "" {
+		env = append(env, "UPLOAD_DIR="+filepath.Join(data, "uploads"), "OUTPUT_DIR="+filepath.Join(data, "outputs"))
+	}
+	return env
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindServer(t *testing.T) {
+	if path, err := findServer("/opt/track2stem/server"); err != nil || path != "/opt/track2stem/server" {
+		t.Errorf("explicit server = %q, %v", path, err)
+	}
+
+	dir := t.TempDir()
+	bin := filepath.Join(dir, serverBinary)
+	os.WriteFile(bin, []byte("#!/bin/sh\n"), 0755)
+	t.Setenv("PATH", dir)
+	if path, err := findServer(""); err != nil || path != bin {
+		t.Errorf("server on the PATH = %q, %v", path, err)
+	}
+	t.Setenv("PATH", t.TempDir())
+	if _, err := findServer(""); err == nil {
+		t.Error("expected a missing server to be reported")
+	}
+}
+
+func TestServeEnv(t *testing.T) {
+	if got := serveEnv("9000", ""); !reflect.DeepEqual(got, []string{"PORT=9000"}) {
+		t.Errorf("serveEnv without --data = %v", got)
+	}
+	want := []string{"PORT=8080", "UPLOAD_DIR=/srv/t2s/uploads", "OUTPUT_DIR=/srv/t2s/outputs"}
+	if got := serveEnv("8080", "/srv/t2s"); !reflect.DeepEqual(got, want) {
+		t.Errorf("serveEnv = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Key names produced by readKeys
+const (
+	keyUp    = "up"
+	keyDown  = "down"
+	keyEnter = "enter"
+	keyEsc   = "esc"
+	keySpace = "space"
+	keyQuit  = "quit"
+)
+
+// tuiAction is what the event loop should do after a key press
+type tuiAction int
+
+const (
+	actionNone tuiAction = iota
+	actionQuit
+	actionRefresh
+	actionDownload
+)
+
+// tuiRow is one job in the queue view
+type tuiRow struct {
+	job
+	Progress float64
+	Stage    string
+}
+
+// tuiModel is the state of the terminal UI, kept free of terminal I/O so
+// key handling and rendering can be tested
+type tuiModel struct {
+	rows   []tuiRow
+	cursor int
+
+	// stem selection view for the job under the cursor
+	stemView   bool
+	stems      []string
+	selected   map[string]bool
+	stemCursor int
+
+	message string
+	width   int
+}
+
+// setJobs replaces the queue, keeping progress already received and the
+// cursor on the same job
+func (m *tuiModel) setJobs(list []job) {
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	current := ""
+	if m.cursor < len(m.rows) {
+		current = m.rows[m.cursor].ID
+	}
+	old := make(map[string]tuiRow, len(m.rows))
+	for _, r := range m.rows {
+		old[r.ID] = r
+	}
+	m.rows = m.rows[:0]
+	m.cursor = 0
+	for i, j := range list {
+		r := tuiRow{job: j}
+		if prev, ok := old[j.ID]; ok {
+			r.Progress, r.Stage = prev.Progress, prev.Stage
+		}
+		if j.Status == "completed" {
+			r.Progress = 100
+		}
+		m.rows = append(m.rows, r)
+		if j.ID == current {
+			m.cursor = i
+		}
+	}
+}
+
+// setProgress records an update from a job's event stream
+func (m *tuiModel) setProgress(id string, p progress) {
+	for i := range m.rows {
+		if m.rows[i].ID == id {
+			m.rows[i].Progress = p.Progress
+			m.rows[i].Stage = p.Stage
+			if p.Status == "completed" || p.Status == "failed" {
+				m.rows[i].Status = p.Status
+			}
+		}
+	}
+}
+
+func (m *tuiModel) current() *tuiRow {
+	if m.cursor < len(m.rows) {
+		return &m.rows[m.cursor]
+	}
+	return nil
+}
+
+// selectedStems returns the checked stems in display order
+func (m *tuiModel) selectedStems() []string {
+	var out []string
+	for _, s := range m.stems {
+		if m.selected[s] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (m *tuiModel) handleKey(key string) tuiAction {
+	if key == keyQuit {
+		return actionQuit
+	}
+	if m.stemView {
+		switch key {
+		case keyUp, "k":
+			if m.stemCursor > 0 {
+				m.stemCursor--
+			}
+		case keyDown, "j":
+			if m.stemCursor < len(m.stems)-1 {
+				m.stemCursor++
+			}
+		case keySpace:
+			if m.stemCursor < len(m.stems) {
+				s := m.stems[m.stemCursor]
+				m.selected[s] = !m.selected[s]
+			}
+		case "a":
+			all := len(m.selectedStems()) < len(m.stems)
+			for _, s := range m.stems {
+				m.selected[s] = all
+			}
+		case "d", keyEnter:
+			if len(m.selectedStems()) == 0 {
+				m.message = "Select at least one stem"
+				return actionNone
+			}
+			return actionDownload
+		case keyEsc, "h":
+			m.stemView = false
+		case "q":
+			return actionQuit
+		}
+		return actionNone
+	}
+
+	switch key {
+	case keyUp, "k":
+		if m.cursor > 0 {
+			m.cursor--
+		}
+	case keyDown, "j":
+		if m.cursor < len(m.rows)-1 {
+			m.cursor++
+		}
+	case keyEnter, "l":
+		row := m.current()
+		if row == nil || row.Status != "completed" {
+			m.message = "Stems are available once the job has completed"
+			return actionNone
+		}
+		m.stems = m.stems[:0]
+		for stem := range row.OutputFiles {
+			m.stems = append(m.stems, stem)
+		}
+		sort.Strings(m.stems)
+		m.selected = make(map[string]bool)
+		m.stemCursor = 0
+		m.stemView = true
+		m.message = ""
+	case "r":
+		return actionRefresh
+	case "q":
+		return actionQuit
+	}
+	return actionNone
+}
+
+// progressBar draws a fixed-width bar for a 0-100 percentage
+func progressBar(pct float64, width int) string {
+	if pct < 0 {
+		pct = 0
+	} else if pct > 100 {
+		pct = 100
+	}
+	filled := int(pct / 100 * float64(width))
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", width-filled) + "]"
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	if n <= 1 {
+		return string(r[:n])
+	}
+	return string(r[:n-1]) + "~"
+}
+
+// render draws the current view; lines end in \r\n for raw-mode terminals
+func (m *tuiModel) render() string {
+	var b strings.Builder
+	line := func(format string, args ...interface{}) {
+		b.WriteString(fmt.Sprintf(format, args...) + "\x1b[K\r\n")
+	}
+	width := m.width
+	if width < 60 {
+		width = 80
+	}
+	nameWidth := width - 50
+
+	if m.stemView {
+		row := m.current()
+		line("\x1b[1mtrack2stem\x1b[0m  %s", truncate(row.FileName, width-12))
+		line("")
+		for i, stem := range m.stems {
+			mark := " "
+			if m.selected[stem] {
+				mark = "x"
+			}
+			prefix := "  "
+			if i == m.stemCursor {
+				prefix = "> "
+			}
+			line("%s[%s] %s", prefix, mark, stem)
+		}
+		line("")
+		line("space toggle  a all  d download  esc back  q quit")
+	} else {
+		line("\x1b[1mtrack2stem\x1b[0m  %d jobs", len(m.rows))
+		line("")
+		if len(m.rows) == 0 {
+			line("  No jobs yet")
+		}
+		for i, r := range m.rows {
+			prefix := "  "
+			if i == m.cursor {
+				prefix = "> "
+			}
+			detail := r.Stage
+			switch r.Status {
+			case "completed":
+				detail = fmt.Sprintf("%d stems", len(r.OutputFiles))
+			case "failed":
+				detail = r.Error
+			}
+			line("%s%-*s %-10s %s %3.0f%% %s", prefix, nameWidth, truncate(r.FileName, nameWidth), r.Status,
+				progressBar(r.Progress, 20), r.Progress, truncate(detail, 12))
+		}
+		line("")
+		line("up/down move  enter stems  r refresh  q quit")
+	}
+	if m.message != "" {
+		line("%s", m.message)
+	}
+	return b.String()
+}
+
+// readKeys decodes raw terminal input into key names
+func readKeys(keys chan<- string) {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			close(keys)
+			return
+		}
+		switch s := string(buf[:n]); s {
+		case "\x1b[A":
+			keys <- keyUp
+		case "\x1b[B":
+			keys <- keyDown
+		case "\r", "\n":
+			keys <- keyEnter
+		case "\x1b":
+			keys <- keyEsc
+		case " ":
+			keys <- keySpace
+		case "\x03", "\x04":
+			keys <- keyQuit
+		default:
+			keys <- s
+		}
+	}
+}
+
+type progressMsg struct {
+	id string
+	p  progress
+}
+
+func tuiCommand(args []string) error {
+	fs := flag.NewFlagSet("tui", flag.ExitOnError)
+	server := fs.String("server", defaultServer(), "backend URL")
+	out := fs.String("out", "./stems", "directory to download stems into")
+	refresh := fs.Duration("refresh", 2*time.Second, "how often to reload the job queue")
+	fs.Parse(args)
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return fmt.Errorf("tui needs an interactive terminal")
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	fmt.Print("\x1b[?1049h\x1b[?25l") // alternate screen, hide cursor
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		term.Restore(fd, state)
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	c := newClient(*server)
+	m := &tuiModel{}
+	keys := make(chan string)
+	updates := make(chan progressMsg, 64)
+	results := make(chan string, 4)
+	following := make(map[string]context.CancelFunc)
+	go readKeys(keys)
+
+	load := func() {
+		list, err := c.jobs(ctx)
+		if err != nil {
+			m.message = "Failed to load jobs: " + err.Error()
+			return
+		}
+		m.setJobs(list)
+		for _, r := range m.rows {
+			_, followed := following[r.ID]
+			active := r.Status == "pending" || r.Status == "queued" || r.Status == "processing"
+			if active && !followed {
+				fctx, cancel := context.WithCancel(ctx)
+				following[r.ID] = cancel
+				go func(id string) {
+					c.follow(fctx, id, func(p progress) {
+						select {
+						case updates <- progressMsg{id: id, p: p}:
+						default:
+						}
+					})
+				}(r.ID)
+			} else if !active && followed {
+				following[r.ID]()
+				delete(following, r.ID)
+			}
+		}
+	}
+
+	load()
+	ticker := time.NewTicker(*refresh)
+	defer ticker.Stop()
+	for {
+		if w, _, err := term.GetSize(fd); err == nil {
+			m.width = w
+		}
+		fmt.Print("\x1b[H" + m.render() + "\x1b[J")
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case key, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			switch m.handleKey(key) {
+			case actionQuit:
+				return nil
+			case actionRefresh:
+				load()
+			case actionDownload:
+				row, stems := m.current(), m.selectedStems()
+				m.message = fmt.Sprintf("Downloading %d stems...", len(stems))
+				go func(id, name string) {
+					dir := filepath.Join(*out, strings.TrimSuffix(name, filepath.Ext(name)))
+					for _, stem := range stems {
+						if _, err := c.download(ctx, id, stem, dir); err != nil {
+							results <- "Download failed: " + err.Error()
+							return
+						}
+					}
+					results <- fmt.Sprintf("Saved %d stems to %s", len(stems), dir)
+				}(row.ID, row.FileName)
+			}
+		case u := <-updates:
+			m.setProgress(u.id, u.p)
+		case msg := <-results:
+			m.message = msg
+		case <-ticker.C:
+			load()
+		}
+	}
+}
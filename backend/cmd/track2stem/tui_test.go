@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressBar(t *testing.T) {
+	if got := progressBar(50, 10); got != "[#####-----]" {
+		t.Errorf("progressBar(50) = %q", got)
+	}
+	if got := progressBar(140, 4); got != "[####]" {
+		t.Errorf("progressBar(140) = %q", got)
+	}
+}
+
+func TestTUIModel(t *testing.T) {
+	now := time.Now()
+	m := &tuiModel{}
+	m.setJobs([]job{
+		{ID: "old", FileName: "old.mp3", Status: "completed", CreatedAt: now.Add(-time.Hour),
+			OutputFiles: map[string]string{"vocals": "a", "drums": "b"}},
+		{ID: "new", FileName: "new.mp3", Status: "processing", CreatedAt: now},
+	})
+	m.setProgress("new", progress{Status: "processing", Progress: 42, Stage: "Separating"})
+	if view := m.render(); !strings.Contains(view, "42%") || !strings.Contains(view, "Separating") {
+		t.Errorf("queue view missing progress:\n%s", view)
+	}
+
+	// The newest job is first and still processing, so it has no stems yet
+	if m.handleKey(keyEnter); m.stemView {
+		t.Fatal("opened stem view for an unfinished job")
+	}
+	m.handleKey(keyDown)
+	m.handleKey(keyEnter)
+	if !m.stemView || strings.Join(m.stems, ",") != "drums,vocals" {
+		t.Fatalf("stem view = %v %v", m.stemView, m.stems)
+	}
+	if m.handleKey("d") != actionNone {
+		t.Error("download started with nothing selected")
+	}
+	m.handleKey(keyDown)
+	m.handleKey(keySpace)
+	if m.handleKey("d") != actionDownload || strings.Join(m.selectedStems(), ",") != "vocals" {
+		t.Errorf("selected = %v", m.selectedStems())
+	}
+
+	// Reloading the queue keeps the cursor on the same job
+	m.setJobs([]job{
+		{ID: "newest", Status: "pending", CreatedAt: now.Add(time.Minute)},
+		{ID: "old", Status: "completed", CreatedAt: now.Add(-time.Hour)},
+		{ID: "new", Status: "processing", CreatedAt: now},
+	})
+	if m.current().ID != "old" || m.rows[1].Progress != 42 {
+		t.Errorf("cursor on %s, progress %v", m.current().ID, m.rows[1].Progress)
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	stream := "event: progress\ndata: {\"progress\": 10}\n\n: keepalive\n\ndata: {\"status\": \"completed\"}\n\ndata: ignored\n\n"
+	var got []string
+	readEvents(strings.NewReader(stream), func(data []byte) bool {
+		got = append(got, string(data))
+		return !strings.Contains(string(data), "completed")
+	})
+	if len(got) != 2 || got[0] != `{"progress": 10}` {
+		t.Errorf("events = %q", got)
+	}
+}
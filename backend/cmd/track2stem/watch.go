@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// audioExtensions are the input formats the processor accepts
+var audioExtensions = map[string]bool{
+	".mp3": true, ".wav": true, ".flac": true, ".ogg": true, ".m4a": true, ".aac": true,
+}
+
+// statusEntry is one line of the watch status log (JSON Lines)
+type statusEntry struct {
+	Time   time.Time `json:"time"`
+	File   string    `json:"file"`
+	JobID  string    `json:"job_id,omitempty"`
+	Status string    `json:"status"` // uploaded, completed, failed
+	Error  string    `json:"error,omitempty"`
+	Stems  []string  `json:"stems,omitempty"` // downloaded paths
+}
+
+// statusLog appends entries to the log file and remembers each file's latest status
+type statusLog struct {
+	mu     sync.Mutex
+	path   string
+	latest map[string]string
+}
+
+// openStatusLog reads an existing log so restarted watches skip finished files
+func openStatusLog(path string) (*statusLog, error) {
+	l := &statusLog{path: path, latest: make(map[string]string)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e statusEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && e.File != "" {
+			l.latest[e.File] = e.Status
+		}
+	}
+	return l, scanner.Err()
+}
+
+func (l *statusLog) status(file string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.latest[file]
+}
+
+func (l *statusLog) record(e statusEntry) error {
+	e.Time = time.Now().UTC()
+	line, _ := json.Marshal(e)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.latest[e.File] = e.Status
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// watcher turns files appearing in a directory into separation jobs
+type watcher struct {
+	client      *client
+	dir         string
+	out         string
+	opts        separationFlags
+	stems       []string // stems to download; empty means all
+	layout      string   // output path template; empty means <out>/<name>/<file>
+	poll        time.Duration
+	retryFailed bool
+	log         *statusLog
+
+	// seen holds the size/mtime of candidate files from the previous scan;
+	// a file is only submitted once it stops changing (copy finished)
+	seen     map[string]string
+	inFlight map[string]bool
+}
+
+// scan returns files that are stable since the previous scan and not yet handled
+func (w *watcher) scan() ([]string, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]string)
+	var ready []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !audioExtensions[strings.ToLower(filepath.Ext(name))] {
+			continue
+		}
+		if w.inFlight[name] {
+			continue
+		}
+		switch w.log.status(name) {
+		case "completed":
+			continue
+		case "failed":
+			if !w.retryFailed {
+				continue
+			}
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		fingerprint := fmt.Sprintf("%d/%d", info.Size(), info.ModTime().UnixNano())
+		current[name] = fingerprint
+		if w.seen[name] == fingerprint {
+			ready = append(ready, name)
+		}
+	}
+	w.seen = current
+	sort.Strings(ready)
+	return ready, nil
+}
+
+// process uploads one file, waits for the job and downloads its stems into
+// <out>/<file name without extension>/
+func (w *watcher) process(ctx context.Context, name string) error {
+	j, err := w.client.upload(ctx, filepath.Join(w.dir, name), w.opts.values())
+	if err != nil {
+		return w.fail(ctx, name, "", err)
+	}
+	w.log.record(statusEntry{File: name, JobID: j.ID, Status: "uploaded"})
+	log.Printf("%s: uploaded as job %s", name, j.ID)
+
+	j, err = w.client.wait(ctx, j.ID, w.poll)
+	if err != nil {
+		return w.fail(ctx, name, "", err)
+	}
+	if j.Status == "failed" {
+		return w.fail(ctx, name, j.ID, fmt.Errorf("%s", j.Error))
+	}
+
+	stems := w.stems
+	if len(stems) == 0 {
+		for stem := range j.OutputFiles {
+			stems = append(stems, stem)
+		}
+		sort.Strings(stems)
+	}
+	dir := filepath.Join(w.out, strings.TrimSuffix(name, filepath.Ext(name)))
+	var written []string
+	for _, stem := range stems {
+		var path string
+		if w.layout != "" {
+			rel := expandLayout(w.layout, j, stem, filepath.Ext(j.OutputFiles[stem]))
+			path, err = w.client.downloadAs(ctx, j.ID, stem, filepath.Join(w.out, filepath.FromSlash(rel)))
+		} else {
+			path, err = w.client.download(ctx, j.ID, stem, dir)
+		}
+		if err != nil {
+			return w.fail(ctx, name, j.ID, fmt.Errorf("download %s: %v", stem, err))
+		}
+		written = append(written, path)
+	}
+	if w.layout != "" && len(written) > 0 {
+		dir = filepath.Dir(written[0])
+	}
+	log.Printf("%s: %d stems written to %s (%s)", name, len(written), dir, j.ProcessingTime)
+	return w.log.record(statusEntry{File: name, JobID: j.ID, Status: "completed", Stems: written})
+}
+
+// pathSegment makes a metadata value safe to use as one path component
+func pathSegment(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r < 0x20 || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, s)
+	s = strings.Trim(s, " .")
+	if r := []rune(s); len(r) > 100 {
+		s = strings.TrimSpace(string(r[:100]))
+	}
+	if s == "" {
+		return "Unknown"
+	}
+	return s
+}
+
+// expandLayout resolves a --layout template for one stem from the job's
+// detected metadata, with the same placeholders as the backend's layouts:
+// {artist}, {album}, {title}, {track}, {year}, {name}, {job_id}, {stem}, {ext}
+func expandLayout(template string, j *job, stem, ext string) string {
+	meta := trackMetadata{}
+	if j.Metadata != nil {
+		meta = *j.Metadata
+	}
+	if meta.Artist == "" {
+		meta.Artist = "Unknown Artist"
+	}
+	if meta.Album == "" {
+		meta.Album = "Unknown Album"
+	}
+	replacer := strings.NewReplacer(
+		"{artist}", meta.Artist,
+		"{album}", meta.Album,
+		"{title}", meta.Title,
+		"{track}", meta.Track,
+		"{year}", meta.Year,
+		"{name}", strings.TrimSuffix(j.FileName, filepath.Ext(j.FileName)),
+		"{job_id}", j.ID,
+		"{stem}", stem,
+		"{ext}", strings.TrimPrefix(ext, "."),
+	)
+	var parts []string
+	for _, part := range strings.Split(template, "/") {
+		parts = append(parts, pathSegment(replacer.Replace(part)))
+	}
+	return path.Join(parts...)
+}
+
+// fail logs and records a failure; interrupted work is left unrecorded so
+// the file is picked up again on the next run
+func (w *watcher) fail(ctx context.Context, name, jobID string, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	log.Printf("%s: failed: %v", name, err)
+	w.log.record(statusEntry{File: name, JobID: jobID, Status: "failed", Error: err.Error()})
+	return err
+}
+
+func watchCommand(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	server := fs.String("server", defaultServer(), "backend URL")
+	out := fs.String("out", "./stems", "directory to write stems into")
+	logPath := fs.String("log", "", "status log (default: <out>/track2stem-watch.log)")
+	stems := fs.String("stems", "", "comma-separated stems to download (default: all)")
+	interval := fs.Duration("interval", 5*time.Second, "how often to scan the directory")
+	poll := fs.Duration("poll", 3*time.Second, "how often to poll job status")
+	parallel := fs.Int("jobs", 2, "files processed at the same time")
+	once := fs.Bool("once", false, "process the files currently present, then exit")
+	retryFailed := fs.Bool("retry-failed", false, "retry files the status log records as failed")
+	layout := fs.String("layout", "", "output path template under -out, e.g. {artist}/{album}/{title}/{stem}.{ext} (default: <file name>/<stem file>)")
+	var opts separationFlags
+	opts.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: track2stem watch <dir> [flags]")
+		fs.PrintDefaults()
+	}
+
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *parallel < 1 {
+		return fmt.Errorf("-jobs must be at least 1")
+	}
+	if *layout != "" && !strings.Contains(*layout, "{stem}") {
+		return fmt.Errorf("-layout must contain {stem}")
+	}
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		return err
+	}
+	if *logPath == "" {
+		*logPath = filepath.Join(*out, "track2stem-watch.log")
+	}
+	status, err := openStatusLog(*logPath)
+	if err != nil {
+		return fmt.Errorf("reading status log: %v", err)
+	}
+
+	w := &watcher{
+		client:      newClient(*server),
+		dir:         positional[0],
+		out:         *out,
+		opts:        opts,
+		poll:        *poll,
+		retryFailed: *retryFailed,
+		layout:      *layout,
+		log:         status,
+		inFlight:    make(map[string]bool),
+	}
+	if *stems != "" {
+		w.stems = strings.Split(*stems, ",")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	log.Printf("Watching %s (status log %s)", w.dir, *logPath)
+
+	sem := make(chan struct{}, *parallel)
+	done := make(chan string)
+	for {
+		ready, err := w.scan()
+		if err != nil {
+			return err
+		}
+		for _, name := range ready {
+			w.inFlight[name] = true
+			go func(name string) {
+				sem <- struct{}{}
+				w.process(ctx, name)
+				<-sem
+				done <- name
+			}(name)
+		}
+
+		// -once is finished when nothing is running or waiting to settle
+		if *once && len(w.inFlight) == 0 && len(w.seen) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			for len(w.inFlight) > 0 {
+				delete(w.inFlight, <-done)
+			}
+			return nil
+		case name := <-done:
+			delete(w.inFlight, name)
+		case <-time.After(*interval):
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseInterspersed(t *testing.T) {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	out := fs.String("out", "", "")
+	got, err := parseInterspersed(fs, []string{"./incoming", "--out", "./stems", "extra"})
+	if err != nil || !reflect.DeepEqual(got, []string{"./incoming", "extra"}) || *out != "./stems" {
+		t.Errorf("parseInterspersed = %v, %v (out %q)", got, err, *out)
+	}
+}
+
+func TestWatcherScanWaitsForStableFiles(t *testing.T) {
+	dir := t.TempDir()
+	status, _ := openStatusLog(filepath.Join(t.TempDir(), "status.log"))
+	w := &watcher{dir: dir, log: status, inFlight: map[string]bool{}}
+
+	os.WriteFile(filepath.Join(dir, "song.mp3"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("a"), 0644)
+	if ready, _ := w.scan(); len(ready) != 0 {
+		t.Fatalf("first scan should only fingerprint files, got %v", ready)
+	}
+	if ready, _ := w.scan(); !reflect.DeepEqual(ready, []string{"song.mp3"}) {
+		t.Fatalf("second scan = %v", ready)
+	}
+
+	status.record(statusEntry{File: "song.mp3", Status: "completed"})
+	if ready, _ := w.scan(); len(ready) != 0 {
+		t.Errorf("completed file was returned again: %v", ready)
+	}
+	reopened, _ := openStatusLog(status.path)
+	if reopened.status("song.mp3") != "completed" {
+		t.Error("status log did not persist the completed file")
+	}
+}
+
+func TestWatcherProcess(t *testing.T) {
+	var form map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/upload":
+			r.ParseMultipartForm(1 << 20)
+			form = map[string]string{"stem_mode": r.FormValue("stem_mode"), "isolate_stem": r.FormValue("isolate_stem")}
+			json.NewEncoder(w).Encode(job{ID: "job-1", Status: "pending"})
+		case "/api/jobs/job-1":
+			json.NewEncoder(w).Encode(job{ID: "job-1", Status: "completed", OutputFiles: map[string]string{"vocals": "x", "instrumental": "y"}})
+		default:
+			stem := filepath.Base(r.URL.Path)
+			w.Header().Set("Content-Disposition", `attachment; filename="song_t2s_`+stem+`.mp3"`)
+			w.Write([]byte(stem))
+		}
+	}))
+	defer server.Close()
+
+	in, out := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(in, "song.mp3"), []byte("audio"), 0644)
+	status, _ := openStatusLog(filepath.Join(out, "status.log"))
+	w := &watcher{
+		client:   newClient(server.URL),
+		dir:      in,
+		out:      out,
+		opts:     separationFlags{twoStems: "vocals"},
+		poll:     time.Millisecond,
+		log:      status,
+		inFlight: map[string]bool{},
+	}
+	if err := w.process(context.Background(), "song.mp3"); err != nil {
+		t.Fatalf("process: %v", err)
+	}
+
+	if form["stem_mode"] != "isolate" || form["isolate_stem"] != "vocals" {
+		t.Errorf("upload form = %v", form)
+	}
+	data, _ := os.ReadFile(filepath.Join(out, "song", "song_t2s_vocals.mp3"))
+	if string(data) != "vocals" {
+		t.Errorf("vocals stem = %q", data)
+	}
+	if status.status("song.mp3") != "completed" {
+		t.Errorf("status = %q", status.status("song.mp3"))
+	}
+}
+
+func TestExpandLayout(t *testing.T) {
+	j := &job{ID: "job-1", FileName: "bohemian.mp3", Metadata: &trackMetadata{Artist: "Queen", Title: "Bohemian Rhapsody"}}
+	if got := expandLayout("{artist}/{album}/{title}/{stem}.{ext}", j, "vocals", ".mp3"); got != "Queen/Unknown Album/Bohemian Rhapsody/vocals.mp3" {
+		t.Errorf("expandLayout = %q", got)
+	}
+	j.Metadata.Title = "AC/DC: ../Live"
+	if got := expandLayout("{title}/{stem}.{ext}", j, "drums", ".wav"); got != "AC_DC_ .._Live/drums.wav" {
+		t.Errorf("unsafe title expanded to %q", got)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	compareSampleRate = 44100
+	compareFrameSize  = 2048
+	compareHop        = 1024
+	// compareMaxSeconds bounds the decoded audio: longer stems are compared
+	// over their first five minutes
+	compareMaxSeconds = 300
+	// compareRenderTTL is how long a rendered difference can be downloaded
+	compareRenderTTL = time.Hour
+)
+
+// compareBands are the frequency ranges reported separately, since bleed
+// usually shows up in a specific range (e.g. hi-hats leaking into vocals)
+var compareBands = []struct {
+	Name          string
+	LowHz, HighHz float64
+}{
+	{"low", 0, 250},
+	{"mid", 250, 4000},
+	{"high", 4000, compareSampleRate / 2},
+}
+
+// BandDifference compares the energy of two stems within a frequency band
+type BandDifference struct {
+	Name      string  `json:"name"`
+	LowHz     float64 `json:"low_hz"`
+	HighHz    float64 `json:"high_hz"`
+	EnergyADB float64 `json:"energy_a_db"`
+	EnergyBDB float64 `json:"energy_b_db"`
+	DeltaDB   float64 `json:"delta_db"`
+}
+
+// StemComparison holds spectral difference metrics between the same stem of
+// two jobs. Lower spectral flatness usually means fewer broadband artifacts.
+type StemComparison struct {
+	Stem                  string           `json:"stem"`
+	JobA                  string           `json:"job_a"`
+	JobB                  string           `json:"job_b"`
+	ModelA                string           `json:"model_a"`
+	ModelB                string           `json:"model_b"`
+	DurationSeconds       float64          `json:"duration_seconds"`
+	LevelADB              float64          `json:"level_a_db"`
+	LevelBDB              float64          `json:"level_b_db"`
+	DifferenceDB          float64          `json:"difference_db"`
+	Correlation           float64          `json:"correlation"`
+	SpectralConvergence   float64          `json:"spectral_convergence"`
+	LogSpectralDistanceDB float64          `json:"log_spectral_distance_db"`
+	FlatnessA             float64          `json:"spectral_flatness_a"`
+	FlatnessB             float64          `json:"spectral_flatness_b"`
+	Bands                 []BandDifference `json:"bands"`
+	DifferenceURL         string           `json:"difference_url,omitempty"`
+}
+
+// compareRender is a rendered difference file
+type compareRender struct {
+	path      string
+	expiresAt time.Time
+}
+
+var (
+	compareRenders      = make(map[string]compareRender)
+	compareRendersMutex = &sync.RWMutex{}
+)
+
+// toDB converts a linear amplitude ratio to decibels with a floor
+func toDB(v float64) float64 {
+	return 20 * math.Log10(v+1e-9)
+}
+
+func rms(x []float64) float64 {
+	if len(x) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range x {
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(len(x)))
+}
+
+// correlation returns the Pearson correlation coefficient of a and b
+func correlation(a, b []float64) float64 {
+	n := float64(len(a))
+	if n == 0 {
+		return 0
+	}
+	var meanA, meanB float64
+	for i := range a {
+		meanA += a[i]
+		meanB += b[i]
+	}
+	meanA /= n
+	meanB /= n
+	var cov, varA, varB float64
+	for i := range a {
+		da, db := a[i]-meanA, b[i]-meanB
+		cov += da * db
+		varA += da * da
+		varB += db * db
+	}
+	if varA == 0 || varB == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(varA*varB)
+}
+
+// spectralFlatness is the mean over frames of geometric/arithmetic mean of
+// the power spectrum: near 1 for noise, near 0 for tonal content
+func spectralFlatness(frames [][]float64) float64 {
+	if len(frames) == 0 {
+		return 0
+	}
+	var total float64
+	for _, f := range frames {
+		var logSum, sum float64
+		for _, m := range f {
+			p := m*m + 1e-12
+			logSum += math.Log(p)
+			sum += p
+		}
+		n := float64(len(f))
+		total += math.Exp(logSum/n) / (sum / n)
+	}
+	return total / float64(len(frames))
+}
+
+// compareSignals computes the difference metrics for two aligned signals
+func compareSignals(a, b []float64, sampleRate int) StemComparison {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	a, b = a[:n], b[:n]
+
+	diff := make([]float64, n)
+	for i := range diff {
+		diff[i] = a[i] - b[i]
+	}
+
+	c := StemComparison{
+		DurationSeconds: float64(n) / float64(sampleRate),
+		LevelADB:        toDB(rms(a)),
+		LevelBDB:        toDB(rms(b)),
+		DifferenceDB:    toDB(rms(diff) / (rms(a) + 1e-9)),
+		Correlation:     correlation(a, b),
+	}
+
+	specA := magnitudeSpectrogram(a, compareFrameSize, compareHop)
+	specB := magnitudeSpectrogram(b, compareFrameSize, compareHop)
+	c.FlatnessA = spectralFlatness(specA)
+	c.FlatnessB = spectralFlatness(specB)
+
+	var diffNorm, aNorm, lsdSum float64
+	bandA := make([]float64, len(compareBands))
+	bandB := make([]float64, len(compareBands))
+	binHz := float64(sampleRate) / compareFrameSize
+	for f := range specA {
+		var frameLSD float64
+		for k := range specA[f] {
+			ma, mb := specA[f][k], specB[f][k]
+			diffNorm += (ma - mb) * (ma - mb)
+			aNorm += ma * ma
+			d := toDB(ma) - toDB(mb)
+			frameLSD += d * d
+			hz := float64(k) * binHz
+			for i, band := range compareBands {
+				if hz >= band.LowHz && hz < band.HighHz {
+					bandA[i] += ma * ma
+					bandB[i] += mb * mb
+				}
+			}
+		}
+		lsdSum += math.Sqrt(frameLSD / float64(len(specA[f])))
+	}
+	if len(specA) > 0 {
+		c.SpectralConvergence = math.Sqrt(diffNorm) / (math.Sqrt(aNorm) + 1e-9)
+		c.LogSpectralDistanceDB = lsdSum / float64(len(specA))
+	}
+	for i, band := range compareBands {
+		ea, eb := 10*math.Log10(bandA[i]+1e-12), 10*math.Log10(bandB[i]+1e-12)
+		c.Bands = append(c.Bands, BandDifference{
+			Name: band.Name, LowHz: band.LowHz, HighHz: band.HighHz,
+			EnergyADB: ea, EnergyBDB: eb, DeltaDB: eb - ea,
+		})
+	}
+	return c
+}
+
+// renderDifference writes a-b as a WAV file and returns its render ID
+func renderDifference(a, b []int16) (string, error) {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	diff := make([]int16, n)
+	for i := range diff {
+		d := int32(a[i]) - int32(b[i])
+		if d > math.MaxInt16 {
+			d = math.MaxInt16
+		} else if d < math.MinInt16 {
+			d = math.MinInt16
+		}
+		diff[i] = int16(d)
+	}
+
+	renderID := uuid.New().String()
+	dir := filepath.Join(outputDir, "compare-"+renderID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "difference.wav")
+	if err := writeWAVFile(path, diff, compareSampleRate, 1); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	compareRendersMutex.Lock()
+	compareRenders[renderID] = compareRender{path: path, expiresAt: time.Now().Add(compareRenderTTL)}
+	compareRendersMutex.Unlock()
+	return renderID, nil
+}
+
+// expireCompareRenders removes the renders past their TTL and their files
+func expireCompareRenders(now time.Time) int {
+	compareRendersMutex.Lock()
+	var expired []string
+	for id, render := range compareRenders {
+		if now.After(render.expiresAt) {
+			expired = append(expired, filepath.Dir(render.path))
+			delete(compareRenders, id)
+		}
+	}
+	compareRendersMutex.Unlock()
+	for _, dir := range expired {
+		os.RemoveAll(dir)
+	}
+	return len(expired)
+}
+
+// compareRenderReaper expires difference renders every interval
+func compareRenderReaper(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		expireCompareRenders(now)
+	}
+}
+
+// compareHandler serves GET /api/compare?job_a=&job_b=&stem=vocals[&render=true]
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	stem := q.Get("stem")
+	if stem == "" {
+		stem = "vocals"
+	}
+
+	jobA, ok := completedJob(w, r, q.Get("job_a"))
+	if !ok || refuseEncrypted(w, jobA) {
+		return
+	}
+	jobB, ok := completedJob(w, r, q.Get("job_b"))
+	if !ok || refuseEncrypted(w, jobB) {
+		return
+	}
+
+	pathA, okA := jobA.OutputFiles[stem]
+	pathB, okB := jobB.OutputFiles[stem]
+	if !okA || !okB {
+		http.Error(w, "Stem not found in both jobs", http.StatusNotFound)
+		return
+	}
+	if !safeOutputPath(pathA) || !safeOutputPath(pathB) {
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
+	}
+
+	samplesA, err := decodeMonoPCMWindow(pathA, compareSampleRate, compareMaxSeconds)
+	if err != nil {
+		log.Printf("Compare: failed to decode %s: %v", pathA, err)
+		http.Error(w, "Failed to decode stem", http.StatusInternalServerError)
+		return
+	}
+	samplesB, err := decodeMonoPCMWindow(pathB, compareSampleRate, compareMaxSeconds)
+	if err != nil {
+		log.Printf("Compare: failed to decode %s: %v", pathB, err)
+		http.Error(w, "Failed to decode stem", http.StatusInternalServerError)
+		return
+	}
+
+	result := compareSignals(int16ToFloat(samplesA), int16ToFloat(samplesB), compareSampleRate)
+	result.Stem = stem
+	result.JobA, result.JobB = jobA.ID, jobB.ID
+	result.ModelA, result.ModelB = jobA.Model, jobB.Model
+
+	if q.Get("render") == "true" {
+		renderID, err := renderDifference(samplesA, samplesB)
+		if err != nil {
+			http.Error(w, "Failed to render difference audio", http.StatusInternalServerError)
+			return
+		}
+		result.DifferenceURL = "/api/compare/renders/" + renderID
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func compareRenderHandler(w http.ResponseWriter, r *http.Request) {
+	compareRendersMutex.RLock()
+	render, exists := compareRenders[mux.Vars(r)["id"]]
+	compareRendersMutex.RUnlock()
+	if !exists || time.Now().After(render.expiresAt) {
+		http.Error(w, "Render not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "audio/wav")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"difference.wav\"")
+	http.ServeFile(w, r, render.path)
+}
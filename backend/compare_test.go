@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tone(n int, hz float64, amp float64) []float64 {
+	out := make([]float64, n)
+	for i := range out {
+		out[i] = amp * math.Sin(2*math.Pi*hz*float64(i)/compareSampleRate)
+	}
+	return out
+}
+
+func TestCompareSignalsIdentical(t *testing.T) {
+	a := tone(compareSampleRate, 440, 0.5)
+	c := compareSignals(a, a, compareSampleRate)
+	if c.Correlation < 0.999 {
+		t.Errorf("identical signals correlation = %f, want ~1", c.Correlation)
+	}
+	if c.SpectralConvergence > 1e-6 || c.LogSpectralDistanceDB > 1e-6 {
+		t.Errorf("identical signals should have zero spectral distance: %+v", c)
+	}
+	if c.DifferenceDB > -100 {
+		t.Errorf("identical signals difference = %f dB, want very low", c.DifferenceDB)
+	}
+}
+
+func TestCompareSignalsDetectsBleed(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	clean := tone(compareSampleRate, 440, 0.5)
+	bleed := make([]float64, len(clean))
+	for i := range bleed {
+		bleed[i] = clean[i] + 0.05*(rng.Float64()*2-1)
+	}
+
+	c := compareSignals(clean, bleed, compareSampleRate)
+	if c.FlatnessB <= c.FlatnessA {
+		t.Errorf("noisy stem should be flatter: a=%f b=%f", c.FlatnessA, c.FlatnessB)
+	}
+	high := c.Bands[len(c.Bands)-1]
+	if high.DeltaDB <= 10 {
+		t.Errorf("broadband bleed should raise high band energy, delta = %f dB", high.DeltaDB)
+	}
+	if c.DurationSeconds != 1 {
+		t.Errorf("duration = %f, want 1", c.DurationSeconds)
+	}
+}
+
+func TestCompareRendersExpire(t *testing.T) {
+	oldOutputDir := outputDir
+	outputDir = t.TempDir()
+	t.Cleanup(func() { outputDir = oldOutputDir })
+
+	id, err := renderDifference([]int16{1, 2, 3}, []int16{1, 1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(outputDir, "compare-"+id)
+	if n := expireCompareRenders(time.Now()); n != 0 {
+		t.Errorf("expired %d fresh renders", n)
+	}
+	if n := expireCompareRenders(time.Now().Add(compareRenderTTL + time.Minute)); n != 1 {
+		t.Errorf("expired %d renders, want 1", n)
+	}
+	compareRendersMutex.RLock()
+	_, exists := compareRenders[id]
+	compareRendersMutex.RUnlock()
+	if _, err := os.Stat(dir); exists || !os.IsNotExist(err) {
+		t.Errorf("expired render kept: registered %v, stat %v", exists, err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Processor request compression. Uncompressed PCM uploads (WAV, AIFF) are
+// sent to the processor gzip-compressed, streamed with chunked transfer
+// encoding so the compressed copy is never held in memory, once the
+// processor has said it decodes gzip: as in RFC 7694 it lists the request
+// encodings it accepts in an Accept-Encoding header on its responses,
+// which the backend notes from /health checks and /process answers. A
+// processor that answers 415 is sent the job again uncompressed. Already
+// compressed inputs (FLAC, MP3, ...) go as they are.
+// PROCESSOR_COMPRESSION=off turns it off.
+
+// compressibleInputs are the upload formats worth compressing on the wire
+var compressibleInputs = map[string]bool{".wav": true, ".aiff": true, ".aif": true}
+
+var (
+	processorGzip      = make(map[string]bool) // by processor URL
+	processorGzipMutex = &sync.Mutex{}
+)
+
+func processorCompressionEnabled() bool {
+	return os.Getenv("PROCESSOR_COMPRESSION") != "off"
+}
+
+// compressibleInput reports whether an upload is sent compressed to
+// processors that accept it
+func compressibleInput(name string) bool {
+	return processorCompressionEnabled() && compressibleInputs[strings.ToLower(filepath.Ext(name))]
+}
+
+// processorAcceptsGzip reports whether the processor at url last said it
+// decodes gzip request bodies
+func processorAcceptsGzip(url string) bool {
+	processorGzipMutex.Lock()
+	defer processorGzipMutex.Unlock()
+	return processorGzip[url]
+}
+
+// noteProcessorEncodings records the request encodings a processor
+// response lists in Accept-Encoding
+func noteProcessorEncodings(url string, header http.Header) {
+	accepts := false
+	for _, value := range header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "gzip") && strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0" {
+				accepts = true
+			}
+		}
+	}
+	processorGzipMutex.Lock()
+	processorGzip[url] = accepts
+	processorGzipMutex.Unlock()
+}
+
+// gzipStream compresses body as it is read. Intra-cluster links are fast,
+// so it trades ratio for speed.
+func gzipStream(body []byte) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zw, _ := gzip.NewWriterLevel(pw, gzip.BestSpeed)
+		_, err := zw.Write(body)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
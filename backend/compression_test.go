@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCompressibleInput(t *testing.T) {
+	for name, want := range map[string]bool{"a.wav": true, "a.AIFF": true, "a.flac": false, "a.mp3": false} {
+		if got := compressibleInput(name); got != want {
+			t.Errorf("compressibleInput(%s) = %v", name, got)
+		}
+	}
+	t.Setenv("PROCESSOR_COMPRESSION", "off")
+	if compressibleInput("a.wav") {
+		t.Error("compression not turned off")
+	}
+}
+
+func TestNoteProcessorEncodings(t *testing.T) {
+	const url = "http://encodings.test"
+	t.Cleanup(func() {
+		processorGzipMutex.Lock()
+		delete(processorGzip, url)
+		processorGzipMutex.Unlock()
+	})
+	for value, want := range map[string]bool{"": false, "gzip": true, "identity, GZIP;q=0.5": true, "gzip;q=0": false, "br": false} {
+		header := http.Header{}
+		if value != "" {
+			header.Set("Accept-Encoding", value)
+		}
+		noteProcessorEncodings(url, header)
+		if got := processorAcceptsGzip(url); got != want {
+			t.Errorf("Accept-Encoding %q: accepts gzip = %v", value, got)
+		}
+	}
+}
+
+func TestIntegrationCompressedUpload(t *testing.T) {
+	b := newIntegrationBackend(t, 1)
+	t.Cleanup(func() {
+		processorGzipMutex.Lock()
+		delete(processorGzip, b.processor.URL)
+		processorGzipMutex.Unlock()
+	})
+
+	b.waitFor(b.upload("first.wav", nil).ID, "completed")
+	// Learnt from this job's response, used from the next one
+	b.processor.setContentEncodings("gzip")
+	b.waitFor(b.upload("second.wav", nil).ID, "completed")
+	b.waitFor(b.upload("third.wav", nil).ID, "completed")
+	b.waitFor(b.upload("song.mp3", nil).ID, "completed")
+
+	// Support withdrawn: 415, then sent again plain
+	b.processor.setContentEncodings()
+	b.waitFor(b.upload("again.wav", nil).ID, "completed")
+
+	requests := b.processor.Requests()
+	if len(requests) != 5 {
+		t.Fatalf("processor requests = %+v", requests)
+	}
+	for i, want := range []string{"", "", "gzip", "", ""} {
+		if got := requests[i]["content_encoding"]; got != want {
+			t.Errorf("request %s: content encoding %q, want %q", requests[i]["filename"], got, want)
+		}
+	}
+	if processorAcceptsGzip(b.processor.URL) {
+		t.Error("415 didn't mark the processor as not accepting gzip")
+	}
+}
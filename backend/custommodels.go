@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Custom models. Admins register their own (e.g. fine-tuned) Demucs
+// separators with POST /api/admin/models/custom:
+//
+//	{"name": "lab_vocals_v2", "checkpoint": "https://models.example.org/lab_vocals_v2.th",
+//	 "stems": ["vocals", "other"], "description": "..."}
+//
+// checkpoint is an http(s) URL or a .th path on the processors. Every
+// processor (see modelProcessors) fetches the checkpoint, loads it and
+// checks that it separates exactly the given stems; only when all of them
+// accept it is the name added to the model allowlist, where uploads, the
+// registry's models tags and GET /api/branding (limits.models and
+// limits.model_stems) offer it. A processor's rejection rolls the
+// registration back on the others. Registrations are kept in
+// CUSTOM_MODELS_FILE (default <UPLOAD_DIR>/.custom-models.json) and
+// DELETE /api/admin/models/custom/{name} removes one.
+
+// customModelNamePattern: Demucs takes the part of a checkpoint's file
+// name before any hyphen as the model's signature, so names have none
+var customModelNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{1,63}$`)
+
+// CustomModel is a separator registered by an admin
+type CustomModel struct {
+	Name        string    `json:"name"`
+	Checkpoint  string    `json:"checkpoint"`
+	Stems       []string  `json:"stems"`
+	Description string    `json:"description,omitempty"`
+	Version     string    `json:"version,omitempty"` // checkpoint checksum reported by the processors
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+var (
+	customModels      = make(map[string]*CustomModel)
+	customModelsMutex = &sync.RWMutex{}
+)
+
+func init() { keepInUploads(customModelsFile) }
+
+func customModelsFile() string {
+	if path := os.Getenv("CUSTOM_MODELS_FILE"); path != "" {
+		return path
+	}
+	return filepath.Join(uploadDir, ".custom-models.json")
+}
+
+// loadCustomModels reads the registered custom models
+func loadCustomModels() {
+	data, err := os.ReadFile(customModelsFile())
+	if err != nil {
+		return
+	}
+	var list []*CustomModel
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Failed to load custom models: %v", err)
+		return
+	}
+	customModelsMutex.Lock()
+	for _, m := range list {
+		customModels[m.Name] = m
+	}
+	customModelsMutex.Unlock()
+	log.Printf("Loaded %d custom models", len(list))
+}
+
+// saveCustomModels writes every custom model to the file. Callers hold
+// customModelsMutex.
+func saveCustomModels() {
+	list := make([]*CustomModel, 0, len(customModels))
+	for _, name := range sortedKeys(customModels) {
+		list = append(list, customModels[name])
+	}
+	data, _ := json.MarshalIndent(list, "", "  ")
+	tmp := customModelsFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Failed to save custom models: %v", err)
+		return
+	}
+	os.Rename(tmp, customModelsFile())
+}
+
+// isAllowedModel reports whether name is a built-in or registered model
+func isAllowedModel(name string) bool {
+	if allowedModels[name] {
+		return true
+	}
+	customModelsMutex.RLock()
+	defer customModelsMutex.RUnlock()
+	return customModels[name] != nil
+}
+
+// modelNames lists the built-in and registered models, sorted
+func modelNames() []string {
+	names := sortedKeys(allowedModels)
+	customModelsMutex.RLock()
+	for name := range customModels {
+		names = append(names, name)
+	}
+	customModelsMutex.RUnlock()
+	slices.Sort(names)
+	return names
+}
+
+// modelStems is the set of stems a model separates, or nil for an unknown
+// model
+func modelStems(name string) []string {
+	if sixStemModels[name] {
+		return []string{"vocals", "drums", "bass", "guitar", "piano", "other"}
+	}
+	if allowedModels[name] {
+		return []string{"vocals", "drums", "bass", "other"}
+	}
+	customModelsMutex.RLock()
+	defer customModelsMutex.RUnlock()
+	if m := customModels[name]; m != nil {
+		return slices.Clone(m.Stems)
+	}
+	return nil
+}
+
+// isCustomModel reports whether name is a registered custom model
+func isCustomModel(name string) bool {
+	return !allowedModels[name] && isAllowedModel(name)
+}
+
+// validateCustomModel checks a registration before processors see it
+func validateCustomModel(m *CustomModel) error {
+	if !customModelNamePattern.MatchString(m.Name) {
+		return fmt.Errorf("Invalid name (lowercase letters, digits and underscores, starting with a letter, 2-64 characters)")
+	}
+	if allowedModels[m.Name] {
+		return fmt.Errorf("%s is a built-in model", m.Name)
+	}
+	u, err := url.Parse(m.Checkpoint)
+	switch {
+	case err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "":
+	case filepath.IsAbs(m.Checkpoint) && strings.HasSuffix(m.Checkpoint, ".th"):
+	default:
+		return fmt.Errorf("Invalid checkpoint (an http(s) URL or an absolute path to a .th file on the processors)")
+	}
+	if len(m.Stems) < 2 {
+		return fmt.Errorf("A model separates at least two stems")
+	}
+	seen := map[string]bool{}
+	for _, stem := range m.Stems {
+		if !allowedStems[stem] {
+			return invalidOption("stems", sortedKeys(allowedStems))
+		}
+		if seen[stem] {
+			return fmt.Errorf("Duplicate stem %s", stem)
+		}
+		seen[stem] = true
+	}
+	if len(m.Description) > 500 {
+		return fmt.Errorf("Description is too long (500 characters at most)")
+	}
+	return nil
+}
+
+// customModelRegistration is one processor's answer to a registration
+type customModelRegistration struct {
+	URL     string
+	Status  int // 0: unreachable
+	Error   string
+	Version string
+}
+
+// registerOnProcessor asks one processor to fetch and validate a model
+func registerOnProcessor(client *http.Client, processorURL string, m *CustomModel) customModelRegistration {
+	reg := customModelRegistration{URL: processorURL}
+	body, _ := json.Marshal(map[string]interface{}{"name": m.Name, "checkpoint": m.Checkpoint, "stems": m.Stems})
+	resp, err := client.Post(processorURL+"/models/custom", "application/json", bytes.NewReader(body))
+	if err != nil {
+		reg.Error = err.Error()
+		return reg
+	}
+	defer resp.Body.Close()
+	reg.Status = resp.StatusCode
+	var reply struct {
+		Error   string `json:"error"`
+		Version string `json:"version"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	json.Unmarshal(data, &reply)
+	if resp.StatusCode != http.StatusCreated {
+		reg.Error = reply.Error
+		if reg.Error == "" {
+			reg.Error = "registration returned " + resp.Status
+		}
+		return reg
+	}
+	reg.Version = reply.Version
+	return reg
+}
+
+// unregisterOnProcessor removes a model from one processor
+func unregisterOnProcessor(client *http.Client, processorURL, name string) error {
+	req, err := http.NewRequest("DELETE", processorURL+"/models/custom/"+url.PathEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unregistering returned %s", resp.Status)
+	}
+	return nil
+}
+
+// registerCustomModelHandler serves POST /api/admin/models/custom
+func registerCustomModelHandler(w http.ResponseWriter, r *http.Request) {
+	var m CustomModel
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateCustomModel(&m); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if isAllowedModel(m.Name) {
+		http.Error(w, "Model "+m.Name+" is already registered", http.StatusConflict)
+		return
+	}
+
+	// Downloading and loading a checkpoint can take a while
+	client := newProcessorClient(10 * time.Minute)
+	targets := modelProcessors()
+	regs := make([]customModelRegistration, len(targets))
+	var wg sync.WaitGroup
+	for i, u := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			regs[i] = registerOnProcessor(client, u, &m)
+		}()
+	}
+	wg.Wait()
+
+	var failed *customModelRegistration
+	for i := range regs {
+		if regs[i].Error != "" {
+			failed = &regs[i]
+			break
+		}
+	}
+	if failed != nil {
+		for _, reg := range regs {
+			if reg.Error == "" {
+				if err := unregisterOnProcessor(client, reg.URL, m.Name); err != nil {
+					log.Printf("Failed to roll back custom model %s on %s: %v", m.Name, reg.URL, err)
+				}
+			}
+		}
+		code := http.StatusUnprocessableEntity
+		if failed.Status == 0 || failed.Status >= 500 {
+			code = http.StatusBadGateway
+		}
+		http.Error(w, fmt.Sprintf("Processor %s rejected the model: %s", failed.URL, failed.Error), code)
+		return
+	}
+	for _, reg := range regs[1:] {
+		if reg.Version != regs[0].Version {
+			log.Printf("Custom model %s: processors fetched different checkpoints (%s on %s, %s on %s)", m.Name, regs[0].Version, regs[0].URL, reg.Version, reg.URL)
+		}
+	}
+
+	m.Version = regs[0].Version
+	m.CreatedAt = time.Now().UTC()
+	customModelsMutex.Lock()
+	if customModels[m.Name] != nil {
+		customModelsMutex.Unlock()
+		http.Error(w, "Model "+m.Name+" is already registered", http.StatusConflict)
+		return
+	}
+	customModels[m.Name] = &m
+	saveCustomModels()
+	customModelsMutex.Unlock()
+	log.Printf("Registered custom model %s (%s) on %d processors", m.Name, strings.Join(m.Stems, ", "), len(regs))
+	writeJSON(w, http.StatusCreated, m)
+}
+
+// listCustomModelsHandler serves GET /api/admin/models/custom
+func listCustomModelsHandler(w http.ResponseWriter, r *http.Request) {
+	customModelsMutex.RLock()
+	list := make([]CustomModel, 0, len(customModels))
+	for _, name := range sortedKeys(customModels) {
+		list = append(list, *customModels[name])
+	}
+	customModelsMutex.RUnlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+// deleteCustomModelHandler serves DELETE /api/admin/models/custom/{name}
+func deleteCustomModelHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	customModelsMutex.Lock()
+	if customModels[name] == nil {
+		customModelsMutex.Unlock()
+		http.Error(w, "Custom model not found", http.StatusNotFound)
+		return
+	}
+	delete(customModels, name)
+	saveCustomModels()
+	customModelsMutex.Unlock()
+
+	client := newProcessorClient(30 * time.Second)
+	for _, u := range modelProcessors() {
+		if err := unregisterOnProcessor(client, u, name); err != nil {
+			log.Printf("Failed to remove custom model %s from %s: %v", name, u, err)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
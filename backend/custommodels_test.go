@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// fakeCustomModelProcessor accepts registrations whose stems match sources
+type fakeCustomModelProcessor struct {
+	*httptest.Server
+	mu         sync.Mutex
+	sources    []string
+	registered map[string]bool
+}
+
+func newFakeCustomModelProcessor(t *testing.T, sources ...string) *fakeCustomModelProcessor {
+	f := &fakeCustomModelProcessor{sources: sources, registered: map[string]bool{}}
+	router := mux.NewRouter()
+	router.HandleFunc("/models/custom", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name  string   `json:"name"`
+			Stems []string `json:"stems"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if strings.Join(req.Stems, ",") != strings.Join(f.sources, ",") {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "Checkpoint separates " + strings.Join(f.sources, ", ")})
+			return
+		}
+		f.mu.Lock()
+		f.registered[req.Name] = true
+		f.mu.Unlock()
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"name": req.Name, "version": "a1b2c3d4e5f60718"})
+	}).Methods("POST")
+	router.HandleFunc("/models/custom/{name}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		delete(f.registered, mux.Vars(r)["name"])
+		f.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+	}).Methods("DELETE")
+	f.Server = httptest.NewServer(router)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeCustomModelProcessor) has(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.registered[name]
+}
+
+// useCustomModels starts the test with no custom models and a fresh file
+func useCustomModels(t *testing.T) {
+	t.Setenv("CUSTOM_MODELS_FILE", filepath.Join(t.TempDir(), "custom-models.json"))
+	customModelsMutex.Lock()
+	old := customModels
+	customModels = make(map[string]*CustomModel)
+	customModelsMutex.Unlock()
+	t.Cleanup(func() {
+		customModelsMutex.Lock()
+		customModels = old
+		customModelsMutex.Unlock()
+	})
+}
+
+func registerCustomModel(body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	registerCustomModelHandler(rec, httptest.NewRequest("POST", "/api/admin/models/custom", strings.NewReader(body)))
+	return rec
+}
+
+func TestRegisterCustomModel(t *testing.T) {
+	useCustomModels(t)
+	gpu := newFakeCustomModelProcessor(t, "vocals", "other")
+	cpu := newFakeCustomModelProcessor(t, "vocals", "other")
+	useProcessors(t, []*processorInstance{{URL: gpu.URL, Healthy: true}, {URL: cpu.URL, Healthy: true}})
+
+	rec := registerCustomModel(`{"name": "lab_vocals", "checkpoint": "https://models.example.org/lab_vocals.th", "stems": ["vocals", "other"]}`)
+	var m CustomModel
+	json.Unmarshal(rec.Body.Bytes(), &m)
+	if rec.Code != http.StatusCreated || m.Version != "a1b2c3d4e5f60718" || !gpu.has("lab_vocals") || !cpu.has("lab_vocals") {
+		t.Fatalf("register = %d %s", rec.Code, rec.Body)
+	}
+	if rec := registerCustomModel(`{"name": "lab_vocals", "checkpoint": "/models/other.th", "stems": ["vocals", "other"]}`); rec.Code != http.StatusConflict {
+		t.Errorf("registering twice = %d", rec.Code)
+	}
+
+	// The model is now accepted for jobs, within its stems
+	if !isAllowedModel("lab_vocals") || !isCustomModel("lab_vocals") {
+		t.Error("lab_vocals isn't allowed")
+	}
+	if b := brandingFromEnv(); !strings.Contains(strings.Join(b.Limits.Models, ","), "lab_vocals") || len(b.Limits.ModelStems["lab_vocals"]) != 2 || len(b.Limits.ModelStems["htdemucs_6s"]) != 6 {
+		t.Errorf("branding limits = %v %v", b.Limits.Models, b.Limits.ModelStems)
+	}
+
+	// Registrations are reloaded on start
+	customModelsMutex.Lock()
+	customModels = make(map[string]*CustomModel)
+	customModelsMutex.Unlock()
+	loadCustomModels()
+	if got := modelStems("lab_vocals"); strings.Join(got, ",") != "vocals,other" {
+		t.Errorf("reloaded stems = %v", got)
+	}
+
+	req := mux.SetURLVars(httptest.NewRequest("DELETE", "/api/admin/models/custom/lab_vocals", nil), map[string]string{"name": "lab_vocals"})
+	rec = httptest.NewRecorder()
+	deleteCustomModelHandler(rec, req)
+	if rec.Code != http.StatusOK || isAllowedModel("lab_vocals") || gpu.has("lab_vocals") || cpu.has("lab_vocals") {
+		t.Errorf("delete = %d", rec.Code)
+	}
+}
+
+func TestRegisterCustomModelRollsBack(t *testing.T) {
+	useCustomModels(t)
+	gpu := newFakeCustomModelProcessor(t, "drums", "other")
+	cpu := newFakeCustomModelProcessor(t, "drums", "bass", "other")
+	useProcessors(t, []*processorInstance{{URL: gpu.URL, Healthy: true}, {URL: cpu.URL, Healthy: true}})
+
+	rec := registerCustomModel(`{"name": "lab_drums", "checkpoint": "/srv/models/lab_drums.th", "stems": ["drums", "other"]}`)
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), cpu.URL) {
+		t.Errorf("register = %d %s", rec.Code, rec.Body)
+	}
+	if isAllowedModel("lab_drums") || gpu.has("lab_drums") {
+		t.Error("a model one processor rejected was kept")
+	}
+
+	for _, bad := range []string{
+		`{"name": "Lab-Drums", "checkpoint": "/srv/models/lab.th", "stems": ["drums", "other"]}`,
+		`{"name": "htdemucs", "checkpoint": "/srv/models/lab.th", "stems": ["drums", "other"]}`,
+		`{"name": "lab_drums", "checkpoint": "ftp://models/lab.th", "stems": ["drums", "other"]}`,
+		`{"name": "lab_drums", "checkpoint": "/srv/models/lab.th", "stems": ["drums"]}`,
+		`{"name": "lab_drums", "checkpoint": "/srv/models/lab.th", "stems": ["drums", "strings"]}`,
+		`{"name": "lab_drums", "checkpoint": "/srv/models/lab.th", "stems": ["drums", "drums"]}`,
+	} {
+		if rec := registerCustomModel(bad); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s = %d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+func TestCustomModelJobOptions(t *testing.T) {
+	useCustomModels(t)
+	customModelsMutex.Lock()
+	customModels["lab_vocals"] = &CustomModel{Name: "lab_vocals", Stems: []string{"vocals", "other"}}
+	customModelsMutex.Unlock()
+
+	if _, err := parseJobOptions(url.Values{"model": {"lab_vocals"}, "stem_mode": {"isolate"}, "isolate_stem": {"vocals"}}.Get); err != nil {
+		t.Errorf("isolating vocals with lab_vocals: %v", err)
+	}
+	if _, err := parseJobOptions(url.Values{"model": {"lab_vocals"}, "stem_mode": {"isolate"}, "isolate_stem": {"drums"}}.Get); err == nil || !strings.Contains(err.Error(), "lab_vocals") {
+		t.Errorf("isolating drums with lab_vocals = %v", err)
+	}
+}
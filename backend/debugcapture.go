@@ -0,0 +1,286 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Debug capture (DEBUG_CAPTURE=true) records the backend's requests to the
+// processor and the responses it got, so an integration bug seen on a
+// failed job can be reproduced. Audio is never kept: the uploaded file is
+// recorded by name and size only, credentials are redacted and response
+// bodies are truncated. Captures of successful jobs are dropped; those of
+// the last DEBUG_CAPTURE_MAX_JOBS (default 50) failed jobs are kept in
+// memory and downloadable by admins as a ZIP with the job, the exchanges
+// and a replay script:
+//
+//	GET /api/admin/debug-captures            failed jobs with captures
+//	GET /api/admin/jobs/{id}/debug-bundle    the bundle of one job
+
+const maxCapturedBody = 64 << 10
+
+// debugExchange is one sanitized request to the processor and its outcome
+type debugExchange struct {
+	Time            time.Time         `json:"time"`
+	DurationMS      int64             `json:"duration_ms"`
+	Method          string            `json:"method"`
+	URL             string            `json:"url"`
+	RequestHeaders  map[string]string `json:"request_headers,omitempty"`
+	FormFields      [][2]string       `json:"form_fields,omitempty"` // in the order they were sent
+	File            *debugFile        `json:"file,omitempty"`
+	Status          int               `json:"status,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+	ResponseBody    string            `json:"response_body,omitempty"`
+	Truncated       bool              `json:"truncated,omitempty"`
+	Error           string            `json:"error,omitempty"`
+}
+
+// debugFile stands in for a file part whose contents aren't captured
+type debugFile struct {
+	Field string `json:"field"`
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+}
+
+// debugCapture holds a job's exchanges
+type debugCapture struct {
+	JobID     string          `json:"job_id"`
+	FailedAt  *time.Time      `json:"failed_at,omitempty"`
+	Exchanges []debugExchange `json:"exchanges"`
+}
+
+var (
+	debugCaptures      = make(map[string]*debugCapture)
+	debugCapturesMutex = &sync.Mutex{}
+	// debugCaptureFailed lists the jobs whose captures are kept, oldest first
+	debugCaptureFailed []string
+)
+
+func debugCaptureEnabled() bool {
+	return os.Getenv("DEBUG_CAPTURE") == "true"
+}
+
+func debugCaptureMaxJobs() int {
+	if n, err := strconv.Atoi(os.Getenv("DEBUG_CAPTURE_MAX_JOBS")); err == nil && n > 0 {
+		return n
+	}
+	return 50
+}
+
+// sensitiveHeaders are redacted in captures
+var sensitiveHeaders = map[string]bool{
+	"Authorization": true, "Cookie": true, "Set-Cookie": true, "X-Api-Key": true, "X-Track2stem-Terms": true,
+}
+
+func sanitizeHeaders(h http.Header) map[string]string {
+	if len(h) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(h))
+	for name, values := range h {
+		if sensitiveHeaders[http.CanonicalHeaderKey(name)] {
+			out[name] = "[redacted]"
+			continue
+		}
+		out[name] = strings.Join(values, ", ")
+	}
+	return out
+}
+
+// sanitizeURL drops credentials and query values from a URL
+func sanitizeURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[invalid url]"
+	}
+	u.User = nil
+	q := u.Query()
+	for key := range q {
+		q.Set(key, "[redacted]")
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// newDebugExchange starts a capture of a request, or returns nil when
+// capturing is off
+func newDebugExchange(req *http.Request) *debugExchange {
+	if !debugCaptureEnabled() {
+		return nil
+	}
+	return &debugExchange{
+		Time:           time.Now().UTC(),
+		Method:         req.Method,
+		URL:            sanitizeURL(req.URL.String()),
+		RequestHeaders: sanitizeHeaders(req.Header),
+	}
+}
+
+// finish records the response (or error) and stores the exchange
+func (e *debugExchange) finish(jobID string, resp *http.Response, body []byte, err error) {
+	if e == nil {
+		return
+	}
+	e.DurationMS = time.Since(e.Time).Milliseconds()
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if resp != nil {
+		e.Status = resp.StatusCode
+		e.ResponseHeaders = sanitizeHeaders(resp.Header)
+	}
+	if len(body) > maxCapturedBody {
+		body, e.Truncated = body[:maxCapturedBody], true
+	}
+	e.ResponseBody = string(body)
+
+	debugCapturesMutex.Lock()
+	c, exists := debugCaptures[jobID]
+	if !exists {
+		c = &debugCapture{JobID: jobID}
+		debugCaptures[jobID] = c
+	}
+	c.Exchanges = append(c.Exchanges, *e)
+	debugCapturesMutex.Unlock()
+}
+
+// retainDebugCapture keeps the captures of failed jobs and drops the rest
+func retainDebugCapture(e Event) {
+	switch e.Type {
+	case EventJobCompleted, EventJobDeleted, EventJobFailed:
+	default:
+		return
+	}
+	debugCapturesMutex.Lock()
+	defer debugCapturesMutex.Unlock()
+	c, exists := debugCaptures[e.Job.ID]
+	if !exists {
+		return
+	}
+	if e.Type != EventJobFailed {
+		// Deleting a failed job keeps its capture: the bundle may be all that is left
+		if c.FailedAt == nil {
+			delete(debugCaptures, e.Job.ID)
+		}
+		return
+	}
+	now := e.CreatedAt
+	c.FailedAt = &now
+	debugCaptureFailed = append(debugCaptureFailed, e.Job.ID)
+	for len(debugCaptureFailed) > debugCaptureMaxJobs() {
+		delete(debugCaptures, debugCaptureFailed[0])
+		debugCaptureFailed = debugCaptureFailed[1:]
+	}
+}
+
+// listDebugCapturesHandler lists the failed jobs that have a bundle
+func listDebugCapturesHandler(w http.ResponseWriter, r *http.Request) {
+	type entry struct {
+		JobID     string    `json:"job_id"`
+		FailedAt  time.Time `json:"failed_at"`
+		Exchanges int       `json:"exchanges"`
+	}
+	debugCapturesMutex.Lock()
+	list := make([]entry, 0, len(debugCaptureFailed))
+	for i := len(debugCaptureFailed) - 1; i >= 0; i-- {
+		c := debugCaptures[debugCaptureFailed[i]]
+		list = append(list, entry{JobID: c.JobID, FailedAt: *c.FailedAt, Exchanges: len(c.Exchanges)})
+	}
+	debugCapturesMutex.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": debugCaptureEnabled(), "jobs": list})
+}
+
+// debugBundleHandler streams a failed job's capture as a ZIP with
+// job.json, exchanges.json and replay.sh
+func debugBundleHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+	if !isValidJobID(jobID) {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	debugCapturesMutex.Lock()
+	var capture debugCapture
+	c, exists := debugCaptures[jobID]
+	if exists && c.FailedAt != nil {
+		capture = *c
+		capture.Exchanges = append([]debugExchange(nil), c.Exchanges...)
+	}
+	debugCapturesMutex.Unlock()
+	if !exists || capture.FailedAt == nil {
+		http.Error(w, "No debug capture for job", http.StatusNotFound)
+		return
+	}
+
+	jobsMutex.RLock()
+	var job interface{} = map[string]string{"id": jobID, "status": "deleted"}
+	if j, ok := jobs[jobID]; ok {
+		job = j.snapshot()
+	}
+	jobsMutex.RUnlock()
+	recordAudit("debug.bundle", jobID, nil)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="debug-%s.zip"`, jobID))
+	zw := zip.NewWriter(w)
+	add := func(name string, data []byte) {
+		if f, err := zw.Create(name); err == nil {
+			f.Write(data)
+		}
+	}
+	jobJSON, _ := json.MarshalIndent(job, "", "  ")
+	add("job.json", jobJSON)
+	exchangesJSON, _ := json.MarshalIndent(capture, "", "  ")
+	add("exchanges.json", exchangesJSON)
+	add("replay.sh", []byte(replayScript(capture)))
+	zw.Close()
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// replayScript rebuilds the captured requests as curl commands. The audio
+// isn't in the bundle, so the original file is passed as an argument.
+func replayScript(c debugCapture) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	fmt.Fprintf(&b, "# Replays the processor requests of job %s.\n", c.JobID)
+	b.WriteString("# Usage: PROCESSOR_URL=http://localhost:5000 ./replay.sh <audio-file>\n")
+	b.WriteString("set -e\n")
+	b.WriteString(": \"${PROCESSOR_URL:=http://localhost:5000}\"\n")
+	b.WriteString("AUDIO=\"${1:?pass the original audio file}\"\n")
+	for _, e := range c.Exchanges {
+		path := e.URL
+		if u, err := url.Parse(e.URL); err == nil {
+			path = u.Path
+		}
+		fmt.Fprintf(&b, "\n# %s -> %s\n", e.Time.Format(time.RFC3339), replayOutcome(e))
+		fmt.Fprintf(&b, "curl -sS -X %s \"$PROCESSOR_URL\"%s", e.Method, shellQuote(path))
+		if e.File != nil {
+			fmt.Fprintf(&b, " \\\n  -F %s", shellQuote(e.File.Field+"=@")+`"$AUDIO"`)
+		}
+		for _, f := range e.FormFields {
+			fmt.Fprintf(&b, " \\\n  -F %s", shellQuote(f[0]+"="+f[1]))
+		}
+		b.WriteString("\necho\n")
+	}
+	return b.String()
+}
+
+func replayOutcome(e debugExchange) string {
+	if e.Error != "" {
+		return "error: " + e.Error
+	}
+	return fmt.Sprintf("HTTP %d after %dms", e.Status, e.DurationMS)
+}
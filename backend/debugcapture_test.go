@@ -0,0 +1,103 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func TestDebugCaptureBundle(t *testing.T) {
+	processor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("model") == "mdx" {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"outputs": map[string]string{}})
+			return
+		}
+		w.Header().Set("Set-Cookie", "session=secret")
+		http.Error(w, "torch.cuda.OutOfMemoryError", http.StatusInternalServerError)
+	}))
+	defer processor.Close()
+	t.Setenv("PROCESSOR_URL", processor.URL)
+	t.Setenv("DEBUG_CAPTURE", "true")
+
+	input := filepath.Join(t.TempDir(), "song.mp3")
+	os.WriteFile(input, []byte("ID3 audio payload"), 0644)
+	failed, completed := uuid.New().String(), uuid.New().String()
+	jobsMutex.Lock()
+	jobs[failed] = &Job{ID: failed, Status: "queued"}
+	jobs[completed] = &Job{ID: completed, Status: "queued"}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, failed)
+		delete(jobs, completed)
+		jobsMutex.Unlock()
+		debugCapturesMutex.Lock()
+		debugCaptures, debugCaptureFailed = make(map[string]*debugCapture), nil
+		debugCapturesMutex.Unlock()
+	})
+
+	// main registers retainDebugCapture as an event listener
+	processJob(failed, input, jobOptions{StemMode: "all", Model: "htdemucs", OutputFormat: "mp3"})
+	retainDebugCapture(Event{Type: EventJobFailed, CreatedAt: time.Now(), Job: Job{ID: failed}})
+	processJob(completed, input, jobOptions{StemMode: "all", Model: "mdx", OutputFormat: "mp3"})
+	retainDebugCapture(Event{Type: EventJobCompleted, CreatedAt: time.Now(), Job: Job{ID: completed}})
+
+	debugCapturesMutex.Lock()
+	_, kept := debugCaptures[completed]
+	debugCapturesMutex.Unlock()
+	if kept {
+		t.Error("capture of a completed job was kept")
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/admin/jobs/{id}/debug-bundle", debugBundleHandler)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/admin/jobs/"+failed+"/debug-bundle", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("bundle = %d: %s", rec.Code, rec.Body.String())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+
+	var capture debugCapture
+	json.Unmarshal([]byte(files["exchanges.json"]), &capture)
+	if len(capture.Exchanges) != 1 {
+		t.Fatalf("exchanges = %+v", capture.Exchanges)
+	}
+	e := capture.Exchanges[0]
+	if e.Status != http.StatusInternalServerError || !strings.Contains(e.ResponseBody, "OutOfMemoryError") {
+		t.Errorf("response = %d %q", e.Status, e.ResponseBody)
+	}
+	if e.File == nil || e.File.Size != int64(len("ID3 audio payload")) || e.ResponseHeaders["Set-Cookie"] != "[redacted]" {
+		t.Errorf("exchange = %+v", e)
+	}
+	if strings.Contains(rec.Body.String(), "audio payload") {
+		t.Error("bundle contains the audio")
+	}
+	if !strings.Contains(files["replay.sh"], `-F 'file=@'"$AUDIO"`) || !strings.Contains(files["replay.sh"], "-F 'model=htdemucs'") {
+		t.Errorf("replay.sh = %s", files["replay.sh"])
+	}
+	if !strings.Contains(files["job.json"], `"status": "failed"`) {
+		t.Errorf("job.json = %s", files["job.json"])
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Content-hash deduplication. Completed jobs are indexed by the SHA-256 of
+// their upload together with the settings that shape the stems (model,
+// stem mode, isolated stem, output format and the quality options), so a
+// track re-uploaded with the same settings reuses the finished stems
+// instead of running Demucs again. The new job gets its own copy of the
+// stems, completes at once and is marked cache_hit. Uploads with
+// ?force=true are always separated; DEDUP_CACHE=false turns the cache off.
+// Canary results are never reused.
+
+var (
+	dedupCache      = make(map[string]string) // dedup key -> completed job ID
+	dedupCacheMutex = &sync.Mutex{}
+)
+
+func dedupEnabled() bool {
+	return os.Getenv("DEDUP_CACHE") != "false"
+}
+
+// dedupKey identifies the stems produced from audio with the given hash
+func dedupKey(hash string, opts jobOptions) string {
+	isolate := ""
+	if opts.StemMode == "isolate" {
+		isolate = opts.IsolateStem
+	}
+	key := strings.Join([]string{
+		hash, opts.Model, opts.StemMode, isolate, opts.OutputFormat,
+		opts.Segment, opts.Overlap, opts.Shifts, opts.ClipMode, opts.MP3Bitrate,
+		strings.Join(opts.ExtraFormats, "+"), opts.localSteps(), formatAdvancedOptions(opts.Advanced),
+	}, "|")
+	// Deterministic stems are vouched for by their recorded seed
+	if opts.Deterministic {
+		key += "|seed=" + opts.Seed
+	}
+	if len(opts.StemGroups) > 0 {
+		key += "|stems=" + formatStemGroups(opts.StemGroups)
+	}
+	if opts.Watermark != "" {
+		key += "|watermark=" + opts.Watermark
+	}
+	return key
+}
+
+// reuseCachedResult completes a new job from an earlier job with the same
+// audio and settings, returning false when the job has to be separated
+func reuseCachedResult(job *Job, uploadPath string) bool {
+	if !dedupEnabled() {
+		return false
+	}
+	hash, err := fileSHA256(uploadPath)
+	if err != nil {
+		log.Printf("Failed to hash upload of job %s: %v", job.ID, err)
+		return false
+	}
+	jobsMutex.Lock()
+	key := dedupKey(hash, job.options())
+	job.dedupKey = key
+	// An inaudible mark identifies the job, so its stems are never shared
+	force := job.force || job.Watermark == "inaudible"
+	jobsMutex.Unlock()
+	if force {
+		return false
+	}
+
+	dedupCacheMutex.Lock()
+	sourceID, cached := dedupCache[key]
+	dedupCacheMutex.Unlock()
+	if !cached {
+		return false
+	}
+	jobsMutex.RLock()
+	source, exists := jobs[sourceID]
+	var src Job
+	if exists {
+		src = source.snapshot()
+	}
+	jobsMutex.RUnlock()
+	if !exists || src.Status != "completed" || len(src.OutputFiles) == 0 {
+		return false
+	}
+
+	// Mixes belong to the source job
+	stems := make(map[string]string, len(src.OutputFiles))
+	for stem, path := range src.OutputFiles {
+		if !isMixOutput(stem) {
+			stems[stem] = path
+		}
+	}
+	dir := filepath.Join(outputDir, job.ID)
+	outputs, err := copyOutputs(stems, dir)
+	if err != nil {
+		log.Printf("Failed to reuse stems of job %s for job %s: %v", sourceID, job.ID, err)
+		os.RemoveAll(dir)
+		return false
+	}
+
+	jobsMutex.Lock()
+	job.Status = "completed"
+	now := time.Now().UTC()
+	job.CompletedAt = &now
+	job.OutputFiles = outputs
+	job.Environment = src.Environment
+	job.Notes = src.Notes
+	job.CacheHit = true
+	job.reusePipelineSteps()
+	jobsMutex.Unlock()
+	log.Printf("Job %s reuses the stems of job %s", job.ID, sourceID)
+
+	emitJobEvent(job.ID, EventJobCreated)
+	emitJobEvent(job.ID, EventJobCompleted)
+	queueAutoDeliveries(job.ID)
+	startPipelineExports(job.ID)
+	return true
+}
+
+// copyOutputs links (or, across file systems, copies) stems into dir
+func copyOutputs(files map[string]string, dir string) (map[string]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	outputs := make(map[string]string, len(files))
+	for stem, path := range files {
+		if !safeOutputPath(path) {
+			return nil, os.ErrPermission
+		}
+		dst := filepath.Join(dir, stem+"_"+filepath.Base(path))
+		if err := os.Link(path, dst); err != nil {
+			if err := copyFile(path, dst); err != nil {
+				return nil, err
+			}
+		}
+		outputs[stem] = dst
+	}
+	return outputs, nil
+}
+
+// indexDedupResult adds completed jobs to the cache and drops deleted and
+// expired ones
+func indexDedupResult(e Event) {
+	switch e.Type {
+	case EventJobCompleted:
+		if e.Job.dedupKey == "" || e.Job.Variant == variantCanary {
+			return
+		}
+		dedupCacheMutex.Lock()
+		dedupCache[e.Job.dedupKey] = e.Job.ID
+		dedupCacheMutex.Unlock()
+	case EventJobDeleted, EventJobExpired:
+		dedupCacheMutex.Lock()
+		for key, id := range dedupCache {
+			if id == e.Job.ID {
+				delete(dedupCache, key)
+			}
+		}
+		dedupCacheMutex.Unlock()
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDedupReusesCompletedStems(t *testing.T) {
+	oldUploadDir, oldOutputDir := uploadDir, outputDir
+	uploadDir, outputDir = t.TempDir(), t.TempDir()
+	externalWorkers = true
+	var created []string
+	t.Cleanup(func() {
+		uploadDir, outputDir, externalWorkers = oldUploadDir, oldOutputDir, false
+		jobsMutex.Lock()
+		for _, id := range created {
+			delete(jobs, id)
+		}
+		jobsMutex.Unlock()
+		dedupCacheMutex.Lock()
+		dedupCache = make(map[string]string)
+		dedupCacheMutex.Unlock()
+	})
+
+	audio := []byte("ID3 the same track")
+	input := filepath.Join(t.TempDir(), "song.mp3")
+	os.WriteFile(input, audio, 0644)
+	hash, _ := fileSHA256(input)
+	opts, _ := parseJobOptions(func(string) string { return "" })
+
+	// An earlier job separated the same audio with the default options
+	source := uuid.New().String()
+	created = append(created, source)
+	os.MkdirAll(filepath.Join(outputDir, source), 0755)
+	vocals := filepath.Join(outputDir, source, "vocals.mp3")
+	os.WriteFile(vocals, []byte("vocals"), 0644)
+	job := newJob(source, "song.mp3", opts)
+	job.Status, job.OutputFiles, job.dedupKey = "completed", map[string]string{"vocals": vocals}, dedupKey(hash, opts)
+	jobsMutex.Lock()
+	jobs[source] = job
+	jobsMutex.Unlock()
+	indexDedupResult(Event{Type: EventJobCompleted, CreatedAt: time.Now(), Job: job.snapshot()})
+
+	upload := func(query string, fields map[string]string) Job {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", "copy.mp3")
+		part.Write(audio)
+		for k, v := range fields {
+			mw.WriteField(k, v)
+		}
+		mw.Close()
+		req := httptest.NewRequest("POST", "/api/upload"+query, &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		uploadHandler(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("upload = %d: %s", rec.Code, rec.Body.String())
+		}
+		var j Job
+		json.Unmarshal(rec.Body.Bytes(), &j)
+		created = append(created, j.ID)
+		return j
+	}
+
+	hit := upload("", nil)
+	if !hit.CacheHit || hit.Status != "completed" {
+		t.Fatalf("re-upload = %+v, want a completed cache hit", hit)
+	}
+	if data, err := os.ReadFile(hit.OutputFiles["vocals"]); err != nil || string(data) != "vocals" || !safeOutputPath(hit.OutputFiles["vocals"]) {
+		t.Errorf("reused stem %q = %q, %v", hit.OutputFiles["vocals"], data, err)
+	}
+
+	if j := upload("?force=true", nil); j.CacheHit || j.Status != "pending" {
+		t.Errorf("forced upload = %+v, want it separated", j)
+	}
+	if j := upload("", map[string]string{"output_format": "wav"}); j.CacheHit {
+		t.Error("upload with another format reused the stems")
+	}
+
+	// Deleting the source keeps the copy it served, and the copy serves later hits
+	indexDedupResult(Event{Type: EventJobDeleted, CreatedAt: time.Now(), Job: Job{ID: source}})
+	os.RemoveAll(filepath.Join(outputDir, source))
+	jobsMutex.Lock()
+	delete(jobs, source)
+	jobsMutex.Unlock()
+	if j := upload("", nil); j.CacheHit {
+		t.Error("upload reused the stems of a deleted job")
+	}
+	jobsMutex.RLock()
+	reused := jobs[hit.ID].snapshot()
+	jobsMutex.RUnlock()
+	indexDedupResult(Event{Type: EventJobCompleted, CreatedAt: time.Now(), Job: reused})
+	if j := upload("", nil); !j.CacheHit {
+		t.Error("upload did not reuse the stems of the earlier cache hit")
+	}
+}
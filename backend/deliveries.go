@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Exporter delivers a completed job's stem files to one destination
+type Exporter interface {
+	Deliver(ctx context.Context, d Delivery, files []deliveryFile) error
+}
+
+// deliveryFile is one stem to deliver: the local file and its slash-separated
+// destination relative to the exporter's base, <job-id>/<file> unless the
+// delivery has a layout
+type deliveryFile struct {
+	Path string
+	Name string
+}
+
+// Delivery tracks one attempt-with-retries to send stems to a target
+type Delivery struct {
+	ID          string     `json:"id"`
+	JobID       string     `json:"job_id"`
+	Target      string     `json:"target"` // local, s3, sftp, webdav, drive, dropbox
+	Stems       []string   `json:"stems"`
+	Folder      string     `json:"folder,omitempty"`
+	Layout      string     `json:"layout,omitempty"`
+	Status      string     `json:"status"` // queued, running, retrying, delivered, failed
+	Attempts    int        `json:"attempts"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+// deliveryRequest is the JSON body of POST /api/jobs/{id}/deliveries
+type deliveryRequest struct {
+	Target string   `json:"target"`
+	Stems  []string `json:"stems"`  // defaults to every stem
+	Folder string   `json:"folder"` // Drive/Dropbox folder name
+	Layout string   `json:"layout"` // path template or packaging profile name
+}
+
+const (
+	deliveryMaxAttempts = 5
+	deliveryTimeout     = 30 * time.Minute
+)
+
+var (
+	deliveryQueue = make(chan deliveryTask, 256)
+	// deliveryRetryBase is doubled after every failed attempt
+	deliveryRetryBase = 10 * time.Second
+)
+
+type deliveryTask struct {
+	JobID      string
+	DeliveryID string
+}
+
+// localExporter copies stems under <dir> on a locally mounted path
+type localExporter struct {
+	dir string
+}
+
+func (e localExporter) Deliver(ctx context.Context, d Delivery, files []deliveryFile) error {
+	for _, file := range files {
+		dst := filepath.Join(e.dir, filepath.FromSlash(file.Name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(file.Path, dst); err != nil {
+			return fmt.Errorf("%s: %v", file.Name, err)
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// s3Exporter uploads stems under <prefix>/ in a bucket
+type s3Exporter struct {
+	config *s3Config
+}
+
+func (e s3Exporter) Deliver(ctx context.Context, d Delivery, files []deliveryFile) error {
+	for _, file := range files {
+		if err := e.config.putObjectFile(ctx, file.Name, file.Path); err != nil {
+			return fmt.Errorf("%s: %v", file.Name, err)
+		}
+	}
+	return nil
+}
+
+// resolveLayout turns a requested layout, or DELIVERY_LAYOUT when none is
+// given, into a path template. Packaging profile names are accepted as
+// shorthands. Every stem must land on its own path, so {stem} is required.
+func resolveLayout(layout string) (string, error) {
+	if layout == "" {
+		layout = os.Getenv("DELIVERY_LAYOUT")
+	}
+	if template, ok := packagingProfiles[layout]; ok {
+		return template, nil
+	}
+	if layout == "" {
+		return "", nil
+	}
+	if !strings.Contains(layout, "{stem}") || strings.HasPrefix(layout, "/") || len(layout) > 256 {
+		return "", fmt.Errorf("Invalid layout value")
+	}
+	return layout, nil
+}
+
+// deliveryFiles resolves the delivery's stems to local files and their
+// destination names
+func deliveryFiles(d Delivery, job Job) ([]deliveryFile, error) {
+	files := make([]deliveryFile, 0, len(d.Stems))
+	for _, stem := range d.Stems {
+		path, exists := job.OutputFiles[stem]
+		if !exists || !safeOutputPath(path) {
+			return nil, fmt.Errorf("stem %s is no longer available", stem)
+		}
+		name := d.JobID + "/" + filepath.Base(path)
+		if d.Layout != "" {
+			name = expandLayout(d.Layout, job, stem, filepath.Ext(path))
+		}
+		files = append(files, deliveryFile{Path: path, Name: name})
+	}
+	return files, nil
+}
+
+// lookupExporter resolves a delivery target to its configured exporter
+func lookupExporter(target string) (Exporter, error) {
+	switch target {
+	case "local":
+		if dir := os.Getenv("LOCAL_EXPORT_DIR"); dir != "" {
+			return localExporter{dir: dir}, nil
+		}
+	case "s3":
+		if config, ok := s3ConfigFromEnv("S3_EXPORT"); ok {
+			return s3Exporter{config: config}, nil
+		}
+	case "sftp", "webdav":
+		dests, err := remoteDestinations()
+		if err != nil {
+			return nil, err
+		}
+		for _, dest := range dests {
+			if dest.Name == target {
+				return remoteExporter{dest: dest}, nil
+			}
+		}
+	case "drive", "dropbox":
+		p := oauthProviders[target]
+		if !p.configured() {
+			break
+		}
+		cloudMutex.Lock()
+		link, linked := storageLinks[target]
+		cloudMutex.Unlock()
+		if !linked {
+			return nil, fmt.Errorf("Storage not linked")
+		}
+		return oauthExporter{provider: p, link: link}, nil
+	default:
+		return nil, fmt.Errorf("Invalid target value")
+	}
+	return nil, fmt.Errorf("Delivery target not configured")
+}
+
+// autoDeliveryTargets returns AUTO_DELIVERY_TARGETS, defaulting to the
+// configured file servers so they receive every completed job
+func autoDeliveryTargets() []string {
+	if v, set := os.LookupEnv("AUTO_DELIVERY_TARGETS"); set {
+		var targets []string
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				targets = append(targets, t)
+			}
+		}
+		return targets
+	}
+	dests, _ := remoteDestinations()
+	targets := make([]string, 0, len(dests))
+	for _, dest := range dests {
+		targets = append(targets, dest.Name)
+	}
+	return targets
+}
+
+// queueAutoDeliveries creates deliveries for a job that just completed: those
+// of its template, then the automatic targets the template didn't cover
+func queueAutoDeliveries(jobID string) {
+	jobsMutex.RLock()
+	var exports []deliveryRequest
+	if job, ok := jobs[jobID]; ok {
+		exports = slices.Clone(job.exports)
+	}
+	jobsMutex.RUnlock()
+	for _, req := range exports {
+		if _, err := addDelivery(jobID, req); err != nil {
+			log.Printf("Template delivery of job %s to %s not queued: %v", jobID, req.Target, err)
+		}
+	}
+
+	for _, target := range autoDeliveryTargets() {
+		if slices.ContainsFunc(exports, func(req deliveryRequest) bool { return req.Target == target }) {
+			continue
+		}
+		if _, err := lookupExporter(target); err != nil {
+			log.Printf("Skipping automatic delivery of job %s to %s: %v", jobID, target, err)
+			continue
+		}
+		if _, err := addDelivery(jobID, deliveryRequest{Target: target}); err != nil {
+			log.Printf("Automatic delivery of job %s to %s not queued: %v", jobID, target, err)
+		}
+	}
+}
+
+// addDelivery validates the request against the job, records a queued
+// delivery on it and enqueues it
+func addDelivery(jobID string, req deliveryRequest) (Delivery, error) {
+	jobsMutex.Lock()
+	job, exists := jobs[jobID]
+	if !exists {
+		jobsMutex.Unlock()
+		return Delivery{}, fmt.Errorf("Job not found")
+	}
+	if job.Status != "completed" {
+		jobsMutex.Unlock()
+		return Delivery{}, fmt.Errorf("Job not completed")
+	}
+	stems := req.Stems
+	if len(stems) == 0 {
+		stems = sortedKeys(job.OutputFiles)
+	}
+	for _, stem := range stems {
+		if _, ok := job.OutputFiles[stem]; !ok {
+			jobsMutex.Unlock()
+			return Delivery{}, fmt.Errorf("Stem not found: %s", stem)
+		}
+	}
+	layout, err := resolveLayout(req.Layout)
+	if err != nil {
+		jobsMutex.Unlock()
+		return Delivery{}, err
+	}
+	now := time.Now().UTC()
+	d := Delivery{
+		ID:        uuid.New().String(),
+		JobID:     jobID,
+		Target:    req.Target,
+		Stems:     stems,
+		Layout:    layout,
+		Status:    "queued",
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if req.Folder != "" {
+		d.Folder = sanitizeFilename(req.Folder)
+	}
+	job.Deliveries = append(job.Deliveries, d)
+	jobsMutex.Unlock()
+
+	enqueueDelivery(deliveryTask{JobID: jobID, DeliveryID: d.ID})
+	return d, nil
+}
+
+func enqueueDelivery(task deliveryTask) {
+	select {
+	case deliveryQueue <- task:
+	default:
+		updateDelivery(task, func(d *Delivery) {
+			d.Status = "failed"
+			d.Error = "Delivery queue is full"
+		})
+	}
+}
+
+// updateDelivery applies fn to the delivery under the jobs lock and returns
+// a copy of the result; ok is false when the job or delivery is gone
+func updateDelivery(task deliveryTask, fn func(d *Delivery)) (Delivery, bool) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	job, exists := jobs[task.JobID]
+	if !exists {
+		return Delivery{}, false
+	}
+	for i := range job.Deliveries {
+		if job.Deliveries[i].ID == task.DeliveryID {
+			fn(&job.Deliveries[i])
+			job.Deliveries[i].UpdatedAt = time.Now().UTC()
+			return job.Deliveries[i], true
+		}
+	}
+	return Delivery{}, false
+}
+
+// startDeliveryWorkers runs n goroutines draining the delivery queue
+func startDeliveryWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for task := range deliveryQueue {
+				runDelivery(task)
+			}
+		}()
+	}
+}
+
+// runDelivery makes one attempt and schedules a retry with exponential
+// backoff on failure, up to deliveryMaxAttempts
+func runDelivery(task deliveryTask) {
+	d, ok := updateDelivery(task, func(d *Delivery) {
+		d.Status = "running"
+		d.Attempts++
+	})
+	if !ok {
+		return
+	}
+
+	jobsMutex.RLock()
+	var job Job
+	if j, exists := jobs[task.JobID]; exists {
+		job = j.snapshot()
+	}
+	jobsMutex.RUnlock()
+
+	err := func() error {
+		exporter, err := lookupExporter(d.Target)
+		if err != nil {
+			return err
+		}
+		files, err := deliveryFiles(d, job)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+		defer cancel()
+		return exporter.Deliver(ctx, d, files)
+	}()
+
+	if err == nil {
+		updateDelivery(task, func(d *Delivery) {
+			now := time.Now().UTC()
+			d.Status = "delivered"
+			d.Error = ""
+			d.DeliveredAt = &now
+		})
+		log.Printf("Delivered job %s to %s", task.JobID, d.Target)
+		return
+	}
+
+	log.Printf("Delivery %s of job %s to %s failed (attempt %d): %v", d.ID, task.JobID, d.Target, d.Attempts, err)
+	if d.Attempts >= deliveryMaxAttempts {
+		updateDelivery(task, func(d *Delivery) {
+			d.Status = "failed"
+			d.Error = err.Error()
+		})
+		return
+	}
+	updateDelivery(task, func(d *Delivery) {
+		d.Status = "retrying"
+		d.Error = err.Error()
+	})
+	time.AfterFunc(deliveryRetryBase<<(d.Attempts-1), func() { enqueueDelivery(task) })
+}
+
+// createDelivery validates a delivery request and writes the API response
+func createDelivery(w http.ResponseWriter, jobID string, req deliveryRequest) {
+	if !isValidJobID(jobID) {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	if _, err := lookupExporter(req.Target); err != nil {
+		status := http.StatusServiceUnavailable
+		switch err.Error() {
+		case "Invalid target value":
+			status = http.StatusBadRequest
+		case "Storage not linked":
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	d, err := addDelivery(jobID, req)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err.Error() == "Job not found" {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, d)
+}
+
+func createDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	var req deliveryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid delivery request", http.StatusBadRequest)
+		return
+	}
+	createDelivery(w, mux.Vars(r)["id"], req)
+}
+
+func listDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+	if !isValidJobID(jobID) {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	jobsMutex.RLock()
+	job, exists := jobs[jobID]
+	var list []Delivery
+	if exists {
+		list = job.snapshot().Deliveries
+	}
+	jobsMutex.RUnlock()
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if list == nil {
+		list = []Delivery{}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
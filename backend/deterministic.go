@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Deterministic mode. deterministic=true asks the processor to separate
+// reproducibly, for archival and forensic workflows: it seeds Python,
+// NumPy and PyTorch with seed (default 0), which fixes the random offsets
+// of shifts, pins PyTorch's thread count and switches it to deterministic
+// algorithms. The processor reports what it pinned, recorded on the job as
+// "determinism" next to its environment; running the same upload with the
+// same options and seed on the same processor image and device gives
+// byte-identical stems. A processor that doesn't report it fails the job,
+// since the stems can't be vouched for.
+
+// maxSeed is the largest seed NumPy accepts
+const maxSeed = 1<<32 - 1
+
+// Determinism is what the processor pinned for a deterministic job
+type Determinism struct {
+	Seed    uint32 `json:"seed"`
+	Shifts  int    `json:"shifts"`
+	Threads int    `json:"threads,omitempty"` // PyTorch intra-op threads
+}
+
+// parseSeed validates the seed of a deterministic job
+func parseSeed(raw string) (string, error) {
+	if raw == "" {
+		return "0", nil
+	}
+	n, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil || n > maxSeed {
+		return "", fmt.Errorf("Invalid seed value (allowed: 0 to %d)", uint64(maxSeed))
+	}
+	return strconv.FormatUint(n, 10), nil
+}
+
+// parseDeterminism reads the "determinism" object of a processor response
+func parseDeterminism(v interface{}) *Determinism {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	data, _ := json.Marshal(m)
+	var d Determinism
+	if json.Unmarshal(data, &d) != nil {
+		return nil
+	}
+	return &d
+}
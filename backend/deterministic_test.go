@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDeterministicOptions(t *testing.T) {
+	for _, tc := range []struct {
+		fields  map[string]string
+		seed    string
+		ignored string
+		err     string
+	}{
+		{fields: map[string]string{"deterministic": "true"}, seed: "0"},
+		{fields: map[string]string{"deterministic": "true", "seed": "042"}, seed: "42"},
+		{fields: map[string]string{"deterministic": "true", "seed": "4294967295"}, seed: "4294967295"},
+		{fields: map[string]string{"deterministic": "true", "seed": "4294967296"}, err: "Invalid seed"},
+		{fields: map[string]string{"deterministic": "true", "seed": "-1"}, err: "Invalid seed"},
+		{fields: map[string]string{"seed": "7"}, ignored: "seed"},
+		{fields: map[string]string{"deterministic": "yes"}, ignored: "deterministic"},
+	} {
+		opts, err := parseJobOptions(func(key string) string { return tc.fields[key] })
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%v: err = %v, want %q", tc.fields, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tc.fields, err)
+			continue
+		}
+		if opts.Seed != tc.seed {
+			t.Errorf("%v: seed = %q, want %q", tc.fields, opts.Seed, tc.seed)
+		}
+		if _, ignored := opts.Ignored[tc.ignored]; tc.ignored != "" && !ignored {
+			t.Errorf("%v: %s not ignored: %v", tc.fields, tc.ignored, opts.Ignored)
+		}
+	}
+
+	// The seed is part of the cache key, and non-deterministic keys are unchanged
+	plain, _ := parseJobOptions(func(string) string { return "" })
+	seeded, _ := parseJobOptions(func(key string) string { return map[string]string{"deterministic": "true", "seed": "1"}[key] })
+	if strings.Contains(dedupKey("h", plain), "seed") || dedupKey("h", seeded) == dedupKey("h", plain) {
+		t.Errorf("dedup keys %q and %q", dedupKey("h", plain), dedupKey("h", seeded))
+	}
+}
+
+func TestIntegrationDeterministic(t *testing.T) {
+	b := newIntegrationBackend(t, 1)
+
+	job := b.waitFor(b.upload("song.mp3", map[string]string{"deterministic": "true", "seed": "1234", "shifts": "2"}).ID, "completed")
+	if !job.Deterministic || job.Seed != "1234" || job.Determinism == nil ||
+		job.Determinism.Seed != 1234 || job.Determinism.Shifts != 2 || job.Determinism.Threads != 4 {
+		t.Errorf("deterministic job = %+v, determinism %+v", job, job.Determinism)
+	}
+	if e := job.Effective; e == nil || !e.Deterministic || e.Seed != "1234" {
+		t.Errorf("effective options = %+v", e)
+	}
+	requests := b.processor.Requests()
+	if len(requests) != 1 || requests[0]["deterministic"] != "true" || requests[0]["seed"] != "1234" {
+		t.Errorf("processor requests = %+v", requests)
+	}
+
+	// The processor has to vouch for the seeds
+	job = b.waitFor(b.upload("legacy.mp3", map[string]string{"deterministic": "true"}).ID, "failed")
+	if !strings.Contains(job.Error, "deterministic") {
+		t.Errorf("job on a processor without deterministic mode failed with %q", job.Error)
+	}
+	job = b.waitFor(b.upload("legacy.mp3", nil).ID, "completed")
+	if job.Determinism != nil || b.processor.Requests()[2]["deterministic"] != "" {
+		t.Errorf("plain job recorded %+v", job.Determinism)
+	}
+}
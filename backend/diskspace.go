@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Uploads are refused with 507 Insufficient Storage when the upload and
+// output filesystems can't hold the file plus its expected stems, instead of
+// failing partway through the copy.
+
+// losslessInputs decode to roughly their own size; compressed inputs grow
+// about elevenfold as WAV
+var losslessInputs = map[string]bool{".wav": true, ".flac": true, ".aiff": true, ".aif": true}
+
+// diskReserve is space always left free (MIN_FREE_DISK_MB, default 256)
+func diskReserve() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("MIN_FREE_DISK_MB"), 10, 64); err == nil && n >= 0 {
+		return n << 20
+	}
+	return 256 << 20
+}
+
+// estimateOutputBytes is a deliberately rough upper bound on the stems a job
+// writes for an input of size bytes
+func estimateOutputBytes(size int64, fileName string, opts jobOptions) int64 {
+	stems := int64(4)
+	if opts.StemMode == "isolate" {
+		stems = 2
+	} else if opts.Model == "htdemucs_6s" {
+		stems = 6
+	}
+	lossless := losslessInputs[strings.ToLower(filepath.Ext(fileName))]
+	var perStem int64
+	for _, format := range append([]string{opts.OutputFormat}, opts.ExtraFormats...) {
+		switch format {
+		case "wav":
+			if lossless {
+				perStem += size
+			} else {
+				perStem += size * 11
+			}
+		case "flac":
+			if lossless {
+				perStem += size * 6 / 10
+			} else {
+				perStem += size * 6
+			}
+		default:
+			perStem += size
+		}
+	}
+	return stems * perStem
+}
+
+// storageError is the JSON body of a 507 response
+type storageError struct {
+	Error          string `json:"error"`
+	Path           string `json:"path"`
+	RequiredBytes  int64  `json:"required_bytes"`
+	AvailableBytes int64  `json:"available_bytes"`
+
+	Code        string       `json:"code"` // insufficient_storage
+	Remediation *Remediation `json:"remediation"`
+}
+
+// checkDiskSpace verifies each directory's filesystem has room for the bytes
+// planned for it plus the reserve. Directories on the same filesystem share
+// its free space. It returns nil when there is room or free space is unknown.
+func checkDiskSpace(need map[string]int64) *storageError {
+	type fsNeed struct {
+		path     string
+		required int64
+		free     int64
+	}
+	byFS := make(map[string]*fsNeed)
+	var order []string
+	for dir, bytes := range need {
+		free, fsid, err := diskFree(dir)
+		if err != nil {
+			continue
+		}
+		if chaosDiskFull() {
+			free = 0
+		}
+		n, ok := byFS[fsid]
+		if !ok {
+			n = &fsNeed{path: dir, required: diskReserve(), free: free}
+			byFS[fsid] = n
+			order = append(order, fsid)
+		}
+		n.required += bytes
+	}
+	for _, fsid := range order {
+		if n := byFS[fsid]; n.required > n.free {
+			return &storageError{
+				Error:          "Insufficient storage",
+				Path:           n.path,
+				RequiredBytes:  n.required,
+				AvailableBytes: n.free,
+			}
+		}
+	}
+	return nil
+}
+
+// writeStorageError sends a 507 with the structured error
+func writeStorageError(w http.ResponseWriter, e *storageError) {
+	body := *e
+	body.Code = "insufficient_storage"
+	body.Remediation = storageRemedy()
+	writeJSON(w, http.StatusInsufficientStorage, body)
+}
+
+// isNoSpace reports whether err is the filesystem running out of space
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
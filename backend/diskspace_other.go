@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// diskFree is not implemented on this platform, so space checks are skipped
+func diskFree(path string) (int64, string, error) {
+	return 0, "", errors.New("disk space check not supported")
+}
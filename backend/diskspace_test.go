@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEstimateOutputBytes(t *testing.T) {
+	cases := []struct {
+		file string
+		opts jobOptions
+		want int64
+	}{
+		{"song.mp3", jobOptions{StemMode: "all", Model: "htdemucs_6s", OutputFormat: "mp3"}, 600},
+		{"song.mp3", jobOptions{StemMode: "all", Model: "htdemucs", OutputFormat: "wav"}, 4400},
+		{"master.WAV", jobOptions{StemMode: "isolate", Model: "htdemucs", OutputFormat: "wav"}, 200},
+		{"master.flac", jobOptions{StemMode: "isolate", Model: "htdemucs", OutputFormat: "flac"}, 120},
+	}
+	for _, tc := range cases {
+		if got := estimateOutputBytes(100, tc.file, tc.opts); got != tc.want {
+			t.Errorf("estimateOutputBytes(100, %q, %+v) = %d, want %d", tc.file, tc.opts, got, tc.want)
+		}
+	}
+}
+
+func TestUploadInsufficientStorage(t *testing.T) {
+	oldUploadDir := uploadDir
+	uploadDir = t.TempDir()
+	t.Cleanup(func() { uploadDir = oldUploadDir })
+	t.Setenv("MIN_FREE_DISK_MB", "100000000000") // more than any disk has free
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "song.mp3")
+	part.Write([]byte("ID3 audio"))
+	mw.Close()
+	req := httptest.NewRequest("POST", "/api/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	uploadHandler(rec, req)
+
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Fatalf("upload = %d, want 507", rec.Code)
+	}
+	var e storageError
+	if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil || e.RequiredBytes <= e.AvailableBytes {
+		t.Errorf("507 body = %s, want required_bytes > available_bytes", rec.Body.String())
+	}
+}
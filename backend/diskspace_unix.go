@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// diskFree returns the bytes available to unprivileged users on the
+// filesystem holding path, and an identifier for that filesystem
+func diskFree(path string) (int64, string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, "", err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), fmt.Sprint(st.Fsid), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Download manifests, for clients that fetch a job's files in parallel and
+// resume them. GET /api/jobs/{id}/download-manifest lists every output of a
+// completed job with its size, SHA-256 and a signed URL (DOWNLOAD_URL_TTL)
+// to its immutable version, /api/download/{id}/{name}/{sha256}, which
+// answers Range requests and only ever serves those exact bytes: a client
+// can fetch the files side by side, pick up a partial file where it
+// stopped, and verify each one against its checksum. Outputs not hashed
+// yet are hashed before answering. The manifest's etag covers the names,
+// sizes and checksums, not the URLs, so a client re-fetching it for fresh
+// URLs (If-None-Match answers 304 while nothing changed) knows whether its
+// partial files still belong to the job. The zip isn't listed, as it is
+// built on every request.
+
+// ManifestArtifact is one file of a download manifest
+type ManifestArtifact struct {
+	Name        string `json:"name"` // key in output_files
+	Kind        string `json:"kind"` // stem, format or mix
+	FileName    string `json:"file_name"`
+	ContentType string `json:"content_type"`
+	SizeBytes   int64  `json:"size_bytes"`
+	SHA256      string `json:"sha256"`
+	URL         string `json:"url"`
+}
+
+// DownloadManifest is the response of GET /api/jobs/{id}/download-manifest
+type DownloadManifest struct {
+	JobID      string             `json:"job_id"`
+	ETag       string             `json:"etag"`
+	TotalBytes int64              `json:"total_bytes"`
+	ExpiresAt  time.Time          `json:"expires_at"` // of the URLs
+	Artifacts  []ManifestArtifact `json:"artifacts"`
+}
+
+// signedVersionURL is the signed path of one output's immutable version
+func signedVersionURL(jobID, name, hash string, expires time.Time) string {
+	unix := expires.Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(unix, 10))
+	q.Set("signature", downloadSignature(jobID, name, unix))
+	return "/api/download/" + jobID + "/" + url.PathEscape(name) + "/" + hash + "?" + q.Encode()
+}
+
+// manifestETag identifies the content a manifest lists
+func manifestETag(artifacts []ManifestArtifact) string {
+	h := sha256.New()
+	for _, a := range artifacts {
+		h.Write([]byte(a.Name + "\n" + strconv.FormatInt(a.SizeBytes, 10) + "\n" + a.SHA256 + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// downloadManifestHandler serves GET /api/jobs/{id}/download-manifest
+func downloadManifestHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupCompletedJob(w, r)
+	if !ok {
+		return
+	}
+	if !canAccessJob(r, &job) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if len(job.OutputHashes) < len(job.OutputFiles) {
+		hashJobOutputs(job.ID)
+		if job, ok = lookupCompletedJob(w, r); !ok {
+			return
+		}
+	}
+
+	expires := time.Now().UTC().Add(downloadURLTTL()).Truncate(time.Second)
+	base := publicBaseURL(r)
+	m := DownloadManifest{JobID: job.ID, ExpiresAt: expires, Artifacts: []ManifestArtifact{}}
+	for _, name := range sortedKeys(job.OutputFiles) {
+		path, hash := job.OutputFiles[name], job.OutputHashes[name]
+		info, err := os.Stat(path)
+		if hash == "" || err != nil {
+			http.Error(w, "Output "+name+" is missing on disk", http.StatusConflict)
+			return
+		}
+		contentType := streamContentTypes[filepath.Ext(path)]
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		m.Artifacts = append(m.Artifacts, ManifestArtifact{
+			Name:        name,
+			Kind:        outputKind(name),
+			FileName:    filepath.Base(path),
+			ContentType: contentType,
+			SizeBytes:   info.Size(),
+			SHA256:      hash,
+			URL:         base + signedVersionURL(job.ID, name, hash, expires),
+		})
+		m.TotalBytes += info.Size()
+	}
+	m.ETag = manifestETag(m.Artifacts)
+
+	w.Header().Set("ETag", `"`+m.ETag+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	if matchesETag(r.Header.Get("If-None-Match"), `"`+m.ETag+`"`) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestIntegrationDownloadManifest(t *testing.T) {
+	b := newIntegrationBackend(t, 1)
+	job := b.waitFor(b.upload("song.mp3", nil).ID, "completed")
+
+	code, data := b.get("/api/jobs/" + job.ID + "/download-manifest")
+	var m DownloadManifest
+	json.Unmarshal(data, &m)
+	if code != http.StatusOK || m.JobID != job.ID || len(m.Artifacts) != len(job.OutputFiles) || m.ETag == "" {
+		t.Fatalf("manifest = %d %s", code, data)
+	}
+	var total int64
+	for _, a := range m.Artifacts {
+		content, _ := os.ReadFile(job.OutputFiles[a.Name])
+		sum := sha256.Sum256(content)
+		if a.SHA256 != hex.EncodeToString(sum[:]) || a.SizeBytes != int64(len(content)) || a.Kind != "stem" || a.ContentType != "audio/mpeg" {
+			t.Errorf("%s = %+v", a.Name, a)
+		}
+		total += a.SizeBytes
+	}
+	if m.TotalBytes != total {
+		t.Errorf("total_bytes = %d, want %d", m.TotalBytes, total)
+	}
+
+	// A download resumes from the offset the client has
+	vocals := m.Artifacts[len(m.Artifacts)-1]
+	req, _ := http.NewRequest("GET", vocals.URL, nil)
+	req.Header.Set("Range", "bytes=2-")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || int64(len(rest)) != vocals.SizeBytes-2 {
+		t.Errorf("ranged download = %d with %d bytes", resp.StatusCode, len(rest))
+	}
+
+	// Unchanged outputs keep the etag
+	req, _ = http.NewRequest("GET", b.URL+"/api/jobs/"+job.ID+"/download-manifest", nil)
+	req.Header.Set("If-None-Match", `"`+m.ETag+`"`)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional manifest = %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Download URLs. Completed jobs in GET /api/jobs/{id}, GET /api/jobs and
+// GET /api/batches/{id} carry download_urls, one per stem plus "all" for
+// the zip, signed for DOWNLOAD_URL_TTL (default 15m) and regenerated on
+// every request:
+//
+//	/api/download/{id}/{stem}?expires=<unix>&signature=<hex HMAC-SHA256>
+//
+// The signature is the only credential, so the URLs work in <audio> tags
+// (add &disposition=inline) and in clients that can't send an API key.
+// It covers the job, the artifact and the expiry and is keyed with
+// DOWNLOAD_URL_SECRET; without one a random key is made at startup, which
+// is fine for a single backend but invalidates URLs on restart. Expired or
+// altered URLs are refused with a 403 when API keys are required.
+
+// downloadURLRoutes are the routes a signed URL can open
+var downloadURLRoutes = map[string]bool{
+	"/api/download/{id}/all":           true,
+	"/api/download/{id}/{stem}":        true,
+	"/api/download/{id}/{stem}/{hash}": true,
+}
+
+var (
+	downloadURLKey     []byte
+	downloadURLKeyOnce sync.Once
+)
+
+func downloadURLTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("DOWNLOAD_URL_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 15 * time.Minute
+}
+
+// downloadURLSecret is DOWNLOAD_URL_SECRET, or a random per-process key
+func downloadURLSecret() []byte {
+	if secret := os.Getenv("DOWNLOAD_URL_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	downloadURLKeyOnce.Do(func() {
+		downloadURLKey = make([]byte, 32)
+		rand.Read(downloadURLKey)
+	})
+	return downloadURLKey
+}
+
+// downloadSignature signs one artifact of a job until expires
+func downloadSignature(jobID, artifact string, expires int64) string {
+	mac := hmac.New(sha256.New, downloadURLSecret())
+	mac.Write([]byte(jobID + "\n" + artifact + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedDownloadURL is the signed path of one artifact ("all" for the zip)
+func signedDownloadURL(jobID, artifact string, expires time.Time) string {
+	unix := expires.Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(unix, 10))
+	q.Set("signature", downloadSignature(jobID, artifact, unix))
+	return "/api/download/" + jobID + "/" + url.PathEscape(artifact) + "?" + q.Encode()
+}
+
+// withDownloadURLs adds freshly signed download URLs to a completed job,
+// or to the ready stems of a processing one, about to be returned
+func withDownloadURLs(r *http.Request, job *Job) {
+	stems := make([]string, 0, len(job.OutputFiles)+1)
+	switch {
+	case job.Status == "completed" && len(job.OutputFiles) > 0:
+		stems = append(sortedKeys(job.OutputFiles), "all")
+	case job.Status == "processing" && len(job.ReadyStems) > 0:
+		stems = append(stems, job.ReadyStems...)
+	default:
+		return
+	}
+	expires := time.Now().UTC().Add(downloadURLTTL()).Truncate(time.Second)
+	base := publicBaseURL(r)
+	job.DownloadURLs = make(map[string]string, len(stems))
+	for _, stem := range stems {
+		job.DownloadURLs[stem] = base + signedDownloadURL(job.ID, stem, expires)
+	}
+	job.DownloadURLsExpireAt = &expires
+	job.DownloadURLsExpireIn = isoDuration(downloadURLTTL())
+}
+
+// isSignedDownload reports whether a request carries a download signature
+// for a route that takes one
+func isSignedDownload(r *http.Request) bool {
+	if !r.URL.Query().Has("signature") {
+		return false
+	}
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	tpl, err := route.GetPathTemplate()
+	return err == nil && downloadURLRoutes[tpl]
+}
+
+// validDownloadSignature checks a signed download request against now
+func validDownloadSignature(r *http.Request, now time.Time) bool {
+	q := r.URL.Query()
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || now.Unix() > expires {
+		return false
+	}
+	vars := mux.Vars(r)
+	artifact := vars["stem"]
+	if artifact == "" {
+		artifact = "all"
+	}
+	want := downloadSignature(vars["id"], artifact, expires)
+	return hmac.Equal([]byte(q.Get("signature")), []byte(want))
+}
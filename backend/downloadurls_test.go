@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSignedDownloadURLs(t *testing.T) {
+	oldUploadDir, oldOutputDir := uploadDir, outputDir
+	uploadDir, outputDir = t.TempDir(), t.TempDir()
+	t.Setenv("API_KEYS_REQUIRED", "true")
+	t.Setenv("DOWNLOAD_URL_SECRET", "test-secret")
+	t.Setenv("PUBLIC_BASE_URL", "https://stems.example.com")
+	t.Cleanup(func() {
+		uploadDir, outputDir = oldUploadDir, oldOutputDir
+		apiKeysMutex.Lock()
+		apiKeys, apiKeyWindows = make(map[string]*APIKey), make(map[string]*apiKeyWindow)
+		apiKeysMutex.Unlock()
+	})
+
+	rec := httptest.NewRecorder()
+	createAPIKeyHandler(rec, httptest.NewRequest("POST", "/api/keys", strings.NewReader(`{"name": "app"}`)))
+	var key apiKeyView
+	json.NewDecoder(rec.Body).Decode(&key)
+
+	id := "5f0c3f3e-8c1a-4a8e-9d4e-0f9b6c1d2e3a"
+	vocals := filepath.Join(outputDir, id, "vocals.mp3")
+	os.MkdirAll(filepath.Dir(vocals), 0755)
+	os.WriteFile(vocals, []byte("vocals"), 0644)
+	jobsMutex.Lock()
+	jobs[id] = &Job{ID: id, Status: "completed", APIKeyID: key.ID, OutputFiles: map[string]string{"vocals": vocals}}
+	jobs["pending-"+id] = &Job{ID: "pending-" + id, Status: "processing", APIKeyID: key.ID}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		delete(jobs, "pending-"+id)
+		jobsMutex.Unlock()
+	})
+
+	router := mux.NewRouter()
+	router.Use(apiKeyMiddleware)
+	router.HandleFunc("/api/jobs", listJobsHandler)
+	router.HandleFunc("/api/jobs/{id}", getJobHandler)
+	router.HandleFunc("/api/download/{id}/all", downloadAllHandler)
+	router.HandleFunc("/api/download/{id}/{stem}", downloadHandler)
+	get := func(path, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", strings.TrimPrefix(path, "https://stems.example.com"), nil)
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var job Job
+	json.NewDecoder(get("/api/jobs/"+id, key.Key).Body).Decode(&job)
+	if len(job.DownloadURLs) != 2 || job.DownloadURLsExpireAt == nil {
+		t.Fatalf("download_urls = %v, expire at %v", job.DownloadURLs, job.DownloadURLsExpireAt)
+	}
+	if d := time.Until(*job.DownloadURLsExpireAt); d <= 14*time.Minute || d > 15*time.Minute {
+		t.Errorf("urls expire in %v, want 15m", d)
+	}
+	url := job.DownloadURLs["vocals"]
+	if !strings.HasPrefix(url, "https://stems.example.com/api/download/"+id+"/vocals?expires=") {
+		t.Errorf("vocals url = %q", url)
+	}
+
+	// The URL needs no API key, also with disposition=inline for <audio>
+	if rec := get(url+"&disposition=inline", ""); rec.Code != http.StatusOK || rec.Body.String() != "vocals" {
+		t.Errorf("signed download = %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := get(job.DownloadURLs["all"], ""); rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Errorf("signed zip = %d: %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if rec := get("/api/download/"+id+"/vocals", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned download = %d, want 401", rec.Code)
+	}
+
+	// A signature only opens its own artifact until it expires
+	tampered := strings.Replace(url, "/vocals?", "/drums?", 1)
+	past := signedDownloadURL(id, "vocals", time.Now().Add(-time.Second))
+	for name, path := range map[string]string{"other stem": tampered, "expired": past, "bad signature": strings.Replace(url, "signature=", "signature=0", 1)} {
+		if rec := get(path, ""); rec.Code != http.StatusForbidden {
+			t.Errorf("%s = %d, want 403", name, rec.Code)
+		}
+	}
+
+	// Each read signs anew; unfinished jobs have nothing to download
+	var page JobList
+	json.NewDecoder(get("/api/jobs", key.Key).Body).Decode(&page)
+	for _, j := range page.Jobs {
+		if (j.Status == "completed") != (j.DownloadURLs["vocals"] != "") {
+			t.Errorf("listed job %s (%s) has download_urls %v", j.ID, j.Status, j.DownloadURLs)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Processor upgrades without failed jobs. POST /api/admin/processors/drain
+// marks an instance draining: it gets no new jobs, while the jobs it is
+// running finish there. Once it is idle the drain is awaiting_upgrade and
+// the instance can be stopped and upgraded; when a health check finds it
+// healthy and reporting a version other than the one it had (or the
+// version the drain expects), it is readmitted and takes jobs again. The
+// version is the processor's PROCESSOR_VERSION, or else its PROCESSOR_IMAGE.
+// A processor that reports no version is put back with
+// POST /api/admin/processors/readmit, which also ends a drain early. Each
+// step is logged, and drains and readmissions go to the audit log.
+
+// Drain statuses
+const (
+	drainDraining        = "draining"         // waiting for its jobs in flight
+	drainAwaitingUpgrade = "awaiting_upgrade" // idle, waiting for the new version
+	drainReadmitted      = "readmitted"
+)
+
+// ProcessorDrain is the upgrade of one processor instance
+type ProcessorDrain struct {
+	Status        string     `json:"status"`
+	FromVersion   string     `json:"from_version,omitempty"`   // reported when the drain started
+	TargetVersion string     `json:"target_version,omitempty"` // readmitted only at this version
+	ToVersion     string     `json:"to_version,omitempty"`     // reported when it was readmitted
+	Manual        bool       `json:"manual,omitempty"`         // readmitted by an admin
+	StartedAt     time.Time  `json:"started_at"`
+	IdleAt        *time.Time `json:"idle_at,omitempty"`
+	ReadmittedAt  *time.Time `json:"readmitted_at,omitempty"`
+}
+
+// drainRequest is the JSON body of POST /api/admin/processors/drain and
+// /readmit
+type drainRequest struct {
+	URL     string `json:"url"`
+	Version string `json:"version"` // drain: the version to wait for
+	Force   bool   `json:"force"`   // drain even if no other instance is healthy
+}
+
+// draining reports whether p is kept from new jobs. Callers hold
+// processorsMutex.
+func (p *processorInstance) draining() bool {
+	return p.Drain != nil && p.Drain.Status != drainReadmitted
+}
+
+// advanceDrain moves p's drain on: to awaiting_upgrade once no job is in
+// flight, and from there to readmitted once it is healthy at a new version.
+// Callers hold processorsMutex.
+func (p *processorInstance) advanceDrain(now time.Time) {
+	d := p.Drain
+	if d == nil || d.Status == drainReadmitted {
+		return
+	}
+	if d.Status == drainDraining && p.Active == 0 {
+		d.Status, d.IdleAt = drainAwaitingUpgrade, &now
+		log.Printf("Processor %s finished its jobs and can be upgraded", p.URL)
+	}
+	version := p.report().Version
+	if d.Status != drainAwaitingUpgrade || !p.Healthy || version == "" || version == d.FromVersion {
+		return
+	}
+	if d.TargetVersion != "" && version != d.TargetVersion {
+		return
+	}
+	d.Status, d.ToVersion, d.ReadmittedAt = drainReadmitted, version, &now
+	log.Printf("Processor %s is back at version %s and takes jobs again", p.URL, version)
+	recordAudit("processor.readmit", "", map[string]string{"url": p.URL, "from_version": d.FromVersion, "to_version": version})
+}
+
+// listedProcessor is p as GET /api/admin/processors shows it. Callers hold
+// processorsMutex.
+func listedProcessor(p *processorInstance) processorInstance {
+	// What dispatch goes by, declared or reported
+	listed := *p
+	listed.Device, listed.Capabilities, listed.Exclude = p.device(), p.capabilities(), p.excluded()
+	listed.Version = p.report().Version
+	if p.Drain != nil {
+		d := *p.Drain
+		listed.Drain = &d
+	}
+	return listed
+}
+
+// decodeDrainRequest reads a drain or readmit body, writing a 400 when it
+// names no processor
+func decodeDrainRequest(w http.ResponseWriter, r *http.Request) (drainRequest, bool) {
+	var req drainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == "" {
+		http.Error(w, "Invalid request body: url is required", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// lookupProcessor returns the registered instance at url, writing a 404
+// when there is none. Callers hold processorsMutex.
+func lookupProcessor(w http.ResponseWriter, url string) (*processorInstance, bool) {
+	for _, p := range processors {
+		if p.URL == url {
+			return p, true
+		}
+	}
+	http.Error(w, "Processor not registered in PROCESSORS", http.StatusNotFound)
+	return nil, false
+}
+
+// drainProcessorHandler serves POST /api/admin/processors/drain
+func drainProcessorHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeDrainRequest(w, r)
+	if !ok {
+		return
+	}
+	processorsMutex.Lock()
+	p, ok := lookupProcessor(w, req.URL)
+	if !ok {
+		processorsMutex.Unlock()
+		return
+	}
+	if p.draining() {
+		processorsMutex.Unlock()
+		http.Error(w, "Processor is already "+p.Drain.Status, http.StatusConflict)
+		return
+	}
+	others := 0
+	for _, other := range processors {
+		if other != p && other.Healthy && !other.draining() {
+			others++
+		}
+	}
+	if others == 0 && !req.Force {
+		processorsMutex.Unlock()
+		http.Error(w, "No other healthy processor would take new jobs (force to drain anyway)", http.StatusConflict)
+		return
+	}
+	p.Drain = &ProcessorDrain{
+		Status:        drainDraining,
+		FromVersion:   p.report().Version,
+		TargetVersion: req.Version,
+		StartedAt:     time.Now().UTC(),
+	}
+	log.Printf("Draining processor %s (%d jobs in flight)", p.URL, p.Active)
+	recordAudit("processor.drain", "", map[string]string{"url": p.URL, "from_version": p.Drain.FromVersion, "target_version": req.Version})
+	p.advanceDrain(p.Drain.StartedAt)
+	listed := listedProcessor(p)
+	processorsMutex.Unlock()
+	writeJSON(w, http.StatusAccepted, listed)
+}
+
+// readmitProcessorHandler serves POST /api/admin/processors/readmit
+func readmitProcessorHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeDrainRequest(w, r)
+	if !ok {
+		return
+	}
+	processorsMutex.Lock()
+	p, ok := lookupProcessor(w, req.URL)
+	if !ok {
+		processorsMutex.Unlock()
+		return
+	}
+	if !p.draining() {
+		processorsMutex.Unlock()
+		http.Error(w, "Processor isn't draining", http.StatusConflict)
+		return
+	}
+	now := time.Now().UTC()
+	d := p.Drain
+	d.Status, d.Manual, d.ToVersion, d.ReadmittedAt = drainReadmitted, true, p.report().Version, &now
+	log.Printf("Processor %s readmitted by an admin", p.URL)
+	recordAudit("processor.readmit", "", map[string]string{"url": p.URL, "from_version": d.FromVersion, "to_version": d.ToVersion, "manual": "true"})
+	listed := listedProcessor(p)
+	processorsMutex.Unlock()
+	writeJSON(w, http.StatusOK, listed)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProcessorDrainAndReadmit(t *testing.T) {
+	var version atomic.Value
+	version.Store("1.0")
+	upgraded := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "version": version.Load().(string)})
+	}))
+	defer upgraded.Close()
+	other := newMockProcessor(t)
+	t.Setenv("PROCESSORS", upgraded.URL+", "+other.URL)
+	useProcessors(t, nil)
+	if err := loadProcessors(); err != nil {
+		t.Fatal(err)
+	}
+	checkProcessors()
+	list := registeredProcessors()
+	first, second := list[0], list[1]
+
+	post := func(path, body string) (int, processorInstance) {
+		rec := httptest.NewRecorder()
+		handler := drainProcessorHandler
+		if strings.HasSuffix(path, "readmit") {
+			handler = readmitProcessorHandler
+		}
+		handler(rec, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		var p processorInstance
+		json.Unmarshal(rec.Body.Bytes(), &p)
+		return rec.Code, p
+	}
+
+	// A job is in flight on the instance being upgraded
+	if p := acquireProcessor(processorNeeds{Model: "htdemucs"}, nil); p != first {
+		t.Fatalf("job went to %v", p)
+	}
+	code, p := post("/api/admin/processors/drain", `{"url": "`+first.URL+`"}`)
+	if code != http.StatusAccepted || p.Drain == nil || p.Drain.Status != drainDraining || p.Drain.FromVersion != "1.0" || p.Version != "1.0" {
+		t.Fatalf("drain = %d %+v", code, p.Drain)
+	}
+	if p := acquireProcessor(processorNeeds{Model: "htdemucs"}, nil); p != second {
+		t.Errorf("new job went to %v, not the other instance", p)
+	}
+	if code, _ := post("/api/admin/processors/drain", `{"url": "`+second.URL+`"}`); code != http.StatusConflict {
+		t.Errorf("draining the last instance = %d", code)
+	}
+	if code, _ := post("/api/admin/processors/drain", `{"url": "http://elsewhere"}`); code != http.StatusNotFound {
+		t.Errorf("unknown instance = %d", code)
+	}
+
+	releaseProcessor(first, "")
+	processorsMutex.Lock()
+	drain := *first.Drain
+	processorsMutex.Unlock()
+	if drain.Status != drainAwaitingUpgrade || drain.IdleAt == nil {
+		t.Fatalf("after the last job = %+v", drain)
+	}
+	checkProcessors()
+	if p := acquireProcessor(processorNeeds{Model: "htdemucs"}, nil); p != second {
+		t.Errorf("job went to %v before the upgrade", p)
+	}
+
+	version.Store("1.1")
+	checkProcessors()
+	rec := httptest.NewRecorder()
+	listProcessorsHandler(rec, httptest.NewRequest("GET", "/api/admin/processors", nil))
+	var listed []processorInstance
+	json.Unmarshal(rec.Body.Bytes(), &listed)
+	if d := listed[0].Drain; d == nil || d.Status != drainReadmitted || d.ToVersion != "1.1" || d.Manual {
+		t.Fatalf("after the upgrade = %s", rec.Body.String())
+	}
+	if p := acquireProcessor(processorNeeds{Model: "htdemucs"}, nil); p != first {
+		t.Errorf("job went to %v, not the readmitted instance", p)
+	}
+
+	// A drain waiting for a version that never comes is ended by hand
+	releaseProcessor(first, "")
+	if code, p := post("/api/admin/processors/drain", `{"url": "`+first.URL+`", "version": "2.0"}`); code != http.StatusAccepted || p.Drain.Status != drainAwaitingUpgrade {
+		t.Fatalf("second drain = %d %+v", code, p.Drain)
+	}
+	version.Store("1.2")
+	checkProcessors()
+	if p := acquireProcessor(processorNeeds{Model: "htdemucs"}, nil); p != second {
+		t.Errorf("job went to %v at the wrong version", p)
+	}
+	if code, p := post("/api/admin/processors/readmit", `{"url": "`+first.URL+`"}`); code != http.StatusOK || !p.Drain.Manual || p.Drain.ToVersion != "1.2" {
+		t.Errorf("readmit = %d %+v", code, p.Drain)
+	}
+	if code, _ := post("/api/admin/processors/readmit", `{"url": "`+first.URL+`"}`); code != http.StatusConflict {
+		t.Errorf("readmitting twice = %d", code)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Share links hand out an unguessable token for one completed job. The token
+// opens a small embeddable player at /embed/{token} with stem previews, and
+// /api/oembed describes it so forums and editors that speak oEmbed can turn a
+// pasted link into the player.
+
+// ShareLink is a share token for one job
+type ShareLink struct {
+	Token     string    `json:"token"`
+	JobID     string    `json:"job_id"`
+	CreatedAt time.Time `json:"created_at"`
+	EmbedURL  string    `json:"embed_url"`
+}
+
+var (
+	shareLinks      = make(map[string]*ShareLink)
+	shareLinksMutex = &sync.Mutex{}
+)
+
+const (
+	embedWidth     = 480
+	embedRowHeight = 56
+)
+
+// publicBaseURL is the origin used in absolute links (PUBLIC_BASE_URL),
+// falling back to the request's own host
+func publicBaseURL(r *http.Request) string {
+	if base := os.Getenv("PUBLIC_BASE_URL"); base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// sharedJob resolves a share token to its job; tokens of deleted jobs are
+// dropped on the way
+func sharedJob(token string) (Job, bool) {
+	shareLinksMutex.Lock()
+	link, ok := shareLinks[token]
+	shareLinksMutex.Unlock()
+	if !ok {
+		return Job{}, false
+	}
+	jobsMutex.RLock()
+	job, exists := jobs[link.JobID]
+	var snapshot Job
+	if exists {
+		snapshot = job.snapshot()
+	}
+	jobsMutex.RUnlock()
+	if !exists {
+		shareLinksMutex.Lock()
+		delete(shareLinks, token)
+		shareLinksMutex.Unlock()
+		return Job{}, false
+	}
+	return snapshot, snapshot.Status == "completed"
+}
+
+// jobTitle is the display title of a job: "Artist – Title" when tagged
+func jobTitle(job Job) string {
+	if m := job.Metadata; m != nil && m.Title != "" {
+		if m.Artist != "" {
+			return m.Artist + " – " + m.Title
+		}
+		return m.Title
+	}
+	return strings.TrimSuffix(job.FileName, filepath.Ext(job.FileName))
+}
+
+func createShareHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupCompletedJob(w, r)
+	if !ok || refuseEncrypted(w, job) {
+		return
+	}
+	link := &ShareLink{Token: randomToken(16), JobID: job.ID, CreatedAt: time.Now().UTC()}
+	link.EmbedURL = publicBaseURL(r) + "/embed/" + link.Token
+	shareLinksMutex.Lock()
+	shareLinks[link.Token] = link
+	shareLinksMutex.Unlock()
+	writeJSON(w, http.StatusCreated, link)
+}
+
+func listSharesHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+	shareLinksMutex.Lock()
+	list := []ShareLink{}
+	for _, link := range shareLinks {
+		if link.JobID == jobID {
+			list = append(list, *link)
+		}
+	}
+	shareLinksMutex.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+func deleteShareHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	shareLinksMutex.Lock()
+	link, ok := shareLinks[vars["token"]]
+	if ok && link.JobID == vars["id"] {
+		delete(shareLinks, link.Token)
+	}
+	shareLinksMutex.Unlock()
+	if !ok || link.JobID != vars["id"] {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var embedPage = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<link rel="alternate" type="application/json+oembed" href="{{.OEmbed}}" title="{{.Title}}">
+<style>body{margin:0;padding:8px 12px;font:14px system-ui,sans-serif;background:#111;color:#eee}
+h1{font-size:15px;margin:0 0 6px;white-space:nowrap;overflow:hidden;text-overflow:ellipsis}
+div{display:flex;align-items:center;gap:8px;height:{{.Row}}px}span{width:90px;text-transform:capitalize}audio{flex:1;height:36px}</style>
+</head><body><h1>{{.Title}}</h1>
+{{range .Stems}}<div><span>{{.}}</span><audio controls preload="none" src="{{$.Base}}/preview/{{.}}"></audio></div>
+{{end}}</body></html>
+`))
+
+// embedHandler serves the player page for a share token
+func embedHandler(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	job, ok := sharedJob(token)
+	if !ok {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	embedURL := publicBaseURL(r) + "/embed/" + token
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// Meant to be framed anywhere, but it loads nothing but its own previews
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; media-src 'self'; style-src 'unsafe-inline'")
+	embedPage.Execute(w, map[string]interface{}{
+		"Title":  jobTitle(job),
+		"Base":   "/embed/" + token,
+		"OEmbed": publicBaseURL(r) + "/api/oembed?format=json&url=" + url.QueryEscape(embedURL),
+		"Row":    embedRowHeight,
+		"Stems":  sortedKeys(job.OutputFiles),
+	})
+}
+
+func embedPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	job, ok := sharedJob(vars["token"])
+	if !ok {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	streamPreview(w, r, job, vars["stem"])
+}
+
+// oembedHandler answers GET /api/oembed?url=<embed URL>&maxwidth=&maxheight=
+// with a "rich" oEmbed response wrapping the player in an iframe
+func oembedHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if format := q.Get("format"); format != "" && format != "json" {
+		http.Error(w, "Only json format is supported", http.StatusNotImplemented)
+		return
+	}
+	u, err := url.Parse(q.Get("url"))
+	if err != nil {
+		http.Error(w, "Invalid url value", http.StatusBadRequest)
+		return
+	}
+	_, token, found := strings.Cut(u.Path, "/embed/")
+	if !found || token == "" || strings.Contains(token, "/") {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	job, ok := sharedJob(token)
+	if !ok {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+
+	width := embedWidth
+	height := 40 + embedRowHeight*len(job.OutputFiles)
+	if n, err := strconv.Atoi(q.Get("maxwidth")); err == nil && n > 0 && n < width {
+		width = n
+	}
+	if n, err := strconv.Atoi(q.Get("maxheight")); err == nil && n > 0 && n < height {
+		height = n
+	}
+	src := publicBaseURL(r) + "/embed/" + token
+	html := `<iframe src="` + template.HTMLEscapeString(src) + `" width="` + strconv.Itoa(width) +
+		`" height="` + strconv.Itoa(height) + `" frameborder="0" allow="autoplay" loading="lazy"></iframe>`
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version":       "1.0",
+		"type":          "rich",
+		"provider_name": "Track2stem",
+		"provider_url":  publicBaseURL(r),
+		"title":         jobTitle(job),
+		"html":          html,
+		"width":         width,
+		"height":        height,
+	})
+}
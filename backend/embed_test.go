@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestShareEmbedAndOEmbed(t *testing.T) {
+	t.Setenv("PUBLIC_BASE_URL", "https://stems.example.com/")
+	jobsMutex.Lock()
+	jobs["embed-job"] = &Job{ID: "embed-job", Status: "completed", FileName: "song.mp3",
+		Metadata:    &TrackMetadata{Artist: "Artist", Title: "<Title>"},
+		OutputFiles: map[string]string{"vocals": "v.mp3", "instrumental": "i.mp3"}}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, "embed-job")
+		jobsMutex.Unlock()
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/jobs/{id}/shares", createShareHandler).Methods("POST")
+	router.HandleFunc("/api/jobs/{id}/shares/{token}", deleteShareHandler).Methods("DELETE")
+	router.HandleFunc("/api/oembed", oembedHandler).Methods("GET")
+	router.HandleFunc("/embed/{token}", embedHandler).Methods("GET")
+	do := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	rec := do("POST", "/api/jobs/embed-job/shares")
+	var link ShareLink
+	json.Unmarshal(rec.Body.Bytes(), &link)
+	if rec.Code != http.StatusCreated || link.EmbedURL != "https://stems.example.com/embed/"+link.Token {
+		t.Fatalf("create share = %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = do("GET", "/embed/"+link.Token)
+	page := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(page, "/embed/"+link.Token+"/preview/vocals") || strings.Contains(page, "<Title>") {
+		t.Errorf("embed page = %d %s", rec.Code, page)
+	}
+
+	rec = do("GET", "/api/oembed?maxwidth=300&url="+url.QueryEscape(link.EmbedURL))
+	var oembed map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &oembed)
+	if rec.Code != http.StatusOK || oembed["type"] != "rich" || oembed["width"] != 300.0 || oembed["title"] != "Artist – <Title>" {
+		t.Errorf("oembed = %d %s", rec.Code, rec.Body.String())
+	}
+	if html, _ := oembed["html"].(string); !strings.Contains(html, `src="`+link.EmbedURL+`"`) {
+		t.Errorf("oembed html = %q", html)
+	}
+	if rec := do("GET", "/api/oembed?format=xml&url="+url.QueryEscape(link.EmbedURL)); rec.Code != http.StatusNotImplemented {
+		t.Errorf("xml format = %d", rec.Code)
+	}
+
+	if rec := do("DELETE", "/api/jobs/embed-job/shares/"+link.Token); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete share = %d", rec.Code)
+	}
+	if rec := do("GET", "/embed/"+link.Token); rec.Code != http.StatusNotFound {
+		t.Errorf("revoked embed = %d", rec.Code)
+	}
+}
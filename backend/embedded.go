@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Embedded mode. Binaries built with -tags embedded (make embedded) run
+// without Docker or the Python processor: unless PROCESSOR_URL or
+// PROCESSORS is set, they start the lightweight engine from separate.go
+// behind an in-process copy of the processor API on a loopback port and
+// send every job there. Uploads and stems default to the user's data
+// directory ($XDG_DATA_HOME/track2stem, usually ~/.local/share). The
+// engine has no model to download and any model option gives the same
+// four stems; 16-bit WAV is read natively, other formats and mp3/flac
+// output need ffmpeg on the PATH (without it stems are written as WAV).
+// `track2stem serve` runs such a binary.
+
+const embeddedSampleRate = 44100 // inputs ffmpeg decodes are resampled to this
+
+// embeddedProcessor serves /process, /status/{id}, /cancel/{id} and
+// /health like the processor service, separating with separateDSP
+type embeddedProcessor struct {
+	mu      sync.Mutex
+	status  map[string]jobProgress
+	cancels map[string]context.CancelFunc
+}
+
+func newEmbeddedProcessor() *embeddedProcessor {
+	return &embeddedProcessor{status: make(map[string]jobProgress), cancels: make(map[string]context.CancelFunc)}
+}
+
+func (e *embeddedProcessor) routes() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/process", e.process).Methods("POST")
+	router.HandleFunc("/status/{id}", e.getStatus).Methods("GET")
+	router.HandleFunc("/cancel/{id}", e.cancel).Methods("POST")
+	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "healthy", "engine": "embedded"})
+	}).Methods("GET")
+	return router
+}
+
+func (e *embeddedProcessor) setStatus(jobID string, p jobProgress) {
+	e.mu.Lock()
+	e.status[jobID] = p
+	e.mu.Unlock()
+}
+
+func (e *embeddedProcessor) process(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "No file provided"})
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "No file provided"})
+		return
+	}
+	defer file.Close()
+	jobID, stemMode, isolate := r.FormValue("job_id"), r.FormValue("stem_mode"), r.FormValue("isolate_stem")
+	if !isValidJobID(jobID) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid job_id"})
+		return
+	}
+	if stemMode == "isolate" && !slices.Contains(dspStems, isolate) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("The embedded engine can't isolate %s; it separates %s", isolate, strings.Join(dspStems, ", "))})
+		return
+	}
+	format := r.FormValue("output_format")
+	if !allowedOutputFormats[format] {
+		format = "wav"
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	e.mu.Lock()
+	e.cancels[jobID] = cancel
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		delete(e.cancels, jobID)
+		e.mu.Unlock()
+	}()
+	e.setStatus(jobID, jobProgress{Status: "processing", Progress: 5, Stage: "Decoding audio"})
+
+	fail := func(code int, msg string) {
+		e.setStatus(jobID, jobProgress{Status: "failed", Stage: msg, Error: msg})
+		writeJSON(w, code, map[string]string{"error": msg})
+	}
+	input, err := os.CreateTemp("", "track2stem-*"+filepath.Ext(header.Filename))
+	if err != nil {
+		fail(http.StatusInternalServerError, "Failed to save upload")
+		return
+	}
+	defer os.Remove(input.Name())
+	_, err = input.ReadFrom(file)
+	input.Close()
+	if err != nil {
+		fail(http.StatusInternalServerError, "Failed to save upload")
+		return
+	}
+	pcm, rate, err := decodeEmbeddedInput(input.Name())
+	if err != nil {
+		fail(http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	name := strings.TrimSuffix(header.Filename[strings.Index(header.Filename, "_")+1:], filepath.Ext(header.Filename))
+	dir := filepath.Join(outputDir, jobID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fail(http.StatusInternalServerError, "Failed to create output directory")
+		return
+	}
+	outputs, err := e.separate(ctx, jobID, pcm, rate, dir, name, stemMode, isolate)
+	if err != nil {
+		os.RemoveAll(dir)
+		if ctx.Err() != nil {
+			e.setStatus(jobID, jobProgress{Status: "cancelled", Stage: "Cancelled by user"})
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Cancelled"})
+			return
+		}
+		fail(http.StatusInternalServerError, "Separation failed: "+err.Error())
+		return
+	}
+
+	if format != "wav" {
+		e.setStatus(jobID, jobProgress{Status: "processing", Progress: 95, Stage: "Encoding " + format})
+		if _, err := exec.LookPath("ffmpeg"); err != nil {
+			log.Printf("Embedded engine: ffmpeg not found, writing %s stems as wav", jobID)
+			format = "wav"
+		}
+		for stem, path := range outputs {
+			if format == "wav" {
+				break
+			}
+			dst := withExtension(path, "."+format)
+			if err := encodeStem(path, dst, format, r.FormValue("mp3_bitrate")); err != nil {
+				fail(http.StatusInternalServerError, "Failed to encode "+stem+": "+err.Error())
+				return
+			}
+			os.Remove(path)
+			outputs[stem] = dst
+		}
+	}
+
+	elapsed := time.Since(start)
+	e.setStatus(jobID, jobProgress{Status: "completed", Progress: 100, Stage: "Done!", Elapsed: formatElapsed(elapsed)})
+	hostname, _ := os.Hostname()
+	result := map[string]interface{}{
+		"outputs":         outputs,
+		"format":          format,
+		"processing_time": formatElapsed(elapsed),
+		"environment":     ProcessingEnv{Instance: hostname, Image: "track2stem embedded", Device: "cpu"},
+	}
+	// The masks involve no randomness, so every run is reproducible
+	if r.FormValue("deterministic") == "true" {
+		seed, _ := strconv.ParseUint(r.FormValue("seed"), 10, 32)
+		result["determinism"] = Determinism{Seed: uint32(seed)}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// separate writes the requested stems of pcm as WAV files in dir and
+// returns their paths by stem
+func (e *embeddedProcessor) separate(ctx context.Context, jobID string, pcm []int16, rate int, dir, name, stemMode, isolate string) (map[string]string, error) {
+	outputs := make(map[string]string)
+	writers := make(map[string]*wavWriter)
+	closeAll := func() error {
+		var first error
+		for _, w := range writers {
+			if err := w.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	}
+	stems := dspStems
+	backing := ""
+	if stemMode == "isolate" {
+		backing = "backing"
+		if isolate == "vocals" {
+			backing = "instrumental"
+		}
+		stems = []string{isolate, backing}
+	}
+	for _, stem := range stems {
+		path := filepath.Join(dir, name+"_t2s_"+stem+".wav")
+		w, err := createWAV(path, rate, 2)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		writers[stem] = w
+		outputs[stem] = path
+	}
+
+	e.setStatus(jobID, jobProgress{Status: "processing", Progress: 10, Stage: "Separating"})
+	err := separateDSP(ctx, pcm, rate, func(offset int, block [4][2][]float64) {
+		for s, stem := range dspStems {
+			w := writers[stem]
+			if w == nil {
+				continue
+			}
+			var b *wavWriter
+			if backing != "" {
+				b = writers[backing] // everything else: the mix minus this stem
+			}
+			for i := range block[s][0] {
+				for ch := range 2 {
+					w.WriteSample(block[s][ch][i])
+					if b != nil {
+						b.WriteSample(float64(pcm[2*(offset+i)+ch])/32768 - block[s][ch][i])
+					}
+				}
+			}
+		}
+	}, func(done float64) {
+		e.setStatus(jobID, jobProgress{Status: "processing", Progress: 10 + 85*done, Stage: "Separating"})
+	})
+	if cerr := closeAll(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return outputs, nil
+}
+
+func (e *embeddedProcessor) getStatus(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	p, ok := e.status[mux.Vars(r)["id"]]
+	e.mu.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "unknown", "progress": 0})
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (e *embeddedProcessor) cancel(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+	e.mu.Lock()
+	cancel, ok := e.cancels[jobID]
+	e.mu.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"status": "not_found", "job_id": jobID})
+		return
+	}
+	cancel()
+	writeJSON(w, http.StatusOK, map[string]string{"status": "cancelled", "job_id": jobID})
+}
+
+// decodeEmbeddedInput reads an upload as interleaved stereo samples: 16-bit
+// WAV natively at its own rate, anything else through ffmpeg
+func decodeEmbeddedInput(path string) ([]int16, int, error) {
+	samples, rate, channels, err := readWAV(path)
+	if err == nil && (channels == 1 || channels == 2) {
+		if channels == 1 {
+			stereo := make([]int16, 2*len(samples))
+			for i, s := range samples {
+				stereo[2*i], stereo[2*i+1] = s, s
+			}
+			samples = stereo
+		}
+		return samples, rate, nil
+	}
+	if _, lookErr := exec.LookPath("ffmpeg"); lookErr != nil {
+		return nil, 0, errors.New("Without ffmpeg the embedded engine only reads 16-bit mono or stereo WAV files")
+	}
+	samples, err = decodeStereoPCM(path, embeddedSampleRate)
+	return samples, embeddedSampleRate, err
+}
+
+// formatElapsed formats a duration like the processor does, "Xm Ys" or "Ys"
+func formatElapsed(d time.Duration) string {
+	secs := int(d.Seconds())
+	if secs >= 60 {
+		return fmt.Sprintf("%dm %ds", secs/60, secs%60)
+	}
+	return fmt.Sprintf("%ds", secs)
+}
+
+// startEmbeddedProcessor serves an embeddedProcessor on a loopback port
+// and returns its URL
+func startEmbeddedProcessor() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		if err := http.Serve(l, newEmbeddedProcessor().routes()); err != nil {
+			log.Printf("Embedded engine stopped: %v", err)
+		}
+	}()
+	return "http://" + l.Addr().String(), nil
+}
+
+// configureEmbedded applies the embedded build's defaults before the rest
+// of main reads its environment
+func configureEmbedded() error {
+	dataDir := os.Getenv("XDG_DATA_HOME")
+	if dataDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		dataDir = filepath.Join(home, ".local", "share")
+	}
+	for key, sub := range map[string]string{"UPLOAD_DIR": "uploads", "OUTPUT_DIR": "outputs"} {
+		dir := os.Getenv(key)
+		if dir == "" {
+			dir = filepath.Join(dataDir, "track2stem", sub)
+			os.Setenv(key, dir)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	if os.Getenv("PROCESSOR_URL") != "" || os.Getenv("PROCESSORS") != "" {
+		return nil
+	}
+	url, err := startEmbeddedProcessor()
+	if err != nil {
+		return fmt.Errorf("embedded engine: %v", err)
+	}
+	os.Setenv("PROCESSOR_URL", url)
+	log.Printf("Separating in-process with the embedded engine (casual quality); set PROCESSOR_URL to use Demucs")
+	return nil
+}
@@ -0,0 +1,6 @@
+//go:build !embedded
+
+package main
+
+// embeddedBuild is false in regular builds, which need a processor service
+const embeddedBuild = false
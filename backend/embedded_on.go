@@ -0,0 +1,7 @@
+//go:build embedded
+
+package main
+
+// embeddedBuild runs stem separation in-process when no processor is
+// configured, in binaries built with -tags embedded
+const embeddedBuild = true
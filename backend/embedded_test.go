@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// postWAV uploads a synthetic mix to url as a WAV file with the given fields
+func postWAV(t *testing.T, url, name string, fields map[string]string) *http.Response {
+	t.Helper()
+	wav := filepath.Join(t.TempDir(), name)
+	if err := writeWAVFile(wav, synthMix(22050, true, true), 22050, 2); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(wav)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", name)
+	part.Write(data)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	mw.Close()
+	resp, err := http.Post(url, mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestEmbeddedProcessor(t *testing.T) {
+	oldOutputDir := outputDir
+	outputDir = t.TempDir()
+	t.Cleanup(func() { outputDir = oldOutputDir })
+	server := httptest.NewServer(newEmbeddedProcessor().routes())
+	defer server.Close()
+
+	resp := postWAV(t, server.URL+"/process", "job-1_song.wav", map[string]string{"job_id": "job-1", "stem_mode": "isolate", "isolate_stem": "vocals", "output_format": "wav"})
+	var result struct {
+		Outputs     map[string]string `json:"outputs"`
+		Format      string            `json:"format"`
+		Environment ProcessingEnv     `json:"environment"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(result.Outputs) != 2 || result.Format != "wav" || result.Environment.Device != "cpu" {
+		t.Fatalf("/process = %d %+v", resp.StatusCode, result)
+	}
+	if want := filepath.Join(outputDir, "job-1", "song_t2s_instrumental.wav"); result.Outputs["instrumental"] != want {
+		t.Errorf("instrumental = %s, want %s", result.Outputs["instrumental"], want)
+	}
+	// The isolated stem and its backing track add back up to the mix
+	vocals, rate, channels, err := readWAV(result.Outputs["vocals"])
+	instrumental, _, _, _ := readWAV(result.Outputs["instrumental"])
+	mix := synthMix(22050, true, true)
+	if err != nil || rate != 22050 || channels != 2 || len(vocals) != len(mix) || len(instrumental) != len(mix) {
+		t.Fatalf("vocals = %d samples at %d Hz, %d channels (%v)", len(vocals), rate, channels, err)
+	}
+	for i := range mix {
+		if d := int(vocals[i]) + int(instrumental[i]) - int(mix[i]); d < -2 || d > 2 {
+			t.Fatalf("sample %d: %d + %d != %d", i, vocals[i], instrumental[i], mix[i])
+		}
+	}
+
+	if resp, err := http.Get(server.URL + "/status/job-1"); err == nil {
+		var p jobProgress
+		json.NewDecoder(resp.Body).Decode(&p)
+		resp.Body.Close()
+		if p.Status != "completed" || p.Progress != 100 {
+			t.Errorf("status = %+v", p)
+		}
+	}
+
+	resp = postWAV(t, server.URL+"/process", "job-2_song.wav", map[string]string{"job_id": "job-2", "stem_mode": "isolate", "isolate_stem": "guitar"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("isolating guitar = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestEmbeddedProcessorEndToEnd(t *testing.T) {
+	b := newIntegrationBackend(t, 1)
+	server := httptest.NewServer(newEmbeddedProcessor().routes())
+	defer server.Close()
+	t.Setenv("PROCESSOR_URL", server.URL)
+
+	resp := postWAV(t, b.URL+"/api/upload", "song.wav", map[string]string{"output_format": "wav"})
+	var job Job
+	json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload = %d", resp.StatusCode)
+	}
+	done := b.waitFor(job.ID, "completed")
+	if len(done.OutputFiles) != 4 || done.Environment == nil || done.Environment.Image != "track2stem embedded" {
+		t.Fatalf("completed job = %+v", done)
+	}
+	if code, data := b.get("/api/download/" + job.ID + "/bass"); code != http.StatusOK || string(data[:4]) != "RIFF" {
+		t.Errorf("download = %d, %d bytes", code, len(data))
+	}
+}
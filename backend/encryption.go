@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// End-to-end encrypted jobs, for clients whose audio the backend mustn't be
+// able to read. The processors share an X25519 key pair: the private key is
+// their PROCESSOR_SEALING_KEY and the public key is the backend's
+// E2E_PUBLIC_KEY, which GET /api/encryption-key serves. A client
+//
+//  1. picks a random 32-byte job key and uploads the audio encrypted with
+//     it: a 12-byte nonce followed by the AES-256-GCM ciphertext and tag;
+//  2. seals the job key to the public key: an ephemeral X25519 public key,
+//     then a 12-byte nonce and the job key encrypted with AES-256-GCM under
+//     HKDF-SHA256(shared secret, salt ephemeral||public key, info
+//     "track2stem job key"), all base64 encoded;
+//  3. uploads with encrypted=true and sealed_key=<sealed key>.
+//
+// The backend stores the ciphertext as uploaded and hands the sealed key to
+// the processor (or leasing worker) only when it dispatches the job. The
+// processor opens it, separates the audio in a private directory and writes
+// each stem back encrypted with the job key the same way, so the upload and
+// output volumes only ever hold ciphertext. Jobs go only to processors with
+// the encrypted capability, which those with a sealing key report. Nothing
+// on the backend reads the audio: the virus scan, policy hook and duration
+// limits see ciphertext, metadata isn't probed, uploads are never
+// deduplicated, and extra formats, pipelines, batching, waveforms,
+// chapters, comparisons, mixes, share links and the gallery are refused.
+
+const (
+	sealedKeySize    = 32 + 12 + 32 + 16 // ephemeral key, nonce, job key, tag
+	sealingAlgorithm = "X25519-HKDF-SHA256-AES-256-GCM"
+)
+
+// encryptedJobMessage is the answer for features that need readable stems
+const encryptedJobMessage = "Job is end-to-end encrypted: its stems can only be read by the client"
+
+// e2ePublicKey returns the key clients seal job keys to, nil when
+// encrypted jobs aren't enabled
+func e2ePublicKey() (*ecdh.PublicKey, error) {
+	raw := os.Getenv("E2E_PUBLIC_KEY")
+	if raw == "" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("E2E_PUBLIC_KEY must be base64")
+	}
+	key, err := ecdh.X25519().NewPublicKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("E2E_PUBLIC_KEY: %v", err)
+	}
+	return key, nil
+}
+
+// checkSealedKey validates the options of an encrypted upload
+func checkSealedKey(opts jobOptions) error {
+	if key, _ := e2ePublicKey(); key == nil {
+		return fmt.Errorf("Encrypted jobs aren't enabled on this server")
+	}
+	if opts.SealedKey == "" {
+		return fmt.Errorf("sealed_key is required with encrypted=true")
+	}
+	if b, err := base64.StdEncoding.DecodeString(opts.SealedKey); err != nil || len(b) != sealedKeySize {
+		return fmt.Errorf("Invalid sealed_key value (%d base64-encoded bytes)", sealedKeySize)
+	}
+	if len(opts.ExtraFormats) > 0 || len(opts.Pipeline) > 0 {
+		return fmt.Errorf("Encrypted jobs can't use extra_formats or a pipeline: the backend can't read their stems")
+	}
+	return nil
+}
+
+// refuseEncrypted answers a 409 for an encrypted job and reports whether it did
+func refuseEncrypted(w http.ResponseWriter, job Job) bool {
+	if !job.Encrypted {
+		return false
+	}
+	http.Error(w, encryptedJobMessage, http.StatusConflict)
+	return true
+}
+
+// encryptionKeyHandler serves GET /api/encryption-key
+func encryptionKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, _ := e2ePublicKey()
+	if key == nil {
+		http.Error(w, "Encrypted jobs aren't enabled on this server", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"algorithm":  sealingAlgorithm,
+		"public_key": base64.StdEncoding.EncodeToString(key.Bytes()),
+	})
+}
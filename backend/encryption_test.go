@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// sealJobKey seals a job key to the processors' public key the way clients do
+func sealJobKey(t *testing.T, public *ecdh.PublicKey, jobKey []byte) string {
+	t.Helper()
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := ephemeral.ECDH(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := append(ephemeral.PublicKey().Bytes(), public.Bytes()...)
+	wrapping, err := hkdf.Key(sha256.New, shared, salt, "track2stem job key", 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := aes.NewCipher(wrapping)
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	sealed := append(ephemeral.PublicKey().Bytes(), nonce...)
+	return base64.StdEncoding.EncodeToString(gcm.Seal(sealed, nonce, jobKey, nil))
+}
+
+// useE2EKey enables encrypted jobs with a fresh key pair
+func useE2EKey(t *testing.T) *ecdh.PublicKey {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("E2E_PUBLIC_KEY", base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()))
+	return private.PublicKey()
+}
+
+func TestParseEncryptedOptions(t *testing.T) {
+	parse := func(fields map[string]string) (jobOptions, error) {
+		return parseJobOptions(func(key string) string { return fields[key] })
+	}
+	if _, err := parse(map[string]string{"encrypted": "true", "sealed_key": "x"}); err == nil || !strings.Contains(err.Error(), "aren't enabled") {
+		t.Errorf("without E2E_PUBLIC_KEY: %v", err)
+	}
+
+	public := useE2EKey(t)
+	sealed := sealJobKey(t, public, make([]byte, 32))
+	opts, err := parse(map[string]string{"encrypted": "true", "sealed_key": sealed})
+	if err != nil || !opts.Encrypted || opts.SealedKey != sealed || !opts.Force {
+		t.Fatalf("encrypted options = %+v, %v", opts, err)
+	}
+	for _, c := range []struct {
+		fields map[string]string
+		want   string
+	}{
+		{map[string]string{"encrypted": "true"}, "sealed_key is required"},
+		{map[string]string{"encrypted": "true", "sealed_key": "AAAA"}, "Invalid sealed_key"},
+		{map[string]string{"encrypted": "true", "sealed_key": sealed, "output_format": "wav", "extra_formats": "mp3"}, "can't use extra_formats"},
+		{map[string]string{"encrypted": "true", "sealed_key": sealed, "output_format": "wav", "pipeline": "transcode:mp3"}, "or a pipeline"},
+	} {
+		if _, err := parse(c.fields); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v = %v, want %q", c.fields, err, c.want)
+		}
+	}
+	if opts, _ := parse(map[string]string{"sealed_key": sealed}); opts.SealedKey != "" || opts.Ignored["sealed_key"] == "" {
+		t.Errorf("sealed_key without encrypted = %+v", opts)
+	}
+}
+
+func TestIntegrationEncryptedJob(t *testing.T) {
+	public := useE2EKey(t)
+	b := newIntegrationBackend(t, 1)
+
+	code, data := b.get("/api/encryption-key")
+	var key map[string]string
+	json.Unmarshal(data, &key)
+	if code != http.StatusOK || key["public_key"] != base64.StdEncoding.EncodeToString(public.Bytes()) || key["algorithm"] != sealingAlgorithm {
+		t.Fatalf("encryption key = %d %s", code, data)
+	}
+
+	sealed := sealJobKey(t, public, make([]byte, 32))
+	job := b.waitFor(b.upload("song.mp3", map[string]string{"encrypted": "true", "sealed_key": sealed}).ID, "completed")
+	if !job.Encrypted || job.Metadata != nil || job.Effective == nil || !job.Effective.Encrypted {
+		t.Errorf("encrypted job = %+v", job)
+	}
+	requests := b.processor.Requests()
+	if len(requests) != 1 || requests[0]["encrypted"] != "true" || requests[0]["sealed_key"] != sealed {
+		t.Errorf("processor request = %v", requests)
+	}
+	// The key is only handed to the processor
+	if _, data := b.get("/api/jobs/" + job.ID); strings.Contains(string(data), sealed) {
+		t.Error("job response includes the sealed key")
+	}
+
+	if code, _ := b.get("/api/jobs/" + job.ID + "/waveform/vocals"); code != http.StatusConflict {
+		t.Errorf("waveform of an encrypted job = %d", code)
+	}
+	if code, _ := b.get("/api/jobs/" + job.ID + "/chapters"); code != http.StatusConflict {
+		t.Errorf("chapters of an encrypted job = %d", code)
+	}
+	if code, _ := b.get("/api/jobs/" + job.ID + "/package?summary=true"); code != http.StatusConflict {
+		t.Errorf("package summary of an encrypted job = %d", code)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"strconv"
+)
+
+// Energy estimates, for institutions that report the footprint of their
+// processing. The processor reports how long Demucs ran and on which
+// device; with ENERGY_GPU_WATTS set (and ENERGY_CPU_WATTS for jobs run on
+// a CPU) each completed job gets an "energy" estimate: that time at the
+// device's configured draw, in watt-hours, and its CO2 equivalent at
+// ENERGY_CARBON_INTENSITY grams per kWh. A processor batch's time is split
+// among its clips by length. /api/admin/stats adds the estimates up. Jobs
+// reusing cached stems separated nothing and get none.
+
+// defaultCarbonIntensity is the world average grid intensity, grams of CO2
+// equivalent per kWh
+const defaultCarbonIntensity = 475
+
+// processorCompute is the "compute" a processor or worker reports
+type processorCompute struct {
+	Device  string  `json:"device"`
+	Seconds float64 `json:"seconds"` // Demucs running time
+}
+
+// EnergyEstimate is what a job's separation is estimated to have used
+type EnergyEstimate struct {
+	Device          string  `json:"device"`
+	ComputeSeconds  float64 `json:"compute_seconds"`
+	Watts           float64 `json:"watts"` // configured draw of the device
+	WattHours       float64 `json:"watt_hours"`
+	CO2Grams        float64 `json:"co2_grams"`
+	CarbonIntensity float64 `json:"carbon_intensity"` // grams CO2e per kWh
+}
+
+// energyStats is "energy" in /api/admin/stats
+type energyStats struct {
+	Jobs           int     `json:"jobs"` // with an estimate
+	ComputeSeconds float64 `json:"compute_seconds"`
+	WattHours      float64 `json:"watt_hours"`
+	CO2Grams       float64 `json:"co2_grams"`
+
+	ByDevice map[string]*energyStats `json:"by_device,omitempty"`
+}
+
+// add counts a job's estimate
+func (s *energyStats) add(e *EnergyEstimate) {
+	s.Jobs++
+	s.ComputeSeconds += e.ComputeSeconds
+	s.WattHours += e.WattHours
+	s.CO2Grams += e.CO2Grams
+}
+
+func (s *energyStats) round() {
+	s.ComputeSeconds, s.WattHours, s.CO2Grams = roundTo2(s.ComputeSeconds), roundTo2(s.WattHours), roundTo2(s.CO2Grams)
+}
+
+// energyWatts is the configured draw of a device, 0 when unset
+func energyWatts(device string) float64 {
+	name := "ENERGY_GPU_WATTS"
+	if device == "cpu" {
+		name = "ENERGY_CPU_WATTS"
+	}
+	if w, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil && w > 0 {
+		return w
+	}
+	return 0
+}
+
+func carbonIntensity() float64 {
+	if g, err := strconv.ParseFloat(os.Getenv("ENERGY_CARBON_INTENSITY"), 64); err == nil && g >= 0 {
+		return g
+	}
+	return defaultCarbonIntensity
+}
+
+// roundTo2 rounds to two decimals
+func roundTo2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+// estimateEnergy turns the compute a processor or worker reported into an
+// estimate, or returns nil when there is none or no draw is configured for
+// its device
+func estimateEnergy(v interface{}) *EnergyEstimate {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var c processorCompute
+	if json.Unmarshal(raw, &c) != nil || c.Seconds <= 0 {
+		return nil
+	}
+	if c.Device == "" {
+		c.Device = "cpu"
+	}
+	watts := energyWatts(c.Device)
+	if watts == 0 {
+		return nil
+	}
+	wh := watts * c.Seconds / 3600
+	intensity := carbonIntensity()
+	return &EnergyEstimate{
+		Device:          c.Device,
+		ComputeSeconds:  c.Seconds,
+		Watts:           watts,
+		WattHours:       roundTo2(wh),
+		CO2Grams:        roundTo2(wh / 1000 * intensity),
+		CarbonIntensity: intensity,
+	}
+}
+
+// splitCompute shares a batch's compute among its clips by their lengths,
+// evenly when a length isn't known
+func splitCompute(c *processorCompute, lengths []float64) []*processorCompute {
+	shares := make([]*processorCompute, len(lengths))
+	if c == nil {
+		return shares
+	}
+	total := 0.0
+	for _, l := range lengths {
+		if l <= 0 {
+			total = 0
+			break
+		}
+		total += l
+	}
+	for i, l := range lengths {
+		part := 1 / float64(len(lengths))
+		if total > 0 {
+			part = l / total
+		}
+		shares[i] = &processorCompute{Device: c.Device, Seconds: roundTo2(c.Seconds * part)}
+	}
+	return shares
+}
+
+// energySnapshot adds up the estimates of every job, overall and per
+// device. Callers hold jobsMutex.
+func energySnapshot() *energyStats {
+	total := &energyStats{ByDevice: map[string]*energyStats{}}
+	for _, job := range jobs {
+		e := job.Energy
+		if e == nil {
+			continue
+		}
+		device, ok := total.ByDevice[e.Device]
+		if !ok {
+			device = &energyStats{}
+			total.ByDevice[e.Device] = device
+		}
+		total.add(e)
+		device.add(e)
+	}
+	total.round()
+	for _, s := range total.ByDevice {
+		s.round()
+	}
+	return total
+}
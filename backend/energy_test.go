@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEstimateEnergy(t *testing.T) {
+	t.Setenv("ENERGY_GPU_WATTS", "300")
+	e := estimateEnergy(map[string]interface{}{"device": "cuda", "seconds": 120})
+	if e == nil || e.WattHours != 10 || e.CO2Grams != 4.75 || e.CarbonIntensity != defaultCarbonIntensity {
+		t.Fatalf("cuda = %+v", e)
+	}
+	t.Setenv("ENERGY_CARBON_INTENSITY", "50")
+	if e := estimateEnergy(processorCompute{Device: "rocm", Seconds: 36}); e == nil || e.WattHours != 3 || e.CO2Grams != 0.15 {
+		t.Errorf("rocm at 50 g/kWh = %+v", e)
+	}
+	// No draw configured for CPUs, nothing reported, or a bad report
+	for _, v := range []interface{}{processorCompute{Device: "cpu", Seconds: 60}, nil, json.RawMessage(""), json.RawMessage("{")} {
+		if e := estimateEnergy(v); e != nil {
+			t.Errorf("%v = %+v", v, e)
+		}
+	}
+
+	shares := splitCompute(&processorCompute{Device: "cpu", Seconds: 30}, []float64{10, 20})
+	if shares[0].Seconds != 10 || shares[1].Seconds != 20 {
+		t.Errorf("by length = %+v %+v", shares[0], shares[1])
+	}
+	if shares := splitCompute(&processorCompute{Device: "cpu", Seconds: 30}, []float64{10, -1, 5}); shares[0].Seconds != 10 || shares[2].Seconds != 10 {
+		t.Errorf("unknown length = %+v", shares)
+	}
+	if shares := splitCompute(nil, []float64{10}); shares[0] != nil {
+		t.Errorf("no compute = %+v", shares[0])
+	}
+}
+
+func TestIntegrationJobEnergy(t *testing.T) {
+	t.Setenv("ENERGY_CPU_WATTS", "60")
+	b := newIntegrationBackend(t, 1)
+	job := b.waitFor(b.upload("song.mp3", nil).ID, "completed")
+	if e := job.Energy; e == nil || e.Device != "cpu" || e.ComputeSeconds != mockCompute.Seconds || e.WattHours != 0.7 || e.CO2Grams != 0.33 {
+		t.Fatalf("energy = %+v", job.Energy)
+	}
+
+	rec := httptest.NewRecorder()
+	adminStatsHandler(rec, httptest.NewRequest("GET", "/api/admin/stats", nil))
+	var stats struct {
+		Energy energyStats `json:"energy"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &stats)
+	if cpu := stats.Energy.ByDevice["cpu"]; stats.Energy.Jobs != 1 || stats.Energy.WattHours != 0.7 || cpu == nil || cpu.CO2Grams != 0.33 {
+		t.Errorf("stats = %s", rec.Body.String())
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Job event logs. Every event emitted for a job is numbered with a per-job
+// sequence and appended, exactly as webhooks receive it, to
+// .events/<job-id>.jsonl in the upload directory, so an integrator coming
+// back from downtime can replay what it missed:
+//
+//	GET /api/jobs/{id}/events?since=2
+//	-> {"events": [<event 3>, <event 4>], "cursor": 4, "has_more": false}
+//
+// since is the sequence of the last event already handled (0 for all), and
+// the next call passes the returned cursor; without since the route streams
+// progress instead (see progress.go). A logged event can also be sent to a
+// webhook again by its ID, whether or not a delivery of it is still in the
+// webhook's history: POST /api/webhooks/{id}/events/{event}/redeliver.
+// Logs outlive their job by JOB_EVENTS_RETENTION (default 7 days), so a
+// deletion can be replayed too.
+
+const (
+	defaultJobEventsRetention = 7 * 24 * time.Hour
+	defaultJobEventsPage      = 100
+	maxJobEventsPage          = 1000
+	maxJobEventLine           = 16 << 20
+)
+
+var (
+	jobEventSequences = make(map[string]int)    // last sequence by job ID
+	jobEventIndex     = make(map[string]string) // job ID by event ID
+	jobEventsMutex    = &sync.Mutex{}
+)
+
+func jobEventsRetention() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("JOB_EVENTS_RETENTION")); err == nil && d > 0 {
+		return d
+	}
+	return defaultJobEventsRetention
+}
+
+func init() { keepInUploads(jobEventLogDir) }
+
+func jobEventLogDir() string {
+	return filepath.Join(uploadDir, ".events")
+}
+
+func jobEventLogPath(jobID string) string {
+	return filepath.Join(jobEventLogDir(), jobID+".jsonl")
+}
+
+// loggedEvent is the part of a logged event the index needs
+type loggedEvent struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Sequence int    `json:"sequence"`
+	Job      struct {
+		APIKeyID string `json:"api_key_id"`
+		OrgID    string `json:"org_id"`
+	} `json:"job"`
+	Invitee string `json:"invitee"`
+}
+
+// readJobEventLog returns the lines of a job's log, oldest first
+func readJobEventLog(jobID string) ([][]byte, error) {
+	f, err := os.Open(jobEventLogPath(jobID))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines [][]byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), maxJobEventLine)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			lines = append(lines, bytes.Clone(line))
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// appendJobEvent numbers an event and appends it to its job's log
+func appendJobEvent(e *Event) {
+	jobEventsMutex.Lock()
+	defer jobEventsMutex.Unlock()
+	jobEventSequences[e.Job.ID]++
+	e.Sequence = jobEventSequences[e.Job.ID]
+	jobEventIndex[e.ID] = e.Job.ID
+
+	// Without the upload directory events are only numbered
+	if err := os.Mkdir(jobEventLogDir(), 0755); err != nil && !os.IsExist(err) {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to encode event %s: %v", e.ID, err)
+		return
+	}
+	f, err := os.OpenFile(jobEventLogPath(e.Job.ID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Failed to log event %s: %v", e.ID, err)
+		return
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to log event %s: %v", e.ID, err)
+	}
+	f.Close()
+}
+
+// loadJobEventLogs restores the sequences and index of the logged events
+func loadJobEventLogs() {
+	entries, err := os.ReadDir(jobEventLogDir())
+	if err != nil {
+		return
+	}
+	jobEventsMutex.Lock()
+	defer jobEventsMutex.Unlock()
+	for _, entry := range entries {
+		jobID, ok := strings.CutSuffix(entry.Name(), ".jsonl")
+		if !ok {
+			continue
+		}
+		lines, err := readJobEventLog(jobID)
+		if err != nil {
+			log.Printf("Failed to load events of job %s: %v", jobID, err)
+		}
+		for _, line := range lines {
+			var e loggedEvent
+			if json.Unmarshal(line, &e) == nil {
+				jobEventIndex[e.ID] = jobID
+				jobEventSequences[jobID] = max(jobEventSequences[jobID], e.Sequence)
+			}
+		}
+	}
+}
+
+// replayJobEventsHandler serves GET /api/jobs/{id}/events?since=<cursor>
+func replayJobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+	if !isValidJobID(jobID) {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	since, err := strconv.Atoi(r.URL.Query().Get("since"))
+	if err != nil || since < 0 {
+		http.Error(w, "Invalid since value", http.StatusBadRequest)
+		return
+	}
+	limit := defaultJobEventsPage
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 1 || limit > maxJobEventsPage {
+			http.Error(w, "Invalid limit value", http.StatusBadRequest)
+			return
+		}
+	}
+
+	jobEventsMutex.Lock()
+	lines, err := readJobEventLog(jobID)
+	jobEventsMutex.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "Failed to read job events", http.StatusInternalServerError)
+		return
+	}
+	// Keys only see their own and their organizations' jobs' events,
+	// deleted jobs included
+	var owner Job
+	known := len(lines) > 0
+	for _, line := range lines {
+		var e loggedEvent
+		if json.Unmarshal(line, &e) == nil {
+			owner = Job{APIKeyID: e.Job.APIKeyID, OrgID: e.Job.OrgID}
+		}
+	}
+	jobsMutex.RLock()
+	if job, exists := jobs[jobID]; exists {
+		owner, known = Job{APIKeyID: job.APIKeyID, OrgID: job.OrgID}, true
+	}
+	jobsMutex.RUnlock()
+	if !known || !canAccessJob(r, &owner) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	events := []json.RawMessage{}
+	cursor, hasMore := since, false
+	for _, line := range lines {
+		var e loggedEvent
+		if json.Unmarshal(line, &e) != nil || e.Sequence <= since {
+			continue
+		}
+		if len(events) == limit {
+			hasMore = true
+			break
+		}
+		events = append(events, line)
+		cursor = e.Sequence
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"events": events, "cursor": cursor, "has_more": hasMore})
+}
+
+// loggedJobEvent returns the logged JSON of the event with the ID
+func loggedJobEvent(eventID string) (loggedEvent, []byte, bool) {
+	jobEventsMutex.Lock()
+	defer jobEventsMutex.Unlock()
+	jobID, exists := jobEventIndex[eventID]
+	if !exists {
+		return loggedEvent{}, nil, false
+	}
+	lines, _ := readJobEventLog(jobID)
+	for _, line := range lines {
+		var e loggedEvent
+		if json.Unmarshal(line, &e) == nil && e.ID == eventID {
+			return e, line, true
+		}
+	}
+	return loggedEvent{}, nil, false
+}
+
+// redeliverJobEventHandler sends a logged event to a webhook as a new
+// delivery: POST /api/webhooks/{id}/events/{event}/redeliver
+func redeliverJobEventHandler(w http.ResponseWriter, r *http.Request) {
+	e, payload, found := loggedJobEvent(mux.Vars(r)["event"])
+
+	webhooksMutex.Lock()
+	h, ok := lookupWebhook(w, r)
+	if !ok {
+		webhooksMutex.Unlock()
+		return
+	}
+	if !found || !h.receives(e.Job.APIKeyID) && !h.receives(e.Invitee) {
+		webhooksMutex.Unlock()
+		http.Error(w, "Event not found", http.StatusNotFound)
+		return
+	}
+	if !h.subscribes(e.Type) {
+		webhooksMutex.Unlock()
+		http.Error(w, "Webhook isn't subscribed to "+e.Type+" events", http.StatusBadRequest)
+		return
+	}
+	d := &WebhookDelivery{
+		ID:         uuid.New().String(),
+		WebhookID:  h.ID,
+		EventID:    e.ID,
+		EventType:  e.Type,
+		Status:     "pending",
+		Redelivery: true,
+		CreatedAt:  time.Now().UTC(),
+		payload:    payload,
+	}
+	recordWebhookDelivery(d)
+	queued := *d
+	webhooksMutex.Unlock()
+
+	go sendWebhook(d)
+	writeJSON(w, http.StatusAccepted, queued)
+}
+
+// staleJobEventLogs returns the logs of jobs that no longer exist and have
+// been left untouched for ttl, by job ID
+func staleJobEventLogs(now time.Time, ttl time.Duration) map[string]fs.FileInfo {
+	stale := make(map[string]fs.FileInfo)
+	entries, err := os.ReadDir(jobEventLogDir())
+	if err != nil {
+		return stale
+	}
+	for _, entry := range entries {
+		jobID, ok := strings.CutSuffix(entry.Name(), ".jsonl")
+		info, err := entry.Info()
+		if !ok || err != nil || now.Sub(info.ModTime()) < ttl {
+			continue
+		}
+		jobsMutex.RLock()
+		_, exists := jobs[jobID]
+		jobsMutex.RUnlock()
+		if !exists {
+			stale[jobID] = info
+		}
+	}
+	return stale
+}
+
+// pruneJobEventLogs removes the logs of jobs that no longer exist once they
+// have been left untouched for ttl, and returns how many were removed
+func pruneJobEventLogs(now time.Time, ttl time.Duration) int {
+	removed := 0
+	for jobID := range staleJobEventLogs(now, ttl) {
+		jobEventsMutex.Lock()
+		lines, _ := readJobEventLog(jobID)
+		for _, line := range lines {
+			var e loggedEvent
+			if json.Unmarshal(line, &e) == nil {
+				delete(jobEventIndex, e.ID)
+			}
+		}
+		delete(jobEventSequences, jobID)
+		err := os.Remove(jobEventLogPath(jobID))
+		jobEventsMutex.Unlock()
+		if err != nil {
+			log.Printf("Failed to remove events of job %s: %v", jobID, err)
+			continue
+		}
+		removed++
+	}
+	return removed
+}
+
+// jobEventLogJanitor prunes event logs every interval
+func jobEventLogJanitor(interval time.Duration) {
+	for range time.Tick(interval) {
+		if n := pruneJobEventLogs(time.Now(), jobEventsRetention()); n > 0 {
+			log.Printf("Removed the event logs of %d deleted jobs", n)
+		}
+	}
+}
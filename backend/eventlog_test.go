@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIntegrationJobEventReplay(t *testing.T) {
+	t.Setenv("OUTBOUND_ALLOW_PRIVATE", "true") // the test endpoint listens on loopback
+	b := newIntegrationBackend(t, 1)
+	job := b.waitFor(b.upload("song.mp3", nil).ID, "completed")
+
+	type replay struct {
+		Events  []Event `json:"events"`
+		Cursor  int     `json:"cursor"`
+		HasMore bool    `json:"has_more"`
+	}
+	get := func(query string) (int, replay) {
+		t.Helper()
+		code, data := b.get("/api/jobs/" + job.ID + "/events?" + query)
+		var page replay
+		json.Unmarshal(data, &page)
+		return code, page
+	}
+	// job.completed is emitted just after the status changes
+	var all replay
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, all = get("since=0"); len(all.Events) == 3 || time.Now().After(deadline) {
+			break
+		}
+	}
+	if len(all.Events) != 3 || all.Events[0].Type != EventJobCreated || all.Events[2].Type != EventJobCompleted || all.Cursor != 3 || all.HasMore {
+		t.Fatalf("replay = %+v", all)
+	}
+	for i, e := range all.Events {
+		if e.Sequence != i+1 || e.Job.ID != job.ID {
+			t.Errorf("event %d = %s #%d", i, e.Type, e.Sequence)
+		}
+	}
+	if _, page := get("since=1&limit=1"); len(page.Events) != 1 || page.Events[0].Sequence != 2 || page.Cursor != 2 || !page.HasMore {
+		t.Errorf("second page = %+v", page)
+	}
+	if _, page := get("since=3"); len(page.Events) != 0 || page.Cursor != 3 {
+		t.Errorf("caught up = %+v", page)
+	}
+	if code, _ := get("since=soon"); code != http.StatusBadRequest {
+		t.Errorf("bad cursor = %d", code)
+	}
+
+	// A deleted job's events, the deletion included, can still be replayed
+	req, _ := http.NewRequest("DELETE", b.URL+"/api/jobs/"+job.ID, nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete = %v %v", resp, err)
+	}
+	if _, page := get("since=3"); len(page.Events) != 1 || page.Events[0].Type != EventJobDeleted {
+		t.Errorf("after deletion = %+v", page)
+	}
+
+	// Redelivery by event ID sends the logged event unchanged
+	bodies := make(chan []byte, 1)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer endpoint.Close()
+	post := func(path, body string) (int, []byte) {
+		t.Helper()
+		resp, err := http.Post(b.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, data
+	}
+	_, data := post("/api/webhooks", `{"url":"`+endpoint.URL+`","events":["job.completed"]}`)
+	var hook Webhook
+	json.Unmarshal(data, &hook)
+	t.Cleanup(func() {
+		webhooksMutex.Lock()
+		delete(webhooks, hook.ID)
+		delete(webhookDeliveries, hook.ID)
+		webhooksMutex.Unlock()
+	})
+	completed := all.Events[2]
+	if code, data := post("/api/webhooks/"+hook.ID+"/events/"+completed.ID+"/redeliver", ""); code != http.StatusAccepted {
+		t.Fatalf("redeliver = %d: %s", code, data)
+	}
+	var sent Event
+	select {
+	case body := <-bodies:
+		json.Unmarshal(body, &sent)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not redelivered")
+	}
+	if sent.ID != completed.ID || sent.Sequence != 3 || sent.Job.Status != "completed" {
+		t.Errorf("redelivered %+v", sent)
+	}
+	if code, _ := post("/api/webhooks/"+hook.ID+"/events/"+all.Events[0].ID+"/redeliver", ""); code != http.StatusBadRequest {
+		t.Errorf("redeliver of an unsubscribed event = %d", code)
+	}
+	if code, _ := post("/api/webhooks/"+hook.ID+"/events/nope/redeliver", ""); code != http.StatusNotFound {
+		t.Errorf("redeliver of an unknown event = %d", code)
+	}
+
+	// The log goes once it has outlived the job by the retention
+	if n := pruneJobEventLogs(time.Now(), time.Hour); n != 0 {
+		t.Errorf("pruned %d fresh logs", n)
+	}
+	if n := pruneJobEventLogs(time.Now().Add(2*time.Hour), time.Hour); n != 1 {
+		t.Errorf("pruned %d logs, want 1", n)
+	}
+	if code, _ := get("since=0"); code != http.StatusNotFound {
+		t.Errorf("replay after pruning = %d", code)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Job lifecycle event types
+const (
+	EventJobCreated    = "job.created"
+	EventJobProcessing = "job.processing"
+	EventJobCompleted  = "job.completed"
+	EventJobFailed     = "job.failed"
+	EventJobDeleted    = "job.deleted"
+	EventJobExpired    = "job.expired"
+	EventJobShared     = "job.shared" // invited another key, see invitations.go
+)
+
+var eventTypes = map[string]bool{
+	EventJobCreated: true, EventJobProcessing: true, EventJobCompleted: true,
+	EventJobFailed: true, EventJobDeleted: true, EventJobExpired: true,
+	EventJobShared: true,
+}
+
+// Event is a job lifecycle notification fanned out to webhooks and streams
+type Event struct {
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	SchemaVersion int       `json:"schema_version"` // see eventschema.go
+	Sequence      int       `json:"sequence"`       // of the job's events, from 1
+	CreatedAt     time.Time `json:"created_at"`
+	Job           Job       `json:"job"`
+	Invitee       string    `json:"invitee,omitempty"` // key a job.shared event was sent for
+}
+
+var (
+	eventListeners      []func(Event)
+	eventListenersMutex = &sync.RWMutex{}
+)
+
+// onEvent registers fn to be called for every emitted event. Listeners run
+// synchronously on the emitting goroutine and must not block.
+func onEvent(fn func(Event)) {
+	eventListenersMutex.Lock()
+	eventListeners = append(eventListeners, fn)
+	eventListenersMutex.Unlock()
+}
+
+// emitEvent logs an event for a job snapshot (see eventlog.go) and sends it
+// to every listener. Self-test jobs are internal and emit nothing.
+func emitEvent(eventType string, job Job) {
+	emitEventFor(eventType, job, "")
+}
+
+// emitEventFor is emitEvent for an event the invitee key's webhooks
+// receive too, besides those of the job's key
+func emitEventFor(eventType string, job Job, invitee string) {
+	if job.SelfTest {
+		return
+	}
+	e := Event{
+		ID:            uuid.New().String(),
+		Type:          eventType,
+		SchemaVersion: eventSchemaVersion,
+		CreatedAt:     time.Now().UTC(),
+		Job:           job,
+		Invitee:       invitee,
+	}
+	appendJobEvent(&e)
+	eventListenersMutex.RLock()
+	listeners := eventListeners
+	eventListenersMutex.RUnlock()
+	for _, fn := range listeners {
+		fn(e)
+	}
+}
+
+// emitJobEvent emits an event for the current state of a job
+func emitJobEvent(jobID, eventType string) {
+	jobsMutex.RLock()
+	job, exists := jobs[jobID]
+	var snapshot Job
+	if exists {
+		snapshot = job.snapshot()
+	}
+	jobsMutex.RUnlock()
+	if exists {
+		emitEvent(eventType, snapshot)
+	}
+}
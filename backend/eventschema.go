@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event payload versions. Every payload sent about a job (webhook bodies,
+// job callbacks, the admin event stream and the job progress stream)
+// carries the schema_version it follows, and webhook and callback
+// deliveries repeat it in the X-Track2stem-Schema-Version header.
+// GET /api/schemas/events returns the JSON Schema of each payload, generated
+// from the types that are marshaled, so integrators can validate against
+// the exact contract and check the version they were written for. Within a
+// version fields and event types are only ever added; removing a field or
+// changing its meaning raises the version.
+
+// eventSchemaVersion is the version of the payloads sent now
+const eventSchemaVersion = 1
+
+// eventSchemaVersions are the versions /api/schemas/events can describe
+var eventSchemaVersions = []int{1}
+
+// jsonSchemaDialect is the JSON Schema draft the schemas are written in
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// schemaBuilder turns Go types into JSON Schemas, collecting named structs
+// in defs so each is described once
+type schemaBuilder struct {
+	defs map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema returns the JSON Schema of values of type t as encoding/json
+// marshals them
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		if _, done := b.defs[t.Name()]; !done {
+			b.defs[t.Name()] = nil // placeholder against recursion
+			b.defs[t.Name()] = b.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	}
+	return map[string]interface{}{} // any value
+}
+
+// object describes the exported fields of a struct; fields without
+// omitempty are required, and those that marshal nil as null may be null
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if ft := f.Type; f.Anonymous && name == "" {
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			// Its fields are marshaled as if they were this struct's,
+			// and may all be missing when it is a nil pointer
+			if ft.Kind() == reflect.Struct {
+				embedded := b.object(ft)
+				maps.Copy(properties, embedded["properties"].(map[string]interface{}))
+				if f.Type.Kind() == reflect.Struct {
+					required = append(required, embedded["required"].([]string)...)
+				}
+				continue
+			}
+		}
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s := b.schema(f.Type)
+		omitEmpty := slices.Contains(strings.Split(opts, ","), "omitempty")
+		if !omitEmpty {
+			required = append(required, name)
+			switch f.Type.Kind() {
+			case reflect.Pointer, reflect.Slice, reflect.Map, reflect.Interface:
+				s = map[string]interface{}{"anyOf": []interface{}{s, map[string]interface{}{"type": "null"}}}
+			}
+		}
+		properties[name] = s
+	}
+	slices.Sort(required)
+	return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+}
+
+// envelope is the schema of one payload type, with type (or event, for
+// callbacks) restricted to the given event types
+func (b *schemaBuilder) envelope(v interface{}, typeField string, types []string) map[string]interface{} {
+	s := b.object(reflect.TypeOf(v))
+	properties := s["properties"].(map[string]interface{})
+	if len(types) == 1 {
+		properties[typeField] = map[string]interface{}{"const": types[0]}
+	} else {
+		properties[typeField] = map[string]interface{}{"enum": types}
+	}
+	properties["schema_version"] = map[string]interface{}{"const": eventSchemaVersion}
+	return s
+}
+
+// eventSchemas is the schema document of GET /api/schemas/events: one
+// definition per webhook event type, the oneOf of which validates any
+// webhook body or admin stream event, plus the callback and progress
+// payloads
+func eventSchemas(base string) map[string]interface{} {
+	b := &schemaBuilder{defs: map[string]interface{}{}}
+	types := sortedKeys(eventTypes)
+	var oneOf []interface{}
+	for _, eventType := range types {
+		b.defs[eventType] = b.envelope(Event{}, "type", []string{eventType})
+		oneOf = append(oneOf, map[string]interface{}{"$ref": "#/$defs/" + eventType})
+	}
+	b.defs["callback"] = b.envelope(callbackPayload{}, "event", []string{callbackCompleted, callbackFailed, callbackCancelled})
+	progress := b.object(reflect.TypeOf(jobProgress{}))
+	progress["properties"].(map[string]interface{})["schema_version"] = map[string]interface{}{"const": eventSchemaVersion}
+	b.defs["progress"] = progress
+
+	return map[string]interface{}{
+		"$schema":        jsonSchemaDialect,
+		"$id":            base + "/api/schemas/events?version=" + strconv.Itoa(eventSchemaVersion),
+		"title":          "track2stem event payloads, version " + strconv.Itoa(eventSchemaVersion),
+		"schema_version": eventSchemaVersion,
+		"event_types":    types,
+		"oneOf":          oneOf,
+		"$defs":          b.defs,
+	}
+}
+
+// eventSchemasHandler serves GET /api/schemas/events?version=
+func eventSchemasHandler(w http.ResponseWriter, r *http.Request) {
+	if v := r.URL.Query().Get("version"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || !slices.Contains(eventSchemaVersions, n) {
+			versions := make([]string, len(eventSchemaVersions))
+			for i, n := range eventSchemaVersions {
+				versions[i] = strconv.Itoa(n)
+			}
+			http.Error(w, invalidOption("version", versions).Error(), http.StatusNotFound)
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	writeJSON(w, http.StatusOK, eventSchemas(publicBaseURL(r)))
+}
+
+// validateSchema checks v, as decoded from JSON, against the parts of JSON
+// Schema that schemaBuilder writes. root holds the $defs that $ref points
+// into.
+func validateSchema(root, s map[string]interface{}, v interface{}, path string) error {
+	if ref, ok := s["$ref"].(string); ok {
+		def := root["$defs"].(map[string]interface{})[strings.TrimPrefix(ref, "#/$defs/")]
+		return validateSchema(root, def.(map[string]interface{}), v, path)
+	}
+	if c, ok := s["const"]; ok && fmt.Sprint(c) != fmt.Sprint(v) {
+		return fmt.Errorf("%s = %v, want %v", path, v, c)
+	}
+	if enum, ok := s["enum"].([]interface{}); ok && !slices.Contains(enum, v) {
+		return fmt.Errorf("%s = %v, want one of %v", path, v, enum)
+	}
+	for _, key := range []string{"anyOf", "oneOf"} {
+		if options, ok := s[key].([]interface{}); ok {
+			var errs []string
+			for _, o := range options {
+				err := validateSchema(root, o.(map[string]interface{}), v, path)
+				if err == nil {
+					return nil
+				}
+				errs = append(errs, err.Error())
+			}
+			return fmt.Errorf("%s matches none of %s: %s", path, key, strings.Join(errs, "; "))
+		}
+	}
+	switch s["type"] {
+	case "null":
+		if v != nil {
+			return fmt.Errorf("%s = %v, want null", path, v)
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s = %v, want a string", path, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s = %v, want a boolean", path, v)
+		}
+	case "integer", "number":
+		n, ok := v.(float64)
+		if !ok || (s["type"] == "integer" && n != float64(int64(n))) {
+			return fmt.Errorf("%s = %v, want an %s", path, v, s["type"])
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s = %v, want an array", path, v)
+		}
+		for i, item := range items {
+			if err := validateSchema(root, s["items"].(map[string]interface{}), item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s = %v, want an object", path, v)
+		}
+		required, _ := s["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				return fmt.Errorf("%s.%s is missing", path, name)
+			}
+		}
+		properties, _ := s["properties"].(map[string]interface{})
+		for name, value := range obj {
+			ps, ok := properties[name].(map[string]interface{})
+			if !ok {
+				ps, ok = s["additionalProperties"].(map[string]interface{})
+			}
+			if !ok {
+				return fmt.Errorf("%s.%s isn't in the schema", path, name)
+			}
+			if err := validateSchema(root, ps, value, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIntegrationEventSchemas(t *testing.T) {
+	b := newIntegrationBackend(t, 1)
+	code, data := b.get("/api/schemas/events")
+	var schema map[string]interface{}
+	if err := json.Unmarshal(data, &schema); code != http.StatusOK || err != nil || schema["schema_version"] != float64(eventSchemaVersion) {
+		t.Fatalf("schemas = %d %s", code, data)
+	}
+	if code, _ := b.get("/api/schemas/events?version=9"); code != http.StatusNotFound {
+		t.Errorf("unknown version = %d", code)
+	}
+
+	job := b.waitFor(b.upload("song.mp3", map[string]string{"stem_mode": "isolate", "isolate_stem": "vocals"}).ID, "completed")
+	var replay struct {
+		Events []json.RawMessage `json:"events"`
+	}
+	for deadline := time.Now().Add(2 * time.Second); len(replay.Events) < 3 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		_, data = b.get("/api/jobs/" + job.ID + "/events?since=0")
+		json.Unmarshal(data, &replay)
+	}
+	if len(replay.Events) != 3 {
+		t.Fatalf("events = %s", data)
+	}
+	for _, raw := range replay.Events {
+		var e interface{}
+		json.Unmarshal(raw, &e)
+		if err := validateSchema(schema, schema, e, "event"); err != nil {
+			t.Errorf("%s: %v", raw, err)
+		}
+	}
+
+	defs := schema["$defs"].(map[string]interface{})
+	payloads := map[string]interface{}{
+		"callback": callbackPayload{Event: callbackCompleted, EventID: "e", SchemaVersion: eventSchemaVersion, Job: job, Downloads: callbackDownloads(job)},
+		"progress": jobProgress{Status: "processing", Progress: 50, ReadyStems: []string{"vocals"}, SchemaVersion: eventSchemaVersion},
+	}
+	for name, payload := range payloads {
+		raw, _ := json.Marshal(payload)
+		var v interface{}
+		json.Unmarshal(raw, &v)
+		if err := validateSchema(schema, defs[name].(map[string]interface{}), v, name); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	// A payload of the wrong type doesn't validate
+	var wrong interface{}
+	json.Unmarshal([]byte(`{"id": "e", "type": "job.renamed", "schema_version": 1, "sequence": 1, "created_at": "2026-01-01T00:00:00Z", "job": {}}`), &wrong)
+	if validateSchema(schema, schema, wrong, "event") == nil {
+		t.Error("unknown event type validated")
+	}
+}
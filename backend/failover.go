@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Hot standby failover. A PROCESSORS instance tagged standby gets no jobs
+// while a primary can take them, and is preferred when a job has to leave
+// the instance it was sent to. Besides failing over when an instance can't
+// be reached or answers 502, 503 or 504, a job already running is moved when its
+// instance stops answering its /status for PROCESSOR_UNRESPONSIVE_AFTER
+// (default 30s; 0 turns the watch off): the request is abandoned, the
+// instance marked unhealthy, and the same upload is sent to the next
+// instance under the same job ID. Every move is recorded on the job as a
+// handoff with the progress the job had reached, so the history of a job
+// that restarted on another instance reads as one run.
+
+const defaultProcessorUnresponsiveAfter = 30 * time.Second
+
+// errProcessorUnresponsive cancels a request to an instance that stopped
+// answering mid-job
+var errProcessorUnresponsive = errors.New("processor stopped responding")
+
+// JobHandoff records a job moving from one processor to another
+type JobHandoff struct {
+	From     string    `json:"from"`
+	To       string    `json:"to,omitempty"` // empty when no instance was left to take it
+	At       time.Time `json:"at"`
+	Reason   string    `json:"reason"`
+	Progress float64   `json:"progress"` // reached on From
+	Stage    string    `json:"stage,omitempty"`
+}
+
+func processorUnresponsiveAfter() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("PROCESSOR_UNRESPONSIVE_AFTER")); err == nil && d >= 0 {
+		return d
+	}
+	return defaultProcessorUnresponsiveAfter
+}
+
+// attemptProgress is the latest progress an instance reported for a job
+type attemptProgress struct {
+	mu       sync.Mutex
+	progress float64
+	stage    string
+}
+
+func (a *attemptProgress) get() (float64, string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.progress, a.stage
+}
+
+// watchProcessor polls an instance's /status for a job while the request
+// to it is in flight, cancelling the request with errProcessorUnresponsive
+// once the instance has failed to answer for the configured time. Any
+// answer, even an error status, shows the instance is alive.
+func watchProcessor(ctx context.Context, cancel context.CancelCauseFunc, jobID, processorURL string, seen *attemptProgress) {
+	after := processorUnresponsiveAfter()
+	if after == 0 {
+		return
+	}
+	ticker := time.NewTicker(after / 3)
+	defer ticker.Stop()
+	lastAnswer := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		code, body, err := fetchStatus(processorURL + "/status/" + jobID)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if time.Since(lastAnswer) >= after {
+				log.Printf("Processor %s stopped responding while running job %s", processorURL, jobID)
+				cancel(errProcessorUnresponsive)
+				return
+			}
+			continue
+		}
+		lastAnswer = time.Now()
+		var status jobProgress
+		if code == 200 && json.Unmarshal(body, &status) == nil && status.Progress > 0 {
+			seen.mu.Lock()
+			seen.progress, seen.stage = status.Progress, status.Stage
+			seen.mu.Unlock()
+		}
+	}
+}
+
+// recordHandoff notes on each job that it left from for reason
+func recordHandoff(jobIDs []string, from, reason string, seen *attemptProgress) {
+	progress, stage := seen.get()
+	h := JobHandoff{From: from, At: time.Now().UTC(), Reason: reason, Progress: progress, Stage: stage}
+	jobsMutex.Lock()
+	for _, id := range jobIDs {
+		if job, exists := jobs[id]; exists {
+			job.Handoffs = append(job.Handoffs, h)
+		}
+	}
+	jobsMutex.Unlock()
+}
+
+// completeHandoff fills in where the jobs' last handoff went
+func completeHandoff(jobIDs []string, to string) {
+	jobsMutex.Lock()
+	for _, id := range jobIDs {
+		if job, exists := jobs[id]; exists && len(job.Handoffs) > 0 && job.Handoffs[len(job.Handoffs)-1].To == "" {
+			job.Handoffs[len(job.Handoffs)-1].To = to
+		}
+	}
+	jobsMutex.Unlock()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestAcquireProcessorStandby(t *testing.T) {
+	primary := &processorInstance{URL: "http://primary", Healthy: true, Active: 3}
+	standby := &processorInstance{URL: "http://standby", Standby: true, Healthy: true}
+	other := &processorInstance{URL: "http://other", Healthy: true, Active: 5}
+	useProcessors(t, []*processorInstance{primary, standby, other})
+
+	needs := processorNeeds{Model: "htdemucs"}
+	if p := acquireProcessor(needs, nil); p != primary {
+		t.Errorf("new job went to %v, want the least-loaded primary", p)
+	}
+	if p := acquireProcessor(needs, map[string]bool{primary.URL: true}); p != standby {
+		t.Errorf("job failing over went to %v, want the standby", p)
+	}
+	// The standby is only the last resort for new jobs
+	primary.Healthy, other.Healthy = false, false
+	if p := acquireProcessor(needs, nil); p != standby {
+		t.Errorf("new job with the primaries down went to %v", p)
+	}
+}
+
+func TestProcessorHandoffWhenUnresponsive(t *testing.T) {
+	t.Setenv("PROCESSOR_UNRESPONSIVE_AFTER", "150ms")
+	oldOutputDir := outputDir
+	outputDir = t.TempDir()
+	t.Cleanup(func() { outputDir = oldOutputDir })
+	m := newMockProcessor(t)
+	// Accepts the job, then stops answering: /status connections drop and
+	// /process never returns
+	frozen := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/process" {
+			io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+			return
+		}
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer frozen.Close()
+	useProcessors(t, []*processorInstance{{URL: frozen.URL, Healthy: true}, {URL: m.URL, Standby: true, Healthy: true}})
+
+	input := filepath.Join(t.TempDir(), "song.mp3")
+	os.WriteFile(input, []byte("ID3"), 0644)
+	id := uuid.New().String()
+	jobsMutex.Lock()
+	jobs[id] = &Job{ID: id, Status: "queued"}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+	})
+
+	processJob(id, input, jobOptions{StemMode: "all", Model: "htdemucs", OutputFormat: "mp3"})
+	jobsMutex.RLock()
+	job := jobs[id].snapshot()
+	jobsMutex.RUnlock()
+	if job.Status != "completed" || job.processorURL != m.URL || len(m.Requests()) != 1 {
+		t.Fatalf("job %s (%s) on %s, want completed on the standby", job.Status, job.Error, job.processorURL)
+	}
+	if len(job.Handoffs) != 1 || job.Handoffs[0].From != frozen.URL || job.Handoffs[0].To != m.URL || job.Handoffs[0].Reason != "stopped responding mid-job" {
+		t.Errorf("handoffs = %+v", job.Handoffs)
+	}
+	if p := progressFromJob(job); p.Handoffs != 1 {
+		t.Errorf("progress handoffs = %d", p.Handoffs)
+	}
+	if list := registeredProcessors(); list[0].Healthy || list[0].Active != 0 {
+		t.Errorf("frozen processor after the handoff = %+v", list[0])
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// fft computes an in-place iterative radix-2 FFT; len(x) must be a power of two
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], x[start+k+size/2]*w
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				w *= step
+			}
+		}
+	}
+}
+
+// hannWindow returns a Hann window of length n
+func hannWindow(n int) []float64 {
+	w := make([]float64, n)
+	for i := range w {
+		w[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+	}
+	return w
+}
+
+// magnitudeSpectrogram returns |STFT| frames of samples (normalized to [-1, 1])
+// using a Hann window of size frameSize (a power of two) and the given hop
+func magnitudeSpectrogram(samples []float64, frameSize, hop int) [][]float64 {
+	window := hannWindow(frameSize)
+	buf := make([]complex128, frameSize)
+	var frames [][]float64
+	for start := 0; start+frameSize <= len(samples); start += hop {
+		for i := 0; i < frameSize; i++ {
+			buf[i] = complex(samples[start+i]*window[i], 0)
+		}
+		fft(buf)
+		mags := make([]float64, frameSize/2+1)
+		for i := range mags {
+			mags[i] = cmplx.Abs(buf[i])
+		}
+		frames = append(frames, mags)
+	}
+	return frames
+}
+
+// int16ToFloat converts PCM samples to floats in [-1, 1]
+func int16ToFloat(samples []int16) []float64 {
+	out := make([]float64, len(samples))
+	for i, s := range samples {
+		out[i] = float64(s) / 32768
+	}
+	return out
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+	"testing"
+)
+
+func TestFFTSinePeak(t *testing.T) {
+	const n = 64
+	x := make([]complex128, n)
+	for i := range x {
+		x[i] = complex(math.Sin(2*math.Pi*4*float64(i)/n), 0)
+	}
+	fft(x)
+
+	peak := 0
+	for k := 1; k < n/2; k++ {
+		if cmplx.Abs(x[k]) > cmplx.Abs(x[peak]) {
+			peak = k
+		}
+	}
+	if peak != 4 {
+		t.Errorf("peak bin = %d, want 4", peak)
+	}
+	if got := cmplx.Abs(x[4]); math.Abs(got-n/2) > 1e-9 {
+		t.Errorf("peak magnitude = %f, want %d", got, n/2)
+	}
+}
+
+func TestMagnitudeSpectrogramFrames(t *testing.T) {
+	frames := magnitudeSpectrogram(make([]float64, 4096), 1024, 512)
+	if len(frames) != 7 {
+		t.Errorf("got %d frames, want 7", len(frames))
+	}
+	if len(frames[0]) != 513 {
+		t.Errorf("got %d bins, want 513", len(frames[0]))
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//go:generate sh -c "python3 ../scripts/gen-unicode-tables.py unicodetables.go && gofmt -w unicodetables.go"
+
+// File name policy. Uploaded file names become the names of their stems
+// (Größenwahn_t2s_vocals.wav), so they are sanitized as FILENAME_POLICY
+// says:
+//
+//	unicode        keep letters, marks and digits of every script, composed to NFC (default)
+//	transliterate  spell letters in ASCII where possible (Größenwahn -> Grossenwahn), then ascii
+//	ascii          keep only A-Z, a-z, 0-9, ".", "_" and "-"
+//
+// Under every policy anything up to the last path separator (/ or \) is
+// dropped, other characters become "_" and names are cut to 255 bytes. The
+// processor keeps the names it is sent, and downloads name non-ASCII files
+// with an RFC 6266 filename* next to an ASCII fallback.
+
+const (
+	filenamePolicyUnicode       = "unicode"
+	filenamePolicyTransliterate = "transliterate"
+	filenamePolicyASCII         = "ascii"
+)
+
+var filenamePolicies = map[string]bool{
+	filenamePolicyUnicode: true, filenamePolicyTransliterate: true, filenamePolicyASCII: true,
+}
+
+var unsafeASCII = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// asciiLetters are spelled out by transliteration; the rest of Latin loses
+// its accents
+var asciiLetters = map[rune]string{
+	'ß': "ss", 'ẞ': "SS", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE",
+	'ø': "o", 'Ø': "O", 'đ': "d", 'Đ': "D", 'ð': "d", 'Ð': "D",
+	'ł': "l", 'Ł': "L", 'þ': "th", 'Þ': "Th", 'ı': "i", 'ħ': "h", 'Ħ': "H",
+}
+
+// nfdPairs inverts nfcPairs, for transliteration
+var nfdPairs = func() map[rune][2]rune {
+	m := make(map[rune][2]rune, len(nfcPairs))
+	for pair, r := range nfcPairs {
+		m[r] = pair
+	}
+	return m
+}()
+
+func filenamePolicy() string {
+	if p := os.Getenv("FILENAME_POLICY"); filenamePolicies[p] {
+		return p
+	}
+	return filenamePolicyUnicode
+}
+
+// sanitizeFilename removes dangerous characters from filenames to prevent
+// path traversal, following FILENAME_POLICY
+func sanitizeFilename(filename string) string {
+	filename = filepath.Base(filename)
+	// Old browsers on Windows send the full client path
+	if i := strings.LastIndex(filename, `\`); i >= 0 && i < len(filename)-1 {
+		filename = filename[i+1:]
+	}
+	switch filenamePolicy() {
+	case filenamePolicyASCII:
+		filename = unsafeASCII.ReplaceAllString(filename, "_")
+	case filenamePolicyTransliterate:
+		filename = unsafeASCII.ReplaceAllString(transliterate(filename), "_")
+	default:
+		filename = strings.Map(func(r rune) rune {
+			if r == '.' || r == '_' || r == '-' || (r != utf8.RuneError && unicode.In(r, unicode.L, unicode.M, unicode.N)) {
+				return r
+			}
+			return '_'
+		}, composeNFC(filename))
+	}
+	// Limit length
+	if len(filename) > 255 {
+		ext := filepath.Ext(filename)
+		cut := 255 - len(ext)
+		for cut > 0 && !utf8.RuneStart(filename[cut]) {
+			cut--
+		}
+		filename = filename[:cut] + ext
+	}
+	return filename
+}
+
+// composePair returns the canonical composition of two characters
+func composePair(a, b rune) (rune, bool) {
+	const sBase, lBase, vBase, tBase, vCount, tCount = 0xAC00, 0x1100, 0x1161, 0x11A7, 21, 28
+	switch {
+	case a >= lBase && a < lBase+19 && b >= vBase && b < vBase+vCount:
+		return sBase + ((a-lBase)*vCount+(b-vBase))*tCount, true
+	case a >= sBase && a < sBase+11172 && (a-sBase)%tCount == 0 && b > tBase && b < tBase+tCount:
+		return a + (b - tBase), true
+	}
+	c, ok := nfcPairs[[2]rune{a, b}]
+	return c, ok
+}
+
+// composeNFC composes decomposed characters, such as the names macOS
+// uploads ("o" followed by a combining diaeresis), into single ones. A
+// combining mark composes with the starter before it unless another
+// starter intervenes; marks are taken in the order given.
+func composeNFC(s string) string {
+	out := make([]rune, 0, len(s))
+	starter := -1
+	for _, r := range s {
+		mark := unicode.Is(unicode.M, r)
+		if starter >= 0 && (mark || starter == len(out)-1) {
+			if c, ok := composePair(out[starter], r); ok {
+				out[starter] = c
+				continue
+			}
+		}
+		out = append(out, r)
+		if !mark {
+			starter = len(out) - 1
+		}
+	}
+	return string(out)
+}
+
+// transliterate decomposes characters, drops their accents and spells out
+// the letters in asciiLetters
+func transliterate(s string) string {
+	var b strings.Builder
+	var decompose func(r rune)
+	decompose = func(r rune) {
+		if pair, ok := nfdPairs[r]; ok {
+			decompose(pair[0])
+			decompose(pair[1])
+			return
+		}
+		if spelled, ok := asciiLetters[r]; ok {
+			b.WriteString(spelled)
+		} else if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(r)
+		}
+	}
+	for _, r := range s {
+		decompose(r)
+	}
+	return b.String()
+}
+
+// contentDisposition is a Content-Disposition header naming a file. A name
+// outside ASCII is given as filename* (RFC 6266), with a transliterated
+// filename for clients that don't read it.
+func contentDisposition(disposition, name string) string {
+	fallback := unsafeASCII.ReplaceAllString(transliterate(name), "_")
+	if fallback == name {
+		return fmt.Sprintf(`%s; filename="%s"`, disposition, name)
+	}
+	var encoded strings.Builder
+	for _, c := range []byte(name) {
+		if c < utf8.RuneSelf && (c == '.' || c == '_' || c == '-' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))) {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback, encoded.String())
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFilenamePolicies(t *testing.T) {
+	decomposed := "Gro\u0308\u00dfenwahn.mp3" // as macOS sends it
+	for _, tc := range []struct {
+		policy, input, want string
+	}{
+		{"", "Größenwahn.mp3", "Größenwahn.mp3"},
+		{"unicode", decomposed, "Größenwahn.mp3"},
+		{"unicode", "東京 ソング.flac", "東京_ソング.flac"},
+		{"unicode", "\u1112\u1161\u11ab\u1100\u1173\u11af.wav", "한글.wav"},
+		{"unicode", "Beyonce\u0301 – Halo?.mp3", "Beyoncé___Halo_.mp3"},
+		{"unicode", `C:\Users\me\Café.mp3`, "Café.mp3"},
+		{"unicode", "../../étc/pässwd", "pässwd"},
+		{"unicode", "a\u200bb\x00c.mp3", "a_b_c.mp3"},
+		{"transliterate", decomposed, "Grossenwahn.mp3"},
+		{"transliterate", "Ærøskøbing Œuvre.wav", "AEroskobing_OEuvre.wav"},
+		{"transliterate", "Straße Łódź.mp3", "Strasse_Lodz.mp3"},
+		{"ascii", "Größenwahn.mp3", "Gr__enwahn.mp3"},
+		{"bogus", "Größenwahn.mp3", "Größenwahn.mp3"},
+	} {
+		t.Setenv("FILENAME_POLICY", tc.policy)
+		if got := sanitizeFilename(tc.input); got != tc.want {
+			t.Errorf("%s: sanitizeFilename(%q) = %q, want %q", tc.policy, tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestSanitizeFilenameLength(t *testing.T) {
+	got := sanitizeFilename(strings.Repeat("ö", 200) + ".flac")
+	if len(got) > 255 || !utf8.ValidString(got) || !strings.HasSuffix(got, ".flac") {
+		t.Errorf("long name cut to %d bytes %q", len(got), got)
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	if got := contentDisposition("attachment", "song_t2s_vocals.wav"); got != `attachment; filename="song_t2s_vocals.wav"` {
+		t.Errorf("ASCII name = %s", got)
+	}
+	want := `inline; filename="Grossenwahn_t2s_vocals.wav"; filename*=UTF-8''Gr%C3%B6%C3%9Fenwahn_t2s_vocals.wav`
+	if got := contentDisposition("inline", "Größenwahn_t2s_vocals.wav"); got != want {
+		t.Errorf("Unicode name = %s, want %s", got, want)
+	}
+}
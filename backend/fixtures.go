@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Recorded API responses, for contract tests of API clients. With
+// FIXTURE_MODE=replay the binary answers every /api request from fixtures
+// instead of running jobs: no processor, no uploads kept, no real audio.
+// The golden fixtures built in (backend/fixtures) cover a job that
+// completes, a job that fails and the common errors; FIXTURE_DIR replaces
+// them with a set of one's own. A fixture is a scenario, a list of
+// request/response exchanges. The X-Track2stem-Fixture header (or
+// ?fixture=) picks the scenario; without it the first scenario, by name,
+// with a matching exchange answers. Requests are matched on method, path
+// and query, and a request that appears more than once in a scenario gets
+// its responses in turn and then the last one again, so polling a job sees
+// it go from queued to completed. POST /api/fixtures/reset starts every
+// sequence over.
+//
+// FIXTURE_MODE=record serves normally and writes each /api exchange to
+// FIXTURE_DIR/<scenario>.json, the scenario named by the same header
+// ("recorded" without one). JSON request bodies are kept; upload bodies,
+// the audio, are not, and event streams aren't recorded. Responses with a
+// known type are checked against the JSON Schema generated from it, as the
+// event schemas are: when fixtures are loaded for replay, and as they are
+// recorded, so a fixture that no longer matches the code is caught.
+
+// fixtureHeader picks the scenario of a request
+const fixtureHeader = "X-Track2stem-Fixture"
+
+// maxFixtureBody is the largest request or response body recorded
+const maxFixtureBody = 1 << 20
+
+const defaultFixtureScenario = "recorded"
+
+//go:embed fixtures/*.json
+var goldenFixtures embed.FS
+
+// FixtureScenario is one fixture file
+type FixtureScenario struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Exchanges   []FixtureExchange `json:"exchanges"`
+}
+
+// FixtureExchange is a request and the response it got
+type FixtureExchange struct {
+	Request  FixtureRequest  `json:"request"`
+	Response FixtureResponse `json:"response"`
+}
+
+// FixtureRequest is what a request is matched on, plus what was sent
+type FixtureRequest struct {
+	Method      string          `json:"method"`
+	Path        string          `json:"path"`
+	Route       string          `json:"route,omitempty"` // as registered, e.g. /api/jobs/{id}
+	Query       string          `json:"query,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+	Body        json.RawMessage `json:"body,omitempty"` // JSON bodies only
+}
+
+// FixtureResponse is a response to serve; one of Body, Text and Data is set
+type FixtureResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"` // JSON
+	Text    string            `json:"text,omitempty"` // other text, such as errors
+	Data    []byte            `json:"data,omitempty"` // anything else, base64
+}
+
+// fixtureHeaders are the response headers a fixture keeps
+var fixtureHeaders = []string{"Content-Type", "Content-Disposition", "Location", "Retry-After"}
+
+// fixtureNamePattern restricts scenario names, which are file names
+var fixtureNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// fixtureResponseTypes are the responses checked against a schema, by
+// method and route
+var fixtureResponseTypes = map[string]interface{}{
+	"POST /api/upload":                     Job{},
+	"GET /api/jobs":                        JobList{},
+	"GET /api/jobs/{id}":                   Job{},
+	"GET /api/jobs/{id}/outputs":           outputsResponse{},
+	"GET /api/jobs/{id}/download-manifest": DownloadManifest{},
+	"POST /api/upload/batch":               batchView{},
+	"GET /api/batches/{id}":                batchView{},
+	"POST /api/webhooks":                   Webhook{},
+	"GET /api/webhooks":                    []Webhook{},
+	"GET /api/webhooks/{id}":               Webhook{},
+	"POST /api/templates":                  JobTemplate{},
+	"GET /api/templates/{name}":            JobTemplate{},
+	"GET /api/changelog":                   changelogResponse{},
+}
+
+var (
+	fixtures      map[string]*FixtureScenario // replayed, by name
+	fixtureServed map[string]int              // times each request was answered
+	recordings    = make(map[string]*FixtureScenario)
+	fixturesMutex = &sync.Mutex{}
+)
+
+// fixtureMode is FIXTURE_MODE: "", record or replay
+func fixtureMode() string {
+	return os.Getenv("FIXTURE_MODE")
+}
+
+// startFixtureMode checks FIXTURE_MODE at startup and loads the fixtures to
+// replay
+func startFixtureMode() error {
+	dir := os.Getenv("FIXTURE_DIR")
+	switch fixtureMode() {
+	case "":
+		return nil
+	case "replay":
+		if err := loadFixtures(dir); err != nil {
+			return err
+		}
+		log.Printf("Replaying %d API fixture scenarios; no jobs will run", len(fixtures))
+		return nil
+	case "record":
+		if dir == "" {
+			return fmt.Errorf("FIXTURE_MODE=record needs FIXTURE_DIR")
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		log.Printf("Recording API fixtures to %s", dir)
+		return nil
+	}
+	return fmt.Errorf("Invalid FIXTURE_MODE %q (record or replay)", fixtureMode())
+}
+
+// loadFixtures reads and checks the scenarios in dir, or the golden ones
+// when dir is empty
+func loadFixtures(dir string) error {
+	var fsys fs.FS = os.DirFS(dir)
+	if dir == "" {
+		fsys, _ = fs.Sub(goldenFixtures, "fixtures")
+	}
+	names, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]*FixtureScenario)
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		var s FixtureScenario
+		if err := json.Unmarshal(data, &s); err != nil {
+			return fmt.Errorf("fixture %s: %v", name, err)
+		}
+		if err := validateFixture(&s); err != nil {
+			return fmt.Errorf("fixture %s: %v", name, err)
+		}
+		if loaded[s.Name] != nil {
+			return fmt.Errorf("fixture %s: scenario %s is defined twice", name, s.Name)
+		}
+		loaded[s.Name] = &s
+	}
+	if len(loaded) == 0 {
+		return fmt.Errorf("no fixtures in %s", dir)
+	}
+	fixturesMutex.Lock()
+	fixtures, fixtureServed = loaded, make(map[string]int)
+	fixturesMutex.Unlock()
+	return nil
+}
+
+// validateFixture checks a scenario's name and exchanges, and its responses
+// against the schemas of their types
+func validateFixture(s *FixtureScenario) error {
+	if !fixtureNamePattern.MatchString(s.Name) {
+		return fmt.Errorf("invalid scenario name %q", s.Name)
+	}
+	for i, e := range s.Exchanges {
+		if e.Request.Method == "" || !strings.HasPrefix(e.Request.Path, "/") {
+			return fmt.Errorf("exchanges[%d]: a method and a path are required", i)
+		}
+		if http.StatusText(e.Response.Status) == "" {
+			return fmt.Errorf("exchanges[%d]: invalid status %d", i, e.Response.Status)
+		}
+		if err := checkFixtureResponse(e); err != nil {
+			return fmt.Errorf("exchanges[%d] %s %s: %v", i, e.Request.Method, e.Request.Path, err)
+		}
+	}
+	return nil
+}
+
+// checkFixtureResponse validates a successful response with a known type
+// against that type's schema
+func checkFixtureResponse(e FixtureExchange) error {
+	v, ok := fixtureResponseTypes[e.Request.Method+" "+e.Request.Route]
+	if !ok || e.Response.Status >= 300 {
+		return nil
+	}
+	if e.Response.Body == nil {
+		return fmt.Errorf("a JSON body is required")
+	}
+	b := &schemaBuilder{defs: map[string]interface{}{}}
+	s := b.schema(reflect.TypeOf(v))
+	// As decoded from JSON, like the body
+	var root, schema, body interface{}
+	data, _ := json.Marshal(map[string]interface{}{"$defs": b.defs})
+	json.Unmarshal(data, &root)
+	data, _ = json.Marshal(s)
+	json.Unmarshal(data, &schema)
+	if err := json.Unmarshal(e.Response.Body, &body); err != nil {
+		return err
+	}
+	return validateSchema(root.(map[string]interface{}), schema.(map[string]interface{}), body, "response")
+}
+
+// fixtureQuery is the query a request is matched on, without the fixture
+// and credential parameters
+func fixtureQuery(q url.Values) string {
+	q.Del("fixture")
+	q.Del("api_key")
+	return q.Encode()
+}
+
+// fixtureScenarioName is the scenario a request names, if any
+func fixtureScenarioName(r *http.Request) string {
+	if name := r.Header.Get(fixtureHeader); name != "" {
+		return name
+	}
+	return r.URL.Query().Get("fixture")
+}
+
+// replayFixture answers r from the fixtures
+func replayFixture(w http.ResponseWriter, r *http.Request) {
+	name := fixtureScenarioName(r)
+	query := fixtureQuery(r.URL.Query())
+
+	fixturesMutex.Lock()
+	var candidates []string
+	if name != "" {
+		if fixtures[name] == nil {
+			fixturesMutex.Unlock()
+			http.Error(w, "No fixture scenario named "+name, http.StatusNotFound)
+			return
+		}
+		candidates = []string{name}
+	} else {
+		candidates = sortedKeys(fixtures)
+	}
+	var matches []FixtureResponse
+	var key string
+	for _, name := range candidates {
+		for _, e := range fixtures[name].Exchanges {
+			if e.Request.Method == r.Method && e.Request.Path == r.URL.Path && e.Request.Query == query {
+				matches = append(matches, e.Response)
+			}
+		}
+		if len(matches) > 0 {
+			key = name + " " + r.Method + " " + r.URL.Path + "?" + query
+			break
+		}
+	}
+	if len(matches) == 0 {
+		fixturesMutex.Unlock()
+		http.Error(w, "No fixture for "+r.Method+" "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+	resp := matches[min(fixtureServed[key], len(matches)-1)]
+	fixtureServed[key]++
+	fixturesMutex.Unlock()
+
+	io.Copy(io.Discard, r.Body)
+	for _, h := range sortedKeys(resp.Headers) {
+		w.Header().Set(h, resp.Headers[h])
+	}
+	switch {
+	case resp.Body != nil:
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.WriteHeader(resp.Status)
+		w.Write(append(resp.Body, '\n'))
+	case resp.Data != nil:
+		w.WriteHeader(resp.Status)
+		w.Write(resp.Data)
+	default:
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		w.WriteHeader(resp.Status)
+		io.WriteString(w, resp.Text)
+	}
+}
+
+// fixtureRecorder keeps a copy of the response it passes through
+type fixtureRecorder struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+	hijacked  bool
+}
+
+func (f *fixtureRecorder) WriteHeader(code int) {
+	if f.status == 0 {
+		f.status = code
+	}
+	f.ResponseWriter.WriteHeader(code)
+}
+
+func (f *fixtureRecorder) Write(b []byte) (int, error) {
+	if f.status == 0 {
+		f.status = http.StatusOK
+	}
+	if f.body.Len()+len(b) > maxFixtureBody {
+		f.truncated = true
+	} else if !f.truncated {
+		f.body.Write(b)
+	}
+	return f.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach deadlines, flushing and hijacking
+func (f *fixtureRecorder) Unwrap() http.ResponseWriter {
+	return f.ResponseWriter
+}
+
+// Flush keeps event streams working behind the recorder
+func (f *fixtureRecorder) Flush() {
+	http.NewResponseController(f.ResponseWriter).Flush()
+}
+
+// Hijack keeps WebSocket upgrades working behind the recorder
+func (f *fixtureRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	f.hijacked = true
+	return http.NewResponseController(f.ResponseWriter).Hijack()
+}
+
+// recordFixture serves r and adds the exchange to its scenario's file
+func recordFixture(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	scenario := fixtureScenarioName(r)
+	if scenario == "" {
+		scenario = defaultFixtureScenario
+	}
+	req := FixtureRequest{
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Query:       fixtureQuery(r.URL.Query()),
+		ContentType: r.Header.Get("Content-Type"),
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		req.Route, _ = route.GetPathTemplate()
+	}
+	if strings.HasPrefix(req.ContentType, "application/json") && r.Body != nil {
+		data, _ := io.ReadAll(io.LimitReader(r.Body, maxFixtureBody+1))
+		if len(data) <= maxFixtureBody && json.Valid(data) {
+			req.Body = json.RawMessage(data)
+		}
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(data), r.Body))
+	}
+
+	rec := &fixtureRecorder{ResponseWriter: w}
+	next.ServeHTTP(rec, r)
+	contentType := w.Header().Get("Content-Type")
+	if !fixtureNamePattern.MatchString(scenario) || rec.truncated || rec.hijacked || strings.HasPrefix(contentType, "text/event-stream") {
+		return
+	}
+
+	resp := FixtureResponse{Status: rec.status, Headers: map[string]string{}}
+	if resp.Status == 0 {
+		resp.Status = http.StatusOK
+	}
+	for _, h := range fixtureHeaders {
+		if v := w.Header().Get(h); v != "" {
+			resp.Headers[h] = v
+		}
+	}
+	body := bytes.TrimSpace(rec.body.Bytes())
+	switch {
+	case strings.HasPrefix(contentType, "application/json") && json.Valid(body):
+		resp.Body = json.RawMessage(body)
+	case strings.HasPrefix(contentType, "text/"):
+		resp.Text = rec.body.String()
+	case rec.body.Len() > 0:
+		resp.Data = bytes.Clone(rec.body.Bytes())
+	}
+	e := FixtureExchange{Request: req, Response: resp}
+	if err := checkFixtureResponse(e); err != nil {
+		log.Printf("Recorded %s %s doesn't match its schema: %v", r.Method, r.URL.Path, err)
+	}
+
+	fixturesMutex.Lock()
+	defer fixturesMutex.Unlock()
+	s := recordings[scenario]
+	if s == nil {
+		s = &FixtureScenario{Name: scenario}
+		recordings[scenario] = s
+	}
+	s.Exchanges = append(s.Exchanges, e)
+	saveFixtureScenario(s)
+}
+
+// saveFixtureScenario writes a recorded scenario to FIXTURE_DIR. Callers
+// hold fixturesMutex.
+func saveFixtureScenario(s *FixtureScenario) {
+	data, _ := json.MarshalIndent(s, "", "  ")
+	path := filepath.Join(os.Getenv("FIXTURE_DIR"), s.Name+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("Failed to save fixture %s: %v", s.Name, err)
+		return
+	}
+	os.Rename(tmp, path)
+}
+
+// fixtureMiddleware replays or records /api requests, per FIXTURE_MODE
+func fixtureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mode := fixtureMode()
+		if mode == "" || !strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/api/fixtures") || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if mode == "replay" {
+			replayFixture(w, r)
+			return
+		}
+		recordFixture(next, w, r)
+	})
+}
+
+// fixtureSummary is one scenario in GET /api/fixtures
+type fixtureSummary struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Requests    []string `json:"requests"` // METHOD path, each once
+}
+
+// listFixturesHandler serves GET /api/fixtures
+func listFixturesHandler(w http.ResponseWriter, r *http.Request) {
+	if fixtureMode() != "replay" {
+		http.Error(w, "Not replaying fixtures (FIXTURE_MODE=replay)", http.StatusNotFound)
+		return
+	}
+	fixturesMutex.Lock()
+	list := make([]fixtureSummary, 0, len(fixtures))
+	for _, name := range sortedKeys(fixtures) {
+		s := fixtures[name]
+		summary := fixtureSummary{Name: s.Name, Description: s.Description, Requests: []string{}}
+		seen := map[string]bool{}
+		for _, e := range s.Exchanges {
+			req := e.Request.Method + " " + e.Request.Path
+			if e.Request.Query != "" {
+				req += "?" + e.Request.Query
+			}
+			if !seen[req] {
+				seen[req] = true
+				summary.Requests = append(summary.Requests, req)
+			}
+		}
+		sort.Strings(summary.Requests)
+		list = append(list, summary)
+	}
+	fixturesMutex.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"scenarios": list})
+}
+
+// resetFixturesHandler serves POST /api/fixtures/reset
+func resetFixturesHandler(w http.ResponseWriter, r *http.Request) {
+	if fixtureMode() != "replay" {
+		http.Error(w, "Not replaying fixtures (FIXTURE_MODE=replay)", http.StatusNotFound)
+		return
+	}
+	fixturesMutex.Lock()
+	clear(fixtureServed)
+	fixturesMutex.Unlock()
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reset"})
+}
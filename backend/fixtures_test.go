@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGoldenFixtures(t *testing.T) {
+	t.Cleanup(func() { fixtures = nil })
+	if err := loadFixtures(""); err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) != 3 {
+		t.Errorf("scenarios = %v", sortedKeys(fixtures))
+	}
+
+	job := FixtureExchange{
+		Request:  FixtureRequest{Method: "GET", Path: "/api/jobs/x", Route: "/api/jobs/{id}"},
+		Response: FixtureResponse{Status: 200, Body: json.RawMessage(`{"id": "x", "status": 3, "filename": "a.mp3", "created_at": "2026-01-05T10:00:00Z"}`)},
+	}
+	if err := validateFixture(&FixtureScenario{Name: "bad", Exchanges: []FixtureExchange{job}}); err == nil || !strings.Contains(err.Error(), "response.status") {
+		t.Errorf("wrong type = %v", err)
+	}
+	job.Response.Body = json.RawMessage(`{"id": "x", "status": "queued", "filename": "a.mp3", "created_at": "2026-01-05T10:00:00Z", "colour": "red"}`)
+	if err := validateFixture(&FixtureScenario{Name: "bad", Exchanges: []FixtureExchange{job}}); err == nil || !strings.Contains(err.Error(), "colour") {
+		t.Errorf("unknown field = %v", err)
+	}
+	if err := validateFixture(&FixtureScenario{Name: "Bad Name"}); err == nil {
+		t.Error("invalid name accepted")
+	}
+}
+
+func TestIntegrationFixtureReplay(t *testing.T) {
+	t.Setenv("FIXTURE_MODE", "replay")
+	t.Cleanup(func() { fixtures = nil })
+	if err := loadFixtures(""); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	send := func(method, path, scenario string) (int, Job) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader("--x--\r\n"))
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+		if scenario != "" {
+			req.Header.Set(fixtureHeader, scenario)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var job Job
+		json.NewDecoder(resp.Body).Decode(&job)
+		return resp.StatusCode, job
+	}
+
+	code, job := send("POST", "/api/upload", "")
+	if code != http.StatusOK || job.ID != "00000000-0000-4000-8000-000000000001" {
+		t.Fatalf("upload = %d %+v", code, job)
+	}
+	// Polling steps through the recorded responses and stays on the last
+	for _, want := range []string{"queued", "processing", "completed", "completed"} {
+		if _, job := send("GET", "/api/jobs/"+job.ID, ""); job.Status != want {
+			t.Fatalf("poll = %q, want %q", job.Status, want)
+		}
+	}
+	if code, _ := send("POST", "/api/fixtures/reset", ""); code != http.StatusOK {
+		t.Fatalf("reset = %d", code)
+	}
+	if _, job := send("GET", "/api/jobs/"+job.ID, ""); job.Status != "queued" {
+		t.Errorf("after a reset = %q", job.Status)
+	}
+
+	if code, job := send("POST", "/api/upload", "job-failed"); code != http.StatusOK || job.ID != "00000000-0000-4000-8000-000000000002" {
+		t.Errorf("job-failed upload = %d %+v", code, job)
+	}
+	if code, _ := send("POST", "/api/upload?fixture=rejected", ""); code != http.StatusBadRequest {
+		t.Errorf("rejected upload = %d", code)
+	}
+	if code, _ := send("GET", "/api/batches/00000000-0000-4000-8000-000000000001", ""); code != http.StatusNotFound {
+		t.Errorf("request without a fixture = %d", code)
+	}
+	if code, _ := send("GET", "/api/health", "missing"); code != http.StatusNotFound {
+		t.Errorf("unknown scenario = %d", code)
+	}
+
+	resp, err := http.Get(server.URL + "/api/download/00000000-0000-4000-8000-000000000001/vocals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "audio/mpeg" || !strings.HasPrefix(string(data), "ID3") {
+		t.Errorf("download = %s %q", resp.Header.Get("Content-Type"), data)
+	}
+	resp, err = http.Get(server.URL + "/api/fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list struct {
+		Scenarios []fixtureSummary `json:"scenarios"`
+	}
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list.Scenarios) != 3 || list.Scenarios[0].Name != "job-completed" {
+		t.Errorf("list = %+v", list.Scenarios)
+	}
+}
+
+func TestIntegrationFixtureRecord(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("FIXTURE_MODE", "record")
+	t.Setenv("FIXTURE_DIR", dir)
+	t.Cleanup(func() {
+		fixtures = nil
+		clear(recordings)
+	})
+	b := newIntegrationBackend(t, 1)
+	job := b.waitFor(b.upload("song.mp3", map[string]string{"stem_mode": "isolate", "isolate_stem": "vocals"}).ID, "completed")
+	b.get("/api/jobs/" + job.ID + "/outputs")
+
+	data, err := os.ReadFile(filepath.Join(dir, "recorded.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s FixtureScenario
+	json.Unmarshal(data, &s)
+	if len(s.Exchanges) < 3 || s.Exchanges[0].Request.Route != "/api/upload" || s.Exchanges[0].Request.Body != nil {
+		t.Fatalf("recorded = %s", data)
+	}
+	// What the backend really sends matches the schemas
+	if err := loadFixtures(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("FIXTURE_MODE", "replay")
+	if replayed := b.job(job.ID); replayed.ID != job.ID || replayed.FileName != "song.mp3" {
+		t.Errorf("replayed job = %+v", replayed)
+	}
+}
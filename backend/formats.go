@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Extra output formats. extra_formats=mp3,flac next to output_format=wav
+// gets every stem in each format from one separation: the processor writes
+// output_format, and before the job completes the backend transcodes each
+// stem with ffmpeg and registers the copies as outputs named
+// <stem>.<format> ("vocals.mp3"), downloaded, hashed, stored and expired
+// like the stems. Copies are made from output_format, so it has to be a
+// lossless one; mp3_bitrate applies to an mp3 copy.
+
+// losslessFormats are the output formats extra formats can be made from
+var losslessFormats = map[string]bool{"wav": true, "flac": true}
+
+// parseExtraFormats reads a comma-separated extra_formats value
+func parseExtraFormats(raw, primary string) ([]string, error) {
+	var formats []string
+	for _, f := range strings.Split(raw, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !allowedOutputFormats[f] {
+			return nil, invalidOption("extra_formats", sortedKeys(allowedOutputFormats))
+		}
+		if f == primary || slices.Contains(formats, f) {
+			return nil, fmt.Errorf("extra_formats repeats %s", f)
+		}
+		formats = append(formats, f)
+	}
+	if len(formats) > 0 && !losslessFormats[primary] {
+		return nil, fmt.Errorf("extra_formats need a lossless output_format (%s): they are transcoded from it", strings.Join(sortedKeys(losslessFormats), ", "))
+	}
+	slices.Sort(formats)
+	return formats, nil
+}
+
+// formatOutputKey names the copy of a stem in another format
+func formatOutputKey(stem, format string) string {
+	return stem + "." + format
+}
+
+// isFormatOutput reports whether an output is a stem copied to an extra format
+func isFormatOutput(key string) bool {
+	_, format, found := strings.Cut(key, ".")
+	return found && allowedOutputFormats[format]
+}
+
+// addExtraFormats transcodes every stem in outputs to the extra formats and
+// adds the copies to outputs. On failure the copies made so far are removed.
+func addExtraFormats(jobID string, outputs map[string]string, opts jobOptions) error {
+	if len(opts.ExtraFormats) == 0 {
+		return nil
+	}
+	var made []string
+	for _, stem := range sortedKeys(outputs) {
+		src := outputs[stem]
+		if !safeOutputPath(src) {
+			continue
+		}
+		for _, format := range opts.ExtraFormats {
+			dst := withExtension(src, "."+format)
+			if err := encodeStem(src, dst, format, opts.MP3Bitrate); err != nil {
+				for _, path := range made {
+					os.Remove(path)
+				}
+				return fmt.Errorf("Failed to convert %s to %s: %v", stem, format, err)
+			}
+			made = append(made, dst)
+			outputs[formatOutputKey(stem, format)] = dst
+		}
+	}
+	log.Printf("Job %s: converted its stems to %s", jobID, strings.Join(opts.ExtraFormats, ", "))
+	return nil
+}
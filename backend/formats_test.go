@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseExtraFormats(t *testing.T) {
+	opts, err := parseJobOptions(url.Values{"output_format": {"wav"}, "extra_formats": {"mp3, flac"}, "mp3_bitrate": {"192"}}.Get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(opts.ExtraFormats, []string{"flac", "mp3"}) || opts.MP3Bitrate != "192" {
+		t.Errorf("extra formats = %v at %s", opts.ExtraFormats, opts.MP3Bitrate)
+	}
+	// The processor only writes the primary format
+	for _, f := range processorFields("job", opts) {
+		if f[0] == "mp3_bitrate" || f[0] == "extra_formats" {
+			t.Errorf("processor field %s = %s", f[0], f[1])
+		}
+	}
+	if dedupKey("hash", opts) == dedupKey("hash", jobOptions{OutputFormat: "wav", Model: opts.Model}) {
+		t.Error("extra formats don't change the dedup key")
+	}
+
+	for raw, want := range map[string]string{
+		"ogg":      "extra_formats",
+		"wav":      "repeats wav",
+		"mp3,mp3":  "repeats mp3",
+		"wav,flac": "lossless",
+	} {
+		primary := "wav"
+		if want == "lossless" {
+			primary = "mp3"
+		}
+		if _, err := parseJobOptions(url.Values{"output_format": {primary}, "extra_formats": {raw}}.Get); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("extra_formats=%s with %s: %v, want %q", raw, primary, err, want)
+		}
+	}
+	if _, err := parseJobOptions(url.Values{"output_format": {"wav"}, "mp3_bitrate": {"192"}}.Get); err == nil {
+		t.Error("mp3_bitrate without mp3 output was accepted")
+	}
+}
+
+// fakeFFmpeg puts an ffmpeg on PATH that writes its last argument, or
+// fails for outputs ending in failExt
+func fakeFFmpeg(t *testing.T, failExt string) {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\nfor last; do :; done\n"
+	if failExt != "" {
+		script += "case \"$last\" in *" + failExt + ") exit 1;; esac\n"
+	}
+	script += "echo converted > \"$last\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestAddExtraFormats(t *testing.T) {
+	oldOutputDir := outputDir
+	outputDir = t.TempDir()
+	t.Cleanup(func() { outputDir = oldOutputDir })
+	stems := func() map[string]string {
+		outputs := make(map[string]string)
+		for _, stem := range []string{"vocals", "drums"} {
+			path := filepath.Join(outputDir, "job", "song_t2s_"+stem+".wav")
+			os.MkdirAll(filepath.Dir(path), 0755)
+			os.WriteFile(path, []byte("RIFF"), 0644)
+			outputs[stem] = path
+		}
+		return outputs
+	}
+	opts := jobOptions{OutputFormat: "wav", ExtraFormats: []string{"flac", "mp3"}, MP3Bitrate: "320"}
+
+	fakeFFmpeg(t, "")
+	outputs := stems()
+	if err := addExtraFormats("job", outputs, opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 6 {
+		t.Fatalf("outputs = %v", outputs)
+	}
+	if got := outputs["vocals.mp3"]; got != filepath.Join(outputDir, "job", "song_t2s_vocals.mp3") || !isFormatOutput("vocals.mp3") || isFormatOutput("vocals") {
+		t.Errorf("vocals.mp3 = %q", got)
+	}
+	if data, err := os.ReadFile(outputs["drums.flac"]); err != nil || string(data) != "converted\n" {
+		t.Errorf("drums.flac = %q, %v", data, err)
+	}
+
+	// A failed conversion fails the job and leaves only the stems
+	os.RemoveAll(filepath.Join(outputDir, "job"))
+	fakeFFmpeg(t, ".mp3")
+	outputs = stems()
+	if err := addExtraFormats("job", outputs, opts); err == nil || !strings.Contains(err.Error(), "to mp3") {
+		t.Errorf("failed conversion: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(outputDir, "job")); len(entries) != 2 {
+		t.Errorf("%d files left after a failed conversion, want the 2 stems", len(entries))
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The public gallery (PUBLIC_GALLERY=true) lists jobs an admin has marked
+// public at /api/public/jobs. Visitors only get short MP3 previews of the
+// stems, transcoded on the fly; the full-length files stay behind the
+// regular download endpoints.
+
+func galleryEnabled() bool {
+	return os.Getenv("PUBLIC_GALLERY") == "true"
+}
+
+// previewSeconds is the length of gallery and embed previews
+// (PREVIEW_SECONDS, default 30)
+func previewSeconds() int {
+	if n, err := strconv.Atoi(os.Getenv("PREVIEW_SECONDS")); err == nil && n > 0 && n <= 120 {
+		return n
+	}
+	return 30
+}
+
+// publicJob is the gallery view of a job, without file paths or deliveries
+type publicJob struct {
+	ID          string            `json:"id"`
+	FileName    string            `json:"filename"`
+	Metadata    *TrackMetadata    `json:"metadata,omitempty"`
+	Model       string            `json:"model,omitempty"`
+	StemMode    string            `json:"stem_mode,omitempty"`
+	CompletedAt *time.Time        `json:"completed_at,omitempty"`
+	PublishedAt *time.Time        `json:"published_at,omitempty"`
+	Previews    map[string]string `json:"previews"` // stem -> preview URL
+}
+
+func newPublicJob(job Job) publicJob {
+	p := publicJob{
+		ID:          job.ID,
+		FileName:    job.FileName,
+		Metadata:    job.Metadata,
+		Model:       job.Model,
+		StemMode:    job.StemMode,
+		CompletedAt: job.CompletedAt,
+		PublishedAt: job.PublishedAt,
+		Previews:    make(map[string]string, len(job.OutputFiles)),
+	}
+	for stem := range job.OutputFiles {
+		p.Previews[stem] = "/api/public/jobs/" + job.ID + "/preview/" + stem
+	}
+	return p
+}
+
+// galleryAuth hides the public endpoints entirely while the gallery is off
+func galleryAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !galleryEnabled() {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// publicJobSnapshot returns the job if it is public and completed
+func publicJobSnapshot(jobID string) (Job, bool) {
+	jobsMutex.RLock()
+	defer jobsMutex.RUnlock()
+	job, exists := jobs[jobID]
+	if !exists || !job.Public || job.Status != "completed" {
+		return Job{}, false
+	}
+	return job.snapshot(), true
+}
+
+// listPublicJobsHandler lists published jobs, most recently published first
+func listPublicJobsHandler(w http.ResponseWriter, r *http.Request) {
+	jobsMutex.RLock()
+	list := []publicJob{}
+	for _, job := range jobs {
+		if job.Public && job.Status == "completed" {
+			list = append(list, newPublicJob(job.snapshot()))
+		}
+	}
+	jobsMutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].PublishedAt, list[j].PublishedAt
+		if a == nil || b == nil {
+			return list[i].ID < list[j].ID
+		}
+		return a.After(*b)
+	})
+	writeJSON(w, http.StatusOK, list)
+}
+
+func getPublicJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := publicJobSnapshot(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, newPublicJob(job))
+}
+
+// publicPreviewHandler streams the first previewSeconds of a stem as MP3
+func publicPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	job, ok := publicJobSnapshot(vars["id"])
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	streamPreview(w, r, job, vars["stem"])
+}
+
+// streamPreview transcodes the start of a stem to MP3 straight into the
+// response
+func streamPreview(w http.ResponseWriter, r *http.Request, job Job, stem string) {
+	path, exists := job.OutputFiles[stem]
+	if !exists || !safeOutputPath(path) {
+		http.Error(w, "Stem not found", http.StatusNotFound)
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		http.Error(w, "File not found on disk", http.StatusNotFound)
+		return
+	}
+
+	cmd := mediaCommand(r.Context(), "ffmpeg", "-nostdin", "-loglevel", "error",
+		"-t", strconv.Itoa(previewSeconds()), "-i", path,
+		"-vn", "-c:a", "libmp3lame", "-b:a", "128k", "-f", "mp3", "-")
+	cmd.Stdout = w
+	w.Header().Set("Content-Type", "audio/mpeg")
+	w.Header().Set("Content-Disposition", "inline")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if err := cmd.Run(); err != nil && r.Context().Err() == nil {
+		log.Printf("Preview of job %s stem %s failed: %v", job.ID, stem, err)
+	}
+}
+
+// setJobPublicHandler publishes or unpublishes a completed job:
+// PUT /api/admin/jobs/{id}/public with {"public": true|false}
+func setJobPublicHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Public *bool `json:"public"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Public == nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	jobID := mux.Vars(r)["id"]
+	jobsMutex.Lock()
+	job, exists := jobs[jobID]
+	if !exists {
+		jobsMutex.Unlock()
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if *req.Public && job.Status != "completed" {
+		jobsMutex.Unlock()
+		http.Error(w, "Job not completed", http.StatusBadRequest)
+		return
+	}
+	if *req.Public && job.Encrypted {
+		jobsMutex.Unlock()
+		http.Error(w, encryptedJobMessage, http.StatusConflict)
+		return
+	}
+	if *req.Public && !job.Public {
+		now := time.Now().UTC()
+		job.PublishedAt = &now
+	} else if !*req.Public {
+		job.PublishedAt = nil
+	}
+	job.Public = *req.Public
+	snapshot := job.snapshot()
+	jobsMutex.Unlock()
+
+	recordAudit("job.public", jobID, map[string]string{"public": strconv.FormatBool(snapshot.Public)})
+	writeJSON(w, http.StatusOK, snapshot)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPublicGallery(t *testing.T) {
+	oldToken := adminToken
+	adminToken = "admin-secret"
+	t.Cleanup(func() { adminToken = oldToken })
+	jobsMutex.Lock()
+	jobs["gallery-job"] = &Job{ID: "gallery-job", Status: "completed", FileName: "song.mp3",
+		OutputFiles: map[string]string{"vocals": "/app/outputs/gallery-job/vocals.mp3"}}
+	jobs["private-job"] = &Job{ID: "private-job", Status: "completed", FileName: "other.mp3"}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, "gallery-job")
+		delete(jobs, "private-job")
+		jobsMutex.Unlock()
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/admin/jobs/{id}/public", adminAuth(setJobPublicHandler)).Methods("PUT")
+	router.HandleFunc("/api/public/jobs", galleryAuth(listPublicJobsHandler)).Methods("GET")
+	router.HandleFunc("/api/public/jobs/{id}", galleryAuth(getPublicJobHandler)).Methods("GET")
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("GET", "/api/public/jobs", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("gallery disabled: list = %d", rec.Code)
+	}
+	t.Setenv("PUBLIC_GALLERY", "true")
+
+	if rec := do("PUT", "/api/admin/jobs/gallery-job/public", `{"public": true}`); rec.Code != http.StatusOK {
+		t.Fatalf("publish = %d: %s", rec.Code, rec.Body.String())
+	}
+	rec := do("GET", "/api/public/jobs", "")
+	var list []map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if len(list) != 1 || list[0]["id"] != "gallery-job" {
+		t.Fatalf("public jobs = %s", rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "/app/outputs") || strings.Contains(rec.Body.String(), "/api/download/") {
+		t.Errorf("gallery leaks full downloads: %s", rec.Body.String())
+	}
+	if previews, _ := list[0]["previews"].(map[string]interface{}); previews["vocals"] != "/api/public/jobs/gallery-job/preview/vocals" {
+		t.Errorf("previews = %v", list[0]["previews"])
+	}
+	if rec := do("GET", "/api/public/jobs/private-job", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("private job = %d", rec.Code)
+	}
+
+	do("PUT", "/api/admin/jobs/gallery-job/public", `{"public": false}`)
+	if rec := do("GET", "/api/public/jobs/gallery-job", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unpublished job = %d", rec.Code)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Guest links let a user send a collaborator without an API key a link to
+// upload through. A link allows a number of uploads (one by default) of up
+// to max_bytes each until it expires (ttl, default GUEST_LINK_TTL, 3 days).
+// Uploads through it are made on behalf of the key that issued it: the jobs
+// are listed in that key's history, count against its quota and tier and
+// are marked with the link's label as guest_link. Only a successful upload
+// uses up the link. Links are kept in memory, like stream tokens.
+
+// GuestLink allows uploads on behalf of the key that issued it
+type GuestLink struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"` // POST the file here
+	Label     string    `json:"label,omitempty"`
+	APIKeyID  string    `json:"api_key_id,omitempty"` // issuer
+	Uploads   int       `json:"uploads"`              // allowed in total
+	Used      int       `json:"used"`
+	MaxBytes  int64     `json:"max_bytes"` // per upload
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	pending int // uploads in progress, each holding one use
+}
+
+var (
+	guestLinks      = make(map[string]*GuestLink) // by token
+	guestLinksMutex = &sync.Mutex{}
+)
+
+const (
+	maxGuestLinkUploads = 100
+	maxGuestLinkTTL     = 30 * 24 * time.Hour
+)
+
+type guestLinkContextKey struct{}
+
+func guestLinkTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("GUEST_LINK_TTL")); err == nil && d > 0 {
+		return min(d, maxGuestLinkTTL)
+	}
+	return 72 * time.Hour
+}
+
+// guestLinkLabel returns the label of the guest link ctx's upload came
+// through, "guest" for unlabelled links and "" for other uploads
+func guestLinkLabel(ctx context.Context) string {
+	label, _ := ctx.Value(guestLinkContextKey{}).(string)
+	return label
+}
+
+// createGuestLinkHandler issues a link:
+// POST /api/guest-links {"label": "sam", "uploads": 3, "max_bytes": 52428800, "ttl": "24h"}
+func createGuestLinkHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Label    string `json:"label"`
+		Uploads  *int   `json:"uploads"`
+		MaxBytes *int64 `json:"max_bytes"`
+		TTL      string `json:"ttl"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	now := time.Now().UTC()
+	link := &GuestLink{Token: randomToken(24), Label: req.Label, APIKeyID: apiKeyID(r.Context()), Uploads: 1, MaxBytes: maxUploadBytes, CreatedAt: now}
+	if req.Uploads != nil {
+		if *req.Uploads < 1 || *req.Uploads > maxGuestLinkUploads {
+			http.Error(w, "Invalid uploads value", http.StatusBadRequest)
+			return
+		}
+		link.Uploads = *req.Uploads
+	}
+	if req.MaxBytes != nil {
+		if *req.MaxBytes < 1 || *req.MaxBytes > maxUploadBytes {
+			http.Error(w, "Invalid max_bytes value", http.StatusBadRequest)
+			return
+		}
+		link.MaxBytes = *req.MaxBytes
+	}
+	ttl := guestLinkTTL()
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 || d > maxGuestLinkTTL {
+			http.Error(w, "Invalid ttl value", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	if len(link.Label) > 100 {
+		http.Error(w, "Label too long", http.StatusBadRequest)
+		return
+	}
+	link.ExpiresAt = now.Add(ttl)
+	link.URL = publicBaseURL(r) + "/api/guest/" + link.Token + "/upload"
+
+	guestLinksMutex.Lock()
+	guestLinks[link.Token] = link
+	view := *link
+	guestLinksMutex.Unlock()
+	recordAudit("guest_link.created", "", map[string]string{"key_id": link.APIKeyID, "label": link.Label})
+	writeJSON(w, http.StatusCreated, view)
+}
+
+// listGuestLinksHandler lists the unexpired links the requester issued
+func listGuestLinksHandler(w http.ResponseWriter, r *http.Request) {
+	keyID := apiKeyID(r.Context())
+	now := time.Now()
+	list := []GuestLink{}
+	guestLinksMutex.Lock()
+	for _, token := range sortedKeys(guestLinks) {
+		if link := guestLinks[token]; link.APIKeyID == keyID && now.Before(link.ExpiresAt) {
+			list = append(list, *link)
+		}
+	}
+	guestLinksMutex.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+// revokeGuestLinkHandler serves DELETE /api/guest-links/{token}
+func revokeGuestLinkHandler(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	guestLinksMutex.Lock()
+	link, exists := guestLinks[token]
+	exists = exists && link.APIKeyID == apiKeyID(r.Context())
+	if exists {
+		delete(guestLinks, token)
+	}
+	guestLinksMutex.Unlock()
+	if !exists {
+		http.Error(w, "Guest link not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// activeGuestLink returns the link with the token unless it has expired or
+// its issuing key was deleted. Callers hold guestLinksMutex.
+func activeGuestLink(token string, now time.Time) (*GuestLink, bool) {
+	link, exists := guestLinks[token]
+	if !exists || now.After(link.ExpiresAt) {
+		return nil, false
+	}
+	if link.APIKeyID != "" {
+		apiKeysMutex.Lock()
+		_, exists = apiKeys[link.APIKeyID]
+		apiKeysMutex.Unlock()
+	}
+	return link, exists
+}
+
+// guestLinkHandler tells a guest what the link allows: GET /api/guest/{token}
+func guestLinkHandler(w http.ResponseWriter, r *http.Request) {
+	guestLinksMutex.Lock()
+	link, ok := activeGuestLink(mux.Vars(r)["token"], time.Now())
+	var info map[string]interface{}
+	if ok {
+		info = map[string]interface{}{
+			"label":        link.Label,
+			"uploads_left": link.Uploads - link.Used,
+			"max_bytes":    link.MaxBytes,
+			"expires_at":   link.ExpiresAt,
+		}
+	}
+	guestLinksMutex.Unlock()
+	if !ok {
+		http.Error(w, "Guest link not found or expired", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// guestUploadHandler uploads a file through a link, as POST /api/upload
+// would for the link's issuer: POST /api/guest/{token}/upload
+func guestUploadHandler(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	guestLinksMutex.Lock()
+	link, ok := activeGuestLink(token, time.Now())
+	full := ok && link.Used+link.pending >= link.Uploads
+	var issuer, label string
+	var maxBytes int64
+	if ok && !full {
+		// Hold a use so concurrent uploads can't exceed the link
+		link.pending++
+		issuer, label, maxBytes = link.APIKeyID, link.Label, link.MaxBytes
+	}
+	guestLinksMutex.Unlock()
+	switch {
+	case !ok:
+		http.Error(w, "Guest link not found or expired", http.StatusNotFound)
+		return
+	case full:
+		http.Error(w, "Guest link has no uploads left", http.StatusGone)
+		return
+	}
+
+	rec := &statusRecorder{ResponseWriter: w}
+	defer func() {
+		guestLinksMutex.Lock()
+		link.pending--
+		if rec.status == http.StatusOK && r.FormValue("dry_run") != "true" {
+			link.Used++
+		}
+		guestLinksMutex.Unlock()
+	}()
+
+	// Multipart framing and form fields on top of the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+1<<20)
+	err := r.ParseMultipartForm(32 << 20)
+	if err == nil && r.MultipartForm.File["file"] != nil && r.MultipartForm.File["file"][0].Size > maxBytes {
+		err = &http.MaxBytesError{Limit: maxBytes}
+	}
+	if isBodyTooLarge(err) {
+		writeRejection(rec, http.StatusRequestEntityTooLarge, "file_too_large", "File exceeds the guest link's size limit", sizeRemedy(maxBytes))
+		return
+	}
+
+	if label == "" {
+		label = "guest"
+	}
+	ctx := context.WithValue(r.Context(), apiKeyContextKey{}, issuer)
+	ctx = context.WithValue(ctx, guestLinkContextKey{}, label)
+	requireTerms(requireQuota(uploadHandler))(rec, r.WithContext(ctx))
+}
+
+// guestLinkReaper drops expired links every interval
+func guestLinkReaper(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		guestLinksMutex.Lock()
+		for token, link := range guestLinks {
+			if now.After(link.ExpiresAt) && link.pending == 0 {
+				delete(guestLinks, token)
+			}
+		}
+		guestLinksMutex.Unlock()
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIntegrationGuestLinks(t *testing.T) {
+	t.Setenv("API_KEYS_REQUIRED", "true")
+	apiKeysMutex.Lock()
+	apiKeys["guest-issuer"] = &APIKey{ID: "guest-issuer", Name: "issuer", Hash: hashAPIKey("t2s_issuer")}
+	apiKeysMutex.Unlock()
+	t.Cleanup(func() {
+		apiKeysMutex.Lock()
+		delete(apiKeys, "guest-issuer")
+		apiKeysMutex.Unlock()
+		guestLinksMutex.Lock()
+		guestLinks = make(map[string]*GuestLink)
+		guestLinksMutex.Unlock()
+	})
+	b := newIntegrationBackend(t, 1)
+
+	do := func(method, path, key, body string) (int, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(method, b.URL+path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, data
+	}
+	upload := func(url string, size int) (int, []byte) {
+		t.Helper()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", "song.mp3")
+		part.Write([]byte("ID3 "))
+		part.Write(bytes.Repeat([]byte{0}, size))
+		mw.Close()
+		resp, err := http.Post(url, mw.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, data
+	}
+
+	if code, _ := do("POST", "/api/guest-links", "", `{}`); code != http.StatusUnauthorized {
+		t.Errorf("link without a key = %d", code)
+	}
+	if code, _ := do("POST", "/api/guest-links", "t2s_issuer", `{"uploads": 0}`); code != http.StatusBadRequest {
+		t.Errorf("link for no uploads = %d", code)
+	}
+	code, data := do("POST", "/api/guest-links", "t2s_issuer", `{"label": "sam", "max_bytes": 1000}`)
+	var link GuestLink
+	if json.Unmarshal(data, &link); code != http.StatusCreated || link.Uploads != 1 || !strings.HasSuffix(link.URL, "/api/guest/"+link.Token+"/upload") {
+		t.Fatalf("create link = %d: %s", code, data)
+	}
+	if code, data := do("GET", "/api/guest/"+link.Token, "", ""); code != http.StatusOK || !strings.Contains(string(data), `"uploads_left":1`) {
+		t.Errorf("link info = %d: %s", code, data)
+	}
+
+	// A refused upload doesn't use the link up
+	if code, _ := upload(link.URL, 2000); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload over the link's limit = %d", code)
+	}
+	code, data = upload(link.URL, 100)
+	var job Job
+	if json.Unmarshal(data, &job); code != http.StatusOK || job.APIKeyID != "guest-issuer" || job.GuestLink != "sam" {
+		t.Fatalf("guest upload = %d: %s", code, data)
+	}
+	if code, _ := upload(link.URL, 100); code != http.StatusGone {
+		t.Errorf("second upload through a one-time link = %d", code)
+	}
+
+	// The job is in the issuer's history
+	code, data = do("GET", "/api/jobs", "t2s_issuer", "")
+	var list JobList
+	if json.Unmarshal(data, &list); code != http.StatusOK || len(list.Jobs) != 1 || list.Jobs[0].ID != job.ID {
+		t.Errorf("issuer's jobs = %d: %s", code, data)
+	}
+	if code, data := do("GET", "/api/guest-links", "t2s_issuer", ""); code != http.StatusOK || !strings.Contains(string(data), `"used":1`) {
+		t.Errorf("issuer's links = %d: %s", code, data)
+	}
+
+	if code, _ := do("DELETE", "/api/guest-links/"+link.Token, "t2s_issuer", ""); code != http.StatusNoContent {
+		t.Errorf("revoke = %d", code)
+	}
+	if code, _ := do("GET", "/api/guest/"+link.Token, "", ""); code != http.StatusNotFound {
+		t.Errorf("revoked link info = %d", code)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Immutable stem URLs. Once a job completes, its outputs are hashed in the
+// background and the SHA-256 of each is listed under output_hashes.
+// /api/download/{id}/{stem}/{hash} serves that exact content with a year-long
+// immutable Cache-Control, so browsers and CDNs never re-fetch it; a hash that
+// no longer matches the stem is a 404 rather than different bytes. The plain
+// /api/download/{id}/{stem} carries the hash as its ETag and must be
+// revalidated, answering 304 when it is unchanged.
+
+const immutableCacheControl = "max-age=31536000, immutable"
+
+// hashOutputs is the event listener that hashes the stems of completed jobs
+func hashOutputs(e Event) {
+	if e.Type == EventJobCompleted && !e.Job.SelfTest {
+		go hashJobOutputs(e.Job.ID)
+	}
+}
+
+// hashJobOutputs records the hash of every output of a job that has none yet
+func hashJobOutputs(jobID string) {
+	jobsMutex.RLock()
+	job, exists := jobs[jobID]
+	pending := map[string]string{}
+	if exists {
+		for stem, path := range job.OutputFiles {
+			if job.OutputHashes[stem] == "" {
+				pending[stem] = path
+			}
+		}
+	}
+	jobsMutex.RUnlock()
+
+	for _, stem := range sortedKeys(pending) {
+		path := pending[stem]
+		if !safeOutputPath(path) {
+			continue
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			log.Printf("Failed to hash %s of job %s: %v", stem, jobID, err)
+			continue
+		}
+		jobsMutex.Lock()
+		// The stem may have been replaced or the job expired while hashing
+		if job.OutputFiles[stem] == path && job.Status == "completed" {
+			if job.OutputHashes == nil {
+				job.OutputHashes = make(map[string]string)
+			}
+			job.OutputHashes[stem] = sum
+		}
+		jobsMutex.Unlock()
+	}
+}
+
+// stemVersionMatches checks the {hash} of a versioned download against the
+// stem's current hash, writing a 404 when it is stale
+func stemVersionMatches(w http.ResponseWriter, r *http.Request, hash string) bool {
+	if version := mux.Vars(r)["hash"]; version != "" && version != hash {
+		http.Error(w, "Stem version not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// cacheHeaders sets the caching headers of a stem served from disk
+func cacheHeaders(w http.ResponseWriter, r *http.Request, hash string, keyed bool) {
+	if mux.Vars(r)["hash"] != "" {
+		// Keyed jobs need the caller's credentials, so shared caches can't keep them
+		scope := "public, "
+		if keyed {
+			scope = "private, "
+		}
+		w.Header().Set("Cache-Control", scope+immutableCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if hash != "" {
+		w.Header().Set("ETag", `"`+hash+`"`)
+	}
+}
+
+// matchesETag reports whether an If-None-Match header lists etag
+func matchesETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func TestImmutableDownloads(t *testing.T) {
+	oldOutputDir := outputDir
+	outputDir = t.TempDir()
+	t.Cleanup(func() { outputDir = oldOutputDir })
+
+	id := uuid.New().String()
+	path := filepath.Join(outputDir, id, "song_t2s_vocals.mp3")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	os.WriteFile(path, []byte("vocals"), 0644)
+	jobsMutex.Lock()
+	jobs[id] = &Job{ID: id, Status: "completed", OutputFiles: map[string]string{"vocals": path}}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+	})
+
+	hashJobOutputs(id)
+	jobsMutex.RLock()
+	hash := jobs[id].OutputHashes["vocals"]
+	jobsMutex.RUnlock()
+	if want, _ := fileSHA256(path); hash != want {
+		t.Fatalf("output hash = %q, want %q", hash, want)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/download/{id}/{stem}", downloadHandler)
+	router.HandleFunc("/api/download/{id}/{stem}/{hash}", downloadHandler)
+	get := func(url, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/api/download/"+id+"/vocals/"+hash, "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "vocals" ||
+		rec.Header().Get("Cache-Control") != "public, max-age=31536000, immutable" {
+		t.Errorf("versioned download = %d %q, Cache-Control %q", rec.Code, rec.Body, rec.Header().Get("Cache-Control"))
+	}
+	rec = get("/api/download/"+id+"/vocals", "")
+	if rec.Header().Get("Cache-Control") != "no-cache" || rec.Header().Get("ETag") != `"`+hash+`"` {
+		t.Errorf("plain download headers = %v", rec.Header())
+	}
+	if rec := get("/api/download/"+id+"/vocals", `W/"other", "`+hash+`"`); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("revalidation = %d %q, want 304", rec.Code, rec.Body)
+	}
+	if rec := get("/api/download/"+id+"/vocals/0123abcd", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("stale version = %d, want 404", rec.Code)
+	}
+
+	jobsMutex.Lock()
+	jobs[id].OutputHashes = nil
+	jobsMutex.Unlock()
+	if rec := get("/api/download/"+id+"/vocals", ""); rec.Code != http.StatusOK || rec.Header().Get("ETag") != "" {
+		t.Errorf("download before hashing = %d, ETag %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
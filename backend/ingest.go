@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// IngestSession records a live RTMP/Icecast stream in fixed-length segments
+// and creates one separation job per recorded segment.
+type IngestSession struct {
+	ID             string     `json:"id"`
+	URL            string     `json:"url"`
+	Name           string     `json:"name"`
+	Status         string     `json:"status"` // recording, stopped, failed
+	SegmentSeconds int        `json:"segment_seconds"`
+	MaxSegments    int        `json:"max_segments,omitempty"`
+	Segments       int        `json:"segments"`
+	JobIDs         []string   `json:"job_ids"`
+	StartedAt      time.Time  `json:"started_at"`
+	StoppedAt      *time.Time `json:"stopped_at,omitempty"`
+	Error          string     `json:"error,omitempty"`
+
+	opts      jobOptions
+	apiKeyID  string // key that started the session, owner of its jobs
+	requestID string // request that started the session, passed to its jobs
+	cancel    context.CancelFunc
+}
+
+// ingestRequest is the JSON body of POST /api/ingest; separation options use
+// the same names and defaults as the upload form
+type ingestRequest struct {
+	URL            string `json:"url"`
+	Name           string `json:"name"`
+	SegmentSeconds int    `json:"segment_seconds"`
+	MaxSegments    int    `json:"max_segments"`
+	StemMode       string `json:"stem_mode"`
+	IsolateStem    string `json:"isolate_stem"`
+	OutputFormat   string `json:"output_format"`
+	Model          string `json:"model"`
+	Segment        string `json:"segment"`
+	Overlap        string `json:"overlap"`
+	Shifts         string `json:"shifts"`
+	ClipMode       string `json:"clip_mode"`
+	MP3Bitrate     string `json:"mp3_bitrate"`
+	ExtraFormats   string `json:"extra_formats"`
+	Deterministic  string `json:"deterministic"`
+	Seed           string `json:"seed"`
+	Pipeline       string `json:"pipeline"`
+	Advanced       string `json:"advanced_options"`
+	Preset         string `json:"preset"`
+	Template       string `json:"template"`
+	Org            string `json:"org"`
+}
+
+const (
+	minIngestSegmentSeconds = 30
+	maxIngestSegmentSeconds = 3600
+	// maxIngestFailures is how many consecutive failed recordings end a session
+	maxIngestFailures = 5
+	// ingestShortfallSeconds is how much shorter than segment_seconds a
+	// recording may be, for the frames ffmpeg rounds off
+	ingestShortfallSeconds = 1
+)
+
+var (
+	ingestSessions      = make(map[string]*IngestSession)
+	ingestSessionsMutex = &sync.RWMutex{}
+	// allowedIngestSchemes are the stream protocols that can be recorded
+	allowedIngestSchemes = map[string]bool{"rtmp": true, "rtmps": true, "http": true, "https": true}
+	// rtmpProtocols are what ffmpeg may use to read an RTMP stream it dials
+	// itself, so it can't be sent on to anything else
+	rtmpProtocols = map[string]string{"rtmp": "rtmp,tcp", "rtmps": "rtmps,tls,tcp"}
+	// ingestClient fetches HTTP streams, checking every address and redirect
+	ingestClient = newStreamClient()
+)
+
+// ingestEnabled reports whether stream ingest is switched on (INGEST_ENABLED=true)
+func ingestEnabled() bool {
+	return os.Getenv("INGEST_ENABLED") == "true"
+}
+
+// defaultIngestSegmentSeconds reads INGEST_SEGMENT_SECONDS (default 10 minutes)
+func defaultIngestSegmentSeconds() int {
+	if n, err := strconv.Atoi(os.Getenv("INGEST_SEGMENT_SECONDS")); err == nil && n > 0 {
+		return n
+	}
+	return 600
+}
+
+// validateIngestURL accepts only absolute stream URLs with an allowed scheme
+func validateIngestURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("Invalid stream url")
+	}
+	if !allowedIngestSchemes[u.Scheme] {
+		return fmt.Errorf("Unsupported stream scheme: %s", u.Scheme)
+	}
+	if err := checkOutboundURL(u); err != nil {
+		return fmt.Errorf("Invalid stream url: %v", err)
+	}
+	return nil
+}
+
+func createIngestHandler(w http.ResponseWriter, r *http.Request) {
+	if !ingestEnabled() {
+		http.Error(w, "Stream ingest disabled", http.StatusForbidden)
+		return
+	}
+
+	var req ingestRequest
+	fieldNames, err := decodeJobRequest(r, &req)
+	if err != nil {
+		http.Error(w, "Invalid ingest request", http.StatusBadRequest)
+		return
+	}
+	if err := validateIngestURL(req.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.SegmentSeconds == 0 {
+		req.SegmentSeconds = defaultIngestSegmentSeconds()
+	}
+	if req.SegmentSeconds < minIngestSegmentSeconds || req.SegmentSeconds > maxIngestSegmentSeconds {
+		http.Error(w, "Invalid segment_seconds value", http.StatusBadRequest)
+		return
+	}
+	if req.MaxSegments < 0 {
+		http.Error(w, "Invalid max_segments value", http.StatusBadRequest)
+		return
+	}
+
+	fields := map[string]string{
+		"stem_mode": req.StemMode, "isolate_stem": req.IsolateStem, "output_format": req.OutputFormat,
+		"model": req.Model, "segment": req.Segment, "overlap": req.Overlap, "shifts": req.Shifts, "clip_mode": req.ClipMode,
+		"mp3_bitrate": req.MP3Bitrate, "extra_formats": req.ExtraFormats,
+		"deterministic": req.Deterministic, "seed": req.Seed, "pipeline": req.Pipeline,
+		"advanced_options": req.Advanced, "preset": req.Preset, "template": req.Template, "org": req.Org,
+	}
+	opts, err := parseJobOptions(func(key string) string { return fields[key] })
+	if err == nil {
+		err = opts.checkFields(fieldNames, jsonFieldNames(&req), strictOptions(r))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if uerr := checkOrg(r.Context(), opts.Org); uerr != nil {
+		uerr.write(w)
+		return
+	}
+
+	name := req.Name
+	if name == "" {
+		name = "stream"
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &IngestSession{
+		ID:             uuid.New().String(),
+		URL:            req.URL,
+		Name:           sanitizeFilename(name),
+		Status:         "recording",
+		SegmentSeconds: req.SegmentSeconds,
+		MaxSegments:    req.MaxSegments,
+		JobIDs:         []string{},
+		StartedAt:      time.Now().UTC(),
+		opts:           opts,
+		apiKeyID:       apiKeyID(r.Context()),
+		requestID:      requestID(r.Context()),
+		cancel:         cancel,
+	}
+
+	ingestSessionsMutex.Lock()
+	ingestSessions[session.ID] = session
+	ingestSessionsMutex.Unlock()
+
+	go runIngest(ctx, session)
+	log.Printf("Ingest session %s started for %s (%ds segments)", session.ID, session.URL, session.SegmentSeconds)
+
+	writeJSON(w, http.StatusCreated, snapshotIngest(session))
+}
+
+func listIngestHandler(w http.ResponseWriter, r *http.Request) {
+	ingestSessionsMutex.RLock()
+	list := make([]IngestSession, 0, len(ingestSessions))
+	for _, session := range ingestSessions {
+		if ownedByRequest(r, session.apiKeyID) {
+			list = append(list, *session)
+		}
+	}
+	ingestSessionsMutex.RUnlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+func getIngestHandler(w http.ResponseWriter, r *http.Request) {
+	ingestSessionsMutex.RLock()
+	session, exists := ingestSessions[mux.Vars(r)["id"]]
+	exists = exists && ownedByRequest(r, session.apiKeyID)
+	var snapshot IngestSession
+	if exists {
+		snapshot = *session
+	}
+	ingestSessionsMutex.RUnlock()
+	if !exists {
+		http.Error(w, "Ingest session not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+func stopIngestHandler(w http.ResponseWriter, r *http.Request) {
+	ingestSessionsMutex.Lock()
+	session, exists := ingestSessions[mux.Vars(r)["id"]]
+	exists = exists && ownedByRequest(r, session.apiKeyID)
+	if exists && session.Status == "recording" {
+		session.cancel()
+		session.Status = "stopped"
+		now := time.Now().UTC()
+		session.StoppedAt = &now
+	}
+	ingestSessionsMutex.Unlock()
+	if !exists {
+		http.Error(w, "Ingest session not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "stopped"})
+}
+
+// snapshotIngest copies a session under the lock for safe encoding
+func snapshotIngest(session *IngestSession) IngestSession {
+	ingestSessionsMutex.RLock()
+	defer ingestSessionsMutex.RUnlock()
+	return *session
+}
+
+// runIngest records segments back to back until the session is stopped,
+// reaches max_segments or the stream fails repeatedly. Every segment goes
+// through the checks of an upload from the session's key; the session
+// stops once the key is over its quota, a segment is over its tier or the
+// session's organization refuses it.
+func runIngest(ctx context.Context, session *IngestSession) {
+	// Checks that read the key or request ID find them as on a request
+	keyCtx := context.WithValue(context.WithValue(ctx, apiKeyContextKey{}, session.apiKeyID), requestIDContextKey{}, session.requestID)
+	failures := 0
+	for n := 0; ctx.Err() == nil; n++ {
+		if session.MaxSegments > 0 && n >= session.MaxSegments {
+			finishIngest(session, "stopped", "")
+			return
+		}
+		if quotaExceeded(session.apiKeyID) {
+			log.Printf("Ingest session %s stopped: key %s is over its quota", session.ID, session.apiKeyID)
+			finishIngest(session, "failed", quotaExceededMessage)
+			return
+		}
+
+		fileName := fmt.Sprintf("%s_segment%04d.flac", session.Name, n)
+		jobID := uuid.New().String()
+		segmentPath := filepath.Join(uploadDir, jobID+"_"+fileName)
+
+		err := recordSegment(ctx, session.URL, segmentPath, session.SegmentSeconds)
+		if err != nil {
+			os.Remove(segmentPath)
+		} else if uerr := acceptSegment(keyCtx, session, jobID, fileName, segmentPath); uerr != nil {
+			if uerr.Tier != nil || session.opts.Org != "" && (uerr.Code == "org_forbidden" || uerr.Code == "quota_exceeded") {
+				log.Printf("Ingest session %s stopped: segment %d refused: %s", session.ID, n, uerr.Message)
+				finishIngest(session, "failed", uerr.Message)
+				return
+			}
+			err = errors.New(uerr.Message)
+		}
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			failures++
+			log.Printf("Ingest session %s segment %d failed (%d/%d): %v", session.ID, n, failures, maxIngestFailures, err)
+			if failures >= maxIngestFailures {
+				finishIngest(session, "failed", err.Error())
+				return
+			}
+			n--
+			select {
+			case <-time.After(time.Duration(failures) * 5 * time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		failures = 0
+		log.Printf("Ingest session %s recorded segment %d as job %s", session.ID, n, jobID)
+	}
+}
+
+// acceptSegment turns a recorded segment into a job of the session, with
+// the scan, tier, policy and dedup checks of an upload
+func acceptSegment(ctx context.Context, session *IngestSession, jobID, fileName, segmentPath string) *uploadError {
+	opts := session.opts
+	opts.Watermark = jobWatermark(session.apiKeyID)
+	job := newJob(jobID, fileName, opts)
+	job.APIKeyID = session.apiKeyID
+	job.Region = currentRegion()
+	job.RequestID = session.requestID
+	jobsMutex.Lock()
+	jobs[jobID] = job
+	jobsMutex.Unlock()
+
+	uerr := acceptUpload(ctx, job, segmentPath, false)
+	jobsMutex.RLock()
+	_, kept := jobs[jobID]
+	jobsMutex.RUnlock()
+	if kept {
+		// Segments blocked by the policy stay as failed jobs, like uploads
+		ingestSessionsMutex.Lock()
+		session.Segments++
+		session.JobIDs = append(session.JobIDs, jobID)
+		ingestSessionsMutex.Unlock()
+	}
+	return uerr
+}
+
+// recordSegment captures seconds of audio from the stream into a FLAC file.
+// HTTP streams are fetched by the backend and piped into ffmpeg, which
+// would otherwise follow redirects and playlist entries anywhere; RTMP
+// streams are dialed by ffmpeg, kept to the RTMP protocols.
+func recordSegment(ctx context.Context, streamURL, dst string, seconds int) error {
+	u, err := url.Parse(streamURL)
+	if err != nil {
+		return err
+	}
+	// Allow some slack beyond the segment length for connection setup
+	recordCtx, cancel := context.WithTimeout(ctx, time.Duration(seconds)*time.Second+2*time.Minute)
+	defer cancel()
+
+	output := []string{"-t", strconv.Itoa(seconds), "-vn", "-c:a", "flac", dst}
+	var cmd *exec.Cmd
+	if protocols, ok := rtmpProtocols[u.Scheme]; ok {
+		// ffmpeg does its own dialing, so re-check where the host resolves to now
+		if err := resolveOutboundHost(ctx, u.Hostname()); err != nil {
+			return err
+		}
+		args := append([]string{"-y", "-nostdin", "-loglevel", "error", "-protocol_whitelist", protocols, "-i", streamURL}, output...)
+		cmd = networkMediaCommand(recordCtx, "ffmpeg", args...)
+	} else {
+		req, err := http.NewRequestWithContext(recordCtx, "GET", streamURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := ingestClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("stream returned %d", resp.StatusCode)
+		}
+		cmd = mediaCommand(recordCtx, "ffmpeg", append([]string{"-y", "-loglevel", "error", "-i", "pipe:0"}, output...)...)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		// ffmpeg stops reading after the segment; the deferred cancel ends the copy
+		go func() {
+			io.Copy(stdin, resp.Body)
+			stdin.Close()
+		}()
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, lastLine(string(out)))
+	}
+	if info, statErr := os.Stat(dst); statErr != nil || info.Size() == 0 {
+		return fmt.Errorf("no audio recorded")
+	}
+	// A stream that ends or drops mid-segment leaves a short file
+	probe, err := probeAudio(ctx, dst)
+	if err != nil {
+		return fmt.Errorf("recorded segment unreadable: %v", err)
+	}
+	return checkSegmentLength(probe.DurationSeconds, seconds)
+}
+
+// checkSegmentLength fails a recording shorter than the segment asked for
+func checkSegmentLength(recorded float64, seconds int) error {
+	if recorded < float64(seconds-ingestShortfallSeconds) {
+		return fmt.Errorf("stream ended after %.1fs of a %ds segment", recorded, seconds)
+	}
+	return nil
+}
+
+// finishIngest marks a session as no longer recording
+func finishIngest(session *IngestSession, status, errMsg string) {
+	ingestSessionsMutex.Lock()
+	defer ingestSessionsMutex.Unlock()
+	if session.Status != "recording" {
+		return
+	}
+	session.Status = status
+	session.Error = errMsg
+	now := time.Now().UTC()
+	session.StoppedAt = &now
+	session.cancel()
+}
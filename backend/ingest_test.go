@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestValidateIngestURL(t *testing.T) {
+	valid := []string{
+		"rtmp://live.example.com/app/stream",
+		"https://radio.example.com:8000/stream.mp3",
+		"http://icecast.local/live",
+	}
+	for _, u := range valid {
+		if err := validateIngestURL(u); err != nil {
+			t.Errorf("expected %q to be accepted: %v", u, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"file:///etc/passwd",
+		"concat:/app/uploads/a.mp3",
+		"/app/uploads/song.mp3",
+		"rtmp://",
+	}
+	for _, u := range invalid {
+		if err := validateIngestURL(u); err == nil {
+			t.Errorf("expected %q to be rejected", u)
+		}
+	}
+}
+
+func TestCreateIngestValidation(t *testing.T) {
+	t.Setenv("INGEST_ENABLED", "true")
+
+	bodies := []string{
+		`not json`,
+		`{"url": "file:///etc/passwd"}`,
+		`{"url": "rtmp://live.example.com/app", "segment_seconds": 5}`,
+		`{"url": "rtmp://live.example.com/app", "model": "evil"}`,
+	}
+	for _, body := range bodies {
+		rec := httptest.NewRecorder()
+		createIngestHandler(rec, httptest.NewRequest("POST", "/api/ingest", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("body %s: got %d, want 400", body, rec.Code)
+		}
+	}
+}
+
+func TestCreateIngestDisabled(t *testing.T) {
+	t.Setenv("INGEST_ENABLED", "")
+	rec := httptest.NewRecorder()
+	createIngestHandler(rec, httptest.NewRequest("POST", "/api/ingest", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got %d, want 403", rec.Code)
+	}
+}
+
+func TestIngestSessionsScopedByKey(t *testing.T) {
+	ingestSessionsMutex.Lock()
+	ingestSessions["ingest-alice"] = &IngestSession{ID: "ingest-alice", Status: "recording", apiKeyID: "alice", cancel: func() {}}
+	ingestSessionsMutex.Unlock()
+	t.Cleanup(func() {
+		ingestSessionsMutex.Lock()
+		delete(ingestSessions, "ingest-alice")
+		ingestSessionsMutex.Unlock()
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/ingest", listIngestHandler).Methods("GET")
+	router.HandleFunc("/api/ingest/{id}", getIngestHandler).Methods("GET")
+	router.HandleFunc("/api/ingest/{id}", stopIngestHandler).Methods("DELETE")
+	as := func(key, method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, key))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var list []IngestSession
+	json.Unmarshal(as("bob", "GET", "/api/ingest").Body.Bytes(), &list)
+	if len(list) != 0 {
+		t.Errorf("bob listed %+v", list)
+	}
+	for _, method := range []string{"GET", "DELETE"} {
+		if rec := as("bob", method, "/api/ingest/ingest-alice"); rec.Code != http.StatusNotFound {
+			t.Errorf("bob %s alice's session = %d", method, rec.Code)
+		}
+	}
+	if snapshotIngest(ingestSessions["ingest-alice"]).Status != "recording" {
+		t.Error("bob stopped alice's session")
+	}
+	if rec := as("alice", "DELETE", "/api/ingest/ingest-alice"); rec.Code != http.StatusOK {
+		t.Errorf("alice stopping her session = %d", rec.Code)
+	}
+}
+
+func TestIngestClientReadsPastOutboundLimit(t *testing.T) {
+	const streamed = 12 << 20
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 64<<10)
+		for sent := 0; sent < streamed; sent += len(chunk) {
+			w.Write(chunk)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("OUTBOUND_ALLOW_PRIVATE", "true")
+
+	resp, err := ingestClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil || n != streamed {
+		t.Errorf("streamed %d bytes, err %v; want %d", n, err, streamed)
+	}
+
+	// Other outbound requests keep the size limit
+	resp, err = newOutboundClient(0).Get(server.URL)
+	if err == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Error("outbound client read past OUTBOUND_MAX_BYTES")
+	}
+}
+
+func TestCheckSegmentLength(t *testing.T) {
+	if err := checkSegmentLength(599.6, 600); err != nil {
+		t.Errorf("full segment: %v", err)
+	}
+	if err := checkSegmentLength(183, 600); err == nil || !strings.Contains(err.Error(), "ended after 183.0s") {
+		t.Errorf("short segment err = %v", err)
+	}
+}
+
+func TestIngestSegmentsCheckedLikeUploads(t *testing.T) {
+	oldUploadDir := uploadDir
+	uploadDir = t.TempDir()
+	t.Cleanup(func() { uploadDir = oldUploadDir })
+	t.Setenv("TIERS", "free formats=mp3, studio")
+	apiKeysMutex.Lock()
+	apiKeys["ingest-free"] = &APIKey{ID: "ingest-free", Tier: "free"}
+	apiKeys["ingest-spent"] = &APIKey{ID: "ingest-spent", MonthlyMinutes: 1, Usage: map[string]float64{usageMonth(time.Now()): 2}}
+	apiKeysMutex.Unlock()
+	t.Cleanup(func() {
+		apiKeysMutex.Lock()
+		delete(apiKeys, "ingest-free")
+		delete(apiKeys, "ingest-spent")
+		apiKeysMutex.Unlock()
+	})
+
+	// A segment over the key's tier never becomes a job
+	opts, _ := parseJobOptions(func(key string) string { return map[string]string{"output_format": "flac"}[key] })
+	session := &IngestSession{ID: "ingest-tier", Name: "show", opts: opts, apiKeyID: "ingest-free", JobIDs: []string{}}
+	ctx := context.WithValue(context.Background(), apiKeyContextKey{}, session.apiKeyID)
+	path := filepath.Join(uploadDir, "tier-job_show_segment0000.flac")
+	os.WriteFile(path, []byte("fLaC"), 0644)
+	uerr := acceptSegment(ctx, session, "tier-job", "show_segment0000.flac", path)
+	if uerr == nil || uerr.Tier == nil || uerr.Tier.Limit != "output_format" {
+		t.Fatalf("segment over the tier = %+v", uerr)
+	}
+	jobsMutex.RLock()
+	_, exists := jobs["tier-job"]
+	jobsMutex.RUnlock()
+	if _, err := os.Stat(path); exists || err == nil || session.Segments != 0 {
+		t.Errorf("refused segment kept: job %v, file err %v, segments %d", exists, err, session.Segments)
+	}
+
+	// A key over its quota records nothing
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	session = &IngestSession{ID: "ingest-quota", URL: "http://stream.invalid/live", Status: "recording", Name: "show",
+		SegmentSeconds: 30, apiKeyID: "ingest-spent", JobIDs: []string{}, cancel: cancel}
+	done := make(chan struct{})
+	go func() {
+		runIngest(runCtx, session)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session over quota kept recording")
+	}
+	if got := snapshotIngest(session); got.Status != "failed" || got.Error != quotaExceededMessage {
+		t.Errorf("session over quota = %s %q", got.Status, got.Error)
+	}
+}
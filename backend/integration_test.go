@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// End-to-end flows through the real router and job queue against
+// mockProcessor: upload, progress, download, processor failures, queueing
+// and cancellation.
+
+func (b *integrationBackend) upload(fileName string, fields map[string]string) Job {
+	b.t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", fileName)
+	part.Write([]byte("ID3 " + fileName))
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	mw.Close()
+	resp, err := http.Post(b.URL+"/api/upload", mw.FormDataContentType(), &body)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		b.t.Fatalf("upload %s = %d: %s", fileName, resp.StatusCode, data)
+	}
+	var job Job
+	json.NewDecoder(resp.Body).Decode(&job)
+	return job
+}
+
+func (b *integrationBackend) get(path string) (int, []byte) {
+	b.t.Helper()
+	resp, err := http.Get(b.URL + path)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, data
+}
+
+func (b *integrationBackend) job(id string) Job {
+	b.t.Helper()
+	code, data := b.get("/api/jobs/" + id)
+	if code != http.StatusOK {
+		b.t.Fatalf("job %s = %d: %s", id, code, data)
+	}
+	var job Job
+	json.Unmarshal(data, &job)
+	return job
+}
+
+// waitFor polls a job until it has the given status
+func (b *integrationBackend) waitFor(id, status string) Job {
+	b.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job := b.job(id)
+		if job.Status == status {
+			return job
+		}
+		if time.Now().After(deadline) {
+			b.t.Fatalf("job %s is %s (%s), want %s", id, job.Status, job.Error, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// progressEvents reads a job's event stream until it ends
+func (b *integrationBackend) progressEvents(id string) []jobProgress {
+	b.t.Helper()
+	resp, err := http.Get(b.URL + "/api/jobs/" + id + "/events")
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var events []jobProgress
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			var p jobProgress
+			json.Unmarshal([]byte(data), &p)
+			events = append(events, p)
+		}
+	}
+	return events
+}
+
+func TestIntegrationUploadProgressDownload(t *testing.T) {
+	b := newIntegrationBackend(t, 1)
+	b.processor.Delay = 200 * time.Millisecond
+
+	job := b.upload("song.mp3", map[string]string{"stem_mode": "isolate", "isolate_stem": "vocals", "output_format": "wav"})
+	events := b.progressEvents(job.ID)
+	var sawProgress bool
+	for _, p := range events {
+		sawProgress = sawProgress || (p.Status == "processing" && p.Progress == 50 && p.Stage == "Separating")
+	}
+	if !sawProgress || len(events) == 0 || events[len(events)-1].Status != "completed" {
+		t.Errorf("progress events = %+v", events)
+	}
+
+	job = b.job(job.ID)
+	if len(job.OutputFiles) != 2 || job.OutputFiles["instrumental"] == "" || job.ProcessingTime != "200ms" ||
+		job.Environment == nil || job.Environment.Instance != "mock-processor" {
+		t.Errorf("completed job = %+v", job)
+	}
+	requests := b.processor.Requests()
+	if len(requests) != 1 || requests[0]["stem_mode"] != "isolate" || requests[0]["output_format"] != "wav" ||
+		requests[0]["filename"] != job.ID+"_song.mp3" {
+		t.Errorf("processor requests = %+v", requests)
+	}
+
+	if code, data := b.get("/api/download/" + job.ID + "/vocals"); code != http.StatusOK || string(data) != "vocals of song" {
+		t.Errorf("download = %d %q", code, data)
+	}
+	if code, _ := b.get("/api/download/" + job.ID + "/drums"); code != http.StatusNotFound {
+		t.Errorf("download of a stem that wasn't made = %d", code)
+	}
+	if code, data := b.get("/api/processing-status/" + job.ID); code != http.StatusOK || !strings.Contains(string(data), `"progress":100`) {
+		t.Errorf("processing status = %d %s", code, data)
+	}
+}
+
+func TestIntegrationProcessorFailures(t *testing.T) {
+	b := newIntegrationBackend(t, 2)
+	failed := b.upload("fail.mp3", nil)
+	garbage := b.upload("garbage.mp3", nil)
+
+	if job := b.waitFor(failed.ID, "failed"); !strings.Contains(job.Error, "Processor failed") || !strings.Contains(job.Error, "Demucs exited") {
+		t.Errorf("processor error = %q", job.Error)
+	}
+	if job := b.waitFor(garbage.ID, "failed"); job.Error != "Failed to parse response" {
+		t.Errorf("malformed response error = %q", job.Error)
+	}
+	if code, _ := b.get("/api/download/" + failed.ID + "/vocals"); code != http.StatusBadRequest {
+		t.Errorf("download of a failed job = %d", code)
+	}
+}
+
+func TestIntegrationQueueAndCancel(t *testing.T) {
+	b := newIntegrationBackend(t, 1)
+	running := b.upload("hang.mp3", nil)
+	b.waitFor(running.ID, "processing")
+	waiting := b.upload("song.mp3", nil)
+	if job := b.job(waiting.ID); job.Status != "queued" || job.QueuePosition != 1 {
+		t.Errorf("second job = %s at %d, want queued at 1", job.Status, job.QueuePosition)
+	}
+
+	req, _ := http.NewRequest("DELETE", b.URL+"/api/jobs/"+running.ID, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete = %d", resp.StatusCode)
+	}
+	if cancelled := b.processor.Cancelled(); len(cancelled) != 1 || cancelled[0] != running.ID {
+		t.Errorf("processor cancels = %v", cancelled)
+	}
+	if code, _ := b.get("/api/jobs/" + running.ID); code != http.StatusNotFound {
+		t.Errorf("deleted job = %d", code)
+	}
+
+	// The freed worker picks up the queued job
+	if job := b.waitFor(waiting.ID, "completed"); len(job.OutputFiles) != 6 {
+		t.Errorf("queued job outputs = %v", job.OutputFiles)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Invitations share one job with another API key, named by its ID or its
+// name, with read or remix permission. Unlike share links and stream
+// tokens, which open for anyone holding the token, an invitation only works
+// for the key it names, and only once that key accepts it:
+//
+//	POST   /api/jobs/{id}/invitations {"to": "mobile-app", "permission": "remix"}
+//	GET    /api/invitations               the requesting key's invitations
+//	POST   /api/invitations/{id}/accept
+//	DELETE /api/invitations/{id}          decline, or leave an accepted one
+//	DELETE /api/jobs/{id}/invitations/{invitation}  revoke
+//
+// The invitee is notified: the invitation is listed in its GET
+// /api/invitations, and its webhooks subscribed to job.shared receive the
+// event. An accepted invitation makes the job visible to the invitee as if
+// it were its own for reading (listed in GET /api/jobs and open on every job
+// route); remix also lets it render mixes (POST /api/jobs/{id}/mix).
+// Invitations are dropped with their job or invitee key, and stored in
+// INVITATIONS_FILE (default .invitations.json in the upload directory).
+
+const (
+	shareRead  = "read"
+	shareRemix = "remix"
+)
+
+var sharePermissions = map[string]bool{shareRead: true, shareRemix: true}
+
+// JobInvitation shares a job with the key To
+type JobInvitation struct {
+	ID         string     `json:"id"`
+	JobID      string     `json:"job_id"`
+	FileName   string     `json:"filename"`       // the job's, to recognise it
+	From       string     `json:"from,omitempty"` // key ID of the inviter
+	To         string     `json:"to"`             // key ID of the invitee
+	ToName     string     `json:"to_name"`
+	Permission string     `json:"permission"` // read or remix
+	Status     string     `json:"status"`     // pending or accepted
+	CreatedAt  time.Time  `json:"created_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+}
+
+var (
+	invitations      = make(map[string]*JobInvitation) // by ID
+	invitationsMutex = &sync.Mutex{}
+)
+
+func init() { keepInUploads(invitationsFile) }
+
+func invitationsFile() string {
+	if path := os.Getenv("INVITATIONS_FILE"); path != "" {
+		return path
+	}
+	return filepath.Join(uploadDir, ".invitations.json")
+}
+
+// loadInvitations restores the invitations saved by saveInvitations
+func loadInvitations() {
+	data, err := os.ReadFile(invitationsFile())
+	if err != nil {
+		return
+	}
+	var list []*JobInvitation
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Failed to load invitations: %v", err)
+		return
+	}
+	invitationsMutex.Lock()
+	for _, inv := range list {
+		invitations[inv.ID] = inv
+	}
+	invitationsMutex.Unlock()
+	log.Printf("Loaded %d invitations", len(list))
+}
+
+// saveInvitations writes every invitation to the file. Callers hold
+// invitationsMutex.
+func saveInvitations() {
+	list := make([]*JobInvitation, 0, len(invitations))
+	for _, id := range sortedKeys(invitations) {
+		list = append(list, invitations[id])
+	}
+	data, _ := json.MarshalIndent(list, "", "  ")
+	tmp := invitationsFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Failed to save invitations: %v", err)
+		return
+	}
+	os.Rename(tmp, invitationsFile())
+}
+
+// sharePermission is the permission of the request's key on a job shared
+// with it through an accepted invitation, "" when there is none
+func sharePermission(ctx context.Context, jobID string) string {
+	keyID := apiKeyID(ctx)
+	if keyID == "" {
+		return ""
+	}
+	invitationsMutex.Lock()
+	defer invitationsMutex.Unlock()
+	permission := ""
+	for _, inv := range invitations {
+		if inv.JobID == jobID && inv.To == keyID && inv.Status == "accepted" {
+			if permission = inv.Permission; permission == shareRemix {
+				break
+			}
+		}
+	}
+	return permission
+}
+
+// canRemixJob reports whether the request renders a mix of a job shared
+// with its key for remixing
+func canRemixJob(r *http.Request, job *Job) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	tpl, err := route.GetPathTemplate()
+	return err == nil && tpl == "/api/jobs/{id}/mix" && sharePermission(r.Context(), job.ID) == shareRemix
+}
+
+// findInvitee resolves the to of an invitation, a key ID or a key name
+func findInvitee(to string) (APIKey, int, string) {
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	if k, exists := apiKeys[to]; exists {
+		return *k, 0, ""
+	}
+	var found []*APIKey
+	for _, k := range apiKeys {
+		if k.Name == to {
+			found = append(found, k)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return APIKey{}, http.StatusNotFound, "No API key named " + to
+	case 1:
+		return *found[0], 0, ""
+	}
+	return APIKey{}, http.StatusConflict, "Several API keys are named " + to + "; invite one by its ID"
+}
+
+// forgetJobInvitations drops the invitations of deleted jobs
+func forgetJobInvitations(e Event) {
+	if e.Type != EventJobDeleted {
+		return
+	}
+	dropInvitations(func(inv *JobInvitation) bool { return inv.JobID == e.Job.ID })
+}
+
+// forgetInvitee drops the invitations to a revoked key
+func forgetInvitee(keyID string) {
+	dropInvitations(func(inv *JobInvitation) bool { return inv.To == keyID })
+}
+
+func dropInvitations(match func(*JobInvitation) bool) {
+	invitationsMutex.Lock()
+	defer invitationsMutex.Unlock()
+	changed := false
+	for id, inv := range invitations {
+		if match(inv) {
+			delete(invitations, id)
+			changed = true
+		}
+	}
+	if changed {
+		saveInvitations()
+	}
+}
+
+// createInvitationHandler invites a key to a job; inviting the same key
+// again changes the permission of its invitation
+func createInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		To         string `json:"to"`
+		Permission string `json:"permission"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Permission == "" {
+		req.Permission = shareRead
+	}
+	if !sharePermissions[req.Permission] {
+		http.Error(w, invalidOption("permission", sortedKeys(sharePermissions)).Error(), http.StatusBadRequest)
+		return
+	}
+	if req.To == "" {
+		http.Error(w, "to is required", http.StatusBadRequest)
+		return
+	}
+	jobID := mux.Vars(r)["id"]
+	jobsMutex.RLock()
+	job, exists := jobs[jobID]
+	var snapshot Job
+	if exists {
+		exists = canAccessJob(r, job)
+		snapshot = job.snapshot()
+	}
+	jobsMutex.RUnlock()
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	invitee, status, msg := findInvitee(req.To)
+	if status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+	from := apiKeyID(r.Context())
+	if invitee.ID == from || invitee.ID == snapshot.APIKeyID {
+		http.Error(w, "The key already has the job", http.StatusBadRequest)
+		return
+	}
+
+	invitationsMutex.Lock()
+	var inv *JobInvitation
+	for _, existing := range invitations {
+		if existing.JobID == jobID && existing.To == invitee.ID {
+			inv = existing
+		}
+	}
+	created := inv == nil
+	if created {
+		inv = &JobInvitation{ID: uuid.New().String(), JobID: jobID, FileName: snapshot.FileName, To: invitee.ID, Status: "pending", CreatedAt: time.Now().UTC()}
+		invitations[inv.ID] = inv
+	}
+	inv.From, inv.ToName, inv.Permission = from, invitee.Name, req.Permission
+	saveInvitations()
+	view := *inv
+	invitationsMutex.Unlock()
+
+	recordAudit("job.invitation_sent", jobID, map[string]string{"key_id": from, "to": invitee.ID, "permission": req.Permission})
+	emitEventFor(EventJobShared, snapshot, invitee.ID)
+	status = http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, view)
+}
+
+// listJobInvitationsHandler lists the invitations to a job for the keys
+// that may change it
+func listJobInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+	jobsMutex.RLock()
+	job, exists := jobs[jobID]
+	allowed := exists && canChangeJob(r, job)
+	jobsMutex.RUnlock()
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Read-only access to this job", http.StatusForbidden)
+		return
+	}
+	invitationsMutex.Lock()
+	list := []JobInvitation{}
+	for _, id := range sortedKeys(invitations) {
+		if inv := invitations[id]; inv.JobID == jobID {
+			list = append(list, *inv)
+		}
+	}
+	invitationsMutex.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+func revokeInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	invitationsMutex.Lock()
+	inv, exists := invitations[vars["invitation"]]
+	exists = exists && inv.JobID == vars["id"]
+	if exists {
+		delete(invitations, inv.ID)
+		saveInvitations()
+	}
+	invitationsMutex.Unlock()
+	if !exists {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listInvitationsHandler lists the invitations to the requesting key,
+// pending ones first
+func listInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	keyID := apiKeyID(r.Context())
+	invitationsMutex.Lock()
+	pending, accepted := []JobInvitation{}, []JobInvitation{}
+	for _, id := range sortedKeys(invitations) {
+		inv := invitations[id]
+		switch {
+		case keyID == "" || inv.To != keyID:
+		case inv.Status == "pending":
+			pending = append(pending, *inv)
+		default:
+			accepted = append(accepted, *inv)
+		}
+	}
+	invitationsMutex.Unlock()
+	writeJSON(w, http.StatusOK, append(pending, accepted...))
+}
+
+// lookupInvitation finds the {id} invitation to the requesting key and
+// returns with invitationsMutex held
+func lookupInvitation(w http.ResponseWriter, r *http.Request) (*JobInvitation, bool) {
+	invitationsMutex.Lock()
+	inv, exists := invitations[mux.Vars(r)["id"]]
+	if !exists || apiKeyID(r.Context()) == "" || inv.To != apiKeyID(r.Context()) {
+		invitationsMutex.Unlock()
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return nil, false
+	}
+	return inv, true
+}
+
+func acceptInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	inv, ok := lookupInvitation(w, r)
+	if !ok {
+		return
+	}
+	if inv.Status != "accepted" {
+		now := time.Now().UTC()
+		inv.Status, inv.AcceptedAt = "accepted", &now
+		saveInvitations()
+	}
+	view := *inv
+	invitationsMutex.Unlock()
+	recordAudit("job.invitation_accepted", view.JobID, map[string]string{"key_id": view.To})
+	writeJSON(w, http.StatusOK, view)
+}
+
+func declineInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	inv, ok := lookupInvitation(w, r)
+	if !ok {
+		return
+	}
+	delete(invitations, inv.ID)
+	saveInvitations()
+	invitationsMutex.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
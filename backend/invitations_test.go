@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvitationShareJobWithKey(t *testing.T) {
+	useOrgs(t)
+	t.Setenv("OUTBOUND_ALLOW_PRIVATE", "true") // the test endpoint listens on loopback
+	t.Cleanup(func() {
+		invitationsMutex.Lock()
+		invitations = make(map[string]*JobInvitation)
+		invitationsMutex.Unlock()
+	})
+	alice, bob, carol := createTestKey(t, "alice"), createTestKey(t, "bob"), createTestKey(t, "carol")
+
+	// The invitee's webhooks hear about the invitation
+	notified := make(chan Event, 4)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &e)
+		notified <- e
+	}))
+	defer endpoint.Close()
+	webhooksMutex.Lock()
+	webhooks["invitee-hook"] = &Webhook{ID: "invitee-hook", URL: endpoint.URL, Events: []string{EventJobShared}, Active: true, apiKeyID: bob.ID}
+	webhooks["stranger-hook"] = &Webhook{ID: "stranger-hook", URL: endpoint.URL, Events: []string{"*"}, Active: true, apiKeyID: carol.ID}
+	webhooksMutex.Unlock()
+	t.Cleanup(func() {
+		webhooksMutex.Lock()
+		delete(webhooks, "invitee-hook")
+		delete(webhookDeliveries, "invitee-hook")
+		delete(webhooks, "stranger-hook")
+		delete(webhookDeliveries, "stranger-hook")
+		webhooksMutex.Unlock()
+	})
+
+	id := "9b2d7f4e-3c1a-4e8b-8f6d-5a4b3c2d1e0f"
+	jobsMutex.Lock()
+	jobs[id] = &Job{ID: id, Status: "completed", FileName: "song.mp3", APIKeyID: alice.ID}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+	})
+
+	router := newRouter()
+	do := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("POST", "/api/jobs/"+id+"/invitations", alice.Key, `{"to": "bob"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("invite = %d: %s", rec.Code, rec.Body.String())
+	}
+	var inv JobInvitation
+	json.NewDecoder(rec.Body).Decode(&inv)
+	if inv.To != bob.ID || inv.Permission != shareRead || inv.Status != "pending" {
+		t.Errorf("invitation = %+v", inv)
+	}
+	lines, _ := readJobEventLog(id)
+	var shared Event
+	if len(lines) > 0 {
+		json.Unmarshal(lines[len(lines)-1], &shared)
+	}
+	if shared.Type != EventJobShared || shared.Invitee != bob.ID {
+		t.Fatalf("logged event = %+v", shared)
+	}
+	dispatchWebhooks(shared)
+	select {
+	case e := <-notified:
+		if e.Type != EventJobShared || e.Invitee != bob.ID || e.Job.ID != id {
+			t.Errorf("notification = %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("invitee's webhook wasn't notified")
+	}
+	webhooksMutex.RLock()
+	strangers := len(webhookDeliveries["stranger-hook"])
+	webhooksMutex.RUnlock()
+	if strangers != 0 {
+		t.Errorf("another key's webhook got %d deliveries", strangers)
+	}
+
+	var inbox []JobInvitation
+	json.NewDecoder(do("GET", "/api/invitations", bob.Key, "").Body).Decode(&inbox)
+	if len(inbox) != 1 || inbox[0].ID != inv.ID {
+		t.Errorf("bob's invitations = %+v", inbox)
+	}
+	// Pending invitations don't open the job, and only the invitee accepts
+	if rec := do("GET", "/api/jobs/"+id, bob.Key, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("pending invitee GET job = %d, want 404", rec.Code)
+	}
+	if rec := do("POST", "/api/invitations/"+inv.ID+"/accept", carol.Key, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("carol accepting = %d, want 404", rec.Code)
+	}
+	if rec := do("POST", "/api/invitations/"+inv.ID+"/accept", bob.Key, ""); rec.Code != http.StatusOK {
+		t.Fatalf("accept = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Read lets bob see the job but not change, mix or reshare it
+	if rec := do("GET", "/api/jobs/"+id, bob.Key, ""); rec.Code != http.StatusOK {
+		t.Errorf("invitee GET job = %d", rec.Code)
+	}
+	var list JobList
+	json.NewDecoder(do("GET", "/api/jobs", bob.Key, "").Body).Decode(&list)
+	if list.Total != 1 {
+		t.Errorf("bob lists %d jobs, want the shared one", list.Total)
+	}
+	for _, path := range []string{"/api/jobs/" + id + "/mix", "/api/jobs/" + id + "/invitations", "/api/jobs/" + id + "/rating"} {
+		if rec := do("POST", path, bob.Key, `{}`); rec.Code != http.StatusForbidden {
+			t.Errorf("read invitee POST %s = %d, want 403", path, rec.Code)
+		}
+	}
+	if rec := do("GET", "/api/jobs/"+id, carol.Key, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("carol GET job = %d, want 404", rec.Code)
+	}
+
+	// Inviting again changes the permission; remix opens mixing only
+	if rec := do("POST", "/api/jobs/"+id+"/invitations", alice.Key, `{"to": "`+bob.ID+`", "permission": "remix"}`); rec.Code != http.StatusOK {
+		t.Fatalf("re-invite = %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("POST", "/api/jobs/"+id+"/mix", bob.Key, `{}`); rec.Code == http.StatusForbidden || rec.Code == http.StatusNotFound {
+		t.Errorf("remix invitee POST mix = %d", rec.Code)
+	}
+	if rec := do("POST", "/api/jobs/"+id+"/rating", bob.Key, `{"score": 4}`); rec.Code != http.StatusForbidden {
+		t.Errorf("remix invitee rating = %d, want 403", rec.Code)
+	}
+
+	// Revoking closes the job again
+	if rec := do("DELETE", "/api/jobs/"+id+"/invitations/"+inv.ID, alice.Key, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("revoke = %d", rec.Code)
+	}
+	if rec := do("GET", "/api/jobs/"+id, bob.Key, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET job after revoke = %d, want 404", rec.Code)
+	}
+}
+
+func TestFindInvitee(t *testing.T) {
+	useOrgs(t)
+	a, _ := createTestKey(t, "twin"), createTestKey(t, "twin")
+	solo := createTestKey(t, "solo")
+	for to, want := range map[string]int{"solo": 0, solo.ID: 0, a.ID: 0, "twin": http.StatusConflict, "nobody": http.StatusNotFound} {
+		if _, status, _ := findInvitee(to); status != want {
+			t.Errorf("findInvitee(%s) = %d, want %d", to, status, want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Job listing. GET /api/jobs returns a page of jobs in a stable envelope,
+// {"jobs": [...], "total": n, "next_cursor": "..."}, newest first:
+//
+//	limit       page size, default 100, at most 1000
+//	cursor      next_cursor of the previous page
+//	sort        created_at (default) or completed_at; jobs that haven't
+//	            completed sort as the oldest
+//	order       desc (default) or asc
+//	status      comma-separated statuses to include
+//	stem_mode   all or isolate
+//	from, to    range of the sort field, RFC 3339 or YYYY-MM-DD (to is
+//	            inclusive of the whole day)
+//	q           case-insensitive filename substring
+//	org         jobs of one organization (see orgs.go)
+//
+// total counts every job that matches, not just the page. Cursors hold the
+// last job's sort key and ID, so pages stay consistent while new jobs
+// arrive; they only work with the sort and order they were made with.
+
+const (
+	defaultJobListLimit = 100
+	maxJobListLimit     = 1000
+)
+
+var (
+	allowedJobStatuses = map[string]bool{"pending": true, "queued": true, "processing": true, "completed": true, "failed": true, "expired": true}
+	allowedJobSorts    = map[string]bool{"created_at": true, "completed_at": true}
+	allowedJobOrders   = map[string]bool{"asc": true, "desc": true}
+)
+
+// jobListQuery is a parsed GET /api/jobs query
+type jobListQuery struct {
+	Limit    int
+	Sort     string
+	Order    string
+	Statuses map[string]bool // empty: any
+	StemMode string
+	From, To time.Time // zero: unbounded; To is exclusive
+	Search   string    // lowercased
+	Org      string
+	After    *jobCursor
+}
+
+// jobCursor is the position after the last job of a page
+type jobCursor struct {
+	Key int64 // sort field, Unix nanoseconds
+	ID  string
+}
+
+// JobList is the GET /api/jobs response
+type JobList struct {
+	Jobs       []Job  `json:"jobs"`
+	Total      int    `json:"total"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// parseJobListQuery reads and validates a GET /api/jobs query
+func parseJobListQuery(v url.Values) (jobListQuery, error) {
+	q := jobListQuery{Limit: defaultJobListLimit, Sort: "created_at", Order: "desc", StemMode: v.Get("stem_mode"), Org: v.Get("org")}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxJobListLimit {
+			return q, fmt.Errorf("Invalid limit (1-%d)", maxJobListLimit)
+		}
+		q.Limit = n
+	}
+	if s := v.Get("sort"); s != "" {
+		if !allowedJobSorts[s] {
+			return q, invalidOption("sort", sortedKeys(allowedJobSorts))
+		}
+		q.Sort = s
+	}
+	if s := v.Get("order"); s != "" {
+		if !allowedJobOrders[s] {
+			return q, invalidOption("order", sortedKeys(allowedJobOrders))
+		}
+		q.Order = s
+	}
+	if s := v.Get("status"); s != "" {
+		q.Statuses = make(map[string]bool)
+		for _, status := range strings.Split(s, ",") {
+			if !allowedJobStatuses[status] {
+				return q, invalidOption("status", sortedKeys(allowedJobStatuses))
+			}
+			q.Statuses[status] = true
+		}
+	}
+	if q.StemMode != "" && !allowedStemModes[q.StemMode] {
+		return q, invalidOption("stem_mode", sortedKeys(allowedStemModes))
+	}
+	var err error
+	if q.From, err = parseListDate(v.Get("from"), false); err != nil {
+		return q, errors.New("Invalid from date")
+	}
+	if q.To, err = parseListDate(v.Get("to"), true); err != nil {
+		return q, errors.New("Invalid to date")
+	}
+	q.Search = strings.ToLower(v.Get("q"))
+	if s := v.Get("cursor"); s != "" {
+		if q.After, err = decodeJobCursor(s, q.Sort, q.Order); err != nil {
+			return q, errors.New("Invalid cursor")
+		}
+	}
+	return q, nil
+}
+
+// parseListDate reads an RFC 3339 time or a date; a date used as an upper
+// bound means the end of that day
+func parseListDate(s string, upper bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		if upper {
+			t = t.Add(time.Nanosecond)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, s)
+	if err == nil && upper {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, err
+}
+
+// sortKey is the job's value of the sort field
+func (q jobListQuery) sortKey(job *Job) int64 {
+	if q.Sort == "completed_at" {
+		if job.CompletedAt == nil {
+			return 0
+		}
+		return job.CompletedAt.UnixNano()
+	}
+	return job.CreatedAt.UnixNano()
+}
+
+func (q jobListQuery) matches(job *Job) bool {
+	if len(q.Statuses) > 0 && !q.Statuses[job.Status] {
+		return false
+	}
+	if q.StemMode != "" && job.StemMode != q.StemMode {
+		return false
+	}
+	if q.Org != "" && job.OrgID != q.Org {
+		return false
+	}
+	if !q.From.IsZero() || !q.To.IsZero() {
+		key := q.sortKey(job)
+		if key == 0 || (!q.From.IsZero() && key < q.From.UnixNano()) || (!q.To.IsZero() && key >= q.To.UnixNano()) {
+			return false
+		}
+	}
+	return q.Search == "" || strings.Contains(strings.ToLower(job.FileName), q.Search)
+}
+
+// less orders two positions by the query's sort and order, breaking ties by ID
+func (q jobListQuery) less(a, b jobCursor) bool {
+	if a.Key != b.Key {
+		return (a.Key < b.Key) == (q.Order == "asc")
+	}
+	return (a.ID < b.ID) == (q.Order == "asc")
+}
+
+func encodeJobCursor(c jobCursor, sort, order string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s|%s|%d|%s", sort, order, c.Key, c.ID)))
+}
+
+func decodeJobCursor(s, sort, order string) (*jobCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(string(raw), "|", 4)
+	if len(parts) != 4 || parts[0] != sort || parts[1] != order {
+		return nil, errors.New("cursor doesn't match the sort")
+	}
+	key, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &jobCursor{Key: key, ID: parts[3]}, nil
+}
+
+// listJobs returns the page of jobs the query selects among those the
+// request may see
+func listJobs(r *http.Request, q jobListQuery) JobList {
+	type entry struct {
+		pos jobCursor
+		job Job
+	}
+	jobsMutex.RLock()
+	var matched []entry
+	for _, job := range jobs {
+		if !job.SelfTest && canAccessJob(r, job) && q.matches(job) {
+			matched = append(matched, entry{jobCursor{q.sortKey(job), job.ID}, job.snapshot()})
+		}
+	}
+	jobsMutex.RUnlock()
+
+	slices.SortFunc(matched, func(a, b entry) int {
+		if q.less(a.pos, b.pos) {
+			return -1
+		}
+		return 1
+	})
+	list := JobList{Jobs: []Job{}, Total: len(matched)}
+	start := 0
+	if q.After != nil {
+		start, _ = slices.BinarySearchFunc(matched, *q.After, func(e entry, c jobCursor) int {
+			if e.pos == c || q.less(e.pos, c) {
+				return -1
+			}
+			return 1
+		})
+	}
+	end := min(start+q.Limit, len(matched))
+	for _, e := range matched[start:end] {
+		if e.job.Status == "queued" {
+			e.job.QueuePosition = processingQueue.position(e.job.ID)
+		}
+		withDownloadURLs(r, &e.job)
+		list.Jobs = append(list.Jobs, e.job)
+	}
+	if end < len(matched) {
+		list.NextCursor = encodeJobCursor(matched[end-1].pos, q.Sort, q.Order)
+	}
+	return list
+}
+
+// listJobsHandler serves GET /api/jobs
+func listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseJobListQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, listJobs(r, q))
+}
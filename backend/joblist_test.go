@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestListJobsPagesAndFilters(t *testing.T) {
+	// Every query searches for tag, so jobs left by other tests don't count
+	tag := uuid.New().String()[:8]
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	var ids []string
+	jobsMutex.Lock()
+	for i, spec := range []struct{ status, mode, name string }{
+		{"completed", "all", "Intro.mp3"},
+		{"failed", "all", "verse.wav"},
+		{"completed", "isolate", "Chorus.mp3"},
+		{"queued", "all", "bridge.flac"},
+		{"completed", "all", "outro-CHORUS.mp3"},
+	} {
+		id := uuid.New().String()
+		job := &Job{ID: id, Status: spec.status, StemMode: spec.mode, FileName: tag + "-" + spec.name, CreatedAt: base.Add(time.Duration(i) * 24 * time.Hour)}
+		if spec.status == "completed" {
+			done := base.Add(time.Duration(10-i) * time.Hour)
+			job.CompletedAt = &done
+		}
+		jobs[id] = job
+		ids = append(ids, id)
+	}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		for _, id := range ids {
+			delete(jobs, id)
+		}
+		jobsMutex.Unlock()
+	})
+
+	list := func(query url.Values) (JobList, int) {
+		query.Set("q", tag)
+		rec := httptest.NewRecorder()
+		listJobsHandler(rec, httptest.NewRequest("GET", "/api/jobs?"+query.Encode(), nil))
+		var page JobList
+		json.Unmarshal(rec.Body.Bytes(), &page)
+		return page, rec.Code
+	}
+	listed := func(page JobList) []string {
+		var got []string
+		for _, job := range page.Jobs {
+			got = append(got, job.ID)
+		}
+		return got
+	}
+
+	// Newest first, two at a time
+	var walked []string
+	query := url.Values{"limit": {"2"}}
+	for pages := 0; pages < 5; pages++ {
+		page, code := list(query)
+		if code != http.StatusOK || page.Total != 5 {
+			t.Fatalf("page %d = %d, total %d", pages, code, page.Total)
+		}
+		walked = append(walked, listed(page)...)
+		if page.NextCursor == "" {
+			break
+		}
+		query.Set("cursor", page.NextCursor)
+	}
+	want := []string{ids[4], ids[3], ids[2], ids[1], ids[0]}
+	if !reflect.DeepEqual(walked, want) {
+		t.Errorf("walked %v, want %v", walked, want)
+	}
+
+	// A job created between pages doesn't shift the next page
+	page, _ := list(url.Values{"limit": {"2"}})
+	late := uuid.New().String()
+	jobsMutex.Lock()
+	jobs[late] = &Job{ID: late, Status: "pending", FileName: tag + "-late.mp3", CreatedAt: base.Add(30 * 24 * time.Hour)}
+	jobsMutex.Unlock()
+	ids = append(ids, late)
+	next, _ := list(url.Values{"limit": {"2"}, "cursor": {page.NextCursor}})
+	if got := listed(next); len(got) != 2 || got[0] != ids[2] || next.Total != 6 {
+		t.Errorf("page after a new job = %v (total %d), want [%s %s]", got, next.Total, ids[2], ids[1])
+	}
+
+	for _, tc := range []struct {
+		query url.Values
+		want  []string
+	}{
+		{url.Values{"status": {"completed,failed"}, "stem_mode": {"all"}}, []string{ids[4], ids[1], ids[0]}},
+		{url.Values{"sort": {"completed_at"}, "order": {"asc"}, "status": {"completed"}}, []string{ids[4], ids[2], ids[0]}},
+		{url.Values{"from": {"2026-03-02"}, "to": {"2026-03-03"}}, []string{ids[2], ids[1]}},
+		{url.Values{"to": {base.Format(time.RFC3339)}}, []string{ids[0]}},
+	} {
+		page, code := list(tc.query)
+		if got := listed(page); code != http.StatusOK || !reflect.DeepEqual(got, tc.want) || page.Total != len(tc.want) {
+			t.Errorf("%v = %d %v, want %v", tc.query, code, got, tc.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	listJobsHandler(rec, httptest.NewRequest("GET", "/api/jobs?q="+tag+"-outro-chorus", nil))
+	var found JobList
+	json.Unmarshal(rec.Body.Bytes(), &found)
+	if len(found.Jobs) != 1 || found.Jobs[0].ID != ids[4] {
+		t.Errorf("case-insensitive search found %v", listed(found))
+	}
+
+	for _, bad := range []url.Values{
+		{"limit": {"0"}}, {"limit": {"5000"}}, {"sort": {"filename"}}, {"order": {"up"}},
+		{"status": {"completed,done"}}, {"stem_mode": {"some"}}, {"from": {"yesterday"}},
+		{"cursor": {"!!"}}, {"cursor": {page.NextCursor}, "order": {"asc"}},
+	} {
+		if _, code := list(bad); code != http.StatusBadRequest {
+			t.Errorf("%v = %d, want 400", bad, code)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Lease hands a pending job to an external worker for a bounded amount of time.
+// Workers must extend the lease while they work; expired leases are requeued.
+type Lease struct {
+	ID        string    `json:"lease_id"`
+	JobID     string    `json:"job_id"`
+	WorkerID  string    `json:"worker_id,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+const (
+	defaultLeaseDuration = 5 * time.Minute
+	maxLeaseDuration     = time.Hour
+)
+
+var (
+	// externalWorkers disables the built-in processor dispatch so jobs stay
+	// pending until a worker leases them (EXTERNAL_WORKERS=true)
+	externalWorkers bool
+	// workerToken is the bearer token workers authenticate with (WORKER_TOKEN)
+	workerToken string
+
+	leases      = make(map[string]*Lease)
+	leasesMutex = &sync.Mutex{}
+)
+
+// leaseRequest is the JSON body accepted by the lease and extend endpoints
+type leaseRequest struct {
+	WorkerID     string `json:"worker_id"`
+	LeaseSeconds int    `json:"lease_seconds"`
+}
+
+// leaseDuration converts a requested lease length into a bounded duration
+func leaseDuration(seconds int) time.Duration {
+	if seconds <= 0 {
+		return defaultLeaseDuration
+	}
+	d := time.Duration(seconds) * time.Second
+	if d > maxLeaseDuration {
+		return maxLeaseDuration
+	}
+	return d
+}
+
+// workerAuth rejects worker API calls that don't carry the configured WORKER_TOKEN
+func workerAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if workerToken == "" {
+			http.Error(w, "Worker API disabled", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+workerToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// acquireLease picks the oldest pending job and leases it to the worker
+func acquireLease(workerID string, d time.Duration) (*Lease, *Job) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	var next *Job
+	for _, job := range jobs {
+		if job.Status != "pending" || job.inputPath == "" {
+			continue
+		}
+		if next == nil || job.CreatedAt.Before(next.CreatedAt) {
+			next = job
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+
+	next.Status = "processing"
+	lease := &Lease{
+		ID:        uuid.New().String(),
+		JobID:     next.ID,
+		WorkerID:  workerID,
+		ExpiresAt: time.Now().UTC().Add(d),
+	}
+	leasesMutex.Lock()
+	leases[lease.ID] = lease
+	leasesMutex.Unlock()
+
+	jobCopy := *next
+	return lease, &jobCopy
+}
+
+// activeLease returns the lease if it exists and hasn't expired
+func activeLease(leaseID string) (*Lease, bool) {
+	leasesMutex.Lock()
+	defer leasesMutex.Unlock()
+	lease, exists := leases[leaseID]
+	if !exists || time.Now().After(lease.ExpiresAt) {
+		return nil, false
+	}
+	return lease, true
+}
+
+// heldLease reports whether the lease is still the one on its job: not
+// expired and requeued, nor released. Callers hold jobsMutex.
+func heldLease(lease *Lease) bool {
+	leasesMutex.Lock()
+	defer leasesMutex.Unlock()
+	held, exists := leases[lease.ID]
+	job, ok := jobs[lease.JobID]
+	return exists && held == lease && time.Now().Before(lease.ExpiresAt) && ok && job.Status == "processing"
+}
+
+// failLeasedJob fails a leased job with errMsg while the lease still holds
+// it, answering 409 and leaving the job alone once it doesn't: it may be
+// another worker's by now
+func failLeasedJob(w http.ResponseWriter, lease *Lease, errMsg string) {
+	jobsMutex.Lock()
+	held := heldLease(lease)
+	if held {
+		releaseLeasesForJob(lease.JobID)
+		jobs[lease.JobID].fail(errMsg)
+	}
+	jobsMutex.Unlock()
+	if !held {
+		http.Error(w, "Lease not found or expired", http.StatusConflict)
+		return
+	}
+	emitJobEvent(lease.JobID, EventJobFailed)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "failed"})
+}
+
+// holdLease keeps a lease from expiring while its result is post-processed
+func holdLease(lease *Lease) {
+	leasesMutex.Lock()
+	lease.ExpiresAt = time.Now().UTC().Add(maxLeaseDuration)
+	leasesMutex.Unlock()
+}
+
+// releaseLeasesForJob drops any lease held on a job (e.g. when it is deleted)
+func releaseLeasesForJob(jobID string) {
+	leasesMutex.Lock()
+	defer leasesMutex.Unlock()
+	for id, lease := range leases {
+		if lease.JobID == jobID {
+			delete(leases, id)
+		}
+	}
+}
+
+// requeueExpiredLeases returns jobs held by expired leases to the pending pool
+func requeueExpiredLeases(now time.Time) int {
+	leasesMutex.Lock()
+	var expired []*Lease
+	for id, lease := range leases {
+		if now.After(lease.ExpiresAt) {
+			expired = append(expired, lease)
+			delete(leases, id)
+		}
+	}
+	leasesMutex.Unlock()
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	for _, lease := range expired {
+		if job, exists := jobs[lease.JobID]; exists && job.Status == "processing" {
+			job.Status = "pending"
+			log.Printf("Lease %s for job %s expired (worker %q), requeued", lease.ID, lease.JobID, lease.WorkerID)
+		}
+	}
+	return len(expired)
+}
+
+// leaseReaper periodically requeues jobs whose workers stopped extending their lease
+func leaseReaper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		requeueExpiredLeases(now)
+	}
+}
+
+func leaseJobHandler(w http.ResponseWriter, r *http.Request) {
+	var req leaseRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid lease request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	lease, job := acquireLease(req.WorkerID, leaseDuration(req.LeaseSeconds))
+	if lease == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	emitEvent(EventJobProcessing, *job)
+
+	resp := map[string]interface{}{
+		"lease_id":   lease.ID,
+		"expires_at": lease.ExpiresAt,
+		"job":        job,
+		"input_url":  "/api/worker/leases/" + lease.ID + "/input",
+	}
+	if job.Encrypted {
+		// Only the worker holding the lease gets the sealed job key
+		resp["sealed_key"] = job.sealedKey
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func leaseInputHandler(w http.ResponseWriter, r *http.Request) {
+	lease, ok := activeLease(mux.Vars(r)["lease"])
+	if !ok {
+		http.Error(w, "Lease not found or expired", http.StatusConflict)
+		return
+	}
+
+	jobsMutex.RLock()
+	job, exists := jobs[lease.JobID]
+	var inputPath string
+	if exists {
+		inputPath = job.inputPath
+	}
+	jobsMutex.RUnlock()
+	if !exists || inputPath == "" {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	// Another replica may have accepted the upload
+	if _, err := os.Stat(inputPath); os.IsNotExist(err) {
+		if s, remote := remoteStorage(); remote {
+			serveFromStorage(w, r, s, inputPath)
+			return
+		}
+	}
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", filepath.Base(inputPath)))
+	http.ServeFile(w, r, inputPath)
+}
+
+func extendLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	var req leaseRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid lease request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	leaseID := mux.Vars(r)["lease"]
+	leasesMutex.Lock()
+	lease, exists := leases[leaseID]
+	if exists && time.Now().After(lease.ExpiresAt) {
+		exists = false
+	}
+	if exists {
+		lease.ExpiresAt = time.Now().UTC().Add(leaseDuration(req.LeaseSeconds))
+	}
+	var leaseCopy Lease
+	if exists {
+		leaseCopy = *lease
+	}
+	leasesMutex.Unlock()
+
+	if !exists {
+		http.Error(w, "Lease not found or expired", http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, leaseCopy)
+}
+
+// completeLeaseHandler accepts the worker's result as a multipart form: a
+// "status" field (completed or failed), optional "error", "processing_time"
+// and "environment" (JSON labels, see ProcessingEnv) fields, and one file
+// part per stem named after the stem, saved as <stem>.<format>. The result,
+// a failure included, is only recorded while the lease still holds the job.
+// For a watermarked job the "watermark" field must report the mark the
+// worker embedded, as the processor does.
+func completeLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	lease, ok := activeLease(mux.Vars(r)["lease"])
+	if !ok {
+		http.Error(w, "Lease not found or expired", http.StatusConflict)
+		return
+	}
+
+	if err := r.ParseMultipartForm(32 << 20); isBodyTooLarge(err) {
+		http.Error(w, "Result too large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	status := r.FormValue("status")
+	if status != "completed" && status != "failed" {
+		http.Error(w, "Invalid status value", http.StatusBadRequest)
+		return
+	}
+
+	if status == "failed" {
+		errMsg := r.FormValue("error")
+		if errMsg == "" {
+			errMsg = "Worker reported failure"
+		}
+		failLeasedJob(w, lease, errMsg)
+		return
+	}
+
+	jobsMutex.RLock()
+	job, exists := jobs[lease.JobID]
+	var opts jobOptions
+	if exists {
+		opts = job.options()
+	}
+	jobsMutex.RUnlock()
+	// Stems without the mark mustn't reach clients of a watermarked tier
+	if opts.Watermark != "" && r.FormValue("watermark") != opts.Watermark {
+		failLeasedJob(w, lease, "Worker doesn't support watermarks: it didn't report the watermark it embedded")
+		return
+	}
+
+	jobOutputDir := filepath.Join(outputDir, lease.JobID)
+	if err := os.MkdirAll(jobOutputDir, 0755); err != nil {
+		http.Error(w, "Failed to create output directory", http.StatusInternalServerError)
+		return
+	}
+
+	outputFiles := make(map[string]string)
+	for stem, headers := range r.MultipartForm.File {
+		if !allowedStems[stem] && stem != "instrumental" && stem != "backing" {
+			http.Error(w, "Invalid stem name: "+stem, http.StatusBadRequest)
+			return
+		}
+		// The worker's file name only tells the format
+		format := strings.TrimPrefix(strings.ToLower(filepath.Ext(headers[0].Filename)), ".")
+		if !allowedOutputFormats[format] {
+			http.Error(w, "Invalid stem format: "+stem, http.StatusBadRequest)
+			return
+		}
+		dstPath := filepath.Join(jobOutputDir, stem+"."+format)
+		if err := saveFormFile(headers[0], dstPath); err != nil {
+			http.Error(w, "Failed to save stem", http.StatusInternalServerError)
+			return
+		}
+		outputFiles[stem] = dstPath
+	}
+	if len(outputFiles) == 0 {
+		http.Error(w, "No stems provided", http.StatusBadRequest)
+		return
+	}
+
+	holdLease(lease)
+	if err := runPipelineSteps(lease.JobID, outputFiles); err != nil {
+		failLeasedJob(w, lease, err.Error())
+		return
+	}
+	if err := addExtraFormats(lease.JobID, outputFiles, opts); err != nil {
+		failLeasedJob(w, lease, err.Error())
+		return
+	}
+
+	jobsMutex.Lock()
+	held := heldLease(lease)
+	job, exists = jobs[lease.JobID]
+	if held {
+		job.Status = "completed"
+		now := time.Now().UTC()
+		job.CompletedAt = &now
+		job.ProcessingTime = r.FormValue("processing_time")
+		job.OutputFiles = outputFiles
+		job.Environment = workerEnvironment(r.FormValue("environment"), lease.WorkerID)
+		job.Energy = workerEnergy(r.FormValue("compute"))
+		job.Notes = parseJobNotes(r.FormValue("notes"))
+		releaseLeasesForJob(lease.JobID)
+	}
+	jobsMutex.Unlock()
+
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if !held {
+		http.Error(w, "Lease not found or expired", http.StatusConflict)
+		return
+	}
+	emitJobEvent(lease.JobID, EventJobCompleted)
+	queueAutoDeliveries(lease.JobID)
+	startPipelineExports(lease.JobID)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "completed"})
+}
+
+// saveFormFile copies an uploaded multipart file to dstPath
+func saveFormFile(header *multipart.FileHeader, dstPath string) error {
+	src, err := header.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// workerEnergy estimates the energy of the compute a worker reported; a
+// worker that reported none leaves the estimate out, as the processor does
+func workerEnergy(raw string) *EnergyEstimate {
+	if raw == "" {
+		return nil
+	}
+	return estimateEnergy(json.RawMessage(raw))
+}
+
+// workerEnvironment parses the labels a worker sent with its result; the
+// instance defaults to the worker's ID
+func workerEnvironment(raw, workerID string) *ProcessingEnv {
+	var env ProcessingEnv
+	if raw != "" && json.Unmarshal([]byte(raw), &env) != nil {
+		env = ProcessingEnv{}
+	}
+	if env.Instance == "" {
+		env.Instance = workerID
+	}
+	if env == (ProcessingEnv{}) {
+		return nil
+	}
+	return &env
+}
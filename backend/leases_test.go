@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestLeaseDuration(t *testing.T) {
+	if got := leaseDuration(0); got != defaultLeaseDuration {
+		t.Errorf("leaseDuration(0) = %v, want %v", got, defaultLeaseDuration)
+	}
+	if got := leaseDuration(30); got != 30*time.Second {
+		t.Errorf("leaseDuration(30) = %v, want 30s", got)
+	}
+	if got := leaseDuration(1 << 20); got != maxLeaseDuration {
+		t.Errorf("leaseDuration(huge) = %v, want %v", got, maxLeaseDuration)
+	}
+}
+
+func TestLeaseExpiryRequeuesJob(t *testing.T) {
+	jobsMutex.Lock()
+	jobs["lease-test-job"] = &Job{ID: "lease-test-job", Status: "pending", CreatedAt: time.Now(), inputPath: "/tmp/input.wav"}
+	jobsMutex.Unlock()
+	defer func() {
+		jobsMutex.Lock()
+		delete(jobs, "lease-test-job")
+		jobsMutex.Unlock()
+		releaseLeasesForJob("lease-test-job")
+	}()
+
+	lease, job := acquireLease("worker-1", time.Minute)
+	if lease == nil || job.ID != "lease-test-job" {
+		t.Fatalf("expected to lease the pending job, got %v", lease)
+	}
+	if again, _ := acquireLease("worker-2", time.Minute); again != nil {
+		t.Fatalf("leased job was handed out twice")
+	}
+
+	requeueExpiredLeases(time.Now().Add(2 * time.Minute))
+
+	jobsMutex.RLock()
+	status := jobs["lease-test-job"].Status
+	jobsMutex.RUnlock()
+	if status != "pending" {
+		t.Errorf("expired lease should requeue job, status = %q", status)
+	}
+	if _, ok := activeLease(lease.ID); ok {
+		t.Error("expired lease should have been removed")
+	}
+}
+
+func TestWorkerAuth(t *testing.T) {
+	handler := workerAuth(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	workerToken = ""
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("POST", "/api/worker/lease", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("disabled worker API: got %d, want 403", rec.Code)
+	}
+
+	workerToken = "secret"
+	defer func() { workerToken = "" }()
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("POST", "/api/worker/lease", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("missing token: got %d, want 401", rec.Code)
+	}
+
+	req := httptest.NewRequest("POST", "/api/worker/lease", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("valid token: got %d, want 200", rec.Code)
+	}
+}
+
+// completeLease posts a worker's result for a lease, with one part per stem
+func completeLease(leaseID string, fields, stems map[string]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	for stem, fileName := range stems {
+		part, _ := mw.CreateFormFile(stem, fileName)
+		part.Write([]byte(stem))
+	}
+	mw.Close()
+	router := mux.NewRouter()
+	router.HandleFunc("/api/worker/leases/{lease}/complete", completeLeaseHandler)
+	req := httptest.NewRequest("POST", "/api/worker/leases/"+leaseID+"/complete", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCompleteLeaseChecksWatermark(t *testing.T) {
+	oldOutputDir := outputDir
+	outputDir = t.TempDir()
+	t.Cleanup(func() { outputDir = oldOutputDir })
+	id := "0b1c2d3e-4f50-4a6b-8c7d-9e0f1a2b3c4d"
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+		releaseLeasesForJob(id)
+	})
+
+	for _, mark := range []string{"", "tone"} {
+		jobsMutex.Lock()
+		jobs[id] = &Job{ID: id, Status: "pending", CreatedAt: time.Now(), inputPath: "/tmp/input.wav", OutputFormat: "wav", Watermark: "tone"}
+		jobsMutex.Unlock()
+		lease, _ := acquireLease("worker-1", time.Minute)
+		rec := completeLease(lease.ID, map[string]string{"status": "completed", "watermark": mark}, map[string]string{"vocals": "vocals.wav"})
+
+		jobsMutex.RLock()
+		status := jobs[id].Status
+		jobsMutex.RUnlock()
+		want := "failed"
+		if mark != "" {
+			want = "completed"
+		}
+		if rec.Code != http.StatusOK || status != want {
+			t.Errorf("watermark %q: %d, job %s, want %s", mark, rec.Code, status, want)
+		}
+	}
+}
+
+func TestCompleteLeaseNamesStemsAndRevalidates(t *testing.T) {
+	oldOutputDir := outputDir
+	outputDir = t.TempDir()
+	t.Cleanup(func() { outputDir = oldOutputDir })
+	id := "1c2d3e4f-5061-4b7c-9d8e-0f1a2b3c4d5e"
+	jobsMutex.Lock()
+	jobs[id] = &Job{ID: id, Status: "pending", CreatedAt: time.Now(), inputPath: "/tmp/input.wav", OutputFormat: "wav"}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+		releaseLeasesForJob(id)
+	})
+
+	lease, _ := acquireLease("worker-1", time.Minute)
+	if rec := completeLease(lease.ID, map[string]string{"status": "completed"}, map[string]string{"vocals": "notes.txt"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("stem without an audio extension = %d", rec.Code)
+	}
+	rec := completeLease(lease.ID, map[string]string{"status": "completed"}, map[string]string{"vocals": "../../Take 3.WAV"})
+	jobsMutex.RLock()
+	path := jobs[id].OutputFiles["vocals"]
+	jobsMutex.RUnlock()
+	if rec.Code != http.StatusOK || path != filepath.Join(outputDir, id, "vocals.wav") {
+		t.Errorf("complete = %d, vocals saved as %q", rec.Code, path)
+	}
+
+	// A job that stopped processing meanwhile keeps its state
+	jobsMutex.Lock()
+	jobs[id].Status, jobs[id].OutputFiles = "pending", nil
+	jobsMutex.Unlock()
+	lease, _ = acquireLease("worker-1", time.Minute)
+	jobsMutex.Lock()
+	jobs[id].Status = "failed"
+	jobsMutex.Unlock()
+	if rec := completeLease(lease.ID, map[string]string{"status": "completed"}, map[string]string{"vocals": "vocals.wav"}); rec.Code != http.StatusConflict {
+		t.Errorf("complete after the job stopped processing = %d", rec.Code)
+	}
+	jobsMutex.RLock()
+	status := jobs[id].Status
+	jobsMutex.RUnlock()
+	if status != "failed" {
+		t.Errorf("status = %s, want failed", status)
+	}
+}
+
+func TestStaleLeaseLeavesJobAlone(t *testing.T) {
+	id := "2d3e4f50-6172-4c8d-8e9f-1a2b3c4d5e6f"
+	jobsMutex.Lock()
+	jobs[id] = &Job{ID: id, Status: "pending", CreatedAt: time.Now(), inputPath: "/tmp/input.wav", OutputFormat: "wav", Watermark: "tone"}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+		releaseLeasesForJob(id)
+	})
+
+	// The first worker's lease expires and the job goes to another worker
+	stale, _ := acquireLease("worker-1", time.Minute)
+	releaseLeasesForJob(id)
+	jobsMutex.Lock()
+	jobs[id].Status = "pending"
+	jobsMutex.Unlock()
+	current, _ := acquireLease("worker-2", time.Minute)
+
+	// Reported failures and failed checks alike
+	for _, msg := range []string{"out of memory", "Worker doesn't support watermarks"} {
+		rec := httptest.NewRecorder()
+		failLeasedJob(rec, stale, msg)
+		jobsMutex.RLock()
+		status := jobs[id].Status
+		jobsMutex.RUnlock()
+		if _, ok := activeLease(current.ID); rec.Code != http.StatusConflict || status != "processing" || !ok {
+			t.Errorf("%q from a stale lease = %d, job %s, current lease kept %v", msg, rec.Code, status, ok)
+		}
+	}
+	if rec := completeLease(current.ID, map[string]string{"status": "failed", "error": "out of memory"}, nil); rec.Code != http.StatusOK {
+		t.Errorf("failure from the current lease = %d", rec.Code)
+	}
+}
+
+func TestWorkerEnergy(t *testing.T) {
+	t.Setenv("ENERGY_GPU_WATTS", "300")
+	if e := workerEnergy(`{"device": "cuda", "seconds": 120}`); e == nil || e.WattHours != 10 {
+		t.Errorf("reported compute = %+v", e)
+	}
+	for _, raw := range []string{"", "{"} {
+		if e := workerEnergy(raw); e != nil {
+			t.Errorf("%q = %+v", raw, e)
+		}
+	}
+}
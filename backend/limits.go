@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxUploadBytes matches the frontend and nginx limit on audio uploads
+const maxUploadBytes = 100 << 20
+
+// routeLimit bounds a route's request body and how long a request may take.
+// A zero Timeout clears the deadlines for long-lived streams (WebSocket).
+type routeLimit struct {
+	MaxBody int64
+	Timeout time.Duration
+}
+
+// Server-wide timeouts; the middleware extends or clears the read/write
+// deadlines per route, so these only cover slow headers and unmatched routes
+const (
+	serverReadHeaderTimeout = 10 * time.Second
+	serverReadTimeout       = 30 * time.Second
+	serverWriteTimeout      = 60 * time.Second
+	serverIdleTimeout       = 2 * time.Minute
+)
+
+// defaultRouteLimit applies to JSON API routes not listed in routeLimits
+var defaultRouteLimit = routeLimit{MaxBody: 1 << 20, Timeout: 30 * time.Second}
+
+// routeLimits are keyed by mux path template
+var routeLimits = map[string]routeLimit{
+	// Multipart framing and form fields on top of the audio itself
+	"/api/upload":                         {MaxBody: maxUploadBytes + 1<<20, Timeout: 30 * time.Minute},
+	"/api/upload/batch":                   {MaxBody: maxBatchBytes + 1<<20, Timeout: 2 * time.Hour},
+	"/api/upload/{id}":                    {MaxBody: maxUploadChunkBytes, Timeout: 10 * time.Minute},
+	"/api/upload/{id}/complete":           {Timeout: 10 * time.Minute},
+	"/api/guest/{token}/upload":           {MaxBody: maxUploadBytes + 1<<20, Timeout: 30 * time.Minute},
+	"/api/download/{id}/{stem}":           {Timeout: 30 * time.Minute},
+	"/api/download/{id}/all":              {Timeout: 2 * time.Hour},
+	"/api/jobs/{id}/package":              {Timeout: 30 * time.Minute},
+	"/api/jobs/{id}/archive":              {Timeout: 30 * time.Minute},
+	"/api/stream/{token}":                 {Timeout: 30 * time.Minute},
+	"/api/compare":                        {Timeout: 5 * time.Minute},
+	"/api/benchmarks":                     {MaxBody: maxUploadBytes + 1<<20, Timeout: 30 * time.Minute},
+	"/api/compare/renders/{id}":           {Timeout: 5 * time.Minute},
+	"/api/live":                           {},
+	"/api/jobs/{id}/events":               {},
+	"/api/admin/events":                   {},
+	"/api/worker/leases/{lease}/input":    {Timeout: 30 * time.Minute},
+	"/api/worker/leases/{lease}/complete": {MaxBody: 2 << 30, Timeout: 30 * time.Minute},
+}
+
+// newServer returns the HTTP server with timeouts that stop slow clients
+// from holding connections open indefinitely
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
+	}
+}
+
+// limitsMiddleware caps the request body with http.MaxBytesReader and sets
+// the matched route's read/write deadlines and context timeout
+func limitsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultRouteLimit
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				if l, ok := routeLimits[tpl]; ok {
+					limit = l
+				}
+			}
+		}
+		if limit.MaxBody == 0 {
+			limit.MaxBody = defaultRouteLimit.MaxBody
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit.MaxBody)
+
+		rc := http.NewResponseController(w)
+		var deadline time.Time
+		if limit.Timeout > 0 {
+			deadline = time.Now().Add(limit.Timeout)
+			ctx, cancel := context.WithDeadline(r.Context(), deadline)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		// Not every ResponseWriter supports deadlines (e.g. in tests)
+		rc.SetReadDeadline(deadline)
+		rc.SetWriteDeadline(deadline)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isBodyTooLarge reports whether err came from exceeding the route's body limit
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestLimitsMiddleware(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(limitsMiddleware)
+	var deadline time.Time
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		deadline, _ = r.Context().Deadline()
+		if _, err := io.ReadAll(r.Body); isBodyTooLarge(err) {
+			http.Error(w, "Too large", http.StatusRequestEntityTooLarge)
+		}
+	}
+	router.HandleFunc("/api/webhooks", echo)
+	router.HandleFunc("/api/upload", echo)
+	router.HandleFunc("/api/live", echo)
+
+	big := strings.Repeat("x", 2<<20)
+	for path, want := range map[string]int{"/api/webhooks": http.StatusRequestEntityTooLarge, "/api/upload": http.StatusOK} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader(big)))
+		if rec.Code != want {
+			t.Errorf("POST %s with 2 MiB = %d, want %d", path, rec.Code, want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", "/api/upload", strings.NewReader("ok")))
+	if left := time.Until(deadline); left < 29*time.Minute || left > 30*time.Minute {
+		t.Errorf("upload deadline in %v, want 30m", left)
+	}
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/live", nil))
+	if !deadline.IsZero() {
+		t.Errorf("live stream got a deadline: %v", deadline)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Listen addresses. LISTEN_ADDRS is a comma-separated list of addresses the
+// server accepts connections on, all at once: "host:port" (":8080" is
+// dual-stack IPv4/IPv6), "tcp4:host:port" or "tcp6:[host]:port" to pin a
+// family, and "unix:/path/to.sock" for a Unix domain socket, e.g. for an
+// nginx upstream on the same host. Sockets are created with
+// UNIX_SOCKET_MODE (octal, default 0660), replacing a stale socket left by
+// a crash. Without LISTEN_ADDRS the server listens on ":$PORT".
+
+const defaultUnixSocketMode = 0660
+
+// listenAddr is one address to listen on
+type listenAddr struct {
+	Network string // tcp, tcp4, tcp6 or unix
+	Address string
+}
+
+func (a listenAddr) String() string {
+	return a.Network + ":" + a.Address
+}
+
+// parseListenAddrs reads LISTEN_ADDRS, defaulting to every interface on port
+func parseListenAddrs(value, port string) ([]listenAddr, error) {
+	if strings.TrimSpace(value) == "" {
+		return []listenAddr{{"tcp", ":" + port}}, nil
+	}
+	var addrs []listenAddr
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		a := listenAddr{Network: "tcp", Address: entry}
+		for _, network := range []string{"unix", "tcp4", "tcp6", "tcp"} {
+			if rest, ok := strings.CutPrefix(entry, network+":"); ok {
+				a = listenAddr{Network: network, Address: rest}
+				break
+			}
+		}
+		if a.Network == "unix" {
+			if !strings.HasPrefix(a.Address, "/") {
+				return nil, fmt.Errorf("listen address %q: socket path must be absolute", entry)
+			}
+		} else if _, p, err := net.SplitHostPort(a.Address); err != nil || p == "" {
+			return nil, fmt.Errorf("listen address %q: want host:port", entry)
+		}
+		addrs = append(addrs, a)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("LISTEN_ADDRS has no addresses")
+	}
+	return addrs, nil
+}
+
+func unixSocketMode() os.FileMode {
+	if m, err := strconv.ParseUint(os.Getenv("UNIX_SOCKET_MODE"), 8, 32); err == nil {
+		return os.FileMode(m)
+	}
+	return defaultUnixSocketMode
+}
+
+// listenAll opens every address, closing the ones already open if any fails
+func listenAll(addrs []listenAddr) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, a := range addrs {
+		l, err := listenOn(a)
+		if err != nil {
+			for _, open := range listeners {
+				open.Close()
+			}
+			return nil, fmt.Errorf("listening on %s: %v", a, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func listenOn(a listenAddr) (net.Listener, error) {
+	if a.Network != "unix" {
+		return net.Listen(a.Network, a.Address)
+	}
+	// A socket file outlives a crashed process and would fail the bind
+	if info, err := os.Lstat(a.Address); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", a.Address)
+		}
+		os.Remove(a.Address)
+	}
+	l, err := net.Listen("unix", a.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(a.Address, unixSocketMode()); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
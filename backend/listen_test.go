@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseListenAddrs(t *testing.T) {
+	addrs, err := parseListenAddrs(" [::1]:8080, tcp4:0.0.0.0:8081 ,unix:/run/t2s.sock,", "9000")
+	want := []listenAddr{{"tcp", "[::1]:8080"}, {"tcp4", "0.0.0.0:8081"}, {"unix", "/run/t2s.sock"}}
+	if err != nil || !reflect.DeepEqual(addrs, want) {
+		t.Errorf("parseListenAddrs = %v, %v; want %v", addrs, err, want)
+	}
+	if addrs, _ := parseListenAddrs("", "9000"); !reflect.DeepEqual(addrs, []listenAddr{{"tcp", ":9000"}}) {
+		t.Errorf("default = %v", addrs)
+	}
+	for _, bad := range []string{"8080", "unix:relative.sock", ",", "tcp6:[::1]"} {
+		if _, err := parseListenAddrs(bad, "9000"); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestListenAllServesTCPAndUnix(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "t2s.sock")
+	// A socket left behind by a crash is replaced
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	t.Setenv("UNIX_SOCKET_MODE", "600")
+
+	listeners, err := listenAll([]listenAddr{{"tcp", "127.0.0.1:0"}, {"unix", socket}})
+	if err != nil {
+		t.Fatalf("listenAll: %v", err)
+	}
+	server := newServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	for _, l := range listeners {
+		go server.Serve(l)
+	}
+	defer server.Close()
+
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, %v; want 0600", info.Mode().Perm(), err)
+	}
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	for client, url := range map[*http.Client]string{
+		http.DefaultClient: "http://" + listeners[0].Addr().String() + "/",
+		unixClient:         "http://unix/",
+	} {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Errorf("GET %s: %v", url, err)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "ok" {
+			t.Errorf("GET %s = %q", url, body)
+		}
+	}
+
+	os.WriteFile(filepath.Join(dir, "plain"), nil, 0644)
+	if _, err := listenAll([]listenAddr{{"unix", filepath.Join(dir, "plain")}}); err == nil {
+		t.Error("expected a regular file in the socket's place to be refused")
+	}
+}
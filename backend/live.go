@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Live separation sessions (experimental)
+//
+// A client opens a WebSocket on /api/live and streams interleaved signed
+// 16-bit little-endian PCM as binary messages. The backend cuts the stream
+// into fixed windows, sends each window to the processor as a small WAV job
+// and streams every separated stem back as a binary WAV message, preceded by
+// a JSON text message describing it. Windows that can't be processed in time
+// are dropped rather than queued, so latency stays bounded.
+//
+// Windows are sent like jobs: to the registered processors with failover,
+// or the canary, within liveWindowTimeout. A key may have
+// LIVE_MAX_SESSIONS_PER_KEY sessions open at once (default 2), and the
+// time spent separating its windows counts against its monthly quota; the
+// session is closed once the quota is used up.
+
+const (
+	liveMinWindowSeconds     = 2
+	liveMaxWindowSeconds     = 30
+	liveDefaultWindowSeconds = 10
+	// liveMaxPendingWindows bounds how far the session may fall behind
+	liveMaxPendingWindows = 2
+	liveWindowTimeout     = 2 * time.Minute
+)
+
+var (
+	liveSessionsPerKey = make(map[string]int) // API key ID -> open sessions
+	liveSessionsMutex  = &sync.Mutex{}
+)
+
+// liveMaxSessionsPerKey reads LIVE_MAX_SESSIONS_PER_KEY (default 2)
+func liveMaxSessionsPerKey() int {
+	if n, err := strconv.Atoi(os.Getenv("LIVE_MAX_SESSIONS_PER_KEY")); err == nil && n > 0 {
+		return n
+	}
+	return 2
+}
+
+// openLiveSession counts a session against its key, reporting false when
+// the key has as many open as it may. Requests without a key aren't counted.
+func openLiveSession(keyID string) bool {
+	if keyID == "" {
+		return true
+	}
+	liveSessionsMutex.Lock()
+	defer liveSessionsMutex.Unlock()
+	if liveSessionsPerKey[keyID] >= liveMaxSessionsPerKey() {
+		return false
+	}
+	liveSessionsPerKey[keyID]++
+	return true
+}
+
+// closeLiveSession ends a session counted by openLiveSession
+func closeLiveSession(keyID string) {
+	if keyID == "" {
+		return
+	}
+	liveSessionsMutex.Lock()
+	defer liveSessionsMutex.Unlock()
+	if liveSessionsPerKey[keyID]--; liveSessionsPerKey[keyID] <= 0 {
+		delete(liveSessionsPerKey, keyID)
+	}
+}
+
+// liveSettings holds the validated query parameters of a live session
+type liveSettings struct {
+	SampleRate    int
+	Channels      int
+	WindowSeconds int
+	Model         string
+	StemMode      string
+	IsolateStem   string
+
+	Variant   string // canary variant of the session, see canary.go
+	RequestID string
+}
+
+// windowBytes is the size of one PCM window in bytes
+func (s liveSettings) windowBytes() int {
+	return s.SampleRate * s.Channels * 2 * s.WindowSeconds
+}
+
+// liveMessage is the JSON text frame sent alongside binary stem data
+type liveMessage struct {
+	Type    string `json:"type"` // ready, stem, dropped, error
+	Session string `json:"session,omitempty"`
+	Window  int    `json:"window"`
+	Stem    string `json:"stem,omitempty"`
+	Bytes   int    `json:"bytes,omitempty"`
+	Latency string `json:"latency,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// liveWindow is one cut of the incoming stream awaiting separation
+type liveWindow struct {
+	Index    int
+	PCM      []byte
+	Received time.Time
+}
+
+var liveUpgrader = websocket.Upgrader{
+	ReadBufferSize:  64 << 10,
+	WriteBufferSize: 64 << 10,
+	CheckOrigin:     liveOriginAllowed,
+}
+
+// liveOriginAllowed applies the ALLOWED_ORIGINS policy to WebSocket handshakes
+func liveOriginAllowed(r *http.Request) bool {
+	allowed := os.Getenv("ALLOWED_ORIGINS")
+	origin := r.Header.Get("Origin")
+	if allowed == "" || allowed == "*" || origin == "" {
+		return true
+	}
+	for _, o := range strings.Split(allowed, ",") {
+		if strings.TrimSpace(o) == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLiveSettings validates the session parameters from the query string
+func parseLiveSettings(r *http.Request) (liveSettings, error) {
+	q := r.URL.Query()
+	s := liveSettings{
+		SampleRate:    44100,
+		Channels:      2,
+		WindowSeconds: liveDefaultWindowSeconds,
+		Model:         q.Get("model"),
+		StemMode:      q.Get("stem_mode"),
+		IsolateStem:   q.Get("isolate_stem"),
+	}
+	if v := q.Get("sample_rate"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 8000 || n > 96000 {
+			return s, fmt.Errorf("invalid sample_rate value")
+		}
+		s.SampleRate = n
+	}
+	if v := q.Get("channels"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 2 {
+			return s, fmt.Errorf("invalid channels value")
+		}
+		s.Channels = n
+	}
+	if v := q.Get("window_seconds"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < liveMinWindowSeconds || n > liveMaxWindowSeconds {
+			return s, fmt.Errorf("invalid window_seconds value")
+		}
+		s.WindowSeconds = n
+	}
+	if s.Model == "" {
+		s.Model = "htdemucs"
+	}
+	if s.StemMode == "" {
+		s.StemMode = "isolate"
+	}
+	if s.IsolateStem == "" {
+		s.IsolateStem = "vocals"
+	}
+	if !isAllowedModel(s.Model) {
+		return s, fmt.Errorf("invalid model value")
+	}
+	if !allowedStemModes[s.StemMode] {
+		return s, fmt.Errorf("invalid stem_mode value")
+	}
+	if s.StemMode == "isolate" && !allowedStems[s.IsolateStem] {
+		return s, fmt.Errorf("invalid isolate_stem value")
+	}
+	return s, nil
+}
+
+func liveSessionHandler(w http.ResponseWriter, r *http.Request) {
+	settings, err := parseLiveSettings(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keyID := apiKeyID(r.Context())
+	if !openLiveSession(keyID) {
+		writeRejection(w, http.StatusTooManyRequests, "live_session_limit",
+			fmt.Sprintf("Too many live sessions (%d open)", liveMaxSessionsPerKey()), retryRemedy(0, "Close another live session first"))
+		return
+	}
+	defer closeLiveSession(keyID)
+
+	conn, err := liveUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Live session upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(int64(settings.windowBytes()))
+
+	sessionID := uuid.New().String()
+	// The session takes a canary variant like a job, by its ID
+	variant := &Job{ID: sessionID, Model: settings.Model}
+	assignVariant(variant)
+	settings.Variant, settings.Model = variant.Variant, variant.Model
+	settings.RequestID = requestID(r.Context())
+	log.Printf("Live session %s started (%d Hz, %d ch, %ds windows, %s)", sessionID, settings.SampleRate, settings.Channels, settings.WindowSeconds, settings.Model)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// All writes go through a single goroutine; gorilla/websocket connections
+	// support one concurrent writer only
+	type outgoing struct {
+		kind int
+		data []byte
+	}
+	out := make(chan outgoing, 16)
+	sendJSON := func(m liveMessage) {
+		data, _ := json.Marshal(m)
+		select {
+		case out <- outgoing{websocket.TextMessage, data}:
+		case <-ctx.Done():
+		}
+	}
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for msg := range out {
+			conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+			if err := conn.WriteMessage(msg.kind, msg.data); err != nil || msg.kind == websocket.CloseMessage {
+				// Closing the connection ends the read loop too
+				cancel()
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	windows := make(chan liveWindow, liveMaxPendingWindows)
+	workerDone := make(chan struct{})
+	go func() {
+		defer close(workerDone)
+		for win := range windows {
+			if quotaExceeded(keyID) {
+				sendJSON(liveMessage{Type: "error", Window: win.Index, Error: quotaExceededMessage})
+				select {
+				case out <- outgoing{websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "quota exceeded")}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			started := time.Now()
+			stems, err := separateLiveWindow(ctx, sessionID, win, settings)
+			if keyID != "" && ctx.Err() == nil {
+				chargeAPIKey(keyID, time.Now(), time.Since(started).Minutes())
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				sendJSON(liveMessage{Type: "error", Window: win.Index, Error: err.Error()})
+				continue
+			}
+			latency := time.Since(win.Received).Round(time.Millisecond).String()
+			for _, stem := range sortedKeys(stems) {
+				sendJSON(liveMessage{Type: "stem", Window: win.Index, Stem: stem, Bytes: len(stems[stem]), Latency: latency})
+				select {
+				case out <- outgoing{websocket.BinaryMessage, stems[stem]}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	sendJSON(liveMessage{Type: "ready", Session: sessionID})
+
+	buf := make([]byte, 0, settings.windowBytes())
+	index := 0
+	for {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if kind != websocket.BinaryMessage {
+			continue
+		}
+		buf = append(buf, data...)
+		for len(buf) >= settings.windowBytes() {
+			win := liveWindow{Index: index, PCM: append([]byte(nil), buf[:settings.windowBytes()]...), Received: time.Now().UTC()}
+			buf = buf[settings.windowBytes():]
+			index++
+			select {
+			case windows <- win:
+			default:
+				// Separation is falling behind the stream: drop the window
+				sendJSON(liveMessage{Type: "dropped", Window: win.Index})
+			}
+		}
+	}
+
+	close(windows)
+	cancel()
+	<-workerDone
+	close(out)
+	<-writerDone
+	log.Printf("Live session %s ended after %d windows", sessionID, index)
+}
+
+// separateLiveWindow runs one PCM window through the processor and returns
+// the WAV bytes of each separated stem
+func separateLiveWindow(ctx context.Context, sessionID string, win liveWindow, s liveSettings) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, liveWindowTimeout)
+	defer cancel()
+
+	jobID := fmt.Sprintf("live-%s-%d", sessionID, win.Index)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", jobID+".wav")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create form")
+	}
+	part.Write(wavHeader(len(win.PCM), s.SampleRate, s.Channels))
+	part.Write(win.PCM)
+	writer.WriteField("job_id", jobID)
+	writer.WriteField("output_format", "wav")
+	writer.WriteField("model", s.Model)
+	writer.WriteField("stem_mode", s.StemMode)
+	writer.WriteField("isolate_stem", s.IsolateStem)
+	writer.Close()
+
+	code, respBody, err := postToProcessor(ctx, jobID, s.Variant, processorNeeds{Model: s.Model}, processRequest{
+		Body:        body.Bytes(),
+		ContentType: writer.FormDataContentType(),
+		RequestID:   s.RequestID,
+		Timeout:     liveWindowTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("processor unreachable")
+	}
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("processor failed with status %d", code)
+	}
+
+	var result struct {
+		Outputs map[string]string `json:"outputs"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse processor response")
+	}
+	defer os.RemoveAll(filepath.Join(outputDir, jobID))
+
+	stems := make(map[string][]byte, len(result.Outputs))
+	for stem, path := range result.Outputs {
+		if !safeOutputPath(path) {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s stem", stem)
+		}
+		stems[stem] = data
+	}
+	return stems, nil
+}
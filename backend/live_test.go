@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseLiveSettings(t *testing.T) {
+	s, err := parseLiveSettings(httptest.NewRequest("GET", "/api/live", nil))
+	if err != nil {
+		t.Fatalf("defaults should be valid: %v", err)
+	}
+	if s.SampleRate != 44100 || s.Channels != 2 || s.WindowSeconds != liveDefaultWindowSeconds {
+		t.Errorf("unexpected defaults: %+v", s)
+	}
+	if got, want := s.windowBytes(), 44100*2*2*liveDefaultWindowSeconds; got != want {
+		t.Errorf("windowBytes() = %d, want %d", got, want)
+	}
+
+	invalid := []string{
+		"/api/live?sample_rate=abc",
+		"/api/live?sample_rate=1000",
+		"/api/live?channels=6",
+		"/api/live?window_seconds=1",
+		"/api/live?window_seconds=600",
+		"/api/live?model=evil",
+		"/api/live?stem_mode=isolate&isolate_stem=kazoo",
+	}
+	for _, target := range invalid {
+		if _, err := parseLiveSettings(httptest.NewRequest("GET", target, nil)); err == nil {
+			t.Errorf("expected %s to be rejected", target)
+		}
+	}
+}
+
+func TestLiveOriginAllowed(t *testing.T) {
+	t.Setenv("ALLOWED_ORIGINS", "https://studio.example")
+
+	req := httptest.NewRequest("GET", "/api/live", nil)
+	req.Header.Set("Origin", "https://studio.example")
+	if !liveOriginAllowed(req) {
+		t.Error("configured origin should be allowed")
+	}
+
+	req.Header.Set("Origin", "https://evil.example")
+	if liveOriginAllowed(req) {
+		t.Error("unlisted origin should be rejected")
+	}
+}
+
+func TestSeparateLiveWindowUsesProcessors(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "loading model", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	var requestID string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID = r.Header.Get("X-Request-ID")
+		w.Write([]byte(`{"outputs": {}}`))
+	}))
+	defer up.Close()
+	useProcessors(t, []*processorInstance{{URL: down.URL, Healthy: true}, {URL: up.URL, Healthy: true}})
+
+	s, _ := parseLiveSettings(httptest.NewRequest("GET", "/api/live?sample_rate=8000&channels=1&window_seconds=2", nil))
+	s.RequestID = "live-request"
+	win := liveWindow{Index: 0, PCM: make([]byte, s.windowBytes()), Received: time.Now()}
+	if _, err := separateLiveWindow(context.Background(), "session", win, s); err != nil {
+		t.Fatalf("window with a healthy processor failed: %v", err)
+	}
+	if requestID != "live-request" {
+		t.Errorf("X-Request-ID = %q", requestID)
+	}
+	if p := registeredProcessors()[0]; p.Healthy || p.Active != 0 {
+		t.Errorf("failing processor = %+v, want unhealthy and idle", p)
+	}
+}
+
+func TestLiveSessionsPerKey(t *testing.T) {
+	t.Setenv("LIVE_MAX_SESSIONS_PER_KEY", "1")
+	if !openLiveSession("live-key") {
+		t.Fatal("first session refused")
+	}
+	req := httptest.NewRequest("GET", "/api/live", nil)
+	req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, "live-key"))
+	rec := httptest.NewRecorder()
+	liveSessionHandler(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second session = %d: %s", rec.Code, rec.Body)
+	}
+	if !openLiveSession("") || !openLiveSession("") {
+		t.Error("sessions without a key are limited")
+	}
+	closeLiveSession("live-key")
+	if !openLiveSession("live-key") {
+		t.Error("closed session still counted")
+	}
+	closeLiveSession("live-key")
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // zone names without the image's zoneinfo
+)
+
+// Response localization, for clients outside the server's zone and
+// language. Timestamps are kept in UTC and every *_at field is RFC 3339;
+// ?tz=America/Sao_Paulo (an IANA zone name) renders them in that zone, with
+// its offset, on any JSON response. ?locale=de formats the human-readable
+// durations, processing_time and elapsed, with the language's units
+// ("2 Min. 5 Sek."); without it they keep the "2m 5s" form. Durations meant
+// for programs are ISO 8601: a job's processing_duration ("PT2M5S") and
+// download_urls_expire_in. An unknown zone is refused with a 400, and a
+// language without its own units gets English ones.
+
+// durationUnits are the unit names of one language
+type durationUnits struct {
+	hour, minute, second string
+	sep                  string // between a number and its unit, and between parts
+}
+
+var localeUnits = map[string]durationUnits{
+	"en": {"h", "min", "s", " "},
+	"de": {"Std.", "Min.", "Sek.", " "},
+	"es": {"h", "min", "s", " "},
+	"fr": {"h", "min", "s", " "},
+	"it": {"h", "min", "s", " "},
+	"nl": {"u", "min", "s", " "},
+	"pt": {"h", "min", "s", " "},
+	"ja": {"時間", "分", "秒", ""},
+}
+
+// responseFormat is how a request wants times and durations rendered
+type responseFormat struct {
+	loc    *time.Location // nil: UTC, as stored
+	locale string         // "": the legacy "2m 5s" durations
+}
+
+// parseResponseFormat reads ?tz= and ?locale=
+func parseResponseFormat(q url.Values) (responseFormat, error) {
+	var f responseFormat
+	if tz := q.Get("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil || tz == "Local" {
+			return f, fmt.Errorf("Invalid tz value: %s is not an IANA time zone (e.g. Europe/Rome, UTC)", tz)
+		}
+		f.loc = loc
+	}
+	if locale := q.Get("locale"); locale != "" {
+		lang, _, _ := strings.Cut(strings.ToLower(strings.ReplaceAll(locale, "_", "-")), "-")
+		if _, ok := localeUnits[lang]; !ok {
+			lang = "en"
+		}
+		f.locale = lang
+	}
+	return f, nil
+}
+
+// isoDuration formats d as an ISO 8601 duration, e.g. PT1H2M5.5S
+func isoDuration(d time.Duration) string {
+	d = d.Round(time.Millisecond)
+	if d <= 0 {
+		return "PT0S"
+	}
+	var b strings.Builder
+	b.WriteString("PT")
+	if h := d / time.Hour; h > 0 {
+		fmt.Fprintf(&b, "%dH", h)
+		d -= h * time.Hour
+	}
+	if m := d / time.Minute; m > 0 {
+		fmt.Fprintf(&b, "%dM", m)
+		d -= m * time.Minute
+	}
+	if d > 0 {
+		b.WriteString(strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "S")
+	}
+	return b.String()
+}
+
+// localizedDuration formats d to the second in the units of a language
+func localizedDuration(d time.Duration, locale string) string {
+	u, ok := localeUnits[locale]
+	if !ok {
+		u = localeUnits["en"]
+	}
+	secs := int(d.Round(time.Second).Seconds())
+	var parts []string
+	if h := secs / 3600; h > 0 {
+		parts = append(parts, strconv.Itoa(h)+u.sep+u.hour)
+	}
+	if m := secs % 3600 / 60; m > 0 {
+		parts = append(parts, strconv.Itoa(m)+u.sep+u.minute)
+	}
+	if s := secs % 60; s > 0 || len(parts) == 0 {
+		parts = append(parts, strconv.Itoa(s)+u.sep+u.second)
+	}
+	return strings.Join(parts, u.sep)
+}
+
+// isTimestampKey reports whether a JSON field holds a timestamp
+func isTimestampKey(key string) bool {
+	return key == "at" || strings.HasSuffix(key, "_at") || key == "next_check_after"
+}
+
+// humanDurationKeys are the fields formatted for people, like "2m 5s"
+var humanDurationKeys = map[string]bool{"processing_time": true, "elapsed": true}
+
+// localize rewrites the timestamps and human durations of decoded JSON
+func (f responseFormat) localize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			s, isString := value.(string)
+			switch {
+			case isString && f.loc != nil && isTimestampKey(key):
+				if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+					v[key] = t.In(f.loc).Format(time.RFC3339Nano)
+				}
+			case isString && f.locale != "" && humanDurationKeys[key]:
+				if d, err := time.ParseDuration(strings.ReplaceAll(s, " ", "")); err == nil {
+					v[key] = localizedDuration(d, f.locale)
+				}
+			default:
+				v[key] = f.localize(value)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = f.localize(v[i])
+		}
+	}
+	return v
+}
+
+// localizingWriter holds back JSON responses to localize them; anything
+// else, event streams included, goes straight through
+type localizingWriter struct {
+	http.ResponseWriter
+	format    responseFormat
+	status    int
+	buffering bool
+	buf       bytes.Buffer
+}
+
+func (l *localizingWriter) WriteHeader(code int) {
+	if l.status != 0 {
+		return
+	}
+	l.status = code
+	if strings.HasPrefix(l.Header().Get("Content-Type"), "application/json") {
+		l.buffering = true
+		return
+	}
+	l.ResponseWriter.WriteHeader(code)
+}
+
+func (l *localizingWriter) Write(b []byte) (int, error) {
+	if l.status == 0 {
+		l.WriteHeader(http.StatusOK)
+	}
+	if l.buffering {
+		return l.buf.Write(b)
+	}
+	return l.ResponseWriter.Write(b)
+}
+
+// finish writes a held-back response, localized when it parses
+func (l *localizingWriter) finish() {
+	if !l.buffering {
+		return
+	}
+	body := l.buf.Bytes()
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err == nil {
+		var out bytes.Buffer
+		if json.NewEncoder(&out).Encode(l.format.localize(v)) == nil {
+			body = out.Bytes()
+		}
+	}
+	l.Header().Del("Content-Length")
+	l.ResponseWriter.WriteHeader(l.status)
+	l.ResponseWriter.Write(body)
+}
+
+// Unwrap lets http.ResponseController reach deadlines, flushing and hijacking
+func (l *localizingWriter) Unwrap() http.ResponseWriter {
+	return l.ResponseWriter
+}
+
+// Flush keeps event streams working; held-back JSON is written at the end
+func (l *localizingWriter) Flush() {
+	if !l.buffering {
+		http.NewResponseController(l.ResponseWriter).Flush()
+	}
+}
+
+// Hijack keeps WebSocket upgrades working behind the writer
+func (l *localizingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(l.ResponseWriter).Hijack()
+}
+
+// localizationMiddleware applies ?tz= and ?locale= to JSON responses
+func localizationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("tz") == "" && q.Get("locale") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		f, err := parseResponseFormat(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lw := &localizingWriter{ResponseWriter: w, format: f}
+		next.ServeHTTP(lw, r)
+		lw.finish()
+	})
+}
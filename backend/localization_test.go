@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDurationFormats(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		0:                                     "PT0S",
+		1500 * time.Millisecond:               "PT1.5S",
+		2*time.Minute + 5*time.Second:         "PT2M5S",
+		26*time.Hour + 3*time.Second:          "PT26H3S",
+		time.Hour + 30*time.Minute:            "PT1H30M",
+		15*time.Minute + 400*time.Microsecond: "PT15M",
+	} {
+		if got := isoDuration(d); got != want {
+			t.Errorf("isoDuration(%s) = %s, want %s", d, got, want)
+		}
+	}
+
+	d := time.Hour + 2*time.Minute + 5*time.Second
+	for locale, want := range map[string]string{"en": "1 h 2 min 5 s", "de": "1 Std. 2 Min. 5 Sek.", "ja": "1時間2分5秒"} {
+		if got := localizedDuration(d, locale); got != want {
+			t.Errorf("%s = %q, want %q", locale, got, want)
+		}
+	}
+	if got := localizedDuration(400*time.Millisecond, "fr"); got != "0 s" {
+		t.Errorf("under a second = %q", got)
+	}
+}
+
+func TestParseResponseFormat(t *testing.T) {
+	f, err := parseResponseFormat(url.Values{"tz": {"Asia/Tokyo"}, "locale": {"de_AT"}})
+	if err != nil || f.loc.String() != "Asia/Tokyo" || f.locale != "de" {
+		t.Errorf("format = %+v, %v", f, err)
+	}
+	if f, _ := parseResponseFormat(url.Values{"locale": {"sw-KE"}}); f.locale != "en" {
+		t.Errorf("unsupported locale = %q", f.locale)
+	}
+	for _, tz := range []string{"Mars/Olympus", "Local", "+02:00"} {
+		if _, err := parseResponseFormat(url.Values{"tz": {tz}}); err == nil {
+			t.Errorf("tz=%s accepted", tz)
+		}
+	}
+}
+
+func TestIntegrationLocalizedJob(t *testing.T) {
+	b := newIntegrationBackend(t, 1)
+	b.processor.Delay = 100 * time.Millisecond
+	job := b.waitFor(b.upload("song.mp3", nil).ID, "completed")
+	if job.ProcessingDuration != "PT0.1S" || job.DownloadURLsExpireIn != "PT15M" {
+		t.Errorf("durations = %s, %s", job.ProcessingDuration, job.DownloadURLsExpireIn)
+	}
+
+	code, data := b.get("/api/jobs/" + job.ID + "?tz=Asia/Tokyo&locale=de")
+	var local map[string]interface{}
+	json.Unmarshal(data, &local)
+	created, _ := local["created_at"].(string)
+	if code != http.StatusOK || !strings.HasSuffix(created, "+09:00") || local["processing_time"] != "0 Sek." {
+		t.Fatalf("localized job = %d %s", code, data)
+	}
+	if at, err := time.Parse(time.RFC3339Nano, created); err != nil || !at.Equal(job.CreatedAt) {
+		t.Errorf("created_at = %s, want %s", created, job.CreatedAt)
+	}
+	// Any JSON response, lists included
+	_, data = b.get("/api/jobs?tz=America/Sao_Paulo")
+	if !strings.Contains(string(data), "-03:00") {
+		t.Errorf("localized list = %s", data)
+	}
+	if code, _ := b.get("/api/jobs/" + job.ID + "?tz=Nowhere"); code != http.StatusBadRequest {
+		t.Errorf("unknown zone = %d", code)
+	}
+	// Event streams aren't held back
+	resp, err := http.Get(b.URL + "/api/jobs/" + job.ID + "/events?tz=UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	stream, _ := io.ReadAll(resp.Body) // ends with the finished job
+	if resp.Header.Get("Content-Type") != "text/event-stream" || !strings.Contains(string(stream), `"status":"completed"`) {
+		t.Errorf("stream = %s %s", resp.Header.Get("Content-Type"), stream)
+	}
+}
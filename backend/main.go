@@ -2,17 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -20,22 +28,114 @@ import (
 )
 
 type Job struct {
-	ID             string            `json:"id"`
-	Status         string            `json:"status"` // pending, processing, completed, failed
-	FileName       string            `json:"filename"`
-	CreatedAt      time.Time         `json:"created_at"`
-	CompletedAt    *time.Time        `json:"completed_at,omitempty"`
-	Error          string            `json:"error,omitempty"`
-	OutputFiles    map[string]string `json:"output_files,omitempty"`
-	StemMode       string            `json:"stem_mode,omitempty"`        // "all" or "isolate"
-	IsolateStem    string            `json:"isolate_stem,omitempty"`     // which stem to isolate
-	ProcessingTime string            `json:"processing_time,omitempty"`  // total processing time
-	OutputFormat   string            `json:"output_format,omitempty"`    // mp3, wav, flac
-	Model          string            `json:"model,omitempty"`            // demucs model name
-	Segment        string            `json:"segment,omitempty"`          // segment size for memory management
-	Overlap        string            `json:"overlap,omitempty"`          // overlap between prediction windows
-	Shifts         string            `json:"shifts,omitempty"`           // shift trick for better quality
-	ClipMode       string            `json:"clip_mode,omitempty"`        // rescale or clamp
+	ID                   string            `json:"id"`
+	Status               string            `json:"status"` // pending, queued, processing, completed, failed, expired
+	FileName             string            `json:"filename"`
+	CreatedAt            time.Time         `json:"created_at"`
+	CompletedAt          *time.Time        `json:"completed_at,omitempty"`
+	Error                string            `json:"error,omitempty"`
+	OutputFiles          map[string]string `json:"output_files,omitempty"`
+	StemMode             string            `json:"stem_mode,omitempty"`       // "all" or "isolate"
+	IsolateStem          string            `json:"isolate_stem,omitempty"`    // which stem to isolate
+	ProcessingTime       string            `json:"processing_time,omitempty"` // total processing time
+	OutputFormat         string            `json:"output_format,omitempty"`   // mp3, wav, flac
+	Model                string            `json:"model,omitempty"`           // demucs model name
+	Segment              string            `json:"segment,omitempty"`         // segment size for memory management
+	Overlap              string            `json:"overlap,omitempty"`         // overlap between prediction windows
+	Shifts               string            `json:"shifts,omitempty"`          // shift trick for better quality
+	ClipMode             string            `json:"clip_mode,omitempty"`       // rescale or clamp
+	MP3Bitrate           string            `json:"mp3_bitrate,omitempty"`     // kbps for mp3 output
+	ExtraFormats         []string          `json:"extra_formats,omitempty"`   // also transcoded to these formats
+	Deterministic        bool              `json:"deterministic,omitempty"`   // reproducible, byte-identical stems
+	Seed                 string            `json:"seed,omitempty"`            // random seed of a deterministic job
+	Encrypted            bool              `json:"encrypted,omitempty"`       // end-to-end encrypted upload and stems
+	Preset               string            `json:"preset,omitempty"`          // non-music separation preset
+	Template             string            `json:"template,omitempty"`        // job template it was created from
+	Watermark            string            `json:"watermark,omitempty"`       // mark embedded in the stems, see watermark.go
+	Determinism          *Determinism      `json:"determinism,omitempty"`     // what the processor pinned
+	Deliveries           []Delivery        `json:"deliveries,omitempty"`      // exports to configured targets
+	Pipeline             []PipelineStep    `json:"pipeline,omitempty"`        // steps run after separation
+	Metadata             *TrackMetadata    `json:"metadata,omitempty"`        // tags detected on the upload
+	Public               bool              `json:"public,omitempty"`          // listed in the public gallery
+	PublishedAt          *time.Time        `json:"published_at,omitempty"`
+	QueuePosition        int               `json:"queue_position,omitempty"`    // 1-based place while queued
+	Policy               *PolicyDecision   `json:"policy,omitempty"`            // content policy hook verdict
+	BatchID              string            `json:"batch_id,omitempty"`          // batch upload the job belongs to
+	ProcessorBatch       string            `json:"processor_batch,omitempty"`   // shared by clips separated in one processor request
+	Variant              string            `json:"variant,omitempty"`           // stable or canary during a rollout
+	Interactive          bool              `json:"interactive,omitempty"`       // short enough for the fast lane
+	Rating               int               `json:"rating,omitempty"`            // user's 1-5 quality score
+	Environment          *ProcessingEnv    `json:"environment,omitempty"`       // where the job was processed
+	Energy               *EnergyEstimate   `json:"energy,omitempty"`            // estimated use of the separation
+	Notes                []JobNote         `json:"notes,omitempty"`             // processor remarks on the result
+	Handoffs             []JobHandoff      `json:"handoffs,omitempty"`          // processors the job left mid-run
+	SelfTest             bool              `json:"self_test,omitempty"`         // synthetic job run by the self-test
+	APIKeyID             string            `json:"api_key_id,omitempty"`        // key that created the job
+	OrgID                string            `json:"org_id,omitempty"`            // organization it belongs to, see orgs.go
+	GuestLink            string            `json:"guest_link,omitempty"`        // label of the guest link it was uploaded through
+	Region               string            `json:"region,omitempty"`            // where its upload and stems are stored
+	CacheHit             bool              `json:"cache_hit,omitempty"`         // stems reused from an identical earlier job
+	Stored               bool              `json:"stored,omitempty"`            // stems copied to remote storage
+	ExpiredAt            *time.Time        `json:"expired_at,omitempty"`        // when retention deleted the stems
+	MissingOutputs       []string          `json:"missing_outputs,omitempty"`   // registered but not on disk
+	Reconciled           bool              `json:"reconciled,omitempty"`        // completed from stems found after a failure
+	ReadyStems           []string          `json:"ready_stems,omitempty"`       // finished while processing, downloadable early
+	Mixes                []Mix             `json:"mixes,omitempty"`             // custom mixdowns of the stems
+	OutputHashes         map[string]string `json:"output_hashes,omitempty"`     // stem -> SHA-256, for immutable URLs
+	CallbackURL          string            `json:"callback_url,omitempty"`      // notified when the job finishes
+	AdvancedOptions      map[string]string `json:"advanced_options,omitempty"`  // Demucs flags passed through
+	RequestID            string            `json:"request_id,omitempty"`        // X-Request-ID of the request that created the job
+	Effective            *EffectiveOptions `json:"effective_options,omitempty"` // resolved options, only in responses
+	DownloadURLs         map[string]string `json:"download_urls,omitempty"`     // signed, short-lived; only in responses
+	DownloadURLsExpireAt *time.Time        `json:"download_urls_expire_at,omitempty"`
+	DownloadURLsExpireIn string            `json:"download_urls_expire_in,omitempty"`
+	ProcessingDuration   string            `json:"processing_duration,omitempty"`
+	PollIntervalMS       int               `json:"poll_interval_ms,omitempty"` // when to check again; only in responses
+	NextCheckAfter       *time.Time        `json:"next_check_after,omitempty"`
+
+	inputPath string // uploaded source file, kept for external workers
+	dedupKey  string // content hash and settings, indexes the result for reuse
+	force     bool   // separate even if a cached result exists
+
+	callbackSecret  string // signs callback_url deliveries
+	sealedKey       string // job key sealed to the processors, see encryption.go
+	stemGroups      []PresetStem
+	processorURL    string // processor instance the job was sent to
+	pinnedProcessor string // processor the job must run on, for upgrade reports
+	ignoredOptions  map[string]string
+	readyOutputs    map[string]string // ready stem -> file, replaced wholesale
+	exports         []deliveryRequest // the template's deliveries, queued on completion
+
+	cancel      context.CancelCauseFunc // stops the job while it is processing
+	clipSeconds float64                 // upload length for batching; 0 not probed yet, <0 unknown
+
+	outputProbes    map[string]outputProbe     // media info of listed outputs, see outputs.go
+	chapterActivity map[float64]cachedActivity // activity map per threshold, see chapters.go
+}
+
+// ProcessingEnv labels the processor instance that produced a job's stems,
+// so quality regressions can be traced to a worker, GPU or model update
+type ProcessingEnv struct {
+	Instance      string `json:"instance,omitempty"` // processor hostname or worker ID
+	Image         string `json:"image,omitempty"`    // container image
+	Device        string `json:"device,omitempty"`   // cpu, cuda, rocm or mps
+	GPU           string `json:"gpu,omitempty"`
+	DemucsVersion string `json:"demucs_version,omitempty"`
+	TorchVersion  string `json:"torch_version,omitempty"`
+}
+
+// parseProcessingEnv reads the environment a processor or worker reported,
+// or returns nil when there is none
+func parseProcessingEnv(v interface{}) *ProcessingEnv {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var env ProcessingEnv
+	if json.Unmarshal(raw, &env) != nil || env == (ProcessingEnv{}) {
+		return nil
+	}
+	return &env
 }
 
 var (
@@ -45,6 +145,12 @@ var (
 	// For production, consider using a database or persistent storage
 )
 
+// Storage roots shared with the processor (overridable via UPLOAD_DIR/OUTPUT_DIR)
+var (
+	uploadDir = "/app/uploads"
+	outputDir = "/app/outputs"
+)
+
 // jobIDPattern validates that job IDs only contain UUID-safe characters
 var jobIDPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9\-]{0,254}$`)
 
@@ -58,6 +164,13 @@ var (
 		"mdx": true, "mdx_extra": true, "mdx_q": true, "mdx_extra_q": true,
 	}
 	allowedClipModes = map[string]bool{"rescale": true, "clamp": true}
+	sixStemModels    = map[string]bool{"htdemucs_6s": true}
+	// Transformer models only run with the segment length they were trained on
+	transformerModels = map[string]bool{"htdemucs": true, "htdemucs_ft": true, "htdemucs_6s": true}
+	// Numeric options, in the order they are listed in error messages
+	allowedMP3Bitrates = []string{"128", "192", "256", "320"}
+	allowedSegments    = []string{"8", "10", "15", "20", "25", "30", "40", "60"}
+	allowedOverlaps    = []string{"0.1", "0.15", "0.2", "0.25", "0.3", "0.35", "0.4", "0.5"}
 )
 
 // isValidJobID checks that a job ID contains only alphanumeric chars and hyphens
@@ -65,53 +178,385 @@ func isValidJobID(id string) bool {
 	return jobIDPattern.MatchString(id)
 }
 
-// sanitizeFilename removes dangerous characters from filenames to prevent path traversal
-func sanitizeFilename(filename string) string {
-	// Remove any path separators
-	filename = filepath.Base(filename)
-	// Remove or replace dangerous characters
-	reg := regexp.MustCompile(`[^a-zA-Z0-9._-]`)
-	filename = reg.ReplaceAllString(filename, "_")
-	// Limit length
-	if len(filename) > 255 {
-		ext := filepath.Ext(filename)
-		filename = filename[:255-len(ext)] + ext
-	}
-	return filename
-}
-
-// safeOutputPath validates that a file path is rooted under /app/outputs
+// safeOutputPath validates that a file path is rooted under the output directory
 func safeOutputPath(path string) bool {
 	absPath, err := filepath.Abs(path)
 	if err != nil {
 		return false
 	}
 	cleaned := filepath.Clean(absPath)
-	return strings.HasPrefix(cleaned, "/app/outputs/")
+	return strings.HasPrefix(cleaned, filepath.Clean(outputDir)+"/")
 }
 
 func main() {
+	if embeddedBuild {
+		if err := configureEmbedded(); err != nil {
+			log.Fatal(err)
+		}
+	}
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
+	if dir := os.Getenv("UPLOAD_DIR"); dir != "" {
+		uploadDir = dir
+	}
+	if dir := os.Getenv("OUTPUT_DIR"); dir != "" {
+		outputDir = dir
+	}
+	if _, remote, err := storageFromEnv(); err != nil {
+		log.Fatal(err)
+	} else if remote {
+		log.Printf("Copying uploads and stems to %s object storage", os.Getenv("STORAGE_BACKEND"))
+	}
+	if c, err := cdnFromEnv(); err != nil {
+		log.Fatal(err)
+	} else if c != nil {
+		log.Printf("Redirecting stored stem downloads to the %s CDN at %s", c.Provider, c.BaseURL)
+	}
+	loadCustomModels()
+	loadJobTemplates()
+	if err := loadProcessors(); err != nil {
+		log.Fatal(err)
+	} else if n := len(registeredProcessors()); n > 0 {
+		log.Printf("Routing jobs across %d processors", n)
+		go processorHealthChecker(processorHealthInterval())
+	}
+	if _, err := parseTiers(os.Getenv("TIERS")); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := parsePresetModels(os.Getenv("PRESET_MODELS")); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkWatermark(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startFixtureMode(); err != nil {
+		log.Fatal(err)
+	}
+	if regions, err := parseStorageRegions(os.Getenv("STORAGE_REGIONS")); err != nil {
+		log.Fatal(err)
+	} else if len(regions) > 0 {
+		log.Printf("Routing uploads across %d storage regions; this backend is in %q", len(regions), currentRegion())
+	}
+	if key, err := e2ePublicKey(); err != nil {
+		log.Fatal(err)
+	} else if key != nil {
+		log.Printf("End-to-end encrypted jobs enabled")
+	}
+	loadPartialUploads()
+	loadAPIKeys()
+	loadOrgs()
+	loadInvitations()
+	loadJobEventLogs()
+	externalWorkers = os.Getenv("EXTERNAL_WORKERS") == "true"
+	workerToken = os.Getenv("WORKER_TOKEN")
+	adminToken = os.Getenv("ADMIN_TOKEN")
+
+	router := newRouter()
+
+	// Event listeners and background workers
+	onEvent(recordJobMetrics)
+	onEvent(recordSLOEvent)
+	onEvent(logJobEvent)
+	onEvent(publishJobProgress)
+	onEvent(publishAdminEvent)
+	onEvent(trackAPIKeyUsage)
+	onEvent(trackOrgUsage)
+	onEvent(forgetJobInvitations)
+	onEvent(retainDebugCapture)
+	onEvent(indexDedupResult)
+	onEvent(syncStorage)
+	onEvent(hashOutputs)
+	onEvent(releaseUpload)
+	onEvent(forgetProcessorStatus)
+	go streamTokenReaper(time.Hour)
+	go guestLinkReaper(time.Hour)
+	go compareRenderReaper(10 * time.Minute)
+	startDeliveryWorkers(2)
+	onEvent(dispatchWebhooks)
+	onEvent(dispatchJobCallback)
+	go leaseReaper(15 * time.Second)
+	go orphanSweeper(orphanGCInterval())
+	go reconciler(reconcileInterval())
+	go partialUploadReaper(partialUploadSweep)
+	go retentionJanitor(retentionSweepInterval)
+	go jobEventLogJanitor(time.Hour)
+	if interval := selfTestInterval(); interval > 0 {
+		go selfTestScheduler(interval)
+	}
+	if !externalWorkers {
+		processingQueue.start(maxConcurrentJobs(), runQueuedJob)
+		processingQueue.startFastLane(fastLaneWorkers(), runQueuedJob)
+	}
+
+	listeners, names, err := serverListeners(port)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := newServer(listeners[0].Addr().String(), router)
+	for i, l := range listeners {
+		go func() {
+			log.Printf("Server listening on %s", names[i])
+			if err := server.Serve(l); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if path := os.Getenv("PID_FILE"); path != "" {
+		if err := writePIDFile(path); err != nil {
+			log.Fatal(err)
+		}
+		defer os.Remove(path)
+	}
+	if path := os.Getenv("HEALTH_FILE"); path != "" {
+		go healthFileWriter(path, healthFileInterval())
+		defer os.Remove(path)
+	}
+	if err := sdNotify("READY=1\n" + serviceStatus()); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+	if interval := watchdogInterval(); interval > 0 {
+		go watchdogPinger(interval)
+	}
 
+	// Stop taking requests, then let running jobs finish before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	log.Printf("Shutting down")
+	sdNotify("STOPPING=1")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+	server.Shutdown(shutdownCtx)
+	if left := processingQueue.drain(shutdownCtx); len(left) > 0 {
+		log.Printf("%d queued jobs were not started", len(left))
+	}
+	if _, running := processingQueue.stats(); running > 0 {
+		// Abort them rather than leave their processor requests behind
+		stopJobs(errShuttingDown)
+		abortCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		processingQueue.wait(abortCtx)
+	}
+}
+
+// serverListeners opens the sockets to serve on: those passed by systemd
+// socket activation, or else LISTEN_ADDRS
+func serverListeners(port string) ([]net.Listener, []string, error) {
+	activated, err := systemdListeners(os.Getenv, os.Getpid(), sdListenFDsStart)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Children (ffmpeg, probes) must not think they were socket activated
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	var listeners []net.Listener
+	var names []string
+	if len(activated) > 0 {
+		for _, l := range activated {
+			listeners = append(listeners, l.Listener)
+			names = append(names, fmt.Sprintf("%s (socket activated, %s)", l.Addr(), l.Name))
+		}
+		return listeners, names, nil
+	}
+	addrs, err := parseListenAddrs(os.Getenv("LISTEN_ADDRS"), port)
+	if err != nil {
+		return nil, nil, err
+	}
+	if listeners, err = listenAll(addrs); err != nil {
+		return nil, nil, err
+	}
+	for _, a := range addrs {
+		names = append(names, a.String())
+	}
+	return listeners, names, nil
+}
+
+// newRouter registers the middleware and every API route
+func newRouter() *mux.Router {
 	router := mux.NewRouter()
 
+	// Request IDs, structured request logs and HTTP metrics
+	router.Use(requestLogMiddleware)
 	// CORS middleware
 	router.Use(corsMiddleware)
+	// Recorded API responses for contract tests (FIXTURE_MODE)
+	router.Use(fixtureMiddleware)
+	// Per-route body size limits and timeouts
+	router.Use(limitsMiddleware)
+	// ?tz= and ?locale= on JSON responses
+	router.Use(localizationMiddleware)
+	// API keys and their rate limits (API_KEYS_REQUIRED=true)
+	router.Use(apiKeyMiddleware)
+	// Keys only reach their own jobs
+	router.Use(jobAccessMiddleware)
 
 	// Routes
 	router.HandleFunc("/api/health", healthHandler).Methods("GET")
-	router.HandleFunc("/api/upload", uploadHandler).Methods("POST")
+	router.HandleFunc("/metrics", metricsHandler).Methods("GET")
+	router.HandleFunc("/api/ready", readyHandler).Methods("GET")
+	router.HandleFunc("/api/branding", brandingHandler).Methods("GET")
+	router.HandleFunc("/api/terms", termsHandler).Methods("GET")
+	router.HandleFunc("/api/changelog", changelogHandler).Methods("GET")
+	router.HandleFunc("/api/schemas/events", eventSchemasHandler).Methods("GET")
+	router.HandleFunc("/api/fixtures", listFixturesHandler).Methods("GET")
+	router.HandleFunc("/api/fixtures/reset", resetFixturesHandler).Methods("POST")
+	router.HandleFunc("/api/terms/accept", acceptTermsHandler).Methods("POST")
+	router.HandleFunc("/api/upload", requireTerms(requireQuota(uploadHandler))).Methods("POST")
+	router.HandleFunc("/api/upload/endpoint", uploadEndpointHandler).Methods("GET")
+	router.HandleFunc("/api/encryption-key", encryptionKeyHandler).Methods("GET")
+	router.HandleFunc("/api/presets", presetsHandler).Methods("GET")
+	router.HandleFunc("/api/templates", createJobTemplateHandler).Methods("POST")
+	router.HandleFunc("/api/templates", listJobTemplatesHandler).Methods("GET")
+	router.HandleFunc("/api/templates/{name}", getJobTemplateHandler).Methods("GET")
+	router.HandleFunc("/api/templates/{name}", replaceJobTemplateHandler).Methods("PUT")
+	router.HandleFunc("/api/templates/{name}", deleteJobTemplateHandler).Methods("DELETE")
+	router.HandleFunc("/api/upload/batch", requireTerms(requireQuota(batchUploadHandler))).Methods("POST")
+	router.HandleFunc("/api/batches/{id}", getBatchHandler).Methods("GET")
+	router.HandleFunc("/api/upload/init", requireTerms(requireQuota(initUploadHandler))).Methods("POST")
+	router.HandleFunc("/api/upload/{id}", getUploadHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/api/upload/{id}", appendUploadHandler).Methods("PATCH")
+	router.HandleFunc("/api/upload/{id}", abortUploadHandler).Methods("DELETE")
+	router.HandleFunc("/api/upload/{id}/complete", completeUploadHandler).Methods("POST")
+	router.HandleFunc("/api/orgs", listOrgsHandler).Methods("GET")
+	router.HandleFunc("/api/orgs/{id}", getOrgHandler).Methods("GET")
+	router.HandleFunc("/api/orgs/{id}/usage", orgUsageHandler).Methods("GET")
+	router.HandleFunc("/api/orgs/{id}/members/{key_id}", putOrgMemberHandler).Methods("PUT")
+	router.HandleFunc("/api/orgs/{id}/members/{key_id}", deleteOrgMemberHandler).Methods("DELETE")
+	router.HandleFunc("/api/guest-links", createGuestLinkHandler).Methods("POST")
+	router.HandleFunc("/api/guest-links", listGuestLinksHandler).Methods("GET")
+	router.HandleFunc("/api/guest-links/{token}", revokeGuestLinkHandler).Methods("DELETE")
+	router.HandleFunc("/api/guest/{token}", guestLinkHandler).Methods("GET")
+	router.HandleFunc("/api/guest/{token}/upload", guestUploadHandler).Methods("POST")
 	router.HandleFunc("/api/jobs/{id}", getJobHandler).Methods("GET")
 	router.HandleFunc("/api/jobs/{id}", deleteJobHandler).Methods("DELETE")
+	router.HandleFunc("/api/jobs/{id}/events", jobEventsHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/rating", rateJobHandler).Methods("POST")
 	router.HandleFunc("/api/jobs", listJobsHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/chapters", chaptersHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/structure", structureHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/outputs", listOutputsHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/download-manifest", downloadManifestHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/waveform/{stem}", waveformHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/annotations", createAnnotationHandler).Methods("POST")
+	router.HandleFunc("/api/jobs/{id}/annotations", listAnnotationsHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/annotations/{annotation}", deleteAnnotationHandler).Methods("DELETE")
+	router.HandleFunc("/api/download/{id}/all", downloadAllHandler).Methods("GET")
 	router.HandleFunc("/api/download/{id}/{stem}", downloadHandler).Methods("GET")
-	router.HandleFunc("/api/processing-status/{id}", processingStatusHandler).Methods("GET")
-
-	log.Printf("Server starting on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, router))
+	router.HandleFunc("/api/download/{id}/{stem}/{hash}", downloadHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/package", packageJobHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/archive", archiveJobHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/mix", createMixHandler).Methods("POST")
+	router.HandleFunc("/api/jobs/{id}/mixes", listMixesHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/mixes/{mix}", getMixHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/quiz", quizHandler).Methods("GET")
+	router.HandleFunc("/api/packaging-profiles", packagingProfilesHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/shares", createShareHandler).Methods("POST")
+	router.HandleFunc("/api/jobs/{id}/shares", listSharesHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/shares/{token}", deleteShareHandler).Methods("DELETE")
+	router.HandleFunc("/api/jobs/{id}/invitations", createInvitationHandler).Methods("POST")
+	router.HandleFunc("/api/jobs/{id}/invitations", listJobInvitationsHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/invitations/{invitation}", revokeInvitationHandler).Methods("DELETE")
+	router.HandleFunc("/api/invitations", listInvitationsHandler).Methods("GET")
+	router.HandleFunc("/api/invitations/{id}/accept", acceptInvitationHandler).Methods("POST")
+	router.HandleFunc("/api/invitations/{id}", declineInvitationHandler).Methods("DELETE")
+	router.HandleFunc("/api/oembed", oembedHandler).Methods("GET")
+	router.HandleFunc("/embed/{token}", embedHandler).Methods("GET")
+	router.HandleFunc("/embed/{token}/preview/{stem}", embedPreviewHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/stems/{stem}/stream-tokens", createStreamTokenHandler).Methods("POST")
+	router.HandleFunc("/api/jobs/{id}/stream-tokens", listStreamTokensHandler).Methods("GET")
+	router.HandleFunc("/api/stream-tokens/{token}", revokeStreamTokenHandler).Methods("DELETE")
+	router.HandleFunc("/api/stream/{token}", streamHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/api/processing-status/{id}", limitPolling(processingStatusHandler)).Methods("GET")
+	router.HandleFunc("/api/compare", compareHandler).Methods("GET")
+	router.HandleFunc("/api/benchmarks", requireTerms(requireQuota(createBenchmarkHandler))).Methods("POST")
+	router.HandleFunc("/api/benchmarks", listBenchmarksHandler).Methods("GET")
+	router.HandleFunc("/api/benchmarks/{id}", getBenchmarkHandler).Methods("GET")
+	router.HandleFunc("/api/compare/renders/{id}", compareRenderHandler).Methods("GET")
+
+	// Experimental live separation over WebSocket
+	router.HandleFunc("/api/live", requireTerms(requireQuota(liveSessionHandler))).Methods("GET")
+
+	// RTMP/Icecast stream ingest
+	router.HandleFunc("/api/ingest", requireTerms(requireQuota(createIngestHandler))).Methods("POST")
+	router.HandleFunc("/api/ingest", listIngestHandler).Methods("GET")
+	router.HandleFunc("/api/ingest/{id}", getIngestHandler).Methods("GET")
+	router.HandleFunc("/api/ingest/{id}", stopIngestHandler).Methods("DELETE")
+
+	// Cloud storage links
+	router.HandleFunc("/api/storage", listStorageHandler).Methods("GET")
+	router.HandleFunc("/api/storage/{provider}/connect", connectStorageHandler).Methods("GET")
+	router.HandleFunc("/api/storage/{provider}/callback", storageCallbackHandler).Methods("GET")
+	router.HandleFunc("/api/storage/{provider}", unlinkStorageHandler).Methods("DELETE")
+	router.HandleFunc("/api/jobs/{id}/export", exportJobHandler).Methods("POST")
+
+	// Result delivery (local dir, S3, SFTP, WebDAV, Drive, Dropbox)
+	router.HandleFunc("/api/jobs/{id}/deliveries", createDeliveryHandler).Methods("POST")
+	router.HandleFunc("/api/jobs/{id}/deliveries", listDeliveriesHandler).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/callbacks", listCallbacksHandler).Methods("GET")
+
+	// Persistent webhook subscriptions for job lifecycle events
+	router.HandleFunc("/api/webhooks", createWebhookHandler).Methods("POST")
+	router.HandleFunc("/api/webhooks", listWebhooksHandler).Methods("GET")
+	router.HandleFunc("/api/webhooks/{id}", getWebhookHandler).Methods("GET")
+	router.HandleFunc("/api/webhooks/{id}", updateWebhookHandler).Methods("PATCH")
+	router.HandleFunc("/api/webhooks/{id}", deleteWebhookHandler).Methods("DELETE")
+	router.HandleFunc("/api/webhooks/{id}/deliveries", listWebhookDeliveriesHandler).Methods("GET")
+	router.HandleFunc("/api/webhooks/{id}/deliveries/{delivery}/redeliver", redeliverWebhookHandler).Methods("POST")
+	router.HandleFunc("/api/webhooks/{id}/events/{event}/redeliver", redeliverJobEventHandler).Methods("POST")
+
+	// External worker leasing API
+	router.HandleFunc("/api/worker/lease", workerAuth(leaseJobHandler)).Methods("POST")
+	router.HandleFunc("/api/worker/leases/{lease}/input", workerAuth(leaseInputHandler)).Methods("GET")
+	router.HandleFunc("/api/worker/leases/{lease}/extend", workerAuth(extendLeaseHandler)).Methods("POST")
+	router.HandleFunc("/api/worker/leases/{lease}/complete", workerAuth(completeLeaseHandler)).Methods("POST")
+
+	// Admin API (ADMIN_TOKEN)
+	router.HandleFunc("/api/admin/stats", adminAuth(adminStatsHandler)).Methods("GET")
+	router.HandleFunc("/api/admin/storage", adminAuth(storageUsageHandler)).Methods("GET")
+	router.HandleFunc("/api/admin/processors", adminAuth(listProcessorsHandler)).Methods("GET")
+	router.HandleFunc("/api/admin/processors/drain", adminAuth(drainProcessorHandler)).Methods("POST")
+	router.HandleFunc("/api/admin/processors/readmit", adminAuth(readmitProcessorHandler)).Methods("POST")
+	router.HandleFunc("/api/admin/models", adminAuth(listModelsHandler)).Methods("GET")
+	router.HandleFunc("/api/admin/models/{name}/download", adminAuth(downloadModelHandler)).Methods("POST")
+	router.HandleFunc("/api/admin/models/custom", adminAuth(registerCustomModelHandler)).Methods("POST")
+	router.HandleFunc("/api/admin/models/custom", adminAuth(listCustomModelsHandler)).Methods("GET")
+	router.HandleFunc("/api/admin/models/custom/{name}", adminAuth(deleteCustomModelHandler)).Methods("DELETE")
+	router.HandleFunc("/api/keys", adminAuth(createAPIKeyHandler)).Methods("POST")
+	router.HandleFunc("/api/keys", adminAuth(listAPIKeysHandler)).Methods("GET")
+	router.HandleFunc("/api/keys/{id}", adminAuth(updateAPIKeyHandler)).Methods("PATCH")
+	router.HandleFunc("/api/keys/{id}", adminAuth(deleteAPIKeyHandler)).Methods("DELETE")
+	router.HandleFunc("/api/admin/orgs", adminAuth(createOrgHandler)).Methods("POST")
+	router.HandleFunc("/api/admin/orgs", adminAuth(listOrgsHandler)).Methods("GET")
+	router.HandleFunc("/api/admin/orgs/{id}", adminAuth(getOrgHandler)).Methods("GET")
+	router.HandleFunc("/api/admin/orgs/{id}", adminAuth(updateOrgHandler)).Methods("PATCH")
+	router.HandleFunc("/api/admin/orgs/{id}", adminAuth(deleteOrgHandler)).Methods("DELETE")
+	router.HandleFunc("/api/admin/orgs/{id}/usage", adminAuth(orgUsageHandler)).Methods("GET")
+	router.HandleFunc("/api/admin/orgs/{id}/members/{key_id}", adminAuth(putOrgMemberHandler)).Methods("PUT")
+	router.HandleFunc("/api/admin/orgs/{id}/members/{key_id}", adminAuth(deleteOrgMemberHandler)).Methods("DELETE")
+	router.HandleFunc("/api/admin/jobs/{id}/public", adminAuth(setJobPublicHandler)).Methods("PUT")
+	router.HandleFunc("/api/admin/debug-captures", adminAuth(listDebugCapturesHandler)).Methods("GET")
+	router.HandleFunc("/api/admin/jobs/{id}/debug-bundle", adminAuth(debugBundleHandler)).Methods("GET")
+	router.HandleFunc("/api/admin/self-test", adminAuth(runSelfTestHandler)).Methods("POST")
+	router.HandleFunc("/api/admin/self-test/baseline", adminAuth(acceptSelfTestBaselineHandler)).Methods("POST")
+	router.HandleFunc("/api/admin/reconcile", adminAuth(reconcileHandler)).Methods("POST")
+	router.HandleFunc("/api/admin/cleanup/preview", adminAuth(cleanupPreviewHandler)).Methods("GET")
+	router.HandleFunc("/api/admin/cleanup/run", adminAuth(cleanupRunHandler)).Methods("POST")
+	router.HandleFunc("/api/admin/migrate", adminAuth(migrateHandler)).Methods("POST")
+	router.HandleFunc("/api/admin/slo", adminAuth(sloHandler)).Methods("GET")
+	router.HandleFunc("/api/admin/trace", adminAuth(traceHandler)).Methods("GET")
+	router.HandleFunc("/api/admin/upgrade-reports", adminAuth(createUpgradeReportHandler)).Methods("POST")
+	router.HandleFunc("/api/admin/upgrade-reports", adminAuth(listUpgradeReportsHandler)).Methods("GET")
+	router.HandleFunc("/api/admin/upgrade-reports/{id}", adminAuth(getUpgradeReportHandler)).Methods("GET")
+	router.HandleFunc("/api/admin/events", adminAuth(adminEventsHandler)).Methods("GET")
+
+	// Public gallery (PUBLIC_GALLERY=true): previews only, no downloads
+	router.HandleFunc("/api/public/jobs", galleryAuth(listPublicJobsHandler)).Methods("GET")
+	router.HandleFunc("/api/public/jobs/{id}", galleryAuth(getPublicJobHandler)).Methods("GET")
+	router.HandleFunc("/api/public/jobs/{id}/preview/{stem}", galleryAuth(publicPreviewHandler)).Methods("GET")
+	return router
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
@@ -150,8 +595,9 @@ func corsMiddleware(next http.Handler) http.Handler {
 
 		// Only set other CORS headers if origin is allowed
 		if originAllowed {
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Upload-Offset, Range, X-Track2stem-Terms, X-API-Key")
+			w.Header().Set("Access-Control-Expose-Headers", "Upload-Offset, Content-Range, Accept-Ranges")
 		}
 
 		if r.Method == "OPTIONS" {
@@ -163,14 +609,48 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// writeJSON encodes v as the JSON response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// sortedKeys returns the keys of m in ascending order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	// The multipart temp file and the saved copy both need room
+	if r.ContentLength > 0 {
+		if e := checkDiskSpace(map[string]int64{os.TempDir(): r.ContentLength, uploadDir: r.ContentLength}); e != nil {
+			writeStorageError(w, e)
+			return
+		}
+	}
+
 	// Parse multipart form
-	err := r.ParseMultipartForm(100 << 20) // 100 MB max
+	// Files beyond 32 MB spill to disk; limitsMiddleware caps the total size
+	err := r.ParseMultipartForm(32 << 20)
+	if isBodyTooLarge(err) {
+		writeRejection(w, http.StatusRequestEntityTooLarge, "file_too_large", "File too large", sizeRemedy(maxUploadBytes))
+		return
+	}
+	if isNoSpace(err) {
+		writeStorageError(w, &storageError{Error: "Insufficient storage", Path: os.TempDir()})
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to parse form", http.StatusBadRequest)
 		return
@@ -181,118 +661,556 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to get file", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
+	file.Close()
 
-	// Get stem options from form
-	stemMode := r.FormValue("stem_mode")
-	if stemMode == "" {
-		stemMode = "all"
-	}
-	isolateStem := r.FormValue("isolate_stem")
-	if isolateStem == "" {
-		isolateStem = "vocals"
+	opts, err := parseJobOptions(r.FormValue)
+	if err == nil {
+		err = opts.checkFields(formFieldNames(r), formFields("file", "dry_run"), strictOptions(r))
 	}
-
-	// Get advanced options from form
-	outputFormat := r.FormValue("output_format")
-	if outputFormat == "" {
-		outputFormat = "mp3"
+	if err != nil {
+		writeRejection(w, http.StatusBadRequest, "invalid_option", err.Error(), optionRemedy(err))
+		return
 	}
-	model := r.FormValue("model")
-	if model == "" {
-		model = "htdemucs_6s"
+	if e := checkTier(r.Context(), opts, ""); e != nil {
+		writeJSON(w, http.StatusForbidden, e)
+		return
 	}
-	segment := r.FormValue("segment")
-	overlap := r.FormValue("overlap")
-	shifts := r.FormValue("shifts")
-	if shifts == "" {
-		shifts = "0"
+	if uerr := checkOrg(r.Context(), opts.Org); uerr != nil {
+		uerr.write(w)
+		return
 	}
-	clipMode := r.FormValue("clip_mode")
-	if clipMode == "" {
-		clipMode = "rescale"
+	if r.FormValue("dry_run") == "true" {
+		preflightUpload(w, r, header, opts)
+		return
 	}
 
-	// Validate all user-supplied options against allowlists
-	if !allowedStemModes[stemMode] {
-		http.Error(w, "Invalid stem_mode value", http.StatusBadRequest)
+	job, uerr := storeUpload(r.Context(), header, opts, "")
+	if uerr != nil {
+		uerr.write(w)
 		return
 	}
-	if stemMode == "isolate" && !allowedStems[isolateStem] {
-		http.Error(w, "Invalid isolate_stem value", http.StatusBadRequest)
+	// A queue worker may already be updating the job
+	jobsMutex.RLock()
+	snapshot := job.snapshot()
+	jobsMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// uploadError is why an uploaded file didn't become a job
+type uploadError struct {
+	Status      int
+	Message     string
+	Code        string        // written as a rejection when set
+	Remediation *Remediation  // what would get the upload through
+	Storage     *storageError // set for 507s, which are written as JSON
+	Tier        *tierError    // set for uploads over a tier limit, likewise
+}
+
+// rejectedUpload is the uploadError of a rejection
+func rejectedUpload(status int, r *Rejection) *uploadError {
+	return &uploadError{Status: status, Message: r.Error, Code: r.Code, Remediation: r.Remediation}
+}
+
+func (e *uploadError) write(w http.ResponseWriter) {
+	if e.Storage != nil {
+		writeStorageError(w, e.Storage)
 		return
 	}
-	if !allowedOutputFormats[outputFormat] {
-		http.Error(w, "Invalid output_format value", http.StatusBadRequest)
+	if e.Tier != nil {
+		writeJSON(w, e.Status, e.Tier)
 		return
 	}
-	if !allowedModels[model] {
-		http.Error(w, "Invalid model value", http.StatusBadRequest)
+	if e.Code != "" {
+		writeRejection(w, e.Status, e.Code, e.Message, e.Remediation)
 		return
 	}
-	if !allowedClipModes[clipMode] {
-		http.Error(w, "Invalid clip_mode value", http.StatusBadRequest)
-		return
+	http.Error(w, e.Message, e.Status)
+}
+
+// storeUpload saves one multipart file as a new job (in a batch when
+// batchID is set) and accepts it for processing
+func storeUpload(ctx context.Context, header *multipart.FileHeader, opts jobOptions, batchID string) (*Job, *uploadError) {
+	if r := checkInputFormat(header.Filename, header.Header.Get("Content-Type")); r != nil {
+		return nil, rejectedUpload(http.StatusUnsupportedMediaType, r)
 	}
+	if r := checkQueueRoom(); r != nil {
+		return nil, rejectedUpload(http.StatusServiceUnavailable, r)
+	}
+	if e := checkDiskSpace(map[string]int64{
+		uploadDir: header.Size,
+		outputDir: estimateOutputBytes(header.Size, header.Filename, opts),
+	}); e != nil {
+		return nil, &uploadError{Status: http.StatusInsufficientStorage, Message: e.Error, Storage: e}
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return nil, &uploadError{Status: http.StatusBadRequest, Message: "Failed to get file"}
+	}
+	defer file.Close()
 
 	// Create job
 	jobID := uuid.New().String()
 	safeFilename := sanitizeFilename(header.Filename)
-	job := &Job{
-		ID:           jobID,
-		Status:       "pending",
-		FileName:     safeFilename,
-		CreatedAt:    time.Now(),
-		StemMode:     stemMode,
-		IsolateStem:  isolateStem,
-		OutputFormat: outputFormat,
-		Model:        model,
-		Segment:      segment,
-		Overlap:      overlap,
-		Shifts:       shifts,
-		ClipMode:     clipMode,
+	recordedExt, isRecording := recordedExtension(header.Filename, header.Header.Get("Content-Type"))
+	// Encrypted recordings are converted by the processor, which can read them
+	isRecording = isRecording && !opts.Encrypted
+	if isRecording {
+		safeFilename = withExtension(safeFilename, recordedExt)
 	}
+	opts.Watermark = jobWatermark(apiKeyID(ctx))
+	job := newJob(jobID, safeFilename, opts)
+	job.BatchID = batchID
+	job.APIKeyID = apiKeyID(ctx)
+	job.GuestLink = guestLinkLabel(ctx)
+	job.Region = currentRegion()
+	job.RequestID = requestID(ctx)
 
 	jobsMutex.Lock()
 	jobs[jobID] = job
 	jobsMutex.Unlock()
 
 	// Save file
-	uploadPath := filepath.Join("/app/uploads", jobID+"_"+safeFilename)
+	uploadPath := filepath.Join(uploadDir, jobID+"_"+safeFilename)
 	dst, err := os.Create(uploadPath)
 	if err != nil {
 		job.Status = "failed"
 		job.Error = "Failed to save file"
-		http.Error(w, job.Error, http.StatusInternalServerError)
-		return
+		return nil, &uploadError{Status: http.StatusInternalServerError, Message: job.Error}
 	}
 	defer dst.Close()
 
 	if _, err := io.Copy(dst, file); err != nil {
 		job.Status = "failed"
 		job.Error = "Failed to save file"
-		http.Error(w, job.Error, http.StatusInternalServerError)
-		return
+		if isNoSpace(err) {
+			dst.Close()
+			os.Remove(uploadPath)
+			e := &storageError{Error: "Insufficient storage", Path: uploadDir}
+			return nil, &uploadError{Status: http.StatusInsufficientStorage, Message: e.Error, Storage: e}
+		}
+		return nil, &uploadError{Status: http.StatusInternalServerError, Message: job.Error}
 	}
+	dst.Close()
 
-	// Start processing in background
-	go processJob(jobID, uploadPath, stemMode, isolateStem, outputFormat, model, segment, overlap, shifts, clipMode)
+	if uerr := acceptUpload(ctx, job, uploadPath, isRecording); uerr != nil {
+		return nil, uerr
+	}
+	return job, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(job)
+// acceptUpload scans and (for browser recordings) converts a saved upload,
+// then dispatches its job. It returns why when the upload is rejected.
+func acceptUpload(ctx context.Context, job *Job, uploadPath string, isRecording bool) *uploadError {
+	jobID := job.ID
+	discard := func() {
+		os.Remove(uploadPath)
+		jobsMutex.Lock()
+		delete(jobs, jobID)
+		jobsMutex.Unlock()
+	}
+
+	// Optional virus scan; rejected uploads never become jobs
+	if scanner := virusScannerFromEnv(); scanner != nil {
+		if status, msg := scanUpload(ctx, scanner, jobID, job.FileName, uploadPath); status != 0 {
+			discard()
+			return checkRejection(status, msg, "scan")
+		}
+	}
+
+	// Browser recordings (MediaRecorder webm/ogg) are converted server-side
+	if isRecording {
+		flacPath := withExtension(uploadPath, ".flac")
+		if err := transcodeToFLAC(uploadPath, flacPath); err != nil {
+			log.Printf("Failed to convert recording for job %s: %v", jobID, err)
+			os.Remove(flacPath)
+			discard()
+			return &uploadError{Status: http.StatusUnprocessableEntity, Message: "Failed to convert recorded audio", Code: "unreadable_audio", Remediation: formatRemedy()}
+		}
+		os.Remove(uploadPath)
+		uploadPath = flacPath
+	}
+
+	// Neither do uploads longer than the client's tier allows
+	if e := checkTier(ctx, job.options(), uploadPath); e != nil {
+		discard()
+		return &uploadError{Status: http.StatusForbidden, Message: e.Error, Tier: e}
+	}
+	// Or ones their organization won't take
+	if uerr := checkOrg(ctx, job.OrgID); uerr != nil {
+		discard()
+		return uerr
+	}
+
+	if info, err := os.Stat(uploadPath); err == nil {
+		recordUploadSize(info.Size())
+	}
+	var meta *TrackMetadata
+	if !job.Encrypted {
+		meta = probeMetadata(uploadPath, job.FileName)
+	}
+	jobsMutex.Lock()
+	job.inputPath = uploadPath
+	job.Metadata = meta
+	jobsMutex.Unlock()
+
+	// Blocked uploads stay as failed jobs so the decision can be audited
+	if status, msg := checkPolicy(ctx, job, uploadPath); status != 0 {
+		os.Remove(uploadPath)
+		jobsMutex.Lock()
+		job.inputPath = ""
+		jobsMutex.Unlock()
+		updateJobError(jobID, msg)
+		return checkRejection(status, msg, "policy")
+	}
+
+	if reuseCachedResult(job, uploadPath) {
+		return nil
+	}
+	dispatchJob(job)
+	return nil
+}
+
+// jobOptions are the user-selectable separation settings of a job
+type jobOptions struct {
+	StemMode     string
+	IsolateStem  string
+	OutputFormat string
+	Model        string
+	Segment      string
+	Overlap      string
+	Shifts       string
+	ClipMode     string
+	MP3Bitrate   string
+	ExtraFormats []string // transcoded from OutputFormat after separation
+	Force        bool     // skip the deduplication cache
+
+	Advanced map[string]string // advanced_options, see advancedoptions.go
+
+	Deterministic bool // seed the processor for reproducible stems
+	Seed          string
+
+	Pipeline []PipelineStep // steps of the pipeline option, see pipeline.go
+
+	Encrypted bool   // the upload is end-to-end encrypted, see encryption.go
+	SealedKey string // its job key, sealed to the processors
+
+	Preset     string       // separation preset, see presets.go
+	StemGroups []PresetStem // the preset's outputs for Model
+
+	Watermark string // set from the client's tier, never by the client
+
+	Org string // organization the job belongs to, see orgs.go
+
+	Template string            // job template the options came from, see templates.go
+	Exports  []deliveryRequest // the template's deliveries
+
+	CallbackURL    string // POSTed to when the job finishes
+	CallbackSecret string
+
+	Ignored map[string]string // given options without effect, see checkFields
 }
 
-func processJob(jobID, filePath, stemMode, isolateStem, outputFormat, model, segment, overlap, shifts, clipMode string) {
+// parseJobOptions reads separation options through get (e.g. r.FormValue),
+// applies defaults and validates every value against the allowlists
+func parseJobOptions(get func(string) string) (jobOptions, error) {
+	var template JobTemplate
+	if name := get("template"); name != "" {
+		t, ok := lookupJobTemplate(name)
+		if !ok {
+			return jobOptions{}, fmt.Errorf("Invalid template value: no template named %s", name)
+		}
+		template, get = t, t.withTemplate(get)
+	}
+	opts := jobOptions{
+		StemMode:     get("stem_mode"),
+		IsolateStem:  get("isolate_stem"),
+		OutputFormat: get("output_format"),
+		Model:        get("model"),
+		Segment:      get("segment"),
+		Overlap:      get("overlap"),
+		Shifts:       get("shifts"),
+		ClipMode:     get("clip_mode"),
+		MP3Bitrate:   get("mp3_bitrate"),
+		Force:        get("force") == "true",
+
+		Deterministic: get("deterministic") == "true",
+		Seed:          get("seed"),
+
+		Encrypted: get("encrypted") == "true",
+		SealedKey: get("sealed_key"),
+
+		Preset: get("preset"),
+
+		Org: get("org"),
+
+		CallbackURL:    get("callback_url"),
+		CallbackSecret: get("callback_secret"),
+
+		Template: template.Name,
+		Exports:  template.Exports,
+	}
+	if opts.StemMode == "" {
+		opts.StemMode = "all"
+	}
+	if opts.IsolateStem == "" {
+		opts.IsolateStem = "vocals"
+	}
+	if opts.OutputFormat == "" {
+		opts.OutputFormat = "mp3"
+	}
+	preset, isPreset := lookupPreset(opts.Preset)
+	if opts.Preset != "" && !isPreset {
+		return opts, invalidOption("preset", sortedKeys(separationPresets))
+	}
+	if opts.Model == "" && isPreset {
+		opts.Model = preset.Model
+	}
+	if opts.Model == "" {
+		opts.Model = "htdemucs_6s"
+	}
+	if opts.Shifts == "" {
+		opts.Shifts = "0"
+	}
+	if opts.ClipMode == "" {
+		opts.ClipMode = "rescale"
+	}
+	extraFormats, formatsErr := parseExtraFormats(get("extra_formats"), opts.OutputFormat)
+	opts.ExtraFormats = extraFormats
+	advanced, advancedErr := parseAdvancedOptions(get("advanced_options"), opts.OutputFormat)
+	opts.Advanced = advanced
+	pipeline, pipelineErr := parsePipeline(get("pipeline"))
+	opts.Pipeline = pipeline
+	producesMP3 := opts.OutputFormat == "mp3" || slices.Contains(opts.ExtraFormats, "mp3") || slices.Contains(opts.transcodeFormats(), "mp3")
+	if opts.MP3Bitrate == "" && producesMP3 {
+		opts.MP3Bitrate = "320"
+	}
+	// "0.10" and "0.1" are the same overlap
+	if f, err := strconv.ParseFloat(opts.Overlap, 64); err == nil {
+		opts.Overlap = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	// Validate all user-supplied options against allowlists
+	if !allowedStemModes[opts.StemMode] {
+		return opts, invalidOption("stem_mode", sortedKeys(allowedStemModes))
+	}
+	if opts.StemMode == "isolate" && !allowedStems[opts.IsolateStem] {
+		return opts, invalidOption("isolate_stem", sortedKeys(allowedStems))
+	}
+	if !allowedOutputFormats[opts.OutputFormat] {
+		return opts, invalidOption("output_format", sortedKeys(allowedOutputFormats))
+	}
+	if formatsErr != nil {
+		return opts, formatsErr
+	}
+	if pipelineErr != nil {
+		return opts, pipelineErr
+	}
+	if advancedErr != nil {
+		return opts, advancedErr
+	}
+	if !isAllowedModel(opts.Model) {
+		return opts, invalidOption("model", modelNames())
+	}
+	if !allowedClipModes[opts.ClipMode] {
+		return opts, invalidOption("clip_mode", sortedKeys(allowedClipModes))
+	}
+	if n, err := strconv.Atoi(opts.Shifts); err != nil || n < 0 || n > 10 {
+		return opts, fmt.Errorf("Invalid shifts value (allowed: 0 to 10)")
+	}
+	if opts.Segment != "" && !slices.Contains(allowedSegments, opts.Segment) {
+		return opts, invalidOption("segment", allowedSegments)
+	}
+	if opts.Overlap != "" && !slices.Contains(allowedOverlaps, opts.Overlap) {
+		return opts, invalidOption("overlap", allowedOverlaps)
+	}
+	if opts.MP3Bitrate != "" && !slices.Contains(allowedMP3Bitrates, opts.MP3Bitrate) {
+		return opts, invalidOption("mp3_bitrate", allowedMP3Bitrates)
+	}
+	if opts.Deterministic {
+		seed, err := parseSeed(opts.Seed)
+		if err != nil {
+			return opts, err
+		}
+		opts.Seed = seed
+	}
+	if opts.Encrypted {
+		if err := checkSealedKey(opts); err != nil {
+			return opts, err
+		}
+		// Every upload is encrypted with its own key, so none repeats
+		opts.Force = true
+	}
+	if opts.CallbackURL != "" {
+		if err := validateWebhookURL(opts.CallbackURL); err != nil {
+			return opts, fmt.Errorf("Invalid callback_url value")
+		}
+	}
+
+	// Combinations the processor can't run
+	if opts.StemMode == "isolate" && !slices.Contains(modelStems(opts.Model), opts.IsolateStem) {
+		if isCustomModel(opts.Model) {
+			return opts, fmt.Errorf("isolate_stem %s isn't separated by model %s (%s)", opts.IsolateStem, opts.Model, strings.Join(modelStems(opts.Model), ", "))
+		}
+		return opts, fmt.Errorf("isolate_stem %s requires a 6-stem model (%s)", opts.IsolateStem, strings.Join(sortedKeys(sixStemModels), ", "))
+	}
+	if opts.MP3Bitrate != "" && !producesMP3 {
+		return opts, fmt.Errorf("mp3_bitrate only applies to mp3 output (output_format, extra_formats or a transcode step)")
+	}
+	if isPreset {
+		if opts.StemMode == "isolate" {
+			return opts, fmt.Errorf("preset can't be combined with stem_mode isolate: the preset picks the stems")
+		}
+		groups, err := preset.stemGroups(opts.Model)
+		if err != nil {
+			return opts, err
+		}
+		opts.StemGroups = groups
+	}
+	if len(opts.ExtraFormats) > 0 && len(opts.transcodeFormats()) > 0 {
+		return opts, fmt.Errorf("extra_formats can't be combined with a pipeline transcode step")
+	}
+	if get("isolate_stem") != "" && opts.StemMode != "isolate" {
+		opts.ignore("isolate_stem", "only applies to stem_mode isolate")
+	}
+	if get("callback_secret") != "" && opts.CallbackURL == "" {
+		opts.ignore("callback_secret", "only applies with callback_url")
+	}
+	if v := get("force"); v != "" && v != "true" && v != "false" {
+		opts.ignore("force", "only true skips the cache")
+	}
+	if v := get("deterministic"); v != "" && v != "true" && v != "false" {
+		opts.ignore("deterministic", "only true pins the seeds")
+	}
+	if opts.Seed != "" && !opts.Deterministic {
+		opts.ignore("seed", "only applies to deterministic=true")
+		opts.Seed = ""
+	}
+	if v := get("encrypted"); v != "" && v != "true" && v != "false" {
+		opts.ignore("encrypted", "only true encrypts the job")
+	}
+	if opts.SealedKey != "" && !opts.Encrypted {
+		opts.ignore("sealed_key", "only applies to encrypted=true")
+		opts.SealedKey = ""
+	}
+	if opts.Segment != "" && transformerModels[opts.Model] {
+		return opts, fmt.Errorf("segment can't be set for model %s: transformer models use the segment length they were trained on", opts.Model)
+	}
+	return opts, nil
+}
+
+// invalidOption describes a rejected option value and the accepted ones
+func invalidOption(name string, allowed []string) error {
+	return &optionError{Name: name, Allowed: allowed}
+}
+
+// newJob creates a pending job record for the given options
+func newJob(jobID, fileName string, opts jobOptions) *Job {
+	return &Job{
+		ID:           jobID,
+		Status:       "pending",
+		FileName:     fileName,
+		CreatedAt:    time.Now().UTC(),
+		StemMode:     opts.StemMode,
+		IsolateStem:  opts.IsolateStem,
+		OutputFormat: opts.OutputFormat,
+		Model:        opts.Model,
+		Segment:      opts.Segment,
+		Overlap:      opts.Overlap,
+		Shifts:       opts.Shifts,
+		ClipMode:     opts.ClipMode,
+		MP3Bitrate:   opts.MP3Bitrate,
+		ExtraFormats: opts.ExtraFormats,
+		force:        opts.Force,
+
+		AdvancedOptions: maps.Clone(opts.Advanced),
+
+		Deterministic: opts.Deterministic,
+		Seed:          opts.Seed,
+
+		Pipeline: slices.Clone(opts.Pipeline),
+
+		Encrypted: opts.Encrypted,
+		sealedKey: opts.SealedKey,
+
+		Preset:     opts.Preset,
+		stemGroups: slices.Clone(opts.StemGroups),
+
+		Watermark: opts.Watermark,
+
+		OrgID: opts.Org,
+
+		Template: opts.Template,
+		exports:  slices.Clone(opts.Exports),
+
+		CallbackURL:    opts.CallbackURL,
+		callbackSecret: opts.CallbackSecret,
+		ignoredOptions: maps.Clone(opts.Ignored),
+	}
+}
+
+// options returns the separation settings recorded on the job
+func (j *Job) options() jobOptions {
+	return jobOptions{
+		StemMode:     j.StemMode,
+		IsolateStem:  j.IsolateStem,
+		OutputFormat: j.OutputFormat,
+		Model:        j.Model,
+		Segment:      j.Segment,
+		Overlap:      j.Overlap,
+		Shifts:       j.Shifts,
+		ClipMode:     j.ClipMode,
+		MP3Bitrate:   j.MP3Bitrate,
+		ExtraFormats: j.ExtraFormats,
+
+		Advanced: maps.Clone(j.AdvancedOptions),
+
+		Deterministic: j.Deterministic,
+		Seed:          j.Seed,
+
+		Pipeline: slices.Clone(j.Pipeline),
+
+		Encrypted: j.Encrypted,
+		SealedKey: j.sealedKey,
+
+		Preset:     j.Preset,
+		StemGroups: slices.Clone(j.stemGroups),
+
+		Watermark: j.Watermark,
+
+		Org: j.OrgID,
+	}
+}
+
+// dispatchJob starts processing a job whose input file has been saved.
+// External workers lease pending jobs themselves, so nothing is started then.
+func dispatchJob(job *Job) {
 	jobsMutex.Lock()
-	job := jobs[jobID]
-	job.Status = "processing"
+	jobID := job.ID
+	assignVariant(job)
 	jobsMutex.Unlock()
+	emitJobEvent(jobID, EventJobCreated)
+	if externalWorkers {
+		return
+	}
+	enqueueJob(jobID)
+}
 
-	// Call processor service
-	processorURL := os.Getenv("PROCESSOR_URL")
-	if processorURL == "" {
-		processorURL = "http://localhost:5000"
+func processJob(jobID, filePath string, opts jobOptions) {
+	jobsMutex.Lock()
+	job, exists := jobs[jobID]
+	if !exists {
+		jobsMutex.Unlock()
+		return
 	}
+	job.Status = "processing"
+	variant, selfTest, reqID := job.Variant, job.SelfTest, job.RequestID
+	ctx, cancel := job.startContext()
+	defer cancel(nil)
+	jobsMutex.Unlock()
+	emitJobEvent(jobID, EventJobProcessing)
 
 	// Open the file
 	file, err := os.Open(filePath)
@@ -312,61 +1230,105 @@ func processJob(jobID, filePath, stemMode, isolateStem, outputFormat, model, seg
 		return
 	}
 
-	_, err = io.Copy(part, file)
+	fileSize, err := io.Copy(part, file)
 	if err != nil {
 		updateJobError(jobID, "Failed to copy file")
 		return
 	}
 
 	// Add job_id, stem options, and advanced options
-	writer.WriteField("job_id", jobID)
-	writer.WriteField("stem_mode", stemMode)
-	writer.WriteField("isolate_stem", isolateStem)
-	writer.WriteField("output_format", outputFormat)
-	writer.WriteField("model", model)
-	writer.WriteField("shifts", shifts)
-	writer.WriteField("clip_mode", clipMode)
-	if segment != "" {
-		writer.WriteField("segment", segment)
-	}
-	if overlap != "" {
-		writer.WriteField("overlap", overlap)
+	fields := processorFields(jobID, opts)
+	for _, f := range fields {
+		writer.WriteField(f[0], f[1])
 	}
 	writer.Close()
 
 	// Send request
-	req, err := http.NewRequest("POST", processorURL+"/process", body)
-	if err != nil {
-		updateJobError(jobID, "Failed to create request")
+	estimate, timeout := processorBudget([]string{jobID}, opts)
+	sentAt := time.Now()
+	code, respBody, err := postToProcessor(ctx, jobID, variant, jobNeeds(opts), processRequest{
+		Body:        body.Bytes(),
+		ContentType: writer.FormDataContentType(),
+		Fields:      fields,
+		File:        &debugFile{Field: "file", Name: filepath.Base(filePath), Size: fileSize},
+		RequestID:   reqID,
+
+		Compressible: compressibleInput(filePath),
+		Timeout:      timeout,
+	})
+	if cause := context.Cause(ctx); cause != nil {
+		// A deleted job is gone already; one stopped by shutdown fails
+		if cause == errShuttingDown {
+			cancelOnProcessor(jobID, variant, reqID)
+			updateJobError(jobID, cause.Error())
+		}
 		return
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-
-	client := &http.Client{Timeout: 30 * time.Minute}
-	resp, err := client.Do(req)
-	if err != nil {
+	if err != nil && code == 0 {
 		updateJobError(jobID, "Failed to process: "+err.Error())
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
+	if code != http.StatusOK {
 		updateJobError(jobID, "Processor failed: "+string(respBody))
 		return
 	}
+	observeProcessorSpeed(opts.Model, estimate, time.Since(sentAt))
 
 	// Parse response
 	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	if err != nil || json.Unmarshal(respBody, &result) != nil {
 		updateJobError(jobID, "Failed to parse response")
 		return
 	}
 
+	var determinism *Determinism
+	if opts.Deterministic {
+		if determinism = parseDeterminism(result["determinism"]); determinism == nil {
+			updateJobError(jobID, "Processor doesn't support deterministic mode: it didn't report the seeds it pinned")
+			return
+		}
+	}
+	// Stems without the mark mustn't reach clients of a watermarked tier
+	if opts.Watermark != "" && result["watermark"] != opts.Watermark {
+		updateJobError(jobID, "Processor doesn't support watermarks: it didn't report the watermark it embedded")
+		return
+	}
+
+	completeJob(jobID, opts, selfTest, result, determinism)
+}
+
+// completeJob records a processor's result for a job: its stems (plus the
+// extra formats opts asks for), processing time, environment and notes
+func completeJob(jobID string, opts jobOptions, selfTest bool, result map[string]interface{}, determinism *Determinism) {
+	// Extract output files
+	var outputFiles map[string]string
+	if outputs, ok := result["outputs"].(map[string]interface{}); ok {
+		outputFiles = make(map[string]string)
+		for stem, path := range outputs {
+			if pathStr, ok := path.(string); ok {
+				outputFiles[stem] = pathStr
+			}
+		}
+	}
+	if err := runPipelineSteps(jobID, outputFiles); err != nil {
+		updateJobError(jobID, err.Error())
+		return
+	}
+	if err := addExtraFormats(jobID, outputFiles, opts); err != nil {
+		updateJobError(jobID, err.Error())
+		return
+	}
+
 	// Update job
 	jobsMutex.Lock()
+	job, exists := jobs[jobID]
+	if !exists {
+		jobsMutex.Unlock()
+		return
+	}
 	job.Status = "completed"
-	now := time.Now()
+	now := time.Now().UTC()
 	job.CompletedAt = &now
 
 	// Extract processing time
@@ -374,28 +1336,146 @@ func processJob(jobID, filePath, stemMode, isolateStem, outputFormat, model, seg
 		job.ProcessingTime = processingTime
 	}
 
-	// Extract output files
-	if outputs, ok := result["outputs"].(map[string]interface{}); ok {
-		job.OutputFiles = make(map[string]string)
-		for stem, path := range outputs {
-			if pathStr, ok := path.(string); ok {
-				job.OutputFiles[stem] = pathStr
-			}
-		}
-	}
+	job.Environment = parseProcessingEnv(result["environment"])
+	job.Energy = estimateEnergy(result["compute"])
+	job.Notes = parseJobNotes(result["notes"])
+	job.Determinism = determinism
+	job.OutputFiles = outputFiles
+	job.ReadyStems, job.readyOutputs = nil, nil
 	jobsMutex.Unlock()
+
+	emitJobEvent(jobID, EventJobCompleted)
+	if !selfTest {
+		queueAutoDeliveries(jobID)
+		startPipelineExports(jobID)
+	}
+}
+
+// processorFields are the form fields sent to the processor with the file
+func processorFields(jobID string, opts jobOptions) [][2]string {
+	fields := [][2]string{
+		{"job_id", jobID},
+		{"stem_mode", opts.StemMode},
+		{"isolate_stem", opts.IsolateStem},
+		{"output_format", opts.OutputFormat},
+		{"model", opts.Model},
+		{"shifts", opts.Shifts},
+		{"clip_mode", opts.ClipMode},
+	}
+	if opts.Segment != "" {
+		fields = append(fields, [2]string{"segment", opts.Segment})
+	}
+	if opts.Overlap != "" {
+		fields = append(fields, [2]string{"overlap", opts.Overlap})
+	}
+	if opts.MP3Bitrate != "" && opts.OutputFormat == "mp3" {
+		fields = append(fields, [2]string{"mp3_bitrate", opts.MP3Bitrate})
+	}
+	if opts.Deterministic {
+		fields = append(fields, [2]string{"deterministic", "true"}, [2]string{"seed", opts.Seed})
+	}
+	if len(opts.Advanced) > 0 {
+		fields = append(fields, [2]string{"advanced_options", formatAdvancedOptions(opts.Advanced)})
+	}
+	if opts.Encrypted {
+		fields = append(fields, [2]string{"encrypted", "true"}, [2]string{"sealed_key", opts.SealedKey})
+	}
+	if opts.Preset != "" {
+		fields = append(fields, [2]string{"preset", opts.Preset}, [2]string{"stem_groups", formatStemGroups(opts.StemGroups)})
+	}
+	if opts.Watermark != "" {
+		fields = append(fields, [2]string{"watermark", opts.Watermark})
+	}
+	return fields
 }
 
 func updateJobError(jobID, errMsg string) {
 	jobsMutex.Lock()
-	defer jobsMutex.Unlock()
+	job, exists := jobs[jobID]
+	if exists {
+		job.fail(errMsg)
+	}
+	jobsMutex.Unlock()
 
-	if job, exists := jobs[jobID]; exists {
-		job.Status = "failed"
-		job.Error = errMsg
-		now := time.Now()
-		job.CompletedAt = &now
+	if exists {
+		emitJobEvent(jobID, EventJobFailed)
+	}
+}
+
+// fail marks the job failed with errMsg; callers hold jobsMutex and emit
+// EventJobFailed once it is released
+func (j *Job) fail(errMsg string) {
+	j.Status = "failed"
+	j.Error = errMsg
+	now := time.Now().UTC()
+	j.CompletedAt = &now
+	j.ReadyStems, j.readyOutputs = nil, nil
+	j.failPipeline(errMsg)
+}
+
+// snapshot returns a copy of the job that is safe to use after releasing jobsMutex
+func (j *Job) snapshot() Job {
+	c := *j
+	c.Effective = j.effectiveOptions()
+	if secs := parseProcessingTime(j.ProcessingTime); secs > 0 {
+		c.ProcessingDuration = isoDuration(time.Duration(secs * float64(time.Second)))
+	}
+	if j.OutputFiles != nil {
+		c.OutputFiles = make(map[string]string, len(j.OutputFiles))
+		for k, v := range j.OutputFiles {
+			c.OutputFiles[k] = v
+		}
+	}
+	if j.OutputHashes != nil {
+		c.OutputHashes = make(map[string]string, len(j.OutputHashes))
+		for k, v := range j.OutputHashes {
+			c.OutputHashes[k] = v
+		}
+	}
+	c.Deliveries = append([]Delivery(nil), j.Deliveries...)
+	c.Mixes = append([]Mix(nil), j.Mixes...)
+	c.Handoffs = append([]JobHandoff(nil), j.Handoffs...)
+	c.Pipeline = j.pipelineView()
+	return c
+}
+
+// lookupCompletedJob resolves the {id} route variable to a completed job,
+// writing the appropriate error response when that isn't possible
+func lookupCompletedJob(w http.ResponseWriter, r *http.Request) (Job, bool) {
+	return completedJob(w, r, mux.Vars(r)["id"])
+}
+
+// completedJob returns a snapshot of the completed job with the given ID,
+// writing the appropriate error response when that isn't possible. Jobs of
+// another API key are not found.
+func completedJob(w http.ResponseWriter, r *http.Request, jobID string) (Job, bool) {
+	if !isValidJobID(jobID) {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return Job{}, false
+	}
+
+	jobsMutex.RLock()
+	job, exists := jobs[jobID]
+	var snap Job
+	if exists {
+		exists = canAccessJob(r, job)
+		snap = job.snapshot()
+	}
+	jobsMutex.RUnlock()
+
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return Job{}, false
+	}
+	if snap.Status == "expired" {
+		http.Error(w, jobExpiredMessage, http.StatusGone)
+		return Job{}, false
+	}
+	if snap.Status != "completed" {
+		http.Error(w, "Job not completed", http.StatusBadRequest)
+		return Job{}, false
 	}
+	return snap, true
 }
 
 func getJobHandler(w http.ResponseWriter, r *http.Request) {
@@ -409,27 +1489,25 @@ func getJobHandler(w http.ResponseWriter, r *http.Request) {
 
 	jobsMutex.RLock()
 	job, exists := jobs[jobID]
+	var snapshot Job
+	if exists {
+		exists = canAccessJob(r, job)
+		snapshot = job.snapshot()
+	}
 	jobsMutex.RUnlock()
 
 	if !exists {
 		http.Error(w, "Job not found", http.StatusNotFound)
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(job)
-}
-
-func listJobsHandler(w http.ResponseWriter, r *http.Request) {
-	jobsMutex.RLock()
-	jobList := make([]*Job, 0, len(jobs))
-	for _, job := range jobs {
-		jobList = append(jobList, job)
+	if snapshot.Status == "queued" {
+		snapshot.QueuePosition = processingQueue.position(jobID)
 	}
-	jobsMutex.RUnlock()
+	withDownloadURLs(r, &snapshot)
+	withPollHints(&snapshot)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(jobList)
+	json.NewEncoder(w).Encode(snapshot)
 }
 
 func deleteJobHandler(w http.ResponseWriter, r *http.Request) {
@@ -443,48 +1521,51 @@ func deleteJobHandler(w http.ResponseWriter, r *http.Request) {
 
 	jobsMutex.RLock()
 	job, exists := jobs[jobID]
+	if exists && !canAccessJob(r, job) {
+		jobsMutex.RUnlock()
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
 	wasProcessing := exists && (job.Status == "pending" || job.Status == "processing")
+	var variant string
+	var stop context.CancelCauseFunc
+	if exists {
+		variant, stop = job.Variant, job.cancel
+	}
 	jobsMutex.RUnlock()
 
-	// If job was processing, cancel it in the processor
+	// If job was processing, abort its request and cancel it in the processor
+	if stop != nil {
+		stop(errJobCancelled)
+	}
 	if wasProcessing {
-		processorURL := os.Getenv("PROCESSOR_URL")
-		if processorURL == "" {
-			processorURL = "http://processor:5000"
-		}
-
-		// Call processor cancel endpoint
-		client := &http.Client{Timeout: 10 * time.Second}
-		cancelReq, err := http.NewRequest("POST", processorURL+"/cancel/"+jobID, nil)
-		if err == nil {
-			resp, err := client.Do(cancelReq)
-			if err != nil {
-				log.Printf("Failed to cancel job in processor: %v", err)
-			} else {
-				resp.Body.Close()
-				log.Printf("Cancelled job %s in processor", jobID)
-			}
-		}
+		cancelOnProcessor(jobID, variant, requestID(r.Context()))
 	}
 
+	processingQueue.remove(jobID)
 	jobsMutex.Lock()
 	job, exists = jobs[jobID]
+	var deleted Job
 	if exists {
 		// Mark as cancelled/failed if still processing
-		if job.Status == "pending" || job.Status == "processing" {
+		if job.Status == "pending" || job.Status == "queued" || job.Status == "processing" {
 			job.Status = "failed"
-			job.Error = "Cancelled by user"
-			now := time.Now()
+			job.Error = jobCancelledMessage
+			now := time.Now().UTC()
 			job.CompletedAt = &now
 		}
+		deleted = job.snapshot()
 		delete(jobs, jobID)
 	}
 	jobsMutex.Unlock()
+	releaseLeasesForJob(jobID)
+	deleteAnnotations(jobID)
 
 	if !exists {
 		http.Error(w, "Job not found", http.StatusNotFound)
 		return
 	}
+	emitEvent(EventJobDeleted, deleted)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
@@ -499,29 +1580,40 @@ func processingStatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get processing status from processor service
-	processorURL := os.Getenv("PROCESSOR_URL")
-	if processorURL == "" {
-		processorURL = "http://processor:5000"
+	// Get processing status from processor service (cached briefly)
+	var variant string
+	status := "processing"
+	jobsMutex.RLock()
+	if job, exists := jobs[jobID]; exists {
+		variant, status = job.Variant, job.Status
+	}
+	jobsMutex.RUnlock()
+	position := 0
+	if status == "queued" {
+		position = processingQueue.position(jobID)
 	}
+	interval := pollInterval(status, position)
 
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Get(processorURL + "/status/" + jobID)
+	_, body, err := processorStatus(jobID, variant)
 	if err != nil {
 		// Return default status if processor is not reachable
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
+		json.NewEncoder(w).Encode(withStatusHints(map[string]interface{}{
 			"status":   "unknown",
 			"progress": 0,
 			"stage":    "Checking status...",
-		})
+		}, interval))
 		return
 	}
-	defer resp.Body.Close()
 
-	// Forward the response
+	readyStemsFromStatus(jobID, body)
+	// Forward the response, with the polling hints when it is an object
+	var resp map[string]interface{}
+	if interval > 0 && json.Unmarshal(body, &resp) == nil && resp != nil {
+		writeJSON(w, http.StatusOK, withStatusHints(resp, interval))
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	body, _ := io.ReadAll(resp.Body)
 	w.Write(body)
 }
 
@@ -534,9 +1626,26 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid job ID", http.StatusBadRequest)
 		return
 	}
+	// inline lets <audio> elements play the stem instead of saving it
+	disposition := r.URL.Query().Get("disposition")
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	if disposition != "attachment" && disposition != "inline" {
+		http.Error(w, "Invalid disposition value", http.StatusBadRequest)
+		return
+	}
 
 	jobsMutex.RLock()
 	job, exists := jobs[jobID]
+	var stored, keyed bool
+	var status, hash, variant string
+	var outputFiles map[string]string
+	if exists {
+		exists = canAccessJob(r, job)
+		stored, status, outputFiles = job.Stored, job.Status, job.OutputFiles
+		keyed, hash, variant = job.APIKeyID != "", job.OutputHashes[stem], job.Variant
+	}
 	jobsMutex.RUnlock()
 
 	if !exists {
@@ -544,12 +1653,24 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if job.Status != "completed" {
+	if status == "expired" {
+		http.Error(w, jobExpiredMessage, http.StatusGone)
+		return
+	}
+	if status == "processing" {
+		// Stems the processor has finished can be fetched before the rest
+		path, ready := readyStemPath(jobID, variant, stem)
+		if !ready {
+			http.Error(w, "Stem not ready", http.StatusBadRequest)
+			return
+		}
+		outputFiles, stored, hash = map[string]string{stem: path}, false, ""
+	} else if status != "completed" {
 		http.Error(w, "Job not completed", http.StatusBadRequest)
 		return
 	}
 
-	filePath, exists := job.OutputFiles[stem]
+	filePath, exists := outputFiles[stem]
 	if !exists {
 		http.Error(w, "Stem not found", http.StatusNotFound)
 		return
@@ -561,13 +1682,21 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid file path", http.StatusBadRequest)
 		return
 	}
+	if !stemVersionMatches(w, r, hash) {
+		return
+	}
+
+	// Stems copied to remote storage are served from there
+	if s, remote := remoteStorage(); remote && stored {
+		serveFromStorage(w, r, s, filePath)
+		return
+	}
 
 	// Check file exists
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		http.Error(w, "File not found on disk", http.StatusNotFound)
 		return
 	}
-
 	// Get the actual filename from the path
 	fileName := filepath.Base(filePath)
 	ext := filepath.Ext(filePath)
@@ -590,18 +1719,16 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Get file info for size
+	// Get file info for the modification time
 	fileInfo, err := file.Stat()
 	if err != nil {
 		http.Error(w, "Failed to get file info", http.StatusInternalServerError)
 		return
 	}
 
-	// Set headers before writing body
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
+	// ServeContent answers Range and conditional requests (ETag, Last-Modified)
+	cacheHeaders(w, r, hash, keyed)
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, fileName))
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
-
-	// Stream the file
-	io.Copy(w, file)
+	http.ServeContent(w, r, fileName, fileInfo.ModTime(), file)
 }
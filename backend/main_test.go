@@ -1,6 +1,11 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -100,3 +105,71 @@ func TestAllowlistMaps(t *testing.T) {
 		t.Error("unexpected model with injection in allowlist")
 	}
 }
+
+func TestProcessJobRecordsEnvironment(t *testing.T) {
+	processor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"completed","outputs":{"vocals":"/app/outputs/j/vocals.mp3"},"processing_time":"1m 2s",` +
+			`"environment":{"instance":"gpu-node-3","image":"track2stem-processor:1.4.0","device":"cuda","gpu":"NVIDIA L4","demucs_version":"4.0.1"}}`))
+	}))
+	defer processor.Close()
+	t.Setenv("PROCESSOR_URL", processor.URL)
+
+	input := filepath.Join(t.TempDir(), "song.mp3")
+	os.WriteFile(input, []byte("ID3"), 0644)
+	jobsMutex.Lock()
+	jobs["env-job"] = &Job{ID: "env-job", Status: "queued"}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, "env-job")
+		jobsMutex.Unlock()
+	})
+
+	processJob("env-job", input, jobOptions{})
+	jobsMutex.RLock()
+	env := jobs["env-job"].Environment
+	jobsMutex.RUnlock()
+	if env == nil || env.Instance != "gpu-node-3" || env.GPU != "NVIDIA L4" || env.Image != "track2stem-processor:1.4.0" {
+		t.Errorf("environment = %+v", env)
+	}
+
+	if env := workerEnvironment("", "worker-7"); env == nil || env.Instance != "worker-7" {
+		t.Errorf("worker environment = %+v, want instance worker-7", env)
+	}
+}
+
+func TestParseJobOptions(t *testing.T) {
+	valid := []map[string]string{
+		{},
+		{"model": "mdx_extra", "segment": "40", "overlap": "0.10", "shifts": "5"},
+		{"output_format": "mp3", "mp3_bitrate": "192"},
+		{"stem_mode": "isolate", "isolate_stem": "piano", "model": "htdemucs_6s"},
+		{"output_format": "flac", "clip_mode": "clamp"},
+	}
+	for _, fields := range valid {
+		if _, err := parseJobOptions(func(k string) string { return fields[k] }); err != nil {
+			t.Errorf("parseJobOptions(%v) = %v", fields, err)
+		}
+	}
+	opts, _ := parseJobOptions(func(k string) string { return map[string]string{"overlap": "0.10"}[k] })
+	if opts.MP3Bitrate != "320" || opts.Overlap != "0.1" {
+		t.Errorf("defaults = %+v, want mp3_bitrate 320 and overlap 0.1", opts)
+	}
+
+	invalid := map[string]map[string]string{
+		"Invalid model value (allowed:":      {"model": "demucs_v9"},
+		"Invalid mp3_bitrate value":          {"mp3_bitrate": "64"},
+		"Invalid shifts value":               {"shifts": "11"},
+		"Invalid segment value":              {"model": "mdx", "segment": "7"},
+		"Invalid overlap value":              {"overlap": "0.9"},
+		"requires a 6-stem model":            {"stem_mode": "isolate", "isolate_stem": "guitar", "model": "htdemucs"},
+		"mp3_bitrate only applies":           {"output_format": "wav", "mp3_bitrate": "320"},
+		"transformer models use the segment": {"model": "htdemucs_ft", "segment": "10"},
+	}
+	for want, fields := range invalid {
+		_, err := parseJobOptions(func(k string) string { return fields[k] })
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseJobOptions(%v) = %v, want %q", fields, err, want)
+		}
+	}
+}
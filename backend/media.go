@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recordedMediaTypes maps MediaRecorder container types to file extensions.
+// Browsers record into containers the processor can't decode, so these
+// uploads are converted to FLAC before a job is dispatched.
+var recordedMediaTypes = map[string]string{
+	"audio/webm": ".webm",
+	"video/webm": ".webm",
+	"audio/ogg":  ".ogg",
+	"audio/opus": ".opus",
+}
+
+// transcodeTimeout caps how long a single ffmpeg conversion may run
+const transcodeTimeout = 5 * time.Minute
+
+// recordedExtension reports the extension for a browser recording, based on
+// the part's Content-Type or, failing that, the filename extension
+func recordedExtension(filename, contentType string) (string, bool) {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if ext, ok := recordedMediaTypes[mediaType]; ok {
+			return ext, true
+		}
+	}
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".webm", ".weba", ".opus", ".ogg":
+		return ext, true
+	}
+	return "", false
+}
+
+// withExtension makes sure a sanitized filename ends in ext; MediaRecorder
+// blobs are usually uploaded as "blob" with no extension at all
+func withExtension(filename, ext string) string {
+	if strings.EqualFold(filepath.Ext(filename), ext) {
+		return filename
+	}
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ext
+}
+
+// transcodeToFLAC converts src into a FLAC file at dst using ffmpeg
+func transcodeToFLAC(src, dst string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	defer cancel()
+
+	cmd := mediaCommand(ctx, "ffmpeg", "-y", "-nostdin", "-i", src, "-vn", "-c:a", "flac", dst)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(dst)
+		if ctx.Err() != nil {
+			return fmt.Errorf("conversion timed out")
+		}
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, lastLine(string(out)))
+	}
+	return nil
+}
+
+// encodeStem converts a stem to another output format with ffmpeg, through
+// the audio filters given, if any
+func encodeStem(src, dst, format, mp3Bitrate string, filters ...string) error {
+	codec := []string{"-c:a", "pcm_s16le"}
+	switch format {
+	case "flac":
+		codec = []string{"-c:a", "flac"}
+	case "mp3":
+		if mp3Bitrate == "" {
+			mp3Bitrate = "320"
+		}
+		codec = []string{"-c:a", "libmp3lame", "-b:a", mp3Bitrate + "k"}
+	}
+	if len(filters) > 0 {
+		codec = append([]string{"-af", strings.Join(filters, ",")}, codec...)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	defer cancel()
+	args := append([]string{"-y", "-nostdin", "-i", src, "-vn"}, codec...)
+	cmd := mediaCommand(ctx, "ffmpeg", append(args, dst)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(dst)
+		if ctx.Err() != nil {
+			return fmt.Errorf("encoding timed out")
+		}
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, lastLine(string(out)))
+	}
+	return nil
+}
+
+// lastLine returns the final non-empty line of command output, which is
+// where ffmpeg reports the actual error
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// decodeMonoPCM decodes any audio file ffmpeg understands into mono signed
+// 16-bit samples at the given sample rate
+func decodeMonoPCM(path string, sampleRate int) ([]int16, error) {
+	return decodePCM(path, sampleRate, 1, 0)
+}
+
+// decodeMonoPCMWindow is decodeMonoPCM for at most the first maxSeconds
+func decodeMonoPCMWindow(path string, sampleRate, maxSeconds int) ([]int16, error) {
+	return decodePCM(path, sampleRate, 1, maxSeconds)
+}
+
+// decodeStereoPCM is decodeMonoPCM for interleaved stereo samples
+func decodeStereoPCM(path string, sampleRate int) ([]int16, error) {
+	return decodePCM(path, sampleRate, 2, 0)
+}
+
+// decodePCM decodes the whole file, or its first maxSeconds when that is
+// above 0
+func decodePCM(path string, sampleRate, channels, maxSeconds int) ([]int16, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	defer cancel()
+
+	args := []string{"-nostdin", "-loglevel", "error", "-i", path}
+	if maxSeconds > 0 {
+		args = append(args, "-t", strconv.Itoa(maxSeconds))
+	}
+	args = append(args, "-vn", "-ac", strconv.Itoa(channels), "-ar", strconv.Itoa(sampleRate), "-f", "s16le", "-")
+	cmd := mediaCommand(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	raw, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("decoding timed out")
+		}
+		return nil, fmt.Errorf("ffmpeg failed: %v: %s", err, lastLine(stderr.String()))
+	}
+
+	samples := make([]int16, len(raw)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(raw[2*i:]))
+	}
+	return samples, nil
+}
+
+// TrackMetadata is the tagging detected on an upload, used for library
+// folder layouts and package manifests
+type TrackMetadata struct {
+	Title  string `json:"title,omitempty"`
+	Artist string `json:"artist,omitempty"`
+	Album  string `json:"album,omitempty"`
+	Track  string `json:"track,omitempty"`
+	Year   string `json:"year,omitempty"`
+	Lyrics string `json:"-"` // served as lyrics.txt inside packages
+}
+
+// probeMetadata reads container tags with ffprobe, falling back to an
+// "Artist - Title" file name when the file has no tags
+func probeMetadata(path, fileName string) *TrackMetadata {
+	meta := &TrackMetadata{}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out, err := mediaCommand(ctx, "ffprobe", "-v", "error", "-show_entries", "format_tags", "-of", "json", path).Output()
+	if err == nil {
+		var probe struct {
+			Format struct {
+				Tags map[string]string `json:"tags"`
+			} `json:"format"`
+		}
+		if json.Unmarshal(out, &probe) == nil {
+			for key, value := range probe.Format.Tags {
+				value = strings.TrimSpace(value)
+				switch key = strings.ToLower(key); {
+				case key == "title":
+					meta.Title = value
+				case key == "artist" || key == "album_artist" && meta.Artist == "":
+					meta.Artist = value
+				case key == "album":
+					meta.Album = value
+				case key == "track":
+					meta.Track = value
+				case key == "date" || key == "year":
+					meta.Year = value
+				case strings.HasPrefix(key, "lyrics") || key == "unsyncedlyrics":
+					meta.Lyrics = value
+				}
+			}
+		}
+	}
+
+	base := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	// Sanitized upload names use underscores for spaces
+	if !strings.Contains(base, " ") {
+		base = strings.ReplaceAll(base, "_", " ")
+	}
+	if meta.Title == "" {
+		meta.Title = base
+		if artist, title, ok := strings.Cut(base, " - "); ok {
+			meta.Title = strings.TrimSpace(title)
+			if meta.Artist == "" {
+				meta.Artist = strings.TrimSpace(artist)
+			}
+		}
+	}
+	return meta
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordedExtension(t *testing.T) {
+	tests := []struct {
+		filename    string
+		contentType string
+		ext         string
+		ok          bool
+	}{
+		{"blob", "audio/webm;codecs=opus", ".webm", true},
+		{"take1.ogg", "audio/ogg; codecs=opus", ".ogg", true},
+		{"jam.webm", "application/octet-stream", ".webm", true},
+		{"take2.ogg", "application/octet-stream", ".ogg", true},
+		{"song.mp3", "audio/mpeg", "", false},
+		{"song.wav", "", "", false},
+	}
+	for _, tc := range tests {
+		ext, ok := recordedExtension(tc.filename, tc.contentType)
+		if ext != tc.ext || ok != tc.ok {
+			t.Errorf("recordedExtension(%q, %q) = %q, %v; want %q, %v", tc.filename, tc.contentType, ext, ok, tc.ext, tc.ok)
+		}
+	}
+}
+
+func TestWithExtension(t *testing.T) {
+	tests := []struct {
+		input, ext, expected string
+	}{
+		{"blob", ".webm", "blob.webm"},
+		{"take.webm", ".webm", "take.webm"},
+		{"take.WEBM", ".webm", "take.WEBM"},
+		{"/app/uploads/id_take.webm", ".flac", "/app/uploads/id_take.flac"},
+	}
+	for _, tc := range tests {
+		if got := withExtension(tc.input, tc.ext); got != tc.expected {
+			t.Errorf("withExtension(%q, %q) = %q, want %q", tc.input, tc.ext, got, tc.expected)
+		}
+	}
+}
+
+func TestProbeMetadataFileNameFallback(t *testing.T) {
+	// An unreadable file has no tags, so the name is used
+	meta := probeMetadata(filepath.Join(t.TempDir(), "missing.mp3"), "Daft_Punk_-_One_More_Time.mp3")
+	if meta.Artist != "Daft Punk" || meta.Title != "One More Time" {
+		t.Errorf("metadata = %+v, want artist and title from the file name", meta)
+	}
+}
+
+func TestIntegrationFailedRecordingLeavesNoJob(t *testing.T) {
+	b := newIntegrationBackend(t, 1)
+	jobsMutex.RLock()
+	before := len(jobs)
+	jobsMutex.RUnlock()
+
+	// ffmpeg isn't available to the tests, so every conversion fails
+	code, _, r := postFile(t, b.URL, "take.webm", nil)
+	if code != http.StatusUnprocessableEntity || r.Code != "unreadable_audio" {
+		t.Errorf("recording = %d %+v", code, r)
+	}
+	jobsMutex.RLock()
+	after := len(jobs)
+	jobsMutex.RUnlock()
+	if after != before {
+		t.Errorf("%d jobs before the upload, %d after", before, after)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheus metrics. GET /metrics serves counters, gauges and histograms
+// in the Prometheus text format: job events by type, jobs by status, queue
+// depth, processing duration, upload sizes, processor errors by instance,
+// HTTP requests by route and status, stem/package bytes downloaded and the
+// service level indicators (slo.go).
+// The route isn't under /api, so the bundled nginx doesn't expose it; set
+// METRICS_TOKEN to require "Authorization: Bearer <token>" from the
+// scraper anyway.
+
+var (
+	processingSecondsBuckets = []float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600}
+	uploadBytesBuckets       = []float64{1 << 20, 5 << 20, 10 << 20, 25 << 20, 50 << 20, 100 << 20, 250 << 20, 500 << 20, 1 << 30}
+)
+
+// histogram is a cumulative Prometheus histogram
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // per bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// appMetrics holds everything /metrics reports that isn't read from the
+// jobs map or queue at scrape time
+type appMetrics struct {
+	jobEvents         map[string]uint64
+	processorErrors   map[string]uint64
+	httpRequests      map[string]uint64 // route, method and status, space separated
+	downloadBytes     uint64
+	processingSeconds *histogram
+	uploadBytes       *histogram
+	processingSince   map[string]time.Time // job ID: when it went to the processor
+}
+
+func newAppMetrics() *appMetrics {
+	return &appMetrics{
+		jobEvents:         make(map[string]uint64),
+		processorErrors:   make(map[string]uint64),
+		httpRequests:      make(map[string]uint64),
+		processingSeconds: newHistogram(processingSecondsBuckets),
+		uploadBytes:       newHistogram(uploadBytesBuckets),
+		processingSince:   make(map[string]time.Time),
+	}
+}
+
+var (
+	metrics      = newAppMetrics()
+	metricsMutex = &sync.Mutex{}
+)
+
+// downloadRoutes count towards track2stem_download_bytes_total
+var downloadRoutes = map[string]bool{
+	"/api/download/{id}/all":           true,
+	"/api/download/{id}/{stem}":        true,
+	"/api/download/{id}/{stem}/{hash}": true,
+	"/api/jobs/{id}/package":           true,
+}
+
+// recordJobMetrics counts job events and times processing; main registers
+// it as an event listener
+func recordJobMetrics(e Event) {
+	if e.Job.SelfTest {
+		return
+	}
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	metrics.jobEvents[strings.TrimPrefix(e.Type, "job.")]++
+	switch e.Type {
+	case EventJobProcessing:
+		metrics.processingSince[e.Job.ID] = e.CreatedAt
+	case EventJobCompleted, EventJobFailed, EventJobDeleted:
+		if since, ok := metrics.processingSince[e.Job.ID]; ok {
+			if e.Type == EventJobCompleted {
+				metrics.processingSeconds.observe(e.CreatedAt.Sub(since).Seconds())
+			}
+			delete(metrics.processingSince, e.Job.ID)
+		}
+	}
+}
+
+// recordUploadSize observes the size of an accepted upload
+func recordUploadSize(size int64) {
+	metricsMutex.Lock()
+	metrics.uploadBytes.observe(float64(size))
+	metricsMutex.Unlock()
+}
+
+// recordProcessorError counts a /process call that failed or didn't answer 200
+func recordProcessorError(processorURL string) {
+	metricsMutex.Lock()
+	metrics.processorErrors[processorURL]++
+	metricsMutex.Unlock()
+}
+
+// recordHTTPRequest counts a served request
+func recordHTTPRequest(route, method string, status int, bytes int64) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	metrics.httpRequests[fmt.Sprintf("%s %s %d", route, method, status)]++
+	if downloadRoutes[route] {
+		metrics.downloadBytes += uint64(bytes)
+	}
+}
+
+// metricsHandler serves GET /metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if token := os.Getenv("METRICS_TOKEN"); token != "" &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	jobsMutex.RLock()
+	byStatus := map[string]uint64{}
+	for _, job := range jobs {
+		if !job.SelfTest {
+			byStatus[job.Status]++
+		}
+	}
+	jobsMutex.RUnlock()
+	queued, running := processingQueue.stats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	writeCounters(w, "track2stem_jobs_total", "counter", "Job lifecycle events by type.", "event", metrics.jobEvents)
+	writeCounters(w, "track2stem_jobs", "gauge", "Jobs currently known by status.", "status", byStatus)
+	writeMetric(w, "track2stem_queue_depth", "gauge", "Jobs waiting for a processing slot.")
+	fmt.Fprintf(w, "track2stem_queue_depth %d\n", queued)
+	writeMetric(w, "track2stem_jobs_running", "gauge", "Jobs being processed.")
+	fmt.Fprintf(w, "track2stem_jobs_running %d\n", running)
+	writeHistogram(w, "track2stem_job_processing_seconds", "Time from dispatch to completion of successful jobs.", metrics.processingSeconds)
+	writeHistogram(w, "track2stem_upload_size_bytes", "Size of accepted uploads.", metrics.uploadBytes)
+	writeCounters(w, "track2stem_processor_errors_total", "counter", "Failed /process calls by processor.", "processor", metrics.processorErrors)
+	writeMetric(w, "track2stem_http_requests_total", "counter", "HTTP requests by route, method and status.")
+	for _, key := range sortedKeys(metrics.httpRequests) {
+		parts := strings.SplitN(key, " ", 3)
+		fmt.Fprintf(w, "track2stem_http_requests_total{route=%s,method=%s,status=%s} %d\n",
+			labelValue(parts[0]), labelValue(parts[1]), labelValue(parts[2]), metrics.httpRequests[key])
+	}
+	writeMetric(w, "track2stem_download_bytes_total", "counter", "Bytes of stems and packages sent to clients.")
+	fmt.Fprintf(w, "track2stem_download_bytes_total %d\n", metrics.downloadBytes)
+	writeSLOMetrics(w)
+	writeCleanupMetrics(w)
+}
+
+func writeMetric(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeCounters(w io.Writer, name, kind, help, label string, values map[string]uint64) {
+	writeMetric(w, name, kind, help)
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", name, label, labelValue(key), values[key])
+	}
+}
+
+func writeHistogram(w io.Writer, name, help string, h *histogram) {
+	writeMetric(w, name, "histogram", help)
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", name, h.count, name, h.sum, name, h.count)
+}
+
+// labelValue quotes a label value, escaping as the text format requires
+func labelValue(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
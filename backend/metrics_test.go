@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	metricsMutex.Lock()
+	old := metrics
+	metrics = newAppMetrics()
+	metricsMutex.Unlock()
+	t.Cleanup(func() {
+		metricsMutex.Lock()
+		metrics = old
+		metricsMutex.Unlock()
+	})
+	t.Setenv("METRICS_TOKEN", "scrape")
+	t.Setenv("REQUEST_LOG", "false")
+
+	id := uuid.New().String()
+	start := time.Now()
+	recordJobMetrics(Event{Type: EventJobProcessing, CreatedAt: start, Job: Job{ID: id}})
+	recordJobMetrics(Event{Type: EventJobCompleted, CreatedAt: start.Add(90 * time.Second), Job: Job{ID: id}})
+	recordJobMetrics(Event{Type: EventJobCompleted, CreatedAt: start, Job: Job{ID: "self-test", SelfTest: true}})
+	recordUploadSize(3 << 20)
+	recordProcessorError("http://processor-gpu:5000")
+
+	router := mux.NewRouter()
+	router.Use(requestLogMiddleware)
+	router.HandleFunc("/api/download/{id}/{stem}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	})
+	router.HandleFunc("/metrics", metricsHandler)
+	for i := 0; i < 2; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/download/"+id+"/vocals", nil))
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("scrape without the token = %d, want 401", rec.Code)
+	}
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scrape")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE track2stem_jobs_total counter\n",
+		`track2stem_jobs_total{event="completed"} 1` + "\n",
+		`track2stem_job_processing_seconds_bucket{le="60"} 0` + "\n",
+		`track2stem_job_processing_seconds_bucket{le="120"} 1` + "\n",
+		`track2stem_job_processing_seconds_bucket{le="+Inf"} 1` + "\n",
+		"track2stem_job_processing_seconds_sum 90\n",
+		`track2stem_upload_size_bytes_bucket{le="5.24288e+06"} 1` + "\n",
+		`track2stem_processor_errors_total{processor="http://processor-gpu:5000"} 1` + "\n",
+		`track2stem_http_requests_total{route="/api/download/{id}/{stem}",method="GET",status="200"} 2` + "\n",
+		`track2stem_http_requests_total{route="/metrics",method="GET",status="401"} 1` + "\n",
+		"track2stem_download_bytes_total 2000\n",
+		"track2stem_queue_depth ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Storage migration, for instances that started on the local volumes and
+// move to a bucket. POST /api/admin/migrate (or `track2stem migrate`)
+// copies the upload and outputs of every finished job, and the job record
+// itself as jobs/<id>.json, to MIGRATE_S3_BUCKET (with _REGION, _ENDPOINT,
+// _PREFIX and credentials as for STORAGE_S3), or else to the configured
+// STORAGE_BACKEND=s3 bucket. Every object is read back and its SHA-256
+// compared with the local file, and a job only counts as migrated once all
+// of its objects match; objects already in the bucket with the same content
+// aren't copied again, so a run that was interrupted or left failures can
+// simply be repeated. When the target is the configured storage, migrated
+// jobs are marked stored and their downloads come from the bucket from then
+// on. ?dry_run=true lists what would be copied. Jobs still queued or
+// processing are skipped. The job table itself is kept in memory, so there
+// is no job store to move records into: jobs/<id>.json keeps the history
+// next to its stems.
+
+// MigrationReport is the outcome of one migration run
+type MigrationReport struct {
+	RanAt     time.Time         `json:"ran_at"`
+	Target    string            `json:"target"` // s3://bucket/prefix
+	DryRun    bool              `json:"dry_run,omitempty"`
+	Migrated  []string          `json:"migrated"`
+	Skipped   map[string]string `json:"skipped,omitempty"` // job -> reason
+	Failed    map[string]string `json:"failed,omitempty"`  // job -> error
+	Objects   int               `json:"objects_copied"`
+	Bytes     int64             `json:"bytes_copied"`
+	Unchanged int               `json:"objects_unchanged"` // already in the bucket
+}
+
+// migrationMutex lets one migration run at a time
+var migrationMutex = &sync.Mutex{}
+
+// jobRecordKey is where a job's record is kept in the bucket
+func jobRecordKey(jobID string) string {
+	return "jobs/" + jobID + ".json"
+}
+
+// migrationTarget returns the bucket to migrate to, its name, and whether
+// it is the configured storage
+func migrationTarget() (Storage, string, bool, error) {
+	if os.Getenv("MIGRATE_S3_BUCKET") != "" {
+		config, ok := s3ConfigFromEnv("MIGRATE_S3")
+		if !ok {
+			return nil, "", false, fmt.Errorf("MIGRATE_S3_BUCKET needs MIGRATE_S3_ACCESS_KEY_ID and MIGRATE_S3_SECRET_ACCESS_KEY")
+		}
+		return s3Storage{config: config}, bucketName(config), false, nil
+	}
+	s, remote, err := storageFromEnv()
+	if err != nil {
+		return nil, "", false, err
+	}
+	if !remote {
+		return nil, "", false, fmt.Errorf("No migration target: set MIGRATE_S3_BUCKET, or STORAGE_BACKEND=s3")
+	}
+	return s, bucketName(s.(s3Storage).config), true, nil
+}
+
+func bucketName(c *s3Config) string {
+	if c.Prefix == "" {
+		return "s3://" + c.Bucket
+	}
+	return "s3://" + c.Bucket + "/" + c.Prefix
+}
+
+// objectSHA256 hashes the object at key
+func objectSHA256(ctx context.Context, s Storage, key string) (string, error) {
+	rc, err := s.Open(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// migrateFile copies path to key unless the bucket already has the same
+// content, and checks the copy; it returns whether it copied the file
+func migrateFile(ctx context.Context, s Storage, key, path string) (bool, error) {
+	want, err := fileSHA256(path)
+	if err != nil {
+		return false, err
+	}
+	if got, err := objectSHA256(ctx, s, key); err == nil && got == want {
+		return false, nil
+	}
+	if err := s.Save(ctx, key, path); err != nil {
+		return false, err
+	}
+	got, err := objectSHA256(ctx, s, key)
+	if err != nil {
+		return true, fmt.Errorf("reading back %s: %v", key, err)
+	}
+	if got != want {
+		return true, fmt.Errorf("%s has SHA-256 %s in the bucket, %s on disk", key, got, want)
+	}
+	return true, nil
+}
+
+// migrateJobRecord copies a job's record to the bucket
+func migrateJobRecord(ctx context.Context, s Storage, job Job) (bool, int64, error) {
+	record, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return false, 0, err
+	}
+	f, err := os.CreateTemp("", "track2stem-job-*.json")
+	if err != nil {
+		return false, 0, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(record)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	copied, err := migrateFile(ctx, s, jobRecordKey(job.ID), f.Name())
+	return copied, int64(len(record)), err
+}
+
+// migrateJobs copies the files and records of every finished job to s
+func migrateJobs(ctx context.Context, s Storage, target string, configured, dryRun bool) MigrationReport {
+	report := MigrationReport{RanAt: time.Now().UTC(), Target: target, DryRun: dryRun, Migrated: []string{},
+		Skipped: map[string]string{}, Failed: map[string]string{}}
+
+	var finished []Job
+	files := map[string][]string{}
+	jobsMutex.RLock()
+	for id, job := range jobs {
+		switch job.Status {
+		case "completed", "failed", "expired":
+			finished = append(finished, job.snapshot())
+			files[id] = jobFiles(job)
+		default:
+			report.Skipped[id] = "still " + job.Status
+		}
+	}
+	jobsMutex.RUnlock()
+	sort.Slice(finished, func(i, j int) bool { return finished[i].CreatedAt.Before(finished[j].CreatedAt) })
+
+	for _, job := range finished {
+		if ctx.Err() != nil {
+			report.Skipped[job.ID] = "migration cancelled"
+			continue
+		}
+		if dryRun {
+			var size int64
+			var missing string
+			for _, path := range files[job.ID] {
+				if info, err := os.Stat(path); err != nil {
+					missing = path
+				} else {
+					size += info.Size()
+				}
+			}
+			if missing != "" {
+				report.Failed[job.ID] = missing + " is missing on disk"
+				continue
+			}
+			report.Migrated = append(report.Migrated, job.ID)
+			report.Objects += len(files[job.ID]) + 1
+			report.Bytes += size
+			continue
+		}
+
+		jobCtx, cancel := context.WithTimeout(ctx, storageTimeout)
+		err := func() error {
+			for _, path := range files[job.ID] {
+				key := storageKey(path)
+				if key == "" {
+					return fmt.Errorf("%s is outside the storage volumes", path)
+				}
+				copied, err := migrateFile(jobCtx, s, key, path)
+				if err != nil {
+					return err
+				}
+				if !copied {
+					report.Unchanged++
+					continue
+				}
+				report.Objects++
+				if info, err := os.Stat(path); err == nil {
+					report.Bytes += info.Size()
+				}
+			}
+			// The record is written as the job will be once migrated
+			if configured && job.Status == "completed" {
+				job.Stored = true
+			}
+			copied, size, err := migrateJobRecord(jobCtx, s, job)
+			if err != nil {
+				return err
+			}
+			if copied {
+				report.Objects++
+				report.Bytes += size
+			} else {
+				report.Unchanged++
+			}
+			return nil
+		}()
+		cancel()
+		if err != nil {
+			report.Failed[job.ID] = err.Error()
+			continue
+		}
+		report.Migrated = append(report.Migrated, job.ID)
+		if configured && job.Status == "completed" {
+			jobsMutex.Lock()
+			if live, exists := jobs[job.ID]; exists && live.Status == "completed" {
+				live.Stored = true
+			}
+			jobsMutex.Unlock()
+		}
+	}
+	return report
+}
+
+// migrateHandler serves POST /api/admin/migrate?dry_run=true
+func migrateHandler(w http.ResponseWriter, r *http.Request) {
+	s, target, configured, err := migrationTarget()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !migrationMutex.TryLock() {
+		http.Error(w, "A migration is already running", http.StatusConflict)
+		return
+	}
+	defer migrationMutex.Unlock()
+
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	report := migrateJobs(r.Context(), s, target, configured, dryRun)
+	if !dryRun {
+		recordAudit("storage.migrate", "", map[string]string{
+			"target":   target,
+			"migrated": strconv.Itoa(len(report.Migrated)),
+			"failed":   strconv.Itoa(len(report.Failed)),
+		})
+	}
+	writeJSON(w, http.StatusOK, report)
+}
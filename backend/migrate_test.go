@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrateJobsToBucket(t *testing.T) {
+	oldUploadDir, oldOutputDir := uploadDir, outputDir
+	uploadDir, outputDir = t.TempDir(), t.TempDir()
+	t.Cleanup(func() { uploadDir, outputDir = oldUploadDir, oldOutputDir })
+	bucket := &fakeBucket{objects: make(map[string]string)}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+
+	migrate := func(query string) (int, MigrationReport) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		migrateHandler(rec, httptest.NewRequest("POST", "/api/admin/migrate"+query, nil))
+		var report MigrationReport
+		json.Unmarshal(rec.Body.Bytes(), &report)
+		return rec.Code, report
+	}
+	if code, _ := migrate(""); code != http.StatusBadRequest {
+		t.Errorf("migration without a target = %d", code)
+	}
+
+	t.Setenv("STORAGE_BACKEND", "s3")
+	t.Setenv("STORAGE_S3_ENDPOINT", server.URL)
+	t.Setenv("STORAGE_S3_BUCKET", "stems")
+	t.Setenv("STORAGE_S3_ACCESS_KEY_ID", "key")
+	t.Setenv("STORAGE_S3_SECRET_ACCESS_KEY", "secret")
+
+	vocals := filepath.Join(outputDir, "migrate-done", "vocals.mp3")
+	os.MkdirAll(filepath.Dir(vocals), 0755)
+	os.WriteFile(vocals, []byte("vocal data"), 0644)
+	input := filepath.Join(uploadDir, "migrate-done_song.mp3")
+	os.WriteFile(input, []byte("ID3 song"), 0644)
+	completed := time.Now()
+	jobsMutex.Lock()
+	jobs["migrate-done"] = &Job{ID: "migrate-done", Status: "completed", CompletedAt: &completed,
+		OutputFiles: map[string]string{"vocals": vocals}, inputPath: input}
+	jobs["migrate-lost"] = &Job{ID: "migrate-lost", Status: "completed",
+		OutputFiles: map[string]string{"vocals": filepath.Join(outputDir, "migrate-lost", "vocals.mp3")}}
+	jobs["migrate-running"] = &Job{ID: "migrate-running", Status: "processing"}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, "migrate-done")
+		delete(jobs, "migrate-lost")
+		delete(jobs, "migrate-running")
+		jobsMutex.Unlock()
+	})
+
+	// A dry run copies nothing
+	code, report := migrate("?dry_run=true")
+	if code != http.StatusOK || len(report.Migrated) != 1 || report.Objects != 3 || report.Bytes != 18 || bucket.len() != 0 {
+		t.Fatalf("dry run = %d %+v", code, report)
+	}
+
+	code, report = migrate("")
+	if code != http.StatusOK || report.Target != "s3://stems" || len(report.Migrated) != 1 || report.Migrated[0] != "migrate-done" || report.Objects != 3 {
+		t.Fatalf("migration = %d %+v", code, report)
+	}
+	if !strings.Contains(report.Failed["migrate-lost"], "no such file") || report.Skipped["migrate-running"] != "still processing" {
+		t.Errorf("failed = %v, skipped = %v", report.Failed, report.Skipped)
+	}
+	var record Job
+	json.Unmarshal([]byte(bucket.objects["/stems/jobs/migrate-done.json"]), &record)
+	if bucket.objects["/stems/outputs/migrate-done/vocals.mp3"] != "vocal data" || bucket.objects["/stems/uploads/migrate-done_song.mp3"] != "ID3 song" || record.ID != "migrate-done" {
+		t.Errorf("objects = %v", bucket.objects)
+	}
+	jobsMutex.RLock()
+	stored := jobs["migrate-done"].Stored
+	jobsMutex.RUnlock()
+	if !stored {
+		t.Error("migrated job not marked stored")
+	}
+
+	// Running it again only checks what is already there
+	if _, report = migrate(""); report.Objects != 0 || report.Unchanged != 3 {
+		t.Errorf("second migration = %+v", report)
+	}
+	// A corrupted object is copied again
+	bucket.mu.Lock()
+	bucket.objects["/stems/outputs/migrate-done/vocals.mp3"] = "truncated"
+	bucket.mu.Unlock()
+	if _, report = migrate(""); report.Objects != 1 || bucket.objects["/stems/outputs/migrate-done/vocals.mp3"] != "vocal data" {
+		t.Errorf("repair = %+v", report)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Custom mixes. POST /api/jobs/{id}/mix renders a mixdown of a completed
+// job's stems with ffmpeg, each at its own gain or muted (drums -6 dB and
+// vocals muted for a karaoke track). The render is tracked on the job as a
+// mix with its own ID and status, like a delivery; once it is done the
+// mixdown is added to the job's output_files as "mix-<name>", so it is
+// downloaded, packaged and delivered like a stem.
+
+// mixOutputPrefix marks output files that are mixes rather than stems
+const mixOutputPrefix = "mix-"
+
+// The gain of a stem in a mix is bounded, in dB
+const (
+	mixMinGainDB = -60
+	mixMaxGainDB = 12
+)
+
+// mixNamePattern restricts mix names, which become part of the output key
+// and file name
+var mixNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// mixSlots caps the number of mixes rendered at once
+var mixSlots = make(chan struct{}, 2)
+
+// renderMix writes a mixdown; replaced in tests
+var renderMix = renderMixFFmpeg
+
+// MixStem is the level of one stem in a mix
+type MixStem struct {
+	GainDB float64 `json:"gain_db"`
+	Mute   bool    `json:"mute,omitempty"`
+}
+
+// Mix is a mixdown of a job's stems rendered on request
+type Mix struct {
+	ID          string             `json:"id"`
+	JobID       string             `json:"job_id"`
+	Name        string             `json:"name"`
+	Output      string             `json:"output"` // key in the job's output_files once rendered
+	Format      string             `json:"format"`
+	Stems       map[string]MixStem `json:"stems"`
+	Status      string             `json:"status"` // rendering, completed, failed
+	Error       string             `json:"error,omitempty"`
+	CreatedAt   time.Time          `json:"created_at"`
+	CompletedAt *time.Time         `json:"completed_at,omitempty"`
+}
+
+// mixRequest is the JSON body of POST /api/jobs/{id}/mix. Stems left out
+// are mixed at 0 dB.
+type mixRequest struct {
+	Name   string             `json:"name"`   // defaults to the start of the mix ID
+	Format string             `json:"format"` // mp3, wav or flac; defaults to the stems' format
+	Stems  map[string]MixStem `json:"stems"`
+}
+
+// mixInput is one stem file fed into a render
+type mixInput struct {
+	Path   string
+	GainDB float64
+}
+
+// mixRender is the work of rendering one mix
+type mixRender struct {
+	Inputs     []mixInput
+	Dst        string
+	MP3Bitrate string
+	Chapters   string // FFMETADATA file muxed in as the chapter track, see chapters.go
+}
+
+func isMixOutput(key string) bool {
+	return strings.HasPrefix(key, mixOutputPrefix)
+}
+
+// mixArgs builds the ffmpeg command line for a render
+func mixArgs(r mixRender) []string {
+	args := []string{"-y", "-nostdin", "-loglevel", "error"}
+	var graph strings.Builder
+	for i, in := range r.Inputs {
+		args = append(args, "-i", in.Path)
+		fmt.Fprintf(&graph, "[%d:a]volume=%sdB[s%d];", i, strconv.FormatFloat(in.GainDB, 'f', -1, 64), i)
+	}
+	for i := range r.Inputs {
+		fmt.Fprintf(&graph, "[s%d]", i)
+	}
+	// normalize=0 keeps unity gains summing back to the original track
+	fmt.Fprintf(&graph, "amix=inputs=%d:duration=longest:normalize=0[mix]", len(r.Inputs))
+	if r.Chapters != "" {
+		// The chapters come in after the stems, so the graph's input numbers hold
+		n := strconv.Itoa(len(r.Inputs))
+		args = append(args, "-f", "ffmetadata", "-i", r.Chapters, "-map_metadata", n, "-map_chapters", n)
+	}
+	args = append(args, "-filter_complex", graph.String(), "-map", "[mix]")
+	switch filepath.Ext(r.Dst) {
+	case ".mp3":
+		args = append(args, "-c:a", "libmp3lame", "-b:a", r.MP3Bitrate+"k")
+	case ".flac":
+		args = append(args, "-c:a", "flac")
+	case ".wav":
+		args = append(args, "-c:a", "pcm_s16le")
+	case ".m4a":
+		args = append(args, "-c:a", "aac", "-b:a", "192k")
+	}
+	return append(args, r.Dst)
+}
+
+func renderMixFFmpeg(ctx context.Context, r mixRender) error {
+	cmd := mediaCommand(ctx, "ffmpeg", mixArgs(r)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(r.Dst)
+		if ctx.Err() != nil {
+			return fmt.Errorf("rendering timed out")
+		}
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, lastLine(string(out)))
+	}
+	return nil
+}
+
+// addMix validates the request against the job and records a rendering
+// mix on it, returning the mix and what to render, or an error and the
+// status to answer with
+func addMix(jobID string, req mixRequest) (Mix, mixRender, int, error) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	job, exists := jobs[jobID]
+	if !exists {
+		return Mix{}, mixRender{}, http.StatusNotFound, fmt.Errorf("Job not found")
+	}
+	if job.Status == "expired" {
+		return Mix{}, mixRender{}, http.StatusGone, fmt.Errorf(jobExpiredMessage)
+	}
+	if job.Status != "completed" {
+		return Mix{}, mixRender{}, http.StatusBadRequest, fmt.Errorf("Job not completed")
+	}
+	if job.Encrypted {
+		return Mix{}, mixRender{}, http.StatusConflict, fmt.Errorf(encryptedJobMessage)
+	}
+
+	m := Mix{ID: uuid.New().String(), JobID: jobID, Name: req.Name, Format: req.Format, Status: "rendering", CreatedAt: time.Now().UTC()}
+	if m.Name == "" {
+		m.Name = m.ID[:8]
+	}
+	if !mixNamePattern.MatchString(m.Name) {
+		return Mix{}, mixRender{}, http.StatusBadRequest, fmt.Errorf("Invalid name value")
+	}
+	m.Output = mixOutputPrefix + m.Name
+	if _, taken := job.OutputFiles[m.Output]; taken {
+		return Mix{}, mixRender{}, http.StatusConflict, fmt.Errorf("Mix already exists: %s", m.Name)
+	}
+	for _, other := range job.Mixes {
+		if other.Name == m.Name && other.Status == "rendering" {
+			return Mix{}, mixRender{}, http.StatusConflict, fmt.Errorf("Mix already exists: %s", m.Name)
+		}
+	}
+
+	for stem := range req.Stems {
+		if _, ok := job.OutputFiles[stem]; !ok || isMixOutput(stem) {
+			return Mix{}, mixRender{}, http.StatusNotFound, fmt.Errorf("Stem not found: %s", stem)
+		}
+	}
+	m.Stems = make(map[string]MixStem)
+	var inputs []mixInput
+	for _, stem := range sortedKeys(job.OutputFiles) {
+		if isMixOutput(stem) {
+			continue
+		}
+		level := req.Stems[stem]
+		if level.GainDB < mixMinGainDB || level.GainDB > mixMaxGainDB {
+			return Mix{}, mixRender{}, http.StatusBadRequest, fmt.Errorf("Invalid gain_db value for %s", stem)
+		}
+		m.Stems[stem] = level
+		path := job.OutputFiles[stem]
+		if !safeOutputPath(path) {
+			return Mix{}, mixRender{}, http.StatusNotFound, fmt.Errorf("Stem not found: %s", stem)
+		}
+		if m.Format == "" {
+			m.Format = strings.TrimPrefix(filepath.Ext(path), ".")
+		}
+		if !level.Mute {
+			inputs = append(inputs, mixInput{Path: path, GainDB: level.GainDB})
+		}
+	}
+	if len(inputs) == 0 {
+		return Mix{}, mixRender{}, http.StatusBadRequest, fmt.Errorf("Every stem is muted")
+	}
+	if !allowedOutputFormats[m.Format] {
+		return Mix{}, mixRender{}, http.StatusBadRequest, fmt.Errorf("Invalid format value")
+	}
+
+	base := strings.TrimSuffix(job.FileName, filepath.Ext(job.FileName))
+	render := mixRender{
+		Inputs:     inputs,
+		Dst:        filepath.Join(outputDir, jobID, base+"_t2s_"+m.Output+"."+m.Format),
+		MP3Bitrate: job.MP3Bitrate,
+	}
+	if render.MP3Bitrate == "" {
+		render.MP3Bitrate = "320"
+	}
+	job.Mixes = append(job.Mixes, m)
+	return m, render, http.StatusAccepted, nil
+}
+
+// runMix renders a mix and adds it to the job's output files
+func runMix(m Mix, render mixRender) {
+	dst := render.Dst
+	mixSlots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	err := renderMix(ctx, render)
+	cancel()
+	<-mixSlots
+
+	jobsMutex.Lock()
+	job, exists := jobs[m.JobID]
+	// Expired while rendering: the stems it was mixed from are gone too
+	current := exists && job.Status == "completed"
+	stored := false
+	if exists {
+		for i := range job.Mixes {
+			if job.Mixes[i].ID != m.ID {
+				continue
+			}
+			switch {
+			case err != nil:
+				job.Mixes[i].Status, job.Mixes[i].Error = "failed", err.Error()
+			case !current:
+				job.Mixes[i].Status, job.Mixes[i].Error = "failed", jobExpiredMessage
+			default:
+				now := time.Now().UTC()
+				job.Mixes[i].Status, job.Mixes[i].CompletedAt = "completed", &now
+				job.OutputFiles[m.Output] = dst
+			}
+		}
+		stored = job.Stored
+	}
+	jobsMutex.Unlock()
+
+	switch {
+	case err != nil:
+		log.Printf("Mix %s of job %s failed: %v", m.Name, m.JobID, err)
+	case !current:
+		os.Remove(dst)
+	case stored:
+		if s, remote := remoteStorage(); remote {
+			ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+			defer cancel()
+			if err := s.Save(ctx, storageKey(dst), dst); err != nil {
+				log.Printf("Failed to store mix %s of job %s: %v", m.Name, m.JobID, err)
+			}
+		}
+	}
+	if err == nil && current {
+		hashJobOutputs(m.JobID)
+	}
+}
+
+// createMixHandler serves POST /api/jobs/{id}/mix
+func createMixHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+	if !isValidJobID(jobID) {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	var req mixRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid mix request", http.StatusBadRequest)
+		return
+	}
+
+	m, render, status, err := addMix(jobID, req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	go runMix(m, render)
+	writeJSON(w, http.StatusAccepted, m)
+}
+
+// jobMixes returns a snapshot of a job's mixes, writing an error response
+// when the job doesn't exist
+func jobMixes(w http.ResponseWriter, jobID string) ([]Mix, bool) {
+	if !isValidJobID(jobID) {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return nil, false
+	}
+	jobsMutex.RLock()
+	job, exists := jobs[jobID]
+	var list []Mix
+	if exists {
+		list = job.snapshot().Mixes
+	}
+	jobsMutex.RUnlock()
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return nil, false
+	}
+	return list, true
+}
+
+func listMixesHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := jobMixes(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	if list == nil {
+		list = []Mix{}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func getMixHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	list, ok := jobMixes(w, vars["id"])
+	if !ok {
+		return
+	}
+	for _, m := range list {
+		if m.ID == vars["mix"] {
+			writeJSON(w, http.StatusOK, m)
+			return
+		}
+	}
+	http.Error(w, "Mix not found", http.StatusNotFound)
+}
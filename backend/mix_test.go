@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func TestMixArgs(t *testing.T) {
+	args := mixArgs(mixRender{
+		Inputs:     []mixInput{{Path: "bass.mp3"}, {Path: "drums.mp3", GainDB: -6}},
+		Dst:        "song_t2s_mix-karaoke.mp3",
+		MP3Bitrate: "192",
+	})
+	got := strings.Join(args, " ")
+	want := "-y -nostdin -loglevel error -i bass.mp3 -i drums.mp3 -filter_complex " +
+		"[0:a]volume=0dB[s0];[1:a]volume=-6dB[s1];[s0][s1]amix=inputs=2:duration=longest:normalize=0[mix] " +
+		"-map [mix] -c:a libmp3lame -b:a 192k song_t2s_mix-karaoke.mp3"
+	if got != want {
+		t.Errorf("mixArgs =\n%s\nwant\n%s", got, want)
+	}
+
+	// Chapters are read after the stems and mapped into the output
+	args = mixArgs(mixRender{Inputs: []mixInput{{Path: "vocals.wav"}}, Dst: "episode.m4a", Chapters: "chapters.txt"})
+	got = strings.Join(args, " ")
+	want = "-y -nostdin -loglevel error -i vocals.wav -f ffmetadata -i chapters.txt -map_metadata 1 -map_chapters 1 " +
+		"-filter_complex [0:a]volume=0dB[s0];[s0]amix=inputs=1:duration=longest:normalize=0[mix] -map [mix] -c:a aac -b:a 192k episode.m4a"
+	if got != want {
+		t.Errorf("mixArgs with chapters =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCreateMix(t *testing.T) {
+	oldOutputDir, oldRender := outputDir, renderMix
+	outputDir = t.TempDir()
+	var rendered mixRender
+	renderMix = func(ctx context.Context, r mixRender) error {
+		rendered = r
+		return os.WriteFile(r.Dst, []byte("mixdown"), 0644)
+	}
+	t.Cleanup(func() { outputDir, renderMix = oldOutputDir, oldRender })
+
+	id := uuid.New().String()
+	outputs := map[string]string{}
+	for _, stem := range []string{"vocals", "drums", "bass", "other"} {
+		path := filepath.Join(outputDir, id, "song_t2s_"+stem+".wav")
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(stem), 0644)
+		outputs[stem] = path
+	}
+	jobsMutex.Lock()
+	jobs[id] = &Job{ID: id, Status: "completed", FileName: "song.mp3", OutputFiles: outputs}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/jobs/{id}/mix", createMixHandler).Methods("POST")
+	router.HandleFunc("/api/jobs/{id}/mixes/{mix}", getMixHandler).Methods("GET")
+	router.HandleFunc("/api/download/{id}/{stem}", downloadHandler).Methods("GET")
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", "/api/jobs/"+id+"/mix", strings.NewReader(body)))
+		return rec
+	}
+
+	rec := post(`{"name": "karaoke", "stems": {"vocals": {"mute": true}, "drums": {"gain_db": -6}}}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("create mix = %d: %s", rec.Code, rec.Body)
+	}
+	var m Mix
+	json.Unmarshal(rec.Body.Bytes(), &m)
+	if m.Status != "rendering" || m.Output != "mix-karaoke" || m.Format != "wav" || len(m.Stems) != 4 {
+		t.Errorf("created mix = %+v", m)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for m.Status == "rendering" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", fmt.Sprintf("/api/jobs/%s/mixes/%s", id, m.ID), nil))
+		json.Unmarshal(rec.Body.Bytes(), &m)
+	}
+	if m.Status != "completed" || m.CompletedAt == nil {
+		t.Fatalf("mix after rendering = %+v", m)
+	}
+	if len(rendered.Inputs) != 3 || rendered.Inputs[1].GainDB != -6 || filepath.Base(rendered.Dst) != "song_t2s_mix-karaoke.wav" {
+		t.Errorf("render = %+v", rendered)
+	}
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/download/"+id+"/mix-karaoke", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "mixdown" {
+		t.Errorf("download of the mix = %d %q", rec.Code, rec.Body)
+	}
+
+	for body, want := range map[string]int{
+		`{"name": "karaoke"}`:                        http.StatusConflict,
+		`{"name": "Bad Name"}`:                       http.StatusBadRequest,
+		`{"stems": {"guitar": {"gain_db": 3}}}`:      http.StatusNotFound,
+		`{"stems": {"mix-karaoke": {"mute": true}}}`: http.StatusNotFound,
+		`{"stems": {"bass": {"gain_db": 40}}}`:       http.StatusBadRequest,
+		`{"format": "ogg"}`:                          http.StatusBadRequest,
+		`{"stems": {"vocals": {"mute": true}, "drums": {"mute": true}, "bass": {"mute": true}, "other": {"mute": true}}}`: http.StatusBadRequest,
+	} {
+		if rec := post(body); rec.Code != want {
+			t.Errorf("mix %s = %d, want %d", body, rec.Code, want)
+		}
+	}
+}
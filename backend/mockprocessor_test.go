@@ -0,0 +1,398 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// mockProcessor imitates the processor's HTTP API (/process, /status/{id},
+// /cancel/{id}) without running Demucs, so dispatch, progress and download
+// flows can be tested end to end. Stems are written to outputDir the way
+// the processor names them. The uploaded file's name picks a scenario:
+//
+//	fail    /process answers 500
+//	garbage /process answers 200 with a body that isn't JSON
+//	hang    /process reports progress, then blocks until /cancel
+//	        (or until the backend gives up on the request)
+//	stuck   like hang, but /cancel doesn't release it
+//	legacy  deterministic and watermarked jobs aren't reported as such, like
+//	        an old processor
+//	mono    the result has a note that the input was upmixed
+//
+// Any other file is separated after Delay, reporting progress meanwhile.
+// A hanging job whose request is dropped keeps running until /cancel, as
+// Demucs does on the processor.
+// Responses list ContentEncodings in Accept-Encoding, and request bodies
+// in one of them are decoded. With a BatchLimit they advertise it in
+// X-Batch-Limit, and /process/batch separates each clip as /process would,
+// a fail clip getting an error result of its own.
+type mockProcessor struct {
+	*httptest.Server
+	Delay time.Duration
+
+	ContentEncodings []string
+	BatchLimit       int
+
+	mu        sync.Mutex
+	status    map[string]jobProgress
+	cancels   map[string]chan struct{}
+	requests  []map[string]string // form fields of each /process call
+	cancelled []string
+	aborted   []string // jobs whose /process request the backend dropped
+}
+
+func newMockProcessor(t *testing.T) *mockProcessor {
+	m := &mockProcessor{
+		Delay:   50 * time.Millisecond,
+		status:  make(map[string]jobProgress),
+		cancels: make(map[string]chan struct{}),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/process", m.process).Methods("POST")
+	router.HandleFunc("/process/batch", m.processBatch).Methods("POST")
+	router.HandleFunc("/status/{id}", m.getStatus).Methods("GET")
+	router.HandleFunc("/cancel/{id}", m.cancel).Methods("POST")
+	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}).Methods("GET")
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		if len(m.ContentEncodings) > 0 {
+			w.Header().Set("Accept-Encoding", strings.Join(m.ContentEncodings, ", "))
+		}
+		if m.BatchLimit > 0 {
+			w.Header().Set("X-Batch-Limit", strconv.Itoa(m.BatchLimit))
+		}
+		m.mu.Unlock()
+		router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		// Release hanging requests so the server can close
+		m.mu.Lock()
+		for id, done := range m.cancels {
+			close(done)
+			delete(m.cancels, id)
+		}
+		m.mu.Unlock()
+		m.Close()
+	})
+	t.Setenv("PROCESSOR_URL", m.URL)
+	return m
+}
+
+func (m *mockProcessor) setStatus(jobID string, p jobProgress) {
+	m.mu.Lock()
+	m.status[jobID] = p
+	m.mu.Unlock()
+}
+
+// Requests returns the form fields of the /process calls so far, and of
+// each clip of /process/batch calls with "batch" set to the clip count
+func (m *mockProcessor) Requests() []map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]map[string]string(nil), m.requests...)
+}
+
+// Cancelled returns the jobs /cancel was called for
+func (m *mockProcessor) Cancelled() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.cancelled...)
+}
+
+// Aborted returns the jobs whose hanging /process request was dropped
+func (m *mockProcessor) Aborted() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.aborted...)
+}
+
+// setContentEncodings changes the request encodings the processor accepts
+func (m *mockProcessor) setContentEncodings(encodings ...string) {
+	m.mu.Lock()
+	m.ContentEncodings = encodings
+	m.mu.Unlock()
+}
+
+// setBatchLimit changes how many clips /process/batch takes; 0 hides it
+func (m *mockProcessor) setBatchLimit(limit int) {
+	m.mu.Lock()
+	m.BatchLimit = limit
+	m.mu.Unlock()
+}
+
+// clipName is the scenario name of an uploaded file
+func clipName(filename string) string {
+	return strings.TrimSuffix(filename[strings.Index(filename, "_")+1:], filepath.Ext(filename))
+}
+
+func (m *mockProcessor) process(w http.ResponseWriter, r *http.Request) {
+	encoding := r.Header.Get("Content-Encoding")
+	if encoding != "" {
+		m.mu.Lock()
+		supported := slices.Contains(m.ContentEncodings, encoding)
+		m.mu.Unlock()
+		if encoding != "gzip" || !supported {
+			writeJSON(w, http.StatusUnsupportedMediaType, map[string]string{"error": "Unsupported Content-Encoding: " + encoding})
+			return
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "No file provided"})
+			return
+		}
+		r.Body = zr
+	}
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "No file provided"})
+		return
+	}
+	_, header, err := r.FormFile("file")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "No file provided"})
+		return
+	}
+	fields := map[string]string{"filename": header.Filename}
+	if encoding != "" {
+		fields["content_encoding"] = encoding
+	}
+	for key, values := range r.MultipartForm.Value {
+		fields[key] = values[0]
+	}
+	jobID := fields["job_id"]
+	done := make(chan struct{})
+	m.mu.Lock()
+	m.requests = append(m.requests, fields)
+	m.cancels[jobID] = done
+	m.mu.Unlock()
+	orphaned := false // the request was dropped, but "Demucs" runs on
+	defer func() {
+		m.mu.Lock()
+		if !orphaned && m.cancels[jobID] == done {
+			delete(m.cancels, jobID)
+		}
+		m.mu.Unlock()
+	}()
+	m.setStatus(jobID, jobProgress{Status: "processing", Progress: 10, Stage: "Loading model"})
+
+	name := clipName(header.Filename)
+	switch name {
+	case "fail":
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Demucs exited with status 1"})
+		return
+	case "garbage":
+		io.WriteString(w, "<html>502 Bad Gateway</html>")
+		return
+	case "hang", "stuck":
+		release := done
+		if name == "stuck" {
+			release = nil
+		}
+		m.setStatus(jobID, jobProgress{Status: "processing", Progress: 50, Stage: "Separating"})
+		select {
+		case <-release:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Cancelled"})
+		case <-r.Context().Done():
+			m.mu.Lock()
+			m.aborted = append(m.aborted, jobID)
+			m.mu.Unlock()
+			orphaned = true
+		}
+		return
+	}
+
+	m.setStatus(jobID, jobProgress{Status: "processing", Progress: 50, Stage: "Separating"})
+	select {
+	case <-time.After(m.Delay):
+	case <-done:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Cancelled"})
+		return
+	}
+
+	outputs := m.writeStems(jobID, name, fields)
+	result := map[string]interface{}{
+		"outputs":         outputs,
+		"processing_time": m.Delay.String(),
+		"environment":     map[string]string{"instance": "mock-processor", "device": "cpu"},
+		"compute":         mockCompute,
+	}
+	if fields["deterministic"] == "true" && name != "legacy" {
+		seed, _ := strconv.Atoi(fields["seed"])
+		shifts, _ := strconv.Atoi(fields["shifts"])
+		result["determinism"] = map[string]int{"seed": seed, "shifts": shifts, "threads": 4}
+	}
+	if fields["watermark"] != "" && name != "legacy" {
+		result["watermark"] = fields["watermark"]
+	}
+	if name == "mono" {
+		result["notes"] = mockMonoNotes
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (m *mockProcessor) processBatch(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "No file provided"})
+		return
+	}
+	files, ids := r.MultipartForm.File["file"], r.MultipartForm.Value["job_id"]
+	if len(files) == 0 || len(files) != len(ids) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Each file needs a job_id"})
+		return
+	}
+	clips := make([]map[string]string, len(files))
+	m.mu.Lock()
+	for i, header := range files {
+		fields := map[string]string{"filename": header.Filename, "batch": strconv.Itoa(len(files))}
+		for key, values := range r.MultipartForm.Value {
+			fields[key] = values[0]
+		}
+		fields["job_id"] = ids[i]
+		clips[i] = fields
+		m.requests = append(m.requests, fields)
+	}
+	m.mu.Unlock()
+	time.Sleep(m.Delay)
+
+	results := make(map[string]interface{}, len(clips))
+	for _, fields := range clips {
+		jobID, name := fields["job_id"], clipName(fields["filename"])
+		if name == "fail" {
+			results[jobID] = map[string]string{"error": "Demucs exited with status 1"}
+			continue
+		}
+		result := map[string]interface{}{"outputs": m.writeStems(jobID, name, fields)}
+		if name == "mono" {
+			result["notes"] = mockMonoNotes
+		}
+		results[jobID] = result
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":          "completed",
+		"results":         results,
+		"processing_time": m.Delay.String(),
+		"environment":     map[string]string{"instance": "mock-processor", "device": "cpu"},
+		"compute":         mockCompute,
+	})
+}
+
+// mockCompute is the Demucs running time the mock reports, per request
+var mockCompute = processorCompute{Device: "cpu", Seconds: 42}
+
+var mockMonoNotes = []map[string]string{{"code": "mono_upmixed", "level": "info", "message": "Mono input was upmixed to stereo"}}
+
+// writeStems writes the stems the processor would make of a job
+func (m *mockProcessor) writeStems(jobID, name string, fields map[string]string) map[string]string {
+	format := fields["output_format"]
+	stems := []string{"vocals", "drums", "bass", "other"}
+	if fields["model"] == "htdemucs_6s" {
+		stems = append(stems, "guitar", "piano")
+	}
+	if fields["stem_mode"] == "isolate" {
+		backing := "backing"
+		if fields["isolate_stem"] == "vocals" {
+			backing = "instrumental"
+		}
+		stems = []string{fields["isolate_stem"], backing}
+	}
+	dir := filepath.Join(outputDir, jobID)
+	os.MkdirAll(dir, 0755)
+	outputs := make(map[string]string, len(stems))
+	for _, stem := range stems {
+		path := filepath.Join(dir, name+"_t2s_"+stem+"."+format)
+		os.WriteFile(path, []byte(stem+" of "+name), 0644)
+		outputs[stem] = path
+	}
+	m.setStatus(jobID, jobProgress{Status: "completed", Progress: 100, Stage: "Done!"})
+	return outputs
+}
+
+func (m *mockProcessor) getStatus(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	p, ok := m.status[mux.Vars(r)["id"]]
+	m.mu.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "unknown", "progress": 0})
+		return
+	}
+	json.NewEncoder(w).Encode(p)
+}
+
+func (m *mockProcessor) cancel(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+	m.mu.Lock()
+	done, ok := m.cancels[jobID]
+	if ok {
+		delete(m.cancels, jobID)
+		close(done)
+		m.cancelled = append(m.cancelled, jobID)
+	}
+	m.mu.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"status": "not_found", "job_id": jobID})
+		return
+	}
+	m.setStatus(jobID, jobProgress{Status: "cancelled", Stage: "Cancelled by user"})
+	writeJSON(w, http.StatusOK, map[string]string{"status": "cancelled", "job_id": jobID})
+}
+
+// integrationBackend serves the full API against a mock processor, with
+// its own storage directories and job queue
+type integrationBackend struct {
+	*httptest.Server
+	t         *testing.T
+	processor *mockProcessor
+}
+
+// integrationListeners registers the event listeners from main() that the
+// flows under test depend on, once per test binary
+var integrationListeners sync.Once
+
+func newIntegrationBackend(t *testing.T, workers int) *integrationBackend {
+	integrationListeners.Do(func() { onEvent(forgetProcessorStatus) })
+	oldUploadDir, oldOutputDir, oldQueue, oldPoll := uploadDir, outputDir, processingQueue, progressPollInterval
+	uploadDir, outputDir = t.TempDir(), t.TempDir()
+	processingQueue, progressPollInterval = newJobQueue(), 10*time.Millisecond
+	processingQueue.start(workers, runQueuedJob)
+	jobsMutex.RLock()
+	existing := make(map[string]bool, len(jobs))
+	for id := range jobs {
+		existing[id] = true
+	}
+	jobsMutex.RUnlock()
+
+	b := &integrationBackend{t: t, processor: newMockProcessor(t)}
+	b.Server = httptest.NewServer(newRouter())
+	t.Cleanup(func() {
+		b.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		processingQueue.drain(ctx)
+		progressFeedsMutex.Lock() // after any progress poller's read
+		uploadDir, outputDir, processingQueue, progressPollInterval = oldUploadDir, oldOutputDir, oldQueue, oldPoll
+		progressFeedsMutex.Unlock()
+		jobsMutex.Lock()
+		for id := range jobs {
+			if !existing[id] {
+				delete(jobs, id)
+			}
+		}
+		jobsMutex.Unlock()
+	})
+	return b
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Model assets. Each processor keeps Demucs weights in its own cache, so
+// instead of logging into GPU boxes to manage them, GET /api/admin/models
+// asks every processor (the PROCESSORS instances, or else PROCESSOR_URL
+// and CANARY_PROCESSOR_URL) which models it has and at which version, the
+// checksums of the weight files. POST /api/admin/models/{name}/download
+// makes them fetch a model in the background, or with {"force": true}
+// fetch it again; {"processors": [...]} limits it to some instances. The
+// last inventory each processor reported is kept, so one that is down
+// still shows what it had, and version changes are logged.
+
+// modelAsset is one model as a processor reports it
+type modelAsset struct {
+	Name      string         `json:"name"`
+	Installed bool           `json:"installed"`
+	Version   string         `json:"version,omitempty"`
+	SizeBytes int64          `json:"size_bytes,omitempty"`
+	Download  *modelDownload `json:"download,omitempty"` // the latest download on that processor
+}
+
+// modelDownload is a background download on a processor
+type modelDownload struct {
+	Status     string `json:"status"` // downloading, completed or failed
+	Error      string `json:"error,omitempty"`
+	StartedAt  string `json:"started_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+}
+
+// processorModels is the inventory of one processor
+type processorModels struct {
+	URL           string       `json:"url"`
+	DemucsVersion string       `json:"demucs_version,omitempty"`
+	Models        []modelAsset `json:"models"`
+	CheckedAt     *time.Time   `json:"checked_at,omitempty"` // last successful read
+	Error         string       `json:"error,omitempty"`      // why the latest read failed
+}
+
+// modelSummary is one model across processors
+type modelSummary struct {
+	Name      string   `json:"name"`
+	Stems     int      `json:"stems"`
+	Installed int      `json:"installed"` // processors that have it
+	Versions  []string `json:"versions"`  // more than one: processors disagree
+}
+
+// ModelList is the GET /api/admin/models response
+type ModelList struct {
+	Models     []modelSummary    `json:"models"`
+	Processors []processorModels `json:"processors"`
+}
+
+var (
+	modelInventory      = make(map[string]*processorModels)
+	modelInventoryMutex = &sync.Mutex{}
+)
+
+// modelProcessors are the processors whose models are managed
+func modelProcessors() []string {
+	var urls []string
+	for _, p := range registeredProcessors() {
+		urls = append(urls, p.URL)
+	}
+	if len(urls) > 0 {
+		return urls
+	}
+	urls = append(urls, processorURLFor(variantStable))
+	if canary := os.Getenv("CANARY_PROCESSOR_URL"); canary != "" && canary != urls[0] {
+		urls = append(urls, canary)
+	}
+	return urls
+}
+
+// processorSupports reports whether a registered processor may run model;
+// processors outside the registry run any model
+func processorSupports(processorURL, model string) bool {
+	for _, p := range registeredProcessors() {
+		if p.URL == processorURL {
+			return p.supports(model)
+		}
+	}
+	return true
+}
+
+// fetchProcessorModels reads a processor's GET /models
+func fetchProcessorModels(client *http.Client, processorURL string) (processorModels, error) {
+	inv := processorModels{URL: processorURL}
+	resp, err := client.Get(processorURL + "/models")
+	if err != nil {
+		return inv, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return inv, fmt.Errorf("/models returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&inv); err != nil {
+		return inv, fmt.Errorf("invalid /models response: %v", err)
+	}
+	inv.URL = processorURL
+	return inv, nil
+}
+
+// refreshModelInventory reads every processor's models, in parallel, and
+// returns the inventories in modelProcessors order
+func refreshModelInventory() []processorModels {
+	urls := modelProcessors()
+	results := make([]processorModels, len(urls))
+	errs := make([]error, len(urls))
+	client := newProcessorClient(10 * time.Second)
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = fetchProcessorModels(client, u)
+		}()
+	}
+	wg.Wait()
+
+	now := time.Now().UTC()
+	modelInventoryMutex.Lock()
+	defer modelInventoryMutex.Unlock()
+	for i, u := range urls {
+		last := modelInventory[u]
+		if errs[i] != nil {
+			if last == nil {
+				last = &processorModels{URL: u, Models: []modelAsset{}}
+				modelInventory[u] = last
+			}
+			last.Error = errs[i].Error()
+			results[i] = *last
+			continue
+		}
+		if last != nil {
+			logModelChanges(u, last.Models, results[i].Models)
+		}
+		results[i].CheckedAt = &now
+		if results[i].Models == nil {
+			results[i].Models = []modelAsset{}
+		}
+		inv := results[i]
+		modelInventory[u] = &inv
+	}
+	return results
+}
+
+// logModelChanges logs models whose installed version changed on a processor
+func logModelChanges(processorURL string, before, after []modelAsset) {
+	old := make(map[string]string, len(before))
+	for _, m := range before {
+		old[m.Name] = m.Version
+	}
+	for _, m := range after {
+		if v, seen := old[m.Name]; seen && v != m.Version {
+			log.Printf("Processor %s: model %s changed from %q to %q", processorURL, m.Name, v, m.Version)
+		}
+	}
+}
+
+// summarizeModels lists every allowed model with its state across processors
+func summarizeModels(inventories []processorModels) []modelSummary {
+	var list []modelSummary
+	for _, name := range modelNames() {
+		s := modelSummary{Name: name, Stems: len(modelStems(name)), Versions: []string{}}
+		for _, inv := range inventories {
+			for _, m := range inv.Models {
+				if m.Name != name || !m.Installed {
+					continue
+				}
+				s.Installed++
+				if !slices.Contains(s.Versions, m.Version) {
+					s.Versions = append(s.Versions, m.Version)
+				}
+			}
+		}
+		slices.Sort(s.Versions)
+		list = append(list, s)
+	}
+	return list
+}
+
+// listModelsHandler serves GET /api/admin/models
+func listModelsHandler(w http.ResponseWriter, r *http.Request) {
+	inventories := refreshModelInventory()
+	writeJSON(w, http.StatusOK, ModelList{Models: summarizeModels(inventories), Processors: inventories})
+}
+
+// modelDownloadResult is one processor's answer to a download request
+type modelDownloadResult struct {
+	URL    string `json:"url"`
+	Status string `json:"status"` // downloading or failed
+	Error  string `json:"error,omitempty"`
+}
+
+// downloadModelHandler serves POST /api/admin/models/{name}/download
+func downloadModelHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !isAllowedModel(name) {
+		http.Error(w, invalidOption("model", modelNames()).Error(), http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Processors []string `json:"processors"`
+		Force      bool     `json:"force"`
+	}
+	// The body is optional: no body downloads to every processor
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	known := modelProcessors()
+	targets := req.Processors
+	if len(targets) == 0 {
+		for _, u := range known {
+			if processorSupports(u, name) {
+				targets = append(targets, u)
+			}
+		}
+	}
+	for _, u := range targets {
+		if !slices.Contains(known, u) {
+			http.Error(w, "Unknown processor: "+u, http.StatusBadRequest)
+			return
+		}
+	}
+	if len(targets) == 0 {
+		http.Error(w, "No processor runs model "+name, http.StatusBadRequest)
+		return
+	}
+
+	client := newProcessorClient(30 * time.Second)
+	results := make([]modelDownloadResult, len(targets))
+	var wg sync.WaitGroup
+	for i, u := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = requestModelDownload(client, u, name, req.Force)
+		}()
+	}
+	wg.Wait()
+	for _, res := range results {
+		if res.Status == "downloading" {
+			log.Printf("Processor %s is downloading model %s", res.URL, name)
+		}
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"model": name, "force": req.Force, "processors": results})
+}
+
+// requestModelDownload asks one processor to download a model
+func requestModelDownload(client *http.Client, processorURL, name string, force bool) modelDownloadResult {
+	res := modelDownloadResult{URL: processorURL, Status: "failed"}
+	target := processorURL + "/models/" + url.PathEscape(name) + "/download"
+	if force {
+		target += "?force=true"
+	}
+	resp, err := client.Post(target, "application/json", bytes.NewReader(nil))
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusAccepted {
+		var reply struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &reply) != nil || reply.Error == "" {
+			reply.Error = fmt.Sprintf("download returned %s", resp.Status)
+		}
+		res.Error = reply.Error
+		return res
+	}
+	res.Status = "downloading"
+	return res
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// fakeModelProcessor serves /models from inventory and records downloads
+type fakeModelProcessor struct {
+	*httptest.Server
+	mu        sync.Mutex
+	inventory string
+	downloads []string // model?force
+}
+
+func newFakeModelProcessor(t *testing.T, inventory string) *fakeModelProcessor {
+	f := &fakeModelProcessor{inventory: inventory}
+	router := mux.NewRouter()
+	router.HandleFunc("/models", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.inventory == "" {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(f.inventory))
+	})
+	router.HandleFunc("/models/{name}/download", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		name := mux.Vars(r)["name"]
+		if name == "mdx" {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "Model mdx is already downloading"})
+			return
+		}
+		f.downloads = append(f.downloads, name+"?"+r.URL.RawQuery)
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "downloading"})
+	}).Methods("POST")
+	f.Server = httptest.NewServer(router)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestModelInventory(t *testing.T) {
+	gpu := newFakeModelProcessor(t, `{"demucs_version": "4.0.1", "models": [
+		{"name": "htdemucs", "installed": true, "version": "955717e8-8726e21a", "size_bytes": 84000000},
+		{"name": "htdemucs_6s", "installed": true, "version": "5c90dfd2-34c22ccb"}]}`)
+	cpu := newFakeModelProcessor(t, `{"models": [{"name": "htdemucs", "installed": true, "version": "955717e8-00000000"}]}`)
+	useProcessors(t, []*processorInstance{{URL: gpu.URL, Healthy: true}, {URL: cpu.URL, Healthy: true, Models: []string{"htdemucs"}}})
+	t.Cleanup(func() {
+		modelInventoryMutex.Lock()
+		delete(modelInventory, gpu.URL)
+		delete(modelInventory, cpu.URL)
+		modelInventoryMutex.Unlock()
+	})
+
+	list := func() ModelList {
+		rec := httptest.NewRecorder()
+		listModelsHandler(rec, httptest.NewRequest("GET", "/api/admin/models", nil))
+		var l ModelList
+		json.Unmarshal(rec.Body.Bytes(), &l)
+		return l
+	}
+	l := list()
+	byName := map[string]modelSummary{}
+	for _, m := range l.Models {
+		byName[m.Name] = m
+	}
+	if len(l.Models) != len(allowedModels) || len(l.Processors) != 2 || l.Processors[0].DemucsVersion != "4.0.1" {
+		t.Fatalf("list = %+v", l)
+	}
+	if m := byName["htdemucs"]; m.Installed != 2 || len(m.Versions) != 2 {
+		t.Errorf("htdemucs = %+v, want on both processors at different versions", m)
+	}
+	if m := byName["htdemucs_6s"]; m.Installed != 1 || m.Stems != 6 {
+		t.Errorf("htdemucs_6s = %+v", m)
+	}
+	if m := byName["mdx"]; m.Installed != 0 || len(m.Versions) != 0 {
+		t.Errorf("mdx = %+v", m)
+	}
+
+	// A processor that stops answering keeps its last inventory
+	cpu.mu.Lock()
+	cpu.inventory = ""
+	cpu.mu.Unlock()
+	l = list()
+	if p := l.Processors[1]; p.Error == "" || len(p.Models) != 1 || p.CheckedAt == nil {
+		t.Errorf("unreachable processor = %+v", p)
+	}
+}
+
+func TestDownloadModel(t *testing.T) {
+	gpu := newFakeModelProcessor(t, `{"models": []}`)
+	cpu := newFakeModelProcessor(t, `{"models": []}`)
+	useProcessors(t, []*processorInstance{{URL: gpu.URL, Healthy: true}, {URL: cpu.URL, Healthy: true, Models: []string{"htdemucs"}}})
+
+	download := func(name, body string) (int, string) {
+		req := httptest.NewRequest("POST", "/api/admin/models/"+name+"/download", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"name": name})
+		rec := httptest.NewRecorder()
+		downloadModelHandler(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	// Only processors that run the model are asked by default
+	if code, body := download("htdemucs_ft", ""); code != http.StatusAccepted || !strings.Contains(body, `"status":"downloading"`) {
+		t.Errorf("download = %d %s", code, body)
+	}
+	if code, _ := download("htdemucs", `{"processors": ["`+cpu.URL+`"], "force": true}`); code != http.StatusAccepted {
+		t.Errorf("forced download = %d", code)
+	}
+	if len(gpu.downloads) != 1 || gpu.downloads[0] != "htdemucs_ft?" || len(cpu.downloads) != 1 || cpu.downloads[0] != "htdemucs?force=true" {
+		t.Errorf("downloads: gpu %v, cpu %v", gpu.downloads, cpu.downloads)
+	}
+
+	var reply struct {
+		Processors []modelDownloadResult `json:"processors"`
+	}
+	_, body := download("mdx", "")
+	json.Unmarshal([]byte(body), &reply)
+	if len(reply.Processors) != 1 || reply.Processors[0].Status != "failed" || !strings.Contains(reply.Processors[0].Error, "already downloading") {
+		t.Errorf("busy processor = %s", body)
+	}
+
+	for _, bad := range []struct{ name, body string }{
+		{"whisper", ""},
+		{"htdemucs", `{"processors": ["http://elsewhere:5000"]}`},
+		{"htdemucs", `{"force": "yes"}`},
+	} {
+		if code, _ := download(bad.name, bad.body); code != http.StatusBadRequest {
+			t.Errorf("download %s %s = %d, want 400", bad.name, bad.body, code)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Job notes. A processor (or external worker) can attach notes to its
+// result explaining output that may surprise: "mono input upmixed", "the
+// vocals stem reached full scale and was turned down". They are kept on
+// the job as notes, each with a machine-readable code, a message and the
+// stem it concerns, and travel with stems reused for identical uploads.
+// Whatever the processor sends is trimmed to maxJobNotes notes of short,
+// plain fields, since it ends up in every job response.
+
+const (
+	maxJobNotes       = 20
+	maxJobNoteMessage = 300
+)
+
+// JobNote is a processor's remark on a job's result
+type JobNote struct {
+	Code    string `json:"code"`           // e.g. mono_upmixed, clipping_rescaled
+	Level   string `json:"level"`          // info or warning
+	Message string `json:"message"`        // for people
+	Stem    string `json:"stem,omitempty"` // empty: the whole job
+}
+
+// noteCode keeps a code to lowercase letters, digits and underscores
+func noteCode(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		case r == '-' || r == ' ' || r == '.':
+			return '_'
+		}
+		return -1
+	}, s)
+	return s[:min(len(s), 64)]
+}
+
+// parseJobNotes reads the notes of a processor result, a JSON array of
+// objects, dropping the ones without a message
+func parseJobNotes(v interface{}) []JobNote {
+	if s, ok := v.(string); ok {
+		// Workers send them as a form field
+		if json.Unmarshal([]byte(s), &v) != nil {
+			return nil
+		}
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var received []JobNote
+	if json.Unmarshal(raw, &received) != nil {
+		return nil
+	}
+	var notes []JobNote
+	for _, n := range received {
+		message := strings.Join(strings.Fields(n.Message), " ")
+		if message == "" {
+			continue
+		}
+		if r := []rune(message); len(r) > maxJobNoteMessage {
+			message = string(r[:maxJobNoteMessage])
+		}
+		if n.Level != "info" {
+			n.Level = "warning"
+		}
+		n.Code = noteCode(n.Code)
+		if n.Code == "" {
+			n.Code = "note"
+		}
+		n.Message = message
+		n.Stem = noteCode(n.Stem)
+		if notes = append(notes, n); len(notes) == maxJobNotes {
+			break
+		}
+	}
+	return notes
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseJobNotes(t *testing.T) {
+	notes := parseJobNotes([]interface{}{
+		map[string]interface{}{"code": "Clipping-Rescaled", "level": "info", "message": " The vocals\nstem was turned down ", "stem": "vocals"},
+		map[string]interface{}{"code": "odd", "level": "fatal", "message": "Unknown level"},
+		map[string]interface{}{"code": "empty"},
+	})
+	if len(notes) != 2 {
+		t.Fatalf("notes = %+v", notes)
+	}
+	if n := notes[0]; n.Code != "clipping_rescaled" || n.Level != "info" || n.Message != "The vocals stem was turned down" || n.Stem != "vocals" {
+		t.Errorf("first note = %+v", n)
+	}
+	if notes[1].Level != "warning" {
+		t.Errorf("unknown level = %q, want warning", notes[1].Level)
+	}
+
+	// Workers send them as a form field; anything malformed is ignored
+	if notes := parseJobNotes(`[{"code": "resampled", "message": "` + strings.Repeat("x", 500) + `"}]`); len(notes) != 1 || len(notes[0].Message) != maxJobNoteMessage {
+		t.Errorf("notes from a form field = %+v", notes)
+	}
+	for _, bad := range []interface{}{nil, "not json", map[string]interface{}{"code": "x"}, []interface{}{"text"}} {
+		if notes := parseJobNotes(bad); notes != nil {
+			t.Errorf("parseJobNotes(%v) = %+v", bad, notes)
+		}
+	}
+	many := make([]interface{}, 30)
+	for i := range many {
+		many[i] = map[string]interface{}{"message": "note"}
+	}
+	if notes := parseJobNotes(many); len(notes) != maxJobNotes || notes[0].Code != "note" {
+		t.Errorf("%d notes kept of 30", len(notes))
+	}
+}
+
+func TestIntegrationJobNotes(t *testing.T) {
+	b := newIntegrationBackend(t, 1)
+	job := b.waitFor(b.upload("mono.mp3", nil).ID, "completed")
+	if len(job.Notes) != 1 || job.Notes[0].Code != "mono_upmixed" || job.Notes[0].Level != "info" {
+		t.Errorf("notes = %+v", job.Notes)
+	}
+	if job := b.waitFor(b.upload("song.mp3", nil).ID, "completed"); job.Notes != nil {
+		t.Errorf("notes without any from the processor = %+v", job.Notes)
+	}
+}
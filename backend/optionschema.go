@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Option schema. Every way of creating a job (uploads, batches, chunked
+// uploads, stream ingest) is checked against the fields it knows. A field
+// it doesn't know, or an option that has no effect with the others (say
+// isolate_stem with stem_mode all), is recorded in the job's
+// effective_options.ignored with the reason; with ?strict=true (a form
+// field also works for uploads) or STRICT_JOB_OPTIONS=true the request is
+// refused with a 400 instead. effective_options echoes the options a job
+// runs with once defaults are applied.
+
+// jobOptionFields are the fields parseJobOptions reads
+var jobOptionFields = []string{
+	"stem_mode", "isolate_stem", "output_format", "model", "segment", "overlap",
+	"shifts", "clip_mode", "mp3_bitrate", "extra_formats", "deterministic", "seed", "force", "callback_url", "callback_secret",
+	"pipeline", "advanced_options", "encrypted", "sealed_key", "preset",
+	"template", "org",
+}
+
+// requestFields are form fields accepted on every upload besides the options
+var requestFields = []string{"strict", "api_key"}
+
+// unknownOption is the ignored reason of a field outside the schema
+const unknownOption = "unknown option"
+
+// defaultOverlap is the overlap Demucs uses when none is given
+const defaultOverlap = "0.25"
+
+// EffectiveOptions are the options a job runs with once defaults are applied
+type EffectiveOptions struct {
+	StemMode      string            `json:"stem_mode"`
+	IsolateStem   string            `json:"isolate_stem,omitempty"` // stem_mode isolate only
+	OutputFormat  string            `json:"output_format"`
+	MP3Bitrate    string            `json:"mp3_bitrate,omitempty"` // mp3 output only
+	ExtraFormats  []string          `json:"extra_formats,omitempty"`
+	Advanced      map[string]string `json:"advanced_options,omitempty"`
+	Model         string            `json:"model"`
+	Segment       string            `json:"segment,omitempty"` // unset: the model's own segment length
+	Overlap       string            `json:"overlap"`
+	Shifts        string            `json:"shifts"`
+	ClipMode      string            `json:"clip_mode"`
+	Deterministic bool              `json:"deterministic"`
+	Seed          string            `json:"seed,omitempty"` // deterministic only
+	Encrypted     bool              `json:"encrypted,omitempty"`
+	Preset        string            `json:"preset,omitempty"`
+	Force         bool              `json:"force"`
+	Ignored       map[string]string `json:"ignored,omitempty"` // field -> why it had no effect
+}
+
+// strictOptions reports whether a request refuses unknown and ineffective
+// options. Callers of multipart requests parse the form first.
+func strictOptions(r *http.Request) bool {
+	if v := r.FormValue("strict"); v != "" {
+		return v == "true"
+	}
+	return os.Getenv("STRICT_JOB_OPTIONS") == "true"
+}
+
+// formFields are the form and query fields of an upload with the extra
+// file fields
+func formFields(extra ...string) []string {
+	return slices.Concat(jobOptionFields, requestFields, extra)
+}
+
+// formFieldNames lists the form and query fields of a parsed request
+func formFieldNames(r *http.Request) []string {
+	names := slices.Collect(maps.Keys(r.Form))
+	if r.MultipartForm != nil {
+		names = slices.AppendSeq(names, maps.Keys(r.MultipartForm.File))
+	}
+	return names
+}
+
+// decodeJobRequest decodes a JSON job request into v and returns the
+// fields of the body
+func decodeJobRequest(r *http.Request, v interface{}) ([]string, error) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	return slices.Collect(maps.Keys(fields)), nil
+}
+
+// jsonFieldNames are the JSON names of the struct v points to
+func jsonFieldNames(v interface{}) []string {
+	t := reflect.TypeOf(v).Elem()
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// checkFields records the given fields outside known as ignored, and in
+// strict mode refuses the request when any field was ignored
+func (o *jobOptions) checkFields(names, known []string, strict bool) error {
+	var unknown []string
+	for _, name := range names {
+		if !slices.Contains(known, name) {
+			unknown = append(unknown, name)
+			o.ignore(name, unknownOption)
+		}
+	}
+	if !strict || len(o.Ignored) == 0 {
+		return nil
+	}
+	var problems []string
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		problems = append(problems, fmt.Sprintf("Unknown option %s (known: %s)", strings.Join(unknown, ", "), strings.Join(slices.Sorted(slices.Values(known)), ", ")))
+	}
+	for _, name := range sortedKeys(o.Ignored) {
+		if o.Ignored[name] != unknownOption {
+			problems = append(problems, name+" has no effect: "+o.Ignored[name])
+		}
+	}
+	return fmt.Errorf("%s", strings.Join(problems, "; "))
+}
+
+// ignore records that a given option has no effect
+func (o *jobOptions) ignore(name, reason string) {
+	if o.Ignored == nil {
+		o.Ignored = map[string]string{}
+	}
+	o.Ignored[name] = reason
+}
+
+// effectiveOptions resolves the options the job runs with
+func (j *Job) effectiveOptions() *EffectiveOptions {
+	e := &EffectiveOptions{
+		StemMode:      j.StemMode,
+		OutputFormat:  j.OutputFormat,
+		MP3Bitrate:    j.MP3Bitrate,
+		ExtraFormats:  j.ExtraFormats,
+		Advanced:      maps.Clone(j.AdvancedOptions),
+		Model:         j.Model,
+		Segment:       j.Segment,
+		Overlap:       j.Overlap,
+		Shifts:        j.Shifts,
+		ClipMode:      j.ClipMode,
+		Deterministic: j.Deterministic,
+		Seed:          j.Seed,
+		Encrypted:     j.Encrypted,
+		Preset:        j.Preset,
+		Force:         j.force,
+		Ignored:       maps.Clone(j.ignoredOptions),
+	}
+	if j.StemMode == "isolate" {
+		e.IsolateStem = j.IsolateStem
+	}
+	if e.Overlap == "" {
+		e.Overlap = defaultOverlap
+	}
+	return e
+}
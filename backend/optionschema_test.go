@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postOptions uploads a small file with the given form fields
+func postOptions(t *testing.T, query string, fields map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "song.mp3")
+	part.Write([]byte("ID3 options"))
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	mw.Close()
+	req := httptest.NewRequest("POST", "/api/upload"+query, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	uploadHandler(rec, req)
+	if rec.Code == http.StatusOK {
+		var j Job
+		json.Unmarshal(rec.Body.Bytes(), &j)
+		t.Cleanup(func() {
+			jobsMutex.Lock()
+			delete(jobs, j.ID)
+			jobsMutex.Unlock()
+		})
+	}
+	return rec
+}
+
+func TestUploadEchoesEffectiveOptions(t *testing.T) {
+	oldUploadDir, oldOutputDir := uploadDir, outputDir
+	uploadDir, outputDir = t.TempDir(), t.TempDir()
+	externalWorkers = true
+	t.Cleanup(func() { uploadDir, outputDir, externalWorkers = oldUploadDir, oldOutputDir, false })
+
+	rec := postOptions(t, "", map[string]string{"stem_mode": "all", "isolate_stem": "drums", "bitrate": "128"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload = %d: %s", rec.Code, rec.Body.String())
+	}
+	var j Job
+	json.Unmarshal(rec.Body.Bytes(), &j)
+	e := j.Effective
+	if e == nil {
+		t.Fatalf("response has no effective_options: %s", rec.Body.String())
+	}
+	if e.StemMode != "all" || e.IsolateStem != "" || e.Model != "htdemucs_6s" || e.MP3Bitrate != "320" || e.Overlap != defaultOverlap || e.Shifts != "0" {
+		t.Errorf("effective_options = %+v", e)
+	}
+	want := map[string]string{"isolate_stem": "only applies to stem_mode isolate", "bitrate": unknownOption}
+	if len(e.Ignored) != len(want) || e.Ignored["isolate_stem"] != want["isolate_stem"] || e.Ignored["bitrate"] != want["bitrate"] {
+		t.Errorf("ignored = %v, want %v", e.Ignored, want)
+	}
+
+	// Options that are all used leave nothing ignored
+	rec = postOptions(t, "?strict=true", map[string]string{"stem_mode": "isolate", "isolate_stem": "drums", "output_format": "wav"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("strict upload = %d: %s", rec.Code, rec.Body.String())
+	}
+	var strict Job
+	json.Unmarshal(rec.Body.Bytes(), &strict)
+	if e := strict.Effective; e.IsolateStem != "drums" || e.MP3Bitrate != "" || len(e.Ignored) != 0 {
+		t.Errorf("effective_options = %+v", e)
+	}
+}
+
+func TestStrictOptionsRejectUnknownFields(t *testing.T) {
+	oldUploadDir, oldOutputDir := uploadDir, outputDir
+	uploadDir, outputDir = t.TempDir(), t.TempDir()
+	externalWorkers = true
+	t.Cleanup(func() { uploadDir, outputDir, externalWorkers = oldUploadDir, oldOutputDir, false })
+
+	rec := postOptions(t, "?strict=true", map[string]string{"bitrate": "128", "isolate_stem": "drums"})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("strict upload = %d, want 400", rec.Code)
+	}
+	if msg := rec.Body.String(); !strings.Contains(msg, "Unknown option bitrate (known: advanced_options, api_key, callback_secret") || !strings.Contains(msg, "isolate_stem has no effect") {
+		t.Errorf("strict error = %q", msg)
+	}
+
+	t.Setenv("STRICT_JOB_OPTIONS", "true")
+	if rec := postOptions(t, "", map[string]string{"force": "yes"}); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "force has no effect") {
+		t.Errorf("upload with STRICT_JOB_OPTIONS = %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := postOptions(t, "?strict=false", map[string]string{"force": "yes"}); rec.Code != http.StatusOK {
+		t.Errorf("upload with strict=false = %d: %s", rec.Code, rec.Body.String())
+	}
+	// The form field works like the query parameter
+	if rec := postOptions(t, "", map[string]string{"strict": "false", "extra": "1"}); rec.Code != http.StatusOK {
+		t.Errorf("upload with a strict=false field = %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStrictOptionsInJSONRequests(t *testing.T) {
+	oldUploadDir := uploadDir
+	uploadDir = t.TempDir()
+	t.Cleanup(func() {
+		uploadDir = oldUploadDir
+		partialUploadsMutex.Lock()
+		partialUploads = make(map[string]*PartialUpload)
+		partialUploadsMutex.Unlock()
+	})
+
+	start := func(query, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		initUploadHandler(rec, httptest.NewRequest("POST", "/api/upload/init"+query, strings.NewReader(body)))
+		return rec
+	}
+	body := `{"filename": "song.mp3", "size": 10, "model": "htdemucs", "force": "true"}`
+	if rec := start("?strict=true", body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Unknown option force") {
+		t.Errorf("strict init = %d: %s", rec.Code, rec.Body.String())
+	}
+	rec := start("", body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("init = %d: %s", rec.Code, rec.Body.String())
+	}
+	var u PartialUpload
+	json.Unmarshal(rec.Body.Bytes(), &u)
+	if u.Ignored["force"] != unknownOption {
+		t.Errorf("ignored = %v, want force (complete takes ?force=true)", u.Ignored)
+	}
+}
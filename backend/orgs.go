@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Organizations are shared workspaces of API keys. An admin creates one
+// (POST /api/admin/orgs) and adds keys to it, each with a role:
+//
+//	owner   manages the members and every job of the organization
+//	member  adds jobs to the organization and manages them
+//	viewer  sees and downloads the organization's jobs
+//
+// A job created with org=<id> (a field like the separation options, on
+// uploads, batches, chunked uploads and stream ingest) belongs to the
+// organization: every member sees it in GET /api/jobs (?org=<id> lists only
+// those) and on every job route, viewers read-only. Its processing minutes
+// count against the organization's monthly_minutes as well as the key's
+// own quota, and GET /api/orgs/{id}/usage aggregates them by month and key
+// for billing. Keys list their organizations at GET /api/orgs; owners add
+// and remove members with PUT and DELETE /api/orgs/{id}/members/{key_id}.
+// Requests without a key act as owners of every organization, as they see
+// every job.
+//
+// Organizations are stored in ORGS_FILE (default .orgs.json in the upload
+// directory) together with their usage.
+
+const (
+	orgOwner  = "owner"
+	orgMember = "member"
+	orgViewer = "viewer"
+)
+
+var orgRoles = map[string]bool{orgOwner: true, orgMember: true, orgViewer: true}
+
+// Organization is a workspace shared by its member keys
+type Organization struct {
+	ID             string                        `json:"id"`
+	Name           string                        `json:"name"`
+	MonthlyMinutes float64                       `json:"monthly_minutes"` // processing minutes per month, 0 for unlimited
+	Members        map[string]string             `json:"members"`         // API key ID -> role
+	CreatedAt      time.Time                     `json:"created_at"`
+	Usage          map[string]map[string]float64 `json:"usage"` // processing minutes by month (2006-01) and key
+}
+
+// orgView is an organization as returned by the API
+type orgView struct {
+	ID             string          `json:"id"`
+	Name           string          `json:"name"`
+	MonthlyMinutes float64         `json:"monthly_minutes"`
+	Members        []orgMemberView `json:"members"`
+	CreatedAt      time.Time       `json:"created_at"`
+	Month          string          `json:"month"`
+	MinutesUsed    float64         `json:"minutes_used"`
+	Role           string          `json:"role,omitempty"` // the requesting key's
+}
+
+type orgMemberView struct {
+	KeyID string `json:"key_id"`
+	Name  string `json:"name,omitempty"`
+	Role  string `json:"role"`
+}
+
+// orgUsageMonth is one month of GET /api/orgs/{id}/usage
+type orgUsageMonth struct {
+	Month   string             `json:"month"`
+	Minutes float64            `json:"minutes"`
+	Keys    map[string]float64 `json:"keys"` // by key ID; "" for jobs created without a key
+}
+
+var (
+	orgs      = make(map[string]*Organization) // by ID
+	orgsMutex = &sync.Mutex{}
+	// orgJobStarts holds when each organization job started processing
+	orgJobStarts = make(map[string]time.Time)
+)
+
+func init() { keepInUploads(orgsFile) }
+
+func orgsFile() string {
+	if path := os.Getenv("ORGS_FILE"); path != "" {
+		return path
+	}
+	return filepath.Join(uploadDir, ".orgs.json")
+}
+
+// loadOrgs restores the organizations saved by saveOrgs
+func loadOrgs() {
+	data, err := os.ReadFile(orgsFile())
+	if err != nil {
+		return
+	}
+	var list []*Organization
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Failed to load organizations: %v", err)
+		return
+	}
+	orgsMutex.Lock()
+	for _, org := range list {
+		orgs[org.ID] = org
+	}
+	orgsMutex.Unlock()
+	log.Printf("Loaded %d organizations", len(list))
+}
+
+// saveOrgs writes every organization to the file. Callers hold orgsMutex.
+func saveOrgs() {
+	list := make([]*Organization, 0, len(orgs))
+	for _, id := range sortedKeys(orgs) {
+		list = append(list, orgs[id])
+	}
+	data, _ := json.MarshalIndent(list, "", "  ")
+	tmp := orgsFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Failed to save organizations: %v", err)
+		return
+	}
+	os.Rename(tmp, orgsFile())
+}
+
+// minutesUsed is the organization's processing time in a month
+func (o *Organization) minutesUsed(month string) float64 {
+	var total float64
+	for _, minutes := range o.Usage[month] {
+		total += minutes
+	}
+	return total
+}
+
+// role is the key's role in the organization, owner for requests without
+// a key and "" for keys outside it
+func (o *Organization) role(keyID string) string {
+	if keyID == "" {
+		return orgOwner
+	}
+	return o.Members[keyID]
+}
+
+// owners counts the organization's owners
+func (o *Organization) owners() int {
+	n := 0
+	for _, role := range o.Members {
+		if role == orgOwner {
+			n++
+		}
+	}
+	return n
+}
+
+// orgRole is the role of the request's key in an organization, "" when it
+// isn't a member or the organization doesn't exist
+func orgRole(ctx context.Context, orgID string) string {
+	if orgID == "" {
+		return ""
+	}
+	orgsMutex.Lock()
+	defer orgsMutex.Unlock()
+	org, exists := orgs[orgID]
+	if !exists {
+		return ""
+	}
+	return org.role(apiKeyID(ctx))
+}
+
+// checkOrg refuses jobs for an organization the key can't add to, or that
+// has used its processing minutes for the month
+func checkOrg(ctx context.Context, orgID string) *uploadError {
+	if orgID == "" {
+		return nil
+	}
+	remedy := &Remediation{Action: remedyContact, Field: "org", Hint: "Ask an owner of the organization for access, or upload without org", URL: supportURL()}
+	orgsMutex.Lock()
+	defer orgsMutex.Unlock()
+	org, exists := orgs[orgID]
+	if !exists || org.role(apiKeyID(ctx)) == "" {
+		return &uploadError{Status: http.StatusForbidden, Message: "Not a member of organization " + orgID, Code: "org_forbidden", Remediation: remedy}
+	}
+	if org.role(apiKeyID(ctx)) == orgViewer {
+		return &uploadError{Status: http.StatusForbidden, Message: "Viewers can't add jobs to the organization", Code: "org_forbidden", Remediation: remedy}
+	}
+	now := time.Now()
+	if org.MonthlyMinutes > 0 && org.minutesUsed(usageMonth(now)) >= org.MonthlyMinutes {
+		return &uploadError{Status: http.StatusTooManyRequests, Message: "Organization monthly processing quota exceeded", Code: "quota_exceeded", Remediation: quotaRemedy(now)}
+	}
+	return nil
+}
+
+// trackOrgUsage adds the processing time of organization jobs to the
+// organization's usage, by month and key
+func trackOrgUsage(e Event) {
+	if e.Job.OrgID == "" {
+		return
+	}
+	orgsMutex.Lock()
+	defer orgsMutex.Unlock()
+	switch e.Type {
+	case EventJobProcessing:
+		orgJobStarts[e.Job.ID] = e.CreatedAt
+	case EventJobCompleted, EventJobFailed, EventJobDeleted:
+		started, ok := orgJobStarts[e.Job.ID]
+		if !ok {
+			return
+		}
+		delete(orgJobStarts, e.Job.ID)
+		org, exists := orgs[e.Job.OrgID]
+		if !exists {
+			return
+		}
+		month := usageMonth(e.CreatedAt)
+		if org.Usage == nil {
+			org.Usage = make(map[string]map[string]float64)
+		}
+		if org.Usage[month] == nil {
+			org.Usage[month] = make(map[string]float64)
+		}
+		org.Usage[month][e.Job.APIKeyID] += e.CreatedAt.Sub(started).Minutes()
+		saveOrgs()
+	}
+}
+
+// forgetOrgMember removes a revoked key from every organization
+func forgetOrgMember(keyID string) {
+	orgsMutex.Lock()
+	defer orgsMutex.Unlock()
+	changed := false
+	for _, org := range orgs {
+		if _, member := org.Members[keyID]; member {
+			delete(org.Members, keyID)
+			changed = true
+		}
+	}
+	if changed {
+		saveOrgs()
+	}
+}
+
+// viewOrg describes an organization for the API with the names of its
+// member keys. Callers hold orgsMutex.
+func viewOrg(org *Organization, names map[string]string, keyID string) orgView {
+	month := usageMonth(time.Now())
+	v := orgView{
+		ID: org.ID, Name: org.Name, MonthlyMinutes: org.MonthlyMinutes, Members: []orgMemberView{}, CreatedAt: org.CreatedAt,
+		Month: month, MinutesUsed: org.minutesUsed(month), Role: org.role(keyID),
+	}
+	for _, id := range sortedKeys(org.Members) {
+		v.Members = append(v.Members, orgMemberView{KeyID: id, Name: names[id], Role: org.Members[id]})
+	}
+	return v
+}
+
+// apiKeyNames maps key IDs to their names
+func apiKeyNames() map[string]string {
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	names := make(map[string]string, len(apiKeys))
+	for id, k := range apiKeys {
+		names[id] = k.Name
+	}
+	return names
+}
+
+// orgRequest is the body of POST and PATCH /api/admin/orgs; owner is the
+// ID of a key to add as the first owner
+type orgRequest struct {
+	Name           string   `json:"name"`
+	MonthlyMinutes *float64 `json:"monthly_minutes"`
+	Owner          string   `json:"owner"`
+}
+
+// createOrgHandler creates an organization:
+// POST /api/admin/orgs {"name": "Studio", "monthly_minutes": 600, "owner": "<key id>"}
+func createOrgHandler(w http.ResponseWriter, r *http.Request) {
+	var req orgRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	org := &Organization{ID: uuid.New().String(), Name: req.Name, Members: map[string]string{}, CreatedAt: time.Now().UTC()}
+	if req.MonthlyMinutes != nil {
+		if *req.MonthlyMinutes < 0 {
+			http.Error(w, "Invalid monthly_minutes value", http.StatusBadRequest)
+			return
+		}
+		org.MonthlyMinutes = *req.MonthlyMinutes
+	}
+	names := apiKeyNames()
+	if req.Owner != "" {
+		if _, exists := names[req.Owner]; !exists {
+			http.Error(w, "API key not found", http.StatusBadRequest)
+			return
+		}
+		org.Members[req.Owner] = orgOwner
+	}
+
+	orgsMutex.Lock()
+	orgs[org.ID] = org
+	saveOrgs()
+	view := viewOrg(org, names, "")
+	orgsMutex.Unlock()
+	recordAudit("org.created", "", map[string]string{"org_id": org.ID, "name": org.Name})
+	writeJSON(w, http.StatusCreated, view)
+}
+
+// listOrgsHandler lists the organizations the request's key belongs to,
+// every organization for requests without a key
+func listOrgsHandler(w http.ResponseWriter, r *http.Request) {
+	keyID := apiKeyID(r.Context())
+	names := apiKeyNames()
+	orgsMutex.Lock()
+	list := []orgView{}
+	for _, id := range sortedKeys(orgs) {
+		if org := orgs[id]; org.role(keyID) != "" {
+			list = append(list, viewOrg(org, names, keyID))
+		}
+	}
+	orgsMutex.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+// lookupOrg finds the {id} organization for a request whose key has one
+// of the given roles in it, answering 404 for organizations it isn't a
+// member of and 403 for other roles. On success it returns with orgsMutex
+// held.
+func lookupOrg(w http.ResponseWriter, r *http.Request, roles ...string) (*Organization, bool) {
+	orgsMutex.Lock()
+	org, exists := orgs[mux.Vars(r)["id"]]
+	role := ""
+	if exists {
+		role = org.role(apiKeyID(r.Context()))
+	}
+	if role == "" {
+		orgsMutex.Unlock()
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return nil, false
+	}
+	for _, allowed := range roles {
+		if role == allowed {
+			return org, true
+		}
+	}
+	orgsMutex.Unlock()
+	http.Error(w, "Only organization owners can do this", http.StatusForbidden)
+	return nil, false
+}
+
+func getOrgHandler(w http.ResponseWriter, r *http.Request) {
+	names := apiKeyNames()
+	org, ok := lookupOrg(w, r, orgOwner, orgMember, orgViewer)
+	if !ok {
+		return
+	}
+	view := viewOrg(org, names, apiKeyID(r.Context()))
+	orgsMutex.Unlock()
+	writeJSON(w, http.StatusOK, view)
+}
+
+// updateOrgHandler renames an organization or changes its quota
+func updateOrgHandler(w http.ResponseWriter, r *http.Request) {
+	var req orgRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.MonthlyMinutes != nil && *req.MonthlyMinutes < 0 {
+		http.Error(w, "Invalid monthly_minutes value", http.StatusBadRequest)
+		return
+	}
+	names := apiKeyNames()
+	org, ok := lookupOrg(w, r, orgOwner)
+	if !ok {
+		return
+	}
+	if req.Name != "" {
+		org.Name = req.Name
+	}
+	if req.MonthlyMinutes != nil {
+		org.MonthlyMinutes = *req.MonthlyMinutes
+	}
+	saveOrgs()
+	view := viewOrg(org, names, "")
+	orgsMutex.Unlock()
+	writeJSON(w, http.StatusOK, view)
+}
+
+// deleteOrgHandler deletes an organization; its jobs stay with the keys
+// that created them
+func deleteOrgHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	orgsMutex.Lock()
+	_, exists := orgs[id]
+	delete(orgs, id)
+	if exists {
+		saveOrgs()
+	}
+	orgsMutex.Unlock()
+	if !exists {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return
+	}
+	recordAudit("org.deleted", "", map[string]string{"org_id": id})
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+// putOrgMemberHandler adds a key to an organization or changes its role:
+// PUT /api/orgs/{id}/members/{key_id} {"role": "member"}
+func putOrgMemberHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !orgRoles[req.Role] {
+		http.Error(w, invalidOption("role", sortedKeys(orgRoles)).Error(), http.StatusBadRequest)
+		return
+	}
+	keyID := mux.Vars(r)["key_id"]
+	names := apiKeyNames()
+	if _, exists := names[keyID]; !exists {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	org, ok := lookupOrg(w, r, orgOwner)
+	if !ok {
+		return
+	}
+	if org.Members[keyID] == orgOwner && req.Role != orgOwner && org.owners() == 1 {
+		orgsMutex.Unlock()
+		http.Error(w, "The organization needs an owner", http.StatusConflict)
+		return
+	}
+	org.Members[keyID] = req.Role
+	saveOrgs()
+	view := viewOrg(org, names, apiKeyID(r.Context()))
+	orgsMutex.Unlock()
+	recordAudit("org.member_set", "", map[string]string{"org_id": org.ID, "key_id": keyID, "role": req.Role})
+	writeJSON(w, http.StatusOK, view)
+}
+
+// deleteOrgMemberHandler removes a key from an organization; the jobs it
+// added stay in the organization
+func deleteOrgMemberHandler(w http.ResponseWriter, r *http.Request) {
+	keyID := mux.Vars(r)["key_id"]
+	names := apiKeyNames()
+	org, ok := lookupOrg(w, r, orgOwner)
+	if !ok {
+		return
+	}
+	role, member := org.Members[keyID]
+	if !member {
+		orgsMutex.Unlock()
+		http.Error(w, "Not a member of the organization", http.StatusNotFound)
+		return
+	}
+	if role == orgOwner && org.owners() == 1 {
+		orgsMutex.Unlock()
+		http.Error(w, "The organization needs an owner", http.StatusConflict)
+		return
+	}
+	delete(org.Members, keyID)
+	saveOrgs()
+	view := viewOrg(org, names, apiKeyID(r.Context()))
+	orgsMutex.Unlock()
+	recordAudit("org.member_removed", "", map[string]string{"org_id": org.ID, "key_id": keyID})
+	writeJSON(w, http.StatusOK, view)
+}
+
+// orgUsageHandler reports an organization's processing minutes by month,
+// newest first, and by key, for owners to bill members
+func orgUsageHandler(w http.ResponseWriter, r *http.Request) {
+	org, ok := lookupOrg(w, r, orgOwner)
+	if !ok {
+		return
+	}
+	months := sortedKeys(org.Usage)
+	list := make([]orgUsageMonth, 0, len(months))
+	for i := len(months) - 1; i >= 0; i-- {
+		keys := make(map[string]float64, len(org.Usage[months[i]]))
+		for id, minutes := range org.Usage[months[i]] {
+			keys[id] = minutes
+		}
+		list = append(list, orgUsageMonth{Month: months[i], Minutes: org.minutesUsed(months[i]), Keys: keys})
+	}
+	quota := org.MonthlyMinutes
+	orgsMutex.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"org_id": mux.Vars(r)["id"], "monthly_minutes": quota, "months": list})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// useOrgs gives a test its own keys and organizations
+func useOrgs(t *testing.T) {
+	oldUploadDir := uploadDir
+	uploadDir = t.TempDir()
+	t.Setenv("API_KEYS_REQUIRED", "true")
+	t.Cleanup(func() {
+		uploadDir = oldUploadDir
+		apiKeysMutex.Lock()
+		apiKeys, apiKeyWindows = make(map[string]*APIKey), make(map[string]*apiKeyWindow)
+		apiKeysMutex.Unlock()
+		orgsMutex.Lock()
+		orgs, orgJobStarts = make(map[string]*Organization), make(map[string]time.Time)
+		orgsMutex.Unlock()
+	})
+}
+
+func createTestKey(t *testing.T, name string) apiKeyView {
+	rec := httptest.NewRecorder()
+	createAPIKeyHandler(rec, httptest.NewRequest("POST", "/api/keys", strings.NewReader(`{"name": "`+name+`", "rate_limit": 0}`)))
+	var v apiKeyView
+	json.NewDecoder(rec.Body).Decode(&v)
+	return v
+}
+
+func createTestOrg(t *testing.T, body string) orgView {
+	rec := httptest.NewRecorder()
+	createOrgHandler(rec, httptest.NewRequest("POST", "/api/admin/orgs", strings.NewReader(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create org = %d: %s", rec.Code, rec.Body.String())
+	}
+	var v orgView
+	json.NewDecoder(rec.Body).Decode(&v)
+	return v
+}
+
+func TestOrgJobsSharedByMembers(t *testing.T) {
+	useOrgs(t)
+	alice, bob, carol, dave := createTestKey(t, "alice"), createTestKey(t, "bob"), createTestKey(t, "carol"), createTestKey(t, "dave")
+	org := createTestOrg(t, `{"name": "Studio", "owner": "`+alice.ID+`"}`)
+
+	router := newRouter()
+	do := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	// The owner adds the others; members can't
+	if rec := do("PUT", "/api/orgs/"+org.ID+"/members/"+bob.ID, alice.Key, `{"role": "member"}`); rec.Code != http.StatusOK {
+		t.Fatalf("add bob = %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("PUT", "/api/orgs/"+org.ID+"/members/"+carol.ID, bob.Key, `{"role": "viewer"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("member adding carol = %d, want 403", rec.Code)
+	}
+	do("PUT", "/api/orgs/"+org.ID+"/members/"+carol.ID, alice.Key, `{"role": "viewer"}`)
+	if rec := do("GET", "/api/orgs/"+org.ID, dave.Key, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("outsider reading the org = %d, want 404", rec.Code)
+	}
+	if rec := do("DELETE", "/api/orgs/"+org.ID+"/members/"+alice.ID, alice.Key, ""); rec.Code != http.StatusConflict {
+		t.Errorf("removing the last owner = %d, want 409", rec.Code)
+	}
+	var mine []orgView
+	json.NewDecoder(do("GET", "/api/orgs", carol.Key, "").Body).Decode(&mine)
+	if len(mine) != 1 || mine[0].Role != orgViewer || len(mine[0].Members) != 3 {
+		t.Errorf("carol's orgs = %+v", mine)
+	}
+
+	id := "7c9e6679-7425-40de-944b-e07fc1f90ae7"
+	jobsMutex.Lock()
+	jobs[id] = &Job{ID: id, Status: "completed", FileName: "song.mp3", APIKeyID: bob.ID, OrgID: org.ID}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+	})
+
+	// Every member sees the job; outsiders don't
+	for _, key := range []apiKeyView{alice, bob, carol, dave} {
+		var list JobList
+		json.NewDecoder(do("GET", "/api/jobs?org="+org.ID, key.Key, "").Body).Decode(&list)
+		if outsider := key.ID == dave.ID; (list.Total == 0) != outsider {
+			t.Errorf("%s lists %d org jobs", key.Name, list.Total)
+		}
+		if rec := do("GET", "/api/jobs/"+id, key.Key, ""); (rec.Code == http.StatusNotFound) != (key.ID == dave.ID) {
+			t.Errorf("%s GET job = %d", key.Name, rec.Code)
+		}
+	}
+	// Viewers only read
+	if rec := do("POST", "/api/jobs/"+id+"/rating", carol.Key, `{"score": 5}`); rec.Code != http.StatusForbidden {
+		t.Errorf("viewer rating = %d, want 403", rec.Code)
+	}
+	if rec := do("POST", "/api/jobs/"+id+"/rating", alice.Key, `{"score": 5}`); rec.Code != http.StatusOK {
+		t.Errorf("owner rating = %d", rec.Code)
+	}
+
+	opts, err := parseJobOptions(func(key string) string { return map[string]string{"org": org.ID}[key] })
+	if err != nil || newJob("org-upload", "song.mp3", opts).OrgID != org.ID {
+		t.Errorf("org option = %+v, %v", opts, err)
+	}
+	// Only members who add jobs may upload into the organization
+	for key, want := range map[string]int{bob.ID: 0, carol.ID: http.StatusForbidden, dave.ID: http.StatusForbidden} {
+		ctx := context.WithValue(context.Background(), apiKeyContextKey{}, key)
+		uerr := checkOrg(ctx, org.ID)
+		if (uerr == nil) != (want == 0) || uerr != nil && (uerr.Status != want || uerr.Code != "org_forbidden") {
+			t.Errorf("checkOrg(%s) = %+v", key, uerr)
+		}
+	}
+
+	// Revoked keys leave their organizations
+	req := httptest.NewRequest("DELETE", "/api/keys/"+carol.ID, nil)
+	deleteAPIKeyHandler(httptest.NewRecorder(), mux.SetURLVars(req, map[string]string{"id": carol.ID}))
+	if role := orgRole(context.WithValue(context.Background(), apiKeyContextKey{}, carol.ID), org.ID); role != "" {
+		t.Errorf("revoked key still has role %q", role)
+	}
+}
+
+func TestOrgUsageAndQuota(t *testing.T) {
+	useOrgs(t)
+	alice, bob := createTestKey(t, "alice"), createTestKey(t, "bob")
+	org := createTestOrg(t, `{"name": "Studio", "monthly_minutes": 5, "owner": "`+alice.ID+`"}`)
+	orgsMutex.Lock()
+	orgs[org.ID].Members[bob.ID] = orgMember
+	orgsMutex.Unlock()
+
+	now := time.Now()
+	for i, run := range []struct {
+		key     string
+		minutes int
+	}{{alice.ID, 2}, {bob.ID, 3}, {bob.ID, 1}} {
+		job := Job{ID: "org-job-" + string(rune('a'+i)), APIKeyID: run.key, OrgID: org.ID}
+		trackOrgUsage(Event{Type: EventJobProcessing, CreatedAt: now.Add(-time.Duration(run.minutes) * time.Minute), Job: job})
+		trackOrgUsage(Event{Type: EventJobCompleted, CreatedAt: now, Job: job})
+	}
+
+	ctx := context.WithValue(context.Background(), apiKeyContextKey{}, bob.ID)
+	if uerr := checkOrg(ctx, org.ID); uerr == nil || uerr.Status != http.StatusTooManyRequests || uerr.Code != "quota_exceeded" {
+		t.Errorf("checkOrg over quota = %+v", uerr)
+	}
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/api/orgs/"+org.ID+"/usage", nil), map[string]string{"id": org.ID})
+	rec := httptest.NewRecorder()
+	orgUsageHandler(rec, req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, bob.ID)))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("member reading usage = %d, want 403", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	orgUsageHandler(rec, req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, alice.ID)))
+	var usage struct {
+		Months []orgUsageMonth `json:"months"`
+	}
+	json.NewDecoder(rec.Body).Decode(&usage)
+	if len(usage.Months) != 1 {
+		t.Fatalf("usage = %s", rec.Body.String())
+	}
+	month := usage.Months[0]
+	if month.Month != usageMonth(now) || int(month.Minutes+0.5) != 6 || int(month.Keys[alice.ID]+0.5) != 2 || int(month.Keys[bob.ID]+0.5) != 4 {
+		t.Errorf("usage month = %+v", month)
+	}
+
+	// Usage survives a restart
+	orgsMutex.Lock()
+	orgs = make(map[string]*Organization)
+	orgsMutex.Unlock()
+	loadOrgs()
+	orgsMutex.Lock()
+	restored := orgs[org.ID]
+	orgsMutex.Unlock()
+	if restored == nil || int(restored.minutesUsed(usageMonth(now))+0.5) != 6 {
+		t.Errorf("restored org = %+v", restored)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The orphan sweep removes files in the upload and output directories that
+// no job, chunked upload, comparison render or running benchmark refers
+// to, such as leftovers from failed saves or deletions that errored
+// halfway. Entries younger than the grace period (ORPHAN_GC_GRACE, default
+// 1h) are kept so files being written right now are never touched. The
+// sweep runs every ORPHAN_GC_INTERVAL (default 15m).
+
+// OrphanGCStats is reported under "orphan_gc" in /api/admin/stats
+type OrphanGCStats struct {
+	LastRun          *time.Time `json:"last_run,omitempty"`
+	LastRunFiles     int        `json:"last_run_files"`
+	LastRunBytes     int64      `json:"last_run_bytes"`
+	TotalFiles       int        `json:"total_files"`
+	TotalBytes       int64      `json:"total_bytes_reclaimed"`
+	GracePeriodHours float64    `json:"grace_period_hours"`
+}
+
+var (
+	orphanGC      OrphanGCStats
+	orphanGCMutex = &sync.Mutex{}
+)
+
+func orphanGCGrace() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("ORPHAN_GC_GRACE")); err == nil && d > 0 {
+		return d
+	}
+	return time.Hour
+}
+
+func orphanGCInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("ORPHAN_GC_INTERVAL")); err == nil && d > 0 {
+		return d
+	}
+	return 15 * time.Minute
+}
+
+func orphanGCSnapshot() OrphanGCStats {
+	orphanGCMutex.Lock()
+	defer orphanGCMutex.Unlock()
+	s := orphanGC
+	s.GracePeriodHours = orphanGCGrace().Hours()
+	return s
+}
+
+// persistedUploads are the paths of the files and directories the backend
+// keeps in the upload directory itself: API keys, templates, event logs and
+// the like
+var persistedUploads []func() string
+
+// keepInUploads registers the path of a store kept in the upload directory,
+// so the sweep never takes it for an orphan. Every store registers its own
+// from an init function; the path is read at sweep time, since it follows
+// the upload directory and its environment variable.
+func keepInUploads(path func() string) {
+	persistedUploads = append(persistedUploads, path)
+}
+
+// referencedEntries returns the top-level upload and output entry names that
+// are still in use
+func referencedEntries() (uploads, outputs map[string]bool) {
+	uploads = make(map[string]bool)
+	for _, path := range persistedUploads {
+		uploads[filepath.Base(path())] = true
+	}
+	outputs = make(map[string]bool)
+
+	jobsMutex.RLock()
+	for id, job := range jobs {
+		outputs[id] = true
+		if job.inputPath != "" {
+			uploads[filepath.Base(job.inputPath)] = true
+		}
+	}
+	jobsMutex.RUnlock()
+
+	compareRendersMutex.RLock()
+	for id := range compareRenders {
+		outputs["compare-"+id] = true
+	}
+	compareRendersMutex.RUnlock()
+
+	benchmarksMutex.Lock()
+	for _, b := range benchmarks {
+		if b.Status == "running" {
+			uploads[filepath.Base(b.inputPath)] = true
+		}
+	}
+	benchmarksMutex.Unlock()
+	return uploads, outputs
+}
+
+// isOrphanUpload reports whether an upload entry belongs to no known job.
+// Uploads are named <job-id>_<filename>; the input path may not be set yet
+// while a job is being accepted, hence the job ID prefix check.
+func isOrphanUpload(name string, referenced map[string]bool) bool {
+	if referenced[name] {
+		return false
+	}
+	if id, _, ok := strings.Cut(name, "_"); ok {
+		jobsMutex.RLock()
+		_, exists := jobs[id]
+		jobsMutex.RUnlock()
+		return !exists
+	}
+	return true
+}
+
+// entrySize returns the total size of a file or directory tree
+func entrySize(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// orphanEntries returns the unreferenced entries older than grace
+func orphanEntries(now time.Time, grace time.Duration) []CleanupItem {
+	uploads, outputs := referencedEntries()
+	cutoff := now.Add(-grace)
+	var items []CleanupItem
+
+	list := func(dir string, orphan func(name string) bool) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || info.ModTime().After(cutoff) || !orphan(e.Name()) {
+				continue
+			}
+			path := filepath.Join(dir, e.Name())
+			items = append(items, CleanupItem{
+				Policy: cleanupOrphans,
+				Paths:  []string{path},
+				Bytes:  entrySize(path),
+				Reason: fmt.Sprintf("no job or upload refers to it, last modified %s ago (grace %s)", now.Sub(info.ModTime()).Round(time.Minute), grace),
+			})
+		}
+	}
+	list(uploadDir, func(name string) bool { return isOrphanUpload(name, uploads) })
+	list(outputDir, func(name string) bool { return !outputs[name] })
+
+	// Chunked upload data whose state was lost
+	partialUploadsMutex.Lock()
+	live := make(map[string]bool, len(partialUploads))
+	for id := range partialUploads {
+		live[id] = true
+	}
+	partialUploadsMutex.Unlock()
+	list(partialUploadDir(), func(name string) bool {
+		id := strings.TrimSuffix(strings.TrimSuffix(name, ".json"), ".part")
+		return !live[id]
+	})
+	return items
+}
+
+// sweepOrphans removes unreferenced entries older than grace and returns
+// how many were removed and the bytes reclaimed
+func sweepOrphans(grace time.Duration) (int, int64) {
+	files, reclaimed := 0, int64(0)
+	for _, item := range orphanEntries(time.Now(), grace) {
+		if err := os.RemoveAll(item.Paths[0]); err != nil {
+			log.Printf("Failed to remove orphaned %s: %v", item.Paths[0], err)
+			continue
+		}
+		files++
+		reclaimed += item.Bytes
+	}
+	return files, reclaimed
+}
+
+// recordOrphanSweep adds a sweep's results to the orphan_gc stats
+func recordOrphanSweep(files int, reclaimed int64) {
+	now := time.Now().UTC()
+	orphanGCMutex.Lock()
+	orphanGC.LastRun = &now
+	orphanGC.LastRunFiles = files
+	orphanGC.LastRunBytes = reclaimed
+	orphanGC.TotalFiles += files
+	orphanGC.TotalBytes += reclaimed
+	orphanGCMutex.Unlock()
+}
+
+// orphanSweeper runs sweepOrphans every interval and records the results
+func orphanSweeper(interval time.Duration) {
+	for range time.Tick(interval) {
+		files, reclaimed := sweepOrphans(orphanGCGrace())
+		recordOrphanSweep(files, reclaimed)
+		if files > 0 {
+			log.Printf("Orphan sweep removed %d entries (%d bytes)", files, reclaimed)
+		}
+	}
+}
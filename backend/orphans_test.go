@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSweepOrphans(t *testing.T) {
+	oldUploadDir, oldOutputDir := uploadDir, outputDir
+	uploadDir, outputDir = t.TempDir(), t.TempDir()
+	t.Cleanup(func() { uploadDir, outputDir = oldUploadDir, oldOutputDir })
+
+	jobsMutex.Lock()
+	jobs["gc-kept"] = &Job{ID: "gc-kept", Status: "completed"}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, "gc-kept")
+		jobsMutex.Unlock()
+	})
+
+	old := time.Now().Add(-2 * time.Hour)
+	write := func(path string, size int, mtime time.Time) {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, make([]byte, size), 0644)
+		os.Chtimes(path, mtime, mtime)
+		os.Chtimes(filepath.Dir(path), mtime, mtime)
+	}
+	write(filepath.Join(uploadDir, "gc-kept_song.mp3"), 10, old)
+	write(filepath.Join(uploadDir, "gc-gone_song.mp3"), 100, old)
+	write(filepath.Join(uploadDir, "gc-fresh_song.mp3"), 100, time.Now())
+	write(filepath.Join(outputDir, "gc-kept", "vocals.mp3"), 10, old)
+	write(filepath.Join(outputDir, "gc-gone", "vocals.mp3"), 50, old)
+	write(filepath.Join(partialUploadDir(), "lost.part"), 7, old)
+	write(customModelsFile(), 5, old)
+	write(jobTemplatesFile(), 5, old)
+	write(apiKeysFile(), 5, old)
+
+	files, reclaimed := sweepOrphans(time.Hour)
+	if files != 3 || reclaimed != 157 {
+		t.Errorf("sweep removed %d entries (%d bytes), want 3 (157)", files, reclaimed)
+	}
+	for _, path := range []string{
+		filepath.Join(uploadDir, "gc-kept_song.mp3"),
+		filepath.Join(uploadDir, "gc-fresh_song.mp3"),
+		filepath.Join(outputDir, "gc-kept", "vocals.mp3"),
+		customModelsFile(),
+		jobTemplatesFile(),
+		apiKeysFile(),
+	} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed", path)
+		}
+	}
+}
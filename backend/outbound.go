@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Outbound requests to user-supplied URLs (webhooks, stream ingest) go
+// through this policy so a public instance can't be used to reach its own
+// network or the cloud metadata service.
+//
+//	OUTBOUND_ALLOWED_HOSTS   comma-separated hosts; "*.example.com" matches subdomains
+//	OUTBOUND_ALLOW_PRIVATE   "true" to permit loopback and private ranges (LAN deployments)
+//	OUTBOUND_MAX_BYTES       response size limit (default 10 MiB); not applied to live streams
+//	OUTBOUND_MAX_REDIRECTS   redirects followed (default 3)
+
+var errOutboundTooLarge = errors.New("response exceeds outbound size limit")
+
+// alwaysDenied are blocked even with OUTBOUND_ALLOW_PRIVATE: link-local
+// covers 169.254.169.254, the metadata address on most clouds
+var alwaysDenied = mustParseCIDRs("169.254.0.0/16", "fe80::/10", "fd00:ec2::254/128", "0.0.0.0/8")
+
+// privateRanges are blocked unless OUTBOUND_ALLOW_PRIVATE=true
+var privateRanges = mustParseCIDRs(
+	"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10",
+	"::1/128", "fc00::/7",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func outboundAllowPrivate() bool {
+	return os.Getenv("OUTBOUND_ALLOW_PRIVATE") == "true"
+}
+
+func outboundMaxBytes() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("OUTBOUND_MAX_BYTES"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return 10 << 20
+}
+
+func outboundMaxRedirects() int {
+	if n, err := strconv.Atoi(os.Getenv("OUTBOUND_MAX_REDIRECTS")); err == nil && n >= 0 {
+		return n
+	}
+	return 3
+}
+
+// checkOutboundIP rejects addresses outside the public internet
+func checkOutboundIP(ip net.IP) error {
+	if ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("destination address %s not allowed", ip)
+	}
+	for _, n := range alwaysDenied {
+		if n.Contains(ip) {
+			return fmt.Errorf("destination address %s not allowed", ip)
+		}
+	}
+	if !outboundAllowPrivate() {
+		for _, n := range privateRanges {
+			if n.Contains(ip) {
+				return fmt.Errorf("destination address %s not allowed", ip)
+			}
+		}
+	}
+	return nil
+}
+
+// checkOutboundHost applies OUTBOUND_ALLOWED_HOSTS and, for IP literals,
+// the address ranges. Hostnames are checked once resolved, at dial time.
+func checkOutboundHost(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if allowed := os.Getenv("OUTBOUND_ALLOWED_HOSTS"); allowed != "" {
+		match := false
+		for _, pattern := range strings.Split(allowed, ",") {
+			pattern = strings.ToLower(strings.TrimSpace(pattern))
+			if pattern == host || strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return fmt.Errorf("destination host %s not allowed", host)
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return checkOutboundIP(ip)
+	}
+	return nil
+}
+
+// checkOutboundURL validates a user-supplied URL before it is stored
+func checkOutboundURL(u *url.URL) error {
+	if u.Hostname() == "" {
+		return fmt.Errorf("missing host")
+	}
+	return checkOutboundHost(u.Hostname())
+}
+
+// resolveOutboundHost resolves host and checks every address, for callers
+// that hand the URL to another program instead of dialing it themselves
+func resolveOutboundHost(ctx context.Context, host string) error {
+	if err := checkOutboundHost(host); err != nil {
+		return err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if err := checkOutboundIP(a.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outboundControl checks the address actually being dialed, so DNS answers
+// that change after validation (rebinding) are still caught
+func outboundControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("destination address %s not allowed", host)
+	}
+	return checkOutboundIP(ip)
+}
+
+// limitedBody fails reads once more than limit bytes have been returned
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		var one [1]byte
+		if n, _ := b.ReadCloser.Read(one[:]); n > 0 {
+			return 0, errOutboundTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// outboundTransport enforces the response size limit
+type outboundTransport struct {
+	base      http.RoundTripper
+	unlimited bool // live streams, which have no end
+}
+
+func (t *outboundTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || t.unlimited {
+		return resp, err
+	}
+	limit := outboundMaxBytes()
+	if resp.ContentLength > limit {
+		resp.Body.Close()
+		return nil, errOutboundTooLarge
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: limit}
+	return resp, nil
+}
+
+// newOutboundClient returns an HTTP client for user-supplied URLs that
+// applies the outbound policy to every connection and redirect
+func newOutboundClient(timeout time.Duration) *http.Client {
+	return outboundClient(timeout, false)
+}
+
+// newStreamClient is the outbound client for live streams: every address
+// and redirect is checked, but the body is read for as long as it lasts
+func newStreamClient() *http.Client {
+	return outboundClient(0, true)
+}
+
+func outboundClient(timeout time.Duration, unlimited bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: outboundControl}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &outboundTransport{unlimited: unlimited, base: &http.Transport{
+			// No proxy: it would dial on our behalf and bypass the address check
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+		}},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > outboundMaxRedirects() {
+				return fmt.Errorf("stopped after %d redirects", len(via)-1)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to %s not allowed", req.URL.Scheme)
+			}
+			return checkOutboundURL(req.URL)
+		},
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckOutboundHost(t *testing.T) {
+	for _, host := range []string{"169.254.169.254", "127.0.0.1", "10.1.2.3", "::1", "fd00:ec2::254", "0.0.0.0"} {
+		if err := checkOutboundHost(host); err == nil {
+			t.Errorf("expected %s to be denied", host)
+		}
+	}
+	if err := checkOutboundHost("93.184.216.34"); err != nil {
+		t.Errorf("public address denied: %v", err)
+	}
+
+	t.Setenv("OUTBOUND_ALLOW_PRIVATE", "true")
+	if err := checkOutboundHost("192.168.1.10"); err != nil {
+		t.Errorf("private address denied with OUTBOUND_ALLOW_PRIVATE: %v", err)
+	}
+	if err := checkOutboundHost("169.254.169.254"); err == nil {
+		t.Error("metadata address allowed with OUTBOUND_ALLOW_PRIVATE")
+	}
+
+	t.Setenv("OUTBOUND_ALLOWED_HOSTS", "hooks.example.com, *.partner.io")
+	for host, ok := range map[string]bool{
+		"hooks.example.com": true, "api.partner.io": true, "partner.io": false, "evil.example.com": false,
+	} {
+		if err := checkOutboundHost(host); (err == nil) != ok {
+			t.Errorf("checkOutboundHost(%q) = %v, want allowed=%v", host, err, ok)
+		}
+	}
+}
+
+func TestOutboundClientLimits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/big":
+			w.Write([]byte(strings.Repeat("x", 2048)))
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+	client := newOutboundClient(5 * time.Second)
+
+	if _, err := client.Get(server.URL); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("loopback request err = %v, want denied", err)
+	}
+
+	t.Setenv("OUTBOUND_ALLOW_PRIVATE", "true")
+	t.Setenv("OUTBOUND_MAX_BYTES", "1024")
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("allowed request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if _, err := client.Get(server.URL + "/loop"); err == nil || !strings.Contains(err.Error(), "redirects") {
+		t.Errorf("redirect loop err = %v, want redirect limit", err)
+	}
+
+	if _, err := client.Get(server.URL + "/big"); !errors.Is(err, errOutboundTooLarge) {
+		t.Errorf("oversized response err = %v, want size limit", err)
+	}
+}
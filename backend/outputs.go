@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Output listing (GET /api/jobs/{id}/outputs). Every file of a completed
+// job, stems, extra formats and mixes alike, with its size and what
+// ffprobe reports: codec, duration, sample rate, channels and bit rate, so
+// clients can show accurate details without downloading or HEAD-probing
+// each file. A file is probed the first time it is listed and the result
+// kept on the job until the file changes.
+
+// OutputInfo describes one output file of a job
+type OutputInfo struct {
+	Name      string `json:"name"` // key in output_files, as in /api/download/{id}/{name}
+	Kind      string `json:"kind"` // stem, format or mix
+	FileName  string `json:"file_name"`
+	SizeBytes int64  `json:"size_bytes"`
+	SHA256    string `json:"sha256,omitempty"`
+	*AudioProbe
+	Error string `json:"error,omitempty"` // why there is no media info
+}
+
+// outputsResponse is the response of GET /api/jobs/{id}/outputs
+type outputsResponse struct {
+	JobID   string       `json:"job_id"`
+	Outputs []OutputInfo `json:"outputs"`
+}
+
+// outputProbe is a cached probe of an output file, valid while the file
+// has the same path, size and modification time
+type outputProbe struct {
+	path    string
+	size    int64
+	modTime time.Time
+	probe   *AudioProbe // nil when ffprobe couldn't read it
+}
+
+func outputKind(name string) string {
+	switch {
+	case isMixOutput(name):
+		return "mix"
+	case isFormatOutput(name):
+		return "format"
+	}
+	return "stem"
+}
+
+// probeOutput returns the media info of a job's output, from the job's
+// cache when the file hasn't changed
+func probeOutput(ctx context.Context, jobID, name, path string, info os.FileInfo) *AudioProbe {
+	jobsMutex.RLock()
+	var cached outputProbe
+	var hit bool
+	if job, exists := jobs[jobID]; exists {
+		cached, hit = job.outputProbes[name]
+	}
+	jobsMutex.RUnlock()
+	if hit && cached.path == path && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.probe
+	}
+
+	probe, err := probeAudio(ctx, path)
+	if err != nil && ctx.Err() != nil {
+		// A request that went away says nothing about the file
+		return nil
+	}
+	jobsMutex.Lock()
+	if job, exists := jobs[jobID]; exists {
+		if job.outputProbes == nil {
+			job.outputProbes = make(map[string]outputProbe)
+		}
+		job.outputProbes[name] = outputProbe{path: path, size: info.Size(), modTime: info.ModTime(), probe: probe}
+	}
+	jobsMutex.Unlock()
+	return probe
+}
+
+func listOutputsHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupCompletedJob(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, outputsResponse{JobID: job.ID, Outputs: jobOutputs(r.Context(), job)})
+}
+
+// jobOutputs describes every output file of a job
+func jobOutputs(ctx context.Context, job Job) []OutputInfo {
+	outputs := []OutputInfo{}
+	for _, name := range sortedKeys(job.OutputFiles) {
+		path := job.OutputFiles[name]
+		out := OutputInfo{Name: name, Kind: outputKind(name), FileName: filepath.Base(path), SHA256: job.OutputHashes[name]}
+		info, err := os.Stat(path)
+		switch {
+		case !safeOutputPath(path):
+			out.Error = "Invalid file path"
+		case err != nil:
+			out.Error = "File not found"
+		default:
+			out.SizeBytes = info.Size()
+			if out.AudioProbe = probeOutput(ctx, job.ID, name, path, info); out.AudioProbe == nil {
+				out.Error = "Failed to read media info"
+			}
+		}
+		outputs = append(outputs, out)
+	}
+	return outputs
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIntegrationListOutputs(t *testing.T) {
+	b := newIntegrationBackend(t, 1)
+	job := b.waitFor(b.upload("song.mp3", nil).ID, "completed")
+
+	// An ffprobe that counts its calls
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho >> " + calls + "\ncat <<'EOF'\n" +
+		`{"streams":[{"codec_name":"mp3","sample_rate":"44100","channels":2}],"format":{"format_name":"mp3","duration":"200.5","bit_rate":"320000"}}` +
+		"\nEOF\n"
+	os.WriteFile(filepath.Join(dir, "ffprobe"), []byte(script), 0755)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	probes := func() int {
+		data, _ := os.ReadFile(calls)
+		return strings.Count(string(data), "\n")
+	}
+	list := func() outputsResponse {
+		code, body := b.get("/api/jobs/" + job.ID + "/outputs")
+		if code != http.StatusOK {
+			t.Fatalf("outputs = %d: %s", code, body)
+		}
+		var resp outputsResponse
+		json.Unmarshal(body, &resp)
+		return resp
+	}
+	output := func(resp outputsResponse, name string) OutputInfo {
+		i := slices.IndexFunc(resp.Outputs, func(o OutputInfo) bool { return o.Name == name })
+		if i < 0 {
+			t.Fatalf("no %s in %+v", name, resp.Outputs)
+		}
+		return resp.Outputs[i]
+	}
+
+	resp := list()
+	if resp.JobID != job.ID || len(resp.Outputs) != len(job.OutputFiles) {
+		t.Fatalf("outputs = %+v", resp)
+	}
+	vocals := output(resp, "vocals")
+	if vocals.Kind != "stem" || vocals.SizeBytes == 0 || vocals.AudioProbe == nil ||
+		vocals.Codec != "mp3" || vocals.DurationSeconds != 200.5 || vocals.SampleRate != 44100 || vocals.Channels != 2 || vocals.BitRate != 320000 {
+		t.Errorf("vocals = %+v %+v", vocals, vocals.AudioProbe)
+	}
+
+	// Probed once, again only when a file changes
+	list()
+	if got := probes(); got != len(job.OutputFiles) {
+		t.Errorf("%d probes for %d outputs", got, len(job.OutputFiles))
+	}
+	f, _ := os.OpenFile(job.OutputFiles["vocals"], os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte("more"))
+	f.Close()
+	os.Remove(job.OutputFiles["drums"])
+	resp = list()
+	if got := probes(); got != len(job.OutputFiles)+1 {
+		t.Errorf("%d probes after one file changed", got)
+	}
+	if drums := output(resp, "drums"); drums.Error != "File not found" || drums.AudioProbe != nil {
+		t.Errorf("missing drums = %+v", drums)
+	}
+
+	if code, _ := b.get("/api/jobs/" + b.waitFor(b.upload("fail.mp3", nil).ID, "failed").ID + "/outputs"); code != http.StatusBadRequest {
+		t.Errorf("outputs of a failed job = %d", code)
+	}
+}
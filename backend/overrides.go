@@ -0,0 +1,109 @@
+package main
+
+import (
+	"time"
+)
+
+// Per-key overrides. An admin can give one API key limits of its own on
+// top of its tier, and its own job retention, as "overrides" in POST or
+// PATCH /api/keys:
+//
+//	{"overrides": {"output_formats": ["mp3", "wav", "flac"], "models": ["htdemucs_6s"], "max_duration_seconds": 1800, "retention_hours": 720}}
+//
+// Each field set replaces the tier's value for that key, so one customer
+// can get FLAC and 6-stem output while the rest of the free tier stays
+// MP3-only; fields left out (or empty lists) keep the tier's. Overrides
+// are checked with the tier at upload time, and apply without TIERS too,
+// as the limits of a "custom" tier. retention_hours replaces
+// JOB_RETENTION_HOURS for the key's jobs, 0 keeping them forever. Sending
+// overrides replaces the key's previous ones; {} clears them. They are
+// stored with the key in API_KEYS_FILE.
+
+// KeyOverrides replaces tier limits and the job retention for one key; nil
+// fields keep the tier's
+type KeyOverrides struct {
+	MaxDurationSeconds *float64 `json:"max_duration_seconds,omitempty"` // 0 for unlimited
+	OutputFormats      []string `json:"output_formats,omitempty"`
+	Models             []string `json:"models,omitempty"`
+	RetentionHours     *float64 `json:"retention_hours,omitempty"` // 0 keeps jobs forever
+}
+
+// valid reports whether the overrides name known formats and models and no
+// negative values
+func (o *KeyOverrides) valid() bool {
+	for _, format := range o.OutputFormats {
+		if !allowedOutputFormats[format] {
+			return false
+		}
+	}
+	for _, model := range o.Models {
+		if !isAllowedModel(model) {
+			return false
+		}
+	}
+	return (o.MaxDurationSeconds == nil || *o.MaxDurationSeconds >= 0) && (o.RetentionHours == nil || *o.RetentionHours >= 0)
+}
+
+// empty reports whether the overrides change nothing
+func (o *KeyOverrides) empty() bool {
+	return o == nil || (o.MaxDurationSeconds == nil && len(o.OutputFormats) == 0 && len(o.Models) == 0 && o.RetentionHours == nil)
+}
+
+// limitsUploads reports whether the overrides set any upload limit
+func (o *KeyOverrides) limitsUploads() bool {
+	return o != nil && (o.MaxDurationSeconds != nil || len(o.OutputFormats) > 0 || len(o.Models) > 0)
+}
+
+// applyTo returns t with the overridden limits replaced
+func (o *KeyOverrides) applyTo(t Tier) Tier {
+	if o == nil {
+		return t
+	}
+	if o.MaxDurationSeconds != nil {
+		t.MaxDurationSeconds = *o.MaxDurationSeconds
+	}
+	if len(o.OutputFormats) > 0 {
+		t.OutputFormats = o.OutputFormats
+	}
+	if len(o.Models) > 0 {
+		t.Models = o.Models
+	}
+	return t
+}
+
+// keyOverrides returns a copy of the overrides of the key with the ID, or nil
+func keyOverrides(id string) *KeyOverrides {
+	if id == "" {
+		return nil
+	}
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	k, exists := apiKeys[id]
+	if !exists || k.Overrides == nil {
+		return nil
+	}
+	o := *k.Overrides
+	return &o
+}
+
+// keyRetentions returns the retention of every key that overrides it
+func keyRetentions() map[string]time.Duration {
+	retentions := make(map[string]time.Duration)
+	apiKeysMutex.Lock()
+	for id, k := range apiKeys {
+		if k.Overrides != nil && k.Overrides.RetentionHours != nil {
+			retentions[id] = time.Duration(*k.Overrides.RetentionHours * float64(time.Hour))
+		}
+	}
+	apiKeysMutex.Unlock()
+	return retentions
+}
+
+// retentionOf returns how long job is kept when completed, or 0 for ever:
+// its key's override, or ttl
+func retentionOf(job *Job, ttl time.Duration, retentions map[string]time.Duration) time.Duration {
+	if d, exists := retentions[job.APIKeyID]; exists {
+		return d
+	}
+	return ttl
+}
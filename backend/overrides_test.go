@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestKeyOverrides(t *testing.T) {
+	oldUploadDir := uploadDir
+	uploadDir = t.TempDir()
+	t.Setenv("TIERS", testTiers)
+	t.Cleanup(func() {
+		uploadDir = oldUploadDir
+		apiKeysMutex.Lock()
+		apiKeys = make(map[string]*APIKey)
+		apiKeysMutex.Unlock()
+	})
+	router := mux.NewRouter()
+	router.HandleFunc("/api/keys", createAPIKeyHandler).Methods("POST")
+	router.HandleFunc("/api/keys/{id}", updateAPIKeyHandler).Methods("PATCH")
+	do := func(method, path, body string) (int, apiKeyView) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		var v apiKeyView
+		json.NewDecoder(rec.Body).Decode(&v)
+		return rec.Code, v
+	}
+	opts := func(fields map[string]string) jobOptions {
+		o, err := parseJobOptions(func(key string) string { return fields[key] })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+
+	for _, body := range []string{
+		`{"name": "x", "overrides": {"output_formats": ["ogg-ish"]}}`,
+		`{"name": "x", "overrides": {"models": ["nope"]}}`,
+		`{"name": "x", "overrides": {"retention_hours": -1}}`,
+	} {
+		if code, _ := do("POST", "/api/keys", body); code != http.StatusBadRequest {
+			t.Errorf("%s = %d", body, code)
+		}
+	}
+	code, key := do("POST", "/api/keys", `{"name": "power", "overrides": {"output_formats": ["mp3", "flac"], "models": ["htdemucs_6s"]}}`)
+	if code != http.StatusCreated || key.Overrides == nil || len(key.Overrides.OutputFormats) != 2 {
+		t.Fatalf("create key = %d %+v", code, key)
+	}
+	ctx := context.WithValue(context.Background(), apiKeyContextKey{}, key.ID)
+
+	// FLAC and 6-stem on the MP3-only free tier
+	if e := checkTier(ctx, opts(map[string]string{"output_format": "flac", "model": "htdemucs_6s"}), ""); e != nil {
+		t.Errorf("overridden upload refused: %+v", e)
+	}
+	if e := checkTier(context.Background(), opts(map[string]string{"output_format": "flac"}), ""); e == nil {
+		t.Error("flac allowed without the key")
+	}
+	// The override holds in every tier, so none would allow wav
+	e := checkTier(ctx, opts(map[string]string{"output_format": "wav", "model": "htdemucs_6s"}), "")
+	if e == nil || e.Limit != "output_format" || e.Tier != "free" || e.UpgradeTier != "" || len(e.Allowed) != 2 {
+		t.Errorf("wav with the key = %+v", e)
+	}
+
+	// Without TIERS the overrides are the only limits
+	t.Setenv("TIERS", "")
+	if e := checkTier(ctx, opts(map[string]string{"output_format": "wav", "model": "htdemucs_6s"}), ""); e == nil || e.Tier != "custom" {
+		t.Errorf("wav without tiers = %+v", e)
+	}
+	if code, key = do("PATCH", "/api/keys/"+key.ID, `{"overrides": {}}`); code != http.StatusOK || key.Overrides != nil {
+		t.Fatalf("clear overrides = %d %+v", code, key)
+	}
+	if e := checkTier(ctx, opts(map[string]string{"output_format": "wav"}), ""); e != nil {
+		t.Errorf("cleared overrides still refuse: %+v", e)
+	}
+}
+
+func TestExpireJobsKeyRetention(t *testing.T) {
+	oldOutputDir := outputDir
+	outputDir = t.TempDir()
+	t.Setenv("JOB_RETENTION_HOURS", "2")
+	forever, short := 0.0, 1.0
+	apiKeysMutex.Lock()
+	apiKeys["keep-key"] = &APIKey{ID: "keep-key", Overrides: &KeyOverrides{RetentionHours: &forever}}
+	apiKeys["short-key"] = &APIKey{ID: "short-key", Overrides: &KeyOverrides{RetentionHours: &short}}
+	apiKeysMutex.Unlock()
+	t.Cleanup(func() {
+		outputDir = oldOutputDir
+		apiKeysMutex.Lock()
+		delete(apiKeys, "keep-key")
+		delete(apiKeys, "short-key")
+		apiKeysMutex.Unlock()
+	})
+
+	now := time.Now()
+	completed := now.Add(-90 * time.Minute)
+	old := now.Add(-100 * time.Hour)
+	for id, job := range map[string]*Job{
+		"retention-keep":    {APIKeyID: "keep-key", CompletedAt: &old},
+		"retention-short":   {APIKeyID: "short-key", CompletedAt: &completed},
+		"retention-default": {CompletedAt: &completed},
+	} {
+		job.ID, job.Status = id, "completed"
+		vocals := filepath.Join(outputDir, id, "song_t2s_vocals.mp3")
+		os.MkdirAll(filepath.Dir(vocals), 0755)
+		os.WriteFile(vocals, []byte("ID3"), 0644)
+		job.OutputFiles = map[string]string{"vocals": vocals}
+		jobsMutex.Lock()
+		jobs[id] = job
+		jobsMutex.Unlock()
+		t.Cleanup(func() {
+			jobsMutex.Lock()
+			delete(jobs, id)
+			jobsMutex.Unlock()
+		})
+	}
+
+	if n := expireJobs(now, jobRetention()); n != 1 {
+		t.Errorf("expired %d jobs, want 1", n)
+	}
+	jobsMutex.RLock()
+	defer jobsMutex.RUnlock()
+	if jobs["retention-short"].Status != "expired" || jobs["retention-keep"].Status != "completed" || jobs["retention-default"].Status != "completed" {
+		t.Errorf("statuses = %s, %s, %s", jobs["retention-short"].Status, jobs["retention-keep"].Status, jobs["retention-default"].Status)
+	}
+}
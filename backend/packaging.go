@@ -0,0 +1,270 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// packagingProfiles lay out a job's stems inside the downloaded ZIP, as
+// path templates over the job's detected metadata
+var packagingProfiles = map[string]string{
+	"zip":          "{name}/{stem}.{ext}",
+	"flat":         "{name} - {stem}.{ext}",
+	"artist-title": "{artist}/{title}/{stem}.{ext}",
+}
+
+// pathSegment makes a metadata value safe to use as one path component
+func pathSegment(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\' || r == ':' || r < 0x20 || r == 0x7f:
+			return '_'
+		}
+		return r
+	}, s)
+	s = strings.Trim(s, " .")
+	if r := []rune(s); len(r) > 100 {
+		s = strings.TrimSpace(string(r[:100]))
+	}
+	if s == "" {
+		return "Unknown"
+	}
+	return s
+}
+
+// expandLayout resolves a layout template for one stem. Placeholders are
+// {artist}, {album}, {title}, {track}, {year}, {name} (upload file name
+// without extension), {job_id}, {stem} and {ext}.
+func expandLayout(template string, job Job, stem, ext string) string {
+	meta := TrackMetadata{}
+	if job.Metadata != nil {
+		meta = *job.Metadata
+	}
+	if meta.Artist == "" {
+		meta.Artist = "Unknown Artist"
+	}
+	if meta.Album == "" {
+		meta.Album = "Unknown Album"
+	}
+	// One pass, so placeholders inside metadata values aren't expanded
+	replacer := strings.NewReplacer(
+		"{artist}", meta.Artist,
+		"{album}", meta.Album,
+		"{title}", meta.Title,
+		"{track}", meta.Track,
+		"{year}", meta.Year,
+		"{name}", strings.TrimSuffix(job.FileName, filepath.Ext(job.FileName)),
+		"{job_id}", job.ID,
+		"{stem}", stem,
+		"{ext}", strings.TrimPrefix(ext, "."),
+	)
+	var parts []string
+	for _, part := range strings.Split(template, "/") {
+		parts = append(parts, pathSegment(replacer.Replace(part)))
+	}
+	return path.Join(parts...)
+}
+
+// packageEntry is one file listed in a package's manifest.json
+type packageEntry struct {
+	Path   string `json:"path"`
+	Stem   string `json:"stem"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// packageJobHandler streams a job's stems as a ZIP laid out by a profile:
+// GET /api/jobs/{id}/package?profile=zip|flat|artist-title&stems=&manifest=false&lyrics=false&summary=true
+func packageJobHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+	q := r.URL.Query()
+	profile := q.Get("profile")
+	if profile == "" {
+		profile = "zip"
+	}
+	template, ok := packagingProfiles[profile]
+	if !ok {
+		http.Error(w, "Invalid profile value", http.StatusBadRequest)
+		return
+	}
+
+	jobsMutex.RLock()
+	j, exists := jobs[jobID]
+	var job Job
+	if exists {
+		job = j.snapshot()
+	}
+	jobsMutex.RUnlock()
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if job.Status == "expired" {
+		http.Error(w, jobExpiredMessage, http.StatusGone)
+		return
+	}
+	if job.Status != "completed" {
+		http.Error(w, "Job not completed", http.StatusBadRequest)
+		return
+	}
+
+	stems, ok := packageStems(w, job, q.Get("stems"))
+	if !ok {
+		return
+	}
+	var structure *SongStructure
+	if q.Get("summary") == "true" {
+		if refuseEncrypted(w, job) {
+			return
+		}
+		s, err := jobStructure(job)
+		if errors.Is(err, errNoStructureStems) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		structure = &s
+	}
+
+	base := strings.TrimSuffix(job.FileName, filepath.Ext(job.FileName))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", sanitizeFilename(base)+".zip"))
+
+	zw := zip.NewWriter(w)
+	var entries []packageEntry
+	dir := ""
+	for _, stem := range stems {
+		src := job.OutputFiles[stem]
+		name := expandLayout(template, job, stem, filepath.Ext(src))
+		dir = path.Dir(name)
+		entry, err := addPackageFile(zw, name, stem, src)
+		if err != nil {
+			// Headers are already sent; a truncated archive is the best signal left
+			zw.Close()
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	if dir == "." {
+		dir = ""
+	}
+	if job.Metadata != nil && job.Metadata.Lyrics != "" && q.Get("lyrics") != "false" {
+		if f, err := zw.Create(path.Join(dir, "lyrics.txt")); err == nil {
+			io.WriteString(f, job.Metadata.Lyrics)
+		}
+	}
+	if structure != nil {
+		if f, err := zw.Create(path.Join(dir, "structure.json")); err == nil {
+			enc := json.NewEncoder(f)
+			enc.SetIndent("", "  ")
+			enc.Encode(structure)
+		}
+		if f, err := zw.Create(path.Join(dir, "structure.txt")); err == nil {
+			io.WriteString(f, structure.Description)
+		}
+	}
+	if q.Get("manifest") != "false" {
+		manifest := jobManifest(job, entries)
+		manifest["packaged_at"] = time.Now().UTC()
+		manifest["profile"] = profile
+		if f, err := zw.Create(path.Join(dir, "manifest.json")); err == nil {
+			enc := json.NewEncoder(f)
+			enc.SetIndent("", "  ")
+			enc.Encode(manifest)
+		}
+	}
+	zw.Close()
+}
+
+// packageStems resolves a stems=vocals,drums selection, all outputs when
+// empty, writing the error response for an unknown one
+func packageStems(w http.ResponseWriter, job Job, raw string) ([]string, bool) {
+	stems := sortedKeys(job.OutputFiles)
+	if raw != "" {
+		stems = strings.Split(raw, ",")
+	}
+	for _, stem := range stems {
+		if p, ok := job.OutputFiles[stem]; !ok || !safeOutputPath(p) {
+			http.Error(w, "Stem not found: "+stem, http.StatusNotFound)
+			return nil, false
+		}
+	}
+	return stems, true
+}
+
+// jobManifest describes a job and the files packaged with it, for the
+// manifest.json of packages and archives
+func jobManifest(job Job, entries []packageEntry) map[string]interface{} {
+	manifest := map[string]interface{}{
+		"job_id":        job.ID,
+		"filename":      job.FileName,
+		"metadata":      job.Metadata,
+		"model":         job.Model,
+		"stem_mode":     job.StemMode,
+		"output_format": job.OutputFormat,
+		"created_at":    job.CreatedAt,
+		"completed_at":  job.CompletedAt,
+		"files":         entries,
+	}
+	// Enough to trace a bad stem back through the logs and the processor
+	if job.RequestID != "" {
+		manifest["request_id"] = job.RequestID
+	}
+	if job.Environment != nil {
+		manifest["environment"] = job.Environment
+	}
+	if job.Variant != "" {
+		manifest["variant"] = job.Variant
+	}
+	return manifest
+}
+
+// addPackageFile stores src in the archive uncompressed (stems are already
+// compressed or not worth the CPU) and hashes it on the way through
+func addPackageFile(zw *zip.Writer, name, stem, src string) (packageEntry, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return packageEntry{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return packageEntry{}, err
+	}
+	header := &zip.FileHeader{Name: name, Method: zip.Store, Modified: info.ModTime()}
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return packageEntry{}, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, h), f)
+	if err != nil {
+		return packageEntry{}, err
+	}
+	return packageEntry{Path: name, Stem: stem, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// packagingProfilesHandler lists the profiles and their layouts
+func packagingProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	list := make([]map[string]string, 0, len(packagingProfiles))
+	for _, name := range sortedKeys(packagingProfiles) {
+		list = append(list, map[string]string{"name": name, "layout": packagingProfiles[name]})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
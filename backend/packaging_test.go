@@ -0,0 +1,109 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestExpandLayout(t *testing.T) {
+	job := Job{ID: "j1", FileName: "Daft_Punk_-_One_More_Time.mp3", Metadata: &TrackMetadata{Artist: "AC/DC", Title: "{job_id} ..", Album: ""}}
+	cases := map[string]string{
+		"{artist}/{title}/{stem}.{ext}": "AC_DC/{job_id}/vocals.mp3",
+		"{name} - {stem}.{ext}":         "Daft_Punk_-_One_More_Time - vocals.mp3",
+		"{album}/../{stem}.{ext}":       "Unknown Album/Unknown/vocals.mp3",
+	}
+	for template, want := range cases {
+		if got := expandLayout(template, job, "vocals", ".mp3"); got != want {
+			t.Errorf("expandLayout(%q) = %q, want %q", template, got, want)
+		}
+	}
+}
+
+func TestPackageJobArtistTitle(t *testing.T) {
+	oldOutputDir := outputDir
+	outputDir = t.TempDir()
+	t.Cleanup(func() { outputDir = oldOutputDir })
+	stems := map[string]string{}
+	for _, stem := range []string{"vocals", "drums"} {
+		stems[stem] = filepath.Join(outputDir, "pkg-job", stem+".mp3")
+		os.MkdirAll(filepath.Dir(stems[stem]), 0755)
+		os.WriteFile(stems[stem], []byte("audio-"+stem), 0644)
+	}
+	jobsMutex.Lock()
+	jobs["pkg-job"] = &Job{ID: "pkg-job", Status: "completed", FileName: "song.mp3", OutputFiles: stems,
+		Metadata:  &TrackMetadata{Artist: "Artist", Title: "Title", Lyrics: "la la la"},
+		RequestID: "req-42", Environment: &ProcessingEnv{Instance: "processor-1", DemucsVersion: "4.0.1"}}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, "pkg-job")
+		jobsMutex.Unlock()
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/jobs/{id}/package", packageJobHandler)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/jobs/pkg-job/package?profile=artist-title", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("package = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	var manifest struct {
+		Files       []packageEntry `json:"files"`
+		RequestID   string         `json:"request_id"`
+		Environment ProcessingEnv  `json:"environment"`
+	}
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.Name == "Artist/Title/manifest.json" {
+			rc, _ := f.Open()
+			json.NewDecoder(rc).Decode(&manifest)
+			rc.Close()
+		}
+	}
+	sort.Strings(names)
+	want := []string{"Artist/Title/drums.mp3", "Artist/Title/lyrics.txt", "Artist/Title/manifest.json", "Artist/Title/vocals.mp3"}
+	if len(names) != len(want) {
+		t.Fatalf("archive = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("archive = %v, want %v", names, want)
+		}
+	}
+	sum := sha256.Sum256([]byte("audio-drums"))
+	if len(manifest.Files) != 2 || manifest.Files[0].SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("manifest files = %+v", manifest.Files)
+	}
+	if manifest.RequestID != "req-42" || manifest.Environment.Instance != "processor-1" {
+		t.Errorf("manifest trace = %q, %+v", manifest.RequestID, manifest.Environment)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/jobs/pkg-job/package?profile=flat&manifest=false&lyrics=false", nil))
+	zr, _ = zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if len(zr.File) != 2 || zr.File[0].Name != "song - drums.mp3" {
+		t.Errorf("flat archive has %d files, first %q", len(zr.File), zr.File[0].Name)
+	}
+	rc, _ := zr.File[0].Open()
+	if data, _ := io.ReadAll(rc); string(data) != "audio-drums" {
+		t.Errorf("flat archive content = %q", data)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Job pipelines. pipeline=separate,normalize,transcode:mp3,export:drive on
+// an upload lists the stages the backend runs for the job, in order, so
+// clients don't have to orchestrate them:
+//
+//	separate          the processor separates the stems (first; implied
+//	                  when left out)
+//	normalize[:LUFS]  loudness-normalizes every stem (EBU R128, default -14)
+//	transcode:FORMAT  re-encodes every stem to mp3, wav or flac, replacing it
+//	export:TARGET     delivers the stems to a target, as a delivery created
+//	                  through /api/jobs/{id}/deliveries would
+//
+// normalize and transcode run with ffmpeg before the job completes, so its
+// stems are the pipeline's result; exports come last and start once it has
+// completed. The job's pipeline shows each step's status (pending, running,
+// completed, failed or skipped); when a step before the exports fails the
+// job fails with it and the later steps are skipped.
+
+// maxPipelineSteps bounds the steps of one pipeline
+const maxPipelineSteps = 10
+
+// defaultNormalizeLUFS is the loudness normalize aims for, the level most
+// streaming services play at
+const defaultNormalizeLUFS = "-14"
+
+// PipelineStep is one stage of a job's pipeline and how it went
+type PipelineStep struct {
+	Step        string     `json:"step"`          // separate, normalize, transcode, export
+	Arg         string     `json:"arg,omitempty"` // target LUFS, format or delivery target
+	Status      string     `json:"status"`        // pending, running, completed, failed, skipped
+	Error       string     `json:"error,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	DeliveryID  string     `json:"delivery_id,omitempty"` // export steps, once started
+}
+
+func (s PipelineStep) String() string {
+	if s.Arg == "" {
+		return s.Step
+	}
+	return s.Step + ":" + s.Arg
+}
+
+// parsePipeline reads a comma-separated pipeline value
+func parsePipeline(raw string) ([]PipelineStep, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var steps []PipelineStep
+	for i, entry := range strings.Split(raw, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		step := PipelineStep{Step: name, Arg: arg, Status: "pending"}
+		switch name {
+		case "separate":
+			if i > 0 || arg != "" {
+				return nil, fmt.Errorf("pipeline step separate comes first and takes no argument")
+			}
+		case "normalize":
+			if step.Arg == "" {
+				step.Arg = defaultNormalizeLUFS
+			}
+			if lufs, err := strconv.ParseFloat(step.Arg, 64); err != nil || lufs < -70 || lufs > -5 {
+				return nil, fmt.Errorf("Invalid normalize value (allowed: -70 to -5 LUFS)")
+			}
+		case "transcode":
+			if !allowedOutputFormats[arg] {
+				return nil, invalidOption("transcode", sortedKeys(allowedOutputFormats))
+			}
+		case "export":
+			if _, err := lookupExporter(arg); err != nil {
+				return nil, fmt.Errorf("pipeline step export:%s: %v", arg, err)
+			}
+		default:
+			return nil, invalidOption("pipeline step", []string{"export", "normalize", "separate", "transcode"})
+		}
+		if name != "export" && len(steps) > 0 && steps[len(steps)-1].Step == "export" {
+			return nil, fmt.Errorf("pipeline exports go after the other steps")
+		}
+		steps = append(steps, step)
+	}
+	if steps[0].Step != "separate" {
+		steps = append([]PipelineStep{{Step: "separate", Status: "pending"}}, steps...)
+	}
+	if len(steps) > maxPipelineSteps {
+		return nil, fmt.Errorf("pipeline has more than %d steps", maxPipelineSteps)
+	}
+	return steps, nil
+}
+
+// transcodeFormats returns the formats a pipeline's transcode steps make
+func (o jobOptions) transcodeFormats() []string {
+	var formats []string
+	for _, step := range o.Pipeline {
+		if step.Step == "transcode" {
+			formats = append(formats, step.Arg)
+		}
+	}
+	return formats
+}
+
+// localSteps describes the steps that change a job's stems, which a
+// reused result must have gone through too
+func (o jobOptions) localSteps() string {
+	var steps []string
+	for _, step := range o.Pipeline {
+		if step.Step == "normalize" || step.Step == "transcode" {
+			steps = append(steps, step.String())
+		}
+	}
+	return strings.Join(steps, ",")
+}
+
+// setStep records a step's progress; called with jobsMutex held
+func (j *Job) setStep(i int, status, errMsg string) {
+	if i >= len(j.Pipeline) {
+		return
+	}
+	step := &j.Pipeline[i]
+	now := time.Now().UTC()
+	switch status {
+	case "running":
+		step.StartedAt = &now
+	case "completed", "failed":
+		if step.StartedAt == nil {
+			step.StartedAt = &now
+		}
+		step.CompletedAt = &now
+	}
+	step.Status, step.Error = status, errMsg
+}
+
+func setPipelineStep(jobID string, i int, status, errMsg string) {
+	jobsMutex.Lock()
+	if job, exists := jobs[jobID]; exists {
+		job.setStep(i, status, errMsg)
+	}
+	jobsMutex.Unlock()
+}
+
+// runPipelineSteps runs a separated job's normalize and transcode steps on
+// its stems, in place. It returns the job's error when one fails.
+func runPipelineSteps(jobID string, outputs map[string]string) error {
+	jobsMutex.Lock()
+	job, exists := jobs[jobID]
+	if !exists || len(job.Pipeline) == 0 {
+		jobsMutex.Unlock()
+		return nil
+	}
+	job.setStep(0, "completed", "")
+	steps := slices.Clone(job.Pipeline)
+	bitrate := job.MP3Bitrate
+	jobsMutex.Unlock()
+
+	for i, step := range steps {
+		var run func() error
+		switch step.Step {
+		case "normalize":
+			run = func() error { return normalizeStems(outputs, step.Arg, bitrate) }
+		case "transcode":
+			run = func() error { return transcodeStems(outputs, step.Arg, bitrate) }
+		default:
+			continue
+		}
+		setPipelineStep(jobID, i, "running", "")
+		if err := run(); err != nil {
+			setPipelineStep(jobID, i, "failed", err.Error())
+			return fmt.Errorf("Pipeline step %s failed: %v", step, err)
+		}
+		setPipelineStep(jobID, i, "completed", "")
+	}
+	return nil
+}
+
+// normalizeStems brings every stem to the given integrated loudness
+func normalizeStems(outputs map[string]string, lufs, mp3Bitrate string) error {
+	filter := "loudnorm=I=" + lufs + ":TP=-1.5:LRA=11"
+	for _, stem := range sortedKeys(outputs) {
+		src := outputs[stem]
+		if !safeOutputPath(src) {
+			continue
+		}
+		ext := filepath.Ext(src)
+		tmp := strings.TrimSuffix(src, ext) + ".normalized" + ext
+		if err := encodeStem(src, tmp, strings.TrimPrefix(ext, "."), mp3Bitrate, filter); err != nil {
+			return fmt.Errorf("%s: %v", stem, err)
+		}
+		if err := os.Rename(tmp, src); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("%s: %v", stem, err)
+		}
+	}
+	return nil
+}
+
+// transcodeStems replaces every stem with a copy in format
+func transcodeStems(outputs map[string]string, format, mp3Bitrate string) error {
+	for _, stem := range sortedKeys(outputs) {
+		src := outputs[stem]
+		if !safeOutputPath(src) || strings.EqualFold(filepath.Ext(src), "."+format) {
+			continue
+		}
+		dst := withExtension(src, "."+format)
+		if err := encodeStem(src, dst, format, mp3Bitrate); err != nil {
+			return fmt.Errorf("%s: %v", stem, err)
+		}
+		os.Remove(src)
+		outputs[stem] = dst
+	}
+	return nil
+}
+
+// reusePipelineSteps marks the steps a reused result went through as
+// done; called with jobsMutex held
+func (j *Job) reusePipelineSteps() {
+	for i, step := range j.Pipeline {
+		if step.Step != "export" {
+			j.setStep(i, "completed", "")
+		}
+	}
+}
+
+// failPipeline ends the pipeline of a failed job: the step it was on fails
+// with it, the rest are skipped; called with jobsMutex held
+func (j *Job) failPipeline(errMsg string) {
+	failed := false
+	for i, step := range j.Pipeline {
+		switch {
+		case step.Status == "failed":
+			failed = true
+		case (step.Status == "pending" || step.Status == "running") && !failed:
+			j.setStep(i, "failed", errMsg)
+			failed = true
+		case step.Status == "pending":
+			j.Pipeline[i].Status = "skipped"
+		}
+	}
+}
+
+// startPipelineExports creates the deliveries of a completed job's export
+// steps
+func startPipelineExports(jobID string) {
+	jobsMutex.RLock()
+	var exports []int
+	var targets []string
+	if job, exists := jobs[jobID]; exists {
+		for i, step := range job.Pipeline {
+			if step.Step == "export" && step.Status == "pending" {
+				exports, targets = append(exports, i), append(targets, step.Arg)
+			}
+		}
+	}
+	jobsMutex.RUnlock()
+
+	for n, i := range exports {
+		d, err := addDelivery(jobID, deliveryRequest{Target: targets[n]})
+		jobsMutex.Lock()
+		if job, exists := jobs[jobID]; exists {
+			if err != nil {
+				job.setStep(i, "failed", err.Error())
+			} else {
+				job.setStep(i, "running", "")
+				job.Pipeline[i].DeliveryID = d.ID
+			}
+		}
+		jobsMutex.Unlock()
+	}
+}
+
+// pipelineView copies a job's steps for a response: separation runs while
+// the job is processing, and exports follow their delivery
+func (j *Job) pipelineView() []PipelineStep {
+	if j.Pipeline == nil {
+		return nil
+	}
+	steps := slices.Clone(j.Pipeline)
+	if steps[0].Status == "pending" && j.Status == "processing" {
+		steps[0].Status = "running"
+	}
+	for i, step := range steps {
+		if step.DeliveryID == "" {
+			continue
+		}
+		for _, d := range j.Deliveries {
+			if d.ID != step.DeliveryID {
+				continue
+			}
+			switch d.Status {
+			case "delivered":
+				steps[i].Status, steps[i].CompletedAt = "completed", d.DeliveredAt
+			case "failed":
+				steps[i].Status, steps[i].Error = "failed", d.Error
+				updated := d.UpdatedAt
+				steps[i].CompletedAt = &updated
+			}
+		}
+	}
+	return steps
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePipeline(t *testing.T) {
+	t.Setenv("LOCAL_EXPORT_DIR", t.TempDir())
+	steps, err := parsePipeline("normalize, transcode:flac, export:local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, step := range steps {
+		names = append(names, step.String())
+		if step.Status != "pending" {
+			t.Errorf("%s is %s", step, step.Status)
+		}
+	}
+	if got := strings.Join(names, ","); got != "separate,normalize:-14,transcode:flac,export:local" {
+		t.Errorf("steps = %s", got)
+	}
+	if steps, _ := parsePipeline(""); steps != nil {
+		t.Errorf("empty pipeline = %+v", steps)
+	}
+
+	for value, want := range map[string]string{
+		"transcode:ogg":          "transcode",
+		"normalize:0":            "normalize",
+		"normalize,separate":     "separate comes first",
+		"export:local,normalize": "after the other steps",
+		"export:s3":              "not configured",
+		"reverse":                "pipeline step",
+		strings.Repeat("normalize,", 10) + "export:local": "more than 10",
+	} {
+		if _, err := parsePipeline(value); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parsePipeline(%q) = %v, want %q", value, err, want)
+		}
+	}
+
+	get := func(fields map[string]string) func(string) string {
+		return func(key string) string { return fields[key] }
+	}
+	opts, err := parseJobOptions(get(map[string]string{"output_format": "wav", "pipeline": "transcode:mp3"}))
+	if err != nil || opts.MP3Bitrate != "320" {
+		t.Errorf("transcode to mp3 = %+v, %v", opts, err)
+	}
+	if _, err := parseJobOptions(get(map[string]string{"output_format": "wav", "extra_formats": "mp3", "pipeline": "transcode:flac"})); err == nil {
+		t.Error("extra_formats with a transcode step accepted")
+	}
+}
+
+func TestFailPipeline(t *testing.T) {
+	job := &Job{Pipeline: []PipelineStep{
+		{Step: "separate", Status: "completed"},
+		{Step: "normalize", Arg: "-14", Status: "running"},
+		{Step: "transcode", Arg: "wav", Status: "pending"},
+		{Step: "export", Arg: "local", Status: "pending"},
+	}}
+	job.failPipeline("ffmpeg failed")
+	var statuses []string
+	for _, step := range job.Pipeline {
+		statuses = append(statuses, step.Status)
+	}
+	if got := strings.Join(statuses, ","); got != "completed,failed,skipped,skipped" || job.Pipeline[1].Error != "ffmpeg failed" {
+		t.Errorf("after failure: %s %+v", got, job.Pipeline[1])
+	}
+}
+
+func TestIntegrationPipeline(t *testing.T) {
+	exportDir := t.TempDir()
+	t.Setenv("LOCAL_EXPORT_DIR", exportDir)
+	fakeFFmpeg(t, "")
+	b := newIntegrationBackend(t, 1)
+
+	job := b.waitFor(b.upload("song.mp3", map[string]string{"pipeline": "separate,normalize:-16,transcode:flac,export:local"}).ID, "completed")
+	if len(job.OutputFiles) == 0 {
+		t.Fatal("no stems")
+	}
+	for stem, path := range job.OutputFiles {
+		if filepath.Ext(path) != ".flac" {
+			t.Errorf("%s = %s, want flac", stem, path)
+		}
+	}
+	if len(job.Pipeline) != 4 || job.Pipeline[2].Status != "completed" || job.Pipeline[3].Status != "running" || job.Pipeline[3].DeliveryID == "" {
+		t.Fatalf("pipeline = %+v", job.Pipeline)
+	}
+
+	runDelivery(<-deliveryQueue)
+	job = b.job(job.ID)
+	if export := job.Pipeline[3]; export.Status != "completed" || export.CompletedAt == nil {
+		t.Errorf("export step = %+v", export)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(exportDir, job.ID)); len(entries) != len(job.OutputFiles) {
+		t.Errorf("exported %d files, want %d", len(entries), len(job.OutputFiles))
+	}
+
+	// A failing step fails the job and skips what comes after it
+	fakeFFmpeg(t, ".wav")
+	job = b.waitFor(b.upload("other.mp3", map[string]string{"pipeline": "transcode:wav,export:local"}).ID, "failed")
+	if !strings.Contains(job.Error, "transcode:wav") || job.Pipeline[1].Status != "failed" || job.Pipeline[2].Status != "skipped" {
+		t.Errorf("failed pipeline = %s %+v", job.Error, job.Pipeline)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// The content policy hook (POLICY_HOOK_URL) lets an external service decide
+// whether an upload may be processed, typically by matching its audio
+// fingerprint against a catalogue of protected works. It is called once per
+// upload before the job is queued:
+//
+//	POST <POLICY_HOOK_URL>
+//	{"job_id", "filename", "sha256", "fingerprint", "duration", "metadata"}
+//	-> {"decision": "allow" | "flag" | "block", "reason": "..."}
+//
+// Flagged jobs are processed as usual; blocked jobs fail without being
+// processed. Either way the decision is kept on the job and audited. The
+// fingerprint is Chromaprint's (fpcalc) when it is installed.
+
+const policyTimeout = 30 * time.Second
+
+// PolicyDecision is the content policy verdict recorded on a job
+type PolicyDecision struct {
+	Decision  string    `json:"decision"` // allow, flag, block
+	Reason    string    `json:"reason,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// policyRequest is the body sent to the policy service
+type policyRequest struct {
+	JobID       string         `json:"job_id"`
+	FileName    string         `json:"filename"`
+	SHA256      string         `json:"sha256"`
+	Fingerprint string         `json:"fingerprint,omitempty"`
+	Duration    float64        `json:"duration,omitempty"`
+	Metadata    *TrackMetadata `json:"metadata,omitempty"`
+}
+
+var policyClient = &http.Client{Timeout: policyTimeout}
+
+// fileSHA256 hashes a file's contents
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// chromaprint returns the acoustic fingerprint and duration, or empty values
+// when fpcalc is unavailable or fails
+func chromaprint(ctx context.Context, path string) (string, float64) {
+	out, err := mediaCommand(ctx, "fpcalc", "-json", path).Output()
+	if err != nil {
+		return "", 0
+	}
+	var result struct {
+		Duration    float64 `json:"duration"`
+		Fingerprint string  `json:"fingerprint"`
+	}
+	if json.Unmarshal(out, &result) != nil {
+		return "", 0
+	}
+	return result.Fingerprint, result.Duration
+}
+
+// askPolicy sends the upload's fingerprint to the policy service
+func askPolicy(ctx context.Context, hookURL string, req policyRequest) (*PolicyDecision, error) {
+	body, _ := json.Marshal(req)
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", hookURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if token := os.Getenv("POLICY_HOOK_TOKEN"); token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := policyClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("policy service returned %d", resp.StatusCode)
+	}
+	var d PolicyDecision
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&d); err != nil {
+		return nil, fmt.Errorf("invalid policy response: %v", err)
+	}
+	switch d.Decision {
+	case "allow", "flag", "block":
+	default:
+		return nil, fmt.Errorf("invalid policy decision %q", d.Decision)
+	}
+	d.CheckedAt = time.Now().UTC()
+	return &d, nil
+}
+
+// checkPolicy runs the hook for an accepted upload and records the decision
+// on the job. It returns a non-zero HTTP status and message when the upload
+// must not be processed.
+func checkPolicy(ctx context.Context, job *Job, path string) (int, string) {
+	hookURL := os.Getenv("POLICY_HOOK_URL")
+	if hookURL == "" {
+		return 0, ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, policyTimeout)
+	defer cancel()
+
+	jobsMutex.RLock()
+	req := policyRequest{JobID: job.ID, FileName: job.FileName, Metadata: job.Metadata}
+	jobsMutex.RUnlock()
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to read upload"
+	}
+	req.SHA256 = sum
+	req.Fingerprint, req.Duration = chromaprint(ctx, path)
+
+	fields := map[string]string{"filename": req.FileName, "sha256": req.SHA256}
+	d, err := askPolicy(ctx, hookURL, req)
+	if err != nil {
+		fields["decision"] = "error"
+		fields["error"] = err.Error()
+		if os.Getenv("POLICY_FAIL_OPEN") != "true" {
+			recordAudit("upload.policy", req.JobID, fields)
+			return http.StatusServiceUnavailable, "Content policy check unavailable"
+		}
+		fields["accepted"] = "true"
+		recordAudit("upload.policy", req.JobID, fields)
+		return 0, ""
+	}
+	fields["decision"] = d.Decision
+	if d.Reason != "" {
+		fields["reason"] = d.Reason
+	}
+	recordAudit("upload.policy", req.JobID, fields)
+
+	jobsMutex.Lock()
+	job.Policy = d
+	jobsMutex.Unlock()
+	if d.Decision == "block" {
+		msg := "Blocked by content policy"
+		if d.Reason != "" {
+			msg += ": " + d.Reason
+		}
+		return http.StatusUnavailableForLegalReasons, msg
+	}
+	return 0, ""
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestUploadPolicyHook(t *testing.T) {
+	oldUploadDir := uploadDir
+	uploadDir = t.TempDir()
+	externalWorkers = true // keep the accepted job from being dispatched to a processor
+	t.Cleanup(func() { uploadDir, externalWorkers = oldUploadDir, false })
+	t.Setenv("AUDIT_LOG_FILE", t.TempDir()+"/audit.jsonl")
+
+	// The fake service decides by file name
+	var seen policyRequest
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&seen)
+		switch seen.FileName {
+		case "protected.mp3":
+			w.Write([]byte(`{"decision":"block","reason":"matches a protected work"}`))
+		case "sample.mp3":
+			w.Write([]byte(`{"decision":"flag","reason":"possible sample"}`))
+		default:
+			w.Write([]byte(`{"decision":"allow"}`))
+		}
+	}))
+	defer service.Close()
+	t.Setenv("POLICY_HOOK_URL", service.URL)
+
+	upload := func(name string) (*httptest.ResponseRecorder, *Job) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", name)
+		part.Write([]byte("ID3 audio"))
+		mw.Close()
+		req := httptest.NewRequest("POST", "/api/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		uploadHandler(rec, req)
+		jobsMutex.RLock()
+		defer jobsMutex.RUnlock()
+		for _, job := range jobs {
+			if job.FileName == name {
+				return rec, job
+			}
+		}
+		return rec, nil
+	}
+
+	rec, job := upload("protected.mp3")
+	if rec.Code != http.StatusUnavailableForLegalReasons || !strings.Contains(rec.Body.String(), "protected work") {
+		t.Fatalf("blocked upload = %d: %s", rec.Code, rec.Body.String())
+	}
+	if job == nil || job.Status != "failed" || job.Policy == nil || job.Policy.Decision != "block" {
+		t.Fatalf("blocked job = %+v", job)
+	}
+	if _, err := os.Stat(job.inputPath); job.inputPath != "" || err == nil {
+		t.Errorf("blocked upload kept its input file")
+	}
+	if len(seen.SHA256) != 64 {
+		t.Errorf("policy request sha256 = %q", seen.SHA256)
+	}
+
+	rec, job = upload("sample.mp3")
+	if rec.Code != http.StatusOK || job == nil || job.Policy == nil || job.Policy.Decision != "flag" {
+		t.Fatalf("flagged upload = %d, job %+v", rec.Code, job)
+	}
+
+	t.Setenv("POLICY_HOOK_URL", "http://127.0.0.1:1")
+	if rec, _ := upload("down.mp3"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("upload with policy service down = %d, want 503", rec.Code)
+	}
+	t.Setenv("POLICY_FAIL_OPEN", "true")
+	if rec, _ := upload("open.mp3"); rec.Code != http.StatusOK {
+		t.Errorf("fail-open upload = %d, want 200", rec.Code)
+	}
+}
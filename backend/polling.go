@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Polling caps. Each client (its API key, or its address) may have at most
+// POLL_MAX_CONCURRENT status requests in flight, and only one per job;
+// more are refused with 429 and a Retry-After of POLL_RETRY_AFTER to twice
+// that many seconds, jittered so clients that were refused together don't
+// come back in lockstep. Behind the bundled nginx every browser shares the
+// proxy's address, so TRUST_PROXY_HEADERS=true identifies them by the
+// X-Real-IP header it sets instead.
+
+// Polling hints. Job and status responses carry poll_interval_ms and
+// next_check_after, so clients poll about as often as there is something
+// new to see: every POLL_INTERVAL (default 2s) while a job is uploading or
+// processing, a multiple of that the further back in the queue it is, and
+// longer again the more jobs the backend has queued, up to
+// POLL_INTERVAL_MAX (default 30s). Finished jobs get no hints.
+
+const (
+	defaultPollMaxConcurrent = 4
+	defaultPollRetryAfter    = 2 // seconds
+)
+
+// pollClient counts the status requests one client has in flight
+type pollClient struct {
+	total int
+	jobs  map[string]bool
+}
+
+var (
+	pollClients      = make(map[string]*pollClient)
+	pollClientsMutex = &sync.Mutex{}
+)
+
+func pollMaxConcurrent() int {
+	if n, err := strconv.Atoi(os.Getenv("POLL_MAX_CONCURRENT")); err == nil && n > 0 {
+		return n
+	}
+	return defaultPollMaxConcurrent
+}
+
+func pollRetryAfter() int {
+	if n, err := strconv.Atoi(os.Getenv("POLL_RETRY_AFTER")); err == nil && n > 0 {
+		return n
+	}
+	return defaultPollRetryAfter
+}
+
+// clientID identifies the client making a request
+func clientID(r *http.Request) string {
+	if id := apiKeyID(r.Context()); id != "" {
+		return "key:" + id
+	}
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		if ip := r.Header.Get("X-Real-IP"); ip != "" {
+			return "ip:" + ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// acquirePoll reserves a status request slot for the client and job
+func acquirePoll(client, jobID string) bool {
+	pollClientsMutex.Lock()
+	defer pollClientsMutex.Unlock()
+	c, exists := pollClients[client]
+	if !exists {
+		c = &pollClient{jobs: make(map[string]bool)}
+		pollClients[client] = c
+	}
+	if c.total >= pollMaxConcurrent() || c.jobs[jobID] {
+		return false
+	}
+	c.total++
+	c.jobs[jobID] = true
+	return true
+}
+
+func releasePoll(client, jobID string) {
+	pollClientsMutex.Lock()
+	defer pollClientsMutex.Unlock()
+	c := pollClients[client]
+	c.total--
+	delete(c.jobs, jobID)
+	if c.total == 0 {
+		delete(pollClients, client)
+	}
+}
+
+// limitPolling applies the polling caps to a status route
+func limitPolling(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, jobID := clientID(r), mux.Vars(r)["id"]
+		if !acquirePoll(client, jobID) {
+			base := pollRetryAfter()
+			w.Header().Set("Retry-After", strconv.Itoa(base+rand.Intn(base+1)))
+			http.Error(w, "Too many concurrent status requests", http.StatusTooManyRequests)
+			return
+		}
+		defer releasePoll(client, jobID)
+		next(w, r)
+	}
+}
+
+func pollDuration(name string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+// pollInterval is how long a client should wait before checking a job in
+// status again, 0 for a finished job
+func pollInterval(status string, queuePosition int) time.Duration {
+	base := pollDuration("POLL_INTERVAL", 2*time.Second)
+	workers := maxConcurrentJobs()
+	var interval time.Duration
+	switch status {
+	case "pending", "processing":
+		interval = base
+	case "queued":
+		// Nothing changes until the jobs ahead of it have started
+		interval = base * time.Duration(1+max(queuePosition-1, 0)/workers)
+	default:
+		return 0
+	}
+	// A busy backend has more clients to answer, so they ease off with it
+	queued, _ := processingQueue.stats()
+	interval += interval * time.Duration(queued) / time.Duration(4*workers)
+	return min(interval, max(pollDuration("POLL_INTERVAL_MAX", 30*time.Second), base))
+}
+
+// withPollHints sets a job response's polling hints
+func withPollHints(job *Job) {
+	interval := pollInterval(job.Status, job.QueuePosition)
+	if interval == 0 {
+		return
+	}
+	next := time.Now().UTC().Add(interval)
+	job.PollIntervalMS, job.NextCheckAfter = int(interval.Milliseconds()), &next
+}
+
+// withStatusHints adds the polling hints to a processing status response
+func withStatusHints(resp map[string]interface{}, interval time.Duration) map[string]interface{} {
+	if interval > 0 {
+		resp["poll_interval_ms"] = interval.Milliseconds()
+		resp["next_check_after"] = time.Now().UTC().Add(interval)
+	}
+	return resp
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestLimitPolling(t *testing.T) {
+	t.Setenv("POLL_MAX_CONCURRENT", "2")
+	t.Setenv("POLL_RETRY_AFTER", "3")
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	router := mux.NewRouter()
+	router.HandleFunc("/api/processing-status/{id}", limitPolling(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.RemoteAddr, "10.0.0.1:") {
+			started.Done()
+			<-release
+		}
+	}))
+	poll := func(jobID, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/processing-status/"+jobID, nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Two polls from one client occupy its slots
+	var done sync.WaitGroup
+	started.Add(2)
+	for _, jobID := range []string{"job-a", "job-b"} {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			poll(jobID, "10.0.0.1:1000")
+		}()
+	}
+	started.Wait()
+
+	rec := poll("job-a", "10.0.0.1:1001")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("parallel poll of the same job = %d, want 429", rec.Code)
+	}
+	if after, _ := strconv.Atoi(rec.Header().Get("Retry-After")); after < 3 || after > 6 {
+		t.Errorf("Retry-After = %q, want 3-6", rec.Header().Get("Retry-After"))
+	}
+	if rec := poll("job-c", "10.0.0.1:1002"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("poll over the client's cap = %d, want 429", rec.Code)
+	}
+
+	// Other clients are unaffected
+	if rec := poll("job-a", "10.0.0.2:1000"); rec.Code != http.StatusOK {
+		t.Errorf("poll from another client = %d", rec.Code)
+	}
+
+	close(release)
+	done.Wait()
+	started.Add(1)
+	if rec := poll("job-a", "10.0.0.1:1003"); rec.Code != http.StatusOK {
+		t.Errorf("poll after the others finished = %d", rec.Code)
+	}
+	pollClientsMutex.Lock()
+	defer pollClientsMutex.Unlock()
+	if len(pollClients) != 0 {
+		t.Errorf("poll slots left after requests finished: %v", pollClients)
+	}
+}
+
+func TestClientID(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/processing-status/x", nil)
+	req.RemoteAddr = "172.18.0.5:4711"
+	req.Header.Set("X-Real-IP", "203.0.113.9")
+	if id := clientID(req); id != "ip:172.18.0.5" {
+		t.Errorf("clientID = %q without trusted proxy headers", id)
+	}
+	t.Setenv("TRUST_PROXY_HEADERS", "true")
+	if id := clientID(req); id != "ip:203.0.113.9" {
+		t.Errorf("clientID = %q behind the proxy", id)
+	}
+}
+
+func TestPollInterval(t *testing.T) {
+	saved := processingQueue
+	processingQueue = newJobQueue()
+	t.Cleanup(func() { processingQueue = saved })
+
+	if got := pollInterval("processing", 0); got != 2*time.Second {
+		t.Errorf("processing = %s", got)
+	}
+	if got := pollInterval("queued", 3); got != 6*time.Second {
+		t.Errorf("third in the queue = %s", got)
+	}
+	if got := pollInterval("completed", 0); got != 0 {
+		t.Errorf("completed = %s", got)
+	}
+
+	// Eight queued jobs double a single worker's intervals
+	for _, id := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		processingQueue.push(id, false)
+	}
+	if got := pollInterval("processing", 0); got != 6*time.Second {
+		t.Errorf("processing on a busy backend = %s", got)
+	}
+	if got := pollInterval("queued", 8); got != 30*time.Second {
+		t.Errorf("last in a busy queue = %s, want the cap", got)
+	}
+	t.Setenv("MAX_CONCURRENT_JOBS", "2")
+	if got := pollInterval("queued", 3); got != 8*time.Second {
+		t.Errorf("third with two workers = %s", got)
+	}
+}
+
+func TestIntegrationPollHints(t *testing.T) {
+	b := newIntegrationBackend(t, 1)
+	running := b.upload("hang.mp3", nil)
+	b.waitFor(running.ID, "processing")
+	waiting := b.upload("waiting.mp3", nil)
+
+	// One queued job adds a quarter to the two second default
+	if job := b.job(waiting.ID); job.Status != "queued" || job.PollIntervalMS != 2500 || job.NextCheckAfter == nil {
+		t.Errorf("queued job = %s, %d ms, %v", job.Status, job.PollIntervalMS, job.NextCheckAfter)
+	}
+	code, body := b.get("/api/processing-status/" + running.ID)
+	var status map[string]interface{}
+	if json.Unmarshal(body, &status); code != http.StatusOK || status["poll_interval_ms"] != float64(2500) || status["next_check_after"] == nil {
+		t.Errorf("processing status = %d %s", code, body)
+	}
+
+	req, _ := http.NewRequest("DELETE", b.URL+"/api/jobs/"+running.ID, nil)
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+	if job := b.waitFor(waiting.ID, "completed"); b.job(job.ID).PollIntervalMS != 0 || b.job(job.ID).NextCheckAfter != nil {
+		t.Errorf("completed job still has polling hints")
+	}
+}
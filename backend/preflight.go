@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Dry runs. An upload with dry_run=true is checked like a real one (form
+// options, storage, ffprobe) and answered with what would happen, but the
+// file is discarded and no job is created: the detected format, duration
+// and channels, whether the dedup cache already has the stems, and rough
+// estimates of the processing time, the output size and, for API keys
+// with a quota, the processing minutes left. The response is 200 when the
+// upload would be accepted and 422 with the problems when it wouldn't.
+// Virus scanning and the content policy hook only run on real uploads.
+//
+// The processing estimate is the audio duration times
+// ESTIMATE_REALTIME_FACTOR (seconds of processing per second of audio
+// with htdemucs, default 1), scaled by the model, shifts and overlap.
+
+// modelCosts is how long a model takes relative to htdemucs; the
+// bag-of-models variants run four networks. Custom models count as 1.
+var modelCosts = map[string]float64{
+	"htdemucs": 1, "htdemucs_6s": 1.2, "hdemucs_mmi": 1,
+	"htdemucs_ft": 4, "mdx": 4, "mdx_extra": 4, "mdx_q": 4, "mdx_extra_q": 4,
+}
+
+// AudioProbe is what ffprobe found in a file
+type AudioProbe struct {
+	Format          string  `json:"format"` // container, e.g. mp3 or "mov,mp4,m4a,3gp,3g2,mj2"
+	Codec           string  `json:"codec"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	SampleRate      int     `json:"sample_rate"`
+	Channels        int     `json:"channels"`
+	BitRate         int64   `json:"bit_rate,omitempty"`
+}
+
+// Preflight is the response to a dry run
+type Preflight struct {
+	Accepted                   bool              `json:"accepted"`
+	Problems                   []string          `json:"problems,omitempty"`   // why it would be refused
+	Rejections                 []Rejection       `json:"rejections,omitempty"` // the problems with their remediation
+	Warnings                   []string          `json:"warnings,omitempty"`
+	FileName                   string            `json:"filename"`
+	SizeBytes                  int64             `json:"size_bytes"`
+	SHA256                     string            `json:"sha256"`
+	Audio                      *AudioProbe       `json:"audio,omitempty"`
+	Metadata                   *TrackMetadata    `json:"metadata,omitempty"`
+	Options                    *EffectiveOptions `json:"effective_options"`
+	CacheHit                   bool              `json:"cache_hit"` // stems would be reused
+	EstimatedProcessingSeconds float64           `json:"estimated_processing_seconds"`
+	EstimatedOutputBytes       int64             `json:"estimated_output_bytes"`
+	QueuedJobs                 int               `json:"queued_jobs"`
+	QuotaMinutesRemaining      *float64          `json:"quota_minutes_remaining,omitempty"`
+}
+
+func realtimeFactor() float64 {
+	if f, err := strconv.ParseFloat(os.Getenv("ESTIMATE_REALTIME_FACTOR"), 64); err == nil && f > 0 {
+		return f
+	}
+	return 1
+}
+
+// probeAudio reads the container and first audio stream of a file
+func probeAudio(ctx context.Context, path string) (*AudioProbe, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	out, err := mediaCommand(ctx, "ffprobe", "-v", "error", "-select_streams", "a:0",
+		"-show_entries", "format=format_name,duration,bit_rate:stream=codec_name,sample_rate,channels", "-of", "json", path).Output()
+	if err != nil {
+		return nil, err
+	}
+	var probe struct {
+		Format struct {
+			Name     string `json:"format_name"`
+			Duration string `json:"duration"`
+			BitRate  string `json:"bit_rate"`
+		} `json:"format"`
+		Streams []struct {
+			Codec      string `json:"codec_name"`
+			SampleRate string `json:"sample_rate"`
+			Channels   int    `json:"channels"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, fmt.Errorf("invalid ffprobe output: %v", err)
+	}
+	if len(probe.Streams) == 0 {
+		return nil, fmt.Errorf("no audio stream")
+	}
+	s := probe.Streams[0]
+	a := &AudioProbe{Format: probe.Format.Name, Codec: s.Codec, Channels: s.Channels}
+	a.DurationSeconds, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	a.SampleRate, _ = strconv.Atoi(s.SampleRate)
+	a.BitRate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	return a, nil
+}
+
+// estimateProcessingSeconds is a rough separation time for audio of the
+// given duration
+func estimateProcessingSeconds(duration float64, opts jobOptions) float64 {
+	cost, known := modelCosts[opts.Model]
+	if !known {
+		cost = 1
+	}
+	shifts, _ := strconv.Atoi(opts.Shifts)
+	seconds := duration * realtimeFactor() * cost * float64(shifts+1)
+	// More overlap means more windows over the same audio
+	if overlap, err := strconv.ParseFloat(opts.Overlap, 64); err == nil {
+		seconds *= (1 - 0.25) / (1 - overlap)
+	}
+	return math.Round(seconds*10) / 10
+}
+
+// refuse records why the upload would be refused
+func (p *Preflight) refuse(r Rejection) {
+	p.Problems = append(p.Problems, r.Error)
+	p.Rejections = append(p.Rejections, r)
+}
+
+// preflightUpload answers a dry run for one uploaded file
+func preflightUpload(w http.ResponseWriter, r *http.Request, header *multipart.FileHeader, opts jobOptions) {
+	src, err := header.Open()
+	if err != nil {
+		http.Error(w, "Failed to get file", http.StatusBadRequest)
+		return
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp("", "preflight-*"+filepath.Ext(sanitizeFilename(header.Filename)))
+	if err != nil {
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, src)
+	tmp.Close()
+	if err != nil {
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+
+	p := Preflight{
+		FileName:             sanitizeFilename(header.Filename),
+		SizeBytes:            header.Size,
+		Options:              newJob("", "", opts).effectiveOptions(),
+		EstimatedOutputBytes: estimateOutputBytes(header.Size, header.Filename, opts),
+	}
+	p.QueuedJobs, _ = processingQueue.stats()
+	p.SHA256, _ = fileSHA256(tmp.Name())
+	if rej := checkInputFormat(header.Filename, header.Header.Get("Content-Type")); rej != nil {
+		p.refuse(*rej)
+	}
+	if rej := checkQueueRoom(); rej != nil {
+		p.refuse(*rej)
+	}
+
+	audio, err := probeAudio(r.Context(), tmp.Name())
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		p.Warnings = append(p.Warnings, "ffprobe is not installed; the audio wasn't checked")
+	case err != nil:
+		p.refuse(Rejection{Error: "No readable audio found in the file", Code: "unreadable_audio", Remediation: formatRemedy()})
+	default:
+		p.Audio = audio
+		p.Metadata = probeMetadata(tmp.Name(), p.FileName)
+		p.EstimatedProcessingSeconds = estimateProcessingSeconds(audio.DurationSeconds, opts)
+	}
+	if e := checkDiskSpace(map[string]int64{uploadDir: header.Size, outputDir: p.EstimatedOutputBytes}); e != nil {
+		p.refuse(Rejection{Error: fmt.Sprintf("%s on %s", e.Error, e.Path), Code: "insufficient_storage", Remediation: storageRemedy()})
+	}
+
+	if dedupEnabled() && !opts.Force && p.SHA256 != "" {
+		dedupCacheMutex.Lock()
+		sourceID, cached := dedupCache[dedupKey(p.SHA256, opts)]
+		dedupCacheMutex.Unlock()
+		jobsMutex.RLock()
+		source, exists := jobs[sourceID]
+		p.CacheHit = cached && exists && source.Status == "completed"
+		jobsMutex.RUnlock()
+		if p.CacheHit {
+			p.EstimatedProcessingSeconds = 0
+		}
+	}
+
+	if id := apiKeyID(r.Context()); id != "" {
+		apiKeysMutex.Lock()
+		if k, exists := apiKeys[id]; exists && k.MonthlyMinutes > 0 {
+			left := max(k.MonthlyMinutes-k.Usage[usageMonth(time.Now())], 0)
+			p.QuotaMinutesRemaining = &left
+			if p.EstimatedProcessingSeconds/60 > left {
+				p.Warnings = append(p.Warnings, "The estimated processing time exceeds the remaining quota")
+			}
+		}
+		apiKeysMutex.Unlock()
+	}
+
+	p.Accepted = len(p.Problems) == 0
+	status := http.StatusOK
+	if !p.Accepted {
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, status, p)
+}
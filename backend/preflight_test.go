@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeFFprobe puts an ffprobe on PATH that prints output, or fails when
+// output is empty
+func fakeFFprobe(t *testing.T, output string) {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\nexit 1\n"
+	if output != "" {
+		script = "#!/bin/sh\ncat <<'EOF'\n" + output + "\nEOF\n"
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ffprobe"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func dryRun(t *testing.T, fields map[string]string) (*httptest.ResponseRecorder, Preflight) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "Artist - Song.mp3")
+	part.Write([]byte("ID3 preflight"))
+	mw.WriteField("dry_run", "true")
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	mw.Close()
+	req := httptest.NewRequest("POST", "/api/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	uploadHandler(rec, req)
+	var p Preflight
+	json.Unmarshal(rec.Body.Bytes(), &p)
+	return rec, p
+}
+
+func TestDryRunUpload(t *testing.T) {
+	oldUploadDir, oldOutputDir := uploadDir, outputDir
+	uploadDir, outputDir = t.TempDir(), t.TempDir()
+	t.Cleanup(func() { uploadDir, outputDir = oldUploadDir, oldOutputDir })
+	fakeFFprobe(t, `{"streams": [{"codec_name": "mp3", "sample_rate": "44100", "channels": 2}],
+	 "format": {"format_name": "mp3", "duration": "200.000000", "bit_rate": "320000"}}`)
+	jobsMutex.RLock()
+	before := len(jobs)
+	jobsMutex.RUnlock()
+
+	rec, p := dryRun(t, map[string]string{"model": "htdemucs_ft", "shifts": "1"})
+	if rec.Code != http.StatusOK || !p.Accepted {
+		t.Fatalf("dry run = %d: %s", rec.Code, rec.Body.String())
+	}
+	if p.Audio == nil || p.Audio.Format != "mp3" || p.Audio.DurationSeconds != 200 || p.Audio.Channels != 2 || p.Audio.SampleRate != 44100 {
+		t.Errorf("audio = %+v", p.Audio)
+	}
+	// 200 s of audio, four networks, two passes
+	if p.EstimatedProcessingSeconds != 1600 {
+		t.Errorf("estimated processing = %v s, want 1600", p.EstimatedProcessingSeconds)
+	}
+	if p.Options.Model != "htdemucs_ft" || p.EstimatedOutputBytes == 0 || p.SHA256 == "" || p.Metadata.Artist != "Artist" {
+		t.Errorf("preflight = %+v", p)
+	}
+	jobsMutex.RLock()
+	after := len(jobs)
+	jobsMutex.RUnlock()
+	if after != before {
+		t.Errorf("dry run created %d jobs", after-before)
+	}
+	if entries, _ := os.ReadDir(uploadDir); len(entries) != 0 {
+		t.Errorf("dry run left %d files in the upload directory", len(entries))
+	}
+
+	t.Setenv("ESTIMATE_REALTIME_FACTOR", "0.1")
+	if _, p := dryRun(t, map[string]string{"overlap": "0.5"}); math.Abs(p.EstimatedProcessingSeconds-36) > 0.01 {
+		t.Errorf("estimate on a fast processor = %v s, want 36", p.EstimatedProcessingSeconds)
+	}
+
+	// Options are still validated
+	if rec, _ := dryRun(t, map[string]string{"model": "nope"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("dry run with an invalid model = %d, want 400", rec.Code)
+	}
+}
+
+func TestDryRunRejectsUnreadableAudio(t *testing.T) {
+	oldUploadDir, oldOutputDir := uploadDir, outputDir
+	uploadDir, outputDir = t.TempDir(), t.TempDir()
+	t.Cleanup(func() { uploadDir, outputDir = oldUploadDir, oldOutputDir })
+
+	fakeFFprobe(t, "")
+	rec, p := dryRun(t, nil)
+	if rec.Code != http.StatusUnprocessableEntity || p.Accepted || len(p.Problems) != 1 {
+		t.Errorf("dry run of unreadable audio = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	fakeFFprobe(t, `{"streams": [], "format": {"format_name": "png_pipe"}}`)
+	if rec, _ := dryRun(t, nil); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("dry run of a file without audio = %d, want 422", rec.Code)
+	}
+}
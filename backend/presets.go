@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Separation presets, for audio other than music. preset=dme on an upload
+// separates a film or TV mix into the dialogue, music and effects stems
+// post-production calls a DME split; preset=field splits a field recording
+// into the clean foreground and the wind and handling noise. A preset picks
+// its model (unless the upload names one) and tells the processor which of
+// the model's stems to mix into each output, which is named after the
+// preset's stem (film_t2s_dialogue.wav):
+//
+//	dme    htdemucs_ft  dialogue = vocals, music = bass+other, effects = drums
+//	field  htdemucs     clean = vocals+other, noise = drums+bass
+//
+// Stems of the model a preset doesn't name (guitar and piano of a 6-stem
+// model) go into music and clean, so the outputs still add up to the input.
+// The music models only approximate these splits. PRESET_MODELS points a
+// preset at another model, typically a registered custom model fine-tuned
+// for it (PRESET_MODELS=dme=cinematic_dme,field=field_v1), which has to
+// separate the stems the preset mixes. GET /api/presets lists the presets
+// with their models and stems.
+
+// PresetStem is one output of a preset and the model stems mixed into it
+type PresetStem struct {
+	Name    string   `json:"name"`
+	Sources []string `json:"sources"`
+	Rest    bool     `json:"-"` // also takes the model's stems no other output names
+}
+
+// SeparationPreset maps a use case to a model and its outputs
+type SeparationPreset struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Model       string       `json:"model"`
+	Stems       []PresetStem `json:"stems"`
+}
+
+// separationPresets are the built-in presets, by name
+var separationPresets = map[string]SeparationPreset{
+	"dme": {
+		Name:        "dme",
+		Description: "Film and TV mixes split into dialogue, music and effects",
+		Model:       "htdemucs_ft",
+		Stems: []PresetStem{
+			{Name: "dialogue", Sources: []string{"vocals"}},
+			{Name: "music", Sources: []string{"bass", "other"}, Rest: true},
+			{Name: "effects", Sources: []string{"drums"}},
+		},
+	},
+	"field": {
+		Name:        "field",
+		Description: "Field recordings split into the clean foreground and wind and handling noise",
+		Model:       "htdemucs",
+		Stems: []PresetStem{
+			{Name: "clean", Sources: []string{"vocals", "other"}, Rest: true},
+			{Name: "noise", Sources: []string{"drums", "bass"}},
+		},
+	},
+}
+
+// parsePresetModels reads a PRESET_MODELS value, preset=model pairs
+func parsePresetModels(value string) (map[string]string, error) {
+	models := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		preset, model, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if _, known := separationPresets[preset]; !ok || !known || model == "" {
+			return nil, fmt.Errorf("PRESET_MODELS: invalid entry %q (preset=model, presets: %s)", pair, strings.Join(sortedKeys(separationPresets), ", "))
+		}
+		models[preset] = model
+	}
+	return models, nil
+}
+
+// lookupPreset returns a preset with its model as PRESET_MODELS sets it;
+// startup has checked the variable parses
+func lookupPreset(name string) (SeparationPreset, bool) {
+	p, ok := separationPresets[name]
+	if !ok {
+		return p, false
+	}
+	models, _ := parsePresetModels(os.Getenv("PRESET_MODELS"))
+	if model := models[name]; model != "" {
+		p.Model = model
+	}
+	return p, true
+}
+
+// stemGroups resolves the preset's outputs against what model separates,
+// or says which stem it can't make
+func (p SeparationPreset) stemGroups(model string) ([]PresetStem, error) {
+	stems := modelStems(model)
+	groups := make([]PresetStem, 0, len(p.Stems))
+	var used []string
+	for _, s := range p.Stems {
+		group := PresetStem{Name: s.Name, Sources: slices.Clone(s.Sources), Rest: s.Rest}
+		for _, source := range group.Sources {
+			if !slices.Contains(stems, source) {
+				return nil, fmt.Errorf("preset %s can't make its %s stem with model %s, which doesn't separate %s", p.Name, s.Name, model, source)
+			}
+		}
+		used = append(used, group.Sources...)
+		groups = append(groups, group)
+	}
+	for i := range groups {
+		if groups[i].Rest {
+			for _, stem := range stems {
+				if !slices.Contains(used, stem) {
+					groups[i].Sources = append(groups[i].Sources, stem)
+				}
+			}
+		}
+	}
+	return groups, nil
+}
+
+// formatStemGroups encodes groups for the processor's stem_groups field:
+// dialogue=vocals;music=bass+other
+func formatStemGroups(groups []PresetStem) string {
+	parts := make([]string, len(groups))
+	for i, g := range groups {
+		parts[i] = g.Name + "=" + strings.Join(g.Sources, "+")
+	}
+	return strings.Join(parts, ";")
+}
+
+// presetsHandler serves GET /api/presets
+func presetsHandler(w http.ResponseWriter, r *http.Request) {
+	list := make([]SeparationPreset, 0, len(separationPresets))
+	for _, name := range sortedKeys(separationPresets) {
+		p, _ := lookupPreset(name)
+		if groups, err := p.stemGroups(p.Model); err == nil {
+			p.Stems = groups
+		}
+		list = append(list, p)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"presets": list})
+}
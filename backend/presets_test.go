@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPresetJobOptions(t *testing.T) {
+	useCustomModels(t)
+	customModelsMutex.Lock()
+	customModels["cinematic"] = &CustomModel{Name: "cinematic", Stems: []string{"vocals", "drums", "bass", "other"}}
+	customModels["lab_vocals"] = &CustomModel{Name: "lab_vocals", Stems: []string{"vocals", "other"}}
+	customModelsMutex.Unlock()
+
+	opts, err := parseJobOptions(url.Values{"preset": {"dme"}}.Get)
+	if err != nil || opts.Model != "htdemucs_ft" || formatStemGroups(opts.StemGroups) != "dialogue=vocals;music=bass+other;effects=drums" {
+		t.Fatalf("dme = %+v, %v", opts, err)
+	}
+	if opts, err := parseJobOptions(url.Values{"preset": {"field"}, "model": {"htdemucs_6s"}}.Get); err != nil || formatStemGroups(opts.StemGroups) != "clean=vocals+other+guitar+piano;noise=drums+bass" {
+		t.Errorf("field with a model = %+v, %v", opts, err)
+	}
+	for values, want := range map[string]string{
+		"preset=karaoke": "Invalid preset value",
+		"preset=dme&stem_mode=isolate&isolate_stem=vocals": "stem_mode isolate",
+		"preset=dme&model=lab_vocals":                      "doesn't separate bass",
+	} {
+		q, _ := url.ParseQuery(values)
+		if _, err := parseJobOptions(q.Get); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s = %v, want %q", values, err, want)
+		}
+	}
+
+	t.Setenv("PRESET_MODELS", "dme=cinematic")
+	if opts, err := parseJobOptions(url.Values{"preset": {"dme"}}.Get); err != nil || opts.Model != "cinematic" {
+		t.Errorf("dme with PRESET_MODELS = %+v, %v", opts, err)
+	}
+	if _, err := parsePresetModels("dialogue=cinematic"); err == nil {
+		t.Error("PRESET_MODELS with an unknown preset accepted")
+	}
+}
+
+func TestIntegrationPresetJob(t *testing.T) {
+	b := newIntegrationBackend(t, 1)
+	job := b.waitFor(b.upload("film.wav", map[string]string{"preset": "field", "output_format": "wav"}).ID, "completed")
+	if job.Preset != "field" || job.Model != "htdemucs" || job.Effective.Preset != "field" {
+		t.Errorf("job = %+v", job)
+	}
+	if requests := b.processor.Requests(); len(requests) != 1 || requests[0]["preset"] != "field" || requests[0]["stem_groups"] != "clean=vocals+other;noise=drums+bass" {
+		t.Errorf("processor requests = %v", requests)
+	}
+
+	code, data := b.get("/api/presets")
+	var body struct {
+		Presets []SeparationPreset `json:"presets"`
+	}
+	json.Unmarshal(data, &body)
+	if code != http.StatusOK || len(body.Presets) != 2 || body.Presets[0].Name != "dme" || len(body.Presets[0].Stems) != 3 {
+		t.Errorf("presets = %d %s", code, data)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Processor capabilities, for fleets mixing CUDA, ROCm, Apple MPS and CPU
+// processors. Each instance has a device, a set of capability flags and
+// models it can't run; a job goes only to an instance that can run its
+// model and has every capability the job needs. Tags in PROCESSORS
+// (device=mps caps=deterministic exclude=htdemucs_6s) win; what an instance
+// leaves untagged is taken from its /health answer, and failing that the
+// device's defaults apply. A processor that reports nothing and isn't
+// tagged is taken to run everything, as before.
+
+// processorCapabilities are the flags a processor can have
+var processorCapabilities = []string{
+	"deterministic", // reproducible, byte-identical runs (deterministic=true)
+	"encrypted",     // holds the sealing key of encrypted jobs (encrypted=true)
+}
+
+// deviceCapabilities are the capabilities of each device unless tagged or
+// reported otherwise: ROCm and MPS kernels don't promise determinism.
+// gpu is an unspecified GPU, as PROCESSORS used to describe them.
+var deviceCapabilities = map[string][]string{
+	"cpu":  {"deterministic"},
+	"cuda": {"deterministic"},
+	"gpu":  {"deterministic"},
+	"rocm": {},
+	"mps":  {},
+}
+
+// processorReport is the hardware a processor describes in its /health
+type processorReport struct {
+	Device            string   `json:"device"`
+	Capabilities      []string `json:"capabilities"` // nil: not reported
+	UnsupportedModels []string `json:"unsupported_models"`
+	Version           string   `json:"version"` // upgrades are told apart by it, see drain.go
+}
+
+var (
+	processorReports      = make(map[string]*processorReport) // by processor URL
+	processorReportsMutex = &sync.Mutex{}
+)
+
+// noteProcessorReport records what a /health body reports; older
+// processors answer without these fields and report nothing
+func noteProcessorReport(url string, body io.Reader) {
+	var report processorReport
+	if err := json.NewDecoder(io.LimitReader(body, 64<<10)).Decode(&report); err != nil {
+		return
+	}
+	if _, known := deviceCapabilities[report.Device]; !known {
+		report.Device = ""
+	}
+	processorReportsMutex.Lock()
+	processorReports[url] = &report
+	processorReportsMutex.Unlock()
+}
+
+func (p *processorInstance) report() processorReport {
+	processorReportsMutex.Lock()
+	defer processorReportsMutex.Unlock()
+	if r := processorReports[p.URL]; r != nil {
+		return *r
+	}
+	return processorReport{}
+}
+
+// device returns the instance's device, empty when unknown
+func (p *processorInstance) device() string {
+	return cmp.Or(p.Device, p.report().Device)
+}
+
+func (p *processorInstance) capabilities() []string {
+	switch reported := p.report(); {
+	case p.Capabilities != nil:
+		return p.Capabilities
+	case reported.Capabilities != nil:
+		return reported.Capabilities
+	case p.device() == "":
+		return processorCapabilities
+	}
+	return deviceCapabilities[p.device()]
+}
+
+func (p *processorInstance) excluded() []string {
+	return append(slices.Clone(p.Exclude), p.report().UnsupportedModels...)
+}
+
+// processorNeeds is what a job requires of the processor it runs on
+type processorNeeds struct {
+	Model        string
+	Capabilities []string
+	Region       string // preferred, not required
+}
+
+func jobNeeds(opts jobOptions) processorNeeds {
+	needs := processorNeeds{Model: opts.Model}
+	if opts.Deterministic {
+		needs.Capabilities = append(needs.Capabilities, "deterministic")
+	}
+	if opts.Encrypted {
+		needs.Capabilities = append(needs.Capabilities, "encrypted")
+	}
+	return needs
+}
+
+func (n processorNeeds) String() string {
+	if len(n.Capabilities) == 0 {
+		return "model " + n.Model
+	}
+	return "model " + n.Model + " with " + strings.Join(n.Capabilities, ", ")
+}
+
+func (p *processorInstance) meets(needs processorNeeds) bool {
+	if !p.supports(needs.Model) {
+		return false
+	}
+	for _, c := range needs.Capabilities {
+		if !slices.Contains(p.capabilities(), c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseProcessorCapabilities(t *testing.T) {
+	list, err := parseProcessors("http://mac:5000 device=mps exclude=htdemucs_6s, http://rocm:5000 device=rocm caps=deterministic")
+	if err != nil {
+		t.Fatalf("parseProcessors: %v", err)
+	}
+	if list[0].Device != "mps" || !slices.Equal(list[0].Exclude, []string{"htdemucs_6s"}) || list[0].Capabilities != nil {
+		t.Errorf("mps = %+v", list[0])
+	}
+	if !slices.Equal(list[1].capabilities(), []string{"deterministic"}) {
+		t.Errorf("tagged rocm capabilities = %v", list[1].capabilities())
+	}
+	for _, bad := range []string{"http://gpu:5000 caps=fp8", "http://gpu:5000 exclude=whisper", "http://gpu:5000 device=tpu"} {
+		if _, err := parseProcessors(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestAcquireProcessorCapabilities(t *testing.T) {
+	mps := &processorInstance{URL: "http://mps", Device: "mps", Exclude: []string{"htdemucs_6s"}, Healthy: true}
+	cuda := &processorInstance{URL: "http://cuda", Device: "cuda", Healthy: true}
+	useProcessors(t, []*processorInstance{mps, cuda})
+
+	if p := acquireProcessor(processorNeeds{Model: "htdemucs"}, nil); p != mps {
+		t.Errorf("htdemucs job went to %v, want the mps (first listed)", p)
+	}
+	if p := acquireProcessor(processorNeeds{Model: "htdemucs_6s"}, map[string]bool{"http://cuda": true}); p != nil {
+		t.Errorf("htdemucs_6s job went to %v; the mps excludes it", p)
+	}
+	deterministic := jobNeeds(jobOptions{Model: "htdemucs", Deterministic: true})
+	if p := acquireProcessor(deterministic, map[string]bool{"http://cuda": true}); p != nil {
+		t.Errorf("deterministic job went to %v", p)
+	}
+	if p := acquireProcessor(deterministic, nil); p != cuda {
+		t.Errorf("deterministic job went to %v, want the cuda", p)
+	}
+	if got := deterministic.String(); got != "model htdemucs with deterministic" {
+		t.Errorf("needs = %q", got)
+	}
+}
+
+func TestProcessorReportedCapabilities(t *testing.T) {
+	reporting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "ok", "device": "rocm", "unsupported_models": ["mdx_q"]}`))
+	}))
+	defer reporting.Close()
+	silent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "ok"}`))
+	}))
+	defer silent.Close()
+	t.Cleanup(func() {
+		processorReportsMutex.Lock()
+		delete(processorReports, reporting.URL)
+		delete(processorReports, silent.URL)
+		processorReportsMutex.Unlock()
+	})
+	// Tags win over what the processor reports
+	t.Setenv("PROCESSORS", reporting.URL+", "+silent.URL+", "+reporting.URL+"/ device=cuda")
+	useProcessors(t, nil)
+	if err := loadProcessors(); err != nil {
+		t.Fatal(err)
+	}
+	checkProcessors()
+
+	list := registeredProcessors()
+	if list[0].device() != "rocm" || len(list[0].capabilities()) != 0 || list[0].supports("mdx_q") {
+		t.Errorf("reported rocm = %s %v %v", list[0].device(), list[0].capabilities(), list[0].excluded())
+	}
+	if list[1].device() != "" || !slices.Equal(list[1].capabilities(), processorCapabilities) {
+		t.Errorf("processor reporting nothing = %s %v", list[1].device(), list[1].capabilities())
+	}
+	if list[2].device() != "cuda" || !slices.Equal(list[2].capabilities(), []string{"deterministic"}) {
+		t.Errorf("tagged cuda = %s %v", list[2].device(), list[2].capabilities())
+	}
+
+	rec := httptest.NewRecorder()
+	listProcessorsHandler(rec, httptest.NewRequest("GET", "/api/admin/processors", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `"device":"rocm","healthy":true`) || !strings.Contains(body, `"exclude":["mdx_q"]`) {
+		t.Errorf("GET /api/admin/processors = %s", body)
+	}
+}
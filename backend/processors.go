@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Processor registry. PROCESSORS lists several processor instances, comma
+// separated, each a URL followed by optional space-separated tags:
+//
+//	PROCESSORS=http://processor-gpu:5000 device=cuda models=htdemucs_ft+htdemucs_6s, http://processor-cpu:5000 device=cpu
+//
+// models limits an instance to those models (all by default), exclude
+// leaves models out, device and caps describe its hardware (see
+// processorcaps.go), standby keeps it for jobs failing over (see
+// failover.go) and region places it in an upload region (see regions.go).
+// Every instance's /health is checked each PROCESSOR_HEALTH_INTERVAL
+// (default 15s). A job goes to the healthy instance meeting its
+// requirements with the fewest jobs in flight, preferring instances in
+// the job's region, earlier entries winning ties; when the instance can't be reached,
+// answers 502, 503 or 504 or stops responding mid-job it is marked
+// unhealthy and the job is sent to the next one before it is failed. Other
+// 5xx answers are about the job, not the instance, and fail the job there. Status and cancel requests
+// follow the job to its instance. Without PROCESSORS the single
+// PROCESSOR_URL is used as before; canary jobs always go to
+// CANARY_PROCESSOR_URL when it is set.
+
+const defaultProcessorHealthInterval = 15 * time.Second
+
+// processorInstance is one registered processor and its observed state
+type processorInstance struct {
+	URL       string     `json:"url"`
+	Device    string     `json:"device,omitempty"` // cpu, cuda, rocm, mps or gpu
+	Models    []string   `json:"models,omitempty"` // empty: every model
+	Healthy   bool       `json:"healthy"`
+	Active    int        `json:"active"` // jobs in flight
+	LastCheck *time.Time `json:"last_check,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+
+	Exclude      []string `json:"exclude,omitempty"`      // models it can't run
+	Capabilities []string `json:"capabilities,omitempty"` // nil: reported or the device's defaults
+	Standby      bool     `json:"standby,omitempty"`      // takes jobs handed off by others, see failover.go
+	Region       string   `json:"region,omitempty"`       // where it reads uploads from
+
+	Version string          `json:"version,omitempty"` // reported in /health, only in listings
+	Drain   *ProcessorDrain `json:"drain,omitempty"`   // upgrade in progress or last done, see drain.go
+}
+
+var (
+	processors      []*processorInstance
+	processorsMutex = &sync.Mutex{}
+)
+
+// parseProcessors reads a PROCESSORS value
+func parseProcessors(value string) ([]*processorInstance, error) {
+	var list []*processorInstance
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		p := &processorInstance{URL: strings.TrimSuffix(fields[0], "/"), Healthy: true}
+		if !strings.HasPrefix(p.URL, "http://") && !strings.HasPrefix(p.URL, "https://") {
+			return nil, fmt.Errorf("processor %q: URL must be http(s)", fields[0])
+		}
+		for _, tag := range fields[1:] {
+			key, val, _ := strings.Cut(tag, "=")
+			switch key {
+			case "device":
+				if _, known := deviceCapabilities[val]; !known {
+					return nil, fmt.Errorf("processor %s: device must be one of %s", p.URL, strings.Join(sortedKeys(deviceCapabilities), ", "))
+				}
+				p.Device = val
+			case "models", "exclude":
+				for _, model := range strings.Split(val, "+") {
+					if !isAllowedModel(model) {
+						return nil, fmt.Errorf("processor %s: unknown model %q", p.URL, model)
+					}
+					if key == "models" {
+						p.Models = append(p.Models, model)
+					} else {
+						p.Exclude = append(p.Exclude, model)
+					}
+				}
+			case "standby":
+				p.Standby = true
+			case "region":
+				if val == "" {
+					return nil, fmt.Errorf("processor %s: region needs a name", p.URL)
+				}
+				p.Region = val
+			case "caps":
+				p.Capabilities = []string{}
+				for _, c := range strings.Split(val, "+") {
+					if !slices.Contains(processorCapabilities, c) {
+						return nil, fmt.Errorf("processor %s: unknown capability %q", p.URL, c)
+					}
+					p.Capabilities = append(p.Capabilities, c)
+				}
+			default:
+				return nil, fmt.Errorf("processor %s: unknown tag %q", p.URL, tag)
+			}
+		}
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+// loadProcessors registers the PROCESSORS instances
+func loadProcessors() error {
+	list, err := parseProcessors(os.Getenv("PROCESSORS"))
+	if err != nil {
+		return err
+	}
+	processorsMutex.Lock()
+	processors = list
+	processorsMutex.Unlock()
+	return nil
+}
+
+func processorHealthInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("PROCESSOR_HEALTH_INTERVAL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultProcessorHealthInterval
+}
+
+func (p *processorInstance) supports(model string) bool {
+	return (len(p.Models) == 0 || slices.Contains(p.Models, model)) && !slices.Contains(p.excluded(), model)
+}
+
+// acquireProcessor picks the least-loaded healthy instance meeting a job's
+// needs that isn't in tried and counts the job against it. Standbys come
+// last for new jobs and first for jobs failing over (tried isn't empty);
+// among the rest, instances in the job's region come first.
+func acquireProcessor(needs processorNeeds, tried map[string]bool) *processorInstance {
+	processorsMutex.Lock()
+	defer processorsMutex.Unlock()
+	failover := len(tried) > 0
+	var best *processorInstance
+	for _, p := range processors {
+		if !p.Healthy || p.draining() || !p.meets(needs) || tried[p.URL] {
+			continue
+		}
+		if best == nil || p.preferredOver(best, needs.Region, failover) {
+			best = p
+		}
+	}
+	if best != nil {
+		best.Active++
+	}
+	return best
+}
+
+// preferredOver reports whether p should take a job rather than other
+func (p *processorInstance) preferredOver(other *processorInstance, region string, failover bool) bool {
+	if p.Standby != other.Standby {
+		return p.Standby == failover
+	}
+	if local := region != "" && p.Region == region; local != (region != "" && other.Region == region) {
+		return local
+	}
+	return p.Active < other.Active
+}
+
+// releaseProcessor ends a job's dispatch to p, marking p unhealthy when it
+// failed to handle the request
+func releaseProcessor(p *processorInstance, failure string) {
+	processorsMutex.Lock()
+	defer processorsMutex.Unlock()
+	p.Active--
+	if failure != "" {
+		p.Healthy, p.LastError = false, failure
+	}
+	p.advanceDrain(time.Now().UTC())
+}
+
+// checkProcessors probes every instance's /health
+func checkProcessors() {
+	client := newProcessorClient(5 * time.Second)
+	for _, p := range registeredProcessors() {
+		failure := ""
+		resp, err := client.Get(p.URL + "/health")
+		if err != nil {
+			failure = err.Error()
+		} else {
+			noteProcessorReport(p.URL, resp.Body)
+			resp.Body.Close()
+			noteProcessorHeaders(p.URL, resp.Header)
+			if resp.StatusCode != http.StatusOK {
+				failure = "health check returned " + resp.Status
+			}
+		}
+		now := time.Now().UTC()
+		processorsMutex.Lock()
+		if failure != "" && p.Healthy {
+			log.Printf("Processor %s is unhealthy: %s", p.URL, failure)
+		} else if failure == "" && !p.Healthy {
+			log.Printf("Processor %s is healthy again", p.URL)
+		}
+		p.Healthy, p.LastError, p.LastCheck = failure == "", failure, &now
+		p.advanceDrain(now)
+		processorsMutex.Unlock()
+	}
+}
+
+// processorHealthChecker checks the registered processors every interval
+func processorHealthChecker(interval time.Duration) {
+	for {
+		checkProcessors()
+		time.Sleep(interval)
+	}
+}
+
+// processorURLForJob returns the processor a job was sent to, or the one
+// its variant uses when it hasn't been sent yet
+func processorURLForJob(jobID, variant string) string {
+	jobsMutex.RLock()
+	var url string
+	if job, exists := jobs[jobID]; exists {
+		url = job.processorURL
+	}
+	jobsMutex.RUnlock()
+	if url != "" {
+		return url
+	}
+	return processorURLFor(variant)
+}
+
+// processRequest is a multipart /process (or /process/batch) request
+type processRequest struct {
+	Body        []byte
+	ContentType string
+	Fields      [][2]string // for debug captures
+	File        *debugFile
+	RequestID   string // X-Request-ID of the request that created the job
+
+	Compressible bool          // the file may be sent gzip-compressed
+	Path         string        // default /process
+	BatchJobs    []string      // the other jobs of a /process/batch request
+	Timeout      time.Duration // default PROCESSOR_TIMEOUT, see processortimeout.go
+}
+
+// postToProcessor sends a job to a processor, failing over to the next
+// registered instance while one can't be reached or is unavailable (see
+// processorUnavailable). It returns the last response's status code and body.
+func postToProcessor(ctx context.Context, jobID, variant string, needs processorNeeds, pr processRequest) (int, []byte, error) {
+	jobsMutex.RLock()
+	var pinned string
+	if job, exists := jobs[jobID]; exists {
+		pinned, needs.Region = job.pinnedProcessor, job.Region
+	}
+	jobsMutex.RUnlock()
+	sent := append([]string{jobID}, pr.BatchJobs...)
+	if pinned != "" {
+		setJobProcessor(pinned, sent...)
+		return sendProcessRequest(ctx, jobID, pinned, pr)
+	}
+	if c := canaryFromEnv(); len(registeredProcessors()) == 0 || (variant == variantCanary && c.ProcessorURL != "") {
+		target := processorURLFor(variant)
+		setJobProcessor(target, sent...)
+		return sendProcessRequest(ctx, jobID, target, pr)
+	}
+
+	tried := map[string]bool{}
+	var code int
+	var body []byte
+	var err error
+	for {
+		p := acquireProcessor(needs, tried)
+		if p == nil {
+			if len(tried) == 0 {
+				return 0, nil, fmt.Errorf("no healthy processor supports %s", needs)
+			}
+			return code, body, err
+		}
+		if len(tried) > 0 {
+			completeHandoff(sent, p.URL)
+		}
+		tried[p.URL] = true
+		setJobProcessor(p.URL, sent...)
+
+		attempt, cancel := context.WithCancelCause(ctx)
+		seen := &attemptProgress{}
+		go watchProcessor(attempt, cancel, jobID, p.URL, seen)
+		code, body, err = sendProcessRequest(attempt, jobID, p.URL, pr)
+		unresponsive := context.Cause(attempt) == errProcessorUnresponsive
+		cancel(nil)
+		if ctx.Err() != nil {
+			// The job was cancelled, not failed by the processor
+			releaseProcessor(p, "")
+			return code, body, err
+		}
+		failure := ""
+		switch {
+		case unresponsive:
+			failure, err = "stopped responding mid-job", errProcessorUnresponsive
+		case err != nil:
+			failure = err.Error()
+		case processorUnavailable(code):
+			failure = fmt.Sprintf("%s returned %d", cmp.Or(pr.Path, "/process"), code)
+		}
+		releaseProcessor(p, failure)
+		if failure == "" {
+			return code, body, err
+		}
+		recordHandoff(sent, p.URL, failure, seen)
+		log.Printf("Processor %s failed job %s (%s), trying another", p.URL, jobID, failure)
+	}
+}
+
+// processorUnavailable reports whether a /process status code says the
+// instance, rather than the job, is at fault. A 500 usually means the input
+// broke the model, which would break every instance in turn.
+func processorUnavailable(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+func registeredProcessors() []*processorInstance {
+	processorsMutex.Lock()
+	defer processorsMutex.Unlock()
+	return slices.Clone(processors)
+}
+
+// setJobProcessor records where a job was sent
+func setJobProcessor(url string, jobIDs ...string) {
+	jobsMutex.Lock()
+	for _, jobID := range jobIDs {
+		if job, exists := jobs[jobID]; exists {
+			job.processorURL = url
+		}
+	}
+	jobsMutex.Unlock()
+}
+
+// sendProcessRequest POSTs a job to one processor's /process
+func sendProcessRequest(ctx context.Context, jobID, processorURL string, pr processRequest) (int, []byte, error) {
+	gzipped := pr.Compressible && processorAcceptsGzip(processorURL)
+	var body io.Reader = bytes.NewReader(pr.Body)
+	if gzipped {
+		body = gzipStream(pr.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", processorURL+cmp.Or(pr.Path, "/process"), body)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", pr.ContentType)
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if pr.RequestID != "" {
+		req.Header.Set("X-Request-ID", pr.RequestID)
+	}
+	capture := newDebugExchange(req)
+	if capture != nil {
+		capture.FormFields = pr.Fields
+		capture.File = pr.File
+	}
+
+	timeout := cmp.Or(pr.Timeout, processorTimeoutEnv("PROCESSOR_TIMEOUT", defaultProcessorTimeout))
+	client := newProcessorClient(timeout)
+	resp, err := client.Do(req)
+	if err != nil {
+		capture.finish(jobID, nil, nil, err)
+		if ctx.Err() == nil {
+			recordProcessorError(processorURL)
+		}
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	capture.finish(jobID, resp, respBody, err)
+	noteProcessorHeaders(processorURL, resp.Header)
+	if gzipped && resp.StatusCode == http.StatusUnsupportedMediaType {
+		// The processor no longer takes gzip: send it as it is
+		pr.Compressible = false
+		return sendProcessRequest(ctx, jobID, processorURL, pr)
+	}
+	if err != nil || resp.StatusCode != http.StatusOK {
+		recordProcessorError(processorURL)
+	}
+	return resp.StatusCode, respBody, err
+}
+
+// noteProcessorHeaders records what a processor response says it supports
+func noteProcessorHeaders(url string, header http.Header) {
+	noteProcessorEncodings(url, header)
+	noteProcessorBatchLimit(url, header)
+}
+
+// listProcessorsHandler serves GET /api/admin/processors
+func listProcessorsHandler(w http.ResponseWriter, r *http.Request) {
+	processorsMutex.Lock()
+	list := make([]processorInstance, 0, len(processors))
+	for _, p := range processors {
+		list = append(list, listedProcessor(p))
+	}
+	processorsMutex.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
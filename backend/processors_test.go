@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// useProcessors registers list for the test
+func useProcessors(t *testing.T, list []*processorInstance) {
+	processorsMutex.Lock()
+	old := processors
+	processors = list
+	processorsMutex.Unlock()
+	t.Cleanup(func() {
+		processorsMutex.Lock()
+		processors = old
+		processorsMutex.Unlock()
+	})
+}
+
+func TestParseProcessors(t *testing.T) {
+	list, err := parseProcessors("http://gpu:5000/ device=gpu models=htdemucs_ft+htdemucs_6s, ,http://cpu:5000 device=cpu")
+	if err != nil {
+		t.Fatalf("parseProcessors: %v", err)
+	}
+	want := []*processorInstance{
+		{URL: "http://gpu:5000", Device: "gpu", Models: []string{"htdemucs_ft", "htdemucs_6s"}, Healthy: true},
+		{URL: "http://cpu:5000", Device: "cpu", Healthy: true},
+	}
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("parseProcessors = %+v, %+v", list[0], list[1])
+	}
+	for _, bad := range []string{"gpu:5000", "http://gpu:5000 device=tpu", "http://gpu:5000 models=whisper", "http://gpu:5000 zone=eu", "http://gpu:5000 region="} {
+		if _, err := parseProcessors(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestAcquireProcessorLeastLoaded(t *testing.T) {
+	gpu := &processorInstance{URL: "http://gpu", Models: []string{"htdemucs_ft"}, Healthy: true}
+	cpu := &processorInstance{URL: "http://cpu", Healthy: true}
+	spare := &processorInstance{URL: "http://spare", Healthy: true}
+	useProcessors(t, []*processorInstance{gpu, cpu, spare})
+
+	if p := acquireProcessor(processorNeeds{Model: "htdemucs_ft"}, nil); p != gpu {
+		t.Errorf("first htdemucs_ft job went to %v, want the gpu (first listed)", p)
+	}
+	if p := acquireProcessor(processorNeeds{Model: "htdemucs_ft"}, nil); p != cpu {
+		t.Errorf("second htdemucs_ft job went to %v, want the idle cpu", p)
+	}
+	if p := acquireProcessor(processorNeeds{Model: "htdemucs"}, nil); p != spare {
+		t.Errorf("htdemucs job went to %v, want the idle spare", p)
+	}
+	releaseProcessor(spare, "connection refused")
+	if p := acquireProcessor(processorNeeds{Model: "htdemucs"}, map[string]bool{"http://cpu": true}); p != nil {
+		t.Errorf("htdemucs job went to %v; the gpu lacks the model and the spare is down", p)
+	}
+	if gpu.Active != 1 || cpu.Active != 1 || spare.Active != 0 || spare.Healthy {
+		t.Errorf("state = gpu %+v, cpu %+v, spare %+v", gpu, cpu, spare)
+	}
+}
+
+func TestProcessorHealthChecks(t *testing.T) {
+	up := newMockProcessor(t)
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "loading model", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	t.Setenv("PROCESSORS", up.URL+" device=gpu, "+down.URL)
+	useProcessors(t, nil)
+	if err := loadProcessors(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkProcessors()
+	list := registeredProcessors()
+	if !list[0].Healthy || list[0].LastCheck == nil || list[1].Healthy || list[1].LastError == "" {
+		t.Errorf("after checks: %+v, %+v", list[0], list[1])
+	}
+
+	rec := httptest.NewRecorder()
+	listProcessorsHandler(rec, httptest.NewRequest("GET", "/api/admin/processors", nil))
+	var listed []processorInstance
+	json.Unmarshal(rec.Body.Bytes(), &listed)
+	if len(listed) != 2 || listed[0].Device != "gpu" || listed[1].Healthy {
+		t.Errorf("GET /api/admin/processors = %s", rec.Body.String())
+	}
+}
+
+func TestProcessorFailover(t *testing.T) {
+	outputDir = t.TempDir()
+	m := newMockProcessor(t)
+	var failing atomic.Int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failing.Add(1)
+		http.Error(w, "CUDA out of memory", http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	useProcessors(t, []*processorInstance{{URL: broken.URL, Healthy: true}, {URL: m.URL, Healthy: true}})
+
+	input := filepath.Join(t.TempDir(), "song.mp3")
+	os.WriteFile(input, []byte("ID3"), 0644)
+	id := uuid.New().String()
+	jobsMutex.Lock()
+	jobs[id] = &Job{ID: id, Status: "queued"}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+	})
+
+	processJob(id, input, jobOptions{StemMode: "all", Model: "htdemucs", OutputFormat: "mp3"})
+	jobsMutex.RLock()
+	status, sentTo := jobs[id].Status, jobs[id].processorURL
+	jobsMutex.RUnlock()
+	if status != "completed" || sentTo != m.URL || failing.Load() != 1 || len(m.Requests()) != 1 {
+		t.Errorf("job %s on %s after %d failed dispatches, want completed on the mock", status, sentTo, failing.Load())
+	}
+	if list := registeredProcessors(); list[0].Healthy || list[0].Active != 0 || list[1].Active != 0 {
+		t.Errorf("processors after failover: %+v, %+v", list[0], list[1])
+	}
+	if got := processorURLForJob(id, ""); got != m.URL {
+		t.Errorf("status and cancel go to %s, want %s", got, m.URL)
+	}
+
+	// With every instance down the job fails instead of waiting
+	processorsMutex.Lock()
+	processors[1].Healthy = false
+	processorsMutex.Unlock()
+	id2 := uuid.New().String()
+	jobsMutex.Lock()
+	jobs[id2] = &Job{ID: id2, Status: "queued"}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id2)
+		jobsMutex.Unlock()
+	})
+	processJob(id2, input, jobOptions{StemMode: "all", Model: "htdemucs", OutputFormat: "mp3"})
+	jobsMutex.RLock()
+	defer jobsMutex.RUnlock()
+	if jobs[id2].Status != "failed" || jobs[id2].Error != "Failed to process: no healthy processor supports model htdemucs" {
+		t.Errorf("job = %s (%q), want failed with no processor available", jobs[id2].Status, jobs[id2].Error)
+	}
+}
+
+func TestBadJobDoesntDrainPool(t *testing.T) {
+	outputDir = t.TempDir()
+	var calls atomic.Int32
+	choke := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/process" {
+			calls.Add(1)
+			http.Error(w, "demucs: input has no audio frames", http.StatusInternalServerError)
+		}
+	}
+	first := httptest.NewServer(http.HandlerFunc(choke))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(choke))
+	defer second.Close()
+	useProcessors(t, []*processorInstance{{URL: first.URL, Healthy: true}, {URL: second.URL, Healthy: true}})
+
+	input := filepath.Join(t.TempDir(), "song.mp3")
+	os.WriteFile(input, []byte("ID3"), 0644)
+	id := uuid.New().String()
+	jobsMutex.Lock()
+	jobs[id] = &Job{ID: id, Status: "queued"}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+	})
+
+	processJob(id, input, jobOptions{StemMode: "all", Model: "htdemucs", OutputFormat: "mp3"})
+	jobsMutex.RLock()
+	status, handoffs := jobs[id].Status, len(jobs[id].Handoffs)
+	jobsMutex.RUnlock()
+	if status != "failed" || calls.Load() != 1 || handoffs != 0 {
+		t.Errorf("job %s after %d dispatches and %d handoffs, want failed once", status, calls.Load(), handoffs)
+	}
+	for _, p := range registeredProcessors() {
+		if !p.Healthy || p.Active != 0 {
+			t.Errorf("processor after a bad job = %+v", p)
+		}
+	}
+}
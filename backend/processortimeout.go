@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Processor timeouts. A processor request gets time for the audio it
+// carries instead of a flat half hour: the preflight processing estimate
+// (duration, model, shifts, overlap; see estimateProcessingSeconds),
+// corrected by how long the processors have actually taken for the model
+// so far, times PROCESSOR_TIMEOUT_MARGIN (default 3). The result is kept
+// between PROCESSOR_TIMEOUT_MIN (default 2m), so a stuck 10-second clip
+// fails within minutes, and PROCESSOR_TIMEOUT_MAX (default 6h), which a
+// 70-minute set on a slow model still fits in. Audio ffprobe can't measure
+// gets PROCESSOR_TIMEOUT (default 30m).
+
+const (
+	defaultProcessorTimeout    = 30 * time.Minute
+	defaultProcessorTimeoutMin = 2 * time.Minute
+	defaultProcessorTimeoutMax = 6 * time.Hour
+	defaultProcessorMargin     = 3
+
+	// processorSpeedWeight is how much each finished request moves a
+	// model's observed speed
+	processorSpeedWeight = 0.2
+)
+
+var (
+	// processorSpeeds is, per model, the observed processing time over
+	// the estimate, a moving average of successful requests
+	processorSpeeds      = make(map[string]float64)
+	processorSpeedsMutex = &sync.Mutex{}
+)
+
+func processorTimeoutEnv(key string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+func processorTimeoutMargin() float64 {
+	if f, err := strconv.ParseFloat(os.Getenv("PROCESSOR_TIMEOUT_MARGIN"), 64); err == nil && f >= 1 {
+		return f
+	}
+	return defaultProcessorMargin
+}
+
+// processorSpeed returns how a model's requests compare to the estimate,
+// 1 until one has finished
+func processorSpeed(model string) float64 {
+	processorSpeedsMutex.Lock()
+	defer processorSpeedsMutex.Unlock()
+	if speed, known := processorSpeeds[model]; known {
+		return speed
+	}
+	return 1
+}
+
+// observeProcessorSpeed records how long a successful request for audio
+// with the given estimate took
+func observeProcessorSpeed(model string, estimate float64, elapsed time.Duration) {
+	if estimate <= 0 {
+		return
+	}
+	ratio := elapsed.Seconds() / estimate
+	processorSpeedsMutex.Lock()
+	if speed, known := processorSpeeds[model]; known {
+		ratio = speed + processorSpeedWeight*(ratio-speed)
+	}
+	processorSpeeds[model] = ratio
+	processorSpeedsMutex.Unlock()
+}
+
+// processorEstimate returns the estimated processing seconds of the jobs
+// of one request, 0 when a clip's duration is unknown
+func processorEstimate(jobIDs []string, opts jobOptions) float64 {
+	var estimate float64
+	for _, id := range jobIDs {
+		seconds := clipSeconds(id)
+		if seconds <= 0 {
+			return 0
+		}
+		estimate += estimateProcessingSeconds(seconds, opts)
+	}
+	return estimate
+}
+
+// processorTimeout returns how long a request with the given estimate
+// may take
+func processorTimeout(estimate float64, model string) time.Duration {
+	if estimate <= 0 {
+		return processorTimeoutEnv("PROCESSOR_TIMEOUT", defaultProcessorTimeout)
+	}
+	seconds := estimate * processorSpeed(model) * processorTimeoutMargin()
+	timeout := time.Duration(math.Ceil(seconds)) * time.Second
+	lo := processorTimeoutEnv("PROCESSOR_TIMEOUT_MIN", defaultProcessorTimeoutMin)
+	hi := max(processorTimeoutEnv("PROCESSOR_TIMEOUT_MAX", defaultProcessorTimeoutMax), lo)
+	return min(max(timeout, lo), hi)
+}
+
+// processorBudget returns the estimate and timeout of a request for jobIDs
+func processorBudget(jobIDs []string, opts jobOptions) (float64, time.Duration) {
+	estimate := processorEstimate(jobIDs, opts)
+	timeout := processorTimeout(estimate, opts.Model)
+	log.Printf("Job %s: processor timeout %s (estimated %.0fs)", jobIDs[0], timeout, estimate)
+	return estimate, timeout
+}
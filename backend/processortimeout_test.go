@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessorTimeout(t *testing.T) {
+	processorSpeedsMutex.Lock()
+	saved := processorSpeeds
+	processorSpeeds = make(map[string]float64)
+	processorSpeedsMutex.Unlock()
+	t.Cleanup(func() {
+		processorSpeedsMutex.Lock()
+		processorSpeeds = saved
+		processorSpeedsMutex.Unlock()
+	})
+
+	if got := processorTimeout(0, "htdemucs"); got != 30*time.Minute {
+		t.Errorf("unknown duration = %s", got)
+	}
+	t.Setenv("PROCESSOR_TIMEOUT", "45m")
+	if got := processorTimeout(0, "htdemucs"); got != 45*time.Minute {
+		t.Errorf("PROCESSOR_TIMEOUT = %s", got)
+	}
+
+	// A short clip gets the minimum, a long set more than half an hour
+	opts := jobOptions{Model: "htdemucs", Shifts: "0", Overlap: "0.25"}
+	if got := processorTimeout(estimateProcessingSeconds(10, opts), "htdemucs"); got != 2*time.Minute {
+		t.Errorf("10s clip = %s", got)
+	}
+	long := estimateProcessingSeconds(70*60, opts)
+	if got := processorTimeout(long, "htdemucs"); got != 210*time.Minute {
+		t.Errorf("70 minute set = %s", got)
+	}
+	if got := processorTimeout(long*10, "htdemucs"); got != 6*time.Hour {
+		t.Errorf("capped = %s", got)
+	}
+
+	// Requests that took twice the estimate double the timeout
+	set := estimateProcessingSeconds(40*60, opts)
+	observeProcessorSpeed("htdemucs", 100, 200*time.Second)
+	if got := processorTimeout(set, "htdemucs"); got != 240*time.Minute {
+		t.Errorf("after slow requests = %s", got)
+	}
+	if got := processorTimeout(set, "htdemucs_ft"); got != 120*time.Minute {
+		t.Errorf("other model = %s", got)
+	}
+	observeProcessorSpeed("htdemucs", 100, 100*time.Second)
+	if got := processorSpeed("htdemucs"); got != 1.8 {
+		t.Errorf("speed = %g, want the moving average 1.8", got)
+	}
+}
+
+func TestIntegrationProcessorTimeout(t *testing.T) {
+	t.Setenv("PROCESSOR_TIMEOUT_MIN", "100ms")
+	t.Setenv("PROCESSOR_TIMEOUT_MAX", "1s")
+	fakeFFprobe(t, `{"streams":[{"codec_name":"mp3","channels":2}],"format":{"format_name":"mp3","duration":"10"}}`)
+	b := newIntegrationBackend(t, 1)
+
+	job := b.waitFor(b.upload("hang.mp3", nil).ID, "failed")
+	if !strings.Contains(job.Error, "Failed to process") {
+		t.Errorf("stuck clip error = %q", job.Error)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// GET /api/jobs/{id}/events streams a job's progress as server-sent events,
+// so clients don't have to poll /api/processing-status. Each job with
+// listeners has one feed: a goroutine polls the processor while the job runs
+// and lifecycle events are pushed as they happen, and every change is fanned
+// out to the connected clients. The stream ends when the job finishes.
+// With ?since= the route replays the job's logged events (see eventlog.go).
+
+// jobProgress is the data of each progress event
+type jobProgress struct {
+	Status        string  `json:"status"`
+	Progress      float64 `json:"progress"`
+	Stage         string  `json:"stage,omitempty"`
+	Elapsed       string  `json:"elapsed,omitempty"`
+	QueuePosition int     `json:"queue_position,omitempty"`
+	Error         string  `json:"error,omitempty"`
+	// ReadyStems can be downloaded before the job completes
+	ReadyStems []string `json:"ready_stems,omitempty"`
+	// Handoffs counts moves to another processor, each restarting progress
+	Handoffs int `json:"handoffs,omitempty"`
+	// SchemaVersion is only set on the progress stream, see eventschema.go
+	SchemaVersion int `json:"schema_version,omitempty"`
+}
+
+func (p jobProgress) finished() bool {
+	return p.Status == "completed" || p.Status == "failed" || p.Status == "deleted" || p.Status == "expired"
+}
+
+// progressFeed fans one job's updates out to its subscribers
+type progressFeed struct {
+	subscribers map[chan jobProgress]struct{}
+	last        jobProgress
+}
+
+var (
+	progressFeeds      = make(map[string]*progressFeed)
+	progressFeedsMutex = &sync.Mutex{}
+
+	progressPollInterval = time.Second
+	keepaliveInterval    = 15 * time.Second
+)
+
+// subscribeProgress returns a channel of a job's updates and a function
+// that stops them. The channel holds only the latest update, so a slow
+// client skips intermediate ones instead of blocking the feed.
+func subscribeProgress(jobID string) (<-chan jobProgress, func()) {
+	ch := make(chan jobProgress, 1)
+	progressFeedsMutex.Lock()
+	feed, exists := progressFeeds[jobID]
+	if !exists {
+		feed = &progressFeed{subscribers: make(map[chan jobProgress]struct{})}
+		progressFeeds[jobID] = feed
+		go pollProgress(jobID, feed)
+	}
+	feed.subscribers[ch] = struct{}{}
+	progressFeedsMutex.Unlock()
+
+	return ch, func() {
+		progressFeedsMutex.Lock()
+		delete(feed.subscribers, ch)
+		progressFeedsMutex.Unlock()
+	}
+}
+
+// publish sends an update to every subscriber unless nothing changed.
+// Callers hold progressFeedsMutex.
+func (f *progressFeed) publish(p jobProgress) {
+	if reflect.DeepEqual(p, f.last) {
+		return
+	}
+	f.last = p
+	for ch := range f.subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- p
+	}
+}
+
+// pollProgress keeps a feed up to date until it loses its subscribers or
+// the job finishes
+func pollProgress(jobID string, feed *progressFeed) {
+	ticker := time.NewTicker(progressPollInterval)
+	defer ticker.Stop()
+	for {
+		p := currentProgress(jobID)
+		progressFeedsMutex.Lock()
+		feed.publish(p)
+		if len(feed.subscribers) == 0 || p.finished() {
+			delete(progressFeeds, jobID)
+			progressFeedsMutex.Unlock()
+			return
+		}
+		progressFeedsMutex.Unlock()
+		<-ticker.C
+	}
+}
+
+// currentProgress combines the job's status with the processor's progress
+// while it runs
+func currentProgress(jobID string) jobProgress {
+	jobsMutex.RLock()
+	job, exists := jobs[jobID]
+	var snapshot Job
+	if exists {
+		snapshot = job.snapshot()
+	}
+	jobsMutex.RUnlock()
+	if !exists {
+		return jobProgress{Status: "deleted"}
+	}
+	p := progressFromJob(snapshot)
+	if p.Status == "processing" && !externalWorkers {
+		if status, err := fetchProcessorStatus(jobID, snapshot.Variant); err == nil {
+			if status.Progress > 0 {
+				p.Progress, p.Stage, p.Elapsed = status.Progress, status.Stage, status.Elapsed
+			}
+			if len(status.ReadyStems) > 0 {
+				p.ReadyStems = status.ReadyStems
+			}
+		}
+	}
+	return p
+}
+
+// progressFromJob describes a job from its own state alone
+func progressFromJob(job Job) jobProgress {
+	p := jobProgress{Status: job.Status, Error: job.Error, Handoffs: len(job.Handoffs)}
+	switch job.Status {
+	case "queued":
+		p.QueuePosition = processingQueue.position(job.ID)
+		p.Stage = "Waiting in queue"
+	case "processing":
+		p.Stage, p.ReadyStems = "Processing", job.ReadyStems
+	case "completed":
+		p.Progress, p.Stage = 100, "Done!"
+	case "failed":
+		p.Stage = "Processing failed"
+	case "expired":
+		p.Progress, p.Stage = 100, "Expired"
+	}
+	return p
+}
+
+// fetchProcessorStatus reads the processor's progress for a job
+func fetchProcessorStatus(jobID, variant string) (jobProgress, error) {
+	code, body, err := processorStatus(jobID, variant)
+	if err != nil {
+		return jobProgress{}, err
+	}
+	if code != http.StatusOK {
+		return jobProgress{}, fmt.Errorf("processor returned %d", code)
+	}
+	var p jobProgress
+	if err = json.Unmarshal(body, &p); err != nil {
+		return p, err
+	}
+	p.ReadyStems = readyStemsFromStatus(jobID, body)
+	return p, nil
+}
+
+// publishJobProgress pushes lifecycle events to the job's feed right away
+// instead of waiting for the next poll
+func publishJobProgress(e Event) {
+	p := progressFromJob(e.Job)
+	if e.Type == EventJobDeleted {
+		p = jobProgress{Status: "deleted"}
+	}
+	progressFeedsMutex.Lock()
+	if feed, exists := progressFeeds[e.Job.ID]; exists {
+		feed.publish(p)
+	}
+	progressFeedsMutex.Unlock()
+}
+
+func jobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("since") {
+		replayJobEventsHandler(w, r)
+		return
+	}
+	jobID := mux.Vars(r)["id"]
+	if !isValidJobID(jobID) {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	jobsMutex.RLock()
+	_, exists := jobs[jobID]
+	jobsMutex.RUnlock()
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // stop nginx buffering the stream
+	w.WriteHeader(http.StatusOK)
+
+	updates, unsubscribe := subscribeProgress(jobID)
+	defer unsubscribe()
+	send := func(p jobProgress) {
+		p.SchemaVersion = eventSchemaVersion
+		data, _ := json.Marshal(p)
+		fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+	// The feed only sends changes, so start with the current state
+	current := currentProgress(jobID)
+	send(current)
+	if current.finished() {
+		return
+	}
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case p := <-updates:
+			send(p)
+			if p.finished() {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func TestJobEventsStream(t *testing.T) {
+	oldInterval := progressPollInterval
+	progressPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { progressPollInterval = oldInterval })
+	processor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"processing","progress":42,"stage":"Separating"}`))
+	}))
+	defer processor.Close()
+	t.Setenv("PROCESSOR_URL", processor.URL)
+
+	jobID := uuid.New().String()
+	jobsMutex.Lock()
+	jobs[jobID] = &Job{ID: jobID, Status: "processing"}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, jobID)
+		jobsMutex.Unlock()
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/jobs/{id}/events", jobEventsHandler)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/api/jobs/" + jobID + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	events := make(chan jobProgress)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var p jobProgress
+				json.Unmarshal([]byte(data), &p)
+				events <- p
+			}
+		}
+	}()
+
+	if p := <-events; p.Status != "processing" || p.Progress != 42 || p.Stage != "Separating" {
+		t.Fatalf("first event = %+v", p)
+	}
+	jobsMutex.Lock()
+	jobs[jobID].Status = "completed"
+	jobsMutex.Unlock()
+	publishJobProgress(Event{Type: EventJobCompleted, Job: Job{ID: jobID, Status: "completed"}})
+
+	var last jobProgress
+	for p := range events {
+		last = p
+	}
+	if last.Status != "completed" || last.Progress != 100 {
+		t.Errorf("last event = %+v, want completed", last)
+	}
+}
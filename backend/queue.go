@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Accepted jobs wait in a FIFO queue with status "queued" until one of
+// MAX_CONCURRENT_JOBS workers (default 1) sends them to the processor, so a
+// burst of uploads can't start more Demucs runs than the processor has
+// memory for. On shutdown the queue stops handing out work and waits for the
+// running jobs to finish; those still running after SHUTDOWN_TIMEOUT are
+// cancelled.
+//
+// Uploads of up to INTERACTIVE_MAX_SECONDS (default 60, measured with
+// ffprobe; 0 turns it off) are marked interactive. Besides being taken in
+// order by the regular workers, they have a fast lane: FAST_LANE_WORKERS
+// (default 1) more workers that only run interactive jobs, so a 30-second
+// clip doesn't wait behind three albums. The fast lane runs on top of
+// MAX_CONCURRENT_JOBS, so the processor should have room for one more run.
+
+// jobQueue is the FIFO of queued job IDs shared by the workers
+type jobQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  []string
+	running  int
+	draining bool
+	workers  sync.WaitGroup
+
+	interactive map[string]bool // queued jobs the fast lane may take
+}
+
+var processingQueue = newJobQueue()
+
+func newJobQueue() *jobQueue {
+	q := &jobQueue{interactive: make(map[string]bool)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// maxConcurrentJobs reads MAX_CONCURRENT_JOBS (default 1)
+func maxConcurrentJobs() int {
+	if n, err := strconv.Atoi(os.Getenv("MAX_CONCURRENT_JOBS")); err == nil && n > 0 {
+		return n
+	}
+	return 1
+}
+
+// shutdownTimeout bounds how long shutdown waits for running jobs
+// (SHUTDOWN_TIMEOUT, default 10m)
+func shutdownTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return 10 * time.Minute
+}
+
+// interactiveMaxSeconds reads INTERACTIVE_MAX_SECONDS (default 60)
+func interactiveMaxSeconds() float64 {
+	if s, err := strconv.ParseFloat(os.Getenv("INTERACTIVE_MAX_SECONDS"), 64); err == nil && s >= 0 {
+		return s
+	}
+	return 60
+}
+
+// fastLaneWorkers reads FAST_LANE_WORKERS (default 1)
+func fastLaneWorkers() int {
+	if n, err := strconv.Atoi(os.Getenv("FAST_LANE_WORKERS")); err == nil && n >= 0 {
+		return n
+	}
+	return 1
+}
+
+// push appends a job, for the fast lane too when it is interactive; it
+// reports false once the queue is draining
+func (q *jobQueue) push(jobID string, interactive bool) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.draining {
+		return false
+	}
+	q.pending = append(q.pending, jobID)
+	if interactive {
+		q.interactive[jobID] = true
+	}
+	// Fast lane workers only wake up for interactive jobs
+	q.cond.Broadcast()
+	return true
+}
+
+// remove drops a job that hasn't started yet
+func (q *jobQueue) remove(jobID string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, id := range q.pending {
+		if id == jobID {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			delete(q.interactive, jobID)
+			return true
+		}
+	}
+	return false
+}
+
+// queued returns the waiting jobs in order
+func (q *jobQueue) queued() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string(nil), q.pending...)
+}
+
+// take removes the given jobs that are still waiting and counts them as
+// running, for a worker that runs them together; it returns those taken
+func (q *jobQueue) take(jobIDs []string) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var taken []string
+	for _, id := range jobIDs {
+		if i := slices.Index(q.pending, id); i >= 0 {
+			q.pending = slices.Delete(q.pending, i, i+1)
+			delete(q.interactive, id)
+			taken = append(taken, id)
+		}
+	}
+	q.running += len(taken)
+	return taken
+}
+
+// position returns a queued job's 1-based place in line, or 0; an
+// interactive job's place is among the interactive jobs
+func (q *jobQueue) position(jobID string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	place := 0
+	for _, id := range q.pending {
+		if !q.interactive[jobID] || q.interactive[id] {
+			place++
+		}
+		if id == jobID {
+			return place
+		}
+	}
+	return 0
+}
+
+// stats returns the number of queued and running jobs
+func (q *jobQueue) stats() (queued, running int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending), q.running
+}
+
+// next blocks until a job is queued, an interactive one for the fast lane;
+// ok is false when draining
+func (q *jobQueue) next(fastLane bool) (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := -1
+	for !q.draining {
+		if i = q.nextIndex(fastLane); i >= 0 {
+			break
+		}
+		q.cond.Wait()
+	}
+	if q.draining {
+		return "", false
+	}
+	jobID := q.pending[i]
+	q.pending = slices.Delete(q.pending, i, i+1)
+	delete(q.interactive, jobID)
+	q.running++
+	return jobID, true
+}
+
+// nextIndex returns where the job a worker takes next is, or -1
+func (q *jobQueue) nextIndex(fastLane bool) int {
+	if !fastLane {
+		if len(q.pending) == 0 {
+			return -1
+		}
+		return 0
+	}
+	return slices.IndexFunc(q.pending, func(id string) bool { return q.interactive[id] })
+}
+
+func (q *jobQueue) done() {
+	q.mu.Lock()
+	q.running--
+	q.mu.Unlock()
+}
+
+// start runs n workers that process jobs with run
+func (q *jobQueue) start(n int, run func(jobID string)) {
+	q.startWorkers(n, false, run)
+}
+
+// startFastLane runs n workers that only process interactive jobs
+func (q *jobQueue) startFastLane(n int, run func(jobID string)) {
+	q.startWorkers(n, true, run)
+}
+
+func (q *jobQueue) startWorkers(n int, fastLane bool, run func(jobID string)) {
+	for i := 0; i < n; i++ {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			for {
+				jobID, ok := q.next(fastLane)
+				if !ok {
+					return
+				}
+				run(jobID)
+				q.done()
+			}
+		}()
+	}
+}
+
+// drain stops handing out jobs and waits for running ones until ctx ends.
+// It returns the jobs left in the queue.
+func (q *jobQueue) drain(ctx context.Context) []string {
+	q.mu.Lock()
+	q.draining = true
+	left := append([]string(nil), q.pending...)
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	if !q.wait(ctx) {
+		_, running := q.stats()
+		log.Printf("Shutdown timeout with %d jobs still running", running)
+	}
+	return left
+}
+
+// wait waits for the workers of a draining queue to exit until ctx ends;
+// it reports whether they did
+func (q *jobQueue) wait(ctx context.Context) bool {
+	finished := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// enqueueJob marks a job queued and adds it to the processing queue
+func enqueueJob(jobID string) {
+	interactive := isInteractive(jobID)
+	jobsMutex.Lock()
+	if job, exists := jobs[jobID]; exists {
+		job.Status = "queued"
+		job.Interactive = interactive
+	}
+	jobsMutex.Unlock()
+	if !processingQueue.push(jobID, interactive) {
+		updateJobError(jobID, errShuttingDown.Error())
+	}
+}
+
+// isInteractive reports whether a job's upload is short enough for the
+// fast lane
+func isInteractive(jobID string) bool {
+	limit := interactiveMaxSeconds()
+	if limit == 0 {
+		return false
+	}
+	seconds := clipSeconds(jobID)
+	return seconds > 0 && seconds <= limit
+}
+
+// runQueuedJob processes a job taken off the queue unless it was deleted
+// while it waited
+func runQueuedJob(jobID string) {
+	jobsMutex.RLock()
+	job, exists := jobs[jobID]
+	var inputPath string
+	var opts jobOptions
+	if exists {
+		inputPath, opts = job.inputPath, job.options()
+		exists = job.Status == "queued"
+	}
+	jobsMutex.RUnlock()
+	if !exists {
+		return
+	}
+	if batch := takeBatch(jobID, opts); len(batch) > 1 {
+		processBatch(batch)
+		return
+	}
+	processJob(jobID, inputPath, opts)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJobQueueBoundsConcurrency(t *testing.T) {
+	q := newJobQueue()
+	release := make(chan struct{})
+	var active, peak atomic.Int32
+	started := make(chan string, 10)
+	q.start(2, func(jobID string) {
+		n := active.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		started <- jobID
+		<-release
+		active.Add(-1)
+	})
+
+	for _, id := range []string{"a", "b", "c", "d"} {
+		q.push(id, false)
+	}
+	<-started
+	<-started
+	if pos := q.position("d"); pos != 2 {
+		t.Errorf("position(d) = %d, want 2", pos)
+	}
+	if !q.remove("d") || q.position("d") != 0 {
+		t.Error("queued job was not removed")
+	}
+	if queued, running := q.stats(); queued != 1 || running != 2 {
+		t.Errorf("stats = %d queued, %d running", queued, running)
+	}
+
+	close(release)
+	if got := <-started; got != "c" {
+		t.Errorf("third job = %q, want c", got)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	q.drain(ctx)
+	if peak.Load() != 2 {
+		t.Errorf("peak concurrency = %d, want 2", peak.Load())
+	}
+	if q.push("e", false) {
+		t.Error("push accepted while draining")
+	}
+}
+
+func TestDrainWaitsForRunningJobs(t *testing.T) {
+	q := newJobQueue()
+	started, finished := make(chan struct{}), make(chan struct{})
+	q.start(1, func(string) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		close(finished)
+	})
+	q.push("a", false)
+	q.push("b", false)
+	<-started
+	left := q.drain(context.Background())
+	select {
+	case <-finished:
+	default:
+		t.Error("drain returned before the running job finished")
+	}
+	if len(left) != 1 || left[0] != "b" {
+		t.Errorf("left = %v", left)
+	}
+}
+
+func TestFastLaneOnlyTakesInteractiveJobs(t *testing.T) {
+	q := newJobQueue()
+	release := make(chan struct{})
+	started := make(chan string, 10)
+	run := func(jobID string) {
+		started <- jobID
+		<-release
+	}
+	q.start(1, run)
+	q.push("album", false)
+	if got := <-started; got != "album" {
+		t.Fatalf("first job = %q", got)
+	}
+	q.startFastLane(1, run)
+
+	// The fast lane passes over the queued album for the clip behind it
+	q.push("album-2", false)
+	q.push("clip", true)
+	if pos := q.position("clip"); pos != 1 {
+		t.Errorf("position(clip) = %d, want 1 among interactive jobs", pos)
+	}
+	if pos := q.position("album-2"); pos != 1 {
+		t.Errorf("position(album-2) = %d, want 1", pos)
+	}
+	if got := <-started; got != "clip" {
+		t.Errorf("fast lane took %q, want clip", got)
+	}
+	select {
+	case got := <-started:
+		t.Errorf("%s started while both workers were busy", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if queued, running := q.stats(); queued != 1 || running != 2 {
+		t.Errorf("stats = %d queued, %d running", queued, running)
+	}
+
+	close(release)
+	if got := <-started; got != "album-2" {
+		t.Errorf("next job = %q, want album-2", got)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	q.drain(ctx)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ear-training quizzes, for music teachers. GET /api/jobs/{id}/quiz
+// renders a ZIP of practice exercises from a job's stems: each exercise
+// is the mix minus one stem picked at random, and the student names the
+// one that is missing. The package has the full mix as reference.<ext>,
+// the exercises as exercise-01.<ext> and so on, exercises.txt with the
+// question and the choices, and answers.json with the missing stem of each
+// exercise (answers=false leaves it out, for the copy handed to students).
+// Every stem is left out once before any is left out again. The seed is
+// reported in the answers, and the same seed gives the same quiz.
+
+// quizMaxExercises caps the exercises of one quiz; each is a render
+const quizMaxExercises = 20
+
+// QuizExercise is one exercise in a quiz's answers.json
+type QuizExercise struct {
+	Number  int    `json:"number"`
+	File    string `json:"file"`
+	Missing string `json:"missing"` // the stem left out of the mix
+}
+
+// QuizAnswers is the answer manifest of a quiz
+type QuizAnswers struct {
+	JobID     string         `json:"job_id"`
+	FileName  string         `json:"filename"`
+	Seed      uint32         `json:"seed"`
+	Stems     []string       `json:"stems"` // the choices
+	Reference string         `json:"reference"`
+	Exercises []QuizExercise `json:"exercises"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// quizStems are the stems of a job an exercise can leave out: separated
+// stems only, since instrumental and backing tracks overlap the others
+func quizStems(job Job) []string {
+	var stems []string
+	for _, stem := range sortedKeys(job.OutputFiles) {
+		if allowedStems[stem] {
+			stems = append(stems, stem)
+		}
+	}
+	return stems
+}
+
+// quizMissing picks the stem left out of each of n exercises. It deals
+// from a shuffled deck of the stems, reshuffled when it runs out, and
+// never leaves the same stem out twice in a row.
+func quizMissing(stems []string, n int, seed uint32) []string {
+	rng := rand.New(rand.NewSource(int64(seed)))
+	var missing, deck []string
+	for len(missing) < n {
+		if len(deck) == 0 {
+			deck = append([]string(nil), stems...)
+			rng.Shuffle(len(deck), func(i, j int) { deck[i], deck[j] = deck[j], deck[i] })
+			if k := len(missing) - 1; k >= 0 && len(deck) > 1 && deck[0] == missing[k] {
+				deck[0], deck[1] = deck[1], deck[0]
+			}
+		}
+		missing = append(missing, deck[0])
+		deck = deck[1:]
+	}
+	return missing
+}
+
+// quizSheet is the exercises.txt handed to students
+func quizSheet(a QuizAnswers) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Ear training: %s\n\n", a.FileName)
+	fmt.Fprintf(&b, "%s is the full mix. Each exercise leaves one stem out; name the missing one.\n", a.Reference)
+	fmt.Fprintf(&b, "Choices: %s.\n\n", spokenList(a.Stems))
+	for _, e := range a.Exercises {
+		fmt.Fprintf(&b, "%d. %s: ____________\n", e.Number, e.File)
+	}
+	return b.String()
+}
+
+// renderQuizMix renders one mixdown of a quiz at unity gain
+func renderQuizMix(job Job, stems []string, dst string) error {
+	render := mixRender{Dst: dst, MP3Bitrate: job.MP3Bitrate}
+	if render.MP3Bitrate == "" {
+		render.MP3Bitrate = "320"
+	}
+	for _, stem := range stems {
+		render.Inputs = append(render.Inputs, mixInput{Path: job.OutputFiles[stem]})
+	}
+	mixSlots <- struct{}{}
+	defer func() { <-mixSlots }()
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	defer cancel()
+	return renderMix(ctx, render)
+}
+
+// quizHandler serves GET /api/jobs/{id}/quiz?exercises=&seed=&format=&answers=false
+func quizHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupCompletedJob(w, r)
+	if !ok || refuseEncrypted(w, job) {
+		return
+	}
+	q := r.URL.Query()
+	stems := quizStems(job)
+	if len(stems) < 2 {
+		http.Error(w, "A quiz needs at least two stems", http.StatusBadRequest)
+		return
+	}
+	for _, stem := range stems {
+		if !safeOutputPath(job.OutputFiles[stem]) {
+			http.Error(w, "Stem not found: "+stem, http.StatusNotFound)
+			return
+		}
+	}
+	n := len(stems)
+	if raw := q.Get("exercises"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 1 || v > quizMaxExercises {
+			http.Error(w, fmt.Sprintf("Invalid exercises value (allowed: 1 to %d)", quizMaxExercises), http.StatusBadRequest)
+			return
+		}
+		n = v
+	}
+	seed := uint32(rand.Int63n(maxSeed + 1))
+	if raw := q.Get("seed"); raw != "" {
+		s, err := parseSeed(raw)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v, _ := strconv.ParseUint(s, 10, 32)
+		seed = uint32(v)
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(job.OutputFiles[stems[0]]), ".")
+	}
+	if !allowedOutputFormats[format] {
+		http.Error(w, invalidOption("format", sortedKeys(allowedOutputFormats)).Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Render everything before answering, so a failed render is an error
+	// response rather than a truncated archive
+	tmp, err := os.MkdirTemp("", "t2s-quiz-")
+	if err != nil {
+		http.Error(w, "Failed to render the quiz", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tmp)
+	answers := QuizAnswers{
+		JobID:     job.ID,
+		FileName:  job.FileName,
+		Seed:      seed,
+		Stems:     stems,
+		Reference: "reference." + format,
+		CreatedAt: time.Now().UTC(),
+	}
+	files := map[string]string{answers.Reference: filepath.Join(tmp, answers.Reference)}
+	if err := renderQuizMix(job, stems, files[answers.Reference]); err != nil {
+		http.Error(w, "Failed to render the quiz: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i, missing := range quizMissing(stems, n, seed) {
+		e := QuizExercise{Number: i + 1, File: fmt.Sprintf("exercise-%02d.%s", i+1, format), Missing: missing}
+		var inputs []string
+		for _, stem := range stems {
+			if stem != missing {
+				inputs = append(inputs, stem)
+			}
+		}
+		files[e.File] = filepath.Join(tmp, e.File)
+		if err := renderQuizMix(job, inputs, files[e.File]); err != nil {
+			http.Error(w, "Failed to render the quiz: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		answers.Exercises = append(answers.Exercises, e)
+	}
+
+	base := sanitizeFilename(strings.TrimSuffix(job.FileName, filepath.Ext(job.FileName)))
+	dir := pathSegment(strings.TrimSuffix(job.FileName, filepath.Ext(job.FileName))) + " - quiz"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", base+" - quiz.zip"))
+	zw := zip.NewWriter(w)
+	for _, name := range sortedKeys(files) {
+		if _, err := addPackageFile(zw, path.Join(dir, name), "", files[name]); err != nil {
+			// Headers are already sent; a truncated archive is the best signal left
+			zw.Close()
+			return
+		}
+	}
+	if f, err := zw.Create(path.Join(dir, "exercises.txt")); err == nil {
+		io.WriteString(f, quizSheet(answers))
+	}
+	if q.Get("answers") != "false" {
+		if f, err := zw.Create(path.Join(dir, "answers.json")); err == nil {
+			enc := json.NewEncoder(f)
+			enc.SetIndent("", "  ")
+			enc.Encode(answers)
+		}
+	}
+	zw.Close()
+}
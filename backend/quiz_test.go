@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func TestQuizMissing(t *testing.T) {
+	stems := []string{"bass", "drums", "other", "vocals"}
+	missing := quizMissing(stems, 10, 7)
+	if !slices.Equal(missing, quizMissing(stems, 10, 7)) {
+		t.Errorf("same seed, different quiz: %v", missing)
+	}
+	// Every stem once per round, never the same twice in a row
+	for round := 0; round+len(stems) <= len(missing); round += len(stems) {
+		got := slices.Sorted(slices.Values(missing[round : round+len(stems)]))
+		if !slices.Equal(got, stems) {
+			t.Errorf("round %d = %v", round/len(stems), missing[round:round+len(stems)])
+		}
+	}
+	for i := 1; i < len(missing); i++ {
+		if missing[i] == missing[i-1] {
+			t.Errorf("%s left out twice in a row: %v", missing[i], missing)
+		}
+	}
+}
+
+func TestQuizHandler(t *testing.T) {
+	oldOutputDir, oldRender := outputDir, renderMix
+	outputDir = t.TempDir()
+	// The "mixdown" lists the stems it was made from
+	renderMix = func(ctx context.Context, r mixRender) error {
+		var names []string
+		for _, in := range r.Inputs {
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(in.Path), "song_t2s_"), ".wav"))
+		}
+		return os.WriteFile(r.Dst, []byte(strings.Join(names, ",")), 0644)
+	}
+	t.Cleanup(func() { outputDir, renderMix = oldOutputDir, oldRender })
+
+	id := uuid.New().String()
+	outputs := map[string]string{}
+	for _, stem := range []string{"vocals", "drums", "bass", "other", "instrumental"} {
+		path := filepath.Join(outputDir, id, "song_t2s_"+stem+".wav")
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(stem), 0644)
+		outputs[stem] = path
+	}
+	jobsMutex.Lock()
+	jobs[id] = &Job{ID: id, Status: "completed", FileName: "song.mp3", OutputFiles: outputs}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/jobs/{id}/quiz", quizHandler).Methods("GET")
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/jobs/"+id+"/quiz"+query, nil))
+		return rec
+	}
+
+	rec := get("?exercises=6&seed=42")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("quiz = %d: %s", rec.Code, rec.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		r, _ := f.Open()
+		data, _ := io.ReadAll(r)
+		r.Close()
+		files[strings.TrimPrefix(f.Name, "song - quiz/")] = string(data)
+	}
+	var answers QuizAnswers
+	if err := json.Unmarshal([]byte(files["answers.json"]), &answers); err != nil {
+		t.Fatalf("answers.json: %v (files %v)", err, sortedKeys(files))
+	}
+	if answers.Seed != 42 || len(answers.Exercises) != 6 || !slices.Equal(answers.Stems, []string{"bass", "drums", "other", "vocals"}) {
+		t.Errorf("answers = %+v", answers)
+	}
+	if files["reference.wav"] != "bass,drums,other,vocals" {
+		t.Errorf("reference = %q", files["reference.wav"])
+	}
+	for _, e := range answers.Exercises {
+		mix := strings.Split(files[e.File], ",")
+		if len(mix) != 3 || slices.Contains(mix, e.Missing) {
+			t.Errorf("exercise %d without %s = %v", e.Number, e.Missing, mix)
+		}
+	}
+	if !strings.Contains(files["exercises.txt"], "6. exercise-06.wav") || !strings.Contains(files["exercises.txt"], "bass, drums, other and vocals") {
+		t.Errorf("exercises.txt = %q", files["exercises.txt"])
+	}
+
+	// The student copy has no answers
+	rec = get("?seed=42&answers=false")
+	zr, _ = zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "answers.json") {
+			t.Error("answers=false included answers.json")
+		}
+	}
+
+	for _, query := range []string{"?exercises=0", "?exercises=21", "?seed=-1", "?format=ogg"} {
+		if rec := get(query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s = %d", query, rec.Code)
+		}
+	}
+}
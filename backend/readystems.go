@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Partial results. While a job is processing, the processor lists the
+// stems it has finished writing under "outputs" in its /status/{id}, one
+// by one as they are encoded. Each time the backend reads that status (the
+// processing-status and events endpoints, or a download of a stem that
+// isn't ready yet) it records them on the job as ready_stems, and
+// GET /api/download/{id}/{stem} serves a ready stem before the job
+// completes; other stems and the ZIP wait for completion. Signed
+// download_urls cover the ready stems too. Jobs run by external workers
+// have no partial results.
+
+// noteReadyStems records the stems the processor reported as written and
+// returns the job's ready stems
+func noteReadyStems(jobID string, outputs map[string]string) []string {
+	ready := make(map[string]string, len(outputs))
+	for stem, path := range outputs {
+		if safeOutputPath(path) {
+			ready[stem] = path
+		}
+	}
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	job, exists := jobs[jobID]
+	if !exists || job.Status != "processing" {
+		return nil
+	}
+	// The processor only adds stems, but a stale cached status may list fewer
+	if len(ready) > len(job.readyOutputs) {
+		job.readyOutputs = ready
+		job.ReadyStems = sortedKeys(ready)
+	}
+	return job.ReadyStems
+}
+
+// readyStemsFromStatus records the stems listed in a processor status body
+func readyStemsFromStatus(jobID string, body []byte) []string {
+	var status struct {
+		Outputs map[string]string `json:"outputs"`
+	}
+	if json.Unmarshal(body, &status) != nil || len(status.Outputs) == 0 {
+		return nil
+	}
+	return noteReadyStems(jobID, status.Outputs)
+}
+
+// refreshReadyStems asks the processor which of a processing job's stems
+// are written
+func refreshReadyStems(jobID, variant string) {
+	if externalWorkers {
+		return
+	}
+	if code, body, err := processorStatus(jobID, variant); err == nil && code == http.StatusOK {
+		readyStemsFromStatus(jobID, body)
+	}
+}
+
+// readyStemPath returns the file of a stem that can be downloaded before
+// its job completes
+func readyStemPath(jobID, variant, stem string) (string, bool) {
+	lookup := func() (string, bool) {
+		jobsMutex.RLock()
+		defer jobsMutex.RUnlock()
+		job, exists := jobs[jobID]
+		if !exists || job.Status != "processing" {
+			return "", false
+		}
+		path, ready := job.readyOutputs[stem]
+		return path, ready
+	}
+	if path, ready := lookup(); ready {
+		return path, true
+	}
+	refreshReadyStems(jobID, variant)
+	return lookup()
+}
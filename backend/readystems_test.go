@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReadyStemsDownload(t *testing.T) {
+	oldOutputDir := outputDir
+	outputDir = t.TempDir()
+	t.Cleanup(func() { outputDir = oldOutputDir })
+
+	jobID := "5b1d2a70-9c3e-4f8a-b6d4-1e7f0a2c3d4e"
+	dir := filepath.Join(outputDir, jobID)
+	os.MkdirAll(dir, 0755)
+	vocals := filepath.Join(dir, "Song_t2s_vocals.wav")
+	os.WriteFile(vocals, []byte("vocals"), 0644)
+
+	var mu sync.Mutex
+	outputs := map[string]string{}
+	processor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "processing", "progress": 92, "outputs": outputs})
+	}))
+	defer processor.Close()
+	t.Setenv("PROCESSOR_URL", processor.URL)
+	t.Setenv("PROCESSOR_STATUS_TTL", "0")
+
+	jobsMutex.Lock()
+	jobs[jobID] = &Job{ID: jobID, Status: "processing", OutputFormat: "wav"}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, jobID)
+		jobsMutex.Unlock()
+	})
+
+	router := newRouter()
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	if rec := get("/api/download/" + jobID + "/vocals"); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Stem not ready") {
+		t.Fatalf("download before the stem is written = %d %q", rec.Code, rec.Body.String())
+	}
+
+	mu.Lock()
+	outputs["vocals"] = vocals
+	outputs["evil"] = "/etc/passwd"
+	mu.Unlock()
+	if rec := get("/api/download/" + jobID + "/vocals"); rec.Code != http.StatusOK || rec.Body.String() != "vocals" {
+		t.Fatalf("download of a ready stem = %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get("/api/download/" + jobID + "/evil"); rec.Code != http.StatusBadRequest {
+		t.Errorf("download of an unsafe path = %d, want 400", rec.Code)
+	}
+	if rec := get("/api/download/" + jobID + "/all"); rec.Code != http.StatusBadRequest {
+		t.Errorf("zip of a processing job = %d, want 400", rec.Code)
+	}
+
+	var job Job
+	json.NewDecoder(get("/api/jobs/" + jobID).Body).Decode(&job)
+	if !slices.Equal(job.ReadyStems, []string{"vocals"}) {
+		t.Errorf("ready_stems = %v, want [vocals]", job.ReadyStems)
+	}
+	if _, signed := job.DownloadURLs["vocals"]; !signed || len(job.DownloadURLs) != 1 {
+		t.Errorf("download_urls = %v, want only vocals", job.DownloadURLs)
+	}
+
+	updateJobError(jobID, "Processor failed: out of memory")
+	jobsMutex.RLock()
+	ready, cleared := jobs[jobID].ReadyStems, jobs[jobID].readyOutputs == nil
+	jobsMutex.RUnlock()
+	if ready != nil || !cleared {
+		t.Errorf("ready stems kept after the job failed: %v", ready)
+	}
+	if rec := get("/api/download/" + jobID + "/vocals"); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Job not completed") {
+		t.Errorf("download after failure = %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output reconciliation cross-checks every finished job against its output
+// directory, to heal drift left by crashes and timeouts. Stems found in the
+// directory but not registered (a mix or extra format whose render finished
+// as the backend went down) are added to the job's output files; a job that
+// failed without getting the processor's answer (lost connection, shutdown)
+// but whose directory holds every stem it asked for is completed with them,
+// marked "reconciled" and announced with job.completed. Registered outputs
+// missing from disk are flagged in the job's "missing_outputs" until they
+// come back; jobs copied to object storage are exempt, their stems are
+// served from there. Files younger than ORPHAN_GC_GRACE are left alone, as
+// they may still be written. The check runs every RECONCILE_INTERVAL
+// (default 15m) and on POST /api/admin/reconcile.
+
+// lostResultErrors start the errors of jobs failed without hearing back
+// from the processor, whose stems may still have been written
+var lostResultErrors = []string{"Failed to process: ", "Failed to parse response", "Server is shutting down"}
+
+// ReconcileReport is the outcome of one reconciliation run
+type ReconcileReport struct {
+	RanAt      time.Time           `json:"ran_at"`
+	Reattached map[string][]string `json:"reattached,omitempty"` // job -> outputs added
+	Recovered  []string            `json:"recovered,omitempty"`  // failed jobs completed from found stems
+	Missing    map[string][]string `json:"missing,omitempty"`    // job -> outputs not on disk
+}
+
+// ReconcileStats is reported under "reconciliation" in /api/admin/stats
+type ReconcileStats struct {
+	Last            *ReconcileReport `json:"last,omitempty"`
+	TotalReattached int              `json:"total_reattached"`
+	TotalRecovered  int              `json:"total_recovered"`
+}
+
+var (
+	reconcileStats ReconcileStats
+	reconcileMutex = &sync.Mutex{}
+)
+
+func reconcileInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("RECONCILE_INTERVAL")); err == nil && d > 0 {
+		return d
+	}
+	return 15 * time.Minute
+}
+
+func reconcileSnapshot() ReconcileStats {
+	reconcileMutex.Lock()
+	defer reconcileMutex.Unlock()
+	return reconcileStats
+}
+
+// expectedStems are the stems a job's processor run writes, or nil when
+// they aren't known
+func expectedStems(opts jobOptions) []string {
+	if opts.StemMode == "isolate" {
+		backing := "backing"
+		if opts.IsolateStem == "vocals" {
+			backing = "instrumental"
+		}
+		return []string{opts.IsolateStem, backing}
+	}
+	if len(opts.StemGroups) > 0 {
+		stems := make([]string, len(opts.StemGroups))
+		for i, g := range opts.StemGroups {
+			stems[i] = g.Name
+		}
+		return stems
+	}
+	return modelStems(opts.Model)
+}
+
+// outputKeyForFile names the output a file in a job directory holds, from
+// the <name>_t2s_<stem>.<format> pattern the processor, mixes and extra
+// formats write, or returns "" for anything else
+func outputKeyForFile(name string, opts jobOptions) string {
+	i := strings.LastIndex(name, "_t2s_")
+	format := strings.TrimPrefix(filepath.Ext(name), ".")
+	if i < 0 || !allowedOutputFormats[format] {
+		return ""
+	}
+	stem := strings.TrimSuffix(name[i+len("_t2s_"):], "."+format)
+	if stem == "" {
+		return ""
+	}
+	if format != opts.OutputFormat && !isMixOutput(stem) && slices.Contains(opts.ExtraFormats, format) {
+		return formatOutputKey(stem, format)
+	}
+	return stem
+}
+
+// foundOutputs returns the outputs in a job's directory older than cutoff
+func foundOutputs(jobID string, opts jobOptions, cutoff time.Time) map[string]string {
+	dir := filepath.Join(outputDir, jobID)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	found := make(map[string]string)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() || info.ModTime().After(cutoff) {
+			continue
+		}
+		if key := outputKeyForFile(e.Name(), opts); key != "" {
+			found[key] = filepath.Join(dir, e.Name())
+		}
+	}
+	return found
+}
+
+// reconcileOutputs checks every finished job once and returns what it changed
+func reconcileOutputs(grace time.Duration) ReconcileReport {
+	report := ReconcileReport{RanAt: time.Now().UTC(), Reattached: map[string][]string{}, Missing: map[string][]string{}}
+	cutoff := time.Now().Add(-grace)
+
+	var finished []Job
+	jobsMutex.RLock()
+	for _, job := range jobs {
+		if (job.Status == "completed" || job.Status == "failed") && !job.SelfTest {
+			finished = append(finished, job.snapshot())
+		}
+	}
+	jobsMutex.RUnlock()
+
+	for _, snap := range finished {
+		opts := snap.options()
+		found := foundOutputs(snap.ID, opts, cutoff)
+		registered := make(map[string]bool, len(snap.OutputFiles))
+		for _, path := range snap.OutputFiles {
+			registered[path] = true
+		}
+
+		added := map[string]string{}
+		var missing []string
+		complete := false
+		switch snap.Status {
+		case "completed":
+			for _, key := range sortedKeys(found) {
+				if _, exists := snap.OutputFiles[key]; !exists && !registered[found[key]] {
+					added[key] = found[key]
+				}
+			}
+			if !snap.Stored {
+				for _, key := range sortedKeys(snap.OutputFiles) {
+					if _, err := os.Stat(snap.OutputFiles[key]); os.IsNotExist(err) {
+						missing = append(missing, key)
+					}
+				}
+			}
+		case "failed":
+			lost := slices.ContainsFunc(lostResultErrors, func(prefix string) bool { return strings.HasPrefix(snap.Error, prefix) })
+			expected := expectedStems(opts)
+			// A watermarked job's stems on disk may predate the mark, which
+			// is embedded after they are saved
+			complete = lost && opts.Watermark == "" && len(expected) > 0 && !slices.ContainsFunc(expected, func(stem string) bool { return found[stem] == "" })
+			if complete {
+				added = found
+			}
+		}
+
+		jobsMutex.Lock()
+		job, exists := jobs[snap.ID]
+		if !exists || job.Status != snap.Status {
+			jobsMutex.Unlock()
+			continue
+		}
+		if complete {
+			now := time.Now().UTC()
+			job.Status, job.Error, job.CompletedAt, job.Reconciled = "completed", "", &now, true
+			job.OutputFiles = nil
+		}
+		if job.OutputFiles == nil && len(added) > 0 {
+			job.OutputFiles = make(map[string]string, len(added))
+		}
+		for key, path := range added {
+			job.OutputFiles[key] = path
+		}
+		job.MissingOutputs = missing
+		jobsMutex.Unlock()
+
+		switch {
+		case complete:
+			report.Recovered = append(report.Recovered, snap.ID)
+			log.Printf("Reconciliation: completed failed job %s from the %d outputs found", snap.ID, len(added))
+			emitJobEvent(snap.ID, EventJobCompleted)
+		case len(added) > 0:
+			report.Reattached[snap.ID] = sortedKeys(added)
+			log.Printf("Reconciliation: added unregistered outputs %v to job %s", sortedKeys(added), snap.ID)
+			go hashJobOutputs(snap.ID)
+			if s, remote := remoteStorage(); remote {
+				paths := make([]string, 0, len(added))
+				for _, key := range sortedKeys(added) {
+					paths = append(paths, added[key])
+				}
+				go saveToStorage(s, snap.ID, paths, true)
+			}
+		}
+		if len(missing) > 0 {
+			report.Missing[snap.ID] = missing
+		}
+	}
+	slices.Sort(report.Recovered)
+	if len(report.Missing) > 0 {
+		log.Printf("Reconciliation: %d jobs have registered outputs missing from disk", len(report.Missing))
+	}
+	return report
+}
+
+// runReconciliation runs reconcileOutputs and records the results
+func runReconciliation() ReconcileReport {
+	report := reconcileOutputs(orphanGCGrace())
+	reattached := 0
+	for _, keys := range report.Reattached {
+		reattached += len(keys)
+	}
+	reconcileMutex.Lock()
+	reconcileStats.Last = &report
+	reconcileStats.TotalReattached += reattached
+	reconcileStats.TotalRecovered += len(report.Recovered)
+	reconcileMutex.Unlock()
+	return report
+}
+
+// reconciler runs the reconciliation every interval
+func reconciler(interval time.Duration) {
+	for range time.Tick(interval) {
+		runReconciliation()
+	}
+}
+
+// reconcileHandler runs the reconciliation now: POST /api/admin/reconcile
+func reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, runReconciliation())
+}
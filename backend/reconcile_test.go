@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReconcileOutputs(t *testing.T) {
+	oldOutputDir := outputDir
+	outputDir = t.TempDir()
+	t.Cleanup(func() { outputDir = oldOutputDir })
+
+	old := time.Now().Add(-time.Hour)
+	write := func(jobID, name string, fresh bool) string {
+		path := filepath.Join(outputDir, jobID, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(name), 0644)
+		if !fresh {
+			os.Chtimes(path, old, old)
+		}
+		return path
+	}
+	ids := map[string]string{
+		"extra":  "0a7c8e52-1111-4d6f-9a3b-5e2c1d0f4b6a",
+		"gone":   "0a7c8e52-2222-4d6f-9a3b-5e2c1d0f4b6a",
+		"lost":   "0a7c8e52-3333-4d6f-9a3b-5e2c1d0f4b6a",
+		"broken": "0a7c8e52-4444-4d6f-9a3b-5e2c1d0f4b6a",
+		"marked": "0a7c8e52-5555-4d6f-9a3b-5e2c1d0f4b6a",
+	}
+	vocals := write(ids["extra"], "Song_t2s_vocals.wav", false)
+	write(ids["extra"], "Song_t2s_mix-karaoke.mp3", false)
+	write(ids["extra"], "Song_t2s_vocals.mp3", true) // still being transcoded
+	write(ids["extra"], "notes.txt", false)
+	for _, id := range []string{ids["lost"], ids["broken"], ids["marked"]} {
+		write(id, "Song_t2s_vocals.flac", false)
+		write(id, "Song_t2s_instrumental.flac", false)
+	}
+	isolate := func(job *Job) *Job {
+		job.StemMode, job.IsolateStem, job.OutputFormat, job.Model = "isolate", "vocals", "flac", "htdemucs"
+		return job
+	}
+	jobsMutex.Lock()
+	jobs[ids["extra"]] = &Job{ID: ids["extra"], Status: "completed", OutputFormat: "wav", ExtraFormats: []string{"mp3"}, OutputFiles: map[string]string{"vocals": vocals}}
+	jobs[ids["gone"]] = &Job{ID: ids["gone"], Status: "completed", OutputFormat: "wav", OutputFiles: map[string]string{"drums": filepath.Join(outputDir, ids["gone"], "Song_t2s_drums.wav")}}
+	jobs[ids["lost"]] = isolate(&Job{ID: ids["lost"], Status: "failed", Error: "Failed to process: context deadline exceeded"})
+	jobs[ids["broken"]] = isolate(&Job{ID: ids["broken"], Status: "failed", Error: "Processor failed: out of memory"})
+	jobs[ids["marked"]] = isolate(&Job{ID: ids["marked"], Status: "failed", Error: "Failed to process: context deadline exceeded", Watermark: "tone"})
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		for _, id := range ids {
+			delete(jobs, id)
+		}
+		jobsMutex.Unlock()
+	})
+
+	report := reconcileOutputs(time.Minute)
+	if got := report.Reattached[ids["extra"]]; !slices.Equal(got, []string{"mix-karaoke"}) {
+		t.Errorf("reattached = %v, want only the finished mix", report.Reattached)
+	}
+	if got := report.Missing[ids["gone"]]; !slices.Equal(got, []string{"drums"}) || len(report.Missing) != 1 {
+		t.Errorf("missing = %v", report.Missing)
+	}
+	if !slices.Equal(report.Recovered, []string{ids["lost"]}) {
+		t.Errorf("recovered = %v, want the unmarked job that lost the processor's answer", report.Recovered)
+	}
+
+	jobsMutex.RLock()
+	extra, gone, lost, broken := jobs[ids["extra"]].snapshot(), jobs[ids["gone"]].snapshot(), jobs[ids["lost"]].snapshot(), jobs[ids["broken"]].snapshot()
+	jobsMutex.RUnlock()
+	if len(extra.OutputFiles) != 2 || extra.MissingOutputs != nil {
+		t.Errorf("completed job outputs = %v, missing %v", extra.OutputFiles, extra.MissingOutputs)
+	}
+	if !slices.Equal(gone.MissingOutputs, []string{"drums"}) || len(gone.OutputFiles) != 1 {
+		t.Errorf("job with a deleted stem = %v, missing %v", gone.OutputFiles, gone.MissingOutputs)
+	}
+	if lost.Status != "completed" || !lost.Reconciled || lost.Error != "" || lost.CompletedAt == nil || len(lost.OutputFiles) != 2 {
+		t.Errorf("recovered job = %+v", lost)
+	}
+	if broken.Status != "failed" || len(broken.OutputFiles) != 0 {
+		t.Errorf("job the processor failed = %+v", broken)
+	}
+
+	// A stem that comes back clears the flag
+	write(ids["gone"], "Song_t2s_drums.wav", false)
+	reconcileOutputs(time.Minute)
+	jobsMutex.RLock()
+	missing := jobs[ids["gone"]].MissingOutputs
+	jobsMutex.RUnlock()
+	if missing != nil {
+		t.Errorf("missing after the stem came back = %v", missing)
+	}
+}
+
+func TestOutputKeyForFile(t *testing.T) {
+	opts := jobOptions{OutputFormat: "wav", ExtraFormats: []string{"mp3"}}
+	for name, want := range map[string]string{
+		"My_Song_t2s_vocals.wav":      "vocals",
+		"My_Song_t2s_vocals.mp3":      "vocals.mp3",
+		"My_Song_t2s_mix-karaoke.mp3": "mix-karaoke",
+		"My_Song_t2s_drums.flac":      "drums",
+		"My_Song_t2s_.wav":            "",
+		"My_Song_vocals.wav":          "",
+		"My_Song_t2s_vocals.wav.tmp":  "",
+	} {
+		if got := outputKeyForFile(name, opts); got != want {
+			t.Errorf("outputKeyForFile(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
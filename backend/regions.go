@@ -0,0 +1,155 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Upload regions. With storage in several regions, STORAGE_REGIONS lists
+// them, comma separated, each a name, the public URL of the backend
+// serving it and optionally the countries it is nearest to:
+//
+//	STORAGE_REGIONS=eu url=https://eu.track2stem.example countries=DE+FR+IT+GB, us url=https://us.track2stem.example countries=US+CA
+//
+// GET /api/upload/endpoint tells a client where to upload. A latency=
+// hint (eu:40,us:130, milliseconds the client measured to each region's
+// ping_url) wins; otherwise the country in GEO_COUNTRY_HEADER (default
+// CF-IPCountry, set by the CDN) picks the region listing it, and the
+// first region is the fallback. Each backend names its own region in
+// REGION; the jobs it accepts record it as their region, where their
+// upload and stems live, and are sent to processors tagged with the same
+// region (see processors.go) before any other, so audio doesn't cross
+// regions unless no processor in its own can take it.
+
+// StorageRegion is one STORAGE_REGIONS region
+type StorageRegion struct {
+	Name      string   `json:"name"`
+	URL       string   `json:"url"`
+	Countries []string `json:"countries,omitempty"`
+}
+
+// parseStorageRegions reads a STORAGE_REGIONS value
+func parseStorageRegions(value string) ([]StorageRegion, error) {
+	var regions []StorageRegion
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		region := StorageRegion{Name: fields[0]}
+		if slices.ContainsFunc(regions, func(other StorageRegion) bool { return other.Name == region.Name }) {
+			return nil, fmt.Errorf("region %s: listed twice", region.Name)
+		}
+		for _, tag := range fields[1:] {
+			key, val, _ := strings.Cut(tag, "=")
+			switch key {
+			case "url":
+				if !strings.HasPrefix(val, "http://") && !strings.HasPrefix(val, "https://") {
+					return nil, fmt.Errorf("region %s: url must be http(s)", region.Name)
+				}
+				region.URL = strings.TrimSuffix(val, "/")
+			case "countries":
+				for _, country := range strings.Split(val, "+") {
+					if len(country) != 2 {
+						return nil, fmt.Errorf("region %s: %q isn't a two-letter country code", region.Name, country)
+					}
+					region.Countries = append(region.Countries, strings.ToUpper(country))
+				}
+			default:
+				return nil, fmt.Errorf("region %s: unknown tag %q", region.Name, tag)
+			}
+		}
+		if region.URL == "" {
+			return nil, fmt.Errorf("region %s: url is required", region.Name)
+		}
+		regions = append(regions, region)
+	}
+	if name := currentRegion(); name != "" && len(regions) > 0 &&
+		!slices.ContainsFunc(regions, func(r StorageRegion) bool { return r.Name == name }) {
+		return nil, fmt.Errorf("REGION: unknown region %q", name)
+	}
+	return regions, nil
+}
+
+// storageRegionsFromEnv returns the STORAGE_REGIONS regions; startup has
+// checked they parse
+func storageRegionsFromEnv() []StorageRegion {
+	regions, _ := parseStorageRegions(os.Getenv("STORAGE_REGIONS"))
+	return regions
+}
+
+// currentRegion is the region this backend's volumes are in
+func currentRegion() string {
+	return os.Getenv("REGION")
+}
+
+// parseLatencyHint reads a latency hint, region:milliseconds pairs
+func parseLatencyHint(value string) (map[string]float64, error) {
+	hint := make(map[string]float64)
+	for _, pair := range strings.Split(value, ",") {
+		name, raw, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		ms, err := strconv.ParseFloat(raw, 64)
+		if !ok || err != nil || ms < 0 {
+			return nil, fmt.Errorf("invalid latency %q", pair)
+		}
+		hint[name] = ms
+	}
+	return hint, nil
+}
+
+// chooseUploadRegion returns the region a client should upload to and what
+// decided it: latency, country or default
+func chooseUploadRegion(regions []StorageRegion, latency map[string]float64, country string) (StorageRegion, string) {
+	best := -1
+	for i, region := range regions {
+		if ms, measured := latency[region.Name]; measured && (best < 0 || ms < latency[regions[best].Name]) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		return regions[best], "latency"
+	}
+	country = strings.ToUpper(country)
+	for _, region := range regions {
+		if country != "" && slices.Contains(region.Countries, country) {
+			return region, "country"
+		}
+	}
+	return regions[0], "default"
+}
+
+// uploadEndpointHandler serves GET /api/upload/endpoint?latency=eu:40,us:130
+func uploadEndpointHandler(w http.ResponseWriter, r *http.Request) {
+	regions := storageRegionsFromEnv()
+	if len(regions) == 0 {
+		// One region: upload here
+		regions = []StorageRegion{{Name: currentRegion(), URL: publicBaseURL(r)}}
+	}
+	var latency map[string]float64
+	if raw := r.URL.Query().Get("latency"); raw != "" {
+		var err error
+		if latency, err = parseLatencyHint(raw); err != nil {
+			http.Error(w, "Invalid latency value", http.StatusBadRequest)
+			return
+		}
+	}
+	country := r.Header.Get(cmp.Or(os.Getenv("GEO_COUNTRY_HEADER"), "CF-IPCountry"))
+	region, chosenBy := chooseUploadRegion(regions, latency, country)
+
+	list := make([]map[string]string, 0, len(regions))
+	for _, other := range regions {
+		list = append(list, map[string]string{"name": other.Name, "ping_url": other.URL + "/api/health"})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"region":        region.Name,
+		"chosen_by":     chosenBy,
+		"upload_url":    region.URL + "/api/upload",
+		"resumable_url": region.URL + "/api/upload/init",
+		"regions":       list,
+	})
+}
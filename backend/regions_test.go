@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testRegions = "eu url=https://eu.example.com/ countries=de+FR, us url=https://us.example.com countries=US+CA"
+
+func TestParseStorageRegions(t *testing.T) {
+	regions, err := parseStorageRegions(testRegions)
+	if err != nil || len(regions) != 2 || regions[0].URL != "https://eu.example.com" || regions[0].Countries[0] != "DE" {
+		t.Fatalf("parseStorageRegions = %+v, %v", regions, err)
+	}
+	for value, want := range map[string]string{
+		"eu":                                 "url is required",
+		"eu url=ftp://x":                     "http(s)",
+		"eu url=https://a countries=FRA":     "two-letter",
+		"eu url=https://a, eu url=https://b": "listed twice",
+		"eu url=https://a zone=1":            "unknown tag",
+	} {
+		if _, err := parseStorageRegions(value); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseStorageRegions(%q) = %v, want %q", value, err, want)
+		}
+	}
+	t.Setenv("REGION", "ap")
+	if _, err := parseStorageRegions(testRegions); err == nil {
+		t.Error("REGION outside STORAGE_REGIONS accepted")
+	}
+}
+
+func TestUploadEndpoint(t *testing.T) {
+	t.Setenv("STORAGE_REGIONS", testRegions)
+	get := func(query, country string) (int, map[string]interface{}) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/upload/endpoint"+query, nil)
+		if country != "" {
+			req.Header.Set("CF-IPCountry", country)
+		}
+		rec := httptest.NewRecorder()
+		uploadEndpointHandler(rec, req)
+		var body map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body
+	}
+
+	for _, c := range []struct{ query, country, region, by string }{
+		{"", "", "eu", "default"},
+		{"", "ca", "us", "country"},
+		{"?latency=eu:120,us:35", "FR", "us", "latency"},
+		{"?latency=ap:5,eu:80", "US", "eu", "latency"},
+	} {
+		code, body := get(c.query, c.country)
+		if code != http.StatusOK || body["region"] != c.region || body["chosen_by"] != c.by {
+			t.Errorf("%q from %q = %d %v, want %s by %s", c.query, c.country, code, body, c.region, c.by)
+		}
+	}
+	if _, body := get("?latency=us:1", ""); body["upload_url"] != "https://us.example.com/api/upload" || len(body["regions"].([]interface{})) != 2 {
+		t.Errorf("endpoint = %v", body)
+	}
+	if code, _ := get("?latency=eu", ""); code != http.StatusBadRequest {
+		t.Errorf("bad latency hint = %d", code)
+	}
+}
+
+func TestAcquireProcessorRegion(t *testing.T) {
+	local := &processorInstance{URL: "http://eu-1", Region: "eu", Healthy: true, Active: 4}
+	remote := &processorInstance{URL: "http://us-1", Region: "us", Healthy: true}
+	standby := &processorInstance{URL: "http://eu-standby", Region: "eu", Standby: true, Healthy: true}
+	useProcessors(t, []*processorInstance{remote, local, standby})
+
+	if p := acquireProcessor(processorNeeds{Model: "htdemucs", Region: "eu"}, nil); p != local {
+		t.Errorf("eu job went to %v, want the busier eu processor", p)
+	}
+	if p := acquireProcessor(processorNeeds{Model: "htdemucs"}, nil); p != remote {
+		t.Errorf("job without a region went to %v, want the least-loaded", p)
+	}
+	if p := acquireProcessor(processorNeeds{Model: "htdemucs", Region: "eu"}, map[string]bool{local.URL: true}); p != standby {
+		t.Errorf("eu job failing over went to %v", p)
+	}
+	local.Healthy = false
+	if p := acquireProcessor(processorNeeds{Model: "htdemucs", Region: "eu"}, nil); p != remote {
+		t.Errorf("eu job with the eu processor down went to %v", p)
+	}
+}
+
+func TestIntegrationJobRegion(t *testing.T) {
+	t.Setenv("REGION", "eu")
+	b := newIntegrationBackend(t, 1)
+	if job := b.waitFor(b.upload("song.mp3", nil).ID, "completed"); job.Region != "eu" {
+		t.Errorf("job region = %q", job.Region)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Upload rejections. An upload refused for its size, format, options,
+// tier, quota, rate limit, a full queue, storage or terms is answered with
+// a JSON body: the "error" message, a machine-readable "code" and a
+// "remediation" saying what would get the upload through. Its "action" is
+// one of shrink, trim, convert, change_option, upgrade, retry,
+// accept_terms or contact; the other fields give the numbers (the size or
+// length to get under, the formats to convert to, the seconds to wait),
+// and "hint" says the same in a sentence, so the frontend and the CLI give
+// the same advice.
+//
+// MAX_QUEUED_JOBS (default 0, no limit) refuses uploads with 503 while
+// that many jobs are waiting, with a Retry-After estimated from their
+// length.
+
+// Remediation actions
+const (
+	remedyShrink       = "shrink"
+	remedyTrim         = "trim"
+	remedyConvert      = "convert"
+	remedyChangeOption = "change_option"
+	remedyUpgrade      = "upgrade"
+	remedyRetry        = "retry"
+	remedyAcceptTerms  = "accept_terms"
+	remedyContact      = "contact"
+)
+
+// inputExtensions are the upload formats the processor decodes; browser
+// recordings are converted to FLAC first
+var inputExtensions = []string{"mp3", "wav", "flac", "ogg", "m4a", "aac"}
+
+// inputMediaTypes are accepted for uploads without a known extension
+var inputMediaTypes = map[string]bool{
+	"audio/mpeg": true, "audio/mp3": true, "audio/wav": true, "audio/x-wav": true, "audio/wave": true,
+	"audio/flac": true, "audio/x-flac": true, "audio/ogg": true, "audio/mp4": true, "audio/m4a": true,
+	"audio/x-m4a": true, "audio/aac": true,
+}
+
+// Remediation is what a client can change for a refused upload to go
+// through
+type Remediation struct {
+	Action             string   `json:"action"`
+	Hint               string   `json:"hint"`
+	Field              string   `json:"field,omitempty"`   // the option to change
+	Allowed            []string `json:"allowed,omitempty"` // values or formats that would be accepted
+	MaxBytes           int64    `json:"max_bytes,omitempty"`
+	MaxDurationSeconds float64  `json:"max_duration_seconds,omitempty"`
+	RetryAfterSeconds  int      `json:"retry_after_seconds,omitempty"`
+	URL                string   `json:"url,omitempty"` // where to upgrade, accept or ask
+}
+
+// Rejection is the JSON body of a refused upload that has no more specific
+// body of its own
+type Rejection struct {
+	Error       string       `json:"error"`
+	Code        string       `json:"code"` // file_too_large, unsupported_format, invalid_option, rate_limited, quota_exceeded, queue_full, ...
+	Remediation *Remediation `json:"remediation,omitempty"`
+}
+
+// writeRejection answers with a rejection, and with Retry-After when the
+// remediation is to wait
+func writeRejection(w http.ResponseWriter, status int, code, message string, remedy *Remediation) {
+	if remedy != nil && remedy.RetryAfterSeconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(remedy.RetryAfterSeconds))
+	}
+	writeJSON(w, status, Rejection{Error: message, Code: code, Remediation: remedy})
+}
+
+// optionError is an option value outside the allowed ones
+type optionError struct {
+	Name    string
+	Allowed []string
+}
+
+func (e *optionError) Error() string {
+	return fmt.Sprintf("Invalid %s value (allowed: %s)", e.Name, strings.Join(e.Allowed, ", "))
+}
+
+// supportURL is where clients are sent when there is nothing to change
+func supportURL() string {
+	return os.Getenv("BRANDING_SUPPORT_URL")
+}
+
+// sizeRemedy is the remediation of a file over maxBytes
+func sizeRemedy(maxBytes int64) *Remediation {
+	return &Remediation{
+		Action:   remedyShrink,
+		Hint:     fmt.Sprintf("Compress or trim the file to under %s", formatMegabytes(maxBytes)),
+		MaxBytes: maxBytes,
+	}
+}
+
+// formatMegabytes writes a byte limit the way clients show it
+func formatMegabytes(n int64) string {
+	return strconv.FormatFloat(float64(n)/(1<<20), 'f', -1, 64) + " MB"
+}
+
+// formatRemedy is the remediation of an upload in a format the processor
+// can't read
+func formatRemedy() *Remediation {
+	return &Remediation{
+		Action:  remedyConvert,
+		Hint:    "Convert to " + orList(inputExtensions),
+		Allowed: inputExtensions,
+	}
+}
+
+// optionRemedy is the remediation of a rejected form option
+func optionRemedy(err error) *Remediation {
+	var oe *optionError
+	if errors.As(err, &oe) {
+		return &Remediation{
+			Action:  remedyChangeOption,
+			Hint:    fmt.Sprintf("Set %s to %s", oe.Name, orList(oe.Allowed)),
+			Field:   oe.Name,
+			Allowed: oe.Allowed,
+		}
+	}
+	return &Remediation{Action: remedyChangeOption, Hint: "Correct the options named in the error"}
+}
+
+// orList joins choices as a sentence would: "a, b or c"
+func orList(names []string) string {
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+// storageRemedy is the remediation of a server short of disk space
+func storageRemedy() *Remediation {
+	return retryRemedy(0, "The server is short of storage space; try again later")
+}
+
+// retryRemedy is the remediation of a refusal that passes with time
+func retryRemedy(seconds int, hint string) *Remediation {
+	return &Remediation{Action: remedyRetry, Hint: hint, RetryAfterSeconds: seconds}
+}
+
+// formatWait writes a wait in whole units: "45s", "12 minutes", "3 days"
+func formatWait(seconds int) string {
+	switch {
+	case seconds < 120:
+		return fmt.Sprintf("%ds", seconds)
+	case seconds < 2*3600:
+		return fmt.Sprintf("%d minutes", int(math.Ceil(float64(seconds)/60)))
+	case seconds < 2*86400:
+		return fmt.Sprintf("%d hours", int(math.Ceil(float64(seconds)/3600)))
+	}
+	return fmt.Sprintf("%d days", int(math.Ceil(float64(seconds)/86400)))
+}
+
+// quotaRemedy is the remediation of a key over its monthly minutes: wait
+// for the next month, in UTC like the usage
+func quotaRemedy(now time.Time) *Remediation {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	seconds := int(math.Ceil(next.Sub(now).Seconds()))
+	r := retryRemedy(seconds, fmt.Sprintf("Retry after %s, when the monthly quota resets, or ask for a higher quota", next.Format("2 January")))
+	r.URL = supportURL()
+	return r
+}
+
+// tierRemedy is the remediation of an upload over a tier limit
+func tierRemedy(e *tierError) *Remediation {
+	r := &Remediation{URL: e.UpgradeURL}
+	switch e.Limit {
+	case "duration":
+		r.Action, r.MaxDurationSeconds = remedyTrim, e.MaxDurationSeconds
+		r.Hint = "Trim to " + formatDuration(e.MaxDurationSeconds)
+	default:
+		r.Action, r.Field, r.Allowed = remedyChangeOption, e.Limit, e.Allowed
+		r.Hint = fmt.Sprintf("Set %s to %s", e.Limit, orList(e.Allowed))
+	}
+	switch {
+	case e.UpgradeTier != "":
+		r.Hint += fmt.Sprintf(", or upgrade to the %s tier", e.UpgradeTier)
+		if len(e.Allowed) == 0 && e.Limit != "duration" {
+			r.Action = remedyUpgrade
+		}
+	case e.ContactURL != "":
+		r.URL = e.ContactURL
+	}
+	return r
+}
+
+// formatDuration writes a duration limit the way a person would say it:
+// "10 minutes", "90 seconds", "1 hour 30 minutes"
+func formatDuration(seconds float64) string {
+	s := int(math.Round(seconds))
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return "1 " + unit
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	switch {
+	case s < 60 || s%60 != 0:
+		return plural(s, "second")
+	case s < 3600:
+		return plural(s/60, "minute")
+	case s%3600 == 0:
+		return plural(s/3600, "hour")
+	}
+	return plural(s/3600, "hour") + " " + plural(s%3600/60, "minute")
+}
+
+// checkInputFormat refuses uploads the processor can't decode, by
+// extension or, for files without one, by Content-Type
+func checkInputFormat(fileName, contentType string) *Rejection {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(fileName)), ".")
+	for _, allowed := range inputExtensions {
+		if ext == allowed {
+			return nil
+		}
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && inputMediaTypes[mediaType] {
+		return nil
+	}
+	if _, isRecording := recordedExtension(fileName, contentType); isRecording {
+		return nil
+	}
+	message := "Unsupported file format"
+	if ext != "" {
+		message = "Unsupported file format: " + ext
+	}
+	return &Rejection{Error: message, Code: "unsupported_format", Remediation: formatRemedy()}
+}
+
+// maxQueuedJobs reads MAX_QUEUED_JOBS (default 0, no limit)
+func maxQueuedJobs() int {
+	if n, err := strconv.Atoi(os.Getenv("MAX_QUEUED_JOBS")); err == nil && n > 0 {
+		return n
+	}
+	return 0
+}
+
+// checkQueueRoom refuses new jobs while MAX_QUEUED_JOBS are waiting. The
+// wait is one average queued job per worker, a minute when none of their
+// lengths is known.
+func checkQueueRoom() *Rejection {
+	limit := maxQueuedJobs()
+	if limit == 0 {
+		return nil
+	}
+	jobsMutex.RLock()
+	queued, known := 0, 0
+	var seconds float64
+	for _, job := range jobs {
+		if job.Status != "queued" {
+			continue
+		}
+		queued++
+		if job.clipSeconds > 0 {
+			known++
+			seconds += estimateProcessingSeconds(job.clipSeconds, job.options()) * processorSpeed(job.Model)
+		}
+	}
+	jobsMutex.RUnlock()
+	if queued < limit {
+		return nil
+	}
+	wait := 60
+	if known > 0 {
+		wait = max(int(math.Ceil(seconds/float64(known)/float64(maxConcurrentJobs()))), 5)
+	}
+	return &Rejection{
+		Error:       fmt.Sprintf("Queue full (%d jobs waiting)", queued),
+		Code:        "queue_full",
+		Remediation: retryRemedy(wait, "Retry after "+formatWait(wait)),
+	}
+}
+
+// checkRejection is the uploadError of a virus scan ("scan") or content
+// policy ("policy") refusal: they pass with time when the check was
+// unavailable, and need a person otherwise
+func checkRejection(status int, message, check string) *uploadError {
+	e := &uploadError{Status: status, Message: message}
+	switch {
+	case status >= 500:
+		e.Code = check + "_unavailable"
+		e.Remediation = retryRemedy(0, "Try again in a few minutes")
+	case check == "scan":
+		e.Code = "scan_rejected"
+		e.Remediation = &Remediation{Action: remedyContact, Hint: "Upload a clean copy of the file, or ask the operator if you think this is a mistake", URL: supportURL()}
+	default:
+		e.Code = "policy_blocked"
+		e.Remediation = &Remediation{Action: remedyContact, Hint: "Ask the operator if you think this is a mistake", URL: supportURL()}
+	}
+	return e
+}
+
+// batchRejection is how a file refused in a batch is reported
+func (e *uploadError) batchRejection(fileName string) batchRejection {
+	r := batchRejection{FileName: fileName, Status: e.Status, Error: e.Message, Code: e.Code, Remediation: e.Remediation, TierLimit: e.Tier}
+	switch {
+	case e.Tier != nil:
+		r.Code, r.Remediation = e.Tier.Code, e.Tier.Remediation
+	case e.Storage != nil:
+		r.Code, r.Remediation = "insufficient_storage", storageRemedy()
+	}
+	return r
+}
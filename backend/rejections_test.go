@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRemediations(t *testing.T) {
+	if r := checkInputFormat("notes.pdf", "application/pdf"); r == nil || r.Code != "unsupported_format" || r.Remediation.Hint != "Convert to mp3, wav, flac, ogg, m4a or aac" {
+		t.Errorf("pdf = %+v", r)
+	}
+	// Known extensions, audio types without one, and browser recordings
+	for name, contentType := range map[string]string{"song.MP3": "application/octet-stream", "track": "audio/x-wav", "blob": "audio/webm;codecs=opus"} {
+		if r := checkInputFormat(name, contentType); r != nil {
+			t.Errorf("%s (%s) = %+v", name, contentType, r)
+		}
+	}
+
+	e := &tierError{Limit: "duration", MaxDurationSeconds: 600, UpgradeTier: "pro", UpgradeURL: "https://example.com/pro"}
+	if r := tierRemedy(e); r.Action != remedyTrim || r.Hint != "Trim to 10 minutes, or upgrade to the pro tier" || r.URL != e.UpgradeURL {
+		t.Errorf("duration = %+v", r)
+	}
+	e = &tierError{Limit: "model", Allowed: []string{"htdemucs", "mdx"}}
+	if r := tierRemedy(e); r.Action != remedyChangeOption || r.Field != "model" || r.Hint != "Set model to htdemucs or mdx" {
+		t.Errorf("model = %+v", r)
+	}
+	if got := formatDuration(5400); got != "1 hour 30 minutes" {
+		t.Errorf("formatDuration(5400) = %q", got)
+	}
+
+	r := quotaRemedy(time.Date(2026, 10, 31, 23, 58, 1, 0, time.UTC))
+	if r.RetryAfterSeconds != 119 || r.Hint != "Retry after 1 November, when the monthly quota resets, or ask for a higher quota" {
+		t.Errorf("quota = %+v", r)
+	}
+	if r := optionRemedy(invalidOption("stem_mode", []string{"all", "isolate"})); r.Field != "stem_mode" || r.Hint != "Set stem_mode to all or isolate" {
+		t.Errorf("option = %+v", r)
+	}
+}
+
+// postFile uploads a file and decodes the rejection it is refused with
+func postFile(t *testing.T, url, fileName string, fields map[string]string) (int, http.Header, Rejection) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", fileName)
+	part.Write([]byte("ID3 " + fileName))
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	mw.Close()
+	resp, err := http.Post(url+"/api/upload", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r Rejection
+	json.NewDecoder(resp.Body).Decode(&r)
+	return resp.StatusCode, resp.Header, r
+}
+
+func TestIntegrationUploadRejections(t *testing.T) {
+	t.Setenv("MAX_QUEUED_JOBS", "1")
+	b := newIntegrationBackend(t, 1)
+
+	code, _, r := postFile(t, b.URL, "notes.pdf", nil)
+	if code != http.StatusUnsupportedMediaType || r.Code != "unsupported_format" || r.Remediation == nil || r.Remediation.Action != remedyConvert {
+		t.Errorf("pdf = %d %+v", code, r)
+	}
+	code, _, r = postFile(t, b.URL, "song.mp3", map[string]string{"stem_mode": "karaoke"})
+	if code != http.StatusBadRequest || r.Code != "invalid_option" || r.Remediation == nil || r.Remediation.Field != "stem_mode" {
+		t.Errorf("bad option = %d %+v", code, r)
+	}
+
+	running := b.upload("hang.mp3", nil)
+	b.waitFor(running.ID, "processing")
+	b.upload("waiting.mp3", nil)
+	code, header, r := postFile(t, b.URL, "song.mp3", nil)
+	if code != http.StatusServiceUnavailable || r.Code != "queue_full" || r.Remediation == nil || r.Remediation.RetryAfterSeconds != 60 || header.Get("Retry-After") != "60" {
+		t.Errorf("queue full = %d %v %+v", code, header, r)
+	}
+	req, _ := http.NewRequest("DELETE", b.URL+"/api/jobs/"+running.ID, nil)
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
+
+func TestStorageRejection(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeStorageError(rec, &storageError{Error: "Insufficient storage", Path: "/data"})
+	var e storageError
+	json.Unmarshal(rec.Body.Bytes(), &e)
+	if rec.Code != http.StatusInsufficientStorage || e.Code != "insufficient_storage" || e.Remediation == nil || e.Remediation.Action != remedyRetry {
+		t.Errorf("507 = %d %s", rec.Code, rec.Body)
+	}
+}
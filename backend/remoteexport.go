@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Automatic delivery of completed stems to a studio file server.
+//
+// Destinations are configured per deployment and used as delivery targets:
+//
+//	SFTP_EXPORT_URL=sftp://user@files.example.com:22/srv/stems
+//	SFTP_EXPORT_PASSWORD or SFTP_EXPORT_KEY_FILE, plus SFTP_EXPORT_KNOWN_HOSTS
+//	WEBDAV_EXPORT_URL=https://dav.example.com/stems/
+//	WEBDAV_EXPORT_USER / WEBDAV_EXPORT_PASSWORD
+//
+// Unless AUTO_DELIVERY_TARGETS says otherwise, every completed job is
+// delivered to each configured destination.
+
+const remoteExportTimeout = 30 * time.Second
+
+// remoteDestination is one configured file server
+type remoteDestination struct {
+	Name     string // "sftp" or "webdav"
+	URL      *url.URL
+	User     string
+	Password string
+	KeyFile  string
+	// KnownHosts is required for SFTP so host keys are always verified
+	KnownHosts string
+}
+
+// remoteDestinations reads the configured SFTP/WebDAV destinations
+func remoteDestinations() ([]remoteDestination, error) {
+	var dests []remoteDestination
+	if raw := os.Getenv("SFTP_EXPORT_URL"); raw != "" {
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme != "sftp" || u.Host == "" || u.User == nil {
+			return nil, fmt.Errorf("invalid SFTP_EXPORT_URL")
+		}
+		dests = append(dests, remoteDestination{
+			Name:       "sftp",
+			URL:        u,
+			User:       u.User.Username(),
+			Password:   os.Getenv("SFTP_EXPORT_PASSWORD"),
+			KeyFile:    os.Getenv("SFTP_EXPORT_KEY_FILE"),
+			KnownHosts: os.Getenv("SFTP_EXPORT_KNOWN_HOSTS"),
+		})
+	}
+	if raw := os.Getenv("WEBDAV_EXPORT_URL"); raw != "" {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid WEBDAV_EXPORT_URL")
+		}
+		dests = append(dests, remoteDestination{
+			Name:     "webdav",
+			URL:      u,
+			User:     os.Getenv("WEBDAV_EXPORT_USER"),
+			Password: os.Getenv("WEBDAV_EXPORT_PASSWORD"),
+		})
+	}
+	return dests, nil
+}
+
+// remoteExporter delivers stems under <base>/ on an SFTP or WebDAV server
+type remoteExporter struct {
+	dest remoteDestination
+}
+
+func (e remoteExporter) Deliver(ctx context.Context, d Delivery, files []deliveryFile) error {
+	if e.dest.Name == "sftp" {
+		return uploadSFTP(e.dest, files)
+	}
+	return uploadWebDAV(ctx, e.dest, files)
+}
+
+// sftpConfig builds an SSH client config with password and/or key auth
+func sftpConfig(dest remoteDestination) (*ssh.ClientConfig, error) {
+	if dest.KnownHosts == "" {
+		return nil, fmt.Errorf("SFTP_EXPORT_KNOWN_HOSTS is required")
+	}
+	hostKeys, err := knownhosts.New(dest.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts: %v", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if dest.KeyFile != "" {
+		key, err := os.ReadFile(dest.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key file: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if dest.Password != "" {
+		auth = append(auth, ssh.Password(dest.Password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no SFTP credentials configured")
+	}
+
+	return &ssh.ClientConfig{
+		User:            dest.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         remoteExportTimeout,
+	}, nil
+}
+
+func uploadSFTP(dest remoteDestination, files []deliveryFile) error {
+	config, err := sftpConfig(dest)
+	if err != nil {
+		return err
+	}
+	host := dest.URL.Host
+	if dest.URL.Port() == "" {
+		host = net.JoinHostPort(host, "22")
+	}
+	conn, err := ssh.Dial("tcp", host, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for _, file := range files {
+		dst := path.Join(dest.URL.Path, file.Name)
+		if err := client.MkdirAll(path.Dir(dst)); err != nil {
+			return err
+		}
+		if err := sftpPut(client, file.Path, dst); err != nil {
+			return fmt.Errorf("%s: %v", file.Name, err)
+		}
+	}
+	return nil
+}
+
+func sftpPut(client *sftp.Client, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := client.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := out.ReadFrom(in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// webdavRequest sends an authenticated WebDAV request
+func webdavRequest(ctx context.Context, dest remoteDestination, method, target string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if dest.User != "" {
+		req.SetBasicAuth(dest.User, dest.Password)
+	}
+	return (&http.Client{Timeout: 30 * time.Minute}).Do(req)
+}
+
+// webdavURL escapes a slash-separated relative name onto the base URL
+func webdavURL(base, name string) string {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return base + "/" + strings.Join(parts, "/")
+}
+
+func uploadWebDAV(ctx context.Context, dest remoteDestination, files []deliveryFile) error {
+	base := strings.TrimSuffix(dest.URL.String(), "/")
+
+	// WebDAV has no recursive MKCOL, so create each parent collection in
+	// turn; MKCOL answers 405 when the collection already exists
+	created := make(map[string]bool)
+	for _, file := range files {
+		parts := strings.Split(file.Name, "/")
+		for i := 1; i < len(parts); i++ {
+			dir := strings.Join(parts[:i], "/")
+			if created[dir] {
+				continue
+			}
+			resp, err := webdavRequest(ctx, dest, "MKCOL", webdavURL(base, dir)+"/", nil, 0)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+				return fmt.Errorf("MKCOL returned %d", resp.StatusCode)
+			}
+			created[dir] = true
+		}
+	}
+
+	for _, file := range files {
+		f, err := os.Open(file.Path)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		resp, err := webdavRequest(ctx, dest, "PUT", webdavURL(base, file.Name), f, info.Size())
+		f.Close()
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("PUT %s returned %d", file.Name, resp.StatusCode)
+		}
+	}
+	return nil
+}
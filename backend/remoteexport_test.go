@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoteDestinations(t *testing.T) {
+	t.Setenv("SFTP_EXPORT_URL", "sftp://studio@files.example.com/srv/stems")
+	t.Setenv("WEBDAV_EXPORT_URL", "https://dav.example.com/stems/")
+	dests, err := remoteDestinations()
+	if err != nil || len(dests) != 2 {
+		t.Fatalf("remoteDestinations() = %v, %v", dests, err)
+	}
+	if dests[0].User != "studio" || dests[0].URL.Path != "/srv/stems" {
+		t.Errorf("unexpected sftp destination %+v", dests[0])
+	}
+	if _, err := sftpConfig(dests[0]); err == nil {
+		t.Error("expected sftp without known hosts to be rejected")
+	}
+
+	for _, raw := range []string{"ftp://files.example.com/", "sftp://files.example.com/"} {
+		t.Setenv("SFTP_EXPORT_URL", raw)
+		if _, err := remoteDestinations(); err == nil {
+			t.Errorf("expected %q to be rejected", raw)
+		}
+	}
+}
+
+func TestUploadWebDAV(t *testing.T) {
+	stored := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "studio" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case "MKCOL":
+			w.WriteHeader(http.StatusCreated)
+		case "PUT":
+			body, _ := io.ReadAll(r.Body)
+			stored[r.URL.Path] = string(body)
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	src := filepath.Join(t.TempDir(), "song_t2s_vocals.mp3")
+	os.WriteFile(src, []byte("vocal data"), 0644)
+	u, _ := url.Parse(server.URL + "/stems/")
+	dest := remoteDestination{Name: "webdav", URL: u, User: "studio", Password: "secret"}
+
+	files := []deliveryFile{{Path: src, Name: "job-1/song_t2s_vocals.mp3"}}
+	if err := uploadWebDAV(context.Background(), dest, files); err != nil {
+		t.Fatalf("uploadWebDAV: %v", err)
+	}
+	if got := stored["/stems/job-1/song_t2s_vocals.mp3"]; got != "vocal data" {
+		t.Errorf("stored %v", stored)
+	}
+
+	nested := []deliveryFile{{Path: src, Name: "Queen/A Night at the Opera/vocals.mp3"}}
+	if err := uploadWebDAV(context.Background(), dest, nested); err != nil {
+		t.Fatalf("uploadWebDAV nested: %v", err)
+	}
+	if got := stored["/stems/Queen/A Night at the Opera/vocals.mp3"]; got != "vocal data" {
+		t.Errorf("stored %v", stored)
+	}
+
+	dest.Password = "wrong"
+	if err := uploadWebDAV(context.Background(), dest, files); err == nil {
+		t.Error("expected unauthorized upload to fail")
+	}
+}
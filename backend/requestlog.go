@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Request logging. Every request gets an ID, taken from its X-Request-ID
+// header when that is a sane token and generated otherwise, which is
+// echoed in the response's X-Request-ID and logged as one JSON line on
+// stderr with the route, status, bytes and duration. Jobs remember the ID
+// of the request that created them and send it to the processor as
+// X-Request-ID, and job events are logged with it, so a job can be traced
+// from upload to stems by grepping one ID across both services' logs.
+// Set REQUEST_LOG=false to drop the per-request lines (the IDs are kept).
+//
+// The ID is also the job's request_id and is written to package manifests
+// next to the processor environment, so a stem file a user reports can be
+// traced back: GET /api/admin/trace?sha256= finds the job that produced a
+// file (or ?request_id= the jobs a request created) with the processor
+// instance, image and model behind it.
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+var structuredLog = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+type requestIDContextKey struct{}
+
+// requestID returns the ID of the request ctx belongs to, or ""
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// statusRecorder remembers the status and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach deadlines, flushing and hijacking
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Flush keeps event streams working behind the recorder
+func (s *statusRecorder) Flush() {
+	http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+// Hijack keeps WebSocket upgrades working behind the recorder
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(s.ResponseWriter).Hijack()
+}
+
+// requestLogMiddleware assigns request IDs, logs requests and counts them
+// for /metrics
+func requestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set("X-Request-ID", id)
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		recordHTTPRequest(route, r.Method, rec.status, rec.bytes)
+		if os.Getenv("REQUEST_LOG") == "false" {
+			return
+		}
+		attrs := []any{
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote_addr", r.RemoteAddr,
+		}
+		if jobID := mux.Vars(r)["id"]; jobID != "" {
+			attrs = append(attrs, "job_id", jobID)
+		}
+		structuredLog.Info("request", attrs...)
+	})
+}
+
+// logJobEvent logs job events with the ID of the request that created the
+// job; main registers it as an event listener
+func logJobEvent(e Event) {
+	if e.Job.SelfTest || os.Getenv("REQUEST_LOG") == "false" {
+		return
+	}
+	attrs := []any{"event", e.Type, "job_id", e.Job.ID, "status", e.Job.Status, "model", e.Job.Model}
+	if e.Job.RequestID != "" {
+		attrs = append(attrs, "request_id", e.Job.RequestID)
+	}
+	if e.Job.processorURL != "" {
+		attrs = append(attrs, "processor", e.Job.processorURL)
+	}
+	if e.Job.Error != "" {
+		attrs = append(attrs, "error", e.Job.Error)
+	}
+	structuredLog.Info("job", attrs...)
+}
+
+// JobTrace is the provenance of a job's stems
+type JobTrace struct {
+	JobID       string         `json:"job_id"`
+	Stems       []string       `json:"stems,omitempty"` // outputs with the requested hash
+	RequestID   string         `json:"request_id,omitempty"`
+	Processor   string         `json:"processor,omitempty"` // processor URL the job was sent to
+	Environment *ProcessingEnv `json:"environment,omitempty"`
+	Model       string         `json:"model"`
+	Variant     string         `json:"variant,omitempty"`
+	Status      string         `json:"status"`
+	CreatedAt   time.Time      `json:"created_at"`
+	CompletedAt *time.Time     `json:"completed_at,omitempty"`
+}
+
+// traceHandler finds the jobs behind a stem file or request:
+// GET /api/admin/trace?sha256=<hash> or ?request_id=<id>
+func traceHandler(w http.ResponseWriter, r *http.Request) {
+	hash, reqID := strings.ToLower(r.URL.Query().Get("sha256")), r.URL.Query().Get("request_id")
+	if hash == "" && reqID == "" {
+		http.Error(w, "sha256 or request_id is required", http.StatusBadRequest)
+		return
+	}
+	traces := []JobTrace{}
+	jobsMutex.RLock()
+	for _, job := range jobs {
+		var stems []string
+		for _, stem := range sortedKeys(job.OutputHashes) {
+			if hash != "" && job.OutputHashes[stem] == hash {
+				stems = append(stems, stem)
+			}
+		}
+		if len(stems) == 0 && (reqID == "" || job.RequestID != reqID) {
+			continue
+		}
+		traces = append(traces, JobTrace{
+			JobID: job.ID, Stems: stems, RequestID: job.RequestID, Processor: job.processorURL,
+			Environment: job.Environment, Model: job.Model, Variant: job.Variant,
+			Status: job.Status, CreatedAt: job.CreatedAt, CompletedAt: job.CompletedAt,
+		})
+	}
+	jobsMutex.RUnlock()
+	slices.SortFunc(traces, func(a, b JobTrace) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	writeJSON(w, http.StatusOK, traces)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func TestRequestIDs(t *testing.T) {
+	t.Setenv("REQUEST_LOG", "false")
+	var seen string
+	router := mux.NewRouter()
+	router.Use(requestLogMiddleware)
+	router.HandleFunc("/api/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r.Context())
+		// Event streams flush through the status recorder
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("flush: %v", err)
+		}
+	})
+
+	req := httptest.NewRequest("GET", "/api/jobs/x", nil)
+	req.Header.Set("X-Request-ID", "edge-7f3a.1")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if seen != "edge-7f3a.1" || rec.Header().Get("X-Request-ID") != "edge-7f3a.1" {
+		t.Errorf("request ID = %q, echoed %q; want the client's", seen, rec.Header().Get("X-Request-ID"))
+	}
+
+	req.Header.Set("X-Request-ID", "not an id\r\n")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if _, err := uuid.Parse(seen); err != nil || rec.Header().Get("X-Request-ID") != seen {
+		t.Errorf("request ID = %q for an invalid header, want a generated UUID", seen)
+	}
+}
+
+func TestRequestIDReachesProcessor(t *testing.T) {
+	outputDir = t.TempDir()
+	var mu sync.Mutex
+	var got string
+	processor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = r.Header.Get("X-Request-ID")
+		mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"outputs": map[string]string{}})
+	}))
+	defer processor.Close()
+	t.Setenv("PROCESSOR_URL", processor.URL)
+
+	input := filepath.Join(t.TempDir(), "song.mp3")
+	os.WriteFile(input, []byte("ID3"), 0644)
+	id := uuid.New().String()
+	jobsMutex.Lock()
+	jobs[id] = &Job{ID: id, Status: "queued", RequestID: "trace-1"}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+	})
+
+	processJob(id, input, jobOptions{StemMode: "all", Model: "htdemucs", OutputFormat: "mp3"})
+	mu.Lock()
+	defer mu.Unlock()
+	if got != "trace-1" {
+		t.Errorf("processor got X-Request-ID %q, want the upload's", got)
+	}
+}
+
+func TestTraceHandler(t *testing.T) {
+	ids := []string{uuid.New().String(), uuid.New().String(), uuid.New().String()}
+	now := time.Now()
+	jobsMutex.Lock()
+	jobs[ids[0]] = &Job{ID: ids[0], Status: "completed", Model: "htdemucs", RequestID: "batch-7", CreatedAt: now,
+		processorURL: "http://processor-gpu:5000", Environment: &ProcessingEnv{Image: "processor:1.2"},
+		OutputHashes: map[string]string{"vocals": "aa11", "drums": "bb22"}}
+	jobs[ids[1]] = &Job{ID: ids[1], Status: "queued", RequestID: "batch-7", CreatedAt: now.Add(time.Second)}
+	jobs[ids[2]] = &Job{ID: ids[2], Status: "completed", RequestID: "other", OutputHashes: map[string]string{"vocals": "cc33"}}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		for _, id := range ids {
+			delete(jobs, id)
+		}
+		jobsMutex.Unlock()
+	})
+
+	trace := func(query string) (int, []JobTrace) {
+		rec := httptest.NewRecorder()
+		traceHandler(rec, httptest.NewRequest("GET", "/api/admin/trace?"+query, nil))
+		var traces []JobTrace
+		json.NewDecoder(rec.Body).Decode(&traces)
+		return rec.Code, traces
+	}
+	_, traces := trace("sha256=AA11")
+	if len(traces) != 1 || traces[0].JobID != ids[0] || len(traces[0].Stems) != 1 || traces[0].Stems[0] != "vocals" ||
+		traces[0].RequestID != "batch-7" || traces[0].Processor != "http://processor-gpu:5000" || traces[0].Environment.Image != "processor:1.2" {
+		t.Errorf("trace by hash = %+v", traces)
+	}
+	if _, traces := trace("request_id=batch-7"); len(traces) != 2 || traces[0].JobID != ids[0] || traces[1].JobID != ids[1] {
+		t.Errorf("trace by request = %+v", traces)
+	}
+	if code, _ := trace(""); code != http.StatusBadRequest {
+		t.Errorf("trace without a query = %d, want 400", code)
+	}
+}
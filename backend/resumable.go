@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Chunked uploads that survive interrupted connections and backend restarts.
+//
+//	POST   /api/upload/init           {"filename", "size", ...job options} -> {"id", "offset"}
+//	PATCH  /api/upload/{id}           chunk body, Upload-Offset header must equal the current offset
+//	GET    /api/upload/{id}           current offset, to resume after a disconnect
+//	POST   /api/upload/{id}/complete  once offset == size; creates the job
+//	DELETE /api/upload/{id}           abort
+//
+// An upload belongs to the API key that started it: other keys get 404,
+// and its job is that key's, checked against its tier again on complete.
+// Each upload keeps its data and a JSON state file under uploadDir/.partial,
+// which are reloaded on startup. Uploads that receive no chunk for
+// PARTIAL_UPLOAD_TTL (default 24h) are abandoned and deleted; responses
+// carry the resulting expires_at.
+
+// maxUploadChunkBytes bounds a single PATCH body
+const maxUploadChunkBytes = 32 << 20
+
+const (
+	defaultPartialUploadTTL = 24 * time.Hour
+	partialUploadSweep      = 10 * time.Minute
+)
+
+// PartialUpload is the persisted state of an in-progress chunked upload.
+// Bytes [0, Received) of the file have been written to TempPath.
+type PartialUpload struct {
+	ID       string            `json:"id"`
+	FileName string            `json:"filename"`
+	Size     int64             `json:"size"`
+	Received int64             `json:"offset"`
+	Options  map[string]string `json:"options,omitempty"`
+	Ignored  map[string]string `json:"ignored,omitempty"` // fields without effect, see checkFields
+	TempPath string            `json:"-"`
+	// ContentType is kept so browser recordings are still detected on complete
+	ContentType string     `json:"content_type,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"` // only in responses
+
+	apiKeyID string     // key that started the upload, owner of its job
+	mu       sync.Mutex // serializes chunk writes
+	closed   bool       // completed or aborted while a request waited on mu
+}
+
+// partialUploadState is the on-disk form, which also records the temp path
+// and the owner
+type partialUploadState struct {
+	PartialUpload
+	TempPath string `json:"temp_path"`
+	APIKeyID string `json:"api_key_id,omitempty"`
+}
+
+var (
+	partialUploads      = make(map[string]*PartialUpload)
+	partialUploadsMutex = &sync.Mutex{}
+)
+
+func init() { keepInUploads(partialUploadDir) }
+
+func partialUploadDir() string {
+	return filepath.Join(uploadDir, ".partial")
+}
+
+// save writes the upload state atomically; callers hold u.mu
+func (u *PartialUpload) save() error {
+	data, err := json.Marshal(partialUploadState{PartialUpload: u.snapshot(), TempPath: u.TempPath, APIKeyID: u.apiKeyID})
+	if err != nil {
+		return err
+	}
+	statePath := filepath.Join(partialUploadDir(), u.ID+".json")
+	tmp := statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, statePath)
+}
+
+// snapshot copies the exported fields and the owner without the mutex
+func (u *PartialUpload) snapshot() PartialUpload {
+	return PartialUpload{
+		ID: u.ID, FileName: u.FileName, Size: u.Size, Received: u.Received, Options: u.Options,
+		TempPath: u.TempPath, ContentType: u.ContentType, CreatedAt: u.CreatedAt, UpdatedAt: u.UpdatedAt,
+		apiKeyID: u.apiKeyID,
+	}
+}
+
+// view is the snapshot returned to clients, without the callback secret
+func (u *PartialUpload) view() PartialUpload {
+	options := u.Options
+	if _, set := options["callback_secret"]; set {
+		options = maps.Clone(options)
+		delete(options, "callback_secret")
+	}
+	expires := u.UpdatedAt.Add(partialUploadTTL())
+	return PartialUpload{
+		ID: u.ID, FileName: u.FileName, Size: u.Size, Received: u.Received, Options: options, Ignored: u.Ignored,
+		ContentType: u.ContentType, CreatedAt: u.CreatedAt, UpdatedAt: u.UpdatedAt, ExpiresAt: &expires,
+	}
+}
+
+// remove deletes the upload's state and data files
+func (u *PartialUpload) remove() {
+	os.Remove(filepath.Join(partialUploadDir(), u.ID+".json"))
+	os.Remove(u.TempPath)
+}
+
+func partialUploadTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("PARTIAL_UPLOAD_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultPartialUploadTTL
+}
+
+// abandoned reports whether the upload has received nothing for ttl; the
+// caller holds u.mu
+func (u *PartialUpload) abandoned(now time.Time, ttl time.Duration) bool {
+	return now.Sub(u.UpdatedAt) >= ttl
+}
+
+// expirePartialUploads deletes uploads that received nothing for ttl and
+// returns how many there were
+func expirePartialUploads(now time.Time, ttl time.Duration) int {
+	var stale []*PartialUpload
+	partialUploadsMutex.Lock()
+	for id, u := range partialUploads {
+		// An upload busy with a chunk isn't abandoned, however slow it is
+		if !u.mu.TryLock() {
+			continue
+		}
+		if !u.abandoned(now, ttl) {
+			u.mu.Unlock()
+			continue
+		}
+		u.closed = true
+		delete(partialUploads, id)
+		stale = append(stale, u)
+	}
+	partialUploadsMutex.Unlock()
+
+	for _, u := range stale {
+		u.remove()
+		u.mu.Unlock()
+		log.Printf("Deleted abandoned upload %s (%d of %d bytes received)", u.ID, u.Received, u.Size)
+	}
+	return len(stale)
+}
+
+// partialUploadReaper deletes abandoned uploads every interval
+func partialUploadReaper(interval time.Duration) {
+	for range time.Tick(interval) {
+		expirePartialUploads(time.Now(), partialUploadTTL())
+	}
+}
+
+// loadPartialUploads restores in-progress uploads after a restart. The data
+// file's size is authoritative: a chunk may have been written after the last
+// state save, and the client resumes from whatever offset we report.
+func loadPartialUploads() {
+	entries, err := os.ReadDir(partialUploadDir())
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		statePath := filepath.Join(partialUploadDir(), e.Name())
+		data, err := os.ReadFile(statePath)
+		if err != nil {
+			continue
+		}
+		var state partialUploadState
+		if err := json.Unmarshal(data, &state); err != nil || !isValidJobID(state.ID) {
+			log.Printf("Discarding unreadable upload state %s", e.Name())
+			os.Remove(statePath)
+			continue
+		}
+		u := state.PartialUpload.snapshot()
+		u.TempPath, u.apiKeyID = state.TempPath, state.APIKeyID
+		info, err := os.Stat(u.TempPath)
+		if err != nil || filepath.Dir(u.TempPath) != partialUploadDir() {
+			log.Printf("Discarding upload %s: data file missing", u.ID)
+			os.Remove(statePath)
+			continue
+		}
+		u.Received = info.Size()
+		if u.Received > u.Size {
+			os.Truncate(u.TempPath, u.Size)
+			u.Received = u.Size
+		}
+		partialUploadsMutex.Lock()
+		partialUploads[u.ID] = &u
+		partialUploadsMutex.Unlock()
+	}
+	if n := len(partialUploads); n > 0 {
+		log.Printf("Restored %d in-progress uploads", n)
+	}
+}
+
+type initUploadRequest struct {
+	FileName     string `json:"filename"`
+	Size         int64  `json:"size"`
+	ContentType  string `json:"content_type"`
+	StemMode     string `json:"stem_mode"`
+	IsolateStem  string `json:"isolate_stem"`
+	OutputFormat string `json:"output_format"`
+	Model        string `json:"model"`
+	Segment      string `json:"segment"`
+	Overlap      string `json:"overlap"`
+	Shifts       string `json:"shifts"`
+	ClipMode     string `json:"clip_mode"`
+	MP3Bitrate   string `json:"mp3_bitrate"`
+	ExtraFormats string `json:"extra_formats"` // comma-separated, like the form field
+
+	Deterministic string `json:"deterministic"`
+	Seed          string `json:"seed"`
+
+	Encrypted string `json:"encrypted"`
+	SealedKey string `json:"sealed_key"`
+	Preset    string `json:"preset"`
+	Template  string `json:"template"`
+	Org       string `json:"org"`
+
+	CallbackURL    string `json:"callback_url"`
+	CallbackSecret string `json:"callback_secret"`
+
+	Pipeline        string `json:"pipeline"`         // comma-separated, like the form field
+	AdvancedOptions string `json:"advanced_options"` // name=value pairs, like the form field
+}
+
+func initUploadHandler(w http.ResponseWriter, r *http.Request) {
+	var req initUploadRequest
+	fieldNames, err := decodeJobRequest(r, &req)
+	if err != nil {
+		http.Error(w, "Invalid upload request", http.StatusBadRequest)
+		return
+	}
+	if req.FileName == "" {
+		http.Error(w, "Invalid filename value", http.StatusBadRequest)
+		return
+	}
+	if req.Size <= 0 {
+		http.Error(w, "Invalid size value", http.StatusBadRequest)
+		return
+	}
+	if req.Size > maxUploadBytes {
+		writeRejection(w, http.StatusRequestEntityTooLarge, "file_too_large", "File too large", sizeRemedy(maxUploadBytes))
+		return
+	}
+	if rej := checkInputFormat(req.FileName, req.ContentType); rej != nil {
+		writeRejection(w, http.StatusUnsupportedMediaType, rej.Code, rej.Error, rej.Remediation)
+		return
+	}
+	fields := map[string]string{
+		"stem_mode": req.StemMode, "isolate_stem": req.IsolateStem, "output_format": req.OutputFormat,
+		"model": req.Model, "segment": req.Segment, "overlap": req.Overlap, "shifts": req.Shifts, "clip_mode": req.ClipMode,
+		"mp3_bitrate": req.MP3Bitrate, "extra_formats": req.ExtraFormats, "deterministic": req.Deterministic, "seed": req.Seed, "callback_url": req.CallbackURL, "callback_secret": req.CallbackSecret,
+		"pipeline": req.Pipeline, "advanced_options": req.AdvancedOptions, "encrypted": req.Encrypted, "sealed_key": req.SealedKey,
+		"preset": req.Preset, "template": req.Template, "org": req.Org,
+	}
+	// Validate now so a bad option fails before any data is sent
+	opts, err := parseJobOptions(func(key string) string { return fields[key] })
+	if err == nil {
+		err = opts.checkFields(fieldNames, jsonFieldNames(&req), strictOptions(r))
+	}
+	if err != nil {
+		writeRejection(w, http.StatusBadRequest, "invalid_option", err.Error(), optionRemedy(err))
+		return
+	}
+	if e := checkTier(r.Context(), opts, ""); e != nil {
+		writeJSON(w, http.StatusForbidden, e)
+		return
+	}
+	if uerr := checkOrg(r.Context(), opts.Org); uerr != nil {
+		uerr.write(w)
+		return
+	}
+	if rej := checkQueueRoom(); rej != nil {
+		writeRejection(w, http.StatusServiceUnavailable, rej.Code, rej.Error, rej.Remediation)
+		return
+	}
+	if e := checkDiskSpace(map[string]int64{
+		uploadDir: req.Size,
+		outputDir: estimateOutputBytes(req.Size, req.FileName, opts),
+	}); e != nil {
+		writeStorageError(w, e)
+		return
+	}
+
+	if err := os.MkdirAll(partialUploadDir(), 0755); err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	u := &PartialUpload{
+		ID:          uuid.New().String(),
+		FileName:    req.FileName,
+		Size:        req.Size,
+		Options:     fields,
+		Ignored:     opts.Ignored,
+		ContentType: req.ContentType,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		apiKeyID:    apiKeyID(r.Context()),
+	}
+	u.TempPath = filepath.Join(partialUploadDir(), u.ID+".part")
+	if err := os.WriteFile(u.TempPath, nil, 0644); err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	if err := u.save(); err != nil {
+		os.Remove(u.TempPath)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	partialUploadsMutex.Lock()
+	partialUploads[u.ID] = u
+	partialUploadsMutex.Unlock()
+
+	writeJSON(w, http.StatusCreated, u.view())
+}
+
+// lockPartialUpload returns the {id} upload with its mutex held, writing a
+// 404 when it doesn't exist or belongs to another key
+func lockPartialUpload(w http.ResponseWriter, r *http.Request) (*PartialUpload, bool) {
+	partialUploadsMutex.Lock()
+	u, exists := partialUploads[mux.Vars(r)["id"]]
+	partialUploadsMutex.Unlock()
+	exists = exists && ownedByRequest(r, u.apiKeyID)
+	if exists {
+		u.mu.Lock()
+		if !u.closed {
+			return u, true
+		}
+		u.mu.Unlock()
+	}
+	http.Error(w, "Upload not found", http.StatusNotFound)
+	return nil, false
+}
+
+func getUploadHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := lockPartialUpload(w, r)
+	if !ok {
+		return
+	}
+	defer u.mu.Unlock()
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Received, 10))
+	writeJSON(w, http.StatusOK, u.view())
+}
+
+// appendUploadHandler writes one chunk at the offset given in Upload-Offset,
+// which must match what has been received so far
+func appendUploadHandler(w http.ResponseWriter, r *http.Request) {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+	u, ok := lockPartialUpload(w, r)
+	if !ok {
+		return
+	}
+	defer u.mu.Unlock()
+	if offset != u.Received {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Received, 10))
+		http.Error(w, fmt.Sprintf("Offset mismatch: expected %d", u.Received), http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(u.TempPath, os.O_WRONLY, 0644)
+	if err != nil {
+		http.Error(w, "Failed to save chunk", http.StatusInternalServerError)
+		return
+	}
+	// Truncate any bytes past the offset left by an earlier interrupted chunk
+	f.Truncate(offset)
+	f.Seek(offset, io.SeekStart)
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, u.Size-offset+1))
+	f.Close()
+
+	u.Received += n
+	if u.Received > u.Size {
+		os.Truncate(u.TempPath, offset)
+		u.Received = offset
+		http.Error(w, "Chunk exceeds declared size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	u.UpdatedAt = time.Now().UTC()
+	if err := u.save(); err != nil {
+		log.Printf("Failed to save upload state %s: %v", u.ID, err)
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Received, 10))
+	if copyErr != nil {
+		// Keep what arrived; the client resumes from the reported offset
+		if isBodyTooLarge(copyErr) {
+			http.Error(w, "Chunk too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if isNoSpace(copyErr) {
+			writeStorageError(w, &storageError{Error: "Insufficient storage", Path: uploadDir})
+			return
+		}
+		http.Error(w, "Chunk interrupted", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, u.view())
+}
+
+// completeUploadHandler turns a fully received upload into a job
+func completeUploadHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := lockPartialUpload(w, r)
+	if !ok {
+		return
+	}
+	defer u.mu.Unlock()
+	if u.Received != u.Size {
+		http.Error(w, fmt.Sprintf("Upload incomplete: %d of %d bytes received", u.Received, u.Size), http.StatusConflict)
+		return
+	}
+	opts, err := parseJobOptions(func(key string) string { return u.Options[key] })
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.Force = opts.Encrypted || r.URL.Query().Get("force") == "true"
+	for name, reason := range u.Ignored {
+		opts.ignore(name, reason)
+	}
+	// The job is the starting key's, whose tier may have changed since
+	ctx := context.WithValue(r.Context(), apiKeyContextKey{}, u.apiKeyID)
+	if e := checkTier(ctx, opts, ""); e != nil {
+		writeJSON(w, http.StatusForbidden, e)
+		return
+	}
+
+	jobID := uuid.New().String()
+	safeFilename := sanitizeFilename(u.FileName)
+	recordedExt, isRecording := recordedExtension(u.FileName, u.ContentType)
+	isRecording = isRecording && !opts.Encrypted
+	if isRecording {
+		safeFilename = withExtension(safeFilename, recordedExt)
+	}
+	uploadPath := filepath.Join(uploadDir, jobID+"_"+safeFilename)
+	if err := os.Rename(u.TempPath, uploadPath); err != nil {
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+	os.Remove(filepath.Join(partialUploadDir(), u.ID+".json"))
+	u.closed = true
+	partialUploadsMutex.Lock()
+	delete(partialUploads, u.ID)
+	partialUploadsMutex.Unlock()
+
+	opts.Watermark = jobWatermark(u.apiKeyID)
+	job := newJob(jobID, safeFilename, opts)
+	job.APIKeyID = u.apiKeyID
+	job.RequestID = requestID(r.Context())
+	jobsMutex.Lock()
+	jobs[jobID] = job
+	jobsMutex.Unlock()
+
+	if uerr := acceptUpload(ctx, job, uploadPath, isRecording); uerr != nil {
+		uerr.write(w)
+		return
+	}
+	jobsMutex.RLock()
+	snapshot := job.snapshot()
+	jobsMutex.RUnlock()
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+func abortUploadHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := lockPartialUpload(w, r)
+	if !ok {
+		return
+	}
+	defer u.mu.Unlock()
+	u.closed = true
+	partialUploadsMutex.Lock()
+	delete(partialUploads, u.ID)
+	partialUploadsMutex.Unlock()
+	u.remove()
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
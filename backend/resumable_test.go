@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func TestResumableUploadSurvivesRestart(t *testing.T) {
+	oldUploadDir := uploadDir
+	uploadDir = t.TempDir()
+	externalWorkers = true // keep the job from being dispatched to a processor
+	t.Cleanup(func() { uploadDir, externalWorkers = oldUploadDir, false })
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/upload/init", initUploadHandler).Methods("POST")
+	router.HandleFunc("/api/upload/{id}", getUploadHandler).Methods("GET")
+	router.HandleFunc("/api/upload/{id}", appendUploadHandler).Methods("PATCH")
+	router.HandleFunc("/api/upload/{id}/complete", completeUploadHandler).Methods("POST")
+	do := func(method, path, offset, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if offset != "" {
+			req.Header.Set("Upload-Offset", offset)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("POST", "/api/upload/init", "", `{"filename": "master.wav", "size": 10, "output_format": "flac"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("init = %d: %s", rec.Code, rec.Body.String())
+	}
+	var u PartialUpload
+	json.Unmarshal(rec.Body.Bytes(), &u)
+	if rec := do("PATCH", "/api/upload/"+u.ID, "0", "RIFF-"); rec.Code != http.StatusOK {
+		t.Fatalf("first chunk = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Simulate a restart: forget everything in memory and reload from disk
+	partialUploadsMutex.Lock()
+	partialUploads = make(map[string]*PartialUpload)
+	partialUploadsMutex.Unlock()
+	loadPartialUploads()
+
+	rec = do("GET", "/api/upload/"+u.ID, "", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("resume = %d offset %q, want 200 at 5", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	if rec := do("PATCH", "/api/upload/"+u.ID, "0", "RIFF-"); rec.Code != http.StatusConflict {
+		t.Errorf("chunk at stale offset = %d, want 409", rec.Code)
+	}
+	if rec := do("POST", "/api/upload/"+u.ID+"/complete", "", ""); rec.Code != http.StatusConflict {
+		t.Errorf("complete before all bytes = %d, want 409", rec.Code)
+	}
+	if rec := do("PATCH", "/api/upload/"+u.ID, "5", "WAVE!"); rec.Code != http.StatusOK {
+		t.Fatalf("second chunk = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = do("POST", "/api/upload/"+u.ID+"/complete", "", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("complete = %d: %s", rec.Code, rec.Body.String())
+	}
+	var job Job
+	json.Unmarshal(rec.Body.Bytes(), &job)
+	jobsMutex.RLock()
+	input, format := jobs[job.ID].inputPath, jobs[job.ID].OutputFormat
+	jobsMutex.RUnlock()
+	if data, _ := os.ReadFile(input); string(data) != "RIFF-WAVE!" || format != "flac" {
+		t.Errorf("job input = %q (format %s), want the assembled file", data, format)
+	}
+	if entries, _ := os.ReadDir(partialUploadDir()); len(entries) != 0 {
+		t.Errorf("%d partial files left after complete", len(entries))
+	}
+}
+
+func TestExpirePartialUploads(t *testing.T) {
+	oldUploadDir := uploadDir
+	uploadDir = t.TempDir()
+	t.Cleanup(func() { uploadDir = oldUploadDir })
+	os.MkdirAll(partialUploadDir(), 0755)
+
+	now := time.Now()
+	add := func(idle time.Duration) *PartialUpload {
+		u := &PartialUpload{ID: uuid.New().String(), Size: 10, UpdatedAt: now.Add(-idle)}
+		u.TempPath = filepath.Join(partialUploadDir(), u.ID+".part")
+		os.WriteFile(u.TempPath, []byte("abc"), 0644)
+		u.save()
+		partialUploadsMutex.Lock()
+		partialUploads[u.ID] = u
+		partialUploadsMutex.Unlock()
+		t.Cleanup(func() {
+			partialUploadsMutex.Lock()
+			delete(partialUploads, u.ID)
+			partialUploadsMutex.Unlock()
+		})
+		return u
+	}
+	stale, fresh, busy := add(25*time.Hour), add(time.Hour), add(25*time.Hour)
+	busy.mu.Lock() // a chunk is being written
+
+	if n := expirePartialUploads(now, 24*time.Hour); n != 1 {
+		t.Errorf("expired %d uploads, want 1", n)
+	}
+	busy.mu.Unlock()
+	partialUploadsMutex.Lock()
+	_, staleLeft := partialUploads[stale.ID]
+	_, freshLeft := partialUploads[fresh.ID]
+	_, busyLeft := partialUploads[busy.ID]
+	partialUploadsMutex.Unlock()
+	if staleLeft || !freshLeft || !busyLeft {
+		t.Errorf("left stale=%v fresh=%v busy=%v, want only the stale upload removed", staleLeft, freshLeft, busyLeft)
+	}
+	if _, err := os.Stat(stale.TempPath); !os.IsNotExist(err) {
+		t.Errorf("data of the expired upload still on disk: %v", err)
+	}
+	if v := fresh.view(); v.ExpiresAt == nil || !v.ExpiresAt.Equal(fresh.UpdatedAt.Add(defaultPartialUploadTTL)) {
+		t.Errorf("expires_at = %v", v.ExpiresAt)
+	}
+}
+
+func TestPartialUploadsBelongToTheirKey(t *testing.T) {
+	oldUploadDir := uploadDir
+	uploadDir = t.TempDir()
+	externalWorkers = true
+	t.Cleanup(func() { uploadDir, externalWorkers = oldUploadDir, false })
+	t.Setenv("TIERS", "free formats=mp3, pro")
+	apiKeysMutex.Lock()
+	apiKeys["upload-alice"] = &APIKey{ID: "upload-alice", Tier: "pro"}
+	apiKeysMutex.Unlock()
+	t.Cleanup(func() {
+		apiKeysMutex.Lock()
+		delete(apiKeys, "upload-alice")
+		apiKeysMutex.Unlock()
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/upload/init", initUploadHandler).Methods("POST")
+	router.HandleFunc("/api/upload/{id}", getUploadHandler).Methods("GET")
+	router.HandleFunc("/api/upload/{id}", appendUploadHandler).Methods("PATCH")
+	router.HandleFunc("/api/upload/{id}", abortUploadHandler).Methods("DELETE")
+	router.HandleFunc("/api/upload/{id}/complete", completeUploadHandler).Methods("POST")
+	as := func(key, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Upload-Offset", "0")
+		req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, key))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := as("upload-alice", "POST", "/api/upload/init", `{"filename": "master.wav", "size": 5, "output_format": "wav"}`)
+	var u PartialUpload
+	json.Unmarshal(rec.Body.Bytes(), &u)
+	if rec.Code != http.StatusCreated || strings.Contains(rec.Body.String(), "upload-alice") {
+		t.Fatalf("init = %d: %s", rec.Code, rec.Body)
+	}
+	if rec := as("upload-alice", "PATCH", "/api/upload/"+u.ID, "RIFF!"); rec.Code != http.StatusOK {
+		t.Fatalf("chunk = %d: %s", rec.Code, rec.Body)
+	}
+
+	// The owner is kept across a restart
+	partialUploadsMutex.Lock()
+	partialUploads = make(map[string]*PartialUpload)
+	partialUploadsMutex.Unlock()
+	loadPartialUploads()
+	for _, method := range []string{"GET", "PATCH", "DELETE"} {
+		if rec := as("upload-bob", method, "/api/upload/"+u.ID, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("bob %s alice's upload = %d", method, rec.Code)
+		}
+	}
+	if rec := as("upload-bob", "POST", "/api/upload/"+u.ID+"/complete", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("bob completing alice's upload = %d", rec.Code)
+	}
+
+	// A key moved to a lower tier meanwhile can't complete over it
+	apiKeysMutex.Lock()
+	apiKeys["upload-alice"].Tier = "free"
+	apiKeysMutex.Unlock()
+	if rec := as("upload-alice", "POST", "/api/upload/"+u.ID+"/complete", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("complete over the tier = %d: %s", rec.Code, rec.Body)
+	}
+	apiKeysMutex.Lock()
+	apiKeys["upload-alice"].Tier = "pro"
+	apiKeysMutex.Unlock()
+	rec = as("upload-alice", "POST", "/api/upload/"+u.ID+"/complete", "")
+	var job Job
+	json.Unmarshal(rec.Body.Bytes(), &job)
+	if rec.Code != http.StatusOK || job.APIKeyID != "upload-alice" {
+		t.Errorf("complete = %d, job of %q", rec.Code, job.APIKeyID)
+	}
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, job.ID)
+		jobsMutex.Unlock()
+	})
+}
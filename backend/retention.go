@@ -0,0 +1,199 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Retention. An upload is deleted as soon as its job has finished, since
+// only the stems are kept for users (KEEP_UPLOADS=true keeps them, e.g.
+// to replay debug bundles). With JOB_RETENTION_HOURS set, a janitor
+// expires completed jobs that finished longer ago than that: their stems
+// are deleted, locally and in remote storage, and the job stays listed
+// with status "expired", so downloads answer 410 Gone instead of 404.
+// A key's overrides can set a retention of its own for its jobs.
+// GET /api/admin/storage reports the disk usage of every job.
+
+// retentionSweepInterval is how often the janitor looks for expired jobs
+const retentionSweepInterval = 10 * time.Minute
+
+// jobExpiredMessage answers requests for the files of an expired job
+const jobExpiredMessage = "Job expired: its stems were deleted after the retention period"
+
+// jobRetention returns how long completed jobs are kept, or 0 for forever
+func jobRetention() time.Duration {
+	if h, err := strconv.ParseFloat(os.Getenv("JOB_RETENTION_HOURS"), 64); err == nil && h > 0 {
+		return time.Duration(h * float64(time.Hour))
+	}
+	return 0
+}
+
+func keepUploads() bool {
+	return os.Getenv("KEEP_UPLOADS") == "true"
+}
+
+// releaseUpload deletes a job's upload once the job has finished
+func releaseUpload(e Event) {
+	if (e.Type != EventJobCompleted && e.Type != EventJobFailed) || keepUploads() {
+		return
+	}
+	jobsMutex.Lock()
+	job, exists := jobs[e.Job.ID]
+	var inputPath string
+	if exists {
+		inputPath, job.inputPath = job.inputPath, ""
+	}
+	jobsMutex.Unlock()
+	if inputPath == "" {
+		return
+	}
+	if err := os.Remove(inputPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove upload of job %s: %v", e.Job.ID, err)
+	}
+	if s, remote := remoteStorage(); remote {
+		go deleteFromStorage(s, []string{storageKey(inputPath)})
+	}
+}
+
+// expiryDue reports whether job is a completed job past its retention as of
+// now, and returns the retention
+func expiryDue(job *Job, now time.Time, ttl time.Duration, retentions map[string]time.Duration) (time.Duration, bool) {
+	if job.Status != "completed" || job.CompletedAt == nil {
+		return 0, false
+	}
+	keep := retentionOf(job, ttl, retentions)
+	return keep, keep > 0 && now.Sub(*job.CompletedAt) >= keep
+}
+
+// jobFiles returns the stems and upload of a job, which expiry deletes
+func jobFiles(job *Job) []string {
+	var paths []string
+	for _, name := range sortedKeys(job.OutputFiles) {
+		paths = append(paths, job.OutputFiles[name])
+	}
+	if job.inputPath != "" {
+		paths = append(paths, job.inputPath)
+	}
+	return paths
+}
+
+// expireJobs deletes the stems of completed jobs that finished longer
+// before now than their retention (ttl unless their key overrides it; 0
+// keeps them) and returns how many jobs expired
+func expireJobs(now time.Time, ttl time.Duration) int {
+	retentions := keyRetentions()
+	var expired []Job
+	var files [][]string
+	jobsMutex.Lock()
+	for _, job := range jobs {
+		if _, due := expiryDue(job, now, ttl, retentions); !due {
+			continue
+		}
+		paths := jobFiles(job)
+		job.Status = "expired"
+		job.ExpiredAt = &now
+		job.OutputFiles = nil
+		job.inputPath = ""
+		job.Stored = false
+		expired = append(expired, job.snapshot())
+		files = append(files, paths)
+	}
+	jobsMutex.Unlock()
+
+	s, remote := remoteStorage()
+	for i, job := range expired {
+		var keys []string
+		for _, path := range files[i] {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to remove %s of expired job %s: %v", path, job.ID, err)
+			}
+			keys = append(keys, storageKey(path))
+		}
+		os.RemoveAll(filepath.Join(outputDir, job.ID))
+		if remote {
+			go deleteFromStorage(s, keys)
+		}
+		emitEvent(EventJobExpired, job)
+	}
+	return len(expired)
+}
+
+// retentionJanitor expires jobs every interval
+func retentionJanitor(interval time.Duration) {
+	for range time.Tick(interval) {
+		if n := expireJobs(time.Now(), jobRetention()); n > 0 {
+			log.Printf("Retention: expired %d jobs", n)
+		}
+	}
+}
+
+// jobStorageUsage is one job's entry in /api/admin/storage
+type jobStorageUsage struct {
+	ID          string     `json:"id"`
+	FileName    string     `json:"filename"`
+	Status      string     `json:"status"`
+	UploadBytes int64      `json:"upload_bytes"`
+	OutputBytes int64      `json:"output_bytes"`
+	TotalBytes  int64      `json:"total_bytes"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// storageUsageHandler reports disk usage per job, largest first
+func storageUsageHandler(w http.ResponseWriter, r *http.Request) {
+	ttl := jobRetention()
+	retentions := keyRetentions()
+	jobsMutex.RLock()
+	usage := make([]jobStorageUsage, 0, len(jobs))
+	inputs := make([]string, 0, len(jobs))
+	for _, job := range jobs {
+		u := jobStorageUsage{ID: job.ID, FileName: job.FileName, Status: job.Status, CompletedAt: job.CompletedAt}
+		if keep := retentionOf(job, ttl, retentions); keep > 0 && job.Status == "completed" && job.CompletedAt != nil {
+			expires := job.CompletedAt.Add(keep)
+			u.ExpiresAt = &expires
+		}
+		usage = append(usage, u)
+		inputs = append(inputs, job.inputPath)
+	}
+	jobsMutex.RUnlock()
+
+	var uploadBytes, outputBytes int64
+	for i := range usage {
+		u := &usage[i]
+		if inputs[i] != "" {
+			u.UploadBytes = entrySize(inputs[i])
+		}
+		u.OutputBytes = entrySize(filepath.Join(outputDir, u.ID))
+		u.TotalBytes = u.UploadBytes + u.OutputBytes
+		uploadBytes += u.UploadBytes
+		outputBytes += u.OutputBytes
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].TotalBytes != usage[j].TotalBytes {
+			return usage[i].TotalBytes > usage[j].TotalBytes
+		}
+		return usage[i].ID < usage[j].ID
+	})
+
+	volumes := map[string]interface{}{}
+	for name, dir := range map[string]string{"uploads": uploadDir, "outputs": outputDir} {
+		v := map[string]interface{}{"path": dir, "used_bytes": entrySize(dir)}
+		if free, _, err := diskFree(dir); err == nil {
+			v["free_bytes"] = free
+		}
+		volumes[name] = v
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"retention_hours":  ttl.Hours(),
+		"keep_uploads":     keepUploads(),
+		"job_upload_bytes": uploadBytes,
+		"job_output_bytes": outputBytes,
+		"volumes":          volumes,
+		"jobs":             usage,
+	})
+}
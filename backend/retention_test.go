@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func TestReleaseUploadAfterProcessing(t *testing.T) {
+	oldUploadDir := uploadDir
+	uploadDir = t.TempDir()
+	t.Cleanup(func() { uploadDir = oldUploadDir })
+
+	newFinishedJob := func() (*Job, string) {
+		id := uuid.New().String()
+		input := filepath.Join(uploadDir, id+"_song.mp3")
+		os.WriteFile(input, []byte("ID3"), 0644)
+		job := &Job{ID: id, Status: "completed", inputPath: input}
+		jobsMutex.Lock()
+		jobs[id] = job
+		jobsMutex.Unlock()
+		t.Cleanup(func() {
+			jobsMutex.Lock()
+			delete(jobs, id)
+			jobsMutex.Unlock()
+		})
+		return job, input
+	}
+
+	job, input := newFinishedJob()
+	releaseUpload(Event{Type: EventJobProcessing, Job: *job})
+	if _, err := os.Stat(input); err != nil {
+		t.Fatal("upload removed while the job was running")
+	}
+	releaseUpload(Event{Type: EventJobCompleted, Job: *job})
+	if _, err := os.Stat(input); !os.IsNotExist(err) {
+		t.Error("upload kept after the job completed")
+	}
+	jobsMutex.RLock()
+	if job.inputPath != "" {
+		t.Errorf("inputPath = %q after release", job.inputPath)
+	}
+	jobsMutex.RUnlock()
+
+	t.Setenv("KEEP_UPLOADS", "true")
+	job, input = newFinishedJob()
+	releaseUpload(Event{Type: EventJobFailed, Job: *job})
+	if _, err := os.Stat(input); err != nil {
+		t.Error("upload removed with KEEP_UPLOADS=true")
+	}
+}
+
+func TestExpireJobs(t *testing.T) {
+	oldUploadDir, oldOutputDir := uploadDir, outputDir
+	uploadDir, outputDir = t.TempDir(), t.TempDir()
+	t.Setenv("JOB_RETENTION_HOURS", "2")
+	t.Cleanup(func() { uploadDir, outputDir = oldUploadDir, oldOutputDir })
+
+	now := time.Now()
+	newCompletedJob := func(age time.Duration, size int) string {
+		id := uuid.New().String()
+		vocals := filepath.Join(outputDir, id, "song_t2s_vocals.mp3")
+		os.MkdirAll(filepath.Dir(vocals), 0755)
+		os.WriteFile(vocals, make([]byte, size), 0644)
+		completed := now.Add(-age)
+		jobsMutex.Lock()
+		jobs[id] = &Job{ID: id, Status: "completed", CompletedAt: &completed, OutputFiles: map[string]string{"vocals": vocals}}
+		jobsMutex.Unlock()
+		t.Cleanup(func() {
+			jobsMutex.Lock()
+			delete(jobs, id)
+			jobsMutex.Unlock()
+		})
+		return id
+	}
+	old, recent := newCompletedJob(3*time.Hour, 10), newCompletedJob(time.Hour, 20)
+
+	if n := expireJobs(now, jobRetention()); n != 1 {
+		t.Fatalf("expired %d jobs, want 1", n)
+	}
+	jobsMutex.RLock()
+	oldJob, recentJob := jobs[old].snapshot(), jobs[recent].snapshot()
+	jobsMutex.RUnlock()
+	if oldJob.Status != "expired" || oldJob.ExpiredAt == nil || oldJob.OutputFiles != nil || recentJob.Status != "completed" {
+		t.Errorf("jobs after expiry = %+v, %+v", oldJob, recentJob)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, old)); !os.IsNotExist(err) {
+		t.Error("stems of the expired job are still on disk")
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/download/{id}/{stem}", downloadHandler)
+	router.HandleFunc("/api/jobs/{id}/package", packageJobHandler)
+	router.HandleFunc("/api/admin/storage", storageUsageHandler)
+	for _, path := range []string{"/api/download/" + old + "/vocals", "/api/jobs/" + old + "/package"} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusGone {
+			t.Errorf("%s = %d, want 410", path, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/admin/storage", nil))
+	var report struct {
+		RetentionHours float64           `json:"retention_hours"`
+		Jobs           []jobStorageUsage `json:"jobs"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	if report.RetentionHours != 2 || len(report.Jobs) < 2 {
+		t.Fatalf("storage report = %s", rec.Body.String())
+	}
+	first := report.Jobs[0]
+	if first.ID != recent || first.OutputBytes != 20 || first.ExpiresAt == nil || !first.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("largest job = %+v", first)
+	}
+}
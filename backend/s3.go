@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Config addresses an S3-compatible bucket (AWS, MinIO, R2, ...)
+type s3Config struct {
+	Endpoint  string // empty for AWS virtual-hosted style
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Service   string // SigV4 service name, "s3" when empty
+}
+
+// s3ConfigFromEnv reads <PREFIX>_BUCKET, _REGION, _ENDPOINT, _PREFIX and
+// _ACCESS_KEY_ID/_SECRET_ACCESS_KEY (falling back to the AWS_* variables)
+func s3ConfigFromEnv(prefix string) (*s3Config, bool) {
+	c := &s3Config{
+		Endpoint:  strings.TrimSuffix(os.Getenv(prefix+"_ENDPOINT"), "/"),
+		Region:    os.Getenv(prefix + "_REGION"),
+		Bucket:    os.Getenv(prefix + "_BUCKET"),
+		Prefix:    strings.Trim(os.Getenv(prefix+"_PREFIX"), "/"),
+		AccessKey: os.Getenv(prefix + "_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv(prefix + "_SECRET_ACCESS_KEY"),
+	}
+	if c.Bucket == "" {
+		return nil, false
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.AccessKey == "" {
+		c.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		c.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	return c, c.AccessKey != "" && c.SecretKey != ""
+}
+
+// objectURL returns the URL of key, path-style when a custom endpoint is set
+func (c *s3Config) objectURL(key string) string {
+	if c.Prefix != "" {
+		key = c.Prefix + "/" + key
+	}
+	escaped := make([]string, 0)
+	for _, part := range strings.Split(key, "/") {
+		escaped = append(escaped, s3Escape(part))
+	}
+	key = strings.Join(escaped, "/")
+	if c.Endpoint != "" {
+		return c.Endpoint + "/" + c.Bucket + "/" + key
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", c.Bucket, c.Region, key)
+}
+
+func (c *s3Config) service() string {
+	if c.Service == "" {
+		return "s3"
+	}
+	return c.Service
+}
+
+// s3Escape percent-encodes everything but the SigV4 unreserved characters
+func s3Escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req,
+// signing the host and every header already set on the request
+func (c *s3Config) signV4(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := sortedKeys(headers)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.Region + "/" + c.service() + "/aws4_request"
+	signature := c.signature(amzDate, scope, canonicalRequest)
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery sorts and encodes query parameters the way SigV4 signs them
+func canonicalQuery(query url.Values) string {
+	queryKeys := make([]string, 0, len(query))
+	for k := range query {
+		queryKeys = append(queryKeys, k)
+	}
+	sort.Strings(queryKeys)
+	var parts []string
+	for _, k := range queryKeys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// signature signs a canonical request with the secret key
+func (c *s3Config) signature(amzDate, scope, canonicalRequest string) string {
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), amzDate[:8])
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, c.service())
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// presignURL signs rawURL in its query string, so it can be fetched
+// without credentials until ttl has passed
+func (c *s3Config) presignURL(method, rawURL string, ttl time.Duration, now time.Time) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + c.Region + "/" + c.service() + "/aws4_request"
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", c.AccessKey+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(ttl.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	u.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + c.signature(amzDate, scope, canonicalRequest)
+	return u.String(), nil
+}
+
+// putObjectFile uploads a local file to key. The payload is sent unsigned so
+// large stems stream from disk; endpoints should use TLS.
+func (c *s3Config) putObjectFile(ctx context.Context, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", c.objectURL(key), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	c.signV4(req, "UNSIGNED-PAYLOAD", time.Now())
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("PUT returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// getObject streams key; a missing object is reported as os.ErrNotExist
+func (c *s3Config) getObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	c.signV4(req, emptyPayloadHash, time.Now())
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return nil, fmt.Errorf("GET returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// deleteObject removes key; deleting a missing object succeeds
+func (c *s3Config) deleteObject(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", c.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	c.signV4(req, emptyPayloadHash, time.Now())
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("DELETE returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
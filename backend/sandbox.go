@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// Media sandbox. ffmpeg, ffprobe and fpcalc decode whatever users upload,
+// the classic way into a public service, so every invocation goes through
+// mediaCommand: the tool runs under a shell that lowers its rlimits
+// (address space MEDIA_MEMORY_LIMIT_MB, CPU time MEDIA_CPU_SECONDS, open
+// files) before exec'ing it, with only PATH, HOME and TMPDIR set, so none
+// of the backend's credentials are in its environment. ffmpeg and ffprobe
+// only get the file and pipe protocols, and on Linux the tool also runs in
+// its own network namespace where the host allows unprivileged ones.
+// Stream ingest, which has to reach the stream, keeps the network but not
+// the rest. Callers keep their own timeouts. MEDIA_SANDBOX=off runs the
+// tools as plain subprocesses.
+//
+// File access is not confined: the tools start in an empty directory of
+// their own, but can read and write any absolute path the backend's user
+// can. Run the backend as a user with access to little besides its upload
+// and output directories.
+
+// mediaWorkDir is the working directory of sandboxed tools, so nothing they
+// write to a relative path lands in the backend's
+var mediaWorkDir = sync.OnceValue(func() string {
+	dir, err := os.MkdirTemp("", "t2s-media-")
+	if err != nil {
+		log.Printf("Media sandbox: no private working directory: %v", err)
+		return os.TempDir()
+	}
+	return dir
+})
+
+// mediaSandboxShell is the shell that applies the limits, empty when there
+// is none and tools run unconfined
+var mediaSandboxShell = sync.OnceValue(func() string {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		log.Printf("Media sandbox: no sh to apply resource limits with, media tools run unconfined")
+		return ""
+	}
+	return sh
+})
+
+func mediaSandboxEnabled() bool {
+	return os.Getenv("MEDIA_SANDBOX") != "off"
+}
+
+// mediaLimit reads a positive integer limit, fallback when unset or invalid
+func mediaLimit(name string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
+
+// mediaLimitScript lowers the shell's limits, which the tool it execs
+// inherits. Sizes are in KiB, as ulimit -v takes them. A limit the host
+// already keeps lower fails to apply and the lower one stays.
+func mediaLimitScript() string {
+	memoryKB := mediaLimit("MEDIA_MEMORY_LIMIT_MB", 2048) * 1024
+	cpuSeconds := mediaLimit("MEDIA_CPU_SECONDS", 900)
+	return "ulimit -v " + strconv.Itoa(memoryKB) + "; ulimit -t " + strconv.Itoa(cpuSeconds) +
+		`; ulimit -n 256; exec "$@"`
+}
+
+// restrictProtocols keeps ffmpeg and ffprobe to local files and pipes:
+// -protocol_whitelist is an input option, so it goes before every input
+func restrictProtocols(name string, args []string) []string {
+	switch name {
+	case "ffprobe":
+		return append([]string{"-protocol_whitelist", "file,pipe"}, args...)
+	case "ffmpeg":
+		restricted := make([]string, 0, len(args)+2)
+		for _, arg := range args {
+			if arg == "-i" {
+				restricted = append(restricted, "-protocol_whitelist", "file,pipe")
+			}
+			restricted = append(restricted, arg)
+		}
+		return restricted
+	}
+	return args
+}
+
+// mediaCommand runs a media tool on local files in the sandbox
+func mediaCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	return sandboxedCommand(ctx, false, name, restrictProtocols(name, args))
+}
+
+// networkMediaCommand runs a media tool that reads from the network, with
+// the sandbox's limits but not its network isolation
+func networkMediaCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	return sandboxedCommand(ctx, true, name, args)
+}
+
+func sandboxedCommand(ctx context.Context, network bool, name string, args []string) *exec.Cmd {
+	path, err := exec.LookPath(name)
+	if err != nil || !mediaSandboxEnabled() || mediaSandboxShell() == "" {
+		// A missing tool still fails with exec.ErrNotFound
+		return exec.CommandContext(ctx, name, args...)
+	}
+	cmd := exec.CommandContext(ctx, mediaSandboxShell(), append([]string{"-c", mediaLimitScript(), name, path}, args...)...)
+	cmd.Dir = mediaWorkDir()
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "HOME=" + cmd.Dir, "TMPDIR=" + cmd.Dir}
+	if !network {
+		cmd.SysProcAttr = isolatedNetwork()
+	}
+	return cmd
+}
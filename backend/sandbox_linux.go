@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// networkNamespaceAttr puts a process in new user and network namespaces,
+// mapped to the backend's own user so it keeps its file access
+func networkNamespaceAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}},
+	}
+}
+
+// networkNamespaces reports whether this host lets the backend create
+// namespaces; container runtimes' default seccomp profiles often don't
+var networkNamespaces = sync.OnceValue(func() bool {
+	cmd := exec.Command(mediaSandboxShell(), "-c", "exit 0")
+	cmd.SysProcAttr = networkNamespaceAttr()
+	if err := cmd.Run(); err != nil {
+		log.Printf("Media sandbox: network namespaces unavailable (%v), relying on ffmpeg's protocol whitelist", err)
+		return false
+	}
+	return true
+})
+
+// isolatedNetwork returns the process attributes that keep a media tool
+// off the network, or nil when the host doesn't allow it
+func isolatedNetwork() *syscall.SysProcAttr {
+	if !networkNamespaces() {
+		return nil
+	}
+	return networkNamespaceAttr()
+}
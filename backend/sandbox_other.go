@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// isolatedNetwork has no namespaces to offer on this platform, so media
+// tools rely on ffmpeg's protocol whitelist alone
+func isolatedNetwork() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestrictProtocols(t *testing.T) {
+	got := strings.Join(restrictProtocols("ffmpeg", []string{"-y", "-i", "a.wav", "-i", "b.wav", "out.wav"}), " ")
+	if got != "-y -protocol_whitelist file,pipe -i a.wav -protocol_whitelist file,pipe -i b.wav out.wav" {
+		t.Errorf("ffmpeg args = %s", got)
+	}
+	if got := strings.Join(restrictProtocols("ffprobe", []string{"-v", "error", "a.wav"}), " "); got != "-protocol_whitelist file,pipe -v error a.wav" {
+		t.Errorf("ffprobe args = %s", got)
+	}
+	if got := strings.Join(restrictProtocols("fpcalc", []string{"-json", "a.wav"}), " "); got != "-json a.wav" {
+		t.Errorf("fpcalc args = %s", got)
+	}
+}
+
+func TestMediaCommandSandbox(t *testing.T) {
+	if mediaSandboxShell() == "" {
+		t.Skip("no sh")
+	}
+	// An ffmpeg that reports what it runs with
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho \"args=$*\"\necho \"cwd=$(pwd)\"\necho \"memory=$(ulimit -v)\"\necho \"cpu=$(ulimit -t)\"\nenv\n"
+	os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0755)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("MEDIA_MEMORY_LIMIT_MB", "512")
+	t.Setenv("MEDIA_CPU_SECONDS", "60")
+	t.Setenv("S3_SECRET_ACCESS_KEY", "hunter2")
+
+	out, err := mediaCommand(context.Background(), "ffmpeg", "-i", "in.wav", "out.flac").Output()
+	if err != nil {
+		t.Fatalf("sandboxed ffmpeg: %v", err)
+	}
+	report := string(out)
+	for _, want := range []string{"args=-protocol_whitelist file,pipe -i in.wav out.flac", "cwd=" + mediaWorkDir(), "memory=524288", "cpu=60"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("missing %q in:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "hunter2") {
+		t.Errorf("backend environment leaked into the tool:\n%s", report)
+	}
+
+	t.Setenv("MEDIA_SANDBOX", "off")
+	if out, _ := mediaCommand(context.Background(), "ffmpeg").Output(); !strings.Contains(string(out), "hunter2") {
+		t.Errorf("MEDIA_SANDBOX=off still scrubbed the environment")
+	}
+
+	// A missing tool is reported as such, as without the sandbox
+	t.Setenv("MEDIA_SANDBOX", "")
+	if err := mediaCommand(context.Background(), "no-such-ffprobe").Run(); !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("missing tool = %v", err)
+	}
+}
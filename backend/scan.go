@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Optional virus scanning of uploads before a job is accepted.
+//
+//	CLAMD_ADDRESS=unix:/run/clamav/clamd.sock or tcp:clamav:3310
+//	ICAP_URL=icap://icap.example.com:1344/avscan
+//	SCAN_FAIL_OPEN=true   accept uploads when the scanner is unreachable
+//
+// Every verdict is recorded in the audit log.
+
+const scanTimeout = 2 * time.Minute
+
+// virusScanner checks a file and returns the name of the detected threat,
+// or "" when the file is clean
+type virusScanner interface {
+	Name() string
+	Scan(ctx context.Context, path string) (string, error)
+}
+
+// virusScannerFromEnv returns the configured scanner, or nil when scanning is off
+func virusScannerFromEnv() virusScanner {
+	if addr := os.Getenv("CLAMD_ADDRESS"); addr != "" {
+		network, address := "tcp", addr
+		if n, a, ok := strings.Cut(addr, ":"); ok && (n == "unix" || n == "tcp") {
+			network, address = n, a
+		}
+		return &clamdScanner{network: network, address: address}
+	}
+	if raw := os.Getenv("ICAP_URL"); raw != "" {
+		return &icapScanner{url: raw}
+	}
+	return nil
+}
+
+// scanUpload scans a saved upload and audits the verdict. It returns a
+// non-zero HTTP status and message when the upload must be rejected.
+func scanUpload(ctx context.Context, scanner virusScanner, jobID, fileName, path string) (int, string) {
+	ctx, cancel := context.WithTimeout(ctx, scanTimeout)
+	defer cancel()
+	threat, err := scanner.Scan(ctx, path)
+
+	fields := map[string]string{"scanner": scanner.Name(), "filename": fileName}
+	switch {
+	case err != nil:
+		fields["verdict"] = "error"
+		fields["error"] = err.Error()
+		if os.Getenv("SCAN_FAIL_OPEN") == "true" {
+			fields["accepted"] = "true"
+			recordAudit("upload.scan", jobID, fields)
+			return 0, ""
+		}
+		recordAudit("upload.scan", jobID, fields)
+		return http.StatusServiceUnavailable, "Virus scan unavailable"
+	case threat != "":
+		fields["verdict"] = "infected"
+		fields["threat"] = threat
+		recordAudit("upload.scan", jobID, fields)
+		return http.StatusUnprocessableEntity, "File rejected by virus scan"
+	}
+	fields["verdict"] = "clean"
+	recordAudit("upload.scan", jobID, fields)
+	return 0, ""
+}
+
+// clamdScanner streams the file to clamd with the INSTREAM command
+type clamdScanner struct {
+	network string
+	address string
+}
+
+func (s *clamdScanner) Name() string { return "clamd" }
+
+func (s *clamdScanner) Scan(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 64<<10)
+	for {
+		n, readErr := f.Read(buf)
+		if n > 0 {
+			var size [4]byte
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, err := conn.Write(append(size[:], buf[:n]...)); err != nil {
+				return "", err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return "", readErr
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply reads "stream: OK", "stream: <name> FOUND" or "... ERROR"
+func parseClamdReply(reply string) (string, error) {
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// icapScanner sends the file as an HTTP response body with ICAP RESPMOD;
+// 204 means unmodified (clean), 200 means the server replaced it (infected)
+type icapScanner struct {
+	url string
+}
+
+func (s *icapScanner) Name() string { return "icap" }
+
+func (s *icapScanner) Scan(ctx context.Context, path string) (string, error) {
+	u, err := url.Parse(s.url)
+	if err != nil || u.Scheme != "icap" || u.Host == "" {
+		return "", fmt.Errorf("invalid ICAP_URL")
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "1344")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	resHeader := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n"
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\nHost: %s\r\nAllow: 204\r\nEncapsulated: res-hdr=0, res-body=%d\r\n\r\n%s",
+		s.url, u.Hostname(), len(resHeader), resHeader)
+	buf := make([]byte, 64<<10)
+	for {
+		n, readErr := f.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return "", readErr
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	status, err := tp.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return "", err
+	}
+	fields := strings.Fields(status)
+	if len(fields) < 2 {
+		return "", fmt.Errorf("icap: malformed status %q", status)
+	}
+	switch fields[1] {
+	case "204":
+		return "", nil
+	case "200":
+		for _, h := range []string{"X-Virus-Id", "X-Infection-Found"} {
+			if v := header.Get(h); v != "" {
+				return v, nil
+			}
+		}
+		return "unknown", nil
+	}
+	return "", fmt.Errorf("icap: %s", status)
+}
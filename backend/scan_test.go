@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeClamd answers INSTREAM requests, flagging streams that contain "EICAR"
+func fakeClamd(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var data bytes.Buffer
+				for {
+					var size uint32
+					if binary.Read(r, binary.BigEndian, &size) != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					io.CopyN(&data, r, int64(size))
+				}
+				if bytes.Contains(data.Bytes(), []byte("EICAR")) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestUploadRejectsInfectedFile(t *testing.T) {
+	oldUploadDir := uploadDir
+	uploadDir = t.TempDir()
+	externalWorkers = true // keep the accepted job from being dispatched to a processor
+	t.Cleanup(func() { uploadDir, externalWorkers = oldUploadDir, false })
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	t.Setenv("AUDIT_LOG_FILE", auditPath)
+	t.Setenv("CLAMD_ADDRESS", "tcp:"+fakeClamd(t))
+
+	upload := func(content string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", "song.mp3")
+		part.Write([]byte(content))
+		mw.Close()
+		req := httptest.NewRequest("POST", "/api/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		uploadHandler(rec, req)
+		return rec
+	}
+
+	if rec := upload("X5O!P%@AP EICAR test"); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("infected upload = %d, want 422", rec.Code)
+	}
+	if entries, _ := os.ReadDir(uploadDir); len(entries) != 0 {
+		t.Errorf("infected upload left %d files behind", len(entries))
+	}
+	rec := upload("ID3 clean audio")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("clean upload = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	audit, _ := os.ReadFile(auditPath)
+	lines := strings.Split(strings.TrimSpace(string(audit)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"threat":"Eicar-Test-Signature"`) || !strings.Contains(lines[1], `"verdict":"clean"`) {
+		t.Errorf("audit log = %s", audit)
+	}
+
+	t.Setenv("CLAMD_ADDRESS", "tcp:127.0.0.1:1")
+	if rec := upload("ID3 clean audio"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("upload with scanner down = %d, want 503", rec.Code)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The self-test (SELF_TEST_INTERVAL, off by default) periodically runs a
+// short reference clip generated by the backend through the queue and the
+// processor like any upload, then records the end-to-end latency and the
+// checksum of every stem. The first run's checksums become the baseline
+// (kept in the upload directory so it survives restarts); later runs that
+// produce different stems report drift, which usually means a model, codec
+// or library changed underneath. GET /api/ready fails while the latest run
+// failed, drifted or exceeded SELF_TEST_MAX_LATENCY (default 10m), and the
+// results are reported under "self_test" in /api/admin/stats.
+//
+// Self-test jobs are hidden from job listings, emit no events and are
+// deleted with their files once checked.
+
+const (
+	selfTestClipName = "self-test.wav"
+	selfTestTimeout  = 35 * time.Minute // longer than the processor request timeout
+)
+
+// selfTestPollInterval is how often a running self-test checks its job
+var selfTestPollInterval = 2 * time.Second
+
+// SelfTestResult is the outcome of one self-test run
+type SelfTestResult struct {
+	RanAt          time.Time         `json:"ran_at"`
+	Passed         bool              `json:"passed"`
+	Model          string            `json:"model"`
+	LatencySeconds float64           `json:"latency_seconds,omitempty"`
+	Checksums      map[string]string `json:"checksums,omitempty"` // stem -> SHA-256
+	Drifted        []string          `json:"drifted,omitempty"`   // stems that differ from the baseline
+	Error          string            `json:"error,omitempty"`
+}
+
+// selfTestBaseline is the accepted output of the reference clip for a model
+type selfTestBaseline struct {
+	Model      string            `json:"model"`
+	Checksums  map[string]string `json:"checksums"`
+	AcceptedAt time.Time         `json:"accepted_at"`
+}
+
+// SelfTestStatus is the self-test state reported by /api/ready and the
+// admin stats
+type SelfTestStatus struct {
+	Enabled           bool              `json:"enabled"`
+	Running           bool              `json:"running,omitempty"`
+	Runs              int               `json:"runs"`
+	Failures          int               `json:"failures"`
+	MaxLatencySeconds float64           `json:"max_latency_seconds"`
+	Last              *SelfTestResult   `json:"last,omitempty"`
+	Baseline          *selfTestBaseline `json:"baseline,omitempty"`
+}
+
+var (
+	selfTest      SelfTestStatus
+	selfTestMutex = &sync.Mutex{}
+)
+
+func selfTestInterval() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("SELF_TEST_INTERVAL"))
+	if err != nil || d <= 0 {
+		return 0
+	}
+	return d
+}
+
+func selfTestMaxLatency() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SELF_TEST_MAX_LATENCY")); err == nil && d > 0 {
+		return d
+	}
+	return 10 * time.Minute
+}
+
+func selfTestModel() string {
+	if m := os.Getenv("SELF_TEST_MODEL"); isAllowedModel(m) {
+		return m
+	}
+	return "htdemucs"
+}
+
+func init() { keepInUploads(selfTestBaselinePath) }
+
+func selfTestBaselinePath() string {
+	return filepath.Join(uploadDir, ".selftest-baseline.json")
+}
+
+func loadSelfTestBaseline() *selfTestBaseline {
+	data, err := os.ReadFile(selfTestBaselinePath())
+	if err != nil {
+		return nil
+	}
+	var b selfTestBaseline
+	if json.Unmarshal(data, &b) != nil || len(b.Checksums) == 0 {
+		return nil
+	}
+	return &b
+}
+
+func saveSelfTestBaseline(b *selfTestBaseline) error {
+	data, _ := json.MarshalIndent(b, "", "  ")
+	return os.WriteFile(selfTestBaselinePath(), data, 0644)
+}
+
+// writeReferenceClip writes the reference clip: six seconds of stereo bass,
+// a chord and noise bursts, so every stem gets some signal. The noise comes
+// from a fixed-seed generator so the clip is identical on every run.
+func writeReferenceClip(path string) error {
+	const sampleRate, seconds = 44100, 6
+	n := sampleRate * seconds
+	samples := make([]int16, 0, n*2)
+	seed := uint32(1)
+	for i := 0; i < n; i++ {
+		t := float64(i) / sampleRate
+		bass := 0.3 * math.Sin(2*math.Pi*55*t)
+		chord := 0.1 * (math.Sin(2*math.Pi*220*t) + math.Sin(2*math.Pi*277.18*t) + math.Sin(2*math.Pi*329.63*t))
+		seed = seed*1664525 + 1013904223
+		noise := (float64(seed>>16)/32768 - 1) * 0.3 * math.Exp(-30*math.Mod(t, 0.5))
+		left, right := bass+chord+noise, bass+0.8*chord+noise
+		samples = append(samples, int16(left*32767*0.8), int16(right*32767*0.8))
+	}
+	return writeWAVFile(path, samples, sampleRate, 2)
+}
+
+// runSelfTest runs the reference clip through the pipeline once and
+// records the result. It returns false when a run is already in progress.
+func runSelfTest() bool {
+	selfTestMutex.Lock()
+	if selfTest.Running {
+		selfTestMutex.Unlock()
+		return false
+	}
+	selfTest.Running = true
+	selfTestMutex.Unlock()
+
+	result := selfTestRun(selfTestModel())
+
+	selfTestMutex.Lock()
+	defer selfTestMutex.Unlock()
+	selfTest.Running = false
+	selfTest.Runs++
+	if result.Error == "" {
+		if selfTest.Baseline == nil || selfTest.Baseline.Model != result.Model {
+			selfTest.Baseline = loadSelfTestBaseline()
+		}
+		b := selfTest.Baseline
+		if b == nil || b.Model != result.Model {
+			// First run for this model: its output becomes the baseline
+			b = &selfTestBaseline{Model: result.Model, Checksums: result.Checksums, AcceptedAt: result.RanAt}
+			if err := saveSelfTestBaseline(b); err != nil {
+				log.Printf("Failed to save self-test baseline: %v", err)
+			}
+			selfTest.Baseline = b
+		}
+		result.Drifted = checksumDrift(b.Checksums, result.Checksums)
+		result.Passed = len(result.Drifted) == 0 && result.LatencySeconds <= selfTestMaxLatency().Seconds()
+	}
+	if !result.Passed {
+		selfTest.Failures++
+		log.Printf("Self-test failed: error=%q latency=%.1fs drifted=%v", result.Error, result.LatencySeconds, result.Drifted)
+	}
+	selfTest.Last = &result
+	return true
+}
+
+// checksumDrift returns the stems whose checksum differs from the
+// baseline, including stems that appeared or disappeared
+func checksumDrift(baseline, current map[string]string) []string {
+	var drifted []string
+	for _, stem := range sortedKeys(baseline) {
+		if current[stem] != baseline[stem] {
+			drifted = append(drifted, stem)
+		}
+	}
+	for _, stem := range sortedKeys(current) {
+		if _, exists := baseline[stem]; !exists {
+			drifted = append(drifted, stem)
+		}
+	}
+	return drifted
+}
+
+// selfTestRun processes the reference clip with model and checksums the
+// stems, then deletes the job and its files
+func selfTestRun(model string) SelfTestResult {
+	result := SelfTestResult{RanAt: time.Now().UTC(), Model: model}
+	jobID := uuid.New().String()
+	inputPath := filepath.Join(uploadDir, jobID+"_"+selfTestClipName)
+	defer func() {
+		processingQueue.remove(jobID)
+		jobsMutex.Lock()
+		delete(jobs, jobID)
+		jobsMutex.Unlock()
+		releaseLeasesForJob(jobID)
+		os.Remove(inputPath)
+		os.RemoveAll(filepath.Join(outputDir, jobID))
+	}()
+
+	if err := writeReferenceClip(inputPath); err != nil {
+		result.Error = "Failed to write reference clip: " + err.Error()
+		return result
+	}
+	// WAV output avoids encoder differences hiding behind the checksums
+	job := newJob(jobID, selfTestClipName, jobOptions{
+		StemMode: "all", IsolateStem: "vocals", OutputFormat: "wav",
+		Model: model, Shifts: "0", ClipMode: "rescale",
+	})
+	job.SelfTest = true
+	job.inputPath = inputPath
+	jobsMutex.Lock()
+	jobs[jobID] = job
+	jobsMutex.Unlock()
+	if !externalWorkers {
+		enqueueJob(jobID)
+	}
+
+	done, ok := waitForSelfTestJob(jobID, selfTestTimeout)
+	if !ok {
+		result.Error = fmt.Sprintf("Timed out after %s", selfTestTimeout)
+		return result
+	}
+	if done.CompletedAt != nil {
+		result.LatencySeconds = done.CompletedAt.Sub(done.CreatedAt).Seconds()
+	}
+	if done.Status != "completed" {
+		result.Error = done.Error
+		return result
+	}
+	if len(done.OutputFiles) == 0 {
+		result.Error = "Processor returned no stems"
+		return result
+	}
+	result.Checksums = make(map[string]string, len(done.OutputFiles))
+	for stem, p := range done.OutputFiles {
+		if !safeOutputPath(p) {
+			result.Error = "Invalid stem path: " + stem
+			return result
+		}
+		sum, err := fileSHA256(p)
+		if err != nil {
+			result.Error = "Failed to read stem " + stem + ": " + err.Error()
+			return result
+		}
+		result.Checksums[stem] = sum
+	}
+	return result
+}
+
+// waitForSelfTestJob polls the job until it finishes or timeout passes
+func waitForSelfTestJob(jobID string, timeout time.Duration) (Job, bool) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		jobsMutex.RLock()
+		job, exists := jobs[jobID]
+		var snap Job
+		if exists {
+			snap = job.snapshot()
+		}
+		jobsMutex.RUnlock()
+		if !exists {
+			return Job{Status: "failed", Error: "Job was deleted"}, true
+		}
+		if snap.Status == "completed" || snap.Status == "failed" {
+			return snap, true
+		}
+		time.Sleep(selfTestPollInterval)
+	}
+	return Job{}, false
+}
+
+// selfTestScheduler runs the self-test every interval, starting with one
+// shortly after startup
+func selfTestScheduler(interval time.Duration) {
+	selfTestMutex.Lock()
+	selfTest.Enabled = true
+	selfTest.Baseline = loadSelfTestBaseline()
+	selfTestMutex.Unlock()
+	time.Sleep(30 * time.Second)
+	for {
+		runSelfTest()
+		time.Sleep(interval)
+	}
+}
+
+func selfTestSnapshot() SelfTestStatus {
+	selfTestMutex.Lock()
+	defer selfTestMutex.Unlock()
+	s := selfTest
+	s.MaxLatencySeconds = selfTestMaxLatency().Seconds()
+	return s
+}
+
+// selfTestReady reports whether the latest self-test (if any) passed
+func selfTestReady(s SelfTestStatus) bool {
+	return !s.Enabled || s.Last == nil || s.Last.Passed
+}
+
+// readyHandler is the readiness check: 503 while the latest self-test
+// failed so load balancers and orchestrators can take the instance out
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	s := selfTestSnapshot()
+	if !selfTestReady(s) {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "not_ready", "self_test": s})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ready", "self_test": s})
+}
+
+// runSelfTestHandler starts a self-test now: POST /api/admin/self-test
+func runSelfTestHandler(w http.ResponseWriter, r *http.Request) {
+	selfTestMutex.Lock()
+	running := selfTest.Running
+	selfTestMutex.Unlock()
+	if running {
+		http.Error(w, "Self-test already running", http.StatusConflict)
+		return
+	}
+	go runSelfTest()
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "started"})
+}
+
+// acceptSelfTestBaselineHandler makes the latest run's stems the new
+// baseline after an intended model or processor change:
+// POST /api/admin/self-test/baseline
+func acceptSelfTestBaselineHandler(w http.ResponseWriter, r *http.Request) {
+	selfTestMutex.Lock()
+	defer selfTestMutex.Unlock()
+	last := selfTest.Last
+	if last == nil || last.Error != "" {
+		http.Error(w, "No successful self-test run to accept", http.StatusConflict)
+		return
+	}
+	b := &selfTestBaseline{Model: last.Model, Checksums: last.Checksums, AcceptedAt: time.Now().UTC()}
+	if err := saveSelfTestBaseline(b); err != nil {
+		http.Error(w, "Failed to save baseline", http.StatusInternalServerError)
+		return
+	}
+	selfTest.Baseline = b
+	// The accepted run no longer counts against readiness
+	accepted := *last
+	accepted.Drifted = nil
+	accepted.Passed = accepted.LatencySeconds <= selfTestMaxLatency().Seconds()
+	selfTest.Last = &accepted
+	writeJSON(w, http.StatusOK, b)
+}
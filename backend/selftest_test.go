@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSelfTestDetectsDrift(t *testing.T) {
+	oldUploadDir, oldOutputDir, oldQueue, oldPoll := uploadDir, outputDir, processingQueue, selfTestPollInterval
+	uploadDir, outputDir = t.TempDir(), t.TempDir()
+	processingQueue, selfTestPollInterval = newJobQueue(), 10*time.Millisecond
+	processingQueue.start(1, runQueuedJob)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		processingQueue.drain(ctx)
+		uploadDir, outputDir, processingQueue, selfTestPollInterval = oldUploadDir, oldOutputDir, oldQueue, oldPoll
+		selfTestMutex.Lock()
+		selfTest = SelfTestStatus{}
+		selfTestMutex.Unlock()
+	})
+
+	var vocals atomic.Value
+	vocals.Store("vocals v1")
+	processor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jobID := r.FormValue("job_id")
+		dir := filepath.Join(outputDir, jobID)
+		os.MkdirAll(dir, 0755)
+		os.WriteFile(filepath.Join(dir, "vocals.wav"), []byte(vocals.Load().(string)), 0644)
+		os.WriteFile(filepath.Join(dir, "drums.wav"), []byte("drums"), 0644)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"outputs": map[string]string{
+			"vocals": filepath.Join(dir, "vocals.wav"),
+			"drums":  filepath.Join(dir, "drums.wav"),
+		}})
+	}))
+	defer processor.Close()
+	t.Setenv("PROCESSOR_URL", processor.URL)
+	selfTestMutex.Lock()
+	selfTest = SelfTestStatus{Enabled: true}
+	selfTestMutex.Unlock()
+
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		readyHandler(rec, httptest.NewRequest("GET", "/api/ready", nil))
+		return rec.Code
+	}
+
+	// The first run sets the baseline, an identical second run passes
+	for i := 0; i < 2; i++ {
+		runSelfTest()
+		if s := selfTestSnapshot(); !s.Last.Passed || s.Baseline == nil || len(s.Last.Checksums) != 2 {
+			t.Fatalf("run %d = %+v", i+1, s.Last)
+		}
+	}
+	if loadSelfTestBaseline() == nil {
+		t.Error("baseline was not saved")
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("ready = %d after passing runs", code)
+	}
+
+	vocals.Store("vocals v2")
+	runSelfTest()
+	s := selfTestSnapshot()
+	if s.Last.Passed || len(s.Last.Drifted) != 1 || s.Last.Drifted[0] != "vocals" || s.Failures != 1 {
+		t.Fatalf("drifted run = %+v", s.Last)
+	}
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("ready = %d after drift, want 503", code)
+	}
+
+	rec := httptest.NewRecorder()
+	acceptSelfTestBaselineHandler(rec, httptest.NewRequest("POST", "/api/admin/self-test/baseline", nil))
+	var b selfTestBaseline
+	json.NewDecoder(rec.Body).Decode(&b)
+	if rec.Code != http.StatusOK || b.Checksums["vocals"] != s.Last.Checksums["vocals"] {
+		t.Errorf("accept baseline = %d %+v", rec.Code, b)
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("ready = %d after accepting the baseline", code)
+	}
+
+	// Self-test jobs and their files are cleaned up
+	jobsMutex.RLock()
+	for _, job := range jobs {
+		if job.SelfTest {
+			t.Errorf("self-test job %s was kept", job.ID)
+		}
+	}
+	jobsMutex.RUnlock()
+	if entries, _ := os.ReadDir(outputDir); len(entries) != 0 {
+		t.Errorf("%d output entries left", len(entries))
+	}
+}
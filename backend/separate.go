@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/cmplx"
+)
+
+// Lightweight separation engine for the embedded build. It needs no model
+// weights or GPU: each STFT frame is split with soft masks built from
+// harmonic/percussive separation (median filters across time and across
+// frequency) and stereo image. Percussive energy is drums; harmonic
+// energy below ~200 Hz is bass; harmonic energy in the voice band that
+// is panned to the center is vocals; the remainder is other, computed as
+// the mix minus the other stems so the four always sum to the input.
+// Results are casual quality, well below Demucs, especially on mono or
+// heavily processed mixes.
+
+const (
+	sepFrameSize = 2048
+	sepHop       = sepFrameSize / 4
+	sepMedian    = 17 // frames (harmonic) and bins (percussive) per median filter
+)
+
+// dspStems are the engine's stems, in the order separateDSP emits them
+var dspStems = []string{"vocals", "drums", "bass", "other"}
+
+// stftFrame is one frame's spectra and mono magnitude
+type stftFrame struct {
+	l, r []complex128
+	mag  []float64
+}
+
+// sqrtHann is the square root of a periodic Hann window, used for both
+// analysis and synthesis so that, at a quarter-frame hop, masks of 1
+// reconstruct the input exactly (after dividing by 2)
+func sqrtHann(n int) []float64 {
+	w := make([]float64, n)
+	for i := range w {
+		w[i] = math.Sqrt(0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n)))
+	}
+	return w
+}
+
+// ifft is the inverse of fft, in place
+func ifft(x []complex128) {
+	for i := range x {
+		x[i] = cmplx.Conj(x[i])
+	}
+	fft(x)
+	scale := 1 / float64(len(x))
+	for i := range x {
+		x[i] = cmplx.Conj(x[i]) * complex(scale, 0)
+	}
+}
+
+// median returns the median of v, reordering it
+func median(v []float64) float64 {
+	for i := 1; i < len(v); i++ {
+		for j := i; j > 0 && v[j] < v[j-1]; j-- {
+			v[j], v[j-1] = v[j-1], v[j]
+		}
+	}
+	return v[len(v)/2]
+}
+
+// bandWeight is 1 between lo and hi Hz, fading to 0 over an octave outside
+func bandWeight(f, lo, hi float64) float64 {
+	switch {
+	case f <= 0:
+		return 0
+	case f < lo:
+		return math.Max(0, math.Log2(f/lo)+1)
+	case f > hi:
+		return math.Max(0, 1-math.Log2(f/hi))
+	}
+	return 1
+}
+
+// separateDSP splits interleaved stereo 16-bit PCM into dspStems. emit is
+// called with consecutive blocks of every stem's left and right samples
+// (in [-1, 1]), starting at sample offset, until the whole input is
+// covered; progress with the share done so far.
+func separateDSP(ctx context.Context, pcm []int16, sampleRate int, emit func(offset int, block [4][2][]float64), progress func(float64)) error {
+	const n, hop, half = sepFrameSize, sepHop, sepMedian / 2
+	samples := len(pcm) / 2
+	bins := n/2 + 1
+	frames := (samples + n - hop + hop - 1) / hop
+	window := sqrtHann(n)
+
+	bass, voice := make([]float64, bins), make([]float64, bins)
+	for k := range bins {
+		f := float64(k) * float64(sampleRate) / n
+		bass[k] = bandWeight(f, 20, 180)
+		voice[k] = bandWeight(f, 150, 6000)
+	}
+
+	ring := make([]*stftFrame, sepMedian)
+	for i := range ring {
+		ring[i] = &stftFrame{make([]complex128, n), make([]complex128, n), make([]float64, bins)}
+	}
+	// frame t covers samples [t*hop - (n-hop), t*hop + hop)
+	frameStart := func(t int) int { return t*hop - (n - hop) }
+	sample := func(i, ch int) float64 {
+		if i < 0 || i >= samples {
+			return 0
+		}
+		return float64(pcm[2*i+ch]) / 32768
+	}
+	analyze := func(t int) {
+		fr, start := ring[t%sepMedian], frameStart(t)
+		for j := range n {
+			fr.l[j] = complex(sample(start+j, 0)*window[j], 0)
+			fr.r[j] = complex(sample(start+j, 1)*window[j], 0)
+		}
+		fft(fr.l)
+		fft(fr.r)
+		for k := range bins {
+			fr.mag[k] = (cmplx.Abs(fr.l[k]) + cmplx.Abs(fr.r[k])) / 2
+		}
+	}
+
+	var masks [3][]float64 // vocals, drums, bass; other is the remainder
+	for i := range masks {
+		masks[i] = make([]float64, bins)
+	}
+	var ola [3][2][]float64
+	for s := range ola {
+		ola[s] = [2][]float64{make([]float64, n), make([]float64, n)}
+	}
+	spec := make([]complex128, n)
+	var vals [sepMedian]float64
+
+	for f := 0; f < frames+half; f++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if f < frames {
+			analyze(f)
+		}
+		t := f - half
+		if t < 0 {
+			continue
+		}
+		cur := ring[t%sepMedian]
+
+		for k := range bins {
+			m := 0
+			for u := max(0, t-half); u <= min(frames-1, t+half); u++ {
+				vals[m] = ring[u%sepMedian].mag[k]
+				m++
+			}
+			h := median(vals[:m])
+			m = 0
+			for q := max(0, k-half); q <= min(bins-1, k+half); q++ {
+				vals[m] = cur.mag[q]
+				m++
+			}
+			p := median(vals[:m])
+			harmonic := 0.5
+			if h+p > 0 {
+				harmonic = h * h / (h*h + p*p)
+			}
+			al, ar := cmplx.Abs(cur.l[k]), cmplx.Abs(cur.r[k])
+			center := 0.0
+			if al+ar > 0 {
+				center = 1 - cmplx.Abs(cur.l[k]-cur.r[k])/(al+ar)
+			}
+			center *= center
+			center *= center
+			masks[0][k] = harmonic * (1 - bass[k]) * voice[k] * center
+			masks[1][k] = 1 - harmonic
+			masks[2][k] = harmonic * bass[k]
+		}
+
+		for s := range masks {
+			for ch, x := range [2][]complex128{cur.l, cur.r} {
+				for k := range bins {
+					spec[k] = x[k] * complex(masks[s][k], 0)
+				}
+				for k := 1; k < n/2; k++ {
+					spec[n-k] = cmplx.Conj(spec[k])
+				}
+				ifft(spec)
+				buf := ola[s][ch]
+				for j := range n {
+					buf[j] += real(spec[j]) * window[j] / 2
+				}
+			}
+		}
+
+		// Samples before the next frame's start are final
+		start := frameStart(t)
+		from, to := max(0, start), min(samples, start+hop)
+		if from < to {
+			var block [4][2][]float64
+			for ch := range 2 {
+				other := make([]float64, to-from)
+				for i := range other {
+					other[i] = sample(from+i, ch)
+				}
+				for s := range ola {
+					out := append([]float64(nil), ola[s][ch][from-start:to-start]...)
+					for i, v := range out {
+						other[i] -= v
+					}
+					block[s][ch] = out
+				}
+				block[3][ch] = other
+			}
+			emit(from, block)
+		}
+		for s := range ola {
+			for ch := range 2 {
+				buf := ola[s][ch]
+				copy(buf, buf[hop:])
+				clear(buf[n-hop:])
+			}
+		}
+		if progress != nil && t%64 == 0 {
+			progress(float64(t) / float64(frames))
+		}
+	}
+	return nil
+}
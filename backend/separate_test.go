@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+// stemEnergy separates pcm and returns each stem's energy between the
+// given sample offsets, and the largest error in the stems' sum
+func stemEnergy(t *testing.T, pcm []int16, rate int, in func(i int) bool) ([4]float64, float64) {
+	t.Helper()
+	var energy [4]float64
+	var worst float64
+	next := 0
+	err := separateDSP(context.Background(), pcm, rate, func(offset int, block [4][2][]float64) {
+		if offset != next {
+			t.Fatalf("block at %d, want %d", offset, next)
+		}
+		next += len(block[0][0])
+		for i := range block[0][0] {
+			for ch := range 2 {
+				var sum float64
+				for s := range block {
+					v := block[s][ch][i]
+					sum += v
+					if in(offset + i) {
+						energy[s] += v * v
+					}
+				}
+				worst = max(worst, math.Abs(sum-float64(pcm[2*(offset+i)+ch])/32768))
+			}
+		}
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != len(pcm)/2 {
+		t.Fatalf("emitted %d samples, want %d", next, len(pcm)/2)
+	}
+	return energy, worst
+}
+
+// synthMix is two seconds of a centered 55 Hz tone and/or a broadband
+// click every quarter second, left of center
+func synthMix(rate int, tone, clicks bool) []int16 {
+	pcm := make([]int16, 2*rate*2)
+	if tone {
+		for i := 0; i < len(pcm)/2; i++ {
+			v := int16(0.3 * 32767 * math.Sin(2*math.Pi*55*float64(i)/float64(rate)))
+			pcm[2*i], pcm[2*i+1] = v, v
+		}
+	}
+	if clicks {
+		for c := rate / 8; c < len(pcm)/2; c += rate / 4 {
+			for j := 0; j < 32; j++ {
+				v := 0.6 * math.Exp(-float64(j)/6) * math.Cos(float64(j)*2.4)
+				pcm[2*(c+j)] += int16(v * 32767)
+				pcm[2*(c+j)+1] += int16(0.2 * v * 32767)
+			}
+		}
+	}
+	return pcm
+}
+
+func TestSeparateDSP(t *testing.T) {
+	const rate = 22050
+	all := func(int) bool { return true }
+	share := func(energy [4]float64, s int) float64 {
+		return energy[s] / (energy[0] + energy[1] + energy[2] + energy[3])
+	}
+
+	if energy, worst := stemEnergy(t, synthMix(rate, true, true), rate, all); worst > 1e-6 {
+		t.Errorf("stems don't sum to the mix, off by %g (%v)", worst, energy)
+	}
+	if energy, _ := stemEnergy(t, synthMix(rate, false, true), rate, all); share(energy, 1) < 0.8 {
+		t.Errorf("clicks went to %v (vocals, drums, bass, other), want mostly drums", energy)
+	}
+	// Skip the edges, where the tone starts and stops like a hit
+	middle := func(i int) bool { return i > rate/2 && i < 3*rate/2 }
+	if energy, _ := stemEnergy(t, synthMix(rate, true, false), rate, middle); share(energy, 2) < 0.8 {
+		t.Errorf("the 55 Hz tone went to %v (vocals, drums, bass, other), want mostly bass", energy)
+	}
+}
+
+func TestSeparateDSPCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := separateDSP(ctx, make([]int16, 2*44100), 44100, func(int, [4][2][]float64) {}, nil)
+	if err != context.Canceled {
+		t.Errorf("separateDSP after cancel = %v", err)
+	}
+}
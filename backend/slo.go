@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Service level objectives. Every finished job is an SLI sample: whether it
+// succeeded, its end-to-end latency (upload to completion) and how long it
+// waited before going to the processor. Over a rolling SLO_WINDOW (default
+// 24h, kept in memory) GET /api/admin/slo reports each indicator against its
+// target with the error budget left:
+//
+//	SLO_SUCCESS_RATIO=0.99   completed / finished jobs
+//	SLO_LATENCY_P95=10m      95th percentile end-to-end latency
+//	SLO_QUEUE_WAIT_P95=5m    95th percentile queue wait
+//
+// /metrics exports the same values as track2stem_sli, track2stem_slo_target
+// and track2stem_slo_error_budget_remaining, labelled by sli, for the
+// alerting rules in deploy/prometheus. Cancelled jobs and self-tests don't
+// count.
+
+const (
+	sliSuccessRatio = "success_ratio"
+	sliLatencyP95   = "latency_p95_seconds"
+	sliQueueWaitP95 = "queue_wait_p95_seconds"
+)
+
+// sloSample is one finished job, or one job leaving the queue
+type sloSample struct {
+	At      time.Time
+	Success bool
+	Seconds float64
+}
+
+// SLOObjective is one indicator measured against its target
+type SLOObjective struct {
+	SLI     string  `json:"sli"`
+	Target  float64 `json:"target"`
+	Value   float64 `json:"value"`
+	Met     bool    `json:"met"`
+	Samples int     `json:"samples"`
+	// ErrorBudgetRemaining is the share of allowed bad samples not used yet;
+	// negative once the objective is missed
+	ErrorBudgetRemaining float64 `json:"error_budget_remaining"`
+}
+
+// SLOReport is the response of GET /api/admin/slo
+type SLOReport struct {
+	Window      string         `json:"window"`
+	WindowStart time.Time      `json:"window_start"`
+	Objectives  []SLOObjective `json:"objectives"`
+}
+
+var (
+	sloFinished []sloSample // success and end-to-end latency
+	sloWaits    []sloSample // queue wait
+	sloQueued   = make(map[string]bool)
+	sloMutex    = &sync.Mutex{}
+)
+
+func sloWindow() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SLO_WINDOW")); err == nil && d > 0 {
+		return d
+	}
+	return 24 * time.Hour
+}
+
+func sloSuccessTarget() float64 {
+	if f, err := strconv.ParseFloat(os.Getenv("SLO_SUCCESS_RATIO"), 64); err == nil && f > 0 && f <= 1 {
+		return f
+	}
+	return 0.99
+}
+
+func sloDurationTarget(key string, fallback time.Duration) float64 {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d.Seconds()
+	}
+	return fallback.Seconds()
+}
+
+// recordSLOEvent collects the samples; main registers it as an event listener
+func recordSLOEvent(e Event) {
+	if e.Job.SelfTest || e.Job.CreatedAt.IsZero() {
+		return
+	}
+	sloMutex.Lock()
+	defer sloMutex.Unlock()
+	switch e.Type {
+	case EventJobProcessing:
+		// A job dispatched again after a lost lease waited once
+		if !sloQueued[e.Job.ID] {
+			sloQueued[e.Job.ID] = true
+			sloWaits = append(sloWaits, sloSample{At: e.CreatedAt, Seconds: e.CreatedAt.Sub(e.Job.CreatedAt).Seconds()})
+		}
+	case EventJobCompleted, EventJobFailed:
+		delete(sloQueued, e.Job.ID)
+		if e.Job.Error == jobCancelledMessage {
+			return
+		}
+		sloFinished = append(sloFinished, sloSample{
+			At:      e.CreatedAt,
+			Success: e.Type == EventJobCompleted,
+			Seconds: e.CreatedAt.Sub(e.Job.CreatedAt).Seconds(),
+		})
+	case EventJobDeleted:
+		delete(sloQueued, e.Job.ID)
+	}
+}
+
+// pruneSLOSamples drops samples older than the window start. Callers hold
+// sloMutex.
+func pruneSLOSamples(start time.Time) {
+	old := func(s sloSample) bool { return s.At.Before(start) }
+	sloFinished, sloWaits = slices.DeleteFunc(sloFinished, old), slices.DeleteFunc(sloWaits, old)
+}
+
+// budgetRemaining is the share of the allowed bad samples still unused
+func budgetRemaining(bad int, allowed float64) float64 {
+	if allowed <= 0 {
+		if bad == 0 {
+			return 1
+		}
+		return 0
+	}
+	return math.Round((1-float64(bad)/allowed)*1000) / 1000
+}
+
+// percentileObjective measures the 95th percentile of samples against target
+func percentileObjective(sli string, samples []sloSample, target float64) SLOObjective {
+	o := SLOObjective{SLI: sli, Target: target, Samples: len(samples), Met: true, ErrorBudgetRemaining: 1}
+	if len(samples) == 0 {
+		return o
+	}
+	values := make([]float64, len(samples))
+	bad := 0
+	for i, s := range samples {
+		values[i] = s.Seconds
+		if s.Seconds > target {
+			bad++
+		}
+	}
+	slices.Sort(values)
+	// Nearest rank
+	o.Value = math.Round(values[int(math.Ceil(0.95*float64(len(values))))-1]*10) / 10
+	o.Met = o.Value <= target
+	o.ErrorBudgetRemaining = budgetRemaining(bad, 0.05*float64(len(samples)))
+	return o
+}
+
+// sloReport measures every objective over the window ending at now
+func sloReport(now time.Time) SLOReport {
+	window := sloWindow()
+	start := now.Add(-window)
+	sloMutex.Lock()
+	pruneSLOSamples(start)
+	finished, waits := slices.Clone(sloFinished), slices.Clone(sloWaits)
+	sloMutex.Unlock()
+
+	var succeeded []sloSample
+	failed := 0
+	for _, s := range finished {
+		if s.Success {
+			succeeded = append(succeeded, s)
+		} else {
+			failed++
+		}
+	}
+	success := SLOObjective{SLI: sliSuccessRatio, Target: sloSuccessTarget(), Samples: len(finished), Value: 1, Met: true, ErrorBudgetRemaining: 1}
+	if len(finished) > 0 {
+		success.Value = math.Round(float64(len(succeeded))/float64(len(finished))*10000) / 10000
+		success.Met = success.Value >= success.Target
+		success.ErrorBudgetRemaining = budgetRemaining(failed, (1-success.Target)*float64(len(finished)))
+	}
+	return SLOReport{
+		Window:      window.String(),
+		WindowStart: start.UTC(),
+		Objectives: []SLOObjective{
+			success,
+			// Latency is measured over the jobs that succeeded
+			percentileObjective(sliLatencyP95, succeeded, sloDurationTarget("SLO_LATENCY_P95", 10*time.Minute)),
+			percentileObjective(sliQueueWaitP95, waits, sloDurationTarget("SLO_QUEUE_WAIT_P95", 5*time.Minute)),
+		},
+	}
+}
+
+// sloHandler serves GET /api/admin/slo
+func sloHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sloReport(time.Now()))
+}
+
+// writeSLOMetrics adds the objectives to /metrics
+func writeSLOMetrics(w io.Writer) {
+	report := sloReport(time.Now())
+	for _, m := range []struct {
+		name, help string
+		value      func(SLOObjective) float64
+	}{
+		{"track2stem_sli", "Service level indicators over SLO_WINDOW.", func(o SLOObjective) float64 { return o.Value }},
+		{"track2stem_slo_target", "Service level objective targets.", func(o SLOObjective) float64 { return o.Target }},
+		{"track2stem_slo_error_budget_remaining", "Share of the error budget left in SLO_WINDOW; negative once an objective is missed.", func(o SLOObjective) float64 { return o.ErrorBudgetRemaining }},
+	} {
+		writeMetric(w, m.name, "gauge", m.help)
+		for _, o := range report.Objectives {
+			fmt.Fprintf(w, "%s{sli=%s} %g\n", m.name, labelValue(o.SLI), m.value(o))
+		}
+	}
+}
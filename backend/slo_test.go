@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSLOReport(t *testing.T) {
+	sloMutex.Lock()
+	oldFinished, oldWaits, oldQueued := sloFinished, sloWaits, sloQueued
+	sloFinished, sloWaits, sloQueued = nil, nil, make(map[string]bool)
+	sloMutex.Unlock()
+	t.Cleanup(func() {
+		sloMutex.Lock()
+		sloFinished, sloWaits, sloQueued = oldFinished, oldWaits, oldQueued
+		sloMutex.Unlock()
+	})
+	t.Setenv("SLO_SUCCESS_RATIO", "0.9")
+	t.Setenv("SLO_LATENCY_P95", "2m")
+
+	now := time.Now()
+	// 20 jobs: each waits 10s and finishes after a minute, except a slow one
+	// and two failures
+	for i := range 20 {
+		job := Job{ID: fmt.Sprintf("job-%d", i), CreatedAt: now.Add(-time.Hour)}
+		recordSLOEvent(Event{Type: EventJobProcessing, CreatedAt: job.CreatedAt.Add(10 * time.Second), Job: job})
+		// Dispatched again after a lost lease: the wait counts once
+		recordSLOEvent(Event{Type: EventJobProcessing, CreatedAt: job.CreatedAt.Add(30 * time.Minute), Job: job})
+		done, event := job.CreatedAt.Add(time.Minute), EventJobCompleted
+		switch i {
+		case 0:
+			done = job.CreatedAt.Add(5 * time.Minute)
+		case 1, 2:
+			event = EventJobFailed
+		}
+		recordSLOEvent(Event{Type: event, CreatedAt: done, Job: job})
+	}
+	// Cancellations, self-tests and samples from before the window don't count
+	cancelled := Job{ID: "cancelled", CreatedAt: now.Add(-time.Hour), Error: jobCancelledMessage}
+	recordSLOEvent(Event{Type: EventJobFailed, CreatedAt: now, Job: cancelled})
+	recordSLOEvent(Event{Type: EventJobFailed, CreatedAt: now, Job: Job{ID: "self-test", CreatedAt: now, SelfTest: true}})
+	old := Job{ID: "old", CreatedAt: now.Add(-48 * time.Hour)}
+	recordSLOEvent(Event{Type: EventJobFailed, CreatedAt: old.CreatedAt.Add(time.Minute), Job: old})
+
+	report := sloReport(now)
+	if len(report.Objectives) != 3 || report.Window != "24h0m0s" {
+		t.Fatalf("report = %+v", report)
+	}
+	success, latency, wait := report.Objectives[0], report.Objectives[1], report.Objectives[2]
+	// 18/20 succeeded, against 2 allowed failures
+	if success.Samples != 20 || success.Value != 0.9 || !success.Met || success.ErrorBudgetRemaining != 0 {
+		t.Errorf("success = %+v", success)
+	}
+	// p95 of 18 latencies is the 18th, the slow job; 1 of 0.9 allowed
+	if latency.Samples != 18 || latency.Value != 300 || latency.Met || latency.ErrorBudgetRemaining >= 0 {
+		t.Errorf("latency = %+v", latency)
+	}
+	if wait.Samples != 20 || wait.Value != 10 || !wait.Met || wait.Target != 300 || wait.ErrorBudgetRemaining != 1 {
+		t.Errorf("queue wait = %+v", wait)
+	}
+
+	rec := httptest.NewRecorder()
+	writeSLOMetrics(rec)
+	for _, want := range []string{
+		`track2stem_sli{sli="success_ratio"} 0.9`,
+		`track2stem_slo_target{sli="latency_p95_seconds"} 120`,
+		`track2stem_slo_error_budget_remaining{sli="queue_wait_p95_seconds"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Processor status cache. Progress published to event streams and
+// GET /api/processing-status/{id} both read the processor's /status/{id};
+// responses are cached for PROCESSOR_STATUS_TTL (default 1s, 0 disables)
+// and concurrent requests for the same job share one processor call, so
+// heavy polling doesn't turn into processor load one for one.
+
+const defaultProcessorStatusTTL = time.Second
+
+// statusFetch is one processor status call and its result, shared by every
+// request that arrives while it is in flight or fresh
+type statusFetch struct {
+	done      chan struct{}
+	code      int
+	body      []byte
+	err       error
+	fetchedAt time.Time
+}
+
+var (
+	statusCache      = make(map[string]*statusFetch) // processor URL + job ID -> latest call
+	statusCacheMutex = &sync.Mutex{}
+)
+
+func processorStatusTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("PROCESSOR_STATUS_TTL")); err == nil && d >= 0 {
+		return d
+	}
+	return defaultProcessorStatusTTL
+}
+
+// processorStatus returns the status code and body of the processor's
+// /status/{id} for a job, from the cache when possible
+func processorStatus(jobID, variant string) (int, []byte, error) {
+	url := processorURLForJob(jobID, variant) + "/status/" + jobID
+	ttl := processorStatusTTL()
+	now := time.Now()
+
+	statusCacheMutex.Lock()
+	f, exists := statusCache[url]
+	if exists {
+		select {
+		case <-f.done:
+			exists = now.Sub(f.fetchedAt) < ttl
+		default: // in flight
+		}
+	}
+	if exists {
+		statusCacheMutex.Unlock()
+		<-f.done
+		return f.code, f.body, f.err
+	}
+	f = &statusFetch{done: make(chan struct{})}
+	statusCache[url] = f
+	pruneStatusCache(now, ttl)
+	statusCacheMutex.Unlock()
+
+	f.code, f.body, f.err = fetchStatus(url)
+	f.fetchedAt = time.Now()
+	close(f.done)
+	if f.err != nil || ttl == 0 {
+		// Only the requests already waiting share a failure
+		statusCacheMutex.Lock()
+		if statusCache[url] == f {
+			delete(statusCache, url)
+		}
+		statusCacheMutex.Unlock()
+	}
+	return f.code, f.body, f.err
+}
+
+func fetchStatus(url string) (int, []byte, error) {
+	client := newProcessorClient(5 * time.Second)
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, nil, fmt.Errorf("reading processor status: %v", err)
+	}
+	return resp.StatusCode, body, nil
+}
+
+// pruneStatusCache drops finished calls older than ttl; the caller holds
+// statusCacheMutex
+func pruneStatusCache(now time.Time, ttl time.Duration) {
+	for url, f := range statusCache {
+		select {
+		case <-f.done:
+			if now.Sub(f.fetchedAt) >= ttl {
+				delete(statusCache, url)
+			}
+		default:
+		}
+	}
+}
+
+// forgetProcessorStatus drops a job's cached status once it finishes, so
+// pollers see the final state rather than the processor's last progress
+func forgetProcessorStatus(e Event) {
+	switch e.Type {
+	case EventJobCompleted, EventJobFailed, EventJobDeleted:
+	default:
+		return
+	}
+	suffix := "/status/" + e.Job.ID
+	statusCacheMutex.Lock()
+	for url := range statusCache {
+		if strings.HasSuffix(url, suffix) {
+			delete(statusCache, url)
+		}
+	}
+	statusCacheMutex.Unlock()
+}
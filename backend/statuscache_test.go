@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestProcessorStatusCache(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	processor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.Write([]byte(`{"status":"processing","progress":40}`))
+	}))
+	defer processor.Close()
+	t.Setenv("PROCESSOR_URL", processor.URL)
+	t.Setenv("PROCESSOR_STATUS_TTL", "1h")
+	jobID := uuid.New().String()
+
+	// Concurrent requests while the first is in flight share it
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code, body, err := processorStatus(jobID, ""); err != nil || code != http.StatusOK || len(body) == 0 {
+				t.Errorf("processorStatus = %d %q %v", code, body, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("processor called %d times for 20 concurrent requests", n)
+	}
+
+	// Fresh results come from the cache until the job finishes
+	if p, err := fetchProcessorStatus(jobID, ""); err != nil || p.Progress != 40 || calls.Load() != 1 {
+		t.Errorf("cached status = %+v, %v after %d calls", p, err, calls.Load())
+	}
+	forgetProcessorStatus(Event{Type: EventJobCompleted, Job: Job{ID: jobID}})
+	processorStatus(jobID, "")
+	if n := calls.Load(); n != 2 {
+		t.Errorf("processor called %d times after the job finished, want 2", n)
+	}
+
+	t.Setenv("PROCESSOR_STATUS_TTL", "0")
+	processorStatus(jobID, "")
+	processorStatus(jobID, "")
+	if n := calls.Load(); n != 4 {
+		t.Errorf("processor called %d times with caching off, want 4", n)
+	}
+}
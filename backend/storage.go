@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage backends for uploads and stems, selected with STORAGE_BACKEND.
+// The processor always works on the shared upload and output volumes; with
+// "local" (the default) those volumes are the storage. With "s3" accepted
+// uploads and finished stems are also copied to an S3-compatible bucket
+// (STORAGE_S3_BUCKET, _REGION, _ENDPOINT, _PREFIX, _ACCESS_KEY_ID and
+// _SECRET_ACCESS_KEY), so any replica can serve them: downloads redirect to
+// a presigned URL valid for STORAGE_URL_TTL (default 15m), or are streamed
+// through the backend with STORAGE_REDIRECT=false, and workers fetch
+// inputs from the bucket when the local copy is gone. Objects are removed
+// when their job is deleted.
+//
+// Keys mirror the volumes: uploads/<job-id>_<file> and
+// outputs/<job-id>/<stem file>.
+
+// Storage stores files under keys
+type Storage interface {
+	// Save copies the local file at path to key
+	Save(ctx context.Context, key, path string) error
+	// Open streams the file at key
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// URL returns a time-limited download URL for key that saves as
+	// fileName, or "" when the file has to be streamed
+	URL(key, fileName string, ttl time.Duration) (string, error)
+	// Delete removes key
+	Delete(ctx context.Context, key string) error
+}
+
+// localStorage keeps files on the upload and output volumes
+type localStorage struct{}
+
+func (localStorage) path(key string) (string, error) {
+	area, rel, _ := strings.Cut(key, "/")
+	root := map[string]string{"uploads": uploadDir, "outputs": outputDir}[area]
+	path := filepath.Join(root, filepath.FromSlash(rel))
+	if root == "" || rel == "" || !strings.HasPrefix(path, filepath.Clean(root)+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return path, nil
+}
+
+func (s localStorage) Save(ctx context.Context, key, path string) error {
+	dst, err := s.path(key)
+	if err != nil || dst == filepath.Clean(path) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return copyFile(path, dst)
+}
+
+func (s localStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (localStorage) URL(key, fileName string, ttl time.Duration) (string, error) {
+	return "", nil
+}
+
+func (s localStorage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// s3Storage keeps files in an S3-compatible bucket
+type s3Storage struct {
+	config   *s3Config
+	redirect bool
+}
+
+func (s s3Storage) Save(ctx context.Context, key, path string) error {
+	return s.config.putObjectFile(ctx, key, path)
+}
+
+func (s s3Storage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.config.getObject(ctx, key)
+}
+
+func (s s3Storage) URL(key, fileName string, ttl time.Duration) (string, error) {
+	if !s.redirect {
+		return "", nil
+	}
+	u := s.config.objectURL(key) + "?response-content-disposition=" +
+		s3Escape(fmt.Sprintf("attachment; filename=\"%s\"", fileName))
+	return s.config.presignURL("GET", u, ttl, time.Now())
+}
+
+func (s s3Storage) Delete(ctx context.Context, key string) error {
+	return s.config.deleteObject(ctx, key)
+}
+
+// storageFromEnv returns the configured backend and whether it is remote,
+// or an error when STORAGE_BACKEND is invalid or incomplete
+func storageFromEnv() (Storage, bool, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "local":
+		return localStorage{}, false, nil
+	case "s3":
+		config, ok := s3ConfigFromEnv("STORAGE_S3")
+		if !ok {
+			return nil, false, fmt.Errorf("STORAGE_BACKEND=s3 needs STORAGE_S3_BUCKET and credentials")
+		}
+		return s3Storage{config: config, redirect: os.Getenv("STORAGE_REDIRECT") != "false"}, true, nil
+	default:
+		return nil, false, fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+}
+
+// remoteStorage returns the storage backend when it isn't the local volumes
+func remoteStorage() (Storage, bool) {
+	s, remote, err := storageFromEnv()
+	if err != nil {
+		log.Printf("Storage: %v", err)
+		return nil, false
+	}
+	return s, remote
+}
+
+func storageURLTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("STORAGE_URL_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 15 * time.Minute
+}
+
+// storageKey maps a file on the upload or output volume to its key
+func storageKey(path string) string {
+	for area, root := range map[string]string{"uploads": uploadDir, "outputs": outputDir} {
+		rel, err := filepath.Rel(root, path)
+		if err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			return area + "/" + filepath.ToSlash(rel)
+		}
+	}
+	return ""
+}
+
+// storageTimeout bounds copying one job's files to or from storage
+const storageTimeout = 30 * time.Minute
+
+// serveFromStorage redirects to or streams a file kept in storage
+func serveFromStorage(w http.ResponseWriter, r *http.Request, s Storage, path string) {
+	key, fileName := storageKey(path), filepath.Base(path)
+	if c, ok := configuredCDN(); ok && strings.HasPrefix(key, "outputs/") {
+		now := time.Now()
+		url, err := c.signedURL(key, now, now.Add(storageURLTTL()))
+		if err != nil {
+			http.Error(w, "Failed to sign download URL", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+	url, err := s.URL(key, fileName, storageURLTTL())
+	if err != nil {
+		http.Error(w, "Failed to sign download URL", http.StatusInternalServerError)
+		return
+	}
+	if url != "" {
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+	rc, err := s.Open(r.Context(), key)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "File not found in storage", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Storage: failed to read %s: %v", key, err)
+		http.Error(w, "Failed to read from storage", http.StatusBadGateway)
+		return
+	}
+	defer rc.Close()
+	contentType := streamContentTypes[filepath.Ext(path)]
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", fileName))
+	w.Header().Set("Content-Type", contentType)
+	io.Copy(w, rc)
+}
+
+// syncStorage copies new uploads and finished stems to remote storage and
+// removes the objects of deleted jobs. Copies run in the background;
+// Job.Stored is set once all stems are in the bucket.
+func syncStorage(e Event) {
+	s, remote := remoteStorage()
+	if !remote {
+		return
+	}
+	job := e.Job
+	switch e.Type {
+	case EventJobCreated:
+		if job.inputPath != "" {
+			go saveToStorage(s, job.ID, []string{job.inputPath}, false)
+		}
+	case EventJobCompleted:
+		paths := make([]string, 0, len(job.OutputFiles))
+		for _, stem := range sortedKeys(job.OutputFiles) {
+			paths = append(paths, job.OutputFiles[stem])
+		}
+		go saveToStorage(s, job.ID, paths, true)
+	case EventJobDeleted:
+		keys := make([]string, 0, len(job.OutputFiles)+1)
+		for _, path := range job.OutputFiles {
+			keys = append(keys, storageKey(path))
+		}
+		if job.inputPath != "" {
+			keys = append(keys, storageKey(job.inputPath))
+		}
+		go deleteFromStorage(s, keys)
+	}
+}
+
+// deleteFromStorage removes keys, skipping empty ones
+func deleteFromStorage(s Storage, keys []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+	defer cancel()
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := s.Delete(ctx, key); err != nil {
+			log.Printf("Storage: failed to delete %s: %v", key, err)
+		}
+	}
+	invalidateCDN(ctx, keys)
+}
+
+func saveToStorage(s Storage, jobID string, paths []string, stems bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+	defer cancel()
+	for _, path := range paths {
+		key := storageKey(path)
+		if key == "" {
+			log.Printf("Storage: %s of job %s is outside the storage volumes", path, jobID)
+			return
+		}
+		if err := s.Save(ctx, key, path); err != nil {
+			log.Printf("Storage: failed to store %s of job %s: %v", key, jobID, err)
+			return
+		}
+	}
+	if stems {
+		jobsMutex.Lock()
+		if job, exists := jobs[jobID]; exists {
+			job.Stored = true
+		}
+		jobsMutex.Unlock()
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Stream tokens let native players (AVPlayer, ExoPlayer) play one stem from
+// a plain URL: the token in the path is the only credential, so no headers
+// are needed, and Range requests are served for seeking. Tokens last
+// STREAM_TOKEN_TTL (default 30 days) unless revoked.
+
+// StreamToken grants read access to a single stem
+type StreamToken struct {
+	Token     string    `json:"token"`
+	JobID     string    `json:"job_id"`
+	Stem      string    `json:"stem"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var (
+	streamTokens      = make(map[string]*StreamToken)
+	streamTokensMutex = &sync.Mutex{}
+)
+
+// maxStreamTokenTTL caps the ttl a client may ask for
+const maxStreamTokenTTL = 365 * 24 * time.Hour
+
+func streamTokenTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("STREAM_TOKEN_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 30 * 24 * time.Hour
+}
+
+// streamContentTypes maps stem extensions to their audio MIME type
+var streamContentTypes = map[string]string{".mp3": "audio/mpeg", ".wav": "audio/wav", ".flac": "audio/flac"}
+
+// createStreamTokenHandler issues a token for one stem:
+// POST /api/jobs/{id}/stems/{stem}/stream-tokens with an optional {"ttl": "720h"}
+func createStreamTokenHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupCompletedJob(w, r)
+	if !ok {
+		return
+	}
+	stem := mux.Vars(r)["stem"]
+	if _, exists := job.OutputFiles[stem]; !exists {
+		http.Error(w, "Stem not found", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		TTL string `json:"ttl"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	ttl := streamTokenTTL()
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 || d > maxStreamTokenTTL {
+			http.Error(w, "Invalid ttl value", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	now := time.Now().UTC()
+	token := &StreamToken{Token: randomToken(24), JobID: job.ID, Stem: stem, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+	token.URL = publicBaseURL(r) + "/api/stream/" + token.Token
+	streamTokensMutex.Lock()
+	streamTokens[token.Token] = token
+	streamTokensMutex.Unlock()
+	writeJSON(w, http.StatusCreated, token)
+}
+
+// listStreamTokensHandler lists a job's unexpired tokens
+func listStreamTokensHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+	now := time.Now()
+	list := []StreamToken{}
+	streamTokensMutex.Lock()
+	for _, token := range streamTokens {
+		if token.JobID == jobID && now.Before(token.ExpiresAt) {
+			list = append(list, *token)
+		}
+	}
+	streamTokensMutex.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+// revokeStreamTokenHandler serves DELETE /api/stream-tokens/{token}
+func revokeStreamTokenHandler(w http.ResponseWriter, r *http.Request) {
+	streamTokensMutex.Lock()
+	_, exists := streamTokens[mux.Vars(r)["token"]]
+	delete(streamTokens, mux.Vars(r)["token"])
+	streamTokensMutex.Unlock()
+	if !exists {
+		http.Error(w, "Stream token not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// streamHandler serves the token's stem with Range support
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["token"]
+	streamTokensMutex.Lock()
+	token, exists := streamTokens[id]
+	if exists && time.Now().After(token.ExpiresAt) {
+		delete(streamTokens, id)
+		exists = false
+	}
+	var t StreamToken
+	if exists {
+		t = *token
+	}
+	streamTokensMutex.Unlock()
+	if !exists {
+		http.Error(w, "Stream token not found", http.StatusNotFound)
+		return
+	}
+
+	jobsMutex.RLock()
+	job, found := jobs[t.JobID]
+	var path string
+	if found {
+		path = job.OutputFiles[t.Stem]
+	}
+	jobsMutex.RUnlock()
+	if path == "" || !safeOutputPath(path) {
+		http.Error(w, "Stem not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "File not found on disk", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Failed to get file info", http.StatusInternalServerError)
+		return
+	}
+	if contentType, ok := streamContentTypes[filepath.Ext(path)]; ok {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+}
+
+// streamTokenReaper drops expired tokens every interval
+func streamTokenReaper(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		streamTokensMutex.Lock()
+		for id, token := range streamTokens {
+			if now.After(token.ExpiresAt) {
+				delete(streamTokens, id)
+			}
+		}
+		streamTokensMutex.Unlock()
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestStreamTokenRange(t *testing.T) {
+	oldOutputDir := outputDir
+	outputDir = t.TempDir()
+	t.Cleanup(func() { outputDir = oldOutputDir })
+	vocals := filepath.Join(outputDir, "stream-job", "vocals.mp3")
+	os.MkdirAll(filepath.Dir(vocals), 0755)
+	os.WriteFile(vocals, []byte("0123456789"), 0644)
+	jobsMutex.Lock()
+	jobs["stream-job"] = &Job{ID: "stream-job", Status: "completed", OutputFiles: map[string]string{"vocals": vocals}}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, "stream-job")
+		jobsMutex.Unlock()
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/jobs/{id}/stems/{stem}/stream-tokens", createStreamTokenHandler).Methods("POST")
+	router.HandleFunc("/api/stream-tokens/{token}", revokeStreamTokenHandler).Methods("DELETE")
+	router.HandleFunc("/api/stream/{token}", streamHandler).Methods("GET", "HEAD")
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("POST", "/api/jobs/stream-job/stems/vocals/stream-tokens", `{"ttl": "10000h"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("ttl beyond a year = %d", rec.Code)
+	}
+	rec := do("POST", "/api/jobs/stream-job/stems/vocals/stream-tokens", `{"ttl": "1h"}`)
+	var token StreamToken
+	json.Unmarshal(rec.Body.Bytes(), &token)
+	if rec.Code != http.StatusCreated || !strings.HasSuffix(token.URL, "/api/stream/"+token.Token) {
+		t.Fatalf("create = %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = do("GET", "/api/stream/"+token.Token, "", "Range", "bytes=2-5")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "2345" || rec.Header().Get("Content-Type") != "audio/mpeg" {
+		t.Errorf("range = %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+
+	do("DELETE", "/api/stream-tokens/"+token.Token, "")
+	if rec := do("GET", "/api/stream/"+token.Token, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("revoked token = %d", rec.Code)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Song structure summaries, for screen-reader users and education tools
+// that navigate separated material without a waveform to look at.
+// GET /api/jobs/{id}/structure estimates the sections of a song from its
+// stems: the stretches before the vocals come in and after they stop are
+// the intro and outro, longer gaps in the vocals are instrumental breaks,
+// and vocal passages are split where the mix changes level, the louder
+// ones taken for choruses and the others for verses. Each section lists
+// the stems audible in it. ?format=text returns the same as one described
+// line per section, ready to be read out; packages include both with
+// summary=true. The labels are estimates from loudness, not from harmony
+// or lyrics.
+
+const (
+	// structureGapFrames bridges pauses between vocal lines shorter than this
+	structureGapFrames = 8
+	// structureWindowFrames is the span compared on each side of a level change
+	structureWindowFrames = 8
+	// structureMinFrames is the shortest vocal section a change can split off
+	structureMinFrames = 16
+	structureChangeDB  = 3.0
+	// structureChorusDB is the least difference in level between vocal
+	// sections that tells choruses from verses
+	structureChorusDB = 1.5
+)
+
+// StructureSection is one estimated part of a song
+type StructureSection struct {
+	Label      string   `json:"label"`            // intro, verse, chorus, instrumental, outro, silence
+	Number     int      `json:"number,omitempty"` // of verses and choruses
+	Title      string   `json:"title"`
+	Start      float64  `json:"start"`
+	End        float64  `json:"end"`
+	Stems      []string `json:"stems"`       // audible in the section
+	LoudnessDB float64  `json:"loudness_db"` // mean level of the mix, dBFS
+}
+
+// errNoStructureStems is returned for jobs without the stems a structure
+// is estimated from
+var errNoStructureStems = errors.New("Structure needs a vocals stem and at least one other stem")
+
+// SongStructure is the response of GET /api/jobs/{id}/structure
+type SongStructure struct {
+	JobID       string             `json:"job_id"`
+	Duration    float64            `json:"duration"`
+	Sections    []StructureSection `json:"sections"`
+	Description string             `json:"description"` // the sections as text
+}
+
+// structureStems are the outputs of a job a structure is estimated from,
+// vocals first
+func structureStems(job Job) []string {
+	var stems []string
+	for _, stem := range sortedKeys(job.OutputFiles) {
+		if stem != "vocals" && (allowedStems[stem] || stem == "instrumental" || stem == "backing") {
+			stems = append(stems, stem)
+		}
+	}
+	if _, ok := job.OutputFiles["vocals"]; ok {
+		stems = append([]string{"vocals"}, stems...)
+	}
+	return stems
+}
+
+// meanLevel averages frame levels by their energy
+func meanLevel(levels []float64) float64 {
+	if len(levels) == 0 {
+		return -180
+	}
+	var energy float64
+	for _, l := range levels {
+		energy += math.Pow(10, l/10)
+	}
+	return 10 * math.Log10(energy/float64(len(levels))+1e-18)
+}
+
+// splitAtChanges splits frames [start, end) where the mix level changes
+// most, as long as both sides stay long enough, and returns the boundaries
+func splitAtChanges(mix []float64, start, end int) []int {
+	best, bestDiff := -1, structureChangeDB
+	for i := start + structureMinFrames; i <= end-structureMinFrames; i++ {
+		diff := math.Abs(meanLevel(mix[i-structureWindowFrames:i]) - meanLevel(mix[i:i+structureWindowFrames]))
+		if diff >= bestDiff {
+			best, bestDiff = i, diff
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	return append(append(splitAtChanges(mix, start, best), best), splitAtChanges(mix, best, end)...)
+}
+
+// songStructure estimates sections from each stem's level per frame
+func songStructure(levels map[string][]float64, frameSeconds float64) []StructureSection {
+	stems := sortedKeys(levels)
+	n := 0
+	all := make([][]float64, 0, len(stems))
+	active := map[string][]bool{}
+	for _, stem := range stems {
+		n = max(n, len(levels[stem]))
+		all = append(all, levels[stem])
+		active[stem] = activeFrames(levels[stem], defaultActivityDB, activityMinRunFrames)
+	}
+	mix := sumLevels(all)
+	vocal := make([]bool, n)
+	copy(vocal, active["vocals"])
+	fillRuns(vocal, false, structureGapFrames)
+
+	type run struct {
+		start, end int
+		vocal      bool
+	}
+	var runs []run
+	for i := 0; i < n; {
+		j := i
+		for j < n && vocal[j] == vocal[i] {
+			j++
+		}
+		if !vocal[i] {
+			runs = append(runs, run{i, j, false})
+		} else {
+			bounds := append(append([]int{i}, splitAtChanges(mix, i, j)...), j)
+			for k := 1; k < len(bounds); k++ {
+				runs = append(runs, run{bounds[k-1], bounds[k], true})
+			}
+		}
+		i = j
+	}
+
+	var sections []StructureSection
+	var vocalLevels []float64
+	for k, r := range runs {
+		s := StructureSection{
+			Start:      float64(r.start) * frameSeconds,
+			End:        float64(r.end) * frameSeconds,
+			Stems:      []string{},
+			LoudnessDB: math.Round(meanLevel(mix[r.start:r.end])*10) / 10,
+		}
+		for _, stem := range stems {
+			frames := 0
+			for i := r.start; i < r.end && i < len(active[stem]); i++ {
+				if active[stem][i] {
+					frames++
+				}
+			}
+			if 2*frames >= r.end-r.start {
+				s.Stems = append(s.Stems, stem)
+			}
+		}
+		switch {
+		case r.vocal:
+			vocalLevels = append(vocalLevels, s.LoudnessDB)
+		case len(s.Stems) == 0:
+			s.Label = "silence"
+		case len(runs) == 1:
+			s.Label = "instrumental"
+		case k == 0:
+			s.Label = "intro"
+		case k == len(runs)-1:
+			s.Label = "outro"
+		default:
+			s.Label = "instrumental"
+		}
+		sections = append(sections, s)
+	}
+	// Choruses are the louder half of the vocal sections, when they differ
+	if len(vocalLevels) > 0 {
+		low, high := slices.Min(vocalLevels), slices.Max(vocalLevels)
+		for i := range sections {
+			if sections[i].Label != "" {
+				continue
+			}
+			sections[i].Label = "verse"
+			if high-low >= structureChorusDB && sections[i].LoudnessDB >= (low+high)/2 {
+				sections[i].Label = "chorus"
+			}
+		}
+	}
+
+	// Neighbours a level change split but that got the same label are one
+	var merged []StructureSection
+	for _, s := range sections {
+		if last := len(merged) - 1; last >= 0 && merged[last].Label == s.Label && (s.Label == "verse" || s.Label == "chorus") {
+			prev := merged[last]
+			merged[last].End = s.End
+			merged[last].LoudnessDB = math.Round(meanLevel(mix[int(math.Round(prev.Start/frameSeconds)):int(math.Round(s.End/frameSeconds))])*10) / 10
+			for _, stem := range s.Stems {
+				if !slices.Contains(prev.Stems, stem) {
+					merged[last].Stems = append(merged[last].Stems, stem)
+				}
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	counts := map[string]int{}
+	for i := range merged {
+		s := &merged[i]
+		s.Title = strings.ToUpper(s.Label[:1]) + s.Label[1:]
+		if s.Label == "verse" || s.Label == "chorus" {
+			counts[s.Label]++
+			s.Number = counts[s.Label]
+			s.Title = fmt.Sprintf("%s %d", s.Title, s.Number)
+		}
+		if s.Label == "instrumental" {
+			s.Title = "Instrumental break"
+		}
+	}
+	return merged
+}
+
+// clockTime formats seconds as m:ss
+func clockTime(seconds float64) string {
+	s := int(math.Round(seconds))
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// spokenList joins names as a sentence would: "a, b and c"
+func spokenList(names []string) string {
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+// describeStructure is the text version of a structure, one line per
+// section
+func describeStructure(fileName string, duration float64, sections []StructureSection) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s, %s long: %d sections, estimated from the separated stems.\n", fileName, clockTime(duration), len(sections))
+	for _, s := range sections {
+		heard := "nothing audible"
+		if len(s.Stems) > 0 {
+			heard = spokenList(s.Stems)
+		}
+		fmt.Fprintf(&b, "%s to %s, %s: %s.\n", clockTime(s.Start), clockTime(s.End), s.Title, heard)
+	}
+	return b.String()
+}
+
+// jobStructure decodes a job's stems and estimates its structure
+func jobStructure(job Job) (SongStructure, error) {
+	stems := structureStems(job)
+	if len(stems) < 2 || stems[0] != "vocals" {
+		return SongStructure{}, errNoStructureStems
+	}
+	levels := make(map[string][]float64, len(stems))
+	for _, stem := range stems {
+		path := job.OutputFiles[stem]
+		if !safeOutputPath(path) {
+			return SongStructure{}, fmt.Errorf("Invalid file path")
+		}
+		l, err := stemLevels(path)
+		if err != nil {
+			return SongStructure{}, fmt.Errorf("Failed to analyze the %s stem", stem)
+		}
+		levels[stem] = l
+	}
+	sections := songStructure(levels, activityFrameSeconds)
+	duration := 0.0
+	if len(sections) > 0 {
+		duration = sections[len(sections)-1].End
+	}
+	return SongStructure{
+		JobID:       job.ID,
+		Duration:    duration,
+		Sections:    sections,
+		Description: describeStructure(job.FileName, duration, sections),
+	}, nil
+}
+
+// structureHandler serves GET /api/jobs/{id}/structure?format=json|text
+func structureHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupCompletedJob(w, r)
+	if !ok || refuseEncrypted(w, job) {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "text" {
+		http.Error(w, invalidOption("format", []string{"json", "text"}).Error(), http.StatusBadRequest)
+		return
+	}
+	s, err := jobStructure(job)
+	if errors.Is(err, errNoStructureStems) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if format == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(s.Description))
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
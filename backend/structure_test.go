@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// levelTrack builds frame levels from runs of (frames, dBFS)
+func levelTrack(runs ...float64) []float64 {
+	var levels []float64
+	for i := 0; i < len(runs); i += 2 {
+		for range int(runs[i]) {
+			levels = append(levels, runs[i+1])
+		}
+	}
+	return levels
+}
+
+func TestSongStructure(t *testing.T) {
+	const off = -90.0
+	// intro, verse, chorus (straight after), break, chorus, outro
+	levels := map[string][]float64{
+		"vocals": levelTrack(20, off, 40, -25, 40, -14, 20, off, 40, -14, 20, off),
+		"drums":  levelTrack(20, -20, 40, -24, 40, -14, 20, -18, 40, -14, 20, -20),
+		"bass":   levelTrack(20, off, 40, -26, 40, -16, 20, -20, 40, -16, 20, off),
+	}
+	sections := songStructure(levels, 0.5)
+	var got []string
+	for _, s := range sections {
+		got = append(got, fmt.Sprintf("%s %g-%g %v", s.Title, s.Start, s.End, s.Stems))
+	}
+	want := []string{
+		"Intro 0-10 [drums]",
+		"Verse 1 10-30 [bass drums vocals]",
+		"Chorus 1 30-50 [bass drums vocals]",
+		"Instrumental break 50-60 [bass drums]",
+		"Chorus 2 60-80 [bass drums vocals]",
+		"Outro 80-90 [drums]",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("sections:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if sections[2].Label != "chorus" || sections[2].Number != 1 || sections[2].LoudnessDB <= sections[1].LoudnessDB {
+		t.Errorf("chorus = %+v", sections[2])
+	}
+
+	// Pauses between lines don't end a verse, and vocal sections of one
+	// level are all verses
+	levels = map[string][]float64{
+		"vocals": levelTrack(30, -20, 4, off, 30, -20),
+		"other":  levelTrack(64, -22),
+	}
+	if sections := songStructure(levels, 0.5); len(sections) != 1 || sections[0].Title != "Verse 1" {
+		t.Errorf("one verse = %+v", sections)
+	}
+
+	text := describeStructure("song.mp3", 90, songStructure(map[string][]float64{
+		"vocals": levelTrack(20, off, 40, -20),
+		"drums":  levelTrack(60, -20),
+	}, 0.5))
+	wantText := "song.mp3, 1:30 long: 2 sections, estimated from the separated stems.\n" +
+		"0:00 to 0:10, Intro: drums.\n" +
+		"0:10 to 0:30, Verse 1: drums and vocals.\n"
+	if text != wantText {
+		t.Errorf("text = %q", text)
+	}
+}
+
+func TestStructureHandlerNeedsVocals(t *testing.T) {
+	dir := t.TempDir()
+	oldOutputDir := outputDir
+	outputDir = dir
+	t.Cleanup(func() { outputDir = oldOutputDir })
+	job := &Job{ID: "structure-job", Status: "completed", OutputFiles: map[string]string{"drums": dir + "/drums.wav", "bass": dir + "/bass.wav"}}
+	jobsMutex.Lock()
+	jobs[job.ID] = job
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, job.ID)
+		jobsMutex.Unlock()
+	})
+
+	for query, want := range map[string]int{"": http.StatusBadRequest, "?format=midi": http.StatusBadRequest} {
+		rec := httptest.NewRecorder()
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/api/jobs/structure-job/structure"+query, nil), map[string]string{"id": job.ID})
+		structureHandler(rec, req)
+		if rec.Code != want || (query == "" && !strings.Contains(rec.Body.String(), "vocals stem")) {
+			t.Errorf("%q = %d %s", query, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Service manager integration for installs without Docker. When systemd
+// starts the backend through a .socket unit (LISTEN_PID/LISTEN_FDS), it
+// serves the sockets it is handed instead of LISTEN_ADDRS. With
+// NOTIFY_SOCKET set (Type=notify) it reports READY=1 once serving and
+// STOPPING=1 on shutdown, and with WatchdogSec= it pings the watchdog
+// every half period while the job table is responsive, so a wedged
+// process gets restarted. PID_FILE and HEALTH_FILE are for other
+// supervisors: the first holds the process ID, the second is rewritten
+// every HEALTH_FILE_INTERVAL (default 10s) with the readiness state, and
+// both are removed on a clean exit.
+
+const (
+	sdListenFDsStart          = 3 // SD_LISTEN_FDS_START
+	defaultHealthFileInterval = 10 * time.Second
+)
+
+// activatedListener is a socket passed by the service manager
+type activatedListener struct {
+	Name string // from FileDescriptorName=, or the fd number
+	net.Listener
+}
+
+// systemdListeners returns the sockets passed by socket activation, or
+// none when the process wasn't socket activated. getenv and pid stand in
+// for os.Getenv and os.Getpid; firstFD is 3 outside tests.
+func systemdListeners(getenv func(string) string, pid, firstFD int) ([]activatedListener, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("LISTEN_FDS=%q: want a socket count", getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+	var listeners []activatedListener
+	for i := 0; i < n; i++ {
+		fd := firstFD + i
+		name := strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		// FileListener dups the descriptor (close-on-exec), so the original goes
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, open := range listeners {
+				open.Close()
+			}
+			return nil, fmt.Errorf("socket %s (fd %d): %v", name, fd, err)
+		}
+		listeners = append(listeners, activatedListener{name, l})
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a state change to the service manager; it does nothing
+// unless NOTIFY_SOCKET is set
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval is how often to ping the systemd watchdog, half of
+// WatchdogSec=, or 0 when the watchdog is off or meant for another process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// responsive reports whether the job table can be locked within timeout;
+// a deadlock there would stall uploads and every status request
+func responsive(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		jobsMutex.RLock()
+		jobsMutex.RUnlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// serviceStatus is the one-line STATUS= shown by systemctl status
+func serviceStatus() string {
+	queued, running := processingQueue.stats()
+	return fmt.Sprintf("STATUS=%d jobs running, %d queued", running, queued)
+}
+
+// watchdogPinger keeps the systemd watchdog fed while the process is healthy
+func watchdogPinger(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !responsive(interval) {
+			log.Printf("Job table unresponsive, skipping watchdog ping")
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1\n" + serviceStatus()); err != nil {
+			log.Printf("Failed to ping watchdog: %v", err)
+		}
+	}
+}
+
+func healthFileInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("HEALTH_FILE_INTERVAL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultHealthFileInterval
+}
+
+// writePIDFile writes the process ID to path
+func writePIDFile(path string) error {
+	return writeFileAtomic(path, []byte(strconv.Itoa(os.Getpid())+"\n"))
+}
+
+// writeHealthFile records the readiness state /api/ready reports
+func writeHealthFile(path string) error {
+	status := "ready"
+	if !responsive(5*time.Second) || !selfTestReady(selfTestSnapshot()) {
+		status = "not_ready"
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"status":     status,
+		"pid":        os.Getpid(),
+		"updated_at": time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// healthFileWriter rewrites the health file every interval
+func healthFileWriter(path string, interval time.Duration) {
+	for {
+		if err := writeHealthFile(path); err != nil {
+			log.Printf("Failed to write health file: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// writeFileAtomic replaces path so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
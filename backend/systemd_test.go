@@ -0,0 +1,133 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSystemdListeners(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(key string) string { return vars[key] }
+	}
+	if ls, err := systemdListeners(env(map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}), 42, 3); ls != nil || err != nil {
+		t.Errorf("sockets meant for another process = %v, %v; want none", ls, err)
+	}
+	if _, err := systemdListeners(env(map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "x"}), 42, 3); err == nil {
+		t.Error("expected a bad LISTEN_FDS to be rejected")
+	}
+
+	// Hand over a listening socket the way systemd would, on a bare fd
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := l.(*net.TCPListener).File()
+	l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := systemdListeners(env(map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "1", "LISTEN_FDNAMES": "http"}), 42, fd)
+	if err != nil || len(ls) != 1 || ls[0].Name != "http" {
+		t.Fatalf("systemdListeners = %v, %v", ls, err)
+	}
+	defer ls[0].Close()
+	go func() {
+		if conn, err := ls[0].Accept(); err == nil {
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", ls[0].Addr().String())
+	if err != nil {
+		t.Fatalf("dial activated socket: %v", err)
+	}
+	buf := make([]byte, 2)
+	conn.Read(buf)
+	conn.Close()
+	if string(buf) != "ok" {
+		t.Errorf("activated socket answered %q", buf)
+	}
+}
+
+func TestSDNotify(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	for _, name := range []string{socket, "@track2stem-test-" + strconv.Itoa(os.Getpid())} {
+		addr := name
+		if strings.HasPrefix(name, "@") {
+			addr = "\x00" + name[1:]
+		}
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("NOTIFY_SOCKET", name)
+		if err := sdNotify("READY=1\nSTATUS=idle"); err != nil {
+			t.Errorf("sdNotify via %q: %v", name, err)
+		}
+		buf := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _ := conn.Read(buf)
+		conn.Close()
+		if string(buf[:n]) != "READY=1\nSTATUS=idle" {
+			t.Errorf("notify socket %q got %q", name, buf[:n])
+		}
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify without a socket: %v", err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if d := watchdogInterval(); d != 15*time.Second {
+		t.Errorf("watchdogInterval = %v, want 15s", d)
+	}
+	t.Setenv("WATCHDOG_PID", "1")
+	if d := watchdogInterval(); d != 0 {
+		t.Errorf("watchdog for another process = %v, want off", d)
+	}
+}
+
+func TestPIDAndHealthFiles(t *testing.T) {
+	dir := t.TempDir()
+	pidFile, healthFile := filepath.Join(dir, "backend.pid"), filepath.Join(dir, "health.json")
+	if err := writePIDFile(pidFile); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(pidFile); string(data) != strconv.Itoa(os.Getpid())+"\n" {
+		t.Errorf("PID file = %q", data)
+	}
+
+	if err := writeHealthFile(healthFile); err != nil {
+		t.Fatal(err)
+	}
+	var health struct {
+		Status    string    `json:"status"`
+		PID       int       `json:"pid"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+	data, _ := os.ReadFile(healthFile)
+	if err := json.Unmarshal(data, &health); err != nil || health.Status != "ready" || health.PID != os.Getpid() || time.Since(health.UpdatedAt) > time.Minute {
+		t.Errorf("health file = %s (%v)", data, err)
+	}
+	if _, err := os.Stat(healthFile + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary file left behind")
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Job templates, for workflows that run the same way every week. A
+// template stores a whole job configuration under a name: the upload
+// options (pipeline and callback_url included) and the deliveries to queue
+// once the job completes. template=weekly-podcast on an upload, a batch, a
+// chunked upload or a stream ingest starts from the template's options;
+// fields the request sets itself win. The job records the template it came
+// from, and the template's deliveries are copied onto it when it is
+// created, so editing or deleting the template doesn't change jobs already
+// running. Templates are kept in JOB_TEMPLATES_FILE.
+
+// JobTemplate is a named job configuration
+type JobTemplate struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Options     map[string]string `json:"options"`           // upload fields, as in a form
+	Exports     []deliveryRequest `json:"exports,omitempty"` // queued once the job completes
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+// templateNamePattern restricts template names, which are used in upload
+// forms and URLs
+var templateNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// templateExcludedOptions can't be stored in a template: a template can't
+// name another, and encrypted jobs need a key of their own
+var templateExcludedOptions = []string{"template", "encrypted", "sealed_key"}
+
+const maxJobTemplates = 100
+
+var (
+	jobTemplates      = make(map[string]*JobTemplate)
+	jobTemplatesMutex = &sync.RWMutex{}
+)
+
+func init() { keepInUploads(jobTemplatesFile) }
+
+// jobTemplatesFile is where templates are kept across restarts
+func jobTemplatesFile() string {
+	if path := os.Getenv("JOB_TEMPLATES_FILE"); path != "" {
+		return path
+	}
+	return filepath.Join(uploadDir, ".job-templates.json")
+}
+
+// loadJobTemplates reads the saved templates
+func loadJobTemplates() {
+	data, err := os.ReadFile(jobTemplatesFile())
+	if err != nil {
+		return
+	}
+	var list []*JobTemplate
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Failed to load job templates: %v", err)
+		return
+	}
+	jobTemplatesMutex.Lock()
+	for _, t := range list {
+		jobTemplates[t.Name] = t
+	}
+	jobTemplatesMutex.Unlock()
+	log.Printf("Loaded %d job templates", len(list))
+}
+
+// saveJobTemplates writes every template to the file. Callers hold
+// jobTemplatesMutex.
+func saveJobTemplates() {
+	list := make([]*JobTemplate, 0, len(jobTemplates))
+	for _, name := range sortedKeys(jobTemplates) {
+		list = append(list, jobTemplates[name])
+	}
+	data, _ := json.MarshalIndent(list, "", "  ")
+	tmp := jobTemplatesFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Failed to save job templates: %v", err)
+		return
+	}
+	os.Rename(tmp, jobTemplatesFile())
+}
+
+// lookupJobTemplate returns a copy of the named template
+func lookupJobTemplate(name string) (JobTemplate, bool) {
+	jobTemplatesMutex.RLock()
+	defer jobTemplatesMutex.RUnlock()
+	t, ok := jobTemplates[name]
+	if !ok {
+		return JobTemplate{}, false
+	}
+	return t.clone(), true
+}
+
+func (t *JobTemplate) clone() JobTemplate {
+	c := *t
+	c.Options = maps.Clone(t.Options)
+	c.Exports = slices.Clone(t.Exports)
+	return c
+}
+
+// redacted returns a copy without the callback secret
+func (t *JobTemplate) redacted() JobTemplate {
+	c := t.clone()
+	delete(c.Options, "callback_secret")
+	return c
+}
+
+// withTemplate returns the get of parseJobOptions with the template's
+// options under the request's own
+func (t JobTemplate) withTemplate(get func(string) string) func(string) string {
+	return func(key string) string {
+		if v := get(key); v != "" {
+			return v
+		}
+		return t.Options[key]
+	}
+}
+
+// validateJobTemplate checks a template's name, that its options make a
+// valid job on their own and that its export targets are configured
+func validateJobTemplate(t *JobTemplate) error {
+	if !templateNamePattern.MatchString(t.Name) {
+		return fmt.Errorf("Invalid name value (lowercase letters, digits, - and _, up to 64)")
+	}
+	if t.Options == nil {
+		t.Options = map[string]string{}
+	}
+	for _, name := range templateExcludedOptions {
+		if _, set := t.Options[name]; set {
+			return fmt.Errorf("Invalid options: %s can't be stored in a template", name)
+		}
+	}
+	opts, err := parseJobOptions(func(key string) string { return t.Options[key] })
+	if err == nil {
+		err = opts.checkFields(slices.Collect(maps.Keys(t.Options)), jobOptionFields, true)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid options: %v", err)
+	}
+	for i, e := range t.Exports {
+		if _, err := lookupExporter(e.Target); err != nil {
+			return fmt.Errorf("Invalid exports[%d]: %v", i, err)
+		}
+		if _, err := resolveLayout(e.Layout); err != nil {
+			return fmt.Errorf("Invalid exports[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// decodeJobTemplate reads and validates the template of a request body
+func decodeJobTemplate(w http.ResponseWriter, r *http.Request) (*JobTemplate, bool) {
+	var t JobTemplate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Invalid template", http.StatusBadRequest)
+		return nil, false
+	}
+	if err := validateJobTemplate(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return &t, true
+}
+
+// createJobTemplateHandler serves POST /api/templates
+func createJobTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := decodeJobTemplate(w, r)
+	if !ok {
+		return
+	}
+	t.CreatedAt = time.Now().UTC()
+	t.UpdatedAt = t.CreatedAt
+
+	jobTemplatesMutex.Lock()
+	if jobTemplates[t.Name] != nil {
+		jobTemplatesMutex.Unlock()
+		http.Error(w, "Template "+t.Name+" already exists", http.StatusConflict)
+		return
+	}
+	if len(jobTemplates) >= maxJobTemplates {
+		jobTemplatesMutex.Unlock()
+		http.Error(w, "Too many templates", http.StatusConflict)
+		return
+	}
+	jobTemplates[t.Name] = t
+	saveJobTemplates()
+	created := t.redacted()
+	jobTemplatesMutex.Unlock()
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// replaceJobTemplateHandler serves PUT /api/templates/{name}
+func replaceJobTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := decodeJobTemplate(w, r)
+	if !ok {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if t.Name != name {
+		http.Error(w, "Template name doesn't match the URL", http.StatusBadRequest)
+		return
+	}
+
+	jobTemplatesMutex.Lock()
+	old := jobTemplates[name]
+	if old == nil {
+		jobTemplatesMutex.Unlock()
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	t.CreatedAt, t.UpdatedAt = old.CreatedAt, time.Now().UTC()
+	jobTemplates[name] = t
+	saveJobTemplates()
+	replaced := t.redacted()
+	jobTemplatesMutex.Unlock()
+	writeJSON(w, http.StatusOK, replaced)
+}
+
+// listJobTemplatesHandler serves GET /api/templates
+func listJobTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	jobTemplatesMutex.RLock()
+	list := make([]JobTemplate, 0, len(jobTemplates))
+	for _, name := range sortedKeys(jobTemplates) {
+		list = append(list, jobTemplates[name].redacted())
+	}
+	jobTemplatesMutex.RUnlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"templates": list})
+}
+
+// getJobTemplateHandler serves GET /api/templates/{name}
+func getJobTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	jobTemplatesMutex.RLock()
+	t, ok := jobTemplates[mux.Vars(r)["name"]]
+	var snapshot JobTemplate
+	if ok {
+		snapshot = t.redacted()
+	}
+	jobTemplatesMutex.RUnlock()
+	if !ok {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+// deleteJobTemplateHandler serves DELETE /api/templates/{name}
+func deleteJobTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	jobTemplatesMutex.Lock()
+	if jobTemplates[name] == nil {
+		jobTemplatesMutex.Unlock()
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	delete(jobTemplates, name)
+	saveJobTemplates()
+	jobTemplatesMutex.Unlock()
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
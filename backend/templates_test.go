@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateJobTemplate(t *testing.T) {
+	t.Setenv("LOCAL_EXPORT_DIR", t.TempDir())
+	valid := JobTemplate{Name: "weekly-podcast", Options: map[string]string{"stem_mode": "isolate", "isolate_stem": "vocals"}, Exports: []deliveryRequest{{Target: "local"}}}
+	if err := validateJobTemplate(&valid); err != nil {
+		t.Fatal(err)
+	}
+	for want, tmpl := range map[string]JobTemplate{
+		"name":            {Name: "Weekly Podcast"},
+		"stem_mode":       {Name: "a", Options: map[string]string{"stem_mode": "most"}},
+		"can't be stored": {Name: "a", Options: map[string]string{"template": "b"}},
+		"has no effect":   {Name: "a", Options: map[string]string{"isolate_stem": "drums"}},
+		"not configured":  {Name: "a", Exports: []deliveryRequest{{Target: "s3"}}},
+		"Invalid layout":  {Name: "a", Exports: []deliveryRequest{{Target: "local", Layout: "by-stem"}}},
+		"Unknown option":  {Name: "a", Options: map[string]string{"bpm": "120"}},
+	} {
+		if err := validateJobTemplate(&tmpl); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%+v = %v, want %q", tmpl, err, want)
+		}
+	}
+
+	if _, err := parseJobOptions(url.Values{"template": {"missing"}}.Get); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("unknown template = %v", err)
+	}
+}
+
+func TestIntegrationJobTemplates(t *testing.T) {
+	exportDir := t.TempDir()
+	t.Setenv("LOCAL_EXPORT_DIR", exportDir)
+	b := newIntegrationBackend(t, 1)
+	t.Cleanup(func() {
+		jobTemplatesMutex.Lock()
+		clear(jobTemplates)
+		jobTemplatesMutex.Unlock()
+	})
+	send := func(method, path, body string) (int, []byte) {
+		req, _ := http.NewRequest(method, b.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, data
+	}
+
+	body := `{"name": "weekly-podcast", "description": "Dialogue for the show notes",
+		"options": {"stem_mode": "isolate", "isolate_stem": "vocals", "output_format": "wav", "callback_url": "https://example.com/done", "callback_secret": "s3cret"},
+		"exports": [{"target": "local", "stems": ["vocals"]}]}`
+	if code, data := send("POST", "/api/templates", body); code != http.StatusCreated || strings.Contains(string(data), "s3cret") {
+		t.Fatalf("create = %d %s", code, data)
+	}
+	if code, _ := send("POST", "/api/templates", body); code != http.StatusConflict {
+		t.Errorf("duplicate = %d", code)
+	}
+	if saved, _ := os.ReadFile(jobTemplatesFile()); !strings.Contains(string(saved), "weekly-podcast") {
+		t.Errorf("templates file = %s", saved)
+	}
+
+	// The request's own fields win over the template's
+	job := b.waitFor(b.upload("episode.mp3", map[string]string{"template": "weekly-podcast", "output_format": "flac"}).ID, "completed")
+	if job.Template != "weekly-podcast" || job.StemMode != "isolate" || job.OutputFormat != "flac" || job.CallbackURL != "https://example.com/done" {
+		t.Fatalf("job = %+v", job)
+	}
+	runDelivery(<-deliveryQueue)
+	if job = b.job(job.ID); len(job.Deliveries) != 1 || job.Deliveries[0].Target != "local" || job.Deliveries[0].Status != "delivered" {
+		t.Fatalf("deliveries = %+v", job.Deliveries)
+	}
+	if _, err := os.Stat(filepath.Join(exportDir, job.ID, filepath.Base(job.OutputFiles["vocals"]))); err != nil {
+		t.Error(err)
+	}
+
+	replaced := strings.Replace(body, `"wav"`, `"mp3"`, 1)
+	if code, data := send("PUT", "/api/templates/weekly-podcast", replaced); code != http.StatusOK {
+		t.Fatalf("replace = %d %s", code, data)
+	}
+	code, data := b.get("/api/templates")
+	var list struct {
+		Templates []JobTemplate `json:"templates"`
+	}
+	json.Unmarshal(data, &list)
+	if code != http.StatusOK || len(list.Templates) != 1 || list.Templates[0].Options["output_format"] != "mp3" || list.Templates[0].Options["callback_secret"] != "" {
+		t.Errorf("list = %d %s", code, data)
+	}
+	if code, _ := send("DELETE", "/api/templates/weekly-podcast", ""); code != http.StatusOK {
+		t.Errorf("delete = %d", code)
+	}
+	if code, _ := b.get("/api/templates/weekly-podcast"); code != http.StatusNotFound {
+		t.Errorf("deleted template = %d", code)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Terms-of-service gating (TERMS_VERSION). While it is set, endpoints that
+// accept audio require an acceptance of the current version, passed in the
+// X-Track2stem-Terms header (or, for WebSockets, which can't set headers, the
+// terms query parameter). The instance has no user accounts, so each
+// client (a browser, a CLI install) records its own acceptance and keeps the
+// returned ID; every acceptance is written to the audit log.
+
+const termsHeader = "X-Track2stem-Terms"
+
+// TermsAcceptance records that a client accepted a terms version
+type TermsAcceptance struct {
+	ID         string    `json:"id"`
+	Version    string    `json:"version"`
+	AcceptedAt time.Time `json:"accepted_at"`
+}
+
+var (
+	termsAcceptances      = make(map[string]TermsAcceptance)
+	termsAcceptancesMutex = &sync.Mutex{}
+)
+
+// termsInfo describes the current terms (GET /api/terms)
+type termsInfo struct {
+	Required bool   `json:"required"`
+	Version  string `json:"version,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Notice   string `json:"notice,omitempty"`
+}
+
+func currentTerms() termsInfo {
+	version := os.Getenv("TERMS_VERSION")
+	return termsInfo{
+		Required: version != "",
+		Version:  version,
+		URL:      os.Getenv("TERMS_URL"),
+		Notice:   os.Getenv("TERMS_NOTICE"),
+	}
+}
+
+// termsError is the JSON body of a refused request
+type termsError struct {
+	Error   string `json:"error"`
+	Code    string `json:"code"` // terms_required, terms_outdated, terms_unknown
+	Version string `json:"version"`
+	URL     string `json:"url,omitempty"`
+	Accept  string `json:"accept"`
+
+	Remediation *Remediation `json:"remediation"`
+}
+
+func termsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentTerms())
+}
+
+// acceptTermsHandler records an acceptance: POST /api/terms/accept with
+// {"version": "..."}, which must be the current version
+func acceptTermsHandler(w http.ResponseWriter, r *http.Request) {
+	terms := currentTerms()
+	if !terms.Required {
+		http.Error(w, "No terms to accept", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Version != terms.Version {
+		http.Error(w, "Invalid version value", http.StatusConflict)
+		return
+	}
+
+	a := TermsAcceptance{ID: randomToken(16), Version: terms.Version, AcceptedAt: time.Now().UTC()}
+	termsAcceptancesMutex.Lock()
+	termsAcceptances[a.ID] = a
+	termsAcceptancesMutex.Unlock()
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	recordAudit("terms.accepted", "", map[string]string{
+		"acceptance": a.ID, "version": a.Version, "remote_addr": host, "user_agent": r.UserAgent(),
+	})
+	writeJSON(w, http.StatusCreated, a)
+}
+
+// requireTerms refuses requests without an acceptance of the current terms:
+// 451 when none (or an outdated one) is presented, 403 for an unknown ID
+func requireTerms(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		terms := currentTerms()
+		if !terms.Required {
+			next(w, r)
+			return
+		}
+		refuse := func(status int, code, msg string) {
+			remedy := &Remediation{Action: remedyAcceptTerms, Hint: "Accept the terms of service (version " + terms.Version + ") and upload again", URL: "/api/terms/accept"}
+			writeJSON(w, status, termsError{Error: msg, Code: code, Version: terms.Version, URL: terms.URL, Accept: "/api/terms/accept", Remediation: remedy})
+		}
+		id := r.Header.Get(termsHeader)
+		if id == "" {
+			id = r.URL.Query().Get("terms")
+		}
+		if id == "" {
+			refuse(http.StatusUnavailableForLegalReasons, "terms_required", "Terms of service must be accepted")
+			return
+		}
+		termsAcceptancesMutex.Lock()
+		a, ok := termsAcceptances[id]
+		termsAcceptancesMutex.Unlock()
+		switch {
+		case !ok:
+			refuse(http.StatusForbidden, "terms_unknown", "Unknown terms acceptance")
+		case a.Version != terms.Version:
+			refuse(http.StatusUnavailableForLegalReasons, "terms_outdated", "Updated terms of service must be accepted")
+		default:
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequireTerms(t *testing.T) {
+	handler := requireTerms(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusAccepted) })
+	upload := func(acceptance string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/upload", nil)
+		if acceptance != "" {
+			req.Header.Set(termsHeader, acceptance)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	accept := func(version string) (*httptest.ResponseRecorder, TermsAcceptance) {
+		rec := httptest.NewRecorder()
+		acceptTermsHandler(rec, httptest.NewRequest("POST", "/api/terms/accept", strings.NewReader(`{"version":"`+version+`"}`)))
+		var a TermsAcceptance
+		json.Unmarshal(rec.Body.Bytes(), &a)
+		return rec, a
+	}
+
+	if rec := upload(""); rec.Code != http.StatusAccepted {
+		t.Fatalf("ungated upload = %d", rec.Code)
+	}
+
+	t.Setenv("TERMS_VERSION", "2026-01")
+	rec := upload("")
+	var refused termsError
+	json.Unmarshal(rec.Body.Bytes(), &refused)
+	if rec.Code != http.StatusUnavailableForLegalReasons || refused.Code != "terms_required" || refused.Version != "2026-01" {
+		t.Errorf("missing acceptance = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := upload("made-up"); rec.Code != http.StatusForbidden {
+		t.Errorf("unknown acceptance = %d", rec.Code)
+	}
+	if rec, _ := accept("2025-06"); rec.Code != http.StatusConflict {
+		t.Errorf("accepting a stale version = %d", rec.Code)
+	}
+	_, a := accept("2026-01")
+	if rec := upload(a.ID); rec.Code != http.StatusAccepted {
+		t.Errorf("accepted upload = %d %s", rec.Code, rec.Body.String())
+	}
+
+	t.Setenv("TERMS_VERSION", "2026-07")
+	rec = upload(a.ID)
+	json.Unmarshal(rec.Body.Bytes(), &refused)
+	if rec.Code != http.StatusUnavailableForLegalReasons || refused.Code != "terms_outdated" {
+		t.Errorf("outdated acceptance = %d %s", rec.Code, rec.Body.String())
+	}
+}
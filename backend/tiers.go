@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Tiers. TIERS lists named sets of upload limits, comma separated, lowest
+// first, each a name followed by optional space-separated limits:
+//
+//	TIERS=free max_duration=300 formats=mp3 models=htdemucs+htdemucs_6s url=https://example.com/pricing, pro formats=mp3+wav+flac url=https://example.com/pro, studio
+//
+// max_duration caps the upload length in seconds (measured with ffprobe),
+// formats the output and extra formats, models the models; a tier without
+// one has no such limit. watermark marks the tier's stems (see
+// watermark.go). API keys are assigned a tier; requests without a
+// key, and keys without one, get TIER_DEFAULT (the first tier by default).
+// An upload its tier refuses is answered 403 with the limit it hit and the
+// lowest higher tier that would allow the whole request, with that tier's
+// url, so the frontend can offer an upgrade; when no tier would, with the
+// support link (BRANDING_SUPPORT_URL) to contact the admin instead. Limits
+// on options are checked before the file is sent, the duration once it
+// has been saved. Without TIERS there are no tier limits, beyond a key's
+// own overrides (see overrides.go).
+
+// Tier is a named set of upload limits
+type Tier struct {
+	Name               string   `json:"name"`
+	MaxDurationSeconds float64  `json:"max_duration_seconds,omitempty"` // 0 for unlimited
+	OutputFormats      []string `json:"output_formats,omitempty"`       // empty: every format
+	Models             []string `json:"models,omitempty"`               // empty: every model
+	URL                string   `json:"url,omitempty"`                  // where to get the tier
+	Watermark          string   `json:"watermark,omitempty"`            // inaudible, tone or none; empty: WATERMARK
+}
+
+// tierError is the JSON body of an upload its tier refuses
+type tierError struct {
+	Error              string   `json:"error"`
+	Code               string   `json:"code"`  // tier_limit
+	Limit              string   `json:"limit"` // duration, output_format or model
+	Tier               string   `json:"tier"`
+	Requested          string   `json:"requested"`
+	Allowed            []string `json:"allowed,omitempty"`              // the formats or models of the tier
+	MaxDurationSeconds float64  `json:"max_duration_seconds,omitempty"` // the tier's duration limit
+	UpgradeTier        string   `json:"upgrade_tier,omitempty"`         // lowest tier that allows the request
+	UpgradeURL         string   `json:"upgrade_url,omitempty"`
+	ContactURL         string   `json:"contact_url,omitempty"` // when no tier allows it
+
+	Remediation *Remediation `json:"remediation"`
+}
+
+// parseTiers reads a TIERS value
+func parseTiers(value string) ([]Tier, error) {
+	var tiers []Tier
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		t := Tier{Name: fields[0]}
+		if slices.ContainsFunc(tiers, func(other Tier) bool { return other.Name == t.Name }) {
+			return nil, fmt.Errorf("tier %s: listed twice", t.Name)
+		}
+		for _, limit := range fields[1:] {
+			key, val, _ := strings.Cut(limit, "=")
+			switch key {
+			case "max_duration":
+				seconds, err := strconv.ParseFloat(val, 64)
+				if err != nil || seconds <= 0 {
+					return nil, fmt.Errorf("tier %s: max_duration must be a positive number of seconds", t.Name)
+				}
+				t.MaxDurationSeconds = seconds
+			case "formats":
+				for _, format := range strings.Split(val, "+") {
+					if !allowedOutputFormats[format] {
+						return nil, fmt.Errorf("tier %s: unknown format %q", t.Name, format)
+					}
+					t.OutputFormats = append(t.OutputFormats, format)
+				}
+			case "models":
+				for _, model := range strings.Split(val, "+") {
+					if !isAllowedModel(model) {
+						return nil, fmt.Errorf("tier %s: unknown model %q", t.Name, model)
+					}
+					t.Models = append(t.Models, model)
+				}
+			case "url":
+				if !strings.HasPrefix(val, "http://") && !strings.HasPrefix(val, "https://") {
+					return nil, fmt.Errorf("tier %s: url must be http(s)", t.Name)
+				}
+				t.URL = val
+			case "watermark":
+				if val != "none" && !slices.Contains(watermarkModes, val) {
+					return nil, fmt.Errorf("tier %s: watermark must be none, %s", t.Name, strings.Join(watermarkModes, " or "))
+				}
+				t.Watermark = val
+			default:
+				return nil, fmt.Errorf("tier %s: unknown limit %q", t.Name, limit)
+			}
+		}
+		tiers = append(tiers, t)
+	}
+	if name := os.Getenv("TIER_DEFAULT"); name != "" && tierIndex(tiers, name) < 0 {
+		return nil, fmt.Errorf("TIER_DEFAULT: unknown tier %q", name)
+	}
+	return tiers, nil
+}
+
+// tiersFromEnv returns the TIERS tiers; startup has checked they parse
+func tiersFromEnv() []Tier {
+	tiers, _ := parseTiers(os.Getenv("TIERS"))
+	return tiers
+}
+
+func tierIndex(tiers []Tier, name string) int {
+	return slices.IndexFunc(tiers, func(t Tier) bool { return t.Name == name })
+}
+
+// isTier reports whether name is one of the TIERS tiers
+func isTier(name string) bool {
+	return tierIndex(tiersFromEnv(), name) >= 0
+}
+
+// requestTier returns the index of the tier a request's limits come from
+func requestTier(ctx context.Context, tiers []Tier) int {
+	return keyTier(tiers, apiKeyID(ctx))
+}
+
+// keyTier returns the index of an API key's tier, or of the default tier
+// for requests without a key (id "")
+func keyTier(tiers []Tier, id string) int {
+	if id != "" {
+		apiKeysMutex.Lock()
+		var name string
+		if k, exists := apiKeys[id]; exists {
+			name = k.Tier
+		}
+		apiKeysMutex.Unlock()
+		if i := tierIndex(tiers, name); i >= 0 {
+			return i
+		}
+	}
+	return max(tierIndex(tiers, os.Getenv("TIER_DEFAULT")), 0)
+}
+
+// refuses returns the first limit of the tier a request exceeds, and what
+// was asked for; seconds is 0 when the duration isn't known
+func (t Tier) refuses(opts jobOptions, seconds float64) (limit, requested string) {
+	if len(t.Models) > 0 && !slices.Contains(t.Models, opts.Model) {
+		return "model", opts.Model
+	}
+	if len(t.OutputFormats) > 0 {
+		formats := append([]string{opts.OutputFormat}, opts.ExtraFormats...)
+		for _, format := range append(formats, opts.transcodeFormats()...) {
+			if !slices.Contains(t.OutputFormats, format) {
+				return "output_format", format
+			}
+		}
+	}
+	// The length of ciphertext can't be measured, so it can't be held to one
+	if t.MaxDurationSeconds > 0 && opts.Encrypted {
+		return "encrypted", "true"
+	}
+	if t.MaxDurationSeconds > 0 && seconds > t.MaxDurationSeconds {
+		return "duration", strconv.FormatFloat(seconds, 'f', 1, 64)
+	}
+	return "", ""
+}
+
+// checkTier returns why the request's tier refuses an upload with opts, or
+// nil. With the path of the saved upload the duration is checked as well.
+func checkTier(ctx context.Context, opts jobOptions, path string) *tierError {
+	tiers := tiersFromEnv()
+	overrides := keyOverrides(apiKeyID(ctx))
+	if len(tiers) == 0 && !overrides.limitsUploads() {
+		return nil
+	}
+	current, tier := -1, Tier{Name: "custom"}
+	if len(tiers) > 0 {
+		current = requestTier(ctx, tiers)
+		tier = tiers[current]
+	}
+	tier = overrides.applyTo(tier)
+	var seconds float64
+	if path != "" && tier.MaxDurationSeconds > 0 {
+		// An upload ffprobe can't measure is let through
+		if probe, err := probeAudio(ctx, path); err == nil {
+			seconds = probe.DurationSeconds
+		}
+	}
+	limit, requested := tier.refuses(opts, seconds)
+	if limit == "" {
+		return nil
+	}
+
+	e := &tierError{Code: "tier_limit", Limit: limit, Tier: tier.Name, Requested: requested}
+	switch limit {
+	case "model":
+		e.Error = fmt.Sprintf("The %s tier doesn't include the %s model", tier.Name, requested)
+		e.Allowed = tier.Models
+	case "output_format":
+		e.Error = fmt.Sprintf("The %s tier doesn't include %s output", tier.Name, requested)
+		e.Allowed = tier.OutputFormats
+	case "duration":
+		e.Error = fmt.Sprintf("The %s tier allows audio up to %g seconds", tier.Name, tier.MaxDurationSeconds)
+		e.MaxDurationSeconds = tier.MaxDurationSeconds
+	case "encrypted":
+		e.Error = fmt.Sprintf("The %s tier limits audio length, so it doesn't take encrypted uploads", tier.Name)
+		e.Allowed = []string{"false"}
+	}
+	for _, higher := range tiers[current+1:] {
+		// The key keeps its overrides in any tier
+		if l, _ := overrides.applyTo(higher).refuses(opts, seconds); l == "" {
+			e.UpgradeTier, e.UpgradeURL = higher.Name, higher.URL
+			e.Remediation = tierRemedy(e)
+			return e
+		}
+	}
+	e.ContactURL = os.Getenv("BRANDING_SUPPORT_URL")
+	e.Remediation = tierRemedy(e)
+	return e
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testTiers = "free max_duration=300 formats=mp3 models=htdemucs+htdemucs_6s url=https://example.com/pricing, " +
+	"pro formats=mp3+wav+flac url=https://example.com/pro, studio"
+
+func TestParseTiers(t *testing.T) {
+	tiers, err := parseTiers(testTiers)
+	if err != nil || len(tiers) != 3 {
+		t.Fatalf("parseTiers = %+v, %v", tiers, err)
+	}
+	if free := tiers[0]; free.MaxDurationSeconds != 300 || len(free.OutputFormats) != 1 || len(free.Models) != 2 || free.URL != "https://example.com/pricing" {
+		t.Errorf("free = %+v", free)
+	}
+	if studio := tiers[2]; studio.MaxDurationSeconds != 0 || studio.OutputFormats != nil || studio.Models != nil {
+		t.Errorf("studio = %+v", studio)
+	}
+	for value, want := range map[string]string{
+		"free max_duration=-1":   "max_duration",
+		"free formats=ogg":       "unknown format",
+		"free models=nope":       "unknown model",
+		"free url=ftp://x":       "url",
+		"free color=red":         "unknown limit",
+		"free, pro, free":        "listed twice",
+		"free max_duration=soon": "max_duration",
+	} {
+		if _, err := parseTiers(value); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseTiers(%q) = %v, want %q", value, err, want)
+		}
+	}
+	t.Setenv("TIER_DEFAULT", "gold")
+	if _, err := parseTiers(testTiers); err == nil {
+		t.Error("unknown TIER_DEFAULT accepted")
+	}
+}
+
+func TestCheckTier(t *testing.T) {
+	t.Setenv("TIERS", testTiers)
+	t.Setenv("BRANDING_SUPPORT_URL", "https://example.com/support")
+	opts := func(fields map[string]string) jobOptions {
+		o, err := parseJobOptions(func(key string) string { return fields[key] })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+	ctx := context.Background()
+
+	if e := checkTier(ctx, opts(map[string]string{"output_format": "mp3"}), ""); e != nil {
+		t.Errorf("free upload refused: %+v", e)
+	}
+	e := checkTier(ctx, opts(map[string]string{"output_format": "flac"}), "")
+	if e == nil || e.Limit != "output_format" || e.Tier != "free" || e.Requested != "flac" || e.UpgradeTier != "pro" || e.UpgradeURL != "https://example.com/pro" || e.ContactURL != "" {
+		t.Errorf("flac on free = %+v", e)
+	}
+	// pro has every format but no model limit, so the lowest tier for both is pro
+	e = checkTier(ctx, opts(map[string]string{"output_format": "mp3", "model": "htdemucs_ft"}), "")
+	if e == nil || e.Limit != "model" || len(e.Allowed) != 2 || e.UpgradeTier != "pro" {
+		t.Errorf("htdemucs_ft on free = %+v", e)
+	}
+
+	// Encrypted audio can't be measured against free's max_duration
+	encrypted := opts(map[string]string{"output_format": "mp3"})
+	encrypted.Encrypted = true
+	e = checkTier(ctx, encrypted, "")
+	if e == nil || e.Limit != "encrypted" || e.UpgradeTier != "pro" || e.Remediation.Hint != "Set encrypted to false, or upgrade to the pro tier" {
+		t.Errorf("encrypted on free = %+v", e)
+	}
+
+	// Keys use their own tier; the highest tier has nothing to upgrade to
+	apiKeysMutex.Lock()
+	apiKeys["tier-key"] = &APIKey{ID: "tier-key", Tier: "studio"}
+	apiKeysMutex.Unlock()
+	t.Cleanup(func() {
+		apiKeysMutex.Lock()
+		delete(apiKeys, "tier-key")
+		apiKeysMutex.Unlock()
+	})
+	keyed := context.WithValue(ctx, apiKeyContextKey{}, "tier-key")
+	if e := checkTier(keyed, opts(map[string]string{"output_format": "flac", "model": "htdemucs_ft"}), ""); e != nil {
+		t.Errorf("studio upload refused: %+v", e)
+	}
+	t.Setenv("TIERS", "free formats=mp3, studio formats=mp3+wav")
+	e = checkTier(keyed, opts(map[string]string{"output_format": "flac"}), "")
+	if e == nil || e.Tier != "studio" || e.UpgradeTier != "" || e.ContactURL != "https://example.com/support" {
+		t.Errorf("flac on capped studio = %+v", e)
+	}
+
+	t.Setenv("TIERS", "")
+	if e := checkTier(ctx, opts(map[string]string{"output_format": "flac"}), ""); e != nil {
+		t.Errorf("no tiers, still refused: %+v", e)
+	}
+}
+
+func TestIntegrationTierLimits(t *testing.T) {
+	t.Setenv("TIERS", testTiers)
+	b := newIntegrationBackend(t, 1)
+	post := func(name string, fields map[string]string) (int, tierError) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", name)
+		part.Write([]byte("ID3 " + name))
+		for k, v := range fields {
+			mw.WriteField(k, v)
+		}
+		mw.Close()
+		resp, err := http.Post(b.URL+"/api/upload", mw.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var e tierError
+		json.NewDecoder(resp.Body).Decode(&e)
+		return resp.StatusCode, e
+	}
+
+	if code, e := post("song.mp3", map[string]string{"output_format": "wav"}); code != http.StatusForbidden || e.Code != "tier_limit" || e.UpgradeTier != "pro" {
+		t.Errorf("wav upload = %d %+v", code, e)
+	}
+
+	// The duration is checked once the upload is saved
+	fakeFFprobe(t, `{"streams":[{"codec_name":"mp3","channels":2}],"format":{"format_name":"mp3","duration":"720"}}`)
+	before := len(b.processor.Requests())
+	code, e := post("long.mp3", map[string]string{"output_format": "mp3"})
+	if code != http.StatusForbidden || e.Limit != "duration" || e.MaxDurationSeconds != 300 || e.Requested != "720.0" || e.UpgradeTier != "pro" {
+		t.Errorf("long upload = %d %+v", code, e)
+	}
+	if len(b.processor.Requests()) != before {
+		t.Error("refused upload was processed")
+	}
+	fakeFFprobe(t, `{"streams":[{"codec_name":"mp3","channels":2}],"format":{"format_name":"mp3","duration":"120"}}`)
+	b.waitFor(b.upload("short.mp3", map[string]string{"output_format": "mp3"}).ID, "completed")
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Upgrade reports. Before switching the processor image or the default
+// model, POST /api/admin/upgrade-reports re-runs a sample of completed jobs
+// with the candidate (a model, a processor URL running the new image, or
+// both) and compares the new stems with the ones users got: the spectral
+// differences from /api/compare per stem, and the processing time. Only
+// jobs whose upload is still on disk can be re-run, which needs
+// KEEP_UPLOADS=true. Re-runs go
+// through the queue one at a time, are hidden like self-test jobs and are
+// deleted after the comparison; reports are kept in memory.
+
+const (
+	defaultUpgradeSample = 5
+	maxUpgradeSample     = 50
+)
+
+// UpgradeJobResult compares one historical job with its re-run
+type UpgradeJobResult struct {
+	JobID                     string           `json:"job_id"`
+	FileName                  string           `json:"filename"`
+	BaselineModel             string           `json:"baseline_model"`
+	BaselineEnvironment       *ProcessingEnv   `json:"baseline_environment,omitempty"`
+	Environment               *ProcessingEnv   `json:"environment,omitempty"`
+	Rating                    int              `json:"rating,omitempty"` // user's score of the baseline
+	BaselineProcessingSeconds float64          `json:"baseline_processing_seconds,omitempty"`
+	ProcessingSeconds         float64          `json:"processing_seconds,omitempty"`
+	Stems                     []StemComparison `json:"stems,omitempty"`
+	MissingStems              []string         `json:"missing_stems,omitempty"` // in the baseline but not the re-run
+	Error                     string           `json:"error,omitempty"`
+}
+
+// UpgradeSummary averages the compared jobs
+type UpgradeSummary struct {
+	Compared                 int     `json:"compared"`
+	Failed                   int     `json:"failed"`
+	AvgCorrelation           float64 `json:"avg_correlation"`
+	AvgLogSpectralDistanceDB float64 `json:"avg_log_spectral_distance_db"`
+	AvgFlatnessBaseline      float64 `json:"avg_spectral_flatness_baseline"`
+	AvgFlatnessCandidate     float64 `json:"avg_spectral_flatness_candidate"`
+	TimeRatio                float64 `json:"time_ratio,omitempty"` // candidate / baseline processing time
+}
+
+// UpgradeReport is the comparison of a sample of jobs against a candidate
+type UpgradeReport struct {
+	ID           string             `json:"id"`
+	Status       string             `json:"status"` // running, completed
+	Model        string             `json:"model,omitempty"`
+	ProcessorURL string             `json:"processor_url,omitempty"`
+	CreatedAt    time.Time          `json:"created_at"`
+	CompletedAt  *time.Time         `json:"completed_at,omitempty"`
+	Jobs         []UpgradeJobResult `json:"jobs"`
+	Summary      *UpgradeSummary    `json:"summary,omitempty"`
+}
+
+var (
+	upgradeReports      = make(map[string]*UpgradeReport)
+	upgradeReportsMutex = &sync.Mutex{}
+)
+
+// parseProcessingTime reads a processing time like "2m 5s" or "42s"
+func parseProcessingTime(s string) float64 {
+	d, err := time.ParseDuration(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		return 0
+	}
+	return d.Seconds()
+}
+
+// upgradeCandidates returns the completed jobs that can be re-run, newest
+// first: their upload is still there and their stems haven't expired.
+// Callers hold jobsMutex.
+func upgradeCandidates() []*Job {
+	var candidates []*Job
+	for _, job := range jobs {
+		if job.Status != "completed" || job.SelfTest || job.CacheHit || job.inputPath == "" || len(job.OutputFiles) == 0 {
+			continue
+		}
+		if _, err := os.Stat(job.inputPath); err != nil {
+			continue
+		}
+		candidates = append(candidates, job)
+	}
+	slices.SortFunc(candidates, func(a, b *Job) int { return b.CompletedAt.Compare(*a.CompletedAt) })
+	return candidates
+}
+
+// createUpgradeReportHandler starts a report: POST /api/admin/upgrade-reports
+// with {"model": "htdemucs_ft", "processor_url": "http://processor-next:5000",
+// "sample": 5} or explicit "job_ids"
+func createUpgradeReportHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Model        string   `json:"model"`
+		ProcessorURL string   `json:"processor_url"`
+		Sample       int      `json:"sample"`
+		JobIDs       []string `json:"job_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Model == "" && req.ProcessorURL == "" {
+		http.Error(w, "model or processor_url is required", http.StatusBadRequest)
+		return
+	}
+	if req.Model != "" && !isAllowedModel(req.Model) {
+		http.Error(w, "Invalid model value", http.StatusBadRequest)
+		return
+	}
+	if req.ProcessorURL != "" {
+		req.ProcessorURL = strings.TrimSuffix(req.ProcessorURL, "/")
+		if !strings.HasPrefix(req.ProcessorURL, "http://") && !strings.HasPrefix(req.ProcessorURL, "https://") {
+			http.Error(w, "processor_url must be http(s)", http.StatusBadRequest)
+			return
+		}
+		if externalWorkers {
+			http.Error(w, "processor_url can't be used with external workers", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Sample <= 0 {
+		req.Sample = defaultUpgradeSample
+	}
+	if req.Sample > maxUpgradeSample || len(req.JobIDs) > maxUpgradeSample {
+		http.Error(w, fmt.Sprintf("At most %d jobs per report", maxUpgradeSample), http.StatusBadRequest)
+		return
+	}
+
+	var sample []Job
+	jobsMutex.RLock()
+	candidates := upgradeCandidates()
+	if len(req.JobIDs) > 0 {
+		for _, id := range req.JobIDs {
+			i := slices.IndexFunc(candidates, func(j *Job) bool { return j.ID == id })
+			if i < 0 {
+				jobsMutex.RUnlock()
+				http.Error(w, "Job "+id+" can't be re-run: it isn't completed or its upload is gone", http.StatusBadRequest)
+				return
+			}
+			sample = append(sample, candidates[i].snapshot())
+		}
+	} else {
+		for _, job := range candidates[:min(req.Sample, len(candidates))] {
+			sample = append(sample, job.snapshot())
+		}
+	}
+	jobsMutex.RUnlock()
+	if len(sample) == 0 {
+		http.Error(w, "No completed jobs with their upload still available (set KEEP_UPLOADS=true)", http.StatusConflict)
+		return
+	}
+
+	report := &UpgradeReport{
+		ID:           uuid.New().String(),
+		Status:       "running",
+		Model:        req.Model,
+		ProcessorURL: req.ProcessorURL,
+		CreatedAt:    time.Now().UTC(),
+	}
+	upgradeReportsMutex.Lock()
+	upgradeReports[report.ID] = report
+	view := *report
+	upgradeReportsMutex.Unlock()
+	go runUpgradeReport(report, sample)
+	writeJSON(w, http.StatusAccepted, view)
+}
+
+// runUpgradeReport re-runs the sample one job at a time, adding each
+// result to the report as it finishes
+func runUpgradeReport(report *UpgradeReport, sample []Job) {
+	for _, job := range sample {
+		result := rerunForUpgrade(job, report.Model, report.ProcessorURL)
+		upgradeReportsMutex.Lock()
+		report.Jobs = append(report.Jobs, result)
+		upgradeReportsMutex.Unlock()
+	}
+	upgradeReportsMutex.Lock()
+	now := time.Now().UTC()
+	report.Status, report.CompletedAt = "completed", &now
+	report.Summary = summarizeUpgrade(report.Jobs)
+	upgradeReportsMutex.Unlock()
+	log.Printf("Upgrade report %s: compared %d jobs (%d failed)", report.ID, report.Summary.Compared, report.Summary.Failed)
+}
+
+// rerunForUpgrade processes a copy of job's upload with the candidate and
+// compares the stems, then deletes the re-run and its files
+func rerunForUpgrade(job Job, model, processorURL string) UpgradeJobResult {
+	result := UpgradeJobResult{
+		JobID:                     job.ID,
+		FileName:                  job.FileName,
+		BaselineModel:             job.Model,
+		BaselineEnvironment:       job.Environment,
+		Rating:                    job.Rating,
+		BaselineProcessingSeconds: parseProcessingTime(job.ProcessingTime),
+	}
+	opts := job.options()
+	if model != "" {
+		opts.Model = model
+	}
+	opts.ExtraFormats, opts.CallbackURL, opts.CallbackSecret = nil, "", ""
+
+	rerunID := uuid.New().String()
+	inputPath := filepath.Join(uploadDir, rerunID+"_"+filepath.Base(job.inputPath))
+	defer func() {
+		processingQueue.remove(rerunID)
+		jobsMutex.Lock()
+		delete(jobs, rerunID)
+		jobsMutex.Unlock()
+		releaseLeasesForJob(rerunID)
+		os.Remove(inputPath)
+		os.RemoveAll(filepath.Join(outputDir, rerunID))
+	}()
+	if err := copyFile(job.inputPath, inputPath); err != nil {
+		result.Error = "Failed to copy upload: " + err.Error()
+		return result
+	}
+	rerun := newJob(rerunID, job.FileName, opts)
+	rerun.SelfTest = true
+	rerun.inputPath = inputPath
+	rerun.pinnedProcessor = processorURL
+	jobsMutex.Lock()
+	jobs[rerunID] = rerun
+	jobsMutex.Unlock()
+	if !externalWorkers {
+		enqueueJob(rerunID)
+	}
+
+	done, ok := waitForSelfTestJob(rerunID, selfTestTimeout)
+	if !ok {
+		result.Error = fmt.Sprintf("Timed out after %s", selfTestTimeout)
+		return result
+	}
+	if done.Status != "completed" {
+		result.Error = done.Error
+		return result
+	}
+	result.Environment = done.Environment
+	result.ProcessingSeconds = parseProcessingTime(done.ProcessingTime)
+
+	for _, stem := range sortedKeys(job.OutputFiles) {
+		if isMixOutput(stem) || isFormatOutput(stem) {
+			continue
+		}
+		newPath, exists := done.OutputFiles[stem]
+		if !exists {
+			result.MissingStems = append(result.MissingStems, stem)
+			continue
+		}
+		oldPath := job.OutputFiles[stem]
+		if !safeOutputPath(oldPath) || !safeOutputPath(newPath) {
+			result.Error = "Invalid stem path: " + stem
+			return result
+		}
+		a, err := decodeMonoPCM(oldPath, compareSampleRate)
+		if err == nil {
+			var b []int16
+			if b, err = decodeMonoPCM(newPath, compareSampleRate); err == nil {
+				c := compareSignals(int16ToFloat(a), int16ToFloat(b), compareSampleRate)
+				c.Stem, c.JobA, c.ModelA, c.ModelB = stem, job.ID, job.Model, opts.Model
+				result.Stems = append(result.Stems, c)
+				continue
+			}
+		}
+		result.Error = "Failed to decode " + stem + ": " + err.Error()
+		return result
+	}
+	return result
+}
+
+// summarizeUpgrade averages the stem metrics over the jobs that compared
+func summarizeUpgrade(results []UpgradeJobResult) *UpgradeSummary {
+	s := &UpgradeSummary{}
+	var stems int
+	var baselineTime, candidateTime float64
+	for _, r := range results {
+		if r.Error != "" {
+			s.Failed++
+			continue
+		}
+		s.Compared++
+		for _, c := range r.Stems {
+			stems++
+			s.AvgCorrelation += c.Correlation
+			s.AvgLogSpectralDistanceDB += c.LogSpectralDistanceDB
+			s.AvgFlatnessBaseline += c.FlatnessA
+			s.AvgFlatnessCandidate += c.FlatnessB
+		}
+		if r.BaselineProcessingSeconds > 0 && r.ProcessingSeconds > 0 {
+			baselineTime += r.BaselineProcessingSeconds
+			candidateTime += r.ProcessingSeconds
+		}
+	}
+	if stems > 0 {
+		n := float64(stems)
+		s.AvgCorrelation /= n
+		s.AvgLogSpectralDistanceDB /= n
+		s.AvgFlatnessBaseline /= n
+		s.AvgFlatnessCandidate /= n
+	}
+	if baselineTime > 0 {
+		s.TimeRatio = math.Round(candidateTime/baselineTime*100) / 100
+	}
+	return s
+}
+
+// listUpgradeReportsHandler serves GET /api/admin/upgrade-reports, newest first
+func listUpgradeReportsHandler(w http.ResponseWriter, r *http.Request) {
+	upgradeReportsMutex.Lock()
+	list := make([]UpgradeReport, 0, len(upgradeReports))
+	for _, report := range upgradeReports {
+		view := *report
+		view.Jobs = slices.Clone(report.Jobs)
+		list = append(list, view)
+	}
+	upgradeReportsMutex.Unlock()
+	slices.SortFunc(list, func(a, b UpgradeReport) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getUpgradeReportHandler serves GET /api/admin/upgrade-reports/{id}
+func getUpgradeReportHandler(w http.ResponseWriter, r *http.Request) {
+	upgradeReportsMutex.Lock()
+	report, exists := upgradeReports[mux.Vars(r)["id"]]
+	var view UpgradeReport
+	if exists {
+		view = *report
+		view.Jobs = slices.Clone(report.Jobs)
+	}
+	upgradeReportsMutex.Unlock()
+	if !exists {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, view)
+}
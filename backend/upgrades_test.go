@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// writeRawPCM writes a sine as the raw samples the fake ffmpeg "decodes"
+func writeRawPCM(t *testing.T, path string, hz, noise float64) {
+	t.Helper()
+	samples := make([]int16, compareSampleRate/2)
+	for i := range samples {
+		v := 0.5*math.Sin(2*math.Pi*hz*float64(i)/compareSampleRate) + noise*math.Sin(float64(i*i))
+		samples[i] = int16(v * 32767 / (1 + noise))
+	}
+	os.MkdirAll(filepath.Dir(path), 0755)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	binary.Write(f, binary.LittleEndian, samples)
+}
+
+func TestUpgradeReport(t *testing.T) {
+	oldUploadDir, oldOutputDir, oldQueue, oldPoll := uploadDir, outputDir, processingQueue, selfTestPollInterval
+	uploadDir, outputDir = t.TempDir(), t.TempDir()
+	processingQueue, selfTestPollInterval = newJobQueue(), 10*time.Millisecond
+	processingQueue.start(1, runQueuedJob)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		processingQueue.drain(ctx)
+		uploadDir, outputDir, processingQueue, selfTestPollInterval = oldUploadDir, oldOutputDir, oldQueue, oldPoll
+		upgradeReportsMutex.Lock()
+		upgradeReports = make(map[string]*UpgradeReport)
+		upgradeReportsMutex.Unlock()
+	})
+
+	// ffmpeg "decodes" by passing the raw samples through
+	dir := t.TempDir()
+	script := "#!/bin/sh\nwhile [ $# -gt 0 ]; do if [ \"$1\" = -i ]; then cat \"$2\"; exit; fi; shift; done\n"
+	os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0755)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	// The default processor must not be used: the report pins the candidate
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("re-run went to the stable processor")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer stable.Close()
+	t.Setenv("PROCESSOR_URL", stable.URL)
+	var models []string
+	candidate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jobID := r.FormValue("job_id")
+		models = append(models, r.FormValue("model"))
+		path := filepath.Join(outputDir, jobID, "vocals.wav")
+		writeRawPCM(t, path, 440, 0.2)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"outputs":         map[string]string{"vocals": path},
+			"processing_time": "5s",
+			"environment":     ProcessingEnv{Image: "processor:next"},
+		})
+	}))
+	defer candidate.Close()
+
+	id := "7d0e4a1b-2c3d-4e5f-8a9b-0c1d2e3f4a5b"
+	input := filepath.Join(uploadDir, id+"_song.wav")
+	os.WriteFile(input, []byte("RIFF"), 0644)
+	vocals := filepath.Join(outputDir, id, "vocals.wav")
+	writeRawPCM(t, vocals, 440, 0)
+	drums := filepath.Join(outputDir, id, "drums.wav")
+	writeRawPCM(t, drums, 60, 0)
+	completed := time.Now()
+	jobsMutex.Lock()
+	jobs[id] = &Job{ID: id, Status: "completed", FileName: "song.wav", Model: "htdemucs", OutputFormat: "wav", StemMode: "all",
+		CompletedAt: &completed, ProcessingTime: "10s", Rating: 4, inputPath: input,
+		OutputFiles: map[string]string{"vocals": vocals, "drums": drums}}
+	jobs["gone-"+id] = &Job{ID: "gone-" + id, Status: "completed", CompletedAt: &completed, OutputFiles: map[string]string{"vocals": vocals}}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		delete(jobs, "gone-"+id)
+		jobsMutex.Unlock()
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/admin/upgrade-reports", createUpgradeReportHandler).Methods("POST")
+	router.HandleFunc("/api/admin/upgrade-reports/{id}", getUpgradeReportHandler).Methods("GET")
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", "/api/admin/upgrade-reports", strings.NewReader(body)))
+		return rec
+	}
+
+	for body, want := range map[string]int{
+		`{}`:                           http.StatusBadRequest,
+		`{"model": "nope"}`:            http.StatusBadRequest,
+		`{"processor_url": "ftp://x"}`: http.StatusBadRequest,
+		`{"model": "htdemucs_ft", "job_ids": ["gone-` + id + `"]}`: http.StatusBadRequest,
+	} {
+		if rec := post(body); rec.Code != want {
+			t.Errorf("%s = %d, want %d", body, rec.Code, want)
+		}
+	}
+
+	rec := post(`{"model": "htdemucs_ft", "processor_url": "` + candidate.URL + `/"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("create = %d: %s", rec.Code, rec.Body.String())
+	}
+	var report UpgradeReport
+	json.NewDecoder(rec.Body).Decode(&report)
+	deadline := time.Now().Add(5 * time.Second)
+	for report.Status != "completed" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/admin/upgrade-reports/"+report.ID, nil))
+		report = UpgradeReport{}
+		json.NewDecoder(rec.Body).Decode(&report)
+	}
+	if report.Status != "completed" || len(report.Jobs) != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+	r := report.Jobs[0]
+	if r.Error != "" || r.JobID != id || r.Rating != 4 || r.Environment == nil || r.Environment.Image != "processor:next" {
+		t.Fatalf("result = %+v", r)
+	}
+	if len(r.Stems) != 1 || r.Stems[0].Stem != "vocals" || r.Stems[0].ModelB != "htdemucs_ft" || len(r.MissingStems) != 1 || r.MissingStems[0] != "drums" {
+		t.Errorf("stems = %+v, missing %v", r.Stems, r.MissingStems)
+	}
+	if c := r.Stems[0].Correlation; c < 0.5 || c > 0.999 {
+		t.Errorf("correlation with a noisier re-run = %v", c)
+	}
+	if len(models) != 1 || models[0] != "htdemucs_ft" {
+		t.Errorf("candidate models = %v", models)
+	}
+	if s := report.Summary; s == nil || s.Compared != 1 || s.TimeRatio != 0.5 {
+		t.Errorf("summary = %+v", s)
+	}
+
+	// The re-run and its files are gone; the original is untouched
+	jobsMutex.RLock()
+	for _, job := range jobs {
+		if job.SelfTest {
+			t.Errorf("re-run %s is still listed", job.ID)
+		}
+	}
+	jobsMutex.RUnlock()
+	if entries, _ := os.ReadDir(outputDir); len(entries) != 1 {
+		t.Errorf("%d output directories after the report, want 1", len(entries))
+	}
+	if entries, _ := os.ReadDir(uploadDir); len(entries) != 1 {
+		t.Errorf("%d uploads after the report, want 1", len(entries))
+	}
+}
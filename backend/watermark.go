@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Watermarks, for deployments that give away previews and sell the clean
+// stems. WATERMARK marks the stems of every job, and a tier's watermark=
+// overrides it for the jobs of its keys (none turns it off):
+//
+//	WATERMARK=tone TIERS=free watermark=tone, pro watermark=inaudible, studio watermark=none
+//
+// tone mixes a short 1 kHz beep into each stem every 10 seconds, audible on
+// purpose; inaudible adds a faint 16.5 kHz carrier keyed with the first 64
+// bits of the job ID, so a leaked stem leads back to its job. The
+// processor embeds the mark before a stem is listed as ready, so extra
+// formats, mixes and packages are made from marked stems. A job without
+// the mark its tier asks for fails rather than handing out clean stems:
+// processors report the watermark they embedded, and those that don't are
+// too old. Watermarked jobs aren't batched, and inaudibly marked ones
+// never reuse other jobs' stems.
+
+// watermarkModes are the marks a processor can embed
+var watermarkModes = []string{"inaudible", "tone"}
+
+// checkWatermark validates WATERMARK
+func checkWatermark() error {
+	if mode := os.Getenv("WATERMARK"); mode != "" && mode != "none" && !slices.Contains(watermarkModes, mode) {
+		return fmt.Errorf("WATERMARK must be none, %s", strings.Join(watermarkModes, " or "))
+	}
+	return nil
+}
+
+// jobWatermark returns the mark the jobs of an API key get ("" for none):
+// its tier's, or WATERMARK
+func jobWatermark(keyID string) string {
+	mode := os.Getenv("WATERMARK")
+	if tiers := tiersFromEnv(); len(tiers) > 0 {
+		if t := tiers[keyTier(tiers, keyID)]; t.Watermark != "" {
+			mode = t.Watermark
+		}
+	}
+	if mode == "none" {
+		return ""
+	}
+	return mode
+}
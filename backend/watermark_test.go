@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJobWatermark(t *testing.T) {
+	if jobWatermark("") != "" {
+		t.Error("watermark without WATERMARK or TIERS")
+	}
+	t.Setenv("WATERMARK", "tone")
+	if got := jobWatermark(""); got != "tone" {
+		t.Errorf("WATERMARK=tone = %q", got)
+	}
+
+	t.Setenv("TIERS", "free, pro watermark=inaudible, studio watermark=none")
+	apiKeysMutex.Lock()
+	apiKeys["watermark-pro"] = &APIKey{ID: "watermark-pro", Tier: "pro"}
+	apiKeys["watermark-studio"] = &APIKey{ID: "watermark-studio", Tier: "studio"}
+	apiKeysMutex.Unlock()
+	t.Cleanup(func() {
+		apiKeysMutex.Lock()
+		delete(apiKeys, "watermark-pro")
+		delete(apiKeys, "watermark-studio")
+		apiKeysMutex.Unlock()
+	})
+	for key, want := range map[string]string{"": "tone", "watermark-pro": "inaudible", "watermark-studio": ""} {
+		if got := jobWatermark(key); got != want {
+			t.Errorf("watermark of %q = %q, want %q", key, got, want)
+		}
+	}
+
+	if _, err := parseTiers("free watermark=beep"); err == nil || !strings.Contains(err.Error(), "watermark must be") {
+		t.Errorf("unknown tier watermark = %v", err)
+	}
+	t.Setenv("WATERMARK", "loud")
+	if checkWatermark() == nil {
+		t.Error("WATERMARK=loud accepted")
+	}
+}
+
+func TestIntegrationWatermarkedJob(t *testing.T) {
+	t.Setenv("WATERMARK", "inaudible")
+	b := newIntegrationBackend(t, 1)
+	job := b.waitFor(b.upload("song.mp3", map[string]string{"watermark": "none"}).ID, "completed")
+	if job.Watermark != "inaudible" {
+		t.Errorf("watermark = %q", job.Watermark)
+	}
+	if requests := b.processor.Requests(); len(requests) != 1 || requests[0]["watermark"] != "inaudible" {
+		t.Errorf("processor requests = %v", requests)
+	}
+
+	// A processor that didn't embed the mark fails the job
+	job = b.waitFor(b.upload("legacy.mp3", nil).ID, "failed")
+	if !strings.Contains(job.Error, "doesn't support watermarks") {
+		t.Errorf("error = %q", job.Error)
+	}
+}
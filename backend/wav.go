@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+// wavHeader builds a canonical 44-byte RIFF/WAVE header for 16-bit PCM data
+func wavHeader(dataLen, sampleRate, channels int) []byte {
+	const bitsPerSample = 16
+	blockAlign := channels * bitsPerSample / 8
+
+	h := make([]byte, 44)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], uint32(36+dataLen))
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16) // fmt chunk size
+	binary.LittleEndian.PutUint16(h[20:], 1)  // PCM
+	binary.LittleEndian.PutUint16(h[22:], uint16(channels))
+	binary.LittleEndian.PutUint32(h[24:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(h[32:], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(h[34:], bitsPerSample)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], uint32(dataLen))
+	return h
+}
+
+// writeWAVFile writes interleaved 16-bit samples to path as a WAV file
+func writeWAVFile(path string, samples []int16, sampleRate, channels int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	w.Write(wavHeader(len(samples)*2, sampleRate, channels))
+	buf := make([]byte, 2)
+	for _, s := range samples {
+		binary.LittleEndian.PutUint16(buf, uint16(s))
+		w.Write(buf)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// readWAV reads a 16-bit PCM WAV file, returning its interleaved samples
+func readWAV(path string) (samples []int16, sampleRate, channels int, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, 0, 0, errors.New("not a WAV file")
+	}
+	for pos := 12; pos+8 <= len(data); {
+		id, size := string(data[pos:pos+4]), int(binary.LittleEndian.Uint32(data[pos+4:]))
+		body := data[pos+8 : min(len(data), pos+8+size)]
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, 0, 0, errors.New("truncated fmt chunk")
+			}
+			format := binary.LittleEndian.Uint16(body[0:])
+			channels = int(binary.LittleEndian.Uint16(body[2:]))
+			sampleRate = int(binary.LittleEndian.Uint32(body[4:]))
+			if bits := binary.LittleEndian.Uint16(body[14:]); (format != 1 && format != 0xFFFE) || bits != 16 {
+				return nil, 0, 0, fmt.Errorf("unsupported WAV encoding (format %d, %d bits); only 16-bit PCM is read natively", format, bits)
+			}
+		case "data":
+			if channels == 0 {
+				return nil, 0, 0, errors.New("data chunk before fmt chunk")
+			}
+			samples = make([]int16, len(body)/2)
+			for i := range samples {
+				samples[i] = int16(binary.LittleEndian.Uint16(body[2*i:]))
+			}
+			return samples, sampleRate, channels, nil
+		}
+		pos += 8 + size + size%2 // chunks are padded to an even length
+	}
+	return nil, 0, 0, errors.New("no data chunk")
+}
+
+// wavWriter streams 16-bit samples to a WAV file whose sizes are filled in
+// on Close
+type wavWriter struct {
+	f          *os.File
+	w          *bufio.Writer
+	dataLen    int
+	sampleRate int
+	channels   int
+}
+
+func createWAV(path string, sampleRate, channels int) (*wavWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &wavWriter{f: f, w: bufio.NewWriter(f), sampleRate: sampleRate, channels: channels}
+	w.w.Write(wavHeader(0, sampleRate, channels))
+	return w, nil
+}
+
+// WriteSample writes one sample in [-1, 1], clamping anything outside
+func (w *wavWriter) WriteSample(v float64) {
+	s := int16(max(-32768, min(32767, math.Round(v*32768))))
+	w.w.WriteByte(byte(s))
+	w.w.WriteByte(byte(uint16(s) >> 8))
+	w.dataLen += 2
+}
+
+func (w *wavWriter) Close() error {
+	defer w.f.Close()
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := w.f.WriteAt(wavHeader(w.dataLen, w.sampleRate, w.channels), 0); err != nil {
+		return err
+	}
+	return w.f.Close()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWavHeader(t *testing.T) {
+	h := wavHeader(1000, 44100, 2)
+	if len(h) != 44 {
+		t.Fatalf("header length = %d, want 44", len(h))
+	}
+	if string(h[0:4]) != "RIFF" || string(h[8:12]) != "WAVE" || string(h[36:40]) != "data" {
+		t.Error("missing RIFF/WAVE/data markers")
+	}
+	if got := binary.LittleEndian.Uint32(h[4:]); got != 1036 {
+		t.Errorf("RIFF size = %d, want 1036", got)
+	}
+	if got := binary.LittleEndian.Uint32(h[28:]); got != 44100*4 {
+		t.Errorf("byte rate = %d, want %d", got, 44100*4)
+	}
+	if got := binary.LittleEndian.Uint32(h[40:]); got != 1000 {
+		t.Errorf("data size = %d, want 1000", got)
+	}
+}
+
+func TestReadWAV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tone.wav")
+	w, err := createWAV(path, 22050, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []float64{0, 0.5, -0.5, 1, -2, 0.25} {
+		w.WriteSample(v)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	samples, rate, channels, err := readWAV(path)
+	if err != nil || rate != 22050 || channels != 2 {
+		t.Fatalf("readWAV = %d Hz, %d channels, %v", rate, channels, err)
+	}
+	if want := []int16{0, 16384, -16384, 32767, -32768, 8192}; !reflect.DeepEqual(samples, want) {
+		t.Errorf("samples = %v, want %v", samples, want)
+	}
+
+	os.WriteFile(path, []byte("ID3 not a wav"), 0644)
+	if _, _, _, err := readWAV(path); err == nil {
+		t.Error("expected an MP3 to be rejected")
+	}
+}
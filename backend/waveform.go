@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Waveform peaks. GET /api/jobs/{id}/waveform/{stem} decodes the stem at a
+// low sample rate and returns the peak level of ?points= equal slices of it
+// (default 800), enough to draw a waveform without fetching the audio. Once
+// the stem is hashed the response has an ETag, so redrawing an unchanged
+// stem is a 304 without decoding it again.
+
+const (
+	waveformSampleRate    = 8000
+	defaultWaveformPoints = 800
+	maxWaveformPoints     = 10000
+)
+
+// Waveform is the downsampled peak data of a stem
+type Waveform struct {
+	Stem            string    `json:"stem"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Peaks           []float64 `json:"peaks"` // 0-1, one per slice
+}
+
+// waveformPeaks returns the peak absolute amplitude of each of points
+// slices of the samples, fewer when there are fewer samples than points
+func waveformPeaks(samples []int16, points int) []float64 {
+	if len(samples) < points {
+		points = len(samples)
+	}
+	peaks := make([]float64, points)
+	for i := range peaks {
+		start, end := i*len(samples)/points, (i+1)*len(samples)/points
+		peak := 0
+		for _, s := range samples[start:end] {
+			v := int(s)
+			if v < 0 {
+				v = -v
+			}
+			peak = max(peak, v)
+		}
+		peaks[i] = math.Round(float64(peak)/32768*1000) / 1000
+	}
+	return peaks
+}
+
+// waveformHandler serves GET /api/jobs/{id}/waveform/{stem}
+func waveformHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupCompletedJob(w, r)
+	if !ok || refuseEncrypted(w, job) {
+		return
+	}
+	points := defaultWaveformPoints
+	if v := r.URL.Query().Get("points"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxWaveformPoints {
+			http.Error(w, "Invalid points value", http.StatusBadRequest)
+			return
+		}
+		points = n
+	}
+	stem := mux.Vars(r)["stem"]
+	path, exists := job.OutputFiles[stem]
+	if !exists {
+		http.Error(w, "Stem not found", http.StatusNotFound)
+		return
+	}
+	if !safeOutputPath(path) {
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
+	}
+
+	if hash := job.OutputHashes[stem]; hash != "" {
+		etag := `"` + hash + "-" + strconv.Itoa(points) + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if matchesETag(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	samples, err := decodeMonoPCM(path, waveformSampleRate)
+	if err != nil {
+		log.Printf("Waveform: failed to decode %s: %v", path, err)
+		http.Error(w, "Failed to decode stem", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, Waveform{
+		Stem:            stem,
+		DurationSeconds: float64(len(samples)) / waveformSampleRate,
+		Peaks:           waveformPeaks(samples, points),
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func TestWaveformPeaks(t *testing.T) {
+	samples := []int16{0, 16384, -32768, 100, -8192, 8192}
+	if got, want := waveformPeaks(samples, 3), []float64{0.5, 1, 0.25}; !reflect.DeepEqual(got, want) {
+		t.Errorf("waveformPeaks(3) = %v, want %v", got, want)
+	}
+	if got := waveformPeaks(samples[:2], 10); len(got) != 2 {
+		t.Errorf("more points than samples gave %d peaks", len(got))
+	}
+}
+
+func TestStemPlayback(t *testing.T) {
+	oldOutputDir := outputDir
+	outputDir = t.TempDir()
+	t.Cleanup(func() { outputDir = oldOutputDir })
+
+	id := uuid.New().String()
+	path := filepath.Join(outputDir, id, "song_t2s_bass.wav")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	os.WriteFile(path, []byte("0123456789"), 0644)
+	jobsMutex.Lock()
+	jobs[id] = &Job{ID: id, Status: "completed", OutputFiles: map[string]string{"bass": path},
+		OutputHashes: map[string]string{"bass": "abc"}}
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/download/{id}/{stem}", downloadHandler)
+	router.HandleFunc("/api/jobs/{id}/waveform/{stem}", waveformHandler)
+	get := func(url string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/api/download/"+id+"/bass?disposition=inline", map[string]string{"Range": "bytes=2-5"})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "2345" ||
+		rec.Header().Get("Content-Range") != "bytes 2-5/10" || rec.Header().Get("Content-Type") != "audio/wav" {
+		t.Errorf("range request = %d %q %v", rec.Code, rec.Body, rec.Header())
+	}
+	if got := rec.Header().Get("Content-Disposition"); got != `inline; filename="song_t2s_bass.wav"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	if rec := get("/api/download/"+id+"/bass", map[string]string{"If-None-Match": `"abc"`}); rec.Code != http.StatusNotModified {
+		t.Errorf("revalidation = %d, want 304", rec.Code)
+	}
+	if rec := get("/api/download/"+id+"/bass?disposition=sideways", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad disposition = %d, want 400", rec.Code)
+	}
+
+	if rec := get("/api/jobs/"+id+"/waveform/bass?points=100", map[string]string{"If-None-Match": `"abc-100"`}); rec.Code != http.StatusNotModified {
+		t.Errorf("waveform revalidation = %d, want 304", rec.Code)
+	}
+	for url, want := range map[string]int{
+		"/api/jobs/" + id + "/waveform/bass?points=0": http.StatusBadRequest,
+		"/api/jobs/" + id + "/waveform/drums":         http.StatusNotFound,
+	} {
+		if rec := get(url, nil); rec.Code != want {
+			t.Errorf("GET %s = %d, want %d", url, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Webhook is a persistent subscription to job lifecycle events. Each
+// delivery is signed with HMAC-SHA256 over the body using the secret and
+// sent in the X-Track2stem-Signature header as "sha256=<hex>". A webhook
+// created with an API key belongs to that key and only receives the events
+// of its jobs, and those of jobs it is invited to (see invitations.go).
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"` // event types, or "*" for all
+	Secret    string    `json:"secret,omitempty"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+
+	apiKeyID string // key that created the webhook
+}
+
+// WebhookDelivery records one event sent (or being sent) to a webhook
+type WebhookDelivery struct {
+	ID           string     `json:"id"`
+	WebhookID    string     `json:"webhook_id,omitempty"` // empty for job callbacks
+	EventID      string     `json:"event_id"`
+	EventType    string     `json:"event_type"`
+	Status       string     `json:"status"` // pending, succeeded, failed
+	Attempts     int        `json:"attempts"`
+	ResponseCode int        `json:"response_code,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	Redelivery   bool       `json:"redelivery,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	DeliveredAt  *time.Time `json:"delivered_at,omitempty"`
+
+	payload []byte
+	target  string // URL and secret of a job callback, which has no webhook
+	secret  string
+}
+
+// webhookRequest is the JSON body of POST/PATCH /api/webhooks
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+	Active *bool    `json:"active"`
+}
+
+const (
+	webhookMaxAttempts = 3
+	webhookHistorySize = 100
+	maxWebhooks        = 100
+)
+
+var (
+	webhooks          = make(map[string]*Webhook)
+	webhookDeliveries = make(map[string][]*WebhookDelivery) // keyed by webhook ID, oldest first
+	webhooksMutex     = &sync.RWMutex{}
+	webhookClient     = newOutboundClient(10 * time.Second)
+	// webhookRetryBase is doubled after every failed attempt
+	webhookRetryBase = 5 * time.Second
+)
+
+// validateWebhookEvents checks that every requested event type is known
+func validateWebhookEvents(events []string) error {
+	if len(events) == 0 {
+		return fmt.Errorf("Invalid events value")
+	}
+	for _, e := range events {
+		if e != "*" && !eventTypes[e] {
+			return fmt.Errorf("Invalid events value: %s", e)
+		}
+	}
+	return nil
+}
+
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid url value")
+	}
+	if err := checkOutboundURL(u); err != nil {
+		return fmt.Errorf("Invalid url value: %v", err)
+	}
+	return nil
+}
+
+// subscribes reports whether the webhook wants events of this type
+func (h *Webhook) subscribes(eventType string) bool {
+	for _, e := range h.Events {
+		if e == "*" || e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// receives reports whether the webhook may be sent the events of a job of
+// the given key: only its own key's when it belongs to one
+func (h *Webhook) receives(jobKeyID string) bool {
+	return h.apiKeyID == "" || jobKeyID == h.apiKeyID
+}
+
+// redacted returns a copy without the signing secret
+func (h *Webhook) redacted() Webhook {
+	c := *h
+	c.Secret = ""
+	c.Events = append([]string(nil), h.Events...)
+	return c
+}
+
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// dispatchWebhooks is the event listener that fans events out to webhooks
+func dispatchWebhooks(e Event) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to encode event %s: %v", e.ID, err)
+		return
+	}
+
+	webhooksMutex.Lock()
+	var queued []*WebhookDelivery
+	for _, h := range webhooks {
+		if !h.Active || !h.subscribes(e.Type) || !h.receives(e.Job.APIKeyID) && !h.receives(e.Invitee) {
+			continue
+		}
+		d := &WebhookDelivery{
+			ID:        uuid.New().String(),
+			WebhookID: h.ID,
+			EventID:   e.ID,
+			EventType: e.Type,
+			Status:    "pending",
+			CreatedAt: time.Now().UTC(),
+			payload:   payload,
+		}
+		recordWebhookDelivery(d)
+		queued = append(queued, d)
+	}
+	webhooksMutex.Unlock()
+
+	for _, d := range queued {
+		go sendWebhook(d)
+	}
+}
+
+// recordWebhookDelivery appends to the webhook's bounded history; callers
+// hold webhooksMutex
+func recordWebhookDelivery(d *WebhookDelivery) {
+	history := append(webhookDeliveries[d.WebhookID], d)
+	if len(history) > webhookHistorySize {
+		history = history[len(history)-webhookHistorySize:]
+	}
+	webhookDeliveries[d.WebhookID] = history
+}
+
+// sendWebhook makes one delivery attempt and schedules retries with
+// exponential backoff on failure
+func sendWebhook(d *WebhookDelivery) {
+	webhooksMutex.Lock()
+	target, secret := d.target, d.secret
+	if d.WebhookID != "" {
+		h, exists := webhooks[d.WebhookID]
+		if !exists {
+			webhooksMutex.Unlock()
+			return
+		}
+		target, secret = h.URL, h.Secret
+	}
+	d.Attempts++
+	attempt := d.Attempts
+	webhooksMutex.Unlock()
+
+	code, err := postWebhook(target, secret, d)
+
+	webhooksMutex.Lock()
+	defer webhooksMutex.Unlock()
+	d.ResponseCode = code
+	if err == nil {
+		now := time.Now().UTC()
+		d.Status = "succeeded"
+		d.Error = ""
+		d.DeliveredAt = &now
+		return
+	}
+	d.Error = err.Error()
+	if attempt >= webhookMaxAttempts {
+		d.Status = "failed"
+		log.Printf("Webhook %s delivery %s failed after %d attempts: %v", target, d.ID, attempt, err)
+		return
+	}
+	time.AfterFunc(webhookRetryBase<<(attempt-1), func() { sendWebhook(d) })
+}
+
+// postWebhook sends the payload, signed when there is a secret, and treats
+// any 2xx as success
+func postWebhook(target, secret string, d *WebhookDelivery) (int, error) {
+	if chaosDropCallback() {
+		return 0, errInjected
+	}
+	req, err := http.NewRequest("POST", target, bytes.NewReader(d.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "track2stem-webhook")
+	req.Header.Set("X-Track2stem-Event", d.EventType)
+	req.Header.Set("X-Track2stem-Delivery", d.ID)
+	req.Header.Set("X-Track2stem-Schema-Version", strconv.Itoa(eventSchemaVersion))
+	if secret != "" {
+		req.Header.Set("X-Track2stem-Signature", signWebhookPayload(secret, d.payload))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid webhook", http.StatusBadRequest)
+		return
+	}
+	if err := validateWebhookURL(req.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateWebhookEvents(req.Events); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Secret == "" {
+		req.Secret = randomToken(32)
+	}
+	h := &Webhook{
+		ID:        uuid.New().String(),
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    req.Secret,
+		Active:    req.Active == nil || *req.Active,
+		CreatedAt: time.Now().UTC(),
+		apiKeyID:  apiKeyID(r.Context()),
+	}
+
+	webhooksMutex.Lock()
+	if len(webhooks) >= maxWebhooks {
+		webhooksMutex.Unlock()
+		http.Error(w, "Too many webhooks", http.StatusConflict)
+		return
+	}
+	webhooks[h.ID] = h
+	created := *h
+	webhooksMutex.Unlock()
+
+	// The secret is only returned once, on creation
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	webhooksMutex.RLock()
+	list := make([]Webhook, 0, len(webhooks))
+	for _, h := range webhooks {
+		if ownedByRequest(r, h.apiKeyID) {
+			list = append(list, h.redacted())
+		}
+	}
+	webhooksMutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	writeJSON(w, http.StatusOK, list)
+}
+
+// lookupWebhook returns the {id} webhook, writing a 404 when it doesn't exist
+// or belongs to another key; callers hold webhooksMutex
+func lookupWebhook(w http.ResponseWriter, r *http.Request) (*Webhook, bool) {
+	h, exists := webhooks[mux.Vars(r)["id"]]
+	if !exists || !ownedByRequest(r, h.apiKeyID) {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return nil, false
+	}
+	return h, true
+}
+
+func getWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhooksMutex.RLock()
+	defer webhooksMutex.RUnlock()
+	if h, ok := lookupWebhook(w, r); ok {
+		writeJSON(w, http.StatusOK, h.redacted())
+	}
+}
+
+// updateWebhookHandler changes the URL, events, secret or active flag
+func updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid webhook", http.StatusBadRequest)
+		return
+	}
+	if req.URL != "" {
+		if err := validateWebhookURL(req.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Events != nil {
+		if err := validateWebhookEvents(req.Events); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	webhooksMutex.Lock()
+	defer webhooksMutex.Unlock()
+	h, ok := lookupWebhook(w, r)
+	if !ok {
+		return
+	}
+	if req.URL != "" {
+		h.URL = req.URL
+	}
+	if req.Events != nil {
+		h.Events = req.Events
+	}
+	if req.Secret != "" {
+		h.Secret = req.Secret
+	}
+	if req.Active != nil {
+		h.Active = *req.Active
+	}
+	writeJSON(w, http.StatusOK, h.redacted())
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhooksMutex.Lock()
+	defer webhooksMutex.Unlock()
+	h, ok := lookupWebhook(w, r)
+	if !ok {
+		return
+	}
+	delete(webhooks, h.ID)
+	delete(webhookDeliveries, h.ID)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+// listWebhookDeliveriesHandler returns the delivery history, newest first
+func listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	webhooksMutex.RLock()
+	defer webhooksMutex.RUnlock()
+	h, ok := lookupWebhook(w, r)
+	if !ok {
+		return
+	}
+	history := webhookDeliveries[h.ID]
+	list := make([]WebhookDelivery, 0, len(history))
+	for i := len(history) - 1; i >= 0; i-- {
+		list = append(list, *history[i])
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// redeliverWebhookHandler sends a past delivery's payload again as a new delivery
+func redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhooksMutex.Lock()
+	h, ok := lookupWebhook(w, r)
+	if !ok {
+		webhooksMutex.Unlock()
+		return
+	}
+	var original *WebhookDelivery
+	for _, d := range webhookDeliveries[h.ID] {
+		if d.ID == mux.Vars(r)["delivery"] {
+			original = d
+		}
+	}
+	if original == nil {
+		webhooksMutex.Unlock()
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	d := &WebhookDelivery{
+		ID:         uuid.New().String(),
+		WebhookID:  h.ID,
+		EventID:    original.EventID,
+		EventType:  original.EventType,
+		Status:     "pending",
+		Redelivery: true,
+		CreatedAt:  time.Now().UTC(),
+		payload:    original.payload,
+	}
+	recordWebhookDelivery(d)
+	queued := *d
+	webhooksMutex.Unlock()
+
+	go sendWebhook(d)
+	writeJSON(w, http.StatusAccepted, queued)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func webhookRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/webhooks", createWebhookHandler).Methods("POST")
+	router.HandleFunc("/api/webhooks/{id}", updateWebhookHandler).Methods("PATCH")
+	router.HandleFunc("/api/webhooks/{id}/deliveries", listWebhookDeliveriesHandler).Methods("GET")
+	router.HandleFunc("/api/webhooks/{id}/deliveries/{delivery}/redeliver", redeliverWebhookHandler).Methods("POST")
+	return router
+}
+
+func TestWebhookSignedDeliveryAndRedelivery(t *testing.T) {
+	t.Setenv("OUTBOUND_ALLOW_PRIVATE", "true") // the test endpoint listens on loopback
+	received := make(chan *http.Request, 4)
+	bodies := make(chan []byte, 4)
+	var fail atomic.Bool
+	fail.Store(true)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer endpoint.Close()
+	webhookRetryBase = time.Hour // keep the failed delivery from retrying during the test
+	t.Cleanup(func() { webhookRetryBase = 5 * time.Second })
+
+	router := webhookRouter()
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", "/api/webhooks",
+		strings.NewReader(`{"url":"`+endpoint.URL+`","events":["job.completed"],"secret":"s3cret"}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d: %s", rec.Code, rec.Body.String())
+	}
+	var hook Webhook
+	json.Unmarshal(rec.Body.Bytes(), &hook)
+	t.Cleanup(func() {
+		webhooksMutex.Lock()
+		delete(webhooks, hook.ID)
+		delete(webhookDeliveries, hook.ID)
+		webhooksMutex.Unlock()
+	})
+
+	dispatchWebhooks(Event{ID: "e1", Type: EventJobCreated})
+	dispatchWebhooks(Event{ID: "e2", Type: EventJobCompleted, Job: Job{ID: "job-1"}})
+
+	r, body := <-received, <-bodies
+	if got := r.Header.Get("X-Track2stem-Event"); got != EventJobCompleted {
+		t.Fatalf("event header = %q, want only the subscribed event", got)
+	}
+	if got, want := r.Header.Get("X-Track2stem-Signature"), signWebhookPayload("s3cret", body); got != want {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+	if got := r.Header.Get("X-Track2stem-Schema-Version"); got != "1" {
+		t.Errorf("schema version header = %q", got)
+	}
+
+	var history []WebhookDelivery
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/webhooks/"+hook.ID+"/deliveries", nil))
+		json.Unmarshal(rec.Body.Bytes(), &history)
+		if len(history) == 1 && history[0].ResponseCode == http.StatusInternalServerError || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(history) != 1 || history[0].Status != "pending" || history[0].Attempts != 1 || history[0].ResponseCode != 500 {
+		t.Fatalf("history = %+v, want one pending delivery with a 500", history)
+	}
+
+	fail.Store(false)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", "/api/webhooks/"+hook.ID+"/deliveries/"+history[0].ID+"/redeliver", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("redeliver = %d: %s", rec.Code, rec.Body.String())
+	}
+	r = <-received
+	if r.Header.Get("X-Track2stem-Delivery") == history[0].ID {
+		t.Error("redelivery reused the original delivery ID")
+	}
+	if <-bodies == nil {
+		t.Error("redelivery sent an empty payload")
+	}
+}
+
+func TestWebhooksScopedByKey(t *testing.T) {
+	t.Setenv("OUTBOUND_ALLOW_PRIVATE", "true")
+	received := make(chan string, 4)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("X-Track2stem-Event")
+	}))
+	defer endpoint.Close()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/webhooks", createWebhookHandler).Methods("POST")
+	router.HandleFunc("/api/webhooks", listWebhooksHandler).Methods("GET")
+	router.HandleFunc("/api/webhooks/{id}", getWebhookHandler).Methods("GET")
+	as := func(key, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, key))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var hook Webhook
+	json.Unmarshal(as("alice", "POST", "/api/webhooks", `{"url":"`+endpoint.URL+`","events":["*"]}`).Body.Bytes(), &hook)
+	t.Cleanup(func() {
+		webhooksMutex.Lock()
+		delete(webhooks, hook.ID)
+		delete(webhookDeliveries, hook.ID)
+		webhooksMutex.Unlock()
+	})
+	if rec := as("bob", "GET", "/api/webhooks/"+hook.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("bob reading alice's webhook = %d", rec.Code)
+	}
+	var list []Webhook
+	json.Unmarshal(as("bob", "GET", "/api/webhooks", "").Body.Bytes(), &list)
+	if len(list) != 0 {
+		t.Errorf("bob listed %+v", list)
+	}
+
+	// Only alice's jobs are delivered to alice's webhook
+	dispatchWebhooks(Event{ID: "e1", Type: EventJobCreated, Job: Job{ID: "job-bob", APIKeyID: "bob"}})
+	dispatchWebhooks(Event{ID: "e2", Type: EventJobCompleted, Job: Job{ID: "job-alice", APIKeyID: "alice"}})
+	if got := <-received; got != EventJobCompleted {
+		t.Errorf("delivered %s, want only alice's job.completed", got)
+	}
+}
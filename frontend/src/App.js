@@ -3,6 +3,9 @@ import axios from 'axios';
 import './App.css';
 import Spectrogram from './Spectrogram';
 
+// Statuses of a job that is still waiting for or undergoing processing
+const ACTIVE_STATUSES = ['pending', 'queued', 'processing'];
+
 // LocalStorage keys
 const STORAGE_KEYS = {
   JOBS: 'track2stem_jobs',
@@ -10,6 +13,26 @@ const STORAGE_KEYS = {
   START_TIME: 'track2stem_start_time',
   PROCESSING_PROGRESS: 'track2stem_progress',
   INPUT_FILE_NAME: 'track2stem_input_filename',
+  TERMS_ACCEPTANCE: 'track2stem_terms_acceptance',
+  API_KEY: 'track2stem_api_key',
+};
+
+// Shown until /api/branding answers, and when it can't be reached
+const DEFAULT_BRANDING = {
+  name: 'Track2stem',
+  tagline: 'Turn any track into multi-stem',
+  logo_url: '',
+  links: {},
+  limits: { max_upload_bytes: 100 * 1024 * 1024 },
+};
+
+const LINK_LABELS = { terms: 'Terms', privacy: 'Privacy', imprint: 'Imprint', support: 'Support' };
+
+// Renders a JSON upload rejection with the backend's remediation hint, so
+// the web app gives the same advice as the CLI
+const rejectionMessage = (data) => {
+  const hint = data.remediation?.hint;
+  return hint ? `${data.error}. ${hint}.` : data.error;
 };
 
 function App() {
@@ -25,9 +48,16 @@ function App() {
   const [elapsedTime, setElapsedTime] = useState(0); // elapsed seconds
   const [isInitialized, setIsInitialized] = useState(false); // Track if localStorage has been loaded
   const [showAdvanced, setShowAdvanced] = useState(false); // Toggle advanced options
+  const [branding, setBranding] = useState(DEFAULT_BRANDING);
+  const [terms, setTerms] = useState({ required: false });
+  const [termsChecked, setTermsChecked] = useState(false);
+  const [apiKey, setApiKey] = useState(() => localStorage.getItem(STORAGE_KEYS.API_KEY) || '');
+  const [keyRequired, setKeyRequired] = useState(false); // the backend answered 401
 
   // Advanced options
   const [outputFormat, setOutputFormat] = useState('mp3');
+  const [mp3Bitrate, setMp3Bitrate] = useState('320');
+  const [alsoMp3, setAlsoMp3] = useState(false);
   const [model, setModel] = useState('htdemucs_6s');
   const [segment, setSegment] = useState('');
   const [overlap, setOverlap] = useState('0.25');
@@ -42,6 +72,12 @@ function App() {
   // Models that produce 6 stems (guitar + piano)
   const SIX_STEM_MODELS = ['htdemucs_6s'];
   const isSixStemModel = SIX_STEM_MODELS.includes(model);
+  // Transformer models only run with the segment length they were trained on
+  const TRANSFORMER_MODELS = ['htdemucs', 'htdemucs_ft', 'htdemucs_6s'];
+  const isTransformerModel = TRANSFORMER_MODELS.includes(model);
+  // Models an admin registered on the backend, offered after the built-in ones
+  const BUILTIN_MODELS = ['htdemucs_6s', 'htdemucs', 'htdemucs_ft', 'hdemucs_mmi', 'mdx', 'mdx_extra', 'mdx_q', 'mdx_extra_q'];
+  const customModels = (branding.limits.models || []).filter((m) => !BUILTIN_MODELS.includes(m));
 
   // Format elapsed time as Xm Ys
   const formatElapsedTime = (seconds) => {
@@ -93,6 +129,76 @@ function App() {
     setIsInitialized(true);
   }, []);
 
+  // Send the API key with every request, and ask for one when the backend
+  // requires it
+  useEffect(() => {
+    const request = axios.interceptors.request.use((config) => {
+      if (apiKey) {
+        config.headers['X-API-Key'] = apiKey;
+      }
+      return config;
+    });
+    const response = axios.interceptors.response.use(undefined, (err) => {
+      if (err.response && err.response.status === 401) {
+        setKeyRequired(true);
+      }
+      return Promise.reject(err);
+    });
+    return () => {
+      axios.interceptors.request.eject(request);
+      axios.interceptors.response.eject(response);
+    };
+  }, [apiKey]);
+
+  const handleApiKeyChange = (value) => {
+    setApiKey(value);
+    if (value) {
+      localStorage.setItem(STORAGE_KEYS.API_KEY, value);
+    } else {
+      localStorage.removeItem(STORAGE_KEYS.API_KEY);
+    }
+  };
+
+  // Links the browser opens itself can't carry the header
+  const withApiKey = (url) => (apiKey ? `${url}${url.includes('?') ? '&' : '?'}api_key=${encodeURIComponent(apiKey)}` : url);
+
+  // Load instance branding and limits configured on the backend
+  useEffect(() => {
+    axios.get(`${API_BASE}/branding`)
+      .then((response) => {
+        const data = response.data;
+        if (data && typeof data === 'object' && !Array.isArray(data) && data.name) {
+          setBranding({ ...DEFAULT_BRANDING, ...data, limits: { ...DEFAULT_BRANDING.limits, ...data.limits } });
+          document.title = data.name;
+        }
+      })
+      .catch(() => {});
+  }, [API_BASE]);
+
+  // Load the terms of service uploads must accept, if the instance has any
+  useEffect(() => {
+    axios.get(`${API_BASE}/terms`)
+      .then((response) => {
+        if (response.data && response.data.required) {
+          setTerms(response.data);
+        }
+      })
+      .catch(() => {});
+  }, [API_BASE]);
+
+  // The stored acceptance ID if it is for the current terms version
+  const storedAcceptance = () => {
+    try {
+      const saved = JSON.parse(localStorage.getItem(STORAGE_KEYS.TERMS_ACCEPTANCE));
+      return saved && saved.version === terms.version ? saved.id : null;
+    } catch (e) {
+      return null;
+    }
+  };
+  const needsTerms = terms.required && !storedAcceptance();
+
+  const maxUploadMB = Math.round(branding.limits.max_upload_bytes / (1024 * 1024));
+
   // Save jobs to localStorage whenever they change
   useEffect(() => {
     if (jobs.length > 0) {
@@ -112,7 +218,7 @@ function App() {
     const doFetchJobs = async () => {
       try {
         const response = await axios.get(`${API_BASE}/jobs`);
-        const serverJobs = response.data || [];
+        const serverJobs = response.data?.jobs || [];
         
         // Merge server jobs with localStorage jobs (localStorage takes precedence for completed jobs)
         const savedJobsStr = localStorage.getItem(STORAGE_KEYS.JOBS);
@@ -149,7 +255,7 @@ function App() {
 
   // Stopwatch effect - runs every second when processing
   useEffect(() => {
-    if (currentJob && (currentJob.status === 'pending' || currentJob.status === 'processing')) {
+    if (currentJob && ACTIVE_STATUSES.includes(currentJob.status)) {
       // Start the timer if not already started
       if (!startTimeRef.current) {
         startTimeRef.current = Date.now();
@@ -201,8 +307,10 @@ function App() {
         });
         setProcessingProgress({ progress: 100, stage: 'Done!' });
       }
+      return updatedJob;
     } catch (err) {
       console.error('Failed to fetch job status:', err);
+      return null;
     }
   }, [API_BASE]);
 
@@ -219,34 +327,74 @@ function App() {
     }
   }, [API_BASE]);
 
+  // Follow the active job over server-sent events, polling when they're unavailable
+  const activeJobId = currentJob && ACTIVE_STATUSES.includes(currentJob.status) ? currentJob.id : null;
   useEffect(() => {
-    if (currentJob && (currentJob.status === 'pending' || currentJob.status === 'processing')) {
-      const interval = setInterval(() => {
-        fetchJobStatus(currentJob.id);
-        fetchProcessingProgress(currentJob.id);
-      }, 2000);
-      return () => clearInterval(interval);
+    if (!activeJobId) {
+      // Don't reset progress here - it causes the 90% issue
+      return undefined;
+    }
+    let interval = null;
+    let source = null;
+    let stopped = false;
+    // Wait as long as the backend suggests, longer when it is busy
+    const poll = (delay = 2000) => {
+      interval = setTimeout(async () => {
+        fetchProcessingProgress(activeJobId);
+        const job = await fetchJobStatus(activeJobId);
+        if (!stopped) poll(job?.poll_interval_ms || 2000);
+      }, delay);
+    };
+    if (typeof window.EventSource === 'function') {
+      let lastState = null;
+      source = new window.EventSource(`${API_BASE}/jobs/${activeJobId}/events${apiKey ? `?api_key=${encodeURIComponent(apiKey)}` : ''}`);
+      source.addEventListener('progress', (e) => {
+        const update = JSON.parse(e.data);
+        if (update.status === 'processing' && update.progress > 0) {
+          setProcessingProgress(update);
+          localStorage.setItem(STORAGE_KEYS.PROCESSING_PROGRESS, JSON.stringify(update));
+        }
+        const state = `${update.status}:${update.queue_position || 0}`;
+        if (state !== lastState) {
+          lastState = state;
+          fetchJobStatus(activeJobId);
+        }
+        if (!ACTIVE_STATUSES.includes(update.status)) {
+          source.close();
+        }
+      });
+      source.onerror = () => {
+        if (source.readyState === window.EventSource.CLOSED || lastState === null) {
+          source.close();
+          if (!interval) poll();
+        }
+      };
+    } else {
+      poll();
     }
-    // Don't reset progress here - it causes the 90% issue
-  }, [currentJob, fetchJobStatus, fetchProcessingProgress]);
+    return () => {
+      stopped = true;
+      if (source) source.close();
+      if (interval) clearTimeout(interval);
+    };
+  }, [API_BASE, activeJobId, apiKey, fetchJobStatus, fetchProcessingProgress]);
 
   const handleFileChange = (e) => {
     const selectedFile = e.target.files[0];
     if (selectedFile) {
-      const validTypes = ['audio/mpeg', 'audio/wav', 'audio/flac', 'audio/ogg', 'audio/m4a', 'audio/aac'];
-      const validExtensions = ['mp3', 'wav', 'flac', 'ogg', 'm4a', 'aac'];
+      const validTypes = ['audio/mpeg', 'audio/wav', 'audio/flac', 'audio/ogg', 'audio/m4a', 'audio/aac', 'audio/webm'];
+      const validExtensions = ['mp3', 'wav', 'flac', 'ogg', 'm4a', 'aac', 'webm'];
       const extension = selectedFile.name.split('.').pop().toLowerCase();
       
       if (!validTypes.includes(selectedFile.type) && !validExtensions.includes(extension)) {
-        setError('Please select a valid audio file (mp3, wav, flac, ogg, m4a, aac)');
+        setError('Please select a valid audio file (mp3, wav, flac, ogg, m4a, aac, webm)');
         setFile(null);
         return;
       }
 
-      const MAX_FILE_SIZE = 100 * 1024 * 1024; // 100 MB
-      if (selectedFile.size > MAX_FILE_SIZE) {
+      if (selectedFile.size > branding.limits.max_upload_bytes) {
         const sizeMB = (selectedFile.size / (1024 * 1024)).toFixed(1);
-        setError(`File is too large (${sizeMB} MB). Maximum allowed size is 100 MB.`);
+        setError(`File is too large (${sizeMB} MB). Maximum allowed size is ${maxUploadMB} MB.`);
         setFile(null);
         return;
       }
@@ -265,12 +413,20 @@ function App() {
     const formData = new FormData();
     formData.append('file', file);
     formData.append('stem_mode', stemMode);
-    formData.append('isolate_stem', isolateStem);
+    if (stemMode === 'isolate') {
+      formData.append('isolate_stem', isolateStem);
+    }
     formData.append('output_format', outputFormat);
+    if (outputFormat !== 'mp3' && alsoMp3) {
+      formData.append('extra_formats', 'mp3');
+    }
+    if (outputFormat === 'mp3' || alsoMp3) {
+      formData.append('mp3_bitrate', mp3Bitrate);
+    }
     formData.append('model', model);
     formData.append('shifts', shifts);
     formData.append('clip_mode', clipMode);
-    if (segment) {
+    if (segment && !isTransformerModel) {
       formData.append('segment', segment);
     }
     if (overlap) {
@@ -294,10 +450,18 @@ function App() {
     localStorage.setItem(STORAGE_KEYS.PROCESSING_PROGRESS, JSON.stringify({ progress: 0, stage: 'Starting...' }));
 
     try {
+      const headers = { 'Content-Type': 'multipart/form-data' };
+      if (terms.required) {
+        let acceptance = storedAcceptance();
+        if (!acceptance) {
+          const accepted = await axios.post(`${API_BASE}/terms/accept`, { version: terms.version });
+          acceptance = accepted.data.id;
+          localStorage.setItem(STORAGE_KEYS.TERMS_ACCEPTANCE, JSON.stringify({ id: acceptance, version: terms.version }));
+        }
+        headers['X-Track2stem-Terms'] = acceptance;
+      }
       const response = await axios.post(`${API_BASE}/upload`, formData, {
-        headers: {
-          'Content-Type': 'multipart/form-data',
-        },
+        headers,
         onUploadProgress: (progressEvent) => {
           const percentCompleted = Math.round((progressEvent.loaded * 100) / progressEvent.total);
           setUploadProgress(percentCompleted);
@@ -314,11 +478,23 @@ function App() {
       const data = err.response?.data;
       let message;
 
-      if (status === 413) {
-        message = 'File is too large. Maximum allowed size is 100 MB.';
+      if (data?.code?.startsWith('terms_')) {
+        // The terms changed or the acceptance was lost: ask again
+        localStorage.removeItem(STORAGE_KEYS.TERMS_ACCEPTANCE);
+        setTermsChecked(false);
+        if (data?.version) {
+          setTerms((prev) => ({ ...prev, required: true, version: data.version }));
+        }
+        message = 'Please accept the terms of service, then upload again.';
+      } else if (data?.error && data?.code) {
+        message = rejectionMessage(data);
+      } else if (status === 413) {
+        message = `File is too large. Maximum allowed size is ${maxUploadMB} MB.`;
+      } else if (status === 507) {
+        message = 'The server is out of storage space. Please try again later.';
       } else if (typeof data === 'string' && data.includes('<html')) {
         // Server returned an HTML error page — show a generic message
-        message = 'The server rejected the request. The file may be too large (max 100 MB).';
+        message = `The server rejected the request. The file may be too large (max ${maxUploadMB} MB).`;
       } else {
         message = data || err.message;
       }
@@ -329,8 +505,8 @@ function App() {
     }
   };
 
-  const handleDownload = (jobId, stem) => {
-    window.open(`${API_BASE}/download/${jobId}/${stem}`, '_blank');
+  const handleDownload = (job, stem) => {
+    window.open(getDownloadUrl(job, stem), '_blank');
   };
 
   const handleDeleteJob = async (jobId) => {
@@ -338,7 +514,7 @@ function App() {
     const jobToDelete = jobs.find(j => j.id === jobId) || (currentJob?.id === jobId ? currentJob : null);
     
     // If job is in progress, try to cancel it on the server
-    if (jobToDelete && (jobToDelete.status === 'pending' || jobToDelete.status === 'processing')) {
+    if (jobToDelete && ACTIVE_STATUSES.includes(jobToDelete.status)) {
       try {
         await axios.delete(`${API_BASE}/jobs/${jobId}`);
       } catch (err) {
@@ -385,15 +561,21 @@ function App() {
     return new Date(dateString).toLocaleString();
   };
 
-  const getDownloadUrl = (jobId, stem) => {
-    return `${API_BASE}/download/${jobId}/${stem}`;
+  // Hashed URLs are served as immutable, so unchanged stems come from the cache
+  const getDownloadUrl = (job, stem, disposition) => {
+    const hash = job.output_hashes?.[stem];
+    const path = hash ? `${job.id}/${stem}/${hash}` : `${job.id}/${stem}`;
+    const query = disposition ? `?disposition=${disposition}` : '';
+    return withApiKey(`${API_BASE}/download/${path}${query}`);
   };
 
   return (
     <div className="App">
       <header className="App-header">
-        <h1>🎵 Track2stem</h1>
-        <p>Turn any track into multi-stem</p>
+        <h1>
+          {branding.logo_url ? <img className="App-logo" src={branding.logo_url} alt="" /> : '🎵'} {branding.name}
+        </h1>
+        <p>{branding.tagline}</p>
       </header>
 
       <main className="App-main">
@@ -403,7 +585,7 @@ function App() {
             <input
               id="file-input"
               type="file"
-              accept=".mp3,.wav,.flac,.ogg,.m4a,.aac,audio/*"
+              accept=".mp3,.wav,.flac,.ogg,.m4a,.aac,.webm,audio/*"
               onChange={handleFileChange}
               disabled={uploading}
             />
@@ -487,6 +669,39 @@ function App() {
                   </div>
                 </fieldset>
 
+                {outputFormat !== 'mp3' && (
+                  <div className="setting-group">
+                    <label className="setting-label" htmlFor="also-mp3">
+                      <input
+                        id="also-mp3"
+                        type="checkbox"
+                        checked={alsoMp3}
+                        onChange={(e) => setAlsoMp3(e.target.checked)}
+                        disabled={uploading}
+                      />
+                      {' '}Also MP3 copies
+                    </label>
+                  </div>
+                )}
+
+                {(outputFormat === 'mp3' || alsoMp3) && (
+                  <div className="setting-group">
+                    <label className="setting-label" htmlFor="bitrate-select">MP3 Bitrate</label>
+                    <select
+                      id="bitrate-select"
+                      value={mp3Bitrate}
+                      onChange={(e) => setMp3Bitrate(e.target.value)}
+                      disabled={uploading}
+                      className="setting-select"
+                    >
+                      <option value="128">128 kbps</option>
+                      <option value="192">192 kbps</option>
+                      <option value="256">256 kbps</option>
+                      <option value="320">320 kbps (best)</option>
+                    </select>
+                  </div>
+                )}
+
                 <div className="setting-group">
                   <label className="setting-label" htmlFor="model-select">AI Model</label>
                   <select
@@ -504,6 +719,11 @@ function App() {
                     <option value="mdx_extra">mdx_extra — MDX with extra training data</option>
                     <option value="mdx_q">mdx_q — MDX quantized (smaller)</option>
                     <option value="mdx_extra_q">mdx_extra_q — MDX extra quantized</option>
+                    {customModels.map((m) => (
+                      <option key={m} value={m}>
+                        {m} — custom ({(branding.limits.model_stems?.[m] || []).join(', ')})
+                      </option>
+                    ))}
                   </select>
                 </div>
               </div>
@@ -524,10 +744,11 @@ function App() {
                       <label className="setting-label" htmlFor="segment-select">Segment Size</label>
                       <select
                         id="segment-select"
-                        value={segment}
+                        value={isTransformerModel ? '' : segment}
                         onChange={(e) => setSegment(e.target.value)}
-                        disabled={uploading}
+                        disabled={uploading || isTransformerModel}
                         className="setting-select"
+                        title={isTransformerModel ? 'Transformer models use a fixed segment length' : undefined}
                       >
                         <option value="">Default</option>
                         <option value="8">8 s (low memory)</option>
@@ -597,9 +818,38 @@ function App() {
               )}
             </div>
             
+            {keyRequired && (
+              <div className="setting-group api-key-input">
+                <label className="setting-label" htmlFor="api-key">API Key</label>
+                <input
+                  id="api-key"
+                  type="password"
+                  value={apiKey}
+                  onChange={(e) => handleApiKeyChange(e.target.value.trim())}
+                  placeholder="t2s_..."
+                  autoComplete="off"
+                  className="setting-select"
+                />
+              </div>
+            )}
+
+            {needsTerms && (
+              <label className="terms-acceptance">
+                <input
+                  type="checkbox"
+                  checked={termsChecked}
+                  onChange={(e) => setTermsChecked(e.target.checked)}
+                />
+                <span>
+                  {terms.notice || 'I confirm I have the rights to process this audio and accept the terms of service.'}
+                  {terms.url && <> <a href={terms.url} target="_blank" rel="noopener noreferrer">Read the terms</a></>}
+                </span>
+              </label>
+            )}
+
             <button
               onClick={handleUpload}
-              disabled={!file || uploading}
+              disabled={!file || uploading || (needsTerms && !termsChecked)}
               className="upload-button"
             >
               {uploading ? `Uploading... ${uploadProgress}%` : 'Upload & Process'}
@@ -633,7 +883,7 @@ function App() {
               <p className="job-id">Job ID: {currentJob.id}</p>
               <p className="job-date">Created: {formatDate(currentJob.created_at)}</p>
               
-              {(currentJob.status === 'processing' || currentJob.status === 'pending') && (
+              {ACTIVE_STATUSES.includes(currentJob.status) && (
                 <div className="processing-indicator">
                   <div className="progress-container large">
                     <div 
@@ -642,22 +892,43 @@ function App() {
                     ></div>
                   </div>
                   <p className="progress-text">
-                    {processingProgress.stage || 'Starting processing...'}
+                    {currentJob.status === 'queued'
+                      ? `Waiting in queue${currentJob.queue_position ? ` (position ${currentJob.queue_position})` : ''}...`
+                      : processingProgress.stage || 'Starting processing...'}
                   </p>
                   <p className="elapsed-time">⏱️ Elapsed: {formatElapsedTime(elapsedTime)}</p>
                   <p className="processing-note">🎧 AI is separating your audio stems. This may take 5-15 minutes depending on file size.</p>
+                  {currentJob.status === 'processing' && (processingProgress.ready_stems || currentJob.ready_stems || []).length > 0 && (
+                    <div className="stem-buttons ready-stems">
+                      {(processingProgress.ready_stems || currentJob.ready_stems).map((stem) => (
+                        <button
+                          key={stem}
+                          onClick={() => handleDownload(currentJob, stem)}
+                          className="stem-button"
+                          data-stem={stem}
+                        >
+                          <span className="stem-icon">🎼</span>
+                          {stem.charAt(0).toUpperCase() + stem.slice(1)} (ready)
+                        </button>
+                      ))}
+                    </div>
+                  )}
                 </div>
               )}
 
               {currentJob.status === 'completed' && currentJob.output_files && (
                 <div className="stems">
-                  <p className="total-time">✅ Processed in {currentJob.processing_time || formatElapsedTime(elapsedTime)}</p>
+                  {currentJob.cache_hit ? (
+                    <p className="total-time">♻️ Same track and settings as an earlier job — reused its stems</p>
+                  ) : (
+                    <p className="total-time">✅ Processed in {currentJob.processing_time || formatElapsedTime(elapsedTime)}</p>
+                  )}
                   <h3>Download Stems:</h3>
                   <div className="stem-buttons">
                     {Object.keys(currentJob.output_files).map((stem) => (
                       <button
                         key={stem}
-                        onClick={() => handleDownload(currentJob.id, stem)}
+                        onClick={() => handleDownload(currentJob, stem)}
                         className="stem-button"
                         data-stem={stem}
                       >
@@ -665,19 +936,33 @@ function App() {
                         {stem.charAt(0).toUpperCase() + stem.slice(1)}
                       </button>
                     ))}
+                    <button
+                      onClick={() => handleDownload(currentJob, 'all')}
+                      className="stem-button"
+                      data-stem="all"
+                    >
+                      <span className="stem-icon">📦</span>
+                      All stems (ZIP)
+                    </button>
                   </div>
                   
                   {/* Spectrograms for output stems */}
                   <div className="output-spectrograms">
                     <h3>📊 Output Spectrograms:</h3>
                     <div className="spectrograms-grid">
-                      {Object.keys(currentJob.output_files).map((stem) => (
-                        <Spectrogram 
-                          key={stem}
-                          audioUrl={getDownloadUrl(currentJob.id, stem)}
-                          title={stem.charAt(0).toUpperCase() + stem.slice(1)}
-                          height={60}
-                        />
+                      {Object.keys(currentJob.output_files).filter((stem) => !stem.includes('.')).map((stem) => (
+                        <div key={stem} className="stem-preview">
+                          <Spectrogram 
+                            audioUrl={getDownloadUrl(currentJob, stem)}
+                            title={stem.charAt(0).toUpperCase() + stem.slice(1)}
+                            height={60}
+                          />
+                          <audio
+                            controls
+                            preload="none"
+                            src={getDownloadUrl(currentJob, stem, 'inline')}
+                          />
+                        </div>
                       ))}
                     </div>
                   </div>
@@ -720,7 +1005,7 @@ function App() {
                       {Object.keys(job.output_files).map((stem) => (
                         <button
                           key={stem}
-                          onClick={() => handleDownload(job.id, stem)}
+                          onClick={() => handleDownload(job, stem)}
                           className="stem-button-small"
                         >
                           {stem}
@@ -737,6 +1022,13 @@ function App() {
 
       <footer className="App-footer">
         <p>Powered by Demucs | Backend: Go | Frontend: React</p>
+        {Object.keys(branding.links).length > 0 && (
+          <p className="App-footer-links">
+            {Object.entries(branding.links).map(([name, url]) => (
+              <a key={name} href={url} target="_blank" rel="noopener noreferrer">{LINK_LABELS[name] || name}</a>
+            ))}
+          </p>
+        )}
       </footer>
     </div>
   );
@@ -1,5 +1,6 @@
 import React from 'react';
 import { render, screen, fireEvent } from '@testing-library/react';
+import axios from 'axios';
 import App from './App';
 
 // Mock axios
@@ -142,4 +143,17 @@ describe('App', () => {
     expect(screen.getByText(/All 4 Stems/i)).toBeInTheDocument();
     expect(screen.queryByText(/All 6 Stems/i)).not.toBeInTheDocument();
   });
+
+  test('applies branding from the backend', async () => {
+    axios.get.mockImplementation((url) => Promise.resolve({
+      data: url.endsWith('/branding')
+        ? { name: 'Studio Stems', tagline: 'Stems for the studio', links: { terms: 'https://example.com/terms' }, limits: { max_upload_bytes: 50 * 1024 * 1024 } }
+        : [],
+    }));
+    render(<App />);
+    expect(await screen.findByText(/Studio Stems/)).toBeInTheDocument();
+    expect(screen.getByText('Stems for the studio')).toBeInTheDocument();
+    expect(screen.getByRole('link', { name: 'Terms' })).toHaveAttribute('href', 'https://example.com/terms');
+    axios.get.mockImplementation(() => Promise.resolve({ data: [] }));
+  });
 });
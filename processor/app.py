@@ -1,4 +1,7 @@
 import os
+import base64
+import binascii
+import tempfile
 import subprocess
 import logging
 import traceback
@@ -7,8 +10,20 @@ import time
 import re
 import pty
 import select
-from flask import Flask, request, jsonify
-from werkzeug.utils import secure_filename
+import socket
+import json
+import gzip
+import hashlib
+import unicodedata
+import urllib.request
+from importlib import metadata
+from flask import Flask, request, jsonify, has_request_context
+from cryptography.exceptions import InvalidTag
+from cryptography.hazmat.primitives import hashes, serialization
+from cryptography.hazmat.primitives.asymmetric.x25519 import X25519PrivateKey, X25519PublicKey
+from cryptography.hazmat.primitives.ciphers import Cipher, algorithms, modes
+from cryptography.hazmat.primitives.ciphers.aead import AESGCM
+from cryptography.hazmat.primitives.kdf.hkdf import HKDF
 import shutil
 
 # Validation pattern for job IDs: alphanumeric characters and hyphens only (up to 255 characters)
@@ -31,15 +46,62 @@ DEMUCS_MODEL_ARG_MAP = {
 ALLOWED_DEMUCS_MODELS = frozenset(DEMUCS_MODEL_ARG_MAP.keys())
 ALLOWED_STEM_MODES = {'all', 'isolate'}
 ALLOWED_STEMS = {'vocals', 'drums', 'bass', 'guitar', 'piano', 'other'}
+# Outputs of a separation preset's stem_groups (dialogue=vocals;music=bass+other)
+STEM_GROUP_NAME_PATTERN = re.compile(r'^[a-z][a-z0-9_]{0,31}$')
 ALLOWED_MODELS = {
     'htdemucs', 'htdemucs_ft', 'htdemucs_6s', 'hdemucs_mmi',
     'mdx', 'mdx_extra', 'mdx_q', 'mdx_extra_q',
 }
 SIX_STEM_MODELS = {'htdemucs_6s'}
+# Transformer models only run with the segment length they were trained on
+TRANSFORMER_MODELS = {'htdemucs', 'htdemucs_ft', 'htdemucs_6s'}
+ALLOWED_MP3_BITRATES = {128, 192, 256, 320}
 ALLOWED_CLIP_MODES = {'rescale', 'clamp'}
 ALLOWED_SHIFTS = set(range(0, 11))  # 0-10
 ALLOWED_SEGMENTS = {None, 8, 10, 15, 20, 25, 30, 40, 60}
 ALLOWED_OVERLAPS = {None, 0.1, 0.15, 0.2, 0.25, 0.3, 0.35, 0.4, 0.5}
+MAX_SEED = 2**32 - 1  # largest seed numpy accepts
+# advanced_options passed through to demucs: name -> (hard-coded CLI flag, allowed values);
+# flags without a value take None and are only added when 'true'
+ADVANCED_OPTION_FLAGS = {
+    'jobs': ('-j', set(range(1, 9))),
+    'float32': ('--float32', None),
+    'int24': ('--int24', None),
+    'mp3_preset': ('--mp3-preset', set(range(2, 8))),
+}
+# PyTorch threads for deterministic jobs: float sums depend on how work is
+# split, so every run has to use the same count whatever the host's cores
+DETERMINISTIC_THREADS = int(os.environ.get('DETERMINISTIC_THREADS', '4'))
+# HKDF info of the key wrapping a sealed job key (encrypted jobs)
+SEALED_KEY_INFO = b'track2stem job key'
+# Audio encrypted with a job key: 12-byte nonce, AES-256-GCM ciphertext, 16-byte tag
+GCM_NONCE_SIZE, GCM_TAG_SIZE = 12, 16
+# Marks embedded into the stems of watermarked jobs (see watermark_filter)
+ALLOWED_WATERMARKS = {'inaudible', 'tone'}
+# tone: a 1 kHz beep at -20 dBFS for 0.5 s every 10 s
+WATERMARK_TONE = {'hz': 1000, 'level': 0.1, 'every': 10, 'length': 0.5}
+# inaudible: a 16.5 kHz carrier at -50 dBFS (still under the lowpass of
+# 128 kbps MP3) keyed on and off, a sync word then the first 64 bits of the
+# job ID, 4 bits a second
+WATERMARK_CARRIER = {'hz': 16500, 'level': 0.00316, 'bit_seconds': 0.25, 'sync': 0xE9C3}
+# Most clips /process/batch separates in one Demucs run, advertised as X-Batch-Limit
+PROCESS_BATCH_LIMIT = int(os.environ.get('PROCESS_BATCH_LIMIT', '8'))
+# Runs demucs with every source of randomness seeded; argv: seed threads demucs-args...
+DETERMINISTIC_DEMUCS = """
+import random, sys
+import numpy, torch
+seed, threads = int(sys.argv[1]), int(sys.argv[2])
+del sys.argv[1:3]
+random.seed(seed)
+numpy.random.seed(seed)
+torch.manual_seed(seed)
+torch.set_num_threads(threads)
+torch.use_deterministic_algorithms(True, warn_only=True)
+torch.backends.cudnn.deterministic = True
+torch.backends.cudnn.benchmark = False
+from demucs.separate import main
+main()
+"""
 
 
 def validate_job_id(job_id):
@@ -64,17 +126,77 @@ def safe_join(base_dir, *paths):
     # Return the normalized, verified-safe path
     return real_joined
 
+
+def safe_filename(filename):
+    """Make an uploaded name safe to save under a directory without losing
+    non-ASCII letters, unlike werkzeug's secure_filename. The backend has
+    already applied its FILENAME_POLICY, so this mirrors its unicode policy:
+    NFC, nothing before a path separator, and anything but letters, marks,
+    digits, '.', '_' and '-' replaced with '_'."""
+    name = unicodedata.normalize('NFC', filename or '')
+    name = name.replace('\\', '/').rsplit('/', 1)[-1]
+    name = ''.join(
+        c if c in '._-' or unicodedata.category(c)[0] in 'LMN' else '_'
+        for c in name
+    )
+    # No hidden files or '..'
+    return name.lstrip('.') or 'upload'
+
+class RequestIDFilter(logging.Filter):
+    """Tags log records with the backend's X-Request-ID so a job can be
+    traced across both services' logs ('-' outside a request)."""
+
+    def filter(self, record):
+        record.request_id = '-'
+        if has_request_context():
+            record.request_id = request.headers.get('X-Request-ID', '-')
+        return True
+
 # Configure logging
 logging.basicConfig(
     level=logging.INFO,
-    format='%(asctime)s - %(levelname)s - %(message)s'
+    format='%(asctime)s - %(levelname)s - [%(request_id)s] %(message)s'
 )
+for _handler in logging.getLogger().handlers:
+    _handler.addFilter(RequestIDFilter())
 logger = logging.getLogger(__name__)
 
 app = Flask(__name__)
 
+# Request body encodings accepted, advertised in Accept-Encoding (RFC 7694)
+CONTENT_ENCODINGS = ['gzip']
+
+@app.before_request
+def decode_request_body():
+    """Decompress gzip request bodies (large WAV uploads) as they are read."""
+    encoding = request.headers.get('Content-Encoding', 'identity').lower()
+    if encoding == 'identity':
+        return None
+    if encoding not in CONTENT_ENCODINGS:
+        return jsonify({'error': f'Unsupported Content-Encoding: {encoding}'}), 415
+    # The backend streams compressed bodies chunked, so the form parser
+    # reads the decompressed stream to its end
+    request.stream = gzip.GzipFile(fileobj=request.stream, mode='rb')
+    return None
+
+@app.after_request
+def echo_request_id(response):
+    request_id = request.headers.get('X-Request-ID')
+    if request_id:
+        response.headers['X-Request-ID'] = request_id
+    # Tells the backend it may send large uploads compressed
+    response.headers['Accept-Encoding'] = ', '.join(CONTENT_ENCODINGS)
+    # ... and short clips together
+    if PROCESS_BATCH_LIMIT > 1:
+        response.headers['X-Batch-Limit'] = str(PROCESS_BATCH_LIMIT)
+    return response
+
 UPLOAD_FOLDER = '/app/uploads'
 OUTPUT_FOLDER = '/app/outputs'
+# Checkpoints of registered custom models, passed to demucs as --repo
+CUSTOM_MODEL_DIR = os.environ.get('CUSTOM_MODEL_DIR', '/app/models')
+# Demucs reads the part of a checkpoint name before a hyphen as its signature
+CUSTOM_MODEL_NAME_PATTERN = re.compile(r'^[a-z][a-z0-9_]{1,63}$')
 ALLOWED_EXTENSIONS = {'mp3', 'wav', 'flac', 'ogg', 'm4a', 'aac'}
 WAV_EXTENSIONS = {'wav'}  # Extensions that support WAV output
 
@@ -122,9 +244,400 @@ def convert_to_flac(src_path, dst_path):
     if os.path.exists(src_path):
         os.remove(src_path)
 
+def sealing_key():
+    """The X25519 private key opening sealed job keys (PROCESSOR_SEALING_KEY,
+    base64), or None when this processor doesn't take encrypted jobs."""
+    raw = os.environ.get('PROCESSOR_SEALING_KEY', '')
+    if not raw:
+        return None
+    return X25519PrivateKey.from_private_bytes(base64.b64decode(raw))
+
+def open_sealed_key(sealed):
+    """Open the job key of an encrypted job.
+
+    sealed is the base64 of the client's ephemeral X25519 public key, a
+    12-byte nonce and the job key encrypted with AES-256-GCM under
+    HKDF-SHA256(shared secret, salt ephemeral||our public key). Raises
+    ValueError when it can't be opened.
+    """
+    private = sealing_key()
+    if private is None:
+        raise ValueError('encrypted jobs are not enabled on this processor')
+    try:
+        raw = base64.b64decode(sealed, validate=True)
+    except binascii.Error:
+        raise ValueError('sealed_key is not base64')
+    if len(raw) != 32 + GCM_NONCE_SIZE + 32 + GCM_TAG_SIZE:
+        raise ValueError('sealed_key has the wrong length')
+    ephemeral = raw[:32]
+    public = private.public_key().public_bytes(serialization.Encoding.Raw, serialization.PublicFormat.Raw)
+    shared = private.exchange(X25519PublicKey.from_public_bytes(ephemeral))
+    wrapping = HKDF(algorithm=hashes.SHA256(), length=32, salt=ephemeral + public, info=SEALED_KEY_INFO).derive(shared)
+    try:
+        return AESGCM(wrapping).decrypt(raw[32:32 + GCM_NONCE_SIZE], raw[32 + GCM_NONCE_SIZE:], None)
+    except InvalidTag:
+        raise ValueError('sealed_key was not sealed to this processor')
+
+def decrypt_file(key, src_path, dst_path):
+    """Decrypt a file encrypted with a job key, streaming it through so
+    large uploads aren't held in memory. Raises ValueError, leaving no
+    dst behind, when the file wasn't encrypted with the key."""
+    size = os.path.getsize(src_path)
+    if size < GCM_NONCE_SIZE + GCM_TAG_SIZE:
+        raise ValueError('the upload is too short to be encrypted')
+    with open(src_path, 'rb') as src:
+        nonce = src.read(GCM_NONCE_SIZE)
+        src.seek(size - GCM_TAG_SIZE)
+        tag = src.read(GCM_TAG_SIZE)
+        src.seek(GCM_NONCE_SIZE)
+        decryptor = Cipher(algorithms.AES(key), modes.GCM(nonce, tag)).decryptor()
+        remaining = size - GCM_NONCE_SIZE - GCM_TAG_SIZE
+        try:
+            with open(dst_path, 'wb') as dst:
+                while remaining > 0:
+                    chunk = src.read(min(1 << 20, remaining))
+                    remaining -= len(chunk)
+                    dst.write(decryptor.update(chunk))
+                dst.write(decryptor.finalize())
+        except InvalidTag:
+            os.remove(dst_path)
+            raise ValueError('the upload was not encrypted with the job key')
+
+def encrypt_file(key, src_path, dst_path):
+    """Encrypt a file with a job key the way clients encrypt uploads."""
+    nonce = os.urandom(GCM_NONCE_SIZE)
+    encryptor = Cipher(algorithms.AES(key), modes.GCM(nonce)).encryptor()
+    with open(src_path, 'rb') as src, open(dst_path, 'wb') as dst:
+        dst.write(nonce)
+        for chunk in iter(lambda: src.read(1 << 20), b''):
+            dst.write(encryptor.update(chunk))
+        dst.write(encryptor.finalize())
+        dst.write(encryptor.tag)
+
+_processing_environment = None
+
+def processing_environment():
+    """Describe this processor instance for the jobs it processes.
+
+    PROCESSOR_INSTANCE and PROCESSOR_IMAGE override the hostname and name the
+    container image; the device and library versions are detected once.
+    """
+    global _processing_environment
+    if _processing_environment is None:
+        env = {
+            'instance': os.environ.get('PROCESSOR_INSTANCE') or socket.gethostname(),
+            'image': os.environ.get('PROCESSOR_IMAGE', ''),
+            'device': 'cpu',
+            'gpu': '',
+        }
+        for package in ('demucs', 'torch'):
+            try:
+                env[f'{package}_version'] = metadata.version(package)
+            except metadata.PackageNotFoundError:
+                env[f'{package}_version'] = ''
+        try:
+            import torch
+            if torch.cuda.is_available():
+                # ROCm builds of torch expose AMD GPUs through the cuda API
+                env['device'] = 'rocm' if getattr(torch.version, 'hip', None) else 'cuda'
+                env['gpu'] = torch.cuda.get_device_name(0)
+            elif torch.backends.mps.is_available():
+                env['device'] = 'mps'
+        except Exception:
+            pass
+        _processing_environment = env
+    return _processing_environment
+
+def compute_report(started):
+    """How long Demucs has run since started, and on which device.
+
+    The backend estimates a job's energy use from it.
+    """
+    return {'device': processing_environment()['device'], 'seconds': round(time.time() - started, 1)}
+
+# Devices whose kernels give byte-identical reruns
+DETERMINISTIC_DEVICES = {'cpu', 'cuda'}
+_hardware_detection = threading.Lock()
+
+
+def hardware_report():
+    """What /health tells the backend about this instance's hardware.
+
+    PROCESSOR_DEVICE, PROCESSOR_CAPABILITIES and PROCESSOR_UNSUPPORTED_MODELS
+    (comma separated) override what is detected; with a PROCESSOR_SEALING_KEY
+    the encrypted capability is always reported. Detecting the device
+    imports torch, which takes longer than a health check may, so it runs
+    in the background and the device is left out until it is known.
+    """
+    report = {}
+    device = os.environ.get('PROCESSOR_DEVICE', '')
+    if not device and _processing_environment is not None:
+        device = _processing_environment['device']
+    elif not device and _hardware_detection.acquire(blocking=False):
+        threading.Thread(target=processing_environment, daemon=True).start()
+    if device:
+        report['device'] = device
+    capabilities = os.environ.get('PROCESSOR_CAPABILITIES')
+    if capabilities is not None:
+        report['capabilities'] = [c.strip() for c in capabilities.split(',') if c.strip()]
+    elif device:
+        report['capabilities'] = ['deterministic'] if device in DETERMINISTIC_DEVICES else []
+    if 'capabilities' in report and os.environ.get('PROCESSOR_SEALING_KEY') and 'encrypted' not in report['capabilities']:
+        report['capabilities'].append('encrypted')
+    unsupported = [m.strip() for m in os.environ.get('PROCESSOR_UNSUPPORTED_MODELS', '').split(',') if m.strip()]
+    if unsupported:
+        report['unsupported_models'] = unsupported
+    return report
+
+def processor_version():
+    """The version upgrades are told apart by: PROCESSOR_VERSION, else the image."""
+    return os.environ.get('PROCESSOR_VERSION') or os.environ.get('PROCESSOR_IMAGE', '')
+
 @app.route('/health', methods=['GET'])
 def health():
-    return jsonify({'status': 'ok'})
+    report = {'status': 'ok', **hardware_report()}
+    if processor_version():
+        report['version'] = processor_version()
+    return jsonify(report)
+
+# Background model downloads by name: status, error, started_at, finished_at
+model_downloads = {}
+model_download_lock = threading.Lock()
+
+
+def model_checkpoint_dir():
+    """Directory where torch hub (and so Demucs) keeps downloaded weights."""
+    import torch.hub
+    return os.path.join(torch.hub.get_dir(), 'checkpoints')
+
+
+def model_weight_files(name):
+    """Checkpoint file names a pretrained Demucs model is made of.
+
+    Each model is a bag of one or more signatures (demucs/remote/<name>.yaml)
+    and files.txt maps signatures to '<signature>-<checksum>.th' files, so
+    the file names double as the model's version.
+    """
+    import yaml
+    from demucs import pretrained
+    files = {}
+    with open(pretrained.REMOTE_ROOT / 'files.txt') as f:
+        for line in f:
+            line = line.strip()
+            if line and not line.startswith('#'):
+                files[line.split('-', 1)[0]] = line
+    with open(pretrained.REMOTE_ROOT / f'{name}.yaml') as f:
+        signatures = yaml.safe_load(f)['models']
+    return [files[sig] for sig in signatures]
+
+
+def model_inventory(name):
+    """Whether a model's weights are cached here, at which version and size."""
+    entry = {'name': name, 'installed': False}
+    if name in custom_models:
+        path = os.path.join(CUSTOM_MODEL_DIR, f'{name}.th')
+        if os.path.isfile(path):
+            entry.update(installed=True, version=custom_models[name]['version'], size_bytes=os.path.getsize(path))
+        with model_download_lock:
+            if name in model_downloads:
+                entry['download'] = dict(model_downloads[name])
+        return entry
+    try:
+        weights = model_weight_files(name)
+    except Exception as e:
+        logger.warning(f"Could not resolve weights for model {name}: {e}")
+        weights = []
+    checkpoint_dir = model_checkpoint_dir()
+    paths = [os.path.join(checkpoint_dir, w) for w in weights]
+    if paths and all(os.path.isfile(p) for p in paths):
+        entry['installed'] = True
+        entry['version'] = '+'.join(os.path.splitext(w)[0] for w in weights)
+        entry['size_bytes'] = sum(os.path.getsize(p) for p in paths)
+    with model_download_lock:
+        if name in model_downloads:
+            entry['download'] = dict(model_downloads[name])
+    return entry
+
+
+def download_model(name, force):
+    """Fetch a model's weights (again, with force) into the torch hub cache.
+
+    Custom models are fetched again from their checkpoint location.
+    """
+    try:
+        if name in custom_models:
+            path = fetch_custom_checkpoint(name, custom_models[name]['checkpoint'])
+            with custom_models_lock:
+                custom_models[name].update(version=file_sha256(path)[:16], size_bytes=os.path.getsize(path))
+                save_custom_models()
+        else:
+            if force:
+                for w in model_weight_files(name):
+                    path = os.path.join(model_checkpoint_dir(), w)
+                    if os.path.exists(path):
+                        os.remove(path)
+            from demucs import pretrained
+            pretrained.get_model(DEMUCS_MODEL_ARG_MAP[name])
+        status, error = 'completed', ''
+        logger.info(f"Downloaded model {name}")
+    except Exception as e:
+        status, error = 'failed', str(e)
+        logger.error(f"Model {name} download failed: {e}")
+    with model_download_lock:
+        model_downloads[name].update({
+            'status': status,
+            'error': error,
+            'finished_at': time.strftime('%Y-%m-%dT%H:%M:%SZ', time.gmtime()),
+        })
+
+
+def custom_models_file():
+    return os.path.join(CUSTOM_MODEL_DIR, 'custom_models.json')
+
+
+def load_custom_models():
+    """Registered custom models by name: checkpoint, stems, version, size_bytes."""
+    try:
+        with open(custom_models_file()) as f:
+            return json.load(f)
+    except (OSError, ValueError):
+        return {}
+
+
+custom_models = load_custom_models()
+custom_models_lock = threading.Lock()
+
+
+def save_custom_models():
+    """Persist the registry. Callers hold custom_models_lock."""
+    tmp = custom_models_file() + '.tmp'
+    with open(tmp, 'w') as f:
+        json.dump(custom_models, f, indent=2)
+    os.replace(tmp, custom_models_file())
+
+
+def model_stems(model):
+    """The stems a built-in or custom model separates."""
+    if model in custom_models:
+        return list(custom_models[model]['stems'])
+    if model in SIX_STEM_MODELS:
+        return ['vocals', 'drums', 'bass', 'guitar', 'piano', 'other']
+    return ['vocals', 'drums', 'bass', 'other']
+
+
+def fetch_custom_checkpoint(name, checkpoint):
+    """Copy or download a checkpoint to CUSTOM_MODEL_DIR/<name>.th."""
+    os.makedirs(CUSTOM_MODEL_DIR, exist_ok=True)
+    dst = os.path.join(CUSTOM_MODEL_DIR, f'{name}.th')
+    tmp = dst + '.tmp'
+    if checkpoint.startswith(('http://', 'https://')):
+        with urllib.request.urlopen(checkpoint, timeout=60) as resp, open(tmp, 'wb') as f:
+            shutil.copyfileobj(resp, f)
+    elif os.path.isabs(checkpoint) and checkpoint.endswith('.th') and os.path.isfile(checkpoint):
+        shutil.copyfile(checkpoint, tmp)
+    else:
+        raise ValueError('checkpoint must be an http(s) URL or an existing .th file')
+    os.replace(tmp, dst)
+    return dst
+
+
+def load_custom_model_sources(name):
+    """Load a custom checkpoint the way demucs --repo will and return its sources."""
+    from pathlib import Path
+    from demucs import pretrained
+    model = pretrained.get_model(name, repo=Path(CUSTOM_MODEL_DIR))
+    return list(model.sources)
+
+
+def file_sha256(path):
+    digest = hashlib.sha256()
+    with open(path, 'rb') as f:
+        for chunk in iter(lambda: f.read(1 << 20), b''):
+            digest.update(chunk)
+    return digest.hexdigest()
+
+
+@app.route('/models/custom', methods=['POST'])
+def register_custom_model():
+    """Fetch a custom checkpoint, check that it loads and separates the given stems."""
+    data = request.get_json(silent=True) or {}
+    name = data.get('name', '')
+    checkpoint = data.get('checkpoint', '')
+    stems = data.get('stems') or []
+    if not isinstance(name, str) or not CUSTOM_MODEL_NAME_PATTERN.match(name) or name in ALLOWED_DEMUCS_MODELS:
+        return jsonify({'error': 'Invalid model name'}), 400
+    if not isinstance(stems, list) or len(stems) < 2 or len(set(stems)) != len(stems) or not set(stems) <= ALLOWED_STEMS:
+        return jsonify({'error': 'Invalid stems'}), 400
+    if not isinstance(checkpoint, str) or not checkpoint:
+        return jsonify({'error': 'Invalid checkpoint'}), 400
+
+    try:
+        path = fetch_custom_checkpoint(name, checkpoint)
+    except Exception as e:
+        logger.error(f"Fetching checkpoint for custom model {name} failed: {e}")
+        return jsonify({'error': f'Could not fetch checkpoint: {e}'}), 422
+    try:
+        sources = load_custom_model_sources(name)
+    except Exception as e:
+        os.remove(path)
+        logger.error(f"Custom model {name} does not load: {e}")
+        return jsonify({'error': f'Checkpoint does not load as a Demucs model: {e}'}), 422
+    if set(sources) != set(stems):
+        os.remove(path)
+        return jsonify({'error': f'Checkpoint separates {", ".join(sources)}, not {", ".join(stems)}'}), 422
+
+    entry = {
+        'checkpoint': checkpoint,
+        'stems': sources,
+        'version': file_sha256(path)[:16],
+        'size_bytes': os.path.getsize(path),
+    }
+    with custom_models_lock:
+        custom_models[name] = entry
+        save_custom_models()
+    logger.info(f"Registered custom model {name} ({', '.join(sources)}) from {checkpoint}")
+    return jsonify({'name': name, **entry}), 201
+
+
+@app.route('/models/custom/<name>', methods=['DELETE'])
+def delete_custom_model(name):
+    """Forget a custom model and delete its checkpoint."""
+    with custom_models_lock:
+        if name not in custom_models:
+            return jsonify({'error': 'Custom model not found'}), 404
+        del custom_models[name]
+        save_custom_models()
+    path = os.path.join(CUSTOM_MODEL_DIR, f'{name}.th')
+    if os.path.exists(path):
+        os.remove(path)
+    logger.info(f"Removed custom model {name}")
+    return jsonify({'status': 'deleted', 'name': name})
+
+
+@app.route('/models', methods=['GET'])
+def list_models():
+    """Report which models are cached on this processor."""
+    return jsonify({
+        'demucs_version': processing_environment().get('demucs_version', ''),
+        'models': [model_inventory(name) for name in sorted(ALLOWED_DEMUCS_MODELS | set(custom_models))],
+    })
+
+
+@app.route('/models/<name>/download', methods=['POST'])
+def start_model_download(name):
+    """Download or, with ?force=true, re-download a model in the background."""
+    if name not in ALLOWED_DEMUCS_MODELS and name not in custom_models:
+        return jsonify({'error': 'Invalid model'}), 400
+    force = request.args.get('force') == 'true'
+    with model_download_lock:
+        if model_downloads.get(name, {}).get('status') == 'downloading':
+            return jsonify({'error': f'Model {name} is already downloading'}), 409
+        model_downloads[name] = {
+            'status': 'downloading',
+            'started_at': time.strftime('%Y-%m-%dT%H:%M:%SZ', time.gmtime()),
+        }
+    threading.Thread(target=download_model, args=(name, force), daemon=True).start()
+    return jsonify({'status': 'downloading', 'model': name}), 202
 
 @app.route('/status/<job_id>', methods=['GET'])
 def get_status(job_id):
@@ -135,6 +648,22 @@ def get_status(job_id):
         return jsonify(processing_status[job_id])
     return jsonify({'status': 'unknown', 'progress': 0})
 
+def cancel_batch_member(job_id, batch):
+    """Drop one clip of a batch. The shared Demucs run only stops once
+    every clip of the batch is cancelled. Called with process_lock held."""
+    batch['cancelled'].add(job_id)
+    del active_processes[job_id]
+    processing_status[job_id] = {'status': 'cancelled', 'progress': 0, 'stage': 'Cancelled by user'}
+    process = batch['process']
+    if batch['cancelled'] == batch['members'] and process.poll() is None:
+        logger.info("Every clip of the batch was cancelled, killing its process")
+        process.terminate()
+        try:
+            process.wait(timeout=5)
+        except subprocess.TimeoutExpired:
+            process.kill()
+    return jsonify({'status': 'cancelled', 'job_id': job_id})
+
 @app.route('/cancel/<job_id>', methods=['POST'])
 def cancel_job(job_id):
     """Cancel a running job by killing its subprocess"""
@@ -145,6 +674,8 @@ def cancel_job(job_id):
     with process_lock:
         if job_id in active_processes:
             proc_info = active_processes[job_id]
+            if 'members' in proc_info:
+                return cancel_batch_member(job_id, proc_info)
             process = proc_info.get('process')
             stop_event = proc_info.get('stop_event')
             master_fd = proc_info.get('master_fd')
@@ -190,10 +721,541 @@ def cancel_job(job_id):
             logger.info(f"No active process found for job {job_id}")
             return jsonify({'status': 'not_found', 'job_id': job_id}), 404
 
+def parse_separation_options(form):
+    """Read and validate the separation options of a /process request.
+
+    Returns (options, None), or (None, response) when a value is invalid.
+    """
+    output_format = form.get('output_format', 'mp3').lower()  # mp3, wav, or flac
+    stem_mode = form.get('stem_mode', 'all').lower()  # 'all' or 'isolate'
+    isolate_stem = form.get('isolate_stem', 'vocals').lower()  # which stem to isolate
+    model = form.get('model', 'htdemucs_6s').lower()  # demucs model
+    custom = model in custom_models
+    if model not in ALLOWED_DEMUCS_MODELS and not custom:
+        logger.error(f"Invalid model requested: {model}")
+        return None, (jsonify({
+            'error': 'Invalid model',
+            'allowed_models': sorted(ALLOWED_DEMUCS_MODELS | set(custom_models)),
+        }), 400)
+    # Custom names were checked against CUSTOM_MODEL_NAME_PATTERN when registered
+    safe_model = model if custom else DEMUCS_MODEL_ARG_MAP[model]
+    clip_mode = form.get('clip_mode', 'rescale').lower()  # rescale or clamp
+    
+    # Parse numeric options – reject non-parseable values with 400
+    shifts_raw = form.get('shifts')
+    if shifts_raw is None or shifts_raw == '':
+        shifts = 0
+    else:
+        try:
+            shifts = int(shifts_raw)
+        except (ValueError, TypeError):
+            logger.error(f"Invalid shifts value: {shifts_raw}")
+            return None, (jsonify({'error': 'Invalid shifts value'}), 400)
+    
+    mp3_bitrate_raw = form.get('mp3_bitrate')
+    if mp3_bitrate_raw is None or mp3_bitrate_raw == '':
+        mp3_bitrate = 320
+    else:
+        try:
+            mp3_bitrate = int(mp3_bitrate_raw)
+        except (ValueError, TypeError):
+            logger.error(f"Invalid mp3_bitrate value: {mp3_bitrate_raw}")
+            return None, (jsonify({'error': 'Invalid mp3_bitrate value'}), 400)
+    
+    segment_raw = form.get('segment', '')
+    segment = None
+    if segment_raw:
+        try:
+            segment = int(segment_raw)
+        except (ValueError, TypeError):
+            logger.error(f"Invalid segment value: {segment_raw}")
+            return None, (jsonify({'error': 'Invalid segment value'}), 400)
+    
+    overlap_raw = form.get('overlap', '')
+    overlap = None
+    if overlap_raw:
+        try:
+            overlap = float(overlap_raw)
+        except (ValueError, TypeError):
+            logger.error(f"Invalid overlap value: {overlap_raw}")
+            return None, (jsonify({'error': 'Invalid overlap value'}), 400)
+    
+    # Deterministic jobs seed demucs so a re-run gives identical stems
+    deterministic = form.get('deterministic', '').lower() == 'true'
+    seed = 0
+    if deterministic and form.get('seed'):
+        try:
+            seed = int(form.get('seed'))
+        except (ValueError, TypeError):
+            seed = -1
+        if not 0 <= seed <= MAX_SEED:
+            logger.error(f"Invalid seed value: {form.get('seed')}")
+            return None, (jsonify({'error': 'Invalid seed value'}), 400)
+    
+    if output_format not in ALLOWED_OUTPUT_FORMATS:
+        logger.error(f"Invalid output format: {output_format}")
+        return None, (jsonify({'error': 'Invalid output format'}), 400)
+    
+    if stem_mode not in ALLOWED_STEM_MODES:
+        logger.error(f"Invalid stem mode: {stem_mode}")
+        return None, (jsonify({'error': 'Invalid stem mode'}), 400)
+    
+    if isolate_stem not in ALLOWED_STEMS:
+        logger.error(f"Invalid isolate stem: {isolate_stem}")
+        return None, (jsonify({'error': 'Invalid isolate stem'}), 400)
+    
+    if model not in ALLOWED_MODELS and not custom:
+        logger.error(f"Invalid model: {model}")
+        return None, (jsonify({'error': 'Invalid model'}), 400)
+    
+    # Ensure isolate_stem is compatible with the selected model
+    if stem_mode == 'isolate' and isolate_stem not in model_stems(model):
+        logger.error(f"Incompatible isolate stem '{isolate_stem}' for model '{model}'")
+        return None, (jsonify({'error': 'Incompatible isolate_stem for selected model'}), 400)
+    
+    if clip_mode not in ALLOWED_CLIP_MODES:
+        logger.error(f"Invalid clip mode: {clip_mode}")
+        return None, (jsonify({'error': 'Invalid clip mode'}), 400)
+    
+    if shifts not in ALLOWED_SHIFTS:
+        logger.error(f"Invalid shifts value: {shifts}")
+        return None, (jsonify({'error': 'Invalid shifts value'}), 400)
+    
+    if segment is not None and segment not in ALLOWED_SEGMENTS:
+        logger.error(f"Invalid segment value: {segment}")
+        return None, (jsonify({'error': 'Invalid segment value'}), 400)
+    
+    if overlap is not None and overlap not in ALLOWED_OVERLAPS:
+        logger.error(f"Invalid overlap value: {overlap}")
+        return None, (jsonify({'error': 'Invalid overlap value'}), 400)
+    
+    if mp3_bitrate not in ALLOWED_MP3_BITRATES:
+        logger.error(f"Invalid mp3_bitrate value: {mp3_bitrate}")
+        return None, (jsonify({'error': 'Invalid mp3_bitrate value'}), 400)
+    
+    if segment is not None and model in TRANSFORMER_MODELS:
+        logger.error(f"Segment {segment} not supported by transformer model '{model}'")
+        return None, (jsonify({'error': 'segment is not supported by transformer models'}), 400)
+    
+    advanced, error = parse_advanced_options(form.get('advanced_options', ''))
+    if error:
+        logger.error(f"Invalid advanced_options: {error}")
+        return None, (jsonify({'error': error}), 400)
+    
+    stem_groups, error = parse_stem_groups(form.get('stem_groups', ''), model, stem_mode)
+    if error:
+        logger.error(f"Invalid stem_groups: {error}")
+        return None, (jsonify({'error': error}), 400)
+    
+    watermark = form.get('watermark', '').lower()
+    if watermark and watermark not in ALLOWED_WATERMARKS:
+        logger.error(f"Invalid watermark: {watermark}")
+        return None, (jsonify({'error': 'Invalid watermark', 'allowed_watermarks': sorted(ALLOWED_WATERMARKS)}), 400)
+    
+    return {
+        'output_format': output_format, 'stem_mode': stem_mode, 'isolate_stem': isolate_stem,
+        'model': model, 'custom': custom, 'safe_model': safe_model, 'clip_mode': clip_mode,
+        'shifts': shifts, 'mp3_bitrate': mp3_bitrate, 'segment': segment, 'overlap': overlap,
+        'deterministic': deterministic, 'seed': seed, 'advanced': advanced, 'stem_groups': stem_groups,
+        'watermark': watermark,
+        # Where Demucs writes its stems; encrypted jobs use a private directory
+        'demucs_root': OUTPUT_FOLDER,
+        # For demucs: use WAV output when user requests wav or flac (flac converted after)
+        'demucs_output_fmt': 'mp3' if output_format == 'mp3' else 'wav',
+    }, None
+
+def parse_stem_groups(raw, model, stem_mode):
+    """Parse a preset's stem_groups into (output, model stems) pairs, e.g.
+    dialogue=vocals;music=bass+other. Every model stem goes into at most one
+    output. Returns (groups, None), or (None, error) when it's invalid.
+    """
+    if not raw:
+        return [], None
+    if stem_mode != 'all':
+        return None, 'stem_groups only apply to stem_mode all'
+    groups, names, used = [], set(), set()
+    for entry in raw.split(';'):
+        name, _, sources = entry.partition('=')
+        sources = sources.split('+') if sources else []
+        if not STEM_GROUP_NAME_PATTERN.match(name) or name in names or not sources:
+            return None, f'Invalid stem group: {entry}'
+        for source in sources:
+            if source not in model_stems(model) or source in used:
+                return None, f'Invalid stem group: {entry}'
+            used.add(source)
+        names.add(name)
+        groups.append((name, sources))
+    return groups, None
+
+def parse_advanced_options(raw):
+    """Parse name=value advanced options into the demucs arguments they add.
+
+    Returns (args, None), or (None, message) for an option outside ADVANCED_OPTION_FLAGS.
+    """
+    args = []
+    for entry in filter(None, (e.strip() for e in raw.split(','))):
+        name, _, value = entry.partition('=')
+        if name not in ADVANCED_OPTION_FLAGS:
+            return None, f'Invalid advanced option {name}'
+        flag, allowed = ADVANCED_OPTION_FLAGS[name]
+        if allowed is None:
+            if value not in ('', 'true', 'false'):
+                return None, f'Invalid advanced option {name} value'
+            if value != 'false':
+                args.append(flag)
+            continue
+        try:
+            number = int(value)
+        except ValueError:
+            number = None
+        if number not in allowed:
+            return None, f'Invalid advanced option {name} value'
+        args.extend([flag, str(number)])
+    return args, None
+
+def demucs_command(options, input_paths):
+    """The Demucs command line separating input_paths with the given options."""
+    safe_model, custom, demucs_output_fmt = options['safe_model'], options['custom'], options['demucs_output_fmt']
+    mp3_bitrate, clip_mode, shifts = options['mp3_bitrate'], options['clip_mode'], options['shifts']
+    segment, overlap, deterministic, seed = options['segment'], options['overlap'], options['deterministic'], options['seed']
+    cmd = [
+        'python', '-m', 'demucs',
+        '-o', options['demucs_root'],
+        '-n', safe_model,
+    ]
+    if custom:
+        cmd.extend(['--repo', CUSTOM_MODEL_DIR])
+    
+    # Add format-specific options
+    if demucs_output_fmt == 'mp3':
+        cmd.extend([
+            '--mp3',
+            '--mp3-bitrate', str(mp3_bitrate),  # 320 kbps unless requested otherwise
+        ])
+    # For WAV/FLAC output, demucs outputs WAV by default (no --mp3 flag)
+    
+    # Add clip mode
+    if clip_mode == 'clamp':
+        cmd.extend(['--clip-mode', 'clamp'])
+    
+    # Add shifts (shift trick for better quality, N times slower)
+    if shifts > 0:
+        cmd.extend(['--shifts', str(shifts)])
+    
+    # Add segment size (for memory management)
+    if segment is not None:
+        cmd.extend(['--segment', str(segment)])
+    
+    # Add overlap
+    if overlap is not None:
+        cmd.extend(['--overlap', str(overlap)])
+    
+    # Vetted pass-through flags (advanced_options)
+    cmd.extend(options.get('advanced', []))
+    
+    cmd.extend(input_paths)
+    if deterministic:
+        # Same arguments, run through the seeding wrapper instead of -m demucs
+        cmd[1:3] = ['-c', DETERMINISTIC_DEMUCS, str(seed), str(DETERMINISTIC_THREADS)]
+        logger.info(f"Deterministic run: seed={seed}, shifts={shifts}, threads={DETERMINISTIC_THREADS}")
+    return cmd
+
+def collect_stems(options, job_id, filename, original_filename, job_output_dir, on_saved, guess_output=True):
+    """Move the stems Demucs wrote for one input into job_output_dir under
+    their final names, converting or mixing them as the options say.
+
+    Returns the stem paths and the Demucs output directory. on_saved is
+    called with the stems saved so far and how many are expected. Without
+    guess_output a missing Demucs directory isn't looked for elsewhere.
+    """
+    model, stem_mode, isolate_stem = options['model'], options['stem_mode'], options['isolate_stem']
+    demucs_output_fmt, mp3_bitrate = options['demucs_output_fmt'], options['mp3_bitrate']
+    actual_output_format = options['output_format']
+    # Demucs creates: OUTPUT_FOLDER/{model}/filename_without_ext/stem.mp3 (or .wav)
+    # Use the original filename with job_id prefix consistently
+    demucs_root = options['demucs_root']
+    filename_no_ext = os.path.splitext(f"{job_id}_{original_filename}")[0]
+    demucs_output = safe_join(demucs_root, model, filename_no_ext)
+    
+    logger.info(f"Looking for output in: {demucs_output}")
+    
+    if not os.path.exists(demucs_output) and guess_output:
+        # Try alternate paths for the model
+        alt_path = safe_join(demucs_root, model, os.path.splitext(filename)[0])
+        logger.info(f"Trying alternate path: {alt_path}")
+        if os.path.exists(alt_path):
+            demucs_output = alt_path
+        else:
+            # List what's actually there
+            model_dir = safe_join(demucs_root, model)
+            if os.path.exists(model_dir):
+                contents = os.listdir(model_dir)
+                logger.info(f"Contents of {model} dir: {contents}")
+                if contents:
+                    demucs_output = safe_join(model_dir, contents[0])
+                    logger.info(f"Using first directory: {demucs_output}")
+    
+    # Move files to job output directory and collect paths
+    output_files = {}
+    # Determine available stems based on model
+    all_stems = model_stems(model)
+    demucs_ext = 'wav' if demucs_output_fmt == 'wav' else 'mp3'
+    
+    # Get original filename without extension for naming output files
+    original_name_no_ext = os.path.splitext(original_filename)[0]
+    
+    if stem_mode == 'isolate':
+        # Isolate mode: output the isolated stem + combined "other" track
+        logger.info(f"Isolate mode: extracting {isolate_stem} and combining the rest")
+        
+        # First, get the isolated stem
+        logger.info(f"[Stem] Processing isolated stem: {isolate_stem}")
+        for ext in [demucs_ext, 'mp3', 'wav']:
+            src = safe_join(demucs_output, f"{isolate_stem}.{ext}")
+            if os.path.exists(src):
+                if actual_output_format == 'flac':
+                    dst_filename = f"{original_name_no_ext}_t2s_{isolate_stem}.flac"
+                    dst = safe_join(job_output_dir, dst_filename)
+                    convert_to_flac(src, dst)
+                else:
+                    dst_filename = f"{original_name_no_ext}_t2s_{isolate_stem}.{ext}"
+                    dst = safe_join(job_output_dir, dst_filename)
+                    shutil.move(src, dst)
+                logger.info(f"Isolated stem saved: {dst}")
+                output_files[isolate_stem] = dst
+                on_saved(output_files, 2)
+                break
+        
+        # Now combine all other stems into "instrumental" or "backing"
+        # We'll use ffmpeg to mix them
+        other_stems = [s for s in all_stems if s != isolate_stem]
+        stem_files = []
+        for stem in other_stems:
+            for ext in [demucs_ext, 'mp3', 'wav']:
+                src = safe_join(demucs_output, f"{stem}.{ext}")
+                if os.path.exists(src):
+                    stem_files.append(src)
+                    break
+        
+        if stem_files:
+            # Use ffmpeg to mix the remaining stems
+            backing_name = "instrumental" if isolate_stem == "vocals" else "backing"
+            logger.info(f"[Stem] Mixing remaining stems into {backing_name}: {', '.join(other_stems)}")
+            dst_filename = f"{original_name_no_ext}_t2s_{backing_name}.{actual_output_format}"
+            dst = safe_join(job_output_dir, dst_filename)
+            # normalize=1 to properly normalize the mixed output and prevent clipping
+            if mix_stems(stem_files, dst, actual_output_format, mp3_bitrate, normalize=True):
+                output_files[backing_name] = dst
+                on_saved(output_files, 2)
+                logger.info(f"Created combined backing track: {dst}")
+    elif options['stem_groups']:
+        # Preset outputs, each one or a mix of several of the model's stems
+        groups = options['stem_groups']
+        for name, sources in groups:
+            logger.info(f"[Stem] Processing {name}: {', '.join(sources)}")
+            stem_files = []
+            for stem in sources:
+                for ext in [demucs_ext, 'mp3', 'wav']:
+                    src = safe_join(demucs_output, f"{stem}.{ext}")
+                    if os.path.exists(src):
+                        stem_files.append(src)
+                        break
+            if len(stem_files) != len(sources):
+                logger.error(f"Missing stems for {name}: found {stem_files}")
+                continue
+            if len(stem_files) == 1 and actual_output_format == 'flac':
+                dst = safe_join(job_output_dir, f"{original_name_no_ext}_t2s_{name}.flac")
+                convert_to_flac(stem_files[0], dst)
+            elif len(stem_files) == 1:
+                ext = os.path.splitext(stem_files[0])[1]
+                dst = safe_join(job_output_dir, f"{original_name_no_ext}_t2s_{name}{ext}")
+                shutil.move(stem_files[0], dst)
+            else:
+                dst = safe_join(job_output_dir, f"{original_name_no_ext}_t2s_{name}.{actual_output_format}")
+                # Summed as they are, so the outputs still add up to the input
+                if not mix_stems(stem_files, dst, actual_output_format, mp3_bitrate, normalize=False):
+                    continue
+            logger.info(f"Preset stem saved: {dst}")
+            output_files[name] = dst
+            on_saved(output_files, len(groups))
+    else:
+        # All stems mode: output all stems
+        for stem in all_stems:
+            logger.info(f"[Stem] Processing stem: {stem}")
+            for ext in [demucs_ext, 'mp3', 'wav']:
+                src = safe_join(demucs_output, f"{stem}.{ext}")
+                if os.path.exists(src):
+                    if actual_output_format == 'flac':
+                        dst_filename = f"{original_name_no_ext}_t2s_{stem}.flac"
+                        dst = safe_join(job_output_dir, dst_filename)
+                        convert_to_flac(src, dst)
+                    else:
+                        dst_filename = f"{original_name_no_ext}_t2s_{stem}.{ext}"
+                        dst = safe_join(job_output_dir, dst_filename)
+                        shutil.move(src, dst)
+                    logger.info(f"Stem saved: {dst}")
+                    output_files[stem] = dst
+                    on_saved(output_files, len(all_stems))
+                    break
+    return output_files, demucs_output
+
+def mix_stems(stem_files, dst, output_format, mp3_bitrate, normalize):
+    """Mix stem_files into dst with ffmpeg, normalized by the number of
+    inputs or summed as they are. Returns whether it worked; a failed mix
+    leaves no dst behind."""
+    ffmpeg_cmd = ['ffmpeg', '-y']
+    for f in stem_files:
+        ffmpeg_cmd.extend(['-i', f])
+    filter_complex = f"amix=inputs={len(stem_files)}:duration=longest:normalize={1 if normalize else 0}"
+    ffmpeg_cmd.extend(['-filter_complex', filter_complex])
+    if output_format == 'mp3':
+        ffmpeg_cmd.extend(['-b:a', f'{mp3_bitrate}k'])
+    ffmpeg_cmd.append(dst)
+    
+    logger.info(f"Mixing stems with ffmpeg: {' '.join(ffmpeg_cmd)}")
+    try:
+        mix_result = subprocess.run(
+            ffmpeg_cmd, capture_output=True, text=True, timeout=600
+        )
+    except subprocess.TimeoutExpired:
+        if os.path.exists(dst):
+            os.remove(dst)
+        logger.error("FFmpeg mix timed out")
+        return False
+    if mix_result.returncode != 0:
+        if os.path.exists(dst):
+            os.remove(dst)
+        logger.error(f"FFmpeg mix failed: {mix_result.stderr}")
+        return False
+    return True
+
+def watermark_filter(mode, job_id):
+    """The ffmpeg aeval filter adding a watermark to every channel.
+
+    The inaudible mark repeats an 80-bit frame: the sync word, then the
+    first 16 hex digits of the job ID as four 16-bit words, most significant
+    bit first, a bit being the carrier on (1) or off (0) for bit_seconds.
+    """
+    if mode == 'tone':
+        t = WATERMARK_TONE
+        expr = f"val(ch)+{t['level']}*lt(mod(t,{t['every']}),{t['length']})*sin(2*PI*{t['hz']}*t)"
+    else:
+        c = WATERMARK_CARRIER
+        payload = int(job_id.replace('-', '')[:16].ljust(16, '0'), 16)
+        words = [c['sync']] + [(payload >> shift) & 0xFFFF for shift in (48, 32, 16, 0)]
+        word = str(words[-1])
+        for i in range(len(words) - 2, -1, -1):
+            word = f"if(lt(ld(0),{16 * (i + 1)}),{words[i]},{word})"
+        # ld(0) is the bit's index in the frame, ld(1) the word holding it
+        expr = (f"st(0,mod(floor(t/{c['bit_seconds']}),80));st(1,{word});"
+                f"val(ch)+{c['level']}*mod(floor(ld(1)/pow(2,15-mod(ld(0),16))),2)*sin(2*PI*{c['hz']}*t)")
+    return f"aeval=exprs='{expr}':c=same"
+
+def apply_watermark(path, mode, job_id, mp3_bitrate):
+    """Embed the watermark into a stem in place, in its own format and
+    sample format. A stem that can't be marked is deleted, never handed
+    out clean, and RuntimeError raised."""
+    tmp = f"{path}.watermark{os.path.splitext(path)[1]}"
+    cmd = ['ffmpeg', '-nostdin', '-y', '-i', path, '-af', watermark_filter(mode, job_id)]
+    ext = os.path.splitext(path)[1].lower()
+    if ext == '.mp3':
+        cmd.extend(['-b:a', f'{mp3_bitrate}k'])
+    else:
+        try:
+            probe = subprocess.run(
+                ['ffprobe', '-v', 'error', '-select_streams', 'a:0',
+                 '-show_entries', 'stream=codec_name,sample_fmt', '-of', 'json', path],
+                capture_output=True, text=True, timeout=30)
+            stream = json.loads(probe.stdout)['streams'][0]
+        except (OSError, subprocess.TimeoutExpired, ValueError, KeyError, IndexError):
+            stream = {}
+        if ext == '.wav' and stream.get('codec_name'):
+            cmd.extend(['-c:a', stream['codec_name']])
+        elif ext == '.flac' and stream.get('sample_fmt'):
+            cmd.extend(['-sample_fmt', stream['sample_fmt']])
+    cmd.append(tmp)
+    try:
+        result = subprocess.run(cmd, capture_output=True, text=True, timeout=600)
+        ok = result.returncode == 0
+        if not ok:
+            logger.error(f"FFmpeg watermark failed: {result.stderr}")
+    except subprocess.TimeoutExpired:
+        logger.error("FFmpeg watermark timed out")
+        ok = False
+    if ok:
+        os.replace(tmp, path)
+        return
+    for leftover in (tmp, path):
+        if os.path.exists(leftover):
+            os.remove(leftover)
+    raise RuntimeError(f'Failed to watermark {os.path.basename(path)}')
+
+def input_notes(input_path):
+    """Notes on how Demucs changes the input before separating it.
+
+    Demucs works on 44.1 kHz stereo: mono inputs are upmixed (the stems are
+    dual mono), only the first two channels of surround inputs are kept and
+    other sample rates are resampled.
+    """
+    try:
+        probe = subprocess.run(
+            ['ffprobe', '-v', 'error', '-select_streams', 'a:0',
+             '-show_entries', 'stream=channels,sample_rate', '-of', 'json', input_path],
+            capture_output=True, text=True, timeout=30)
+        stream = json.loads(probe.stdout)['streams'][0]
+        channels, rate = int(stream['channels']), int(stream['sample_rate'])
+    except (OSError, subprocess.TimeoutExpired, ValueError, KeyError, IndexError):
+        return []
+    notes = []
+    if channels == 1:
+        notes.append({'code': 'mono_upmixed', 'level': 'info',
+                      'message': 'Mono input was upmixed to stereo, so every stem is dual mono'})
+    elif channels > 2:
+        notes.append({'code': 'channels_dropped', 'level': 'warning',
+                      'message': f'Only the first 2 of the input\'s {channels} channels were separated'})
+    if rate != 44100:
+        notes.append({'code': 'resampled', 'level': 'info',
+                      'message': f'Input was resampled from {rate} Hz to 44100 Hz'})
+    return notes
+
+
+def peak_db(path):
+    """The peak level of an audio file in dBFS, or None when unreadable."""
+    try:
+        result = subprocess.run(['ffmpeg', '-nostdin', '-i', path, '-af', 'volumedetect', '-f', 'null', '-'],
+                                capture_output=True, text=True, timeout=120)
+    except (OSError, subprocess.TimeoutExpired):
+        return None
+    match = re.search(r'max_volume: (-?[0-9.]+) dB', result.stderr)
+    return float(match.group(1)) if match else None
+
+
+def stem_notes(output_files, clip_mode):
+    """Notes on stems that reached full scale.
+
+    Demucs keeps stems in range either by turning a stem that would clip
+    down as a whole (clip_mode rescale, leaving it to peak just under
+    0 dBFS) or by clamping the samples (clamp, which clips them).
+    """
+    notes = []
+    for stem, path in sorted(output_files.items()):
+        peak = peak_db(path)
+        if peak is None:
+            continue
+        if clip_mode == 'clamp' and peak >= -0.01:
+            notes.append({'code': 'clipping_clamped', 'level': 'warning', 'stem': stem,
+                          'message': f'The {stem} stem went over full scale and its peaks were clipped'})
+        elif clip_mode != 'clamp' and peak >= -0.1:
+            notes.append({'code': 'clipping_rescaled', 'level': 'info', 'stem': stem,
+                          'message': f'The {stem} stem peaks at {peak:.1f} dBFS: it was turned down to avoid clipping'})
+    return notes
+
+
 @app.route('/process', methods=['POST'])
 def process_audio():
     logger.info("=== Starting new processing request ===")
     job_id = None
+    work_dir = None  # private directory of an encrypted job's plaintext
     start_time = time.time()  # Track processing time
     
     try:
@@ -203,89 +1265,27 @@ def process_audio():
         
         file = request.files['file']
         job_id = request.form.get('job_id', 'unknown')
-        output_format = request.form.get('output_format', 'mp3').lower()  # mp3, wav, or flac
-        stem_mode = request.form.get('stem_mode', 'all').lower()  # 'all' or 'isolate'
-        isolate_stem = request.form.get('isolate_stem', 'vocals').lower()  # which stem to isolate
-        model = request.form.get('model', 'htdemucs_6s').lower()  # demucs model
-        if model not in ALLOWED_DEMUCS_MODELS:
-            logger.error(f"Invalid model requested: {model}")
-            return jsonify({
-                'error': 'Invalid model',
-                'allowed_models': sorted(ALLOWED_DEMUCS_MODELS),
-            }), 400
-        safe_model = DEMUCS_MODEL_ARG_MAP[model]
-        clip_mode = request.form.get('clip_mode', 'rescale').lower()  # rescale or clamp
-        
-        # Parse numeric options – reject non-parseable values with 400
-        shifts_raw = request.form.get('shifts')
-        if shifts_raw is None or shifts_raw == '':
-            shifts = 0
-        else:
-            try:
-                shifts = int(shifts_raw)
-            except (ValueError, TypeError):
-                logger.error(f"Invalid shifts value: {shifts_raw}")
-                return jsonify({'error': 'Invalid shifts value'}), 400
-        
-        segment_raw = request.form.get('segment', '')
-        segment = None
-        if segment_raw:
-            try:
-                segment = int(segment_raw)
-            except (ValueError, TypeError):
-                logger.error(f"Invalid segment value: {segment_raw}")
-                return jsonify({'error': 'Invalid segment value'}), 400
-        
-        overlap_raw = request.form.get('overlap', '')
-        overlap = None
-        if overlap_raw:
-            try:
-                overlap = float(overlap_raw)
-            except (ValueError, TypeError):
-                logger.error(f"Invalid overlap value: {overlap_raw}")
-                return jsonify({'error': 'Invalid overlap value'}), 400
-        
         # Validate user inputs to prevent injection and path traversal
         if not validate_job_id(job_id):
             logger.error(f"Invalid job ID: {job_id}")
             return jsonify({'error': 'Invalid job ID'}), 400
         
-        if output_format not in ALLOWED_OUTPUT_FORMATS:
-            logger.error(f"Invalid output format: {output_format}")
-            return jsonify({'error': 'Invalid output format'}), 400
-        
-        if stem_mode not in ALLOWED_STEM_MODES:
-            logger.error(f"Invalid stem mode: {stem_mode}")
-            return jsonify({'error': 'Invalid stem mode'}), 400
-        
-        if isolate_stem not in ALLOWED_STEMS:
-            logger.error(f"Invalid isolate stem: {isolate_stem}")
-            return jsonify({'error': 'Invalid isolate stem'}), 400
-        
-        if model not in ALLOWED_MODELS:
-            logger.error(f"Invalid model: {model}")
-            return jsonify({'error': 'Invalid model'}), 400
-        
-        # Ensure isolate_stem is compatible with the selected model
-        if model not in SIX_STEM_MODELS and isolate_stem in {'guitar', 'piano'}:
-            logger.error(f"Incompatible isolate stem '{isolate_stem}' for model '{model}'")
-            return jsonify({'error': 'Incompatible isolate_stem for selected model'}), 400
+        options, error = parse_separation_options(request.form)
+        if error:
+            return error
+        output_format, stem_mode, isolate_stem = options['output_format'], options['stem_mode'], options['isolate_stem']
+        model, custom, safe_model, clip_mode = options['model'], options['custom'], options['safe_model'], options['clip_mode']
+        shifts, mp3_bitrate, segment, overlap = options['shifts'], options['mp3_bitrate'], options['segment'], options['overlap']
+        deterministic, seed = options['deterministic'], options['seed']
         
-        if clip_mode not in ALLOWED_CLIP_MODES:
-            logger.error(f"Invalid clip mode: {clip_mode}")
-            return jsonify({'error': 'Invalid clip mode'}), 400
-        
-        if shifts not in ALLOWED_SHIFTS:
-            logger.error(f"Invalid shifts value: {shifts}")
-            return jsonify({'error': 'Invalid shifts value'}), 400
-        
-        if segment is not None and segment not in ALLOWED_SEGMENTS:
-            logger.error(f"Invalid segment value: {segment}")
-            return jsonify({'error': 'Invalid segment value'}), 400
-        
-        if overlap is not None and overlap not in ALLOWED_OVERLAPS:
-            logger.error(f"Invalid overlap value: {overlap}")
-            return jsonify({'error': 'Invalid overlap value'}), 400
+        # Encrypted jobs: the job key only ever exists in this process
+        job_key = None
+        if request.form.get('encrypted') == 'true':
+            try:
+                job_key = open_sealed_key(request.form.get('sealed_key', ''))
+            except ValueError as e:
+                logger.error(f"Cannot open the job key of {job_id}: {e}")
+                return jsonify({'error': f'Cannot open sealed_key: {e}'}), 400
         
         segment_str = f'{segment}s' if segment is not None else 'default'
         logger.info(f"Job ID: {job_id}, File: {file.filename}, Model: {model}, Format: {output_format}, Mode: {stem_mode}, Isolate: {isolate_stem}, Segment: {segment_str}, Overlap: {overlap}, Shifts: {shifts}, Clip: {clip_mode}")
@@ -313,7 +1313,7 @@ def process_audio():
         logger.info(f"Requested format: {output_format}, Demucs output: {demucs_output_fmt}")
         
         # Save uploaded file
-        filename = secure_filename(file.filename)
+        filename = safe_filename(file.filename)
         # The filename from backend includes job_id prefix like "uuid_originalname.mp3"
         # Extract the original filename by removing the job_id prefix if present
         if filename.startswith(job_id + '_'):
@@ -321,10 +1321,26 @@ def process_audio():
         else:
             original_filename = filename
         
-        input_path = safe_join(UPLOAD_FOLDER, f"{job_id}_{original_filename}")
-        logger.info(f"Saving file to: {input_path}")
-        logger.info(f"Original filename: {original_filename}")
-        file.save(input_path)
+        if job_key is None:
+            input_path = safe_join(UPLOAD_FOLDER, f"{job_id}_{original_filename}")
+            logger.info(f"Saving file to: {input_path}")
+            logger.info(f"Original filename: {original_filename}")
+            file.save(input_path)
+        else:
+            # The plaintext and Demucs' stems stay off the shared volumes
+            work_dir = tempfile.mkdtemp(prefix='track2stem-')
+            options['demucs_root'] = work_dir
+            encrypted_path = safe_join(work_dir, f"{job_id}_{original_filename}.enc")
+            input_path = safe_join(work_dir, f"{job_id}_{original_filename}")
+            file.save(encrypted_path)
+            try:
+                decrypt_file(job_key, encrypted_path, input_path)
+            except ValueError as e:
+                logger.error(f"Cannot decrypt the upload of {job_id}: {e}")
+                processing_status[job_id] = {'status': 'failed', 'progress': 0, 'stage': 'Decryption failed'}
+                return jsonify({'error': f'Cannot decrypt the upload: {e}'}), 400
+            os.remove(encrypted_path)
+            logger.info(f"Decrypted encrypted upload into {work_dir}")
         
         file_size = os.path.getsize(input_path)
         logger.info(f"File saved successfully. Size: {file_size / (1024*1024):.2f} MB")
@@ -335,45 +1351,19 @@ def process_audio():
         job_output_dir = safe_join(OUTPUT_FOLDER, job_id)
         os.makedirs(job_output_dir, exist_ok=True)
         logger.info(f"Output directory created: {job_output_dir}")
+        # Encrypted jobs' stems are collected privately, then encrypted into it
+        stems_dir = job_output_dir if job_key is None else safe_join(work_dir, job_id)
+        os.makedirs(stems_dir, exist_ok=True)
         
         # Run Demucs separation
         processing_status[job_id] = {'status': 'processing', 'progress': 15, 'stage': f'Loading AI model ({safe_model})'}
-        expected_stems = ['vocals', 'drums', 'bass', 'guitar', 'piano', 'other'] if model in SIX_STEM_MODELS else ['vocals', 'drums', 'bass', 'other']
+        expected_stems = model_stems(model)
         logger.info(f"Starting Demucs separation: file='{original_filename}', model={safe_model}, segment={segment_str}, stems=[{', '.join(expected_stems)}]")
         
-        cmd = [
-            'python', '-m', 'demucs',
-            '-o', OUTPUT_FOLDER,
-            '-n', safe_model,
-        ]
-        
-        # Add format-specific options
-        if demucs_output_fmt == 'mp3':
-            cmd.extend([
-                '--mp3',
-                '--mp3-bitrate', '320',  # Highest quality MP3 (320 kbps)
-            ])
-        # For WAV/FLAC output, demucs outputs WAV by default (no --mp3 flag)
-        
-        # Add clip mode
-        if clip_mode == 'clamp':
-            cmd.extend(['--clip-mode', 'clamp'])
-        
-        # Add shifts (shift trick for better quality, N times slower)
-        if shifts > 0:
-            cmd.extend(['--shifts', str(shifts)])
+        notes = input_notes(input_path)
+        cmd = demucs_command(options, [input_path])
         
-        # Add segment size (for memory management)
-        if segment is not None:
-            cmd.extend(['--segment', str(segment)])
-        
-        # Add overlap
-        if overlap is not None:
-            cmd.extend(['--overlap', str(overlap)])
-        
-        cmd.append(input_path)
-        
-        logger.info(f"Running command: {' '.join(cmd)}")
+        logger.info(f"Running command: {' '.join(cmd[3:] if deterministic else cmd)}")
         processing_status[job_id] = {'status': 'processing', 'progress': 10, 'stage': f'Starting AI separation of {original_filename} ({safe_model}, segment {segment_str})...'}
         
         # Use PTY to capture tqdm progress output (tqdm uses \r for updates)
@@ -385,9 +1375,14 @@ def process_audio():
             stdout=slave_fd,
             stderr=slave_fd,
             close_fds=True,
-            env={**os.environ, 'CUDA_VISIBLE_DEVICES': '', 'PYTHONUNBUFFERED': '1', 'TERM': 'xterm'}
+            env={
+                **os.environ, 'CUDA_VISIBLE_DEVICES': '', 'PYTHONUNBUFFERED': '1', 'TERM': 'xterm',
+                **({'PYTHONHASHSEED': str(seed), 'CUBLAS_WORKSPACE_CONFIG': ':4096:8'} if deterministic else {}),
+            }
         )
         
+        demucs_started = time.time()
+        
         # Close slave FD in parent process
         os.close(slave_fd)
         
@@ -411,6 +1406,30 @@ def process_audio():
             secs = int(seconds % 60)
             return f"{mins}m {secs}s" if mins > 0 else f"{secs}s"
         
+        watermarked = set()
+        
+        def mark_stems(output_files):
+            """Watermark the stems saved since the last call"""
+            for stem, path in output_files.items():
+                if options['watermark'] and stem not in watermarked:
+                    apply_watermark(path, options['watermark'], job_id, mp3_bitrate)
+                    watermarked.add(stem)
+        
+        def stem_saved(output_files, total):
+            """List the stems written so far in the job status, so the backend
+            can serve them while the rest are still being encoded (not those
+            of encrypted jobs, which are encrypted once all are saved).
+            Watermarks go in first."""
+            mark_stems(output_files)
+            processing_status[job_id] = {
+                'status': 'processing',
+                'progress': 90 + 5 * len(output_files) / max(total, 1),
+                'stage': f'Saved {len(output_files)} of {total} stems',
+                'elapsed': format_elapsed(time.time() - start_time),
+            }
+            if job_key is None:
+                processing_status[job_id]['outputs'] = dict(output_files)
+        
         def update_progress(new_progress, stage_msg):
             """Thread-safe progress update"""
             nonlocal last_progress
@@ -573,6 +1592,8 @@ def process_audio():
                     del active_processes[job_id]
             raise subprocess.TimeoutExpired(cmd, 1800)
         
+        compute = compute_report(demucs_started)
+        
         # Signal threads to stop and clean up
         stop_threads.set()
         try:
@@ -601,139 +1622,24 @@ def process_audio():
         processing_status[job_id] = {'status': 'processing', 'progress': 90, 'stage': f'AI separation of {original_filename} complete, organizing files...', 'elapsed': format_elapsed(elapsed)}
         logger.info(f"Demucs completed successfully for '{original_filename}' (model={model}, segment={segment_str}), organizing output files...")
         
-        # Demucs creates: OUTPUT_FOLDER/{model}/filename_without_ext/stem.mp3 (or .wav)
-        # Use the original filename with job_id prefix consistently
-        filename_no_ext = os.path.splitext(f"{job_id}_{original_filename}")[0]
-        demucs_output = safe_join(OUTPUT_FOLDER, model, filename_no_ext)
-        
-        logger.info(f"Looking for output in: {demucs_output}")
-        
-        if not os.path.exists(demucs_output):
-            # Try alternate paths for the model
-            alt_path = safe_join(OUTPUT_FOLDER, model, os.path.splitext(filename)[0])
-            logger.info(f"Trying alternate path: {alt_path}")
-            if os.path.exists(alt_path):
-                demucs_output = alt_path
-            else:
-                # List what's actually there
-                model_dir = safe_join(OUTPUT_FOLDER, model)
-                if os.path.exists(model_dir):
-                    contents = os.listdir(model_dir)
-                    logger.info(f"Contents of {model} dir: {contents}")
-                    if contents:
-                        demucs_output = safe_join(model_dir, contents[0])
-                        logger.info(f"Using first directory: {demucs_output}")
-        
-        # Move files to job output directory and collect paths
-        output_files = {}
-        # Determine available stems based on model
-        if model in SIX_STEM_MODELS:
-            all_stems = ['vocals', 'drums', 'bass', 'guitar', 'piano', 'other']
-        else:
-            all_stems = ['vocals', 'drums', 'bass', 'other']
-        demucs_ext = 'wav' if demucs_output_fmt == 'wav' else 'mp3'
-        
-        # Get original filename without extension for naming output files
-        original_name_no_ext = os.path.splitext(original_filename)[0]
-        
-        if stem_mode == 'isolate':
-            # Isolate mode: output the isolated stem + combined "other" track
-            logger.info(f"Isolate mode: extracting {isolate_stem} and combining the rest")
-            
-            # First, get the isolated stem
-            logger.info(f"[Stem] Processing isolated stem: {isolate_stem}")
-            for ext in [demucs_ext, 'mp3', 'wav']:
-                src = safe_join(demucs_output, f"{isolate_stem}.{ext}")
-                if os.path.exists(src):
-                    if actual_output_format == 'flac':
-                        dst_filename = f"{original_name_no_ext}_t2s_{isolate_stem}.flac"
-                        dst = safe_join(job_output_dir, dst_filename)
-                        convert_to_flac(src, dst)
-                    else:
-                        dst_filename = f"{original_name_no_ext}_t2s_{isolate_stem}.{ext}"
-                        dst = safe_join(job_output_dir, dst_filename)
-                        shutil.move(src, dst)
-                    logger.info(f"Isolated stem saved: {dst}")
-                    output_files[isolate_stem] = dst
-                    break
-            
-            # Now combine all other stems into "instrumental" or "backing"
-            # We'll use ffmpeg to mix them
-            other_stems = [s for s in all_stems if s != isolate_stem]
-            stem_files = []
-            for stem in other_stems:
-                for ext in [demucs_ext, 'mp3', 'wav']:
-                    src = safe_join(demucs_output, f"{stem}.{ext}")
-                    if os.path.exists(src):
-                        stem_files.append(src)
-                        break
-            
-            if stem_files:
-                # Use ffmpeg to mix the remaining stems
-                backing_name = "instrumental" if isolate_stem == "vocals" else "backing"
-                logger.info(f"[Stem] Mixing remaining stems into {backing_name}: {', '.join(other_stems)}")
-                dst_filename = f"{original_name_no_ext}_t2s_{backing_name}.{actual_output_format}"
-                dst = safe_join(job_output_dir, dst_filename)
-                
-                # Build ffmpeg command to mix multiple audio files
-                ffmpeg_cmd = ['ffmpeg', '-y']
-                for f in stem_files:
-                    ffmpeg_cmd.extend(['-i', f])
-                
-                # Create filter to mix all inputs
-                # Use normalize=1 to properly normalize the mixed output and prevent clipping
-                filter_complex = f"amix=inputs={len(stem_files)}:duration=longest:normalize=1"
-                ffmpeg_cmd.extend(['-filter_complex', filter_complex])
-                
-                # Output settings
-                if actual_output_format == 'mp3':
-                    ffmpeg_cmd.extend(['-b:a', '320k'])
-                ffmpeg_cmd.append(dst)
-                
-                logger.info(f"Mixing stems with ffmpeg: {' '.join(ffmpeg_cmd)}")
-                try:
-                    mix_result = subprocess.run(
-                        ffmpeg_cmd, capture_output=True, text=True, timeout=600
-                    )
-                except subprocess.TimeoutExpired:
-                    if os.path.exists(dst):
-                        os.remove(dst)
-                    logger.error("FFmpeg mix timed out")
-                else:
-                    if mix_result.returncode == 0:
-                        output_files[backing_name] = dst
-                        logger.info(f"Created combined backing track: {dst}")
-                    else:
-                        if os.path.exists(dst):
-                            os.remove(dst)
-                        logger.error(f"FFmpeg mix failed: {mix_result.stderr}")
-        else:
-            # All stems mode: output all stems
-            for stem in all_stems:
-                logger.info(f"[Stem] Processing stem: {stem}")
-                for ext in [demucs_ext, 'mp3', 'wav']:
-                    src = safe_join(demucs_output, f"{stem}.{ext}")
-                    if os.path.exists(src):
-                        if actual_output_format == 'flac':
-                            dst_filename = f"{original_name_no_ext}_t2s_{stem}.flac"
-                            dst = safe_join(job_output_dir, dst_filename)
-                            convert_to_flac(src, dst)
-                        else:
-                            dst_filename = f"{original_name_no_ext}_t2s_{stem}.{ext}"
-                            dst = safe_join(job_output_dir, dst_filename)
-                            shutil.move(src, dst)
-                        logger.info(f"Stem saved: {dst}")
-                        output_files[stem] = dst
-                        break
+        output_files, demucs_output = collect_stems(options, job_id, filename, original_filename, stems_dir, stem_saved)
+        mark_stems(output_files)
         
         logger.info(f"Output files collected: {list(output_files.keys())}")
+        notes.extend(stem_notes(output_files, clip_mode))
+        if job_key is not None:
+            for stem, path in output_files.items():
+                sealed = safe_join(job_output_dir, os.path.basename(path))
+                encrypt_file(job_key, path, sealed)
+                output_files[stem] = sealed
+            logger.info(f"Encrypted {len(output_files)} stems into {job_output_dir}")
         elapsed = time.time() - start_time
-        processing_status[job_id] = {'status': 'processing', 'progress': 95, 'stage': 'Cleaning up', 'elapsed': format_elapsed(elapsed)}
+        processing_status[job_id] = {'status': 'processing', 'progress': 95, 'stage': 'Cleaning up', 'elapsed': format_elapsed(elapsed), 'outputs': dict(output_files)}
         
         # Clean up demucs directory
         if os.path.exists(demucs_output):
             shutil.rmtree(demucs_output)
-        parent_dir = safe_join(OUTPUT_FOLDER, model)
+        parent_dir = safe_join(options['demucs_root'], model)
         if os.path.exists(parent_dir) and not os.listdir(parent_dir):
             os.rmdir(parent_dir)
         
@@ -757,13 +1663,23 @@ def process_audio():
             if job_id in active_processes:
                 del active_processes[job_id]
         
-        return jsonify({
+        response = {
             'status': 'completed',
             'job_id': job_id,
             'outputs': output_files,
             'format': actual_output_format,
-            'processing_time': time_str
-        })
+            'processing_time': time_str,
+            'environment': processing_environment(),
+            'compute': compute,
+        }
+        if notes:
+            response['notes'] = notes
+        if deterministic:
+            response['determinism'] = {'seed': seed, 'shifts': shifts, 'threads': DETERMINISTIC_THREADS}
+        if options['watermark']:
+            # Lets the backend tell marked stems from those of an older processor
+            response['watermark'] = options['watermark']
+        return jsonify(response)
     
     except subprocess.TimeoutExpired:
         logger.error("Processing timeout exceeded")
@@ -776,6 +1692,149 @@ def process_audio():
         if job_id:
             processing_status[job_id] = {'status': 'failed', 'progress': 0, 'stage': 'Error'}
         return jsonify({'error': 'Internal server error'}), 500
+    finally:
+        if work_dir:
+            shutil.rmtree(work_dir, ignore_errors=True)
+
+@app.route('/process/batch', methods=['POST'])
+def process_batch():
+    """Separate several short clips with one Demucs run, so the model is
+    loaded once for all of them. Each file is paired with the job_id field
+    in the same position; the other options apply to every clip. Answers
+    with a result per job: its outputs, or the error that clip failed with.
+    """
+    logger.info("=== Starting new batch processing request ===")
+    start_time = time.time()
+    files = request.files.getlist('file')
+    job_ids = request.form.getlist('job_id')
+    if not files:
+        return jsonify({'error': 'No file provided'}), 400
+    if len(files) != len(job_ids) or len(set(job_ids)) != len(job_ids):
+        return jsonify({'error': 'Every file needs its own job_id'}), 400
+    if len(files) > PROCESS_BATCH_LIMIT:
+        return jsonify({'error': f'At most {PROCESS_BATCH_LIMIT} clips per batch'}), 400
+    for job_id in job_ids:
+        if not validate_job_id(job_id):
+            logger.error(f"Invalid job ID: {job_id}")
+            return jsonify({'error': 'Invalid job ID'}), 400
+    options, error = parse_separation_options(request.form)
+    if error:
+        return error
+    if options['deterministic']:
+        return jsonify({'error': 'Deterministic jobs are separated one at a time'}), 400
+    if request.form.get('encrypted') == 'true':
+        return jsonify({'error': 'Encrypted jobs are separated one at a time'}), 400
+    if options['watermark']:
+        return jsonify({'error': 'Watermarked jobs are separated one at a time'}), 400
+    for file in files:
+        if not allowed_file(file.filename):
+            logger.error(f"File type not allowed: {file.filename}")
+            return jsonify({'error': 'File type not allowed'}), 400
+
+    clips = []  # job_id, saved name, original name, input path
+    try:
+        for job_id, file in zip(job_ids, files):
+            filename = safe_filename(file.filename)
+            original_filename = filename[len(job_id) + 1:] if filename.startswith(job_id + '_') else filename
+            input_path = safe_join(UPLOAD_FOLDER, f"{job_id}_{original_filename}")
+            file.save(input_path)
+            clips.append((job_id, filename, original_filename, input_path))
+            processing_status[job_id] = {'status': 'processing', 'progress': 15, 'stage': f'Separating in a batch of {len(files)} clips'}
+
+        notes = {clip[0]: input_notes(clip[3]) for clip in clips}
+        cmd = demucs_command(options, [clip[3] for clip in clips])
+        logger.info(f"Running batch of {len(clips)} clips: {' '.join(cmd)}")
+        process = subprocess.Popen(
+            cmd, stdout=subprocess.PIPE, stderr=subprocess.STDOUT, text=True,
+            env={**os.environ, 'CUDA_VISIBLE_DEVICES': '', 'PYTHONUNBUFFERED': '1'},
+        )
+        batch = {'process': process, 'members': set(job_ids), 'cancelled': set()}
+        with process_lock:
+            for job_id in job_ids:
+                active_processes[job_id] = batch
+        demucs_started = time.time()
+        try:
+            output, _ = process.communicate(timeout=1800)  # 30 min timeout
+        except subprocess.TimeoutExpired:
+            process.kill()
+            process.communicate()
+            raise
+        finally:
+            with process_lock:
+                for job_id in job_ids:
+                    if active_processes.get(job_id) is batch:
+                        del active_processes[job_id]
+
+        compute = compute_report(demucs_started)
+        if process.returncode != 0 and batch['cancelled'] != batch['members']:
+            logger.error(f"Demucs failed with return code {process.returncode}")
+            logger.error(f"Output: {output}")
+            for job_id in job_ids:
+                if job_id not in batch['cancelled']:
+                    processing_status[job_id] = {'status': 'failed', 'progress': 0, 'stage': 'Processing failed'}
+            return jsonify({'error': 'Processing failed', 'details': output}), 500
+
+        results = {}
+        for job_id, filename, original_filename, input_path in clips:
+            if job_id in batch['cancelled']:
+                results[job_id] = {'error': 'Cancelled'}
+                demucs_output = safe_join(OUTPUT_FOLDER, options['model'], os.path.splitext(os.path.basename(input_path))[0])
+                if os.path.exists(demucs_output):
+                    shutil.rmtree(demucs_output)
+                continue
+            job_output_dir = safe_join(OUTPUT_FOLDER, job_id)
+            os.makedirs(job_output_dir, exist_ok=True)
+            try:
+                output_files, demucs_output = collect_stems(
+                    options, job_id, filename, original_filename, job_output_dir,
+                    lambda saved, total: None, guess_output=False)
+            except RuntimeError as e:
+                logger.error(f"Collecting stems of job {job_id} failed: {e}")
+                results[job_id] = {'error': str(e)}
+                processing_status[job_id] = {'status': 'failed', 'progress': 0, 'stage': 'Processing failed'}
+                continue
+            if os.path.exists(demucs_output):
+                shutil.rmtree(demucs_output)
+            if output_files:
+                results[job_id] = {'outputs': output_files}
+                clip_notes = notes[job_id] + stem_notes(output_files, options['clip_mode'])
+                if clip_notes:
+                    results[job_id]['notes'] = clip_notes
+                processing_status[job_id] = {'status': 'completed', 'progress': 100, 'stage': 'Complete!'}
+            else:
+                results[job_id] = {'error': 'Demucs wrote no stems'}
+                processing_status[job_id] = {'status': 'failed', 'progress': 0, 'stage': 'Processing failed'}
+        parent_dir = safe_join(OUTPUT_FOLDER, options['model'])
+        if os.path.exists(parent_dir) and not os.listdir(parent_dir):
+            os.rmdir(parent_dir)
+
+        total_time = time.time() - start_time
+        minutes, seconds = int(total_time // 60), int(total_time % 60)
+        time_str = f"{minutes}m {seconds}s" if minutes > 0 else f"{seconds}s"
+        logger.info(f"=== Batch of {len(clips)} clips completed: model={options['model']}, time={time_str} ===")
+        return jsonify({
+            'status': 'completed',
+            'results': results,
+            'format': options['output_format'],
+            'processing_time': time_str,
+            'environment': processing_environment(),
+            'compute': compute,
+        })
+    except subprocess.TimeoutExpired:
+        logger.error("Batch processing timeout exceeded")
+        for job_id in job_ids:
+            processing_status[job_id] = {'status': 'failed', 'progress': 0, 'stage': 'Timeout'}
+        return jsonify({'error': 'Processing timeout'}), 500
+    except Exception as e:
+        logger.error(f"Unexpected error: {str(e)}")
+        logger.error(traceback.format_exc())
+        for job_id in job_ids:
+            processing_status[job_id] = {'status': 'failed', 'progress': 0, 'stage': 'Error'}
+        return jsonify({'error': 'Internal server error'}), 500
+    finally:
+        for clip in clips:
+            if os.path.exists(clip[3]):
+                os.remove(clip[3])
 
 if __name__ == '__main__':
     port = int(os.environ.get('PORT', 5000))
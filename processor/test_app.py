@@ -1,8 +1,10 @@
 """Tests for input validation and path safety in processor/app.py"""
 import os
 import json
+import gzip
 import io
 import pytest
+from unittest.mock import MagicMock
 
 from app import (
     validate_job_id,
@@ -18,7 +20,9 @@ from app import (
     ALLOWED_SEGMENTS,
     ALLOWED_OVERLAPS,
     SIX_STEM_MODELS,
+    processing_environment,
 )
+import app as app_module
 
 
 class TestValidateJobId:
@@ -113,6 +117,35 @@ class TestEndpointValidation:
         resp = client.get('/status/abc-123-def')
         assert resp.status_code == 200
 
+    def test_request_id_echoed(self, client):
+        resp = client.get('/health', headers={'X-Request-ID': 'req-42'})
+        assert resp.headers['X-Request-ID'] == 'req-42'
+        assert 'X-Request-ID' not in client.get('/health').headers
+
+    def test_accept_encoding_advertised(self, client):
+        assert client.get('/health').headers['Accept-Encoding'] == 'gzip'
+
+    def test_process_gzip_body(self, client):
+        body = (
+            b'--b\r\nContent-Disposition: form-data; name="job_id"\r\n\r\n../x\r\n'
+            b'--b\r\nContent-Disposition: form-data; name="file"; filename="t.wav"\r\n'
+            b'Content-Type: audio/wav\r\n\r\n' + b'\x00' * 4096 + b'\r\n--b--\r\n'
+        )
+        resp = client.post(
+            '/process',
+            data=gzip.compress(body),
+            content_type='multipart/form-data; boundary=b',
+            headers={'Content-Encoding': 'gzip'},
+        )
+        # The form was read, or this would be "No file provided"
+        assert resp.status_code == 400
+        assert json.loads(resp.data)['error'] == 'Invalid job ID'
+
+    def test_process_unsupported_encoding(self, client):
+        resp = client.post('/process', data=b'x', headers={'Content-Encoding': 'br'})
+        assert resp.status_code == 415
+        assert resp.headers['Accept-Encoding'] == 'gzip'
+
     def test_cancel_invalid_job_id(self, client):
         resp = client.post('/cancel/abc;rm -rf')
         assert resp.status_code == 400
@@ -261,6 +294,40 @@ class TestEndpointValidation:
         body = json.loads(resp.data)
         assert body['error'] == 'Invalid overlap value'
 
+    def test_process_invalid_mp3_bitrate(self, client):
+        data = {
+            'job_id': 'valid-job-ddd',
+            'output_format': 'mp3',
+            'stem_mode': 'all',
+            'mp3_bitrate': '64',
+        }
+        resp = client.post(
+            '/process',
+            data={**data, 'file': (io.BytesIO(b'fake audio'), 'test.mp3')},
+            content_type='multipart/form-data',
+        )
+        assert resp.status_code == 400
+        body = json.loads(resp.data)
+        assert body['error'] == 'Invalid mp3_bitrate value'
+
+    def test_process_segment_with_transformer_model(self, client):
+        """Transformer models reject a custom segment length."""
+        data = {
+            'job_id': 'valid-job-eee',
+            'output_format': 'mp3',
+            'stem_mode': 'all',
+            'model': 'htdemucs',
+            'segment': '10',
+        }
+        resp = client.post(
+            '/process',
+            data={**data, 'file': (io.BytesIO(b'fake audio'), 'test.mp3')},
+            content_type='multipart/form-data',
+        )
+        assert resp.status_code == 400
+        body = json.loads(resp.data)
+        assert body['error'] == 'segment is not supported by transformer models'
+
     def test_process_flac_format_accepted(self, client):
         """Verify 'flac' is accepted by the output_format validator."""
         assert 'flac' in ALLOWED_OUTPUT_FORMATS
@@ -350,3 +417,370 @@ class TestModelStemMapping:
                      'mdx', 'mdx_extra', 'mdx_q', 'mdx_extra_q'}
         for m in four_stem:
             assert m not in SIX_STEM_MODELS
+
+
+class TestProcessingEnvironment:
+    """Environment labels reported with each job."""
+
+    def test_reports_instance_and_device(self):
+        env = processing_environment()
+        assert env['instance']
+        assert env['device'] in ('cpu', 'cuda')
+        for key in ('image', 'gpu', 'demucs_version', 'torch_version'):
+            assert key in env
+
+    def test_compute_report(self, monkeypatch):
+        monkeypatch.setattr(app_module.time, 'time', lambda: 1042.04)
+        report = app_module.compute_report(1000)
+        assert report == {'device': processing_environment()['device'], 'seconds': 42.0}
+
+
+class TestModelAssets:
+    """Model inventory and downloads."""
+
+    @pytest.fixture
+    def client(self, tmp_path, monkeypatch):
+        monkeypatch.setattr(app_module, 'model_checkpoint_dir', lambda: str(tmp_path))
+        monkeypatch.setattr(app_module, 'model_weight_files',
+                            lambda name: ['955717e8-8726e21a.th'] if name == 'htdemucs' else ['0d19c1c6-0f06f20e.th', '7ecf8ec1-70f50cc9.th'])
+        (tmp_path / '955717e8-8726e21a.th').write_bytes(b'weights')
+        (tmp_path / '0d19c1c6-0f06f20e.th').write_bytes(b'partial')
+        app.config['TESTING'] = True
+        with app.test_client() as client:
+            yield client
+
+    def test_lists_cached_models(self, client):
+        resp = client.get('/models')
+        assert resp.status_code == 200
+        models = {m['name']: m for m in json.loads(resp.data)['models']}
+        assert set(models) == ALLOWED_DEMUCS_MODELS
+        assert models['htdemucs'] == {'name': 'htdemucs', 'installed': True,
+                                      'version': '955717e8-8726e21a', 'size_bytes': 7}
+        # Only one of mdx's weight files is there
+        assert models['mdx']['installed'] is False
+
+    def test_download_invalid_model(self, client):
+        resp = client.post('/models/whisper/download')
+        assert resp.status_code == 400
+        assert json.loads(resp.data)['error'] == 'Invalid model'
+
+    def test_download_already_running(self, client, monkeypatch):
+        monkeypatch.setitem(app_module.model_downloads, 'htdemucs', {'status': 'downloading'})
+        resp = client.post('/models/htdemucs/download')
+        assert resp.status_code == 409
+
+
+class TestCustomModels:
+    """Registering custom checkpoints."""
+
+    @pytest.fixture
+    def client(self, tmp_path, monkeypatch):
+        checkpoint = tmp_path / 'upload' / 'lab.th'
+        checkpoint.parent.mkdir()
+        checkpoint.write_bytes(b'weights')
+        monkeypatch.setattr(app_module, 'CUSTOM_MODEL_DIR', str(tmp_path / 'models'))
+        monkeypatch.setattr(app_module, 'custom_models', {})
+        monkeypatch.setattr(app_module, 'load_custom_model_sources', lambda name: ['vocals', 'other'])
+        app.config['TESTING'] = True
+        with app.test_client() as client:
+            client.checkpoint = str(checkpoint)
+            yield client
+
+    def test_register_lists_and_deletes(self, client):
+        resp = client.post('/models/custom', json={'name': 'lab_vocals', 'checkpoint': client.checkpoint, 'stems': ['other', 'vocals']})
+        assert resp.status_code == 201
+        body = json.loads(resp.data)
+        assert body['stems'] == ['vocals', 'other'] and body['size_bytes'] == 7 and len(body['version']) == 16
+        models = {m['name']: m for m in json.loads(client.get('/models').data)['models']}
+        assert models['lab_vocals']['installed'] is True
+        # Registrations survive a restart
+        assert 'lab_vocals' in app_module.load_custom_models()
+
+        assert client.delete('/models/custom/lab_vocals').status_code == 200
+        assert client.delete('/models/custom/lab_vocals').status_code == 404
+
+    def test_rejects_mismatched_stems(self, client):
+        resp = client.post('/models/custom', json={'name': 'lab_drums', 'checkpoint': client.checkpoint, 'stems': ['drums', 'other']})
+        assert resp.status_code == 422
+        assert 'separates vocals, other' in json.loads(resp.data)['error']
+        assert 'lab_drums' not in app_module.custom_models
+
+    def test_rejects_invalid_registrations(self, client):
+        for data in (
+            {'name': 'lab-vocals', 'checkpoint': client.checkpoint, 'stems': ['vocals', 'other']},
+            {'name': 'htdemucs', 'checkpoint': client.checkpoint, 'stems': ['vocals', 'other']},
+            {'name': 'lab', 'checkpoint': client.checkpoint, 'stems': ['vocals']},
+            {'name': 'lab', 'checkpoint': client.checkpoint, 'stems': ['vocals', 'strings']},
+        ):
+            assert client.post('/models/custom', json=data).status_code == 400
+        resp = client.post('/models/custom', json={'name': 'lab', 'checkpoint': 'relative.th', 'stems': ['vocals', 'other']})
+        assert resp.status_code == 422
+
+
+class TestBatchProcessing:
+    """Several short clips in one /process/batch request."""
+
+    @pytest.fixture
+    def client(self, monkeypatch):
+        monkeypatch.setattr(app_module, 'active_processes', {})
+        app.config['TESTING'] = True
+        with app.test_client() as client:
+            yield client
+
+    def test_batch_limit_advertised(self, client):
+        resp = client.get('/health')
+        assert resp.headers['X-Batch-Limit'] == str(app_module.PROCESS_BATCH_LIMIT)
+
+    def test_every_file_needs_a_job_id(self, client):
+        resp = client.post('/process/batch', data={
+            'job_id': ['clip-1'],
+            'file': [(io.BytesIO(b'a'), 'a.wav'), (io.BytesIO(b'b'), 'b.wav')],
+        }, content_type='multipart/form-data')
+        assert resp.status_code == 400
+        assert json.loads(resp.data)['error'] == 'Every file needs its own job_id'
+
+    def test_options_are_validated(self, client):
+        resp = client.post('/process/batch', data={
+            'job_id': ['clip-1', 'clip-2'], 'output_format': 'exe',
+            'file': [(io.BytesIO(b'a'), 'a.wav'), (io.BytesIO(b'b'), 'b.wav')],
+        }, content_type='multipart/form-data')
+        assert resp.status_code == 400
+        assert json.loads(resp.data)['error'] == 'Invalid output format'
+
+    def test_deterministic_jobs_are_not_batched(self, client):
+        resp = client.post('/process/batch', data={
+            'job_id': ['clip-1'], 'deterministic': 'true',
+            'file': [(io.BytesIO(b'a'), 'a.wav')],
+        }, content_type='multipart/form-data')
+        assert resp.status_code == 400
+
+    def test_cancel_stops_the_run_with_the_last_clip(self, client):
+        process = MagicMock()
+        process.poll.return_value = None
+        batch = {'process': process, 'members': {'clip-1', 'clip-2'}, 'cancelled': set()}
+        app_module.active_processes.update({'clip-1': batch, 'clip-2': batch})
+
+        assert client.post('/cancel/clip-1').status_code == 200
+        process.terminate.assert_not_called()
+        assert app_module.processing_status['clip-1']['status'] == 'cancelled'
+        assert client.post('/cancel/clip-2').status_code == 200
+        process.terminate.assert_called_once()
+        assert app_module.active_processes == {}
+
+
+class TestHardwareReport:
+    """/health describes the device so the backend can route jobs."""
+
+    @pytest.fixture
+    def client(self):
+        app.config['TESTING'] = True
+        with app.test_client() as client:
+            yield client
+
+    def test_configured_device(self, client, monkeypatch):
+        monkeypatch.setenv('PROCESSOR_DEVICE', 'mps')
+        monkeypatch.setenv('PROCESSOR_UNSUPPORTED_MODELS', 'htdemucs_6s, mdx_q')
+        data = json.loads(client.get('/health').data)
+        assert data['status'] == 'ok'
+        assert data['device'] == 'mps'
+        assert data['capabilities'] == []
+        assert data['unsupported_models'] == ['htdemucs_6s', 'mdx_q']
+
+    def test_capabilities_override(self, client, monkeypatch):
+        monkeypatch.setenv('PROCESSOR_DEVICE', 'rocm')
+        monkeypatch.setenv('PROCESSOR_CAPABILITIES', 'deterministic')
+        assert json.loads(client.get('/health').data)['capabilities'] == ['deterministic']
+
+    def test_detected_device(self, client, monkeypatch):
+        monkeypatch.delenv('PROCESSOR_DEVICE', raising=False)
+        monkeypatch.setattr(app_module, '_processing_environment', {'device': 'cuda'})
+        data = json.loads(client.get('/health').data)
+        assert data['device'] == 'cuda'
+        assert data['capabilities'] == ['deterministic']
+
+    def test_version(self, client, monkeypatch):
+        monkeypatch.setenv('PROCESSOR_IMAGE', 'track2stem-processor:1.4.0')
+        monkeypatch.delenv('PROCESSOR_VERSION', raising=False)
+        assert json.loads(client.get('/health').data)['version'] == 'track2stem-processor:1.4.0'
+        monkeypatch.setenv('PROCESSOR_VERSION', '1.4.1')
+        assert json.loads(client.get('/health').data)['version'] == '1.4.1'
+
+
+class TestResultNotes:
+    """Notes explaining output that may surprise."""
+
+    def run_returning(self, monkeypatch, **outputs):
+        monkeypatch.setattr(app_module.subprocess, 'run', lambda *a, **kw: MagicMock(**outputs))
+
+    def test_mono_and_resampled_input(self, monkeypatch):
+        self.run_returning(monkeypatch, stdout='{"streams": [{"channels": 1, "sample_rate": "22050"}]}')
+        codes = [n['code'] for n in app_module.input_notes('in.wav')]
+        assert codes == ['mono_upmixed', 'resampled']
+
+    def test_plain_stereo_input(self, monkeypatch):
+        self.run_returning(monkeypatch, stdout='{"streams": [{"channels": 2, "sample_rate": "44100"}]}')
+        assert app_module.input_notes('in.wav') == []
+
+    def test_unreadable_input(self, monkeypatch):
+        self.run_returning(monkeypatch, stdout='')
+        assert app_module.input_notes('in.wav') == []
+
+    def test_stems_at_full_scale(self, monkeypatch):
+        self.run_returning(monkeypatch, stderr='[Parsed_volumedetect_0] max_volume: -0.1 dB')
+        notes = app_module.stem_notes({'vocals': 'v.mp3'}, 'rescale')
+        assert notes[0]['code'] == 'clipping_rescaled' and notes[0]['stem'] == 'vocals'
+        self.run_returning(monkeypatch, stderr='[Parsed_volumedetect_0] max_volume: 0.0 dB')
+        assert app_module.stem_notes({'vocals': 'v.mp3'}, 'clamp')[0]['code'] == 'clipping_clamped'
+        self.run_returning(monkeypatch, stderr='[Parsed_volumedetect_0] max_volume: -3.2 dB')
+        assert app_module.stem_notes({'vocals': 'v.mp3'}, 'rescale') == []
+
+
+class TestEncryptedJobs:
+    """Job keys sealed to the processor, and audio encrypted with them."""
+
+    @pytest.fixture
+    def keys(self, monkeypatch):
+        from cryptography.hazmat.primitives.asymmetric.x25519 import X25519PrivateKey
+        from cryptography.hazmat.primitives import serialization
+        private = X25519PrivateKey.generate()
+        raw = private.private_bytes(serialization.Encoding.Raw, serialization.PrivateFormat.Raw,
+                                    serialization.NoEncryption())
+        monkeypatch.setenv('PROCESSOR_SEALING_KEY', app_module.base64.b64encode(raw).decode())
+        return private.public_key().public_bytes(serialization.Encoding.Raw, serialization.PublicFormat.Raw)
+
+    def seal(self, public, job_key):
+        """Seal a job key the way clients do."""
+        from cryptography.hazmat.primitives.asymmetric.x25519 import X25519PrivateKey, X25519PublicKey
+        from cryptography.hazmat.primitives import hashes, serialization
+        from cryptography.hazmat.primitives.ciphers.aead import AESGCM
+        from cryptography.hazmat.primitives.kdf.hkdf import HKDF
+        ephemeral = X25519PrivateKey.generate()
+        ephemeral_public = ephemeral.public_key().public_bytes(serialization.Encoding.Raw, serialization.PublicFormat.Raw)
+        shared = ephemeral.exchange(X25519PublicKey.from_public_bytes(public))
+        wrapping = HKDF(algorithm=hashes.SHA256(), length=32, salt=ephemeral_public + public,
+                        info=b'track2stem job key').derive(shared)
+        nonce = os.urandom(12)
+        return app_module.base64.b64encode(ephemeral_public + nonce + AESGCM(wrapping).encrypt(nonce, job_key, None)).decode()
+
+    def test_sealed_key_round_trip(self, keys):
+        job_key = os.urandom(32)
+        assert app_module.open_sealed_key(self.seal(keys, job_key)) == job_key
+        with pytest.raises(ValueError):
+            app_module.open_sealed_key(self.seal(os.urandom(32), job_key))
+
+    def test_file_round_trip(self, tmp_path):
+        job_key = os.urandom(32)
+        (tmp_path / 'in.wav').write_bytes(b'RIFF' * 1000)
+        app_module.encrypt_file(job_key, str(tmp_path / 'in.wav'), str(tmp_path / 'in.enc'))
+        assert b'RIFF' not in (tmp_path / 'in.enc').read_bytes()
+        app_module.decrypt_file(job_key, str(tmp_path / 'in.enc'), str(tmp_path / 'out.wav'))
+        assert (tmp_path / 'out.wav').read_bytes() == b'RIFF' * 1000
+        with pytest.raises(ValueError):
+            app_module.decrypt_file(os.urandom(32), str(tmp_path / 'in.enc'), str(tmp_path / 'bad.wav'))
+        assert not (tmp_path / 'bad.wav').exists()
+
+    def test_capability_reported(self, keys, monkeypatch):
+        monkeypatch.setenv('PROCESSOR_DEVICE', 'mps')
+        app.config['TESTING'] = True
+        with app.test_client() as client:
+            assert json.loads(client.get('/health').data)['capabilities'] == ['encrypted']
+
+    def test_refused_without_a_sealing_key(self, monkeypatch):
+        monkeypatch.delenv('PROCESSOR_SEALING_KEY', raising=False)
+        app.config['TESTING'] = True
+        with app.test_client() as client:
+            resp = client.post('/process', data={
+                'job_id': 'enc-1', 'encrypted': 'true', 'sealed_key': 'x',
+                'file': (io.BytesIO(b'ciphertext'), 'song.mp3'),
+            }, content_type='multipart/form-data')
+        assert resp.status_code == 400
+        assert 'not enabled' in json.loads(resp.data)['error']
+
+
+class TestStemGroups:
+    """Preset outputs mixed from the model's stems."""
+
+    def test_parse(self):
+        groups, error = app_module.parse_stem_groups('dialogue=vocals;music=bass+other;effects=drums', 'htdemucs_ft', 'all')
+        assert error is None
+        assert groups == [('dialogue', ['vocals']), ('music', ['bass', 'other']), ('effects', ['drums'])]
+        assert app_module.parse_stem_groups('', 'htdemucs', 'all') == ([], None)
+
+    @pytest.mark.parametrize('raw', [
+        'dialogue=vocals;dialogue=drums',  # output twice
+        'dialogue=vocals;music=vocals',    # source twice
+        'dialogue=guitar',                 # not separated by a 4-stem model
+        'Dialogue=vocals',
+        'dialogue=',
+    ])
+    def test_invalid(self, raw):
+        groups, error = app_module.parse_stem_groups(raw, 'htdemucs', 'all')
+        assert groups is None and error
+
+    def test_collect(self, tmp_path, monkeypatch):
+        demucs_output = tmp_path / 'htdemucs' / 'job-1_film'
+        demucs_output.mkdir(parents=True)
+        for stem in ('vocals', 'drums', 'bass', 'other'):
+            (demucs_output / f'{stem}.wav').write_bytes(b'RIFF')
+        mixed = []
+
+        def mix(stem_files, dst, output_format, mp3_bitrate, normalize):
+            mixed.append((sorted(os.path.basename(f) for f in stem_files), normalize))
+            open(dst, 'wb').close()
+            return True
+        monkeypatch.setattr(app_module, 'mix_stems', mix)
+        options = {
+            'model': 'htdemucs', 'stem_mode': 'all', 'isolate_stem': 'vocals', 'demucs_output_fmt': 'wav',
+            'mp3_bitrate': 320, 'output_format': 'wav', 'demucs_root': str(tmp_path),
+            'stem_groups': [('clean', ['vocals', 'other']), ('noise', ['drums'])],
+        }
+        out = tmp_path / 'out'
+        out.mkdir()
+        files, _ = app_module.collect_stems(options, 'job-1', 'job-1_film.wav', 'film.wav', str(out), lambda *a: None)
+        assert sorted(files) == ['clean', 'noise']
+        assert os.path.basename(files['clean']) == 'film_t2s_clean.wav'
+        assert os.path.basename(files['noise']) == 'film_t2s_noise.wav'
+        assert mixed == [(['other.wav', 'vocals.wav'], False)]
+
+
+class TestWatermarks:
+    """Marks embedded into the stems of watermarked jobs."""
+
+    def test_tone_filter(self):
+        f = app_module.watermark_filter('tone', 'job-1')
+        assert f.startswith("aeval=exprs='val(ch)+") and f.endswith("':c=same")
+        assert 'lt(mod(t,10),0.5)' in f and 'sin(2*PI*1000*t)' in f
+
+    def test_inaudible_filter_encodes_the_job(self):
+        f = app_module.watermark_filter('inaudible', '0123abcd-ef45-6789-0000-000000000000')
+        # sync word, then 0123 abcd ef45 6789 as 16-bit words
+        for word in (0xE9C3, 0x0123, 0xABCD, 0xEF45, 0x6789):
+            assert f',{word},' in f or f',{word})' in f
+        assert "val(ch)+0.00316*" in f.split(';')[-1]
+
+    def test_invalid_watermark(self):
+        app.config['TESTING'] = True
+        with app.test_client() as client:
+            resp = client.post('/process', data={
+                'job_id': 'wm-1', 'watermark': 'visible',
+                'file': (io.BytesIO(b'ID3'), 'song.mp3'),
+            }, content_type='multipart/form-data')
+        assert resp.status_code == 400
+        assert json.loads(resp.data)['allowed_watermarks'] == ['inaudible', 'tone']
+
+    def test_failed_mark_removes_the_stem(self, tmp_path, monkeypatch):
+        stem = tmp_path / 'song_t2s_vocals.mp3'
+        stem.write_bytes(b'ID3')
+        monkeypatch.setattr(app_module.subprocess, 'run', MagicMock(return_value=MagicMock(returncode=1, stderr='boom')))
+        with pytest.raises(RuntimeError):
+            app_module.apply_watermark(str(stem), 'tone', 'job-1', 320)
+        assert not stem.exists()
+
+    def test_batch_refuses_watermarks(self):
+        app.config['TESTING'] = True
+        with app.test_client() as client:
+            resp = client.post('/process/batch', data={
+                'job_id': ['wm-1', 'wm-2'], 'watermark': 'tone',
+                'file': [(io.BytesIO(b'ID3'), 'a.mp3'), (io.BytesIO(b'ID3'), 'b.mp3')],
+            }, content_type='multipart/form-data')
+        assert resp.status_code == 400
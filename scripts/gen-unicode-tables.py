@@ -0,0 +1,31 @@
+#!/usr/bin/env python3
+"""Generates backend/unicodetables.go, the canonical compositions used to
+normalize file names to NFC, from Python's Unicode database.
+
+Run from backend/ with `go generate`.
+"""
+import sys
+import unicodedata
+
+pairs = []
+for cp in range(0x110000):
+    d = unicodedata.decomposition(chr(cp))
+    if not d or d.startswith('<'):
+        continue
+    parts = [int(p, 16) for p in d.split()]
+    if len(parts) != 2 or 0xAC00 <= cp <= 0xD7A3:
+        continue
+    # Composition exclusions decompose but never compose back
+    if unicodedata.normalize('NFC', chr(parts[0]) + chr(parts[1])) != chr(cp):
+        continue
+    pairs.append((parts[0], parts[1], cp))
+
+out = sys.stdout if len(sys.argv) < 2 else open(sys.argv[1], 'w')
+out.write('// Code generated by scripts/gen-unicode-tables.py from Unicode %s; DO NOT EDIT.\n\n' % unicodedata.unidata_version)
+out.write('package main\n\n')
+out.write('// nfcPairs maps a starter and a combining character to their canonical\n')
+out.write('// composition, for every primary composite outside Hangul\n')
+out.write('var nfcPairs = map[[2]rune]rune{\n')
+for a, b, c in pairs:
+    out.write('\t{0x%04X, 0x%04X}: 0x%04X,\n' % (a, b, c))
+out.write('}\n')